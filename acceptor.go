@@ -0,0 +1,70 @@
+package streammux
+
+import "context"
+
+// acceptor takes the streams of a Conn from its muxer in the background,
+// for the wrappers that prepare or queue them before handing them to
+// AcceptStream.
+type acceptor struct {
+	accepted chan Stream
+
+	// done is closed with err set once accepting failed.
+	done chan struct{}
+	err  error
+}
+
+// newAcceptor returns an acceptor queueing up to backlog streams not
+// accepted yet.
+func newAcceptor(backlog int) *acceptor {
+	return &acceptor{
+		accepted: make(chan Stream, backlog),
+		done:     make(chan struct{}),
+	}
+}
+
+// loop accepts the streams of c until that fails, passing each to handle.
+func (a *acceptor) loop(c Conn, handle func(Stream)) {
+	for {
+		s, err := c.AcceptStream()
+		if err != nil {
+			a.err = err
+			close(a.done)
+			return
+		}
+		handle(s)
+	}
+}
+
+// prepareLoop accepts the streams of c and prepares each concurrently, so
+// that a peer slow to send what one needs does not hold up the others. The
+// streams prepare fails for are reset, as are those prepared once
+// accepting failed.
+func (a *acceptor) prepareLoop(c Conn, prepare func(Stream) (Stream, error)) {
+	a.loop(c, func(s Stream) {
+		go func() {
+			ps, err := prepare(s)
+			if err != nil {
+				s.Reset()
+				return
+			}
+			select {
+			case a.accepted <- ps:
+			case <-a.done:
+				ps.Reset()
+			}
+		}()
+	})
+}
+
+// accept returns the next stream handed over, or why accepting failed, or
+// ctx.Err() once ctx is done.
+func (a *acceptor) accept(ctx context.Context) (Stream, error) {
+	select {
+	case s := <-a.accepted:
+		return s, nil
+	case <-a.done:
+		return nil, a.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
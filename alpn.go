@@ -0,0 +1,92 @@
+package streammux
+
+import (
+	"crypto/tls"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// ErrNoALPN is returned by NewConnTLS when the TLS handshake negotiated no
+// application protocol, or one no registered transport has.
+var ErrNoALPN = errors.New("no muxer registered for the negotiated ALPN protocol")
+
+// ALPNTransport is implemented by Transports negotiated over TLS under an
+// application protocol name of their own, such as "h2", rather than their
+// protocol ID.
+type ALPNTransport interface {
+	Transport
+
+	// ALPN returns the transport's TLS application protocol name.
+	ALPN() string
+}
+
+// ALPN returns the TLS application protocol name of tr registered under
+// id: the name it reports if it is an ALPNTransport, and id without its
+// leading "/" otherwise, as in "yamux/1.0.0".
+func ALPN(id string, tr Transport) string {
+	if at, ok := tr.(ALPNTransport); ok {
+		return at.ALPN()
+	}
+	return strings.TrimPrefix(id, "/")
+}
+
+// ALPNProtocols returns the TLS application protocol names of all
+// registered transports, sorted by protocol ID, for the NextProtos of the
+// tls.Configs of both sides.
+func (r *Registry) ALPNProtocols() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ids := make([]string, 0, len(r.transports))
+	for id := range r.transports {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	protos := make([]string, len(ids))
+	for i, id := range ids {
+		protos[i] = ALPN(id, r.transports[id])
+	}
+	return protos
+}
+
+// GetALPN returns the transport whose TLS application protocol name is
+// proto.
+func (r *Registry) GetALPN(proto string) (Transport, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for id, tr := range r.transports {
+		if ALPN(id, tr) == proto {
+			return tr, true
+		}
+	}
+	return nil, false
+}
+
+// NewConnTLS establishes a connection over c with the transport of the
+// application protocol its handshake negotiated, completing the handshake
+// first if need be, so that TLS negotiates the muxer without the round
+// trips of multistream-select. It returns ErrNoALPN if no registered
+// transport has the negotiated protocol.
+func (r *Registry) NewConnTLS(c *tls.Conn, isServer bool) (Conn, error) {
+	if err := c.Handshake(); err != nil {
+		return nil, err
+	}
+	proto := c.ConnectionState().NegotiatedProtocol
+	tr, ok := r.GetALPN(proto)
+	if proto == "" || !ok {
+		return nil, ErrNoALPN
+	}
+	return tr.NewConn(c, isServer)
+}
+
+// ALPNProtocols returns the TLS application protocol names of the
+// transports of the DefaultRegistry.
+func ALPNProtocols() []string {
+	return DefaultRegistry.ALPNProtocols()
+}
+
+// NewConnTLS establishes a connection over c with the transport of the
+// DefaultRegistry its handshake negotiated.
+func NewConnTLS(c *tls.Conn, isServer bool) (Conn, error) {
+	return DefaultRegistry.NewConnTLS(c, isServer)
+}
@@ -0,0 +1,132 @@
+package streammux
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrOpenerClosed is the error of futures still queued when an AsyncOpener
+// is closed.
+var ErrOpenerClosed = errors.New("async opener closed")
+
+// AsyncOpenConn is implemented by Conns that can open streams without
+// blocking the caller. OpenStreamAsync calls done exactly once, when the
+// stream is usable or opening it failed.
+type AsyncOpenConn interface {
+	Conn
+	OpenStreamAsync(done func(Stream, error))
+}
+
+// StreamFuture is the pending result of an asynchronous stream open.
+type StreamFuture struct {
+	done   chan struct{}
+	stream Stream
+	err    error
+}
+
+func newStreamFuture() *StreamFuture {
+	return &StreamFuture{done: make(chan struct{})}
+}
+
+func (f *StreamFuture) resolve(s Stream, err error) {
+	f.stream, f.err = s, err
+	close(f.done)
+}
+
+// Done returns a channel that is closed once the open completed.
+func (f *StreamFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait blocks until the open completed and returns its result.
+func (f *StreamFuture) Wait() (Stream, error) {
+	<-f.done
+	return f.stream, f.err
+}
+
+// AsyncOpener opens streams in the background with a fixed number of
+// worker goroutines, so that hundreds of opens towards many peers can be
+// pending without a goroutine each. Conns implementing AsyncOpenConn are
+// opened natively and do not use the workers.
+type AsyncOpener struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []asyncOpen
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+type asyncOpen struct {
+	conn   Conn
+	future *StreamFuture
+}
+
+// NewAsyncOpener returns an AsyncOpener with the given number of workers,
+// at least one, as opens would never complete without workers.
+func NewAsyncOpener(workers int) *AsyncOpener {
+	if workers < 1 {
+		workers = 1
+	}
+	o := new(AsyncOpener)
+	o.cond = sync.NewCond(&o.mu)
+	o.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go o.worker()
+	}
+	return o
+}
+
+func (o *AsyncOpener) worker() {
+	defer o.wg.Done()
+	for {
+		o.mu.Lock()
+		for len(o.pending) == 0 && !o.closed {
+			o.cond.Wait()
+		}
+		if o.closed {
+			o.mu.Unlock()
+			return
+		}
+		req := o.pending[0]
+		o.pending[0] = asyncOpen{}
+		o.pending = o.pending[1:]
+		o.mu.Unlock()
+
+		req.future.resolve(req.conn.OpenStream())
+	}
+}
+
+// Open starts opening a stream on c and returns immediately.
+func (o *AsyncOpener) Open(c Conn) *StreamFuture {
+	f := newStreamFuture()
+	if ac, ok := c.(AsyncOpenConn); ok {
+		ac.OpenStreamAsync(f.resolve)
+		return f
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		f.resolve(nil, ErrOpenerClosed)
+		return f
+	}
+	o.pending = append(o.pending, asyncOpen{c, f})
+	o.cond.Signal()
+	return f
+}
+
+// Close stops the workers once their current opens complete and fails all
+// opens still queued with ErrOpenerClosed.
+func (o *AsyncOpener) Close() {
+	o.mu.Lock()
+	pending := o.pending
+	o.pending = nil
+	o.closed = true
+	o.cond.Broadcast()
+	o.mu.Unlock()
+
+	for _, req := range pending {
+		req.future.resolve(nil, ErrOpenerClosed)
+	}
+	o.wg.Wait()
+}
@@ -0,0 +1,73 @@
+package streammux
+
+import "context"
+
+// The behaviors of Options.AcceptOverflow, once the streams the peer opened
+// and the application has not accepted fill the accept backlog.
+const (
+	// BlockOverflow stops taking streams from the muxer, which queues
+	// them past its own backlog: the bundled muxers go on reading the
+	// connection, so that the streams already open keep flowing, until
+	// a bounded queue fills, after which they stop reading, holding back
+	// the opens of the peer. No stream is lost.
+	BlockOverflow = "block"
+
+	// ResetOverflow resets the streams past the backlog, which the peer
+	// reads as ErrReset and may retry, leaving the rest of the
+	// connection flowing.
+	ResetOverflow = "reset"
+)
+
+// WithAcceptBacklog wraps c to queue at most backlog streams opened by the
+// peer and not accepted yet, taking them from the muxer as they arrive,
+// and to handle the streams past it as overflow says, BlockOverflow if
+// empty. It enforces Options.AcceptBacklog and Options.AcceptOverflow, the
+// same way for every muxer. With BlockOverflow, the muxer's own backlog
+// queues streams on top of those of c.
+func WithAcceptBacklog(c Conn, backlog int, overflow string) ContextAcceptConn {
+	bc := &backlogConn{
+		Conn:     c,
+		reset:    overflow == ResetOverflow,
+		closed:   CloseChan(c),
+		acceptor: newAcceptor(backlog),
+	}
+	go bc.acceptLoop()
+	return bc
+}
+
+type backlogConn struct {
+	Conn
+	reset    bool
+	closed   <-chan struct{}
+	acceptor *acceptor
+}
+
+func (c *backlogConn) unwrapConn() Conn {
+	return c.Conn
+}
+
+func (c *backlogConn) acceptLoop() {
+	c.acceptor.loop(c.Conn, func(s Stream) {
+		if c.reset {
+			select {
+			case c.acceptor.accepted <- s:
+			default:
+				s.Reset()
+			}
+			return
+		}
+		select {
+		case c.acceptor.accepted <- s:
+		case <-c.closed:
+			s.Reset()
+		}
+	})
+}
+
+func (c *backlogConn) AcceptStream() (Stream, error) {
+	return c.AcceptStreamContext(context.Background())
+}
+
+func (c *backlogConn) AcceptStreamContext(ctx context.Context) (Stream, error) {
+	return c.acceptor.accept(ctx)
+}
@@ -0,0 +1,32 @@
+package streammux
+
+// BatchOpenConn is implemented by Conns that can open many streams at
+// once, e.g. by batching the control frames into a single write.
+type BatchOpenConn interface {
+	Conn
+
+	// OpenStreams opens n streams. It either opens all of them or none.
+	OpenStreams(n int) ([]Stream, error)
+}
+
+// OpenStreams opens n streams on c, natively if c is a BatchOpenConn and
+// one at a time otherwise. If opening any of them fails, the streams
+// already opened are reset and the error is returned.
+func OpenStreams(c Conn, n int) ([]Stream, error) {
+	if bc, ok := c.(BatchOpenConn); ok {
+		return bc.OpenStreams(n)
+	}
+
+	streams := make([]Stream, 0, n)
+	for i := 0; i < n; i++ {
+		s, err := c.OpenStream()
+		if err != nil {
+			for _, s := range streams {
+				s.Reset()
+			}
+			return nil, err
+		}
+		streams = append(streams, s)
+	}
+	return streams, nil
+}
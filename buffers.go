@@ -0,0 +1,48 @@
+package streammux
+
+import "net"
+
+// BuffersWriter is implemented by Streams that can write several slices as
+// a single frame, such as a header followed by a payload.
+type BuffersWriter interface {
+	WriteBuffers(bufs net.Buffers) (int64, error)
+}
+
+// WriteBuffers writes the concatenation of bufs to s, natively if s is a
+// BuffersWriter. Otherwise the slices are coalesced through a pooled
+// buffer into writes of up to CopyBufferSize bytes, so that small slices
+// do not each cost a frame.
+func WriteBuffers(s Stream, bufs net.Buffers) (int64, error) {
+	if bw, ok := s.(BuffersWriter); ok {
+		return bw.WriteBuffers(bufs)
+	}
+
+	pooled := DefaultBufferPool.Get(CopyBufferSize)
+	defer DefaultBufferPool.Put(pooled)
+	buf := pooled[:0]
+
+	var written int64
+	flush := func() error {
+		n, err := s.Write(buf)
+		written += int64(n)
+		buf = buf[:0]
+		return err
+	}
+	for _, b := range bufs {
+		for len(b) > 0 {
+			n := copy(buf[len(buf):cap(buf)], b)
+			buf, b = buf[:len(buf)+n], b[n:]
+			if len(buf) == cap(buf) {
+				if err := flush(); err != nil {
+					return written, err
+				}
+			}
+		}
+	}
+	if len(buf) > 0 {
+		if err := flush(); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
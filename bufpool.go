@@ -0,0 +1,105 @@
+package streammux
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// BufferPool hands out the byte slices muxers and the wrappers of this
+// package read and write frames through, so that they are reused rather
+// than allocated for every frame.
+type BufferPool interface {
+	// Get returns a slice of length n, with undefined contents.
+	Get(n int) []byte
+
+	// Put hands a slice obtained from Get back for reuse. The caller
+	// must not use it afterwards.
+	Put(b []byte)
+}
+
+// The size classes of NewBufferPool, 512 bytes to 1MB.
+const (
+	minBufferClass = 9
+	maxBufferClass = 20
+)
+
+// NewBufferPool returns a BufferPool keeping slices in a sync.Pool per
+// size class, of powers of two from 512 bytes to 1MB, so a slice is at
+// most twice the size asked for. Larger slices are allocated, and dropped
+// when put back.
+func NewBufferPool() BufferPool {
+	return &bufferPool{}
+}
+
+type bufferPool struct {
+	classes [maxBufferClass - minBufferClass + 1]sync.Pool
+}
+
+// bufferClass returns the index of the smallest class holding n bytes, or
+// -1 if none does.
+func bufferClass(n int) int {
+	if n <= 1<<minBufferClass {
+		return 0
+	}
+	c := bits.Len(uint(n-1)) - minBufferClass
+	if c > maxBufferClass-minBufferClass {
+		return -1
+	}
+	return c
+}
+
+func (p *bufferPool) Get(n int) []byte {
+	c := bufferClass(n)
+	if c < 0 {
+		return make([]byte, n)
+	}
+	if bp, ok := p.classes[c].Get().(*[]byte); ok {
+		return (*bp)[:n]
+	}
+	return make([]byte, n, 1<<uint(c+minBufferClass))
+}
+
+func (p *bufferPool) Put(b []byte) {
+	c := bufferClass(cap(b))
+	// slices not from Get, of another capacity, would shrink the class.
+	if c < 0 || cap(b) != 1<<uint(c+minBufferClass) {
+		return
+	}
+	b = b[:0]
+	p.classes[c].Put(&b)
+}
+
+// DefaultBufferPool is the BufferPool of the wrappers of this package, and
+// of the muxers of this repository unless given another.
+var DefaultBufferPool = NewBufferPool()
+
+// NoBufferPool allocates every slice and reuses none, which is the
+// baseline pooling is measured against, and isolates a muxer suspected of
+// using a slice after putting it back.
+var NoBufferPool BufferPool = noBufferPool{}
+
+type noBufferPool struct{}
+
+func (noBufferPool) Get(n int) []byte { return make([]byte, n) }
+func (noBufferPool) Put(b []byte)     {}
+
+// BufferPoolTransport is implemented by Transports whose connections can
+// draw their frame buffers from a BufferPool other than
+// DefaultBufferPool.
+type BufferPoolTransport interface {
+	Transport
+
+	// WithBufferPool returns a copy of the transport whose connections
+	// use p. The receiver is left unchanged.
+	WithBufferPool(p BufferPool) Transport
+}
+
+// WithBufferPool derives a copy of tr whose connections use p, or returns
+// ErrNotSupported if tr is not a BufferPoolTransport.
+func WithBufferPool(tr Transport, p BufferPool) (Transport, error) {
+	bt, ok := tr.(BufferPoolTransport)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return bt.WithBufferPool(p), nil
+}
@@ -0,0 +1,346 @@
+package streammux
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Captures start with captureMagic and a role byte, 'c' for the muxer's
+// client and 's' for its server. Then every read and write is a record: a
+// direction byte ('r' for bytes read from the peer, 'w' for bytes written
+// to it), the time as big endian int64 Unix nanoseconds, a big endian
+// uint32 length and that many bytes of data.
+const captureMagic = "smuxcap\x01"
+
+// ErrBadCapture is returned by ReadCapture when its input is not a capture.
+var ErrBadCapture = errors.New("not a stream muxer capture")
+
+// CaptureTransport wraps tr to record all the bytes each of its
+// connections reads and writes to a new file in dir, named after the
+// number of the connection and its role, such as "3-server.smuxcap".
+// ReadCapture reads the files, and ReplayConn feeds them to a muxer again.
+func CaptureTransport(tr Transport, dir string) Transport {
+	t := &captureTransport{inner: tr, dir: dir}
+	if _, ok := tr.(FeatureTransport); ok {
+		return featureCaptureTransport{t}
+	}
+	return t
+}
+
+type captureTransport struct {
+	inner Transport
+	dir   string
+	conns uint64
+}
+
+// featureCaptureTransport is the captureTransport of a FeatureTransport,
+// which has the same features.
+type featureCaptureTransport struct {
+	*captureTransport
+}
+
+func (t featureCaptureTransport) Features() Features {
+	f, _ := TransportFeatures(t.inner)
+	return f
+}
+
+func (t *captureTransport) create(isServer bool) (*os.File, error) {
+	role := "client"
+	if isServer {
+		role = "server"
+	}
+	name := fmt.Sprintf("%d-%s.smuxcap", atomic.AddUint64(&t.conns, 1), role)
+	return os.Create(filepath.Join(t.dir, name))
+}
+
+func (t *captureTransport) NewConn(c net.Conn, isServer bool) (Conn, error) {
+	f, err := t.create(isServer)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := t.inner.NewConn(&captureConn{c, newCapturer(f, isServer)}, isServer)
+	if err != nil {
+		f.Close()
+	}
+	return conn, err
+}
+
+func (t *captureTransport) NewConnRWC(rwc io.ReadWriteCloser, isServer bool) (Conn, error) {
+	if c, ok := rwc.(net.Conn); ok {
+		return t.NewConn(c, isServer)
+	}
+	f, err := t.create(isServer)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := NewConnRWC(t.inner, &captureRWC{rwc, newCapturer(f, isServer)}, isServer)
+	if err != nil {
+		f.Close()
+	}
+	return conn, err
+}
+
+// CaptureConn returns c recording all the bytes read and written to w, in
+// the format CaptureTransport writes files in. isServer is the role of the
+// muxer using the returned net.Conn. Closing the net.Conn does not close w.
+func CaptureConn(c net.Conn, isServer bool, w io.Writer) net.Conn {
+	return &captureConn{c, newCapturer(nopWriteCloser{w}, isServer)}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// capturer writes the records of a capture, each with a single write so
+// the capture is complete up to the last record if the process dies.
+// Errors writing them are ignored, so a full disk does not break the
+// connection.
+type capturer struct {
+	mu     sync.Mutex
+	f      io.WriteCloser
+	buf    []byte
+	closed bool
+}
+
+func newCapturer(f io.WriteCloser, isServer bool) *capturer {
+	role := "c"
+	if isServer {
+		role = "s"
+	}
+	io.WriteString(f, captureMagic+role)
+	return &capturer{f: f}
+}
+
+func (c *capturer) record(dir byte, b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.buf = append(c.buf[:0], dir)
+	c.buf = append(c.buf, make([]byte, 12)...)
+	binary.BigEndian.PutUint64(c.buf[1:], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint32(c.buf[9:], uint32(len(b)))
+	c.buf = append(c.buf, b...)
+	c.f.Write(c.buf)
+}
+
+func (c *capturer) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.f.Close()
+}
+
+type captureConn struct {
+	net.Conn
+	cap *capturer
+}
+
+func (c *captureConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.cap.record('r', b[:n])
+	return n, err
+}
+
+func (c *captureConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.cap.record('w', b[:n])
+	return n, err
+}
+
+func (c *captureConn) Close() error {
+	err := c.Conn.Close()
+	c.cap.close()
+	return err
+}
+
+type captureRWC struct {
+	io.ReadWriteCloser
+	cap *capturer
+}
+
+func (c *captureRWC) Read(b []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(b)
+	c.cap.record('r', b[:n])
+	return n, err
+}
+
+func (c *captureRWC) Write(b []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(b)
+	c.cap.record('w', b[:n])
+	return n, err
+}
+
+func (c *captureRWC) Close() error {
+	err := c.ReadWriteCloser.Close()
+	c.cap.close()
+	return err
+}
+
+// Capture is a recording of the bytes a muxer read and wrote on a
+// connection.
+type Capture struct {
+	// Server is the role of the muxer which was recorded.
+	Server  bool
+	Records []CaptureRecord
+}
+
+// CaptureRecord is a single read or write.
+type CaptureRecord struct {
+	Time time.Time
+	Sent bool // written to the peer, rather than read from it
+	Data []byte
+}
+
+// ReadCapture reads a capture written by CaptureTransport or CaptureConn.
+// A capture cut short by a crash is returned up to its last whole record,
+// along with io.ErrUnexpectedEOF.
+func ReadCapture(r io.Reader) (*Capture, error) {
+	br := bufio.NewReader(r)
+	var hdr [len(captureMagic) + 1]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil || string(hdr[:len(captureMagic)]) != captureMagic {
+		return nil, ErrBadCapture
+	}
+	role := hdr[len(captureMagic)]
+	if role != 'c' && role != 's' {
+		return nil, ErrBadCapture
+	}
+
+	c := &Capture{Server: role == 's'}
+	for {
+		var rh [13]byte
+		if _, err := io.ReadFull(br, rh[:]); err == io.EOF {
+			return c, nil
+		} else if err != nil {
+			return c, io.ErrUnexpectedEOF
+		}
+		if rh[0] != 'r' && rh[0] != 'w' {
+			return c, ErrBadCapture
+		}
+		data := make([]byte, binary.BigEndian.Uint32(rh[9:]))
+		if _, err := io.ReadFull(br, data); err != nil {
+			return c, io.ErrUnexpectedEOF
+		}
+		c.Records = append(c.Records, CaptureRecord{
+			Time: time.Unix(0, int64(binary.BigEndian.Uint64(rh[1:]))),
+			Sent: rh[0] == 'w',
+			Data: data,
+		})
+	}
+}
+
+// side returns everything sent, or received if sent is false.
+func (c *Capture) side(sent bool) []byte {
+	var b []byte
+	for _, r := range c.Records {
+		if r.Sent == sent {
+			b = append(b, r.Data...)
+		}
+	}
+	return b
+}
+
+// Received returns all the bytes the muxer read, in order.
+func (c *Capture) Received() []byte {
+	return c.side(false)
+}
+
+// Sent returns all the bytes the muxer wrote, in order.
+func (c *Capture) Sent() []byte {
+	return c.side(true)
+}
+
+// ReplayConn is a net.Conn whose reads return the bytes read in a
+// capture, one recorded read at a time, and which keeps what is written
+// to it. A muxer created over it, with the role of the capture, parses the
+// same input as the recorded one, whatever the timing was:
+//
+//	c, err := tr.NewConn(smux.NewReplayConn(capture), capture.Server)
+type ReplayConn struct {
+	// Hold makes reads block once the capture is consumed, until the
+	// ReplayConn is closed, rather than return io.EOF. The muxer is then
+	// left in the state the capture took it to.
+	Hold bool
+
+	mu      sync.Mutex
+	records [][]byte
+	written []byte
+	closed  chan struct{}
+	once    sync.Once
+}
+
+// NewReplayConn returns a ReplayConn replaying the reads of c.
+func NewReplayConn(c *Capture) *ReplayConn {
+	rc := &ReplayConn{closed: make(chan struct{})}
+	for _, r := range c.Records {
+		if !r.Sent {
+			rc.records = append(rc.records, r.Data)
+		}
+	}
+	return rc
+}
+
+func (c *ReplayConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	if len(c.records) == 0 {
+		c.mu.Unlock()
+		if c.Hold {
+			<-c.closed
+		}
+		return 0, io.EOF
+	}
+	n := copy(b, c.records[0])
+	if c.records[0] = c.records[0][n:]; len(c.records[0]) == 0 {
+		c.records = c.records[1:]
+	}
+	c.mu.Unlock()
+	return n, nil
+}
+
+func (c *ReplayConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.written = append(c.written, b...)
+	return len(b), nil
+}
+
+// Written returns everything written so far.
+func (c *ReplayConn) Written() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]byte(nil), c.written...)
+}
+
+func (c *ReplayConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *ReplayConn) LocalAddr() net.Addr                { return muxAddr{} }
+func (c *ReplayConn) RemoteAddr() net.Addr               { return muxAddr{} }
+func (c *ReplayConn) SetDeadline(t time.Time) error      { return nil }
+func (c *ReplayConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *ReplayConn) SetWriteDeadline(t time.Time) error { return nil }
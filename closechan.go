@@ -0,0 +1,33 @@
+package streammux
+
+import "time"
+
+// CloseNotifyConn is implemented by Conns that can notify of their death.
+type CloseNotifyConn interface {
+	Conn
+
+	// CloseChan returns a channel that is closed once the connection is
+	// closed, locally or because the underlying net.Conn died.
+	CloseChan() <-chan struct{}
+}
+
+// closePollInterval is how often CloseChan polls Conns that are not
+// CloseNotifyConns.
+const closePollInterval = 100 * time.Millisecond
+
+// CloseChan returns a channel that is closed once c is closed. For Conns
+// that are not CloseNotifyConns, a goroutine polls IsClosed until then.
+func CloseChan(c Conn) <-chan struct{} {
+	if cn, ok := c.(CloseNotifyConn); ok {
+		return cn.CloseChan()
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for !c.IsClosed() {
+			time.Sleep(closePollInterval)
+		}
+	}()
+	return closed
+}
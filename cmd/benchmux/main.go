@@ -0,0 +1,148 @@
+// Command benchmux compares the muxers of this repository, those of
+// transports.AllTransports carrying several streams per connection, and
+// those registered in the smux.DefaultRegistry. It runs a fixed matrix of
+// workloads against each of them over loopback TCP and prints a table of
+// throughput, stream open latency, allocations and goroutines. -json also writes the results to a
+// file, in the format of the results package, which the test package's
+// -smux.json writes too; -compare prints a table comparing such files
+// instead of running anything:
+//
+//	benchmux -json before.json
+//	benchmux -json after.json
+//	benchmux -compare before.json,after.json
+//
+// -profile writes a CPU and a heap profile of every workload run against
+// every muxer to a directory, named after both, for go tool pprof:
+//
+//	benchmux -muxer http2 -workload bulk -profile prof
+//	go tool pprof prof/http2_bulk.cpu.pprof
+//
+// Both ends of every connection run in the process, so allocations and
+// goroutines are those of the dialing and the listening side together.
+// To compare muxers outside this repository, copy the command and add
+// them to transports.AllTransports, or import their packages, which
+// register themselves.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	smux "github.com/dms3-p2p/go-stream-muxer"
+	"github.com/dms3-p2p/go-stream-muxer/results"
+
+	"github.com/dms3-p2p/go-stream-muxer/transports"
+)
+
+func main() {
+	var (
+		muxers    = flag.String("muxer", "", "comma separated names or protocol IDs of the muxers to run (default: all those of this repository carrying several streams per connection, then all registered)")
+		workloads = flag.String("workload", "", "comma separated names of the workloads to run (default: all)")
+		scale     = flag.Float64("scale", 1, "multiply the size of every workload by this factor")
+		jsonFile  = flag.String("json", "", "write the results as JSON to this file")
+		compare   = flag.String("compare", "", "comma separated JSON results files to print a table comparing, instead of running the workloads")
+		profile   = flag.String("profile", "", "write a CPU and a heap profile of every workload run against every muxer to this directory, created if need be")
+	)
+	flag.Parse()
+
+	var err error
+	if *compare != "" {
+		err = compareFiles(strings.Split(*compare, ","))
+	} else {
+		err = run(*muxers, *workloads, *scale, *jsonFile, *profile)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(muxers, workloads string, scale float64, jsonFile, profileDir string) error {
+	ids := transports.Multiplexing()
+	listed := make(map[string]bool)
+	for _, name := range ids {
+		listed[smux.ProtocolID(transports.AllTransports[name])] = true
+	}
+	for _, id := range smux.DefaultRegistry.IDs() {
+		if !listed[id] {
+			ids = append(ids, id)
+		}
+	}
+	if muxers != "" {
+		ids = strings.Split(muxers, ",")
+	}
+	var trs []smux.Transport
+	for _, id := range ids {
+		tr, ok := transports.AllTransports[id]
+		if !ok {
+			tr, ok = smux.Get(id)
+		}
+		if !ok {
+			return fmt.Errorf("unknown muxer %q, available: %v and %v", id, transports.Names(), smux.DefaultRegistry.IDs())
+		}
+		trs = append(trs, tr)
+	}
+
+	ws := Workloads
+	if workloads != "" {
+		ws = nil
+		for _, name := range strings.Split(workloads, ",") {
+			w, ok := findWorkload(name)
+			if !ok {
+				return fmt.Errorf("unknown workload %q", name)
+			}
+			ws = append(ws, w)
+		}
+	}
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(out, "muxer\tworkload\ttime\tthroughput\topen latency\tallocs\tgoroutines\t")
+	failed := 0
+	var rs []results.Result
+	for i, tr := range trs {
+		for _, w := range ws {
+			res, err := measure(tr, ids[i], w, scale, profileDir)
+			rs = append(rs, res.record(ids[i], w.Name, err))
+			if err != nil {
+				failed++
+				fmt.Fprintf(out, "%s\t%s\tFAIL: %s\t\t\t\t\t\n", ids[i], w.Name, err)
+				continue
+			}
+			fmt.Fprintf(out, "%s\t%s\t%s\n", ids[i], w.Name, res)
+		}
+	}
+	out.Flush()
+
+	if jsonFile != "" {
+		if err := results.WriteFile(jsonFile, rs); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d runs failed", failed)
+	}
+	return nil
+}
+
+// compareFiles prints a table of the results in the files paths, with the
+// columns of each file named after it if there are several.
+func compareFiles(paths []string) error {
+	var all []results.Result
+	for _, path := range paths {
+		rs, err := results.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		for _, r := range rs {
+			if len(paths) > 1 {
+				r.Transport = strings.TrimSuffix(filepath.Base(path), ".json") + ":" + r.Transport
+			}
+			all = append(all, r)
+		}
+	}
+	return results.Table(os.Stdout, all)
+}
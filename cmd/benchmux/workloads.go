@@ -0,0 +1,334 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"sync"
+	"time"
+
+	smux "github.com/dms3-p2p/go-stream-muxer"
+	"github.com/dms3-p2p/go-stream-muxer/results"
+)
+
+// Workload is a benchmark run over a muxed connection whose peer echoes
+// every stream. Run returns the number of bytes sent and the open latency
+// of each stream it timed, if any.
+type Workload struct {
+	Name string
+	Run  func(c smux.Conn, scale float64) (int64, []time.Duration, error)
+}
+
+// Workloads are the workloads run by default, in order.
+var Workloads = []Workload{
+	{"bulk", runBulk},
+	{"streams", runStreams},
+	{"tiny", runTiny},
+}
+
+func findWorkload(name string) (Workload, bool) {
+	for _, w := range Workloads {
+		if w.Name == name {
+			return w, true
+		}
+	}
+	return Workload{}, false
+}
+
+func scaled(n int, scale float64) int {
+	if m := int(float64(n) * scale); m > 0 {
+		return m
+	}
+	return 1
+}
+
+// result is the outcome of a run, formatted as a row of the table.
+type result struct {
+	elapsed    time.Duration
+	bytes      int64
+	latency    time.Duration // mean open latency, if timed
+	allocs     uint64
+	goroutines int // peak above the baseline
+}
+
+// throughput returns the throughput of r in MB/s, of 10^6 bytes as go test
+// reports them.
+func (r result) throughput() float64 {
+	return float64(r.bytes) / r.elapsed.Seconds() / 1e6
+}
+
+func (r result) String() string {
+	throughput := fmt.Sprintf("%.1f MB/s", r.throughput())
+	latency := "-"
+	if r.latency > 0 {
+		latency = r.latency.String()
+	}
+	return fmt.Sprintf("%s\t%s\t%s\t%d\t%d\t", r.elapsed.Round(time.Millisecond), throughput, latency, r.allocs, r.goroutines)
+}
+
+// record returns r, of the workload name run against the muxer id, in the
+// format of the results package, which -json writes.
+func (r result) record(id, name string, err error) results.Result {
+	res := results.Result{
+		Transport: id,
+		Name:      name,
+		Status:    results.Pass,
+		Duration:  r.elapsed,
+	}
+	if err != nil {
+		res.Status = results.Fail
+		res.Error = err.Error()
+		return res
+	}
+	res.Metrics = map[string]float64{
+		results.MBPerSec:   r.throughput(),
+		results.Allocs:     float64(r.allocs),
+		results.Goroutines: float64(r.goroutines),
+	}
+	if r.latency > 0 {
+		res.Metrics["open-latency-ns"] = float64(r.latency.Nanoseconds())
+	}
+	return res
+}
+
+// measure runs w over a fresh loopback connection muxed with tr, the
+// muxer id, profiling the run into profileDir if not empty.
+func measure(tr smux.Transport, id string, w Workload, scale float64, profileDir string) (result, error) {
+	a, b, err := tcpPipe()
+	if err != nil {
+		return result{}, err
+	}
+	// the listening side is established concurrently, for transports
+	// which handshake in NewConn.
+	type established struct {
+		c   smux.Conn
+		err error
+	}
+	listened := make(chan established, 1)
+	go func() {
+		c, err := tr.NewConn(b, true)
+		listened <- established{c, err}
+	}()
+	ca, err := tr.NewConn(a, false)
+	if err != nil {
+		a.Close()
+		b.Close()
+		if l := <-listened; l.err == nil {
+			l.c.Close()
+		}
+		return result{}, err
+	}
+	defer ca.Close()
+	l := <-listened
+	if l.err != nil {
+		b.Close()
+		return result{}, l.err
+	}
+	cb := l.c
+	defer cb.Close()
+	go serveEcho(cb)
+
+	runtime.GC()
+	base := runtime.NumGoroutine()
+	stop := make(chan struct{})
+	peak := make(chan int)
+	go func() {
+		max := 0
+		t := time.NewTicker(time.Millisecond)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				// the sampler itself is not counted.
+				if n := runtime.NumGoroutine() - base - 1; n > max {
+					max = n
+				}
+			case <-stop:
+				peak <- max
+				return
+			}
+		}
+	}()
+
+	var stopProfiles func() error
+	if profileDir != "" {
+		if stopProfiles, err = results.StartProfiles(profileDir, id+"/"+w.Name); err != nil {
+			close(stop)
+			<-peak
+			return result{}, err
+		}
+	}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	n, latencies, err := w.Run(ca, scale)
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+	close(stop)
+	if stopProfiles != nil {
+		// the heap profile is taken with the connection still open.
+		if perr := stopProfiles(); perr != nil && err == nil {
+			err = perr
+		}
+	}
+	res := result{
+		elapsed:    elapsed,
+		bytes:      n,
+		allocs:     after.Mallocs - before.Mallocs,
+		goroutines: <-peak,
+	}
+	if err != nil {
+		return res, err
+	}
+	if len(latencies) > 0 {
+		var sum time.Duration
+		for _, d := range latencies {
+			sum += d
+		}
+		res.latency = sum / time.Duration(len(latencies))
+	}
+	return res, nil
+}
+
+func tcpPipe() (net.Conn, net.Conn, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		accepted <- c
+	}()
+	a, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		return nil, nil, err
+	}
+	b := <-accepted
+	if b == nil {
+		a.Close()
+		return nil, nil, fmt.Errorf("accept failed")
+	}
+	return a, b, nil
+}
+
+func serveEcho(c smux.Conn) {
+	for {
+		s, err := c.AcceptStream()
+		if err != nil {
+			return
+		}
+		go func() {
+			io.Copy(s, s)
+			s.Close()
+		}()
+	}
+}
+
+// echo writes msg count times to s and closes it, and reads the echo back
+// until EOF.
+func echo(s smux.Stream, msg []byte, count int) error {
+	werr := make(chan error, 1)
+	go func() {
+		for i := 0; i < count; i++ {
+			if _, err := s.Write(msg); err != nil {
+				werr <- err
+				return
+			}
+		}
+		werr <- s.Close()
+	}()
+	n, err := io.Copy(ioutil.Discard, s)
+	if err == nil {
+		err = <-werr
+	}
+	if err == nil && n != int64(len(msg)*count) {
+		err = fmt.Errorf("echoed %d bytes of %d", n, len(msg)*count)
+	}
+	return err
+}
+
+// runBulk sends 64MB over a single stream in 64KB writes.
+func runBulk(c smux.Conn, scale float64) (int64, []time.Duration, error) {
+	msg := make([]byte, 64<<10)
+	count := scaled(1024, scale)
+	s, err := c.OpenStream()
+	if err != nil {
+		return 0, nil, err
+	}
+	return int64(len(msg) * count), nil, echo(s, msg, count)
+}
+
+// runStreams opens 1000 streams, 100 at a time, and sends 1KB on each. The
+// open latency is the time from OpenStream to the first echoed byte.
+func runStreams(c smux.Conn, scale float64) (int64, []time.Duration, error) {
+	const concurrency = 100
+	msg := make([]byte, 1<<10)
+	streams := scaled(1000, scale)
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		latencies []time.Duration
+		firstErr  error
+	)
+	sem := make(chan struct{}, concurrency)
+	for i := 0; i < streams; i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			latency, err := openAndEcho(c, msg)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+			latencies = append(latencies, latency)
+		}()
+	}
+	wg.Wait()
+	return int64(len(msg) * streams), latencies, firstErr
+}
+
+func openAndEcho(c smux.Conn, msg []byte) (time.Duration, error) {
+	start := time.Now()
+	s, err := c.OpenStream()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := s.Write(msg); err != nil {
+		s.Reset()
+		return 0, err
+	}
+	if err := s.Close(); err != nil {
+		s.Reset()
+		return 0, err
+	}
+	var first [1]byte
+	if _, err := io.ReadFull(s, first[:]); err != nil {
+		s.Reset()
+		return 0, err
+	}
+	latency := time.Since(start)
+	n, err := io.Copy(ioutil.Discard, s)
+	if err == nil && n+1 != int64(len(msg)) {
+		err = fmt.Errorf("echoed %d bytes of %d", n+1, len(msg))
+	}
+	return latency, err
+}
+
+// runTiny sends 100000 messages of 16 bytes over a single stream.
+func runTiny(c smux.Conn, scale float64) (int64, []time.Duration, error) {
+	msg := make([]byte, 16)
+	count := scaled(100000, scale)
+	s, err := c.OpenStream()
+	if err != nil {
+		return 0, nil, err
+	}
+	return int64(len(msg) * count), nil, echo(s, msg, count)
+}
@@ -0,0 +1,198 @@
+// Command muxcat is netcat over a stream muxer: it listens or dials, sets
+// up the muxer given with -muxer over the connection, and bridges its
+// stdin and stdout to streams, to test interop with other implementations
+// by hand and to debug deployments:
+//
+//	muxcat -listen :4001
+//	muxcat -dial host:4001 -streams 4 < request
+//
+// -muxer is a name of transports.AllTransports or a protocol ID registered
+// in the smux.DefaultRegistry, and defaults to multistream, which
+// negotiates http2 or websocket with multistream-select as libp2p does.
+// memconn is not available, as it only connects the two ends of a
+// connection within a process.
+//
+// The dialing side opens -streams streams and the listening side accepts
+// as many, on the first connection it accepts. Once they are all open,
+// stdin is written to every one of them, which are closed for writing at
+// its end, and what each of them reads is written to stdout, a read at a
+// time. muxcat exits once stdin ended and the peer closed every stream,
+// or when one is reset.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	smux "github.com/dms3-p2p/go-stream-muxer"
+
+	"github.com/dms3-p2p/go-stream-muxer/transports"
+)
+
+// closeTimeout is how long closing the connection waits for the data
+// written to the streams to be sent.
+const closeTimeout = 5 * time.Second
+
+func main() {
+	var (
+		muxer   = flag.String("muxer", "multistream", "name or protocol ID of the muxer to use")
+		listen  = flag.String("listen", "", "listen on this TCP address and use the first accepted connection")
+		dial    = flag.String("dial", "", "dial this TCP address")
+		streams = flag.Int("streams", 1, "number of streams to open, or accept, in parallel")
+	)
+	flag.Parse()
+
+	if err := run(*muxer, *listen, *dial, *streams); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func getTransport(muxer string) (smux.Transport, error) {
+	if muxer == "memconn" {
+		return nil, fmt.Errorf("memconn only connects connections within a process")
+	}
+	tr, ok := transports.AllTransports[muxer]
+	if !ok {
+		tr, ok = smux.Get(muxer)
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown muxer %q, available: %v and %v", muxer, transports.Names(), smux.DefaultRegistry.IDs())
+	}
+	return tr, nil
+}
+
+func run(muxer, listen, dial string, n int) error {
+	tr, err := getTransport(muxer)
+	if err != nil {
+		return err
+	}
+	if n < 1 {
+		return fmt.Errorf("-streams must be at least 1, not %d", n)
+	}
+
+	var (
+		nc       net.Conn
+		isServer bool
+	)
+	switch {
+	case listen != "" && dial == "":
+		var l net.Listener
+		l, err = net.Listen("tcp", listen)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "listening on %s\n", l.Addr())
+		nc, err = l.Accept()
+		l.Close()
+		isServer = true
+	case dial != "" && listen == "":
+		nc, err = net.Dial("tcp", dial)
+	default:
+		return fmt.Errorf("exactly one of -listen and -dial must be given")
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "connected to %s\n", nc.RemoteAddr())
+
+	c, err := tr.NewConn(nc, isServer)
+	if err != nil {
+		nc.Close()
+		return err
+	}
+	defer smux.CloseTimeout(c, closeTimeout)
+
+	return bridge(c, isServer, n, os.Stdin, os.Stdout)
+}
+
+// bridge opens, or accepts, n streams on c, copies each of them to out as
+// soon as it is open, and in to all of them once they all are. It returns
+// once in and every stream reached EOF, or with the first error.
+func bridge(c smux.Conn, isServer bool, n int, in io.Reader, out io.Writer) error {
+	var (
+		wg      sync.WaitGroup
+		errOnce sync.Once
+		err     error
+		failed  = make(chan struct{})
+	)
+	fail := func(e error) {
+		errOnce.Do(func() {
+			err = e
+			close(failed)
+		})
+	}
+
+	w := &lockedWriter{w: out}
+	streams := make([]smux.Stream, 0, n)
+	writers := make([]io.Writer, 0, n)
+	for i := 0; i < n; i++ {
+		var (
+			s    smux.Stream
+			oerr error
+		)
+		if isServer {
+			s, oerr = c.AcceptStream()
+		} else {
+			s, oerr = c.OpenStream()
+		}
+		if oerr != nil {
+			return oerr
+		}
+		streams = append(streams, s)
+		writers = append(writers, s)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := io.Copy(w, s); err != nil {
+				fail(err)
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if _, err := io.Copy(io.MultiWriter(writers...), in); err != nil {
+			fail(err)
+			return
+		}
+		for _, s := range streams {
+			if err := s.Close(); err != nil {
+				fail(err)
+				return
+			}
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-failed:
+		return err
+	}
+}
+
+// lockedWriter writes every buffer whole, so that reads of several streams
+// are not interleaved within one another.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (w *lockedWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(b)
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	smux "github.com/dms3-p2p/go-stream-muxer"
+	"github.com/dms3-p2p/go-stream-muxer/results"
+)
+
+const (
+	// defaultSize is the size of the messages of upload and download
+	// streams, unless -size says otherwise.
+	defaultSize = 128 << 10
+	// pingSize is the size of the messages of the stream measuring round
+	// trips next to those, and of latency streams unless -size says
+	// otherwise.
+	pingSize = 64
+	// pingInterval is how often the stream measuring round trips next to
+	// upload and download streams pings.
+	pingInterval = 10 * time.Millisecond
+)
+
+// config is the workload run by the client.
+type config struct {
+	mode     string
+	streams  int
+	size     int
+	duration time.Duration
+	interval time.Duration
+}
+
+// check validates cfg, and sets the default message size of its mode.
+func (cfg *config) check() error {
+	switch cfg.mode {
+	case "upload", "download":
+		if cfg.size == 0 {
+			cfg.size = defaultSize
+		}
+	case "latency":
+		if cfg.size == 0 {
+			cfg.size = pingSize
+		}
+	default:
+		return fmt.Errorf("unknown mode %q, available: upload, download and latency", cfg.mode)
+	}
+	if cfg.streams < 1 {
+		return fmt.Errorf("-streams must be at least 1, not %d", cfg.streams)
+	}
+	if cfg.size < 1 {
+		return fmt.Errorf("-size must be at least 1, not %d", cfg.size)
+	}
+	if cfg.duration <= 0 {
+		return fmt.Errorf("-duration must be positive, not %s", cfg.duration)
+	}
+	return nil
+}
+
+// report is the outcome of a workload.
+type report struct {
+	elapsed time.Duration
+	bytes   int64
+	rtts    []time.Duration // sorted
+
+	cpu           time.Duration
+	serverCPU     time.Duration
+	serverElapsed time.Duration
+}
+
+func (r report) throughput() float64 {
+	return float64(r.bytes) / r.elapsed.Seconds() / 1e6
+}
+
+func (r report) clientCPU() float64 {
+	return 100 * r.cpu.Seconds() / r.elapsed.Seconds()
+}
+
+func (r report) serverCPUPercent() float64 {
+	if r.serverElapsed <= 0 {
+		return 0
+	}
+	return 100 * r.serverCPU.Seconds() / r.serverElapsed.Seconds()
+}
+
+func (r report) print(w io.Writer) {
+	fmt.Fprintf(w, "throughput  %.1f MB/s, %d bytes in %s\n", r.throughput(), r.bytes, r.elapsed.Round(time.Millisecond))
+	if len(r.rtts) > 0 {
+		fmt.Fprintf(w, "round trip  p50 %s, p95 %s, p99 %s, max %s, of %d\n",
+			percentile(r.rtts, 0.50), percentile(r.rtts, 0.95), percentile(r.rtts, 0.99), r.rtts[len(r.rtts)-1], len(r.rtts))
+	}
+	fmt.Fprintf(w, "cpu         client %.0f%%, server %.0f%% of a core\n", r.clientCPU(), r.serverCPUPercent())
+}
+
+// record returns r, of the workload mode run with the muxer, in the format
+// of the results package, which -json writes.
+func (r report) record(muxer, mode string) results.Result {
+	res := results.Result{
+		Transport: muxer,
+		Name:      mode,
+		Status:    results.Pass,
+		Duration:  r.elapsed,
+		Metrics: map[string]float64{
+			results.MBPerSec: r.throughput(),
+			"client-cpu-%":   r.clientCPU(),
+			"server-cpu-%":   r.serverCPUPercent(),
+		},
+	}
+	if len(r.rtts) > 0 {
+		res.Metrics["p50-ns"] = float64(percentile(r.rtts, 0.50).Nanoseconds())
+		res.Metrics["p95-ns"] = float64(percentile(r.rtts, 0.95).Nanoseconds())
+		res.Metrics["p99-ns"] = float64(percentile(r.rtts, 0.99).Nanoseconds())
+	}
+	return res
+}
+
+// percentile returns the p-th percentile of sorted, by the nearest-rank
+// method.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted))*p+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// run runs the workload cfg on c, printing the throughput of every
+// interval to out.
+func run(c smux.Conn, cfg config, out io.Writer) (report, error) {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		rep      report
+		firstErr error
+		moved    int64 // atomically, for the intervals
+	)
+	done := func(n int64, rtts []time.Duration, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		rep.bytes += n
+		rep.rtts = append(rep.rtts, rtts...)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	start, startCPU := time.Now(), cpuTime()
+	end := start.Add(cfg.duration)
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		reportIntervals(out, cfg.interval, start, &moved, stop)
+	}()
+
+	for i := 0; i < cfg.streams; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			switch cfg.mode {
+			case "upload":
+				n, err := upload(c, cfg.size, end, &moved)
+				done(n, nil, err)
+			case "download":
+				n, err := download(c, cfg.size, cfg.duration, &moved)
+				done(n, nil, err)
+			case "latency":
+				rtts, err := ping(c, cfg.size, end, 0, &moved)
+				done(int64(len(rtts)*cfg.size), rtts, err)
+			}
+		}()
+	}
+	if cfg.mode != "latency" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var ignored int64
+			rtts, err := ping(c, pingSize, end, pingInterval, &ignored)
+			done(0, rtts, err)
+		}()
+	}
+	wg.Wait()
+	rep.elapsed = time.Since(start)
+	rep.cpu = cpuTime() - startCPU
+	close(stop)
+	<-stopped
+	if firstErr != nil {
+		return rep, firstErr
+	}
+	sort.Slice(rep.rtts, func(i, j int) bool { return rep.rtts[i] < rep.rtts[j] })
+
+	var err error
+	rep.serverCPU, rep.serverElapsed, err = serverStats(c)
+	return rep, err
+}
+
+// reportIntervals prints the throughput of the bytes added to moved over
+// every interval, until stop is closed.
+func reportIntervals(out io.Writer, interval time.Duration, start time.Time, moved *int64, stop <-chan struct{}) {
+	if interval <= 0 {
+		<-stop
+		return
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	var last int64
+	from := time.Duration(0)
+	for {
+		select {
+		case now := <-t.C:
+			n := atomic.LoadInt64(moved)
+			to := now.Sub(start)
+			fmt.Fprintf(out, "%6.1fs-%6.1fs  %8.1f MB/s\n", from.Seconds(), to.Seconds(), float64(n-last)/(to-from).Seconds()/1e6)
+			last, from = n, to
+		case <-stop:
+			return
+		}
+	}
+}
+
+// upload writes messages of size bytes until end, and returns the number
+// of bytes the server read.
+func upload(c smux.Conn, size int, end time.Time, moved *int64) (int64, error) {
+	s, err := c.OpenStream()
+	if err != nil {
+		return 0, err
+	}
+	if err := writeHeader(s, modeUpload, size, 0); err != nil {
+		s.Reset()
+		return 0, err
+	}
+	msg := make([]byte, size)
+	for time.Now().Before(end) {
+		n, err := s.Write(msg)
+		atomic.AddInt64(moved, int64(n))
+		if err != nil {
+			s.Reset()
+			return 0, err
+		}
+	}
+	if err := s.Close(); err != nil {
+		s.Reset()
+		return 0, err
+	}
+	var b [8]byte
+	if _, err := io.ReadFull(s, b[:]); err != nil {
+		s.Reset()
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(b[:])), nil
+}
+
+// download has the server write messages of size bytes for d, and returns
+// the number of bytes read.
+func download(c smux.Conn, size int, d time.Duration, moved *int64) (int64, error) {
+	s, err := c.OpenStream()
+	if err != nil {
+		return 0, err
+	}
+	if err := writeHeader(s, modeDownload, size, d); err != nil {
+		s.Reset()
+		return 0, err
+	}
+	if err := s.Close(); err != nil {
+		s.Reset()
+		return 0, err
+	}
+	n, err := io.Copy(ioutil.Discard, &countingReader{r: s, n: moved})
+	if err != nil {
+		s.Reset()
+	}
+	return n, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	atomic.AddInt64(r.n, int64(n))
+	return n, err
+}
+
+// ping sends messages of size bytes and reads their echoes until end,
+// every interval or back to back, and returns their round trip times.
+func ping(c smux.Conn, size int, end time.Time, interval time.Duration, moved *int64) ([]time.Duration, error) {
+	s, err := c.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeHeader(s, modePing, size, 0); err != nil {
+		s.Reset()
+		return nil, err
+	}
+	var rtts []time.Duration
+	msg, buf := make([]byte, size), make([]byte, size)
+	for time.Now().Before(end) {
+		sent := time.Now()
+		if _, err := s.Write(msg); err != nil {
+			s.Reset()
+			return rtts, err
+		}
+		if _, err := io.ReadFull(s, buf); err != nil {
+			s.Reset()
+			return rtts, err
+		}
+		rtt := time.Since(sent)
+		rtts = append(rtts, rtt)
+		atomic.AddInt64(moved, int64(size))
+		if interval > rtt {
+			time.Sleep(interval - rtt)
+		}
+	}
+	if err := s.Close(); err != nil {
+		s.Reset()
+		return rtts, err
+	}
+	if _, err := io.Copy(ioutil.Discard, s); err != nil {
+		s.Reset()
+		return rtts, err
+	}
+	return rtts, nil
+}
+
+// serverStats returns the CPU time the server used since the connection
+// was established, and the time since.
+func serverStats(c smux.Conn) (cpu, elapsed time.Duration, err error) {
+	s, err := c.OpenStream()
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := writeHeader(s, modeStats, 0, 0); err != nil {
+		s.Reset()
+		return 0, 0, err
+	}
+	if err := s.Close(); err != nil {
+		s.Reset()
+		return 0, 0, err
+	}
+	var b [16]byte
+	if _, err := io.ReadFull(s, b[:]); err != nil {
+		s.Reset()
+		return 0, 0, err
+	}
+	return time.Duration(binary.BigEndian.Uint64(b[:])), time.Duration(binary.BigEndian.Uint64(b[8:])), nil
+}
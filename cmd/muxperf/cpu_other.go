@@ -0,0 +1,12 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package main
+
+import "time"
+
+// cpuTime returns zero, as the CPU time of the process is only measured
+// on unix systems.
+func cpuTime() time.Duration {
+	return 0
+}
@@ -0,0 +1,118 @@
+// Command muxperf measures the performance of a muxer between two
+// machines, as iperf does for TCP: loopback benchmarks, such as those of
+// cmd/benchmux, hide the flow control behavior only real round trip times
+// bring out. One side serves, and the other runs a workload against it
+// and reports the throughput, the round trip latency percentiles and the
+// CPU usage of both sides:
+//
+//	muxperf -listen :5201
+//	muxperf -dial host:5201 -streams 8 -duration 30s
+//
+// -mode upload, the default, has the client write -size messages on
+// -streams streams for -duration, and download has the server write them.
+// Both measure round trips on an additional stream meanwhile, pinging
+// every 10ms, which shows how much the bulk streams delay the others.
+// latency has every stream ping back and forth instead, as fast as the
+// round trips go. -json writes the measurements to a file in the format of
+// the results package, which cmd/benchmux -compare prints tables of.
+//
+// -muxer is a name of transports.AllTransports or a protocol ID registered
+// in the smux.DefaultRegistry, and must be the same on both sides. The
+// server serves every connection it accepts, until interrupted.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	smux "github.com/dms3-p2p/go-stream-muxer"
+	"github.com/dms3-p2p/go-stream-muxer/results"
+
+	"github.com/dms3-p2p/go-stream-muxer/transports"
+)
+
+func main() {
+	var (
+		muxer    = flag.String("muxer", "http2", "name or protocol ID of the muxer to use")
+		listen   = flag.String("listen", "", "serve on this TCP address")
+		dial     = flag.String("dial", "", "run the workload against the server at this TCP address")
+		mode     = flag.String("mode", "upload", "workload to run: upload, download or latency")
+		streams  = flag.Int("streams", 1, "number of streams to run the workload on in parallel")
+		size     = flag.Int("size", 0, "size of the messages (default: 128KB, or 64 bytes in latency mode)")
+		duration = flag.Duration("duration", 10*time.Second, "how long to run the workload for")
+		interval = flag.Duration("interval", time.Second, "report the throughput every interval, if not zero")
+		jsonFile = flag.String("json", "", "write the results as JSON to this file")
+	)
+	flag.Parse()
+
+	var err error
+	switch {
+	case *listen != "" && *dial == "":
+		err = serve(*muxer, *listen)
+	case *dial != "" && *listen == "":
+		cfg := config{
+			mode:     *mode,
+			streams:  *streams,
+			size:     *size,
+			duration: *duration,
+			interval: *interval,
+		}
+		err = runClient(*muxer, *dial, cfg, *jsonFile)
+	default:
+		err = fmt.Errorf("exactly one of -listen and -dial must be given")
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func getTransport(muxer string) (smux.Transport, error) {
+	if muxer == "memconn" {
+		return nil, fmt.Errorf("memconn only connects connections within a process")
+	}
+	tr, ok := transports.AllTransports[muxer]
+	if !ok {
+		tr, ok = smux.Get(muxer)
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown muxer %q, available: %v and %v", muxer, transports.Names(), smux.DefaultRegistry.IDs())
+	}
+	return tr, nil
+}
+
+func runClient(muxer, addr string, cfg config, jsonFile string) error {
+	tr, err := getTransport(muxer)
+	if err != nil {
+		return err
+	}
+	if err := cfg.check(); err != nil {
+		return err
+	}
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	c, err := tr.NewConn(nc, false)
+	if err != nil {
+		nc.Close()
+		return err
+	}
+	defer c.Close()
+
+	fmt.Printf("%s over %s to %s, %d streams of %d byte messages, for %s\n",
+		cfg.mode, muxer, nc.RemoteAddr(), cfg.streams, cfg.size, cfg.duration)
+	rep, err := run(c, cfg, os.Stdout)
+	if err != nil {
+		return err
+	}
+	rep.print(os.Stdout)
+
+	if jsonFile != "" {
+		return results.WriteFile(jsonFile, []results.Result{rep.record(muxer, cfg.mode)})
+	}
+	return nil
+}
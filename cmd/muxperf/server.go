@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"time"
+
+	smux "github.com/dms3-p2p/go-stream-muxer"
+)
+
+// Every stream starts with a header of its mode, the size of its messages
+// and its duration in milliseconds, as big endian uint32s.
+const headerSize = 9
+
+// The modes of streams.
+const (
+	// modeUpload streams are discarded by the server, which then writes
+	// back the number of bytes read, as a uint64, and closes them.
+	modeUpload = 'u'
+	// modeDownload streams are written by the server, with messages of
+	// their size, for their duration, and then closed.
+	modeDownload = 'd'
+	// modePing streams are echoed.
+	modePing = 'p'
+	// modeStats streams get the CPU time the server used since the
+	// connection was established, and the time since, in nanoseconds as
+	// uint64s.
+	modeStats = 's'
+)
+
+func writeHeader(w io.Writer, mode byte, size int, d time.Duration) error {
+	var h [headerSize]byte
+	h[0] = mode
+	binary.BigEndian.PutUint32(h[1:], uint32(size))
+	binary.BigEndian.PutUint32(h[5:], uint32(d/time.Millisecond))
+	_, err := w.Write(h[:])
+	return err
+}
+
+func readHeader(r io.Reader) (mode byte, size int, d time.Duration, err error) {
+	var h [headerSize]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return 0, 0, 0, err
+	}
+	size = int(binary.BigEndian.Uint32(h[1:]))
+	d = time.Duration(binary.BigEndian.Uint32(h[5:])) * time.Millisecond
+	return h[0], size, d, nil
+}
+
+func serve(muxer, addr string) error {
+	tr, err := getTransport(muxer)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	fmt.Fprintf(os.Stderr, "serving %s on %s\n", muxer, l.Addr())
+
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			err := serveConn(tr, nc)
+			if err == smux.ErrConnClosed || err == io.EOF {
+				fmt.Fprintf(os.Stderr, "%s: disconnected\n", nc.RemoteAddr())
+				return
+			}
+			fmt.Fprintf(os.Stderr, "%s: %v\n", nc.RemoteAddr(), err)
+		}()
+	}
+}
+
+// serveConn serves the streams of the connection established over nc until
+// it is closed.
+func serveConn(tr smux.Transport, nc net.Conn) error {
+	start, startCPU := time.Now(), cpuTime()
+	c, err := tr.NewConn(nc, true)
+	if err != nil {
+		nc.Close()
+		return err
+	}
+	defer c.Close()
+	fmt.Fprintf(os.Stderr, "%s: connected\n", nc.RemoteAddr())
+
+	return smux.Serve(c, func(s smux.Stream) {
+		if err := serveStream(s, start, startCPU); err != nil {
+			s.Reset()
+		}
+	})
+}
+
+func serveStream(s smux.Stream, start time.Time, startCPU time.Duration) error {
+	mode, size, d, err := readHeader(s)
+	if err != nil {
+		return err
+	}
+	switch mode {
+	case modeUpload:
+		n, err := io.Copy(ioutil.Discard, s)
+		if err != nil {
+			return err
+		}
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], uint64(n))
+		if _, err := s.Write(b[:]); err != nil {
+			return err
+		}
+	case modeDownload:
+		msg := make([]byte, size)
+		for end := time.Now().Add(d); time.Now().Before(end); {
+			if _, err := s.Write(msg); err != nil {
+				return err
+			}
+		}
+	case modePing:
+		if _, err := io.Copy(s, s); err != nil {
+			return err
+		}
+	case modeStats:
+		var b [16]byte
+		binary.BigEndian.PutUint64(b[:], uint64(cpuTime()-startCPU))
+		binary.BigEndian.PutUint64(b[8:], uint64(time.Since(start)))
+		if _, err := s.Write(b[:]); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown mode %q", mode)
+	}
+	return s.Close()
+}
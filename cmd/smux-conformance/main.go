@@ -0,0 +1,19 @@
+// Command smux-conformance runs the conformance checks of package
+// conformance over the network, acting as either the driver or the
+// responder, so muxers written in other languages can be tested against a
+// Go implementation.
+//
+// The muxer is selected with -muxer from the transports registered in the
+// smux.DefaultRegistry; muxer packages register themselves when imported.
+package main
+
+import (
+	"github.com/dms3-p2p/go-stream-muxer/conformance"
+
+	_ "github.com/dms3-p2p/go-stream-muxer/http2"
+	_ "github.com/dms3-p2p/go-stream-muxer/websocket"
+)
+
+func main() {
+	conformance.Main()
+}
@@ -0,0 +1,322 @@
+package streammux
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// ErrUnknownCompressor is the error of WithCompression streams named after
+// a format the connection does not have, which are reset.
+var ErrUnknownCompressor = errors.New("stream compressed in an unknown format")
+
+// Compressor is a compression format of the streams of WithCompression,
+// such as Gzip. Snappy, or any other format, is a Compressor wrapping its
+// library's stream writer and reader.
+type Compressor interface {
+	// Name identifies the format in the names of streams. It is at most
+	// MaxStreamNameSize bytes long.
+	Name() string
+
+	// NewWriter returns a writer compressing to w.
+	NewWriter(w io.Writer) CompressWriter
+
+	// NewReader returns a reader of the data compressed to r, by a
+	// writer of NewWriter which was closed at the end.
+	NewReader(r io.Reader) (io.Reader, error)
+}
+
+// CompressWriter is the compressing writer of a Compressor.
+type CompressWriter interface {
+	io.Writer
+
+	// Flush writes out the compressed data of everything written so
+	// far, so that the peer can read it.
+	Flush() error
+
+	// Close flushes and writes the end of the compressed data, without
+	// closing the underlying writer.
+	Close() error
+}
+
+// Gzip compresses streams with gzip, at the default compression level.
+var Gzip Compressor = &gzipCompressor{}
+
+// Deflate compresses streams with raw DEFLATE, at the default compression
+// level, which saves the gzip header and checksum.
+var Deflate Compressor = &deflateCompressor{}
+
+// The Compressors of this package pool their writers and readers, whose
+// state is too large to allocate for every stream: writers go back to the
+// pool once closed, and readers once they returned an error, EOF included.
+
+type gzipCompressor struct {
+	writers, readers sync.Pool
+}
+
+func (*gzipCompressor) Name() string { return "gzip" }
+
+func (c *gzipCompressor) NewWriter(w io.Writer) CompressWriter {
+	zw, ok := c.writers.Get().(*gzip.Writer)
+	if ok {
+		zw.Reset(w)
+	} else {
+		zw = gzip.NewWriter(w)
+	}
+	return &pooledWriter{w: zw, put: func() { c.writers.Put(zw) }}
+}
+
+func (c *gzipCompressor) NewReader(r io.Reader) (io.Reader, error) {
+	zr, ok := c.readers.Get().(*gzip.Reader)
+	var err error
+	if ok {
+		err = zr.Reset(r)
+	} else {
+		zr, err = gzip.NewReader(r)
+	}
+	if err != nil {
+		if zr != nil {
+			c.readers.Put(zr)
+		}
+		return nil, err
+	}
+	return &pooledReader{r: zr, put: func() { c.readers.Put(zr) }}, nil
+}
+
+type deflateCompressor struct {
+	writers, readers sync.Pool
+}
+
+func (*deflateCompressor) Name() string { return "deflate" }
+
+func (c *deflateCompressor) NewWriter(w io.Writer) CompressWriter {
+	fw, ok := c.writers.Get().(*flate.Writer)
+	if ok {
+		fw.Reset(w)
+	} else {
+		// the default level is valid, so there is no error.
+		fw, _ = flate.NewWriter(w, flate.DefaultCompression)
+	}
+	return &pooledWriter{w: fw, put: func() { c.writers.Put(fw) }}
+}
+
+func (c *deflateCompressor) NewReader(r io.Reader) (io.Reader, error) {
+	fr, ok := c.readers.Get().(io.ReadCloser)
+	if ok {
+		fr.(flate.Resetter).Reset(r, nil)
+	} else {
+		fr = flate.NewReader(r)
+	}
+	return &pooledReader{r: fr, put: func() { c.readers.Put(fr) }}, nil
+}
+
+// pooledWriter puts w back in its pool once closed.
+type pooledWriter struct {
+	w   CompressWriter
+	put func()
+}
+
+func (w *pooledWriter) Write(b []byte) (int, error) { return w.w.Write(b) }
+func (w *pooledWriter) Flush() error                { return w.w.Flush() }
+
+func (w *pooledWriter) Close() error {
+	err := w.w.Close()
+	w.put()
+	return err
+}
+
+// pooledReader puts r back in its pool once it returned an error, which
+// it returns from then on.
+type pooledReader struct {
+	r   io.Reader
+	put func()
+	err error
+}
+
+func (r *pooledReader) Read(b []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.r.Read(b)
+	if err != nil {
+		r.err = err
+		r.put()
+	}
+	return n, err
+}
+
+// WithCompression wraps tr so that the payloads of the streams of its
+// connections are compressed, while the frames of the muxer are left
+// as they are. The streams a connection opens are compressed with the
+// first of cs, Gzip if none, whose name they carry in the preamble of
+// WithStreamNames; those it accepts in any of cs, and those in another
+// format are reset. Both sides of a connection must be wrapped.
+//
+// Every Write is flushed, so that the peer reads it without waiting for
+// more, and Close ends the compressed data before closing the stream for
+// writing. Deadlines work, but a read or write past its deadline fails
+// all that follow, as the compressed data cannot resume midway; the
+// transport does not declare FeatureDeadlines, nor FeatureHalfClose.
+//
+// Every stream written to holds a compressor until it is closed, of
+// about a megabyte for Gzip and Deflate, so connections keeping many
+// streams open are better off compressing the messages of their protocol.
+func WithCompression(tr Transport, cs ...Compressor) Transport {
+	if len(cs) == 0 {
+		cs = []Compressor{Gzip}
+	}
+	t := &compressTransport{inner: tr, cs: cs}
+	if _, ok := tr.(FeatureTransport); ok {
+		return featureCompressTransport{t}
+	}
+	return t
+}
+
+type compressTransport struct {
+	inner Transport
+	cs    []Compressor
+}
+
+// featureCompressTransport is the compressTransport of a FeatureTransport,
+// with its features but those its streams lose, and those of connections.
+type featureCompressTransport struct {
+	*compressTransport
+}
+
+func (t featureCompressTransport) Features() Features {
+	f, _ := TransportFeatures(t.inner)
+	return f &^ (FeatureDeadlines | FeatureHalfClose | connFeatures)
+}
+
+func (t *compressTransport) NewConn(c net.Conn, isServer bool) (Conn, error) {
+	return t.wrap(t.inner.NewConn(c, isServer))
+}
+
+func (t *compressTransport) NewConnRWC(rwc io.ReadWriteCloser, isServer bool) (Conn, error) {
+	return t.wrap(NewConnRWC(t.inner, rwc, isServer))
+}
+
+func (t *compressTransport) wrap(c Conn, err error) (Conn, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &compressConn{Conn: WithStreamNames(c), cs: t.cs}, nil
+}
+
+// compressConn is the connection of a compressTransport, whose Conn names
+// the streams after their format.
+type compressConn struct {
+	Conn
+	cs []Compressor
+}
+
+func (c *compressConn) unwrapConn() Conn {
+	return c.Conn
+}
+
+func (c *compressConn) OpenStream() (Stream, error) {
+	codec := c.cs[0]
+	s, err := c.Conn.(NamedStreamConn).OpenNamedStream(codec.Name())
+	if err != nil {
+		return nil, err
+	}
+	return &compressedStream{Stream: s, conn: c, codec: codec}, nil
+}
+
+func (c *compressConn) AcceptStream() (Stream, error) {
+	for {
+		s, err := c.Conn.AcceptStream()
+		if err != nil {
+			return nil, err
+		}
+		codec, err := c.compressor(StreamName(s))
+		if err != nil {
+			s.Reset()
+			continue
+		}
+		return &compressedStream{Stream: s, conn: c, codec: codec}, nil
+	}
+}
+
+func (c *compressConn) compressor(name string) (Compressor, error) {
+	for _, codec := range c.cs {
+		if codec.Name() == name {
+			return codec, nil
+		}
+	}
+	return nil, ErrUnknownCompressor
+}
+
+// compressedStream compresses what is written to it, and decompresses
+// what is read, once there is something to.
+type compressedStream struct {
+	Stream
+	conn  *compressConn
+	codec Compressor
+
+	wmu    sync.Mutex
+	w      CompressWriter
+	closed bool
+
+	rmu sync.Mutex
+	r   io.Reader
+}
+
+func (s *compressedStream) unwrapStream() Stream {
+	return s.Stream
+}
+
+func (s *compressedStream) Conn() Conn {
+	return s.conn
+}
+
+func (s *compressedStream) Write(b []byte) (int, error) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if s.closed {
+		// the stream is closed for writing, and fails the write.
+		return s.Stream.Write(b)
+	}
+	if s.w == nil {
+		s.w = s.codec.NewWriter(s.Stream)
+	}
+	n, err := s.w.Write(b)
+	if err == nil {
+		err = s.w.Flush()
+	}
+	return n, err
+}
+
+func (s *compressedStream) Close() error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.w == nil {
+		s.w = s.codec.NewWriter(s.Stream)
+	}
+	err := s.w.Close()
+	s.w = nil
+	if cerr := s.Stream.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (s *compressedStream) Read(b []byte) (int, error) {
+	s.rmu.Lock()
+	defer s.rmu.Unlock()
+	if s.r == nil {
+		r, err := s.codec.NewReader(s.Stream)
+		if err != nil {
+			return 0, err
+		}
+		s.r = r
+	}
+	return s.r.Read(b)
+}
@@ -0,0 +1,37 @@
+// Package conformance runs the stream muxer conformance checks over a real
+// network connection, so that a muxer implementation written in another
+// language can be tested against a Go implementation of the same protocol.
+//
+// One side of the connection is the driver and runs the checks, the other
+// is the responder and only reacts to streams the driver opens. Either side
+// may be the muxer's client or server; the two roles are independent.
+//
+// # Orchestration protocol
+//
+// Every stream the driver opens starts with a single command line: an ASCII
+// command, optionally followed by a space and a decimal argument,
+// terminated by "\n". Lines are at most 64 bytes. The responder reads the
+// line byte by byte (so it never consumes data past it) and then:
+//
+//	echo      writes back everything it reads until EOF, then closes the
+//	          stream.
+//	close     closes the stream for writing immediately, then discards
+//	          everything it reads.
+//	reset     resets the stream immediately.
+//	open <n>  opens n streams towards the driver, writes "stream <i>\n"
+//	          on the i-th (counting from 0) and closes it, then closes the
+//	          command stream.
+//
+// Unknown commands are answered with a stream reset. The responder must
+// keep accepting streams until the driver closes the connection.
+//
+// # Running over stdio
+//
+// Instead of a TCP connection, ExecDrive muxes the stdin and stdout of a
+// peer process, so implementations in other languages can be tested
+// without opening sockets. The process is the muxer's server and the
+// responder; it exits when its stdin closes. smux-conformance -stdio is
+// such a process, and smux-conformance -exec runs one:
+//
+//	smux-conformance -muxer /http2/1.0.0 -exec "node responder.js"
+package conformance
@@ -0,0 +1,230 @@
+package conformance
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+
+	smux "github.com/dms3-p2p/go-stream-muxer"
+)
+
+// Check is a single conformance check run by the driver.
+type Check struct {
+	Name string
+	Run  func(c smux.Conn, accepted <-chan smux.Stream) error
+}
+
+// Checks are the checks run by Drive, in order.
+var Checks = []Check{
+	{"simple-write", checkSimpleWrite},
+	{"stress", checkStress},
+	{"close-eof", checkCloseEOF},
+	{"reset", checkReset},
+	{"responder-open", checkResponderOpen},
+}
+
+// Result is the outcome of a single check.
+type Result struct {
+	Check    string
+	Err      error
+	Duration time.Duration
+}
+
+// Drive runs all the checks over c against a responder on the other side
+// and writes a line per check to out. It returns an error if any check
+// failed.
+func Drive(c smux.Conn, out io.Writer) error {
+	accepted := make(chan smux.Stream)
+	go func() {
+		for {
+			s, err := c.AcceptStream()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- s
+		}
+	}()
+
+	failed := 0
+	for _, res := range runChecks(c, accepted) {
+		if res.Err != nil {
+			failed++
+			fmt.Fprintf(out, "FAIL %s (%s): %s\n", res.Check, res.Duration, res.Err)
+		} else {
+			fmt.Fprintf(out, "ok   %s (%s)\n", res.Check, res.Duration)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("conformance: %d of %d checks failed", failed, len(Checks))
+	}
+	return nil
+}
+
+func runChecks(c smux.Conn, accepted <-chan smux.Stream) []Result {
+	results := make([]Result, 0, len(Checks))
+	for _, check := range Checks {
+		start := time.Now()
+		err := check.Run(c, accepted)
+		results = append(results, Result{
+			Check:    check.Name,
+			Err:      err,
+			Duration: time.Since(start),
+		})
+	}
+	return results
+}
+
+func openCommand(c smux.Conn, cmd string, arg int) (smux.Stream, error) {
+	s, err := c.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeCommand(s, cmd, arg); err != nil {
+		s.Reset()
+		return nil, err
+	}
+	return s, nil
+}
+
+func randBuf(size int) []byte {
+	buf := make([]byte, size)
+	if _, err := crand.Read(buf); err != nil {
+		panic(err)
+	}
+	return buf
+}
+
+func echoRoundTrip(s smux.Stream, out []byte) error {
+	if _, err := s.Write(out); err != nil {
+		return fmt.Errorf("write: %s", err)
+	}
+	in := make([]byte, len(out))
+	if _, err := io.ReadFull(s, in); err != nil {
+		return fmt.Errorf("read: %s", err)
+	}
+	if !bytes.Equal(in, out) {
+		return fmt.Errorf("echoed data does not match")
+	}
+	return nil
+}
+
+func checkSimpleWrite(c smux.Conn, _ <-chan smux.Stream) error {
+	s, err := openCommand(c, "echo", 0)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	return echoRoundTrip(s, randBuf(4096))
+}
+
+func checkStress(c smux.Conn, _ <-chan smux.Stream) error {
+	const (
+		streams = 100
+		msgs    = 100
+		msgsize = 2048
+	)
+
+	errs := make(chan error, streams)
+	var wg sync.WaitGroup
+	for i := 0; i < streams; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s, err := openCommand(c, "echo", 0)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer s.Close()
+			out := randBuf(msgsize)
+			for j := 0; j < msgs; j++ {
+				if err := echoRoundTrip(s, out); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+func checkCloseEOF(c smux.Conn, _ <-chan smux.Stream) error {
+	s, err := openCommand(c, "close", 0)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	n, err := io.Copy(ioutil.Discard, s)
+	if err != nil {
+		return fmt.Errorf("expected EOF, got %s", err)
+	}
+	if n != 0 {
+		return fmt.Errorf("expected no data before EOF, got %d bytes", n)
+	}
+	return nil
+}
+
+func checkReset(c smux.Conn, _ <-chan smux.Stream) error {
+	s, err := openCommand(c, "reset", 0)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	s.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.Copy(ioutil.Discard, s); err == nil {
+		return fmt.Errorf("expected reading a reset stream to fail, got EOF")
+	}
+	return nil
+}
+
+func checkResponderOpen(c smux.Conn, accepted <-chan smux.Stream) error {
+	const n = 10
+
+	s, err := openCommand(c, "open", n)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	var got []string
+	timeout := time.After(10 * time.Second)
+	for len(got) < n {
+		select {
+		case ns, ok := <-accepted:
+			if !ok {
+				return fmt.Errorf("connection closed after accepting %d streams", len(got))
+			}
+			line, err := ioutil.ReadAll(ns)
+			ns.Close()
+			if err != nil {
+				return err
+			}
+			got = append(got, string(line))
+		case <-timeout:
+			return fmt.Errorf("timed out after accepting %d of %d streams", len(got), n)
+		}
+	}
+
+	sort.Strings(got)
+	want := make([]string, n)
+	for i := range want {
+		want[i] = fmt.Sprintf("stream %d\n", i)
+	}
+	sort.Strings(want)
+	for i := range want {
+		if got[i] != want[i] {
+			return fmt.Errorf("unexpected stream contents %q", got[i])
+		}
+	}
+	return nil
+}
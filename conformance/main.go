@@ -0,0 +1,137 @@
+package conformance
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+
+	smux "github.com/dms3-p2p/go-stream-muxer"
+)
+
+// Main implements a conformance command line tool over the muxers
+// registered in the smux.DefaultRegistry. It parses the command line flags
+// and exits when done.
+//
+// Exactly one of -listen, -dial, -exec and -stdio must be given; the
+// listening side is the muxer's server. The dialing side drives the checks
+// unless -role says otherwise. -exec runs a peer process and drives the
+// checks over its stdin and stdout, as the muxer's client; -stdio is the
+// other end, responding over the stdin and stdout of the command as the
+// muxer's server.
+func Main() {
+	var (
+		muxer  = flag.String("muxer", "", "protocol ID of the muxer to use")
+		listen = flag.String("listen", "", "listen on this TCP address and use the accepted connection")
+		dial   = flag.String("dial", "", "dial this TCP address")
+		exe    = flag.String("exec", "", "run this command, split at spaces, and drive the checks over its stdin and stdout")
+		stdio  = flag.Bool("stdio", false, "respond over stdin and stdout")
+		role   = flag.String("role", "", "driver or responder (default: the dialer drives)")
+	)
+	flag.Parse()
+
+	var err error
+	switch {
+	case *exe != "" && *listen == "" && *dial == "" && !*stdio:
+		err = runExec(*muxer, strings.Fields(*exe))
+	case *stdio && *listen == "" && *dial == "":
+		err = runStdio(*muxer)
+	default:
+		err = run(*muxer, *listen, *dial, *role)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func getTransport(muxer string) (smux.Transport, error) {
+	tr, ok := smux.Get(muxer)
+	if !ok {
+		return nil, fmt.Errorf("unknown muxer %q, available: %v", muxer, smux.DefaultRegistry.IDs())
+	}
+	return tr, nil
+}
+
+func runExec(muxer string, args []string) error {
+	tr, err := getTransport(muxer)
+	if err != nil {
+		return err
+	}
+	return ExecDrive(tr, exec.Command(args[0], args[1:]...), os.Stdout)
+}
+
+func runStdio(muxer string) error {
+	tr, err := getTransport(muxer)
+	if err != nil {
+		return err
+	}
+	c, err := smux.NewConnRWC(tr, Stdio(), true)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// the driver is done once it closes stdin.
+	err = Respond(c)
+	if err == smux.ErrConnClosed || err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+func run(muxer, listen, dial, role string) error {
+	tr, err := getTransport(muxer)
+	if err != nil {
+		return err
+	}
+
+	var (
+		nc       net.Conn
+		isServer bool
+	)
+	switch {
+	case listen != "" && dial == "":
+		var l net.Listener
+		l, err = net.Listen("tcp", listen)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "listening on %s\n", l.Addr())
+		nc, err = l.Accept()
+		l.Close()
+		isServer = true
+	case dial != "" && listen == "":
+		nc, err = net.Dial("tcp", dial)
+	default:
+		return fmt.Errorf("exactly one of -listen, -dial, -exec and -stdio must be given")
+	}
+	if err != nil {
+		return err
+	}
+
+	c, err := tr.NewConn(nc, isServer)
+	if err != nil {
+		nc.Close()
+		return err
+	}
+	defer c.Close()
+
+	if role == "" {
+		role = "responder"
+		if !isServer {
+			role = "driver"
+		}
+	}
+	switch role {
+	case "driver":
+		return Drive(c, os.Stdout)
+	case "responder":
+		return Respond(c)
+	default:
+		return fmt.Errorf("unknown role %q", role)
+	}
+}
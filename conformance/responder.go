@@ -0,0 +1,100 @@
+package conformance
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	smux "github.com/dms3-p2p/go-stream-muxer"
+)
+
+// maxCommandLen is the maximum length of a command line, including the
+// trailing newline.
+const maxCommandLen = 64
+
+var errCommandTooLong = errors.New("conformance: command line too long")
+
+// readCommand reads a command line from the stream without reading past
+// its end.
+func readCommand(s smux.Stream) (cmd string, arg int, err error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(s, b); err != nil {
+			return "", 0, err
+		}
+		if b[0] == '\n' {
+			break
+		}
+		line = append(line, b[0])
+		if len(line) >= maxCommandLen {
+			return "", 0, errCommandTooLong
+		}
+	}
+
+	fields := strings.SplitN(string(line), " ", 2)
+	if len(fields) == 2 {
+		arg, err = strconv.Atoi(fields[1])
+		if err != nil {
+			return "", 0, fmt.Errorf("conformance: bad command argument %q", fields[1])
+		}
+	}
+	return fields[0], arg, nil
+}
+
+func writeCommand(s smux.Stream, cmd string, arg int) error {
+	line := cmd + "\n"
+	if arg != 0 {
+		line = fmt.Sprintf("%s %d\n", cmd, arg)
+	}
+	_, err := io.WriteString(s, line)
+	return err
+}
+
+// Respond accepts streams opened by the driver on c and handles their
+// commands until c fails or is closed. It returns the error AcceptStream
+// failed with.
+func Respond(c smux.Conn) error {
+	for {
+		s, err := c.AcceptStream()
+		if err != nil {
+			return err
+		}
+		go respondStream(c, s)
+	}
+}
+
+func respondStream(c smux.Conn, s smux.Stream) {
+	cmd, arg, err := readCommand(s)
+	if err != nil {
+		s.Reset()
+		return
+	}
+
+	switch cmd {
+	case "echo":
+		io.Copy(s, s)
+		s.Close()
+	case "close":
+		s.Close()
+		io.Copy(ioutil.Discard, s)
+	case "reset":
+		s.Reset()
+	case "open":
+		for i := 0; i < arg; i++ {
+			ns, err := c.OpenStream()
+			if err != nil {
+				s.Reset()
+				return
+			}
+			fmt.Fprintf(ns, "stream %d\n", i)
+			ns.Close()
+		}
+		s.Close()
+	default:
+		s.Reset()
+	}
+}
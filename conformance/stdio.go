@@ -0,0 +1,112 @@
+package conformance
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"time"
+
+	smux "github.com/dms3-p2p/go-stream-muxer"
+)
+
+// exitTimeout bounds how long Close waits for a peer process to exit once
+// its stdin is closed, after which it is killed.
+const exitTimeout = 5 * time.Second
+
+// Stdio returns the stdin and stdout of the process as a single
+// io.ReadWriteCloser, for a responder started by ExecDrive.
+func Stdio() io.ReadWriteCloser {
+	return stdio{}
+}
+
+type stdio struct{}
+
+func (stdio) Read(b []byte) (int, error)  { return os.Stdin.Read(b) }
+func (stdio) Write(b []byte) (int, error) { return os.Stdout.Write(b) }
+
+func (stdio) Close() error {
+	err := os.Stdout.Close()
+	if err2 := os.Stdin.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// Process is a peer process whose stdin and stdout carry the muxed
+// connection.
+type Process struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	exited chan error
+}
+
+// StartProcess starts cmd with pipes as its stdin and stdout. Its stderr
+// is that of the current process unless cmd sets one.
+func StartProcess(cmd *exec.Cmd) (*Process, error) {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		stdin.Close()
+		return nil, err
+	}
+	if cmd.Stderr == nil {
+		cmd.Stderr = os.Stderr
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	p := &Process{
+		cmd:    cmd,
+		stdin:  stdin,
+		stdout: stdout,
+		exited: make(chan error, 1),
+	}
+	go func() { p.exited <- cmd.Wait() }()
+	return p, nil
+}
+
+func (p *Process) Read(b []byte) (int, error)  { return p.stdout.Read(b) }
+func (p *Process) Write(b []byte) (int, error) { return p.stdin.Write(b) }
+
+// Close closes the stdin of the process and waits for it to exit, killing
+// it if it has not within a few seconds. It returns the error the process
+// exited with.
+func (p *Process) Close() error {
+	p.stdin.Close()
+	select {
+	case err := <-p.exited:
+		p.exited <- err
+		return err
+	case <-time.After(exitTimeout):
+		p.cmd.Process.Kill()
+		err := <-p.exited
+		p.exited <- err
+		return err
+	}
+}
+
+// ExecDrive starts cmd as the responder, muxes its stdin and stdout with tr
+// as the muxer's client, and runs the checks against it, writing a line per
+// check to out. cmd is the muxer's server; it may run "smux-conformance
+// -stdio", or an implementation in another language which reads and writes
+// the muxed connection on its own stdio.
+func ExecDrive(tr smux.Transport, cmd *exec.Cmd, out io.Writer) error {
+	p, err := StartProcess(cmd)
+	if err != nil {
+		return err
+	}
+	c, err := smux.NewConnRWC(tr, p, false)
+	if err != nil {
+		p.Close()
+		return err
+	}
+	err = Drive(c, out)
+	c.Close()
+	// responders exit once the connection closes, with whatever status.
+	p.Close()
+	return err
+}
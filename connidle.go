@@ -0,0 +1,155 @@
+package streammux
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// WithConnIdleTimeout wraps c to close it once it has had no stream open
+// and no read or write returning data on its streams for timeout, so that
+// connection pools garbage collect the sessions nothing uses anymore. The
+// returned Conn is a CloseNotifyConn, whose CloseChan is closed then. Its
+// streams are open until they are reset, or closed and read to EOF, as
+// with WithStreamTracking. It enforces Options.ConnIdleTimeout.
+func WithConnIdleTimeout(c Conn, timeout time.Duration) CloseNotifyConn {
+	ic := &connIdleConn{Conn: c, timeout: timeout, last: time.Now()}
+	ic.mu.Lock()
+	ic.timer = time.AfterFunc(timeout, ic.check)
+	ic.mu.Unlock()
+	return ic
+}
+
+type connIdleConn struct {
+	Conn
+	timeout time.Duration
+
+	mu     sync.Mutex
+	timer  *time.Timer
+	open   int
+	last   time.Time
+	closed bool
+
+	chanOnce sync.Once
+	closeCh  <-chan struct{}
+}
+
+func (c *connIdleConn) unwrapConn() Conn {
+	return c.Conn
+}
+
+// check closes the connection if it has been idle for the timeout, and
+// waits for the rest of it otherwise.
+func (c *connIdleConn) check() {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	idle := time.Since(c.last)
+	if c.open > 0 || idle < c.timeout {
+		wait := c.timeout - idle
+		if c.open > 0 {
+			wait = c.timeout
+		}
+		c.timer.Reset(wait)
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	c.mu.Unlock()
+	c.Conn.Close()
+}
+
+// active records traffic, and opened streams opening or ending.
+func (c *connIdleConn) active(opened int) {
+	c.mu.Lock()
+	c.open += opened
+	c.last = time.Now()
+	c.mu.Unlock()
+}
+
+func (c *connIdleConn) OpenStream() (Stream, error) {
+	s, err := c.Conn.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	c.active(1)
+	return &connIdleStream{Stream: s, conn: c}, nil
+}
+
+func (c *connIdleConn) AcceptStream() (Stream, error) {
+	s, err := c.Conn.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	c.active(1)
+	return &connIdleStream{Stream: s, conn: c}, nil
+}
+
+func (c *connIdleConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.timer.Stop()
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+func (c *connIdleConn) CloseChan() <-chan struct{} {
+	c.chanOnce.Do(func() { c.closeCh = CloseChan(c.Conn) })
+	return c.closeCh
+}
+
+type connIdleStream struct {
+	Stream
+	conn *connIdleConn
+	end  streamEnd
+}
+
+func (s *connIdleStream) unwrapStream() Stream {
+	return s.Stream
+}
+
+func (s *connIdleStream) Conn() Conn {
+	return s.conn
+}
+
+func (s *connIdleStream) finish(write, read, reset bool) {
+	if s.end.done(write, read, reset) {
+		s.conn.active(-1)
+	}
+}
+
+func (s *connIdleStream) Read(b []byte) (int, error) {
+	n, err := s.Stream.Read(b)
+	if n > 0 {
+		s.conn.active(0)
+	}
+	switch {
+	case err == io.EOF:
+		s.finish(false, true, false)
+	case isReset(err):
+		s.finish(false, false, true)
+	}
+	return n, err
+}
+
+func (s *connIdleStream) Write(b []byte) (int, error) {
+	n, err := s.Stream.Write(b)
+	if n > 0 {
+		s.conn.active(0)
+	}
+	return n, err
+}
+
+func (s *connIdleStream) Close() error {
+	err := s.Stream.Close()
+	s.finish(true, false, false)
+	return err
+}
+
+func (s *connIdleStream) Reset() error {
+	err := s.Stream.Reset()
+	s.finish(false, false, true)
+	return err
+}
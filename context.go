@@ -0,0 +1,128 @@
+package streammux
+
+import "context"
+
+// ContextOpenConn is implemented by Conns whose stream opens can be
+// cancelled, e.g. while waiting for the peer to acknowledge the stream or
+// for a stream slot to free up.
+type ContextOpenConn interface {
+	Conn
+
+	// OpenStreamContext opens a stream like OpenStream, but gives up and
+	// returns ctx.Err() once ctx is done.
+	OpenStreamContext(ctx context.Context) (Stream, error)
+}
+
+// OpenStreamContext opens a stream on c, returning ctx.Err() if ctx is done
+// first. Conns that are not ContextOpenConns keep opening in the
+// background; a stream that opens after ctx is done is reset.
+func OpenStreamContext(ctx context.Context, c Conn) (Stream, error) {
+	if cc, ok := c.(ContextOpenConn); ok {
+		return cc.OpenStreamContext(ctx)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		s   Stream
+		err error
+	}
+	opened := make(chan result, 1)
+	go func() {
+		s, err := c.OpenStream()
+		opened <- result{s, err}
+	}()
+
+	select {
+	case r := <-opened:
+		return r.s, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-opened; r.err == nil {
+				r.s.Reset()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// ContextAcceptConn is implemented by Conns whose AcceptStream can be
+// cancelled without closing the connection, e.g. to stop a server's accept
+// loop for a graceful shutdown while its streams finish.
+type ContextAcceptConn interface {
+	Conn
+
+	// AcceptStreamContext accepts a stream like AcceptStream, but gives
+	// up and returns ctx.Err() once ctx is done. A stream the peer opens
+	// meanwhile is left to the next accept rather than dropped.
+	AcceptStreamContext(ctx context.Context) (Stream, error)
+}
+
+// AcceptStreamContext accepts a stream on c, returning ctx.Err() if ctx is
+// done first, or ErrNotSupported if c is not a ContextAcceptConn. Conns
+// can be made ContextAcceptConns with WithAcceptContext.
+func AcceptStreamContext(ctx context.Context, c Conn) (Stream, error) {
+	if cc, ok := c.(ContextAcceptConn); ok {
+		return cc.AcceptStreamContext(ctx)
+	}
+	return nil, ErrNotSupported
+}
+
+// WithAcceptContext returns c if it is a ContextAcceptConn, and otherwise
+// wraps c to emulate AcceptStreamContext with an AcceptStream of c running
+// in the background: once ctx is done, it keeps waiting for a stream,
+// which the next AcceptStream or AcceptStreamContext returns.
+func WithAcceptContext(c Conn) ContextAcceptConn {
+	if cc, ok := c.(ContextAcceptConn); ok {
+		return cc
+	}
+	return &acceptContextConn{Conn: c, turn: make(chan struct{}, 1)}
+}
+
+type acceptResult struct {
+	s   Stream
+	err error
+}
+
+type acceptContextConn struct {
+	Conn
+
+	// turn is held by the accept waiting for pending, so that concurrent
+	// accepts take the streams in turn.
+	turn    chan struct{}
+	pending chan acceptResult
+}
+
+func (c *acceptContextConn) unwrapConn() Conn {
+	return c.Conn
+}
+
+func (c *acceptContextConn) AcceptStream() (Stream, error) {
+	return c.AcceptStreamContext(context.Background())
+}
+
+func (c *acceptContextConn) AcceptStreamContext(ctx context.Context) (Stream, error) {
+	select {
+	case c.turn <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-c.turn }()
+
+	if c.pending == nil {
+		pending := make(chan acceptResult, 1)
+		c.pending = pending
+		go func() {
+			s, err := c.Conn.AcceptStream()
+			pending <- acceptResult{s, err}
+		}()
+	}
+	select {
+	case r := <-c.pending:
+		c.pending = nil
+		return r.s, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
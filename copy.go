@@ -0,0 +1,144 @@
+package streammux
+
+import (
+	"io"
+	"sync"
+)
+
+// closeWriter is implemented by connections that can be closed for writing
+// only, like *net.TCPConn.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// CopyBufferSize is the size of the writes of the ReadFrom methods of the
+// stream wrappers of this package and of CopyBoth, matching the largest
+// frames of common muxers.
+const CopyBufferSize = 1 << 16
+
+// streamReadFrom copies r to s until EOF, natively if s is an
+// io.ReaderFrom, and otherwise through a pooled CopyBufferSize buffer.
+func streamReadFrom(s Stream, r io.Reader) (int64, error) {
+	if rf, ok := s.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	buf := DefaultBufferPool.Get(CopyBufferSize)
+	defer DefaultBufferPool.Put(buf)
+	return copyBuffer(s, r, buf)
+}
+
+// streamWriteTo copies s to w until EOF, natively if s is an io.WriterTo,
+// from the buffers of s if it is a BufferReader, and otherwise through a
+// pooled CopyBufferSize buffer.
+func streamWriteTo(s Stream, w io.Writer) (int64, error) {
+	if wt, ok := s.(io.WriterTo); ok {
+		return wt.WriteTo(w)
+	}
+	if br, ok := s.(BufferReader); ok {
+		return writeBuffers(br, w)
+	}
+	buf := DefaultBufferPool.Get(CopyBufferSize)
+	defer DefaultBufferPool.Put(buf)
+	return copyBuffer(w, s, buf)
+}
+
+// writeBuffers copies the buffers read from br to w until EOF.
+func writeBuffers(br BufferReader, w io.Writer) (written int64, err error) {
+	for {
+		buf, rerr := br.ReadBuffer()
+		if rerr == io.EOF {
+			return written, nil
+		}
+		if rerr != nil {
+			return written, rerr
+		}
+		nw, werr := w.Write(buf)
+		written += int64(nw)
+		br.ReleaseBuffer(buf)
+		if werr != nil {
+			return written, werr
+		}
+		if nw != len(buf) {
+			return written, io.ErrShortWrite
+		}
+	}
+}
+
+// copyBuffer is io.CopyBuffer without its ReaderFrom and WriterTo
+// shortcuts, which would call back into the wrappers.
+func copyBuffer(w io.Writer, r io.Reader, buf []byte) (written int64, err error) {
+	for {
+		nr, rerr := r.Read(buf)
+		if nr > 0 {
+			nw, werr := w.Write(buf[:nr])
+			written += int64(nw)
+			if werr != nil {
+				return written, werr
+			}
+			if nw != nr {
+				return written, io.ErrShortWrite
+			}
+		}
+		if rerr == io.EOF {
+			return written, nil
+		}
+		if rerr != nil {
+			return written, rerr
+		}
+	}
+}
+
+// CopyBoth splices s and rwc together, copying in both directions until
+// both are done, and returns the first error encountered.
+//
+// When one side reaches EOF, the other side is closed for writing only: s
+// with Close, rwc with CloseWrite if it has that method. If rwc cannot be
+// half-closed, it is closed once both directions are done. When copying in
+// either direction fails, s is reset and rwc is closed, so the failure
+// propagates to both peers.
+func CopyBoth(s Stream, rwc io.ReadWriteCloser) error {
+	var (
+		wg        sync.WaitGroup
+		errOnce   sync.Once
+		firstErr  error
+		abortOnce sync.Once
+	)
+
+	abort := func(err error) {
+		errOnce.Do(func() { firstErr = err })
+		abortOnce.Do(func() {
+			s.Reset()
+			rwc.Close()
+		})
+	}
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if _, err := streamReadFrom(s, rwc); err != nil {
+			abort(err)
+			return
+		}
+		if err := s.Close(); err != nil {
+			abort(err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		if _, err := streamWriteTo(s, rwc); err != nil {
+			abort(err)
+			return
+		}
+		if cw, ok := rwc.(closeWriter); ok {
+			if err := cw.CloseWrite(); err != nil {
+				abort(err)
+			}
+		}
+	}()
+	wg.Wait()
+
+	if err := rwc.Close(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
@@ -0,0 +1,33 @@
+package streammux
+
+import "time"
+
+// WithAcceptDeadline wraps c so that every stream it accepts has its read
+// and write deadline set to timeout after it was accepted. This protects
+// servers from peers that open streams and never use them. Handlers that
+// expect long-lived streams refresh or clear the deadline with
+// SetDeadline.
+func WithAcceptDeadline(c Conn, timeout time.Duration) Conn {
+	return &acceptDeadlineConn{Conn: c, timeout: timeout}
+}
+
+type acceptDeadlineConn struct {
+	Conn
+	timeout time.Duration
+}
+
+func (c *acceptDeadlineConn) unwrapConn() Conn {
+	return c.Conn
+}
+
+func (c *acceptDeadlineConn) AcceptStream() (Stream, error) {
+	s, err := c.Conn.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		s.Reset()
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,114 @@
+package streammux
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+// ErrMessageTooLarge is returned when a length-prefixed message exceeds the
+// allowed size.
+var ErrMessageTooLarge = errors.New("message too large")
+
+// ErrBadVarint is returned when reading a length prefix that is not a
+// minimally encoded unsigned varint of at most 64 bits.
+var ErrBadVarint = errors.New("malformed varint length prefix")
+
+// WriteLengthPrefixed writes msg to w, prefixed by its length as an
+// unsigned varint, as the protocols of libp2p delimit their messages. The
+// prefix and msg go in a single write, so concurrent writers do not
+// interleave them on streams whose writes are atomic.
+func WriteLengthPrefixed(w io.Writer, msg []byte) error {
+	buf := DefaultBufferPool.Get(binary.MaxVarintLen64 + len(msg))
+	defer DefaultBufferPool.Put(buf)
+	n := binary.PutUvarint(buf, uint64(len(msg)))
+	n += copy(buf[n:], msg)
+	_, err := w.Write(buf[:n])
+	return err
+}
+
+// ReadLengthPrefixed reads a message written by WriteLengthPrefixed from
+// r, reading r no further than its end, so that r can carry other data
+// after it. It returns ErrMessageTooLarge, before allocating anything, if
+// the message is longer than max bytes, after which r is mid-message and
+// must be given up on. It returns io.EOF if r ends before the message,
+// and io.ErrUnexpectedEOF if it ends within.
+func ReadLengthPrefixed(r io.Reader, max int) ([]byte, error) {
+	n, err := readUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(max) {
+		return nil, ErrMessageTooLarge
+	}
+	return readBody(r, int(n))
+}
+
+// WriteUint32Prefixed writes msg to w, prefixed by its length as a big
+// endian uint32, in a single write. It returns ErrMessageTooLarge if msg
+// is longer than a uint32 counts.
+func WriteUint32Prefixed(w io.Writer, msg []byte) error {
+	if uint64(len(msg)) > math.MaxUint32 {
+		return ErrMessageTooLarge
+	}
+	buf := DefaultBufferPool.Get(4 + len(msg))
+	defer DefaultBufferPool.Put(buf)
+	binary.BigEndian.PutUint32(buf, uint32(len(msg)))
+	copy(buf[4:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadUint32Prefixed reads a message written by WriteUint32Prefixed from
+// r, like ReadLengthPrefixed.
+func ReadUint32Prefixed(r io.Reader, max int) ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if uint64(n) > uint64(max) {
+		return nil, ErrMessageTooLarge
+	}
+	return readBody(r, int(n))
+}
+
+// readBody reads the n bytes of a message whose prefix was read.
+func readBody(r io.Reader, n int) ([]byte, error) {
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return msg, nil
+}
+
+// readUvarint reads an unsigned varint from r a byte at a time, so as not
+// to read past it, rejecting those not minimally encoded, as the
+// multiformats specification does.
+func readUvarint(r io.Reader) (uint64, error) {
+	var b [1]byte
+	var x uint64
+	for i := 0; i < binary.MaxVarintLen64; i++ {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			if err == io.EOF && i > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		c := b[0]
+		if c < 0x80 {
+			// a last byte of zero adds nothing, and the tenth byte only
+			// holds the 64th bit.
+			if (i > 0 && c == 0) || (i == binary.MaxVarintLen64-1 && c > 1) {
+				return 0, ErrBadVarint
+			}
+			return x | uint64(c)<<(7*uint(i)), nil
+		}
+		x |= uint64(c&0x7f) << (7 * uint(i))
+	}
+	return 0, ErrBadVarint
+}
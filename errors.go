@@ -0,0 +1,152 @@
+package streammux
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// WithErrorTranslation wraps c so that the errors of c and its streams go
+// through translate, which muxers built on libraries with their own errors
+// use to return ErrConnClosed, ErrReset and ErrTimeout instead. translate
+// returns errors it does not know unchanged; it is never called with nil.
+func WithErrorTranslation(c Conn, translate func(error) error) Conn {
+	return &translatingConn{Conn: c, translate: translate}
+}
+
+type translatingConn struct {
+	Conn
+	translate func(error) error
+}
+
+func (c *translatingConn) unwrapConn() Conn {
+	return c.Conn
+}
+
+func (c *translatingConn) err(err error) error {
+	if err == nil {
+		return nil
+	}
+	return c.translate(err)
+}
+
+func (c *translatingConn) Close() error {
+	return c.err(c.Conn.Close())
+}
+
+func (c *translatingConn) OpenStream() (Stream, error) {
+	s, err := c.Conn.OpenStream()
+	if err != nil {
+		return nil, c.err(err)
+	}
+	return &translatingStream{Stream: s, conn: c}, nil
+}
+
+func (c *translatingConn) AcceptStream() (Stream, error) {
+	s, err := c.Conn.AcceptStream()
+	if err != nil {
+		return nil, c.err(err)
+	}
+	return &translatingStream{Stream: s, conn: c}, nil
+}
+
+type translatingStream struct {
+	Stream
+	conn *translatingConn
+}
+
+func (s *translatingStream) unwrapStream() Stream {
+	return s.Stream
+}
+
+func (s *translatingStream) Conn() Conn {
+	return s.conn
+}
+
+// ReadFrom translates the errors of the stream, but returns those of r,
+// which are the caller's, as they are.
+func (s *translatingStream) ReadFrom(r io.Reader) (int64, error) {
+	src := &sourceReader{Reader: r}
+	n, err := streamReadFrom(s.Stream, src)
+	if err != nil && err == src.err {
+		return n, err
+	}
+	return n, s.conn.err(err)
+}
+
+// WriteTo translates the errors of the stream, but returns those of w,
+// which are the caller's, as they are.
+func (s *translatingStream) WriteTo(w io.Writer) (int64, error) {
+	dst := &destWriter{Writer: w}
+	n, err := streamWriteTo(s.Stream, dst)
+	if err != nil && err == dst.err {
+		return n, err
+	}
+	return n, s.conn.err(err)
+}
+
+func (s *translatingStream) WriteBuffers(bufs net.Buffers) (int64, error) {
+	n, err := WriteBuffers(s.Stream, bufs)
+	return n, s.conn.err(err)
+}
+
+func (s *translatingStream) Read(b []byte) (int, error) {
+	n, err := s.Stream.Read(b)
+	if err == io.EOF {
+		return n, err
+	}
+	return n, s.conn.err(err)
+}
+
+func (s *translatingStream) Write(b []byte) (int, error) {
+	n, err := s.Stream.Write(b)
+	return n, s.conn.err(err)
+}
+
+func (s *translatingStream) Close() error {
+	return s.conn.err(s.Stream.Close())
+}
+
+func (s *translatingStream) Reset() error {
+	return s.conn.err(s.Stream.Reset())
+}
+
+func (s *translatingStream) SetDeadline(t time.Time) error {
+	return s.conn.err(s.Stream.SetDeadline(t))
+}
+
+func (s *translatingStream) SetReadDeadline(t time.Time) error {
+	return s.conn.err(s.Stream.SetReadDeadline(t))
+}
+
+func (s *translatingStream) SetWriteDeadline(t time.Time) error {
+	return s.conn.err(s.Stream.SetWriteDeadline(t))
+}
+
+// sourceReader records the last error of the reader a stream copies from.
+type sourceReader struct {
+	io.Reader
+	err error
+}
+
+func (r *sourceReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// destWriter records the last error of the writer a stream copies to.
+type destWriter struct {
+	io.Writer
+	err error
+}
+
+func (w *destWriter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,250 @@
+package streammux
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// FallbackTransport establishes connections with a primary transport, and
+// falls back to a secondary one when the primary fails, e.g. because its
+// handshake found the peer speaks something else.
+//
+// The net.Conn is reused for the secondary if the primary did not write to
+// it: everything the primary read is replayed to the secondary. This is
+// the case of servers whose muxer waits for the client's handshake before
+// answering, as those of http2 and websocket do. Otherwise the peer saw
+// the primary's handshake and the connection is unusable, so the client
+// side redials with Redial if it is set, and the connection fails with a
+// FallbackError otherwise.
+type FallbackTransport struct {
+	Primary   Transport
+	Secondary Transport
+
+	// Redial, if set, opens a fresh connection to the peer of c, which
+	// is closed, for the secondary transport.
+	Redial func(c net.Conn) (net.Conn, error)
+}
+
+// NewFallbackTransport returns a FallbackTransport without Redial.
+func NewFallbackTransport(primary, secondary Transport) *FallbackTransport {
+	return &FallbackTransport{Primary: primary, Secondary: secondary}
+}
+
+// FallbackError is returned when the primary transport failed and the
+// connection could not be reused or redialed for the secondary.
+type FallbackError struct {
+	// Primary is the error of the primary transport.
+	Primary error
+}
+
+func (e *FallbackError) Error() string {
+	return fmt.Sprintf("smux: primary transport failed after writing to the connection, cannot fall back: %s", e.Primary)
+}
+
+// NewConn establishes a connection over c with the primary transport, or
+// failing that with the secondary one, in the background, so that it does
+// not wait for the peer. The primary fails if its NewConn does, or the
+// handshake of the connection it returns, seen through Handshake. Opening
+// and accepting streams wait for the connection to be established, and
+// fail if both transports did.
+func (f *FallbackTransport) NewConn(c net.Conn, isServer bool) (Conn, error) {
+	fc := &fallbackConn{nc: c, ready: make(chan struct{})}
+	go func() {
+		defer close(fc.ready)
+		conn, err := f.establish(c, isServer)
+		fc.mu.Lock()
+		if err != nil && fc.closing {
+			err = ErrConnClosed
+		}
+		fc.mu.Unlock()
+		fc.Conn, fc.err = conn, err
+	}()
+	return fc, nil
+}
+
+func (f *FallbackTransport) establish(c net.Conn, isServer bool) (Conn, error) {
+	rc := &rewindConn{Conn: c, recording: true}
+	conn, err := f.Primary.NewConn(rc, isServer)
+	if err == nil {
+		if err = Handshake(conn); err == nil {
+			rc.stopRecording()
+			return conn, nil
+		}
+	}
+
+	// what the primary does from now on does not reach c.
+	nc, ok := rc.rewind()
+	if conn != nil {
+		conn.Close()
+	}
+	if ok {
+		return f.Secondary.NewConn(nc, isServer)
+	}
+	c.Close()
+	if isServer || f.Redial == nil {
+		return nil, &FallbackError{Primary: err}
+	}
+	nc, err = f.Redial(c)
+	if err != nil {
+		return nil, err
+	}
+	return f.Secondary.NewConn(nc, isServer)
+}
+
+// fallbackConn is a connection whose transport may still be picked. Conn
+// and err are set once ready is closed.
+type fallbackConn struct {
+	Conn
+	err   error
+	nc    net.Conn
+	ready chan struct{}
+
+	mu      sync.Mutex
+	closing bool // Close aborted the handshakes
+
+	closeOnce sync.Once
+}
+
+func (c *fallbackConn) unwrapConn() Conn {
+	<-c.ready
+	return c.Conn
+}
+
+func (c *fallbackConn) wait() error {
+	<-c.ready
+	return c.err
+}
+
+// Handshake waits for the connection to be established, and returns why
+// both transports failed.
+func (c *fallbackConn) Handshake() error {
+	return c.wait()
+}
+
+// Close aborts the handshakes if they are still running, and closes the
+// established connection otherwise.
+func (c *fallbackConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		select {
+		case <-c.ready:
+		default:
+			c.mu.Lock()
+			c.closing = true
+			c.mu.Unlock()
+			c.nc.Close()
+		}
+		<-c.ready
+		if c.Conn != nil {
+			err = c.Conn.Close()
+		}
+	})
+	return err
+}
+
+func (c *fallbackConn) IsClosed() bool {
+	select {
+	case <-c.ready:
+	default:
+		return false
+	}
+	return c.Conn == nil || c.Conn.IsClosed()
+}
+
+func (c *fallbackConn) OpenStream() (Stream, error) {
+	if err := c.wait(); err != nil {
+		return nil, err
+	}
+	return c.Conn.OpenStream()
+}
+
+func (c *fallbackConn) AcceptStream() (Stream, error) {
+	if err := c.wait(); err != nil {
+		return nil, err
+	}
+	return c.Conn.AcceptStream()
+}
+
+// rewindConn records what is read from a net.Conn until it is rewound, or
+// recording is stopped. Rewinding hands the net.Conn over to a new
+// rewindConn replaying the recorded data, and cuts off the old one, whose
+// reads and writes fail from then on, and whose Close does nothing.
+type rewindConn struct {
+	net.Conn
+
+	mu        sync.Mutex
+	recording bool
+	recorded  []byte
+	replay    []byte
+	wrote     bool
+	cut       bool
+}
+
+func (c *rewindConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	if c.cut {
+		c.mu.Unlock()
+		return 0, io.ErrClosedPipe
+	}
+	if len(c.replay) > 0 {
+		n := copy(b, c.replay)
+		c.replay = c.replay[n:]
+		c.mu.Unlock()
+		return n, nil
+	}
+	c.mu.Unlock()
+
+	n, err := c.Conn.Read(b)
+	c.mu.Lock()
+	if c.recording {
+		c.recorded = append(c.recorded, b[:n]...)
+	}
+	c.mu.Unlock()
+	return n, err
+}
+
+func (c *rewindConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	if c.cut {
+		c.mu.Unlock()
+		return 0, io.ErrClosedPipe
+	}
+	if c.recording && len(b) > 0 {
+		c.wrote = true
+	}
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+// Close closes the net.Conn, unless the connection is still recording, as
+// the primary transport closes it on failing, or was cut off.
+func (c *rewindConn) Close() error {
+	c.mu.Lock()
+	keep := c.recording || c.cut
+	c.mu.Unlock()
+	if keep {
+		return nil
+	}
+	return c.Conn.Close()
+}
+
+// rewind cuts c off, and returns a connection replaying what was recorded
+// to its next reads. It returns false if c was written to, in which case
+// it cannot be handed over.
+func (c *rewindConn) rewind() (net.Conn, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cut = true
+	if c.wrote {
+		return nil, false
+	}
+	return &rewindConn{Conn: c.Conn, replay: c.recorded}, true
+}
+
+func (c *rewindConn) stopRecording() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.recorded, c.recording = nil, false
+}
@@ -0,0 +1,124 @@
+package streammux
+
+import "strings"
+
+// Features is the set of optional capabilities a Transport's connections
+// and streams have, so that callers, and the conformance tests, can tell
+// what to rely on before opening a connection rather than probing each
+// stream for the interfaces of this package.
+type Features uint32
+
+const (
+	// FeatureMultiplex is set by muxers carrying more than one stream per
+	// connection, opened by either side.
+	FeatureMultiplex Features = 1 << iota
+
+	// FeatureReset is set by muxers whose Reset aborts both directions of
+	// a stream, failing the peer's reads and writes with ErrReset.
+	FeatureReset
+
+	// FeatureDeadlines is set by muxers whose streams honor read and
+	// write deadlines.
+	FeatureDeadlines
+
+	// FeatureHalfClose is set by muxers whose streams are HalfClosers,
+	// which close for reading as well as for writing.
+	FeatureHalfClose
+
+	// FeatureStreamIDs is set by muxers whose streams are StreamIDers.
+	FeatureStreamIDs
+
+	// FeaturePriority is set by muxers whose streams are PriorityStreams.
+	FeaturePriority
+
+	// FeatureReceiveWindow is set by muxers whose streams are
+	// ReceiveWindowSetters.
+	FeatureReceiveWindow
+
+	// FeatureLinger is set by muxers whose connections are LingerConns.
+	FeatureLinger
+
+	// FeatureAbort is set by muxers whose connections are AbortConns.
+	FeatureAbort
+
+	// FeatureGoAway is set by muxers whose connections are GoAwayConns.
+	FeatureGoAway
+
+	// FeatureEvents is set by muxers whose connections are
+	// EventReporters, reporting at least window stalls.
+	FeatureEvents
+
+	// FeatureWait is set by muxers whose connections are WaitConns.
+	FeatureWait
+
+	// FeatureResetCodes is set by muxers whose streams are
+	// ErrorResetters.
+	FeatureResetCodes
+
+	// FeatureNoWire is set by muxers whose connections carry no data over
+	// the net.Conn they are established over, such as memconn, so that
+	// wrappers of it, injecting latency or dropping data, have no effect.
+	FeatureNoWire
+)
+
+// connFeatures are the features of connections rather than streams, which
+// the Conn wrappers of this package hide, so that wrapper transports do
+// not declare them.
+const connFeatures = FeatureLinger | FeatureAbort | FeatureGoAway | FeatureEvents | FeatureWait
+
+var featureNames = []string{
+	"multiplex",
+	"reset",
+	"deadlines",
+	"half-close",
+	"stream-ids",
+	"priority",
+	"receive-window",
+	"linger",
+	"abort",
+	"go-away",
+	"events",
+	"wait",
+	"reset-codes",
+	"no-wire",
+}
+
+// Has returns whether f has all the features of g.
+func (f Features) Has(g Features) bool {
+	return f&g == g
+}
+
+// String returns the names of the features of f, separated by "|", such
+// as "multiplex|reset".
+func (f Features) String() string {
+	var names []string
+	for i, name := range featureNames {
+		if f&(1<<uint(i)) != 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, "|")
+}
+
+// FeatureTransport is implemented by Transports that declare the features
+// of their connections.
+type FeatureTransport interface {
+	Transport
+
+	// Features returns the features of the transport's connections and
+	// their streams.
+	Features() Features
+}
+
+// TransportFeatures returns the features tr declares, and false if tr is
+// not a FeatureTransport, in which case its features are only known by
+// probing its connections and streams.
+func TransportFeatures(tr Transport) (Features, bool) {
+	if ft, ok := tr.(FeatureTransport); ok {
+		return ft.Features(), true
+	}
+	return 0, false
+}
@@ -0,0 +1,218 @@
+// Package frames is a toolkit for muxers framing their streams over a
+// single connection with headers like those of yamux or multiplex, so
+// that new implementations build on a tested frame layer rather than
+// write their own. The bundled muxers frame their streams as their
+// protocols require; only the http2 muxer uses the package, for its
+// WriteScheduler.
+//
+// A Format encodes and decodes the headers of frames, a stream ID, a
+// type and the length of the payload: Fixed in 9 bytes, and Varint as
+// multiplex does. A Reader reads frames, enforcing a maximum payload
+// size, into buffers of a smux.BufferPool. A Writer writes frames from a
+// single write loop, in the order of a WriteScheduler, by default taking
+// turns over the streams with frames queued so that one writing bulk data
+// does not hold up the others, and coalesces the frames queued together
+// into single writes.
+package frames
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+
+	smux "github.com/dms3-p2p/go-stream-muxer"
+)
+
+// DefaultMaxSize is the largest payload Readers and Writers accept, unless
+// configured otherwise.
+const DefaultMaxSize = 1 << 20
+
+// ErrFrameTooLarge is returned when reading or writing a frame whose
+// payload is larger than the maximum size.
+var ErrFrameTooLarge = errors.New("frames: frame too large")
+
+// ErrInvalidHeader is returned when encoding a header its Format cannot
+// represent.
+var ErrInvalidHeader = errors.New("frames: header not representable in the format")
+
+// Header is the header of a frame.
+type Header struct {
+	StreamID uint64
+	Type     byte
+	Length   int // of the payload
+}
+
+// Format is the wire encoding of headers.
+type Format interface {
+	// AppendHeader appends the encoding of h to b, or returns
+	// ErrInvalidHeader if h does not fit in the format.
+	AppendHeader(b []byte, h Header) ([]byte, error)
+
+	// ReadHeader reads a header from r.
+	ReadHeader(r *bufio.Reader) (Header, error)
+}
+
+// Fixed encodes headers as the stream ID (uint32), the type (byte) and the
+// length of the payload (uint32), big endian.
+var Fixed Format = fixedFormat{}
+
+type fixedFormat struct{}
+
+const fixedHeaderSize = 9
+
+func (fixedFormat) AppendHeader(b []byte, h Header) ([]byte, error) {
+	if h.StreamID > math.MaxUint32 || h.Length < 0 || uint64(h.Length) > math.MaxUint32 {
+		return b, ErrInvalidHeader
+	}
+	var hdr [fixedHeaderSize]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(h.StreamID))
+	hdr[4] = h.Type
+	binary.BigEndian.PutUint32(hdr[5:], uint32(h.Length))
+	return append(b, hdr[:]...), nil
+}
+
+func (fixedFormat) ReadHeader(r *bufio.Reader) (Header, error) {
+	var hdr [fixedHeaderSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return Header{}, err
+	}
+	length := binary.BigEndian.Uint32(hdr[5:])
+	if length > math.MaxInt32 {
+		return Header{}, ErrFrameTooLarge
+	}
+	return Header{
+		StreamID: uint64(binary.BigEndian.Uint32(hdr[:])),
+		Type:     hdr[4],
+		Length:   int(length),
+	}, nil
+}
+
+// Varint encodes headers as multiplex does: the stream ID shifted left by
+// three bits, with the type in those, and then the length of the payload,
+// as unsigned varints. Types take values up to 7.
+var Varint Format = varintFormat{}
+
+type varintFormat struct{}
+
+// varintTypeBits is the number of bits of the type in the first varint.
+const varintTypeBits = 3
+
+func (varintFormat) AppendHeader(b []byte, h Header) ([]byte, error) {
+	if h.Type >= 1<<varintTypeBits || h.StreamID > math.MaxUint64>>varintTypeBits || h.Length < 0 {
+		return b, ErrInvalidHeader
+	}
+	var hdr [2 * binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(hdr[:], h.StreamID<<varintTypeBits|uint64(h.Type))
+	n += binary.PutUvarint(hdr[n:], uint64(h.Length))
+	return append(b, hdr[:n]...), nil
+}
+
+func (varintFormat) ReadHeader(r *bufio.Reader) (Header, error) {
+	idType, err := binary.ReadUvarint(r)
+	if err != nil {
+		return Header{}, err
+	}
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return Header{}, unexpectedEOF(err)
+	}
+	if length > math.MaxInt32 {
+		return Header{}, ErrFrameTooLarge
+	}
+	return Header{
+		StreamID: idType >> varintTypeBits,
+		Type:     byte(idType & (1<<varintTypeBits - 1)),
+		Length:   int(length),
+	}, nil
+}
+
+// unexpectedEOF returns io.ErrUnexpectedEOF for io.EOF, as the header
+// already started.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Config configures Readers and Writers. The zero value is valid.
+type Config struct {
+	// Format is the encoding of headers. Nil means Fixed.
+	Format Format
+
+	// MaxSize is the largest payload accepted. Zero means
+	// DefaultMaxSize.
+	MaxSize int
+
+	// BufferPool is the pool of the payloads Readers read. Nil means
+	// smux.DefaultBufferPool.
+	BufferPool smux.BufferPool
+
+	// Scheduler returns the scheduler of a Writer. Nil means
+	// NewRoundRobinScheduler.
+	Scheduler func() WriteScheduler
+}
+
+func (cfg Config) withDefaults() Config {
+	if cfg.Format == nil {
+		cfg.Format = Fixed
+	}
+	if cfg.MaxSize == 0 {
+		cfg.MaxSize = DefaultMaxSize
+	}
+	if cfg.BufferPool == nil {
+		cfg.BufferPool = smux.DefaultBufferPool
+	}
+	if cfg.Scheduler == nil {
+		cfg.Scheduler = NewRoundRobinScheduler
+	}
+	return cfg
+}
+
+// Reader reads frames. It is not safe for concurrent use, as muxers read
+// frames from a single loop.
+type Reader struct {
+	br  *bufio.Reader
+	cfg Config
+}
+
+// NewReader returns a Reader of the frames of r.
+func NewReader(r io.Reader, cfg Config) *Reader {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &Reader{br: br, cfg: cfg.withDefaults()}
+}
+
+// ReadFrame reads the next frame. Its payload is in a buffer of the pool,
+// which the caller owns until it hands it back with Release, and nil if
+// empty. It returns io.EOF if r ended between frames, and
+// ErrFrameTooLarge, without reading the payload, if it is over MaxSize.
+func (r *Reader) ReadFrame() (Header, []byte, error) {
+	h, err := r.cfg.Format.ReadHeader(r.br)
+	if err != nil {
+		return Header{}, nil, err
+	}
+	if h.Length > r.cfg.MaxSize {
+		return h, nil, ErrFrameTooLarge
+	}
+	if h.Length == 0 {
+		return h, nil, nil
+	}
+	payload := r.cfg.BufferPool.Get(h.Length)
+	if _, err := io.ReadFull(r.br, payload); err != nil {
+		r.cfg.BufferPool.Put(payload)
+		return Header{}, nil, unexpectedEOF(err)
+	}
+	return h, payload, nil
+}
+
+// Release hands a payload returned by ReadFrame back to the pool.
+func (r *Reader) Release(payload []byte) {
+	if payload != nil {
+		r.cfg.BufferPool.Put(payload)
+	}
+}
@@ -0,0 +1,246 @@
+package frames_test
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"testing"
+
+	smux "github.com/dms3-p2p/go-stream-muxer"
+	"github.com/dms3-p2p/go-stream-muxer/frames"
+)
+
+func payload(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	return b
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		format  frames.Format
+		headers []frames.Header
+	}{
+		{"fixed", frames.Fixed, []frames.Header{
+			{},
+			{StreamID: 1, Type: 1, Length: 5},
+			{StreamID: math.MaxUint32, Type: math.MaxUint8, Length: 1},
+			{StreamID: 7, Type: 3, Length: 100000},
+		}},
+		{"varint", frames.Varint, []frames.Header{
+			{},
+			{StreamID: 1, Type: 7, Length: 5},
+			{StreamID: math.MaxUint64 >> 3, Type: 0, Length: 1},
+			{StreamID: 300, Type: 2, Length: 100000},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := frames.Config{Format: tc.format}
+			var buf bytes.Buffer
+			w := frames.NewWriter(&buf, cfg)
+			defer w.Close()
+			for _, h := range tc.headers {
+				if err := w.WriteFrame(h, payload(h.Length)); err != nil {
+					t.Fatalf("writing %+v: %v", h, err)
+				}
+			}
+
+			r := frames.NewReader(&buf, cfg)
+			for _, want := range tc.headers {
+				h, p, err := r.ReadFrame()
+				if err != nil {
+					t.Fatalf("reading %+v: %v", want, err)
+				}
+				if h != want {
+					t.Fatalf("read header %+v, expected %+v", h, want)
+				}
+				if !bytes.Equal(p, payload(want.Length)) {
+					t.Fatalf("payload of %+v does not match", want)
+				}
+				r.Release(p)
+			}
+			if _, _, err := r.ReadFrame(); err != io.EOF {
+				t.Fatalf("reading past the frames returned %v, expected %v", err, io.EOF)
+			}
+		})
+	}
+}
+
+func TestInvalidHeader(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		format frames.Format
+		h      frames.Header
+	}{
+		{"fixed stream ID", frames.Fixed, frames.Header{StreamID: math.MaxUint32 + 1}},
+		{"fixed length", frames.Fixed, frames.Header{Length: -1}},
+		{"varint type", frames.Varint, frames.Header{Type: 8}},
+		{"varint stream ID", frames.Varint, frames.Header{StreamID: math.MaxUint64>>3 + 1}},
+		{"varint length", frames.Varint, frames.Header{Length: -1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := tc.format.AppendHeader([]byte("x"), tc.h)
+			if err != frames.ErrInvalidHeader {
+				t.Fatalf("appending %+v returned %v, expected %v", tc.h, err, frames.ErrInvalidHeader)
+			}
+			if string(b) != "x" {
+				t.Fatalf("appending %+v left %q, expected %q", tc.h, b, "x")
+			}
+		})
+	}
+
+	w := frames.NewWriter(io.Discard, frames.Config{Format: frames.Varint})
+	defer w.Close()
+	if err := w.WriteFrame(frames.Header{Type: 8}, nil); err != frames.ErrInvalidHeader {
+		t.Fatalf("writing an invalid header returned %v, expected %v", err, frames.ErrInvalidHeader)
+	}
+}
+
+func TestReadMalformed(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		format frames.Format
+		data   []byte
+		err    error // nil for any error
+	}{
+		{"fixed empty", frames.Fixed, nil, io.EOF},
+		{"fixed truncated header", frames.Fixed, []byte{0, 0, 0, 1, 0}, io.ErrUnexpectedEOF},
+		{"fixed truncated payload", frames.Fixed, []byte{0, 0, 0, 1, 0, 0, 0, 0, 4, 1, 2}, io.ErrUnexpectedEOF},
+		{"fixed over MaxSize", frames.Fixed, []byte{0, 0, 0, 1, 0, 0, 0, 0, 17}, frames.ErrFrameTooLarge},
+		{"fixed over MaxInt32", frames.Fixed, []byte{0, 0, 0, 1, 0, 0x80, 0, 0, 0}, frames.ErrFrameTooLarge},
+		{"varint empty", frames.Varint, nil, io.EOF},
+		{"varint truncated stream ID", frames.Varint, []byte{0x80}, io.ErrUnexpectedEOF},
+		{"varint missing length", frames.Varint, []byte{0x08}, io.ErrUnexpectedEOF},
+		{"varint truncated payload", frames.Varint, []byte{0x08, 4, 1, 2}, io.ErrUnexpectedEOF},
+		{"varint over MaxSize", frames.Varint, []byte{0x08, 17}, frames.ErrFrameTooLarge},
+		{"varint over MaxInt32", frames.Varint, []byte{0x08, 0x80, 0x80, 0x80, 0x80, 0x08}, frames.ErrFrameTooLarge},
+		{"varint overflow", frames.Varint, bytes.Repeat([]byte{0xff}, 11), nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := frames.NewReader(bytes.NewReader(tc.data), frames.Config{Format: tc.format, MaxSize: 16})
+			_, p, err := r.ReadFrame()
+			switch {
+			case tc.err == nil && err == nil:
+				t.Fatal("reading a malformed frame succeeded")
+			case tc.err != nil && err != tc.err:
+				t.Fatalf("reading returned %v, expected %v", err, tc.err)
+			}
+			if p != nil {
+				t.Fatal("reading a malformed frame returned a payload")
+			}
+		})
+	}
+}
+
+func TestReaderBufio(t *testing.T) {
+	// a bufio.Reader is read from as it is, so that what follows the
+	// frames stays in it.
+	b, _ := frames.Fixed.AppendHeader(nil, frames.Header{StreamID: 1, Length: 2})
+	b = append(b, "hi rest"...)
+	br := bufio.NewReader(bytes.NewReader(b))
+	r := frames.NewReader(br, frames.Config{})
+	if _, p, err := r.ReadFrame(); err != nil || string(p) != "hi" {
+		t.Fatalf("read %q, %v, expected %q", p, err, "hi")
+	}
+	if rest, _ := io.ReadAll(br); string(rest) != " rest" {
+		t.Fatalf("left %q in the bufio.Reader, expected %q", rest, " rest")
+	}
+}
+
+func TestWriterErrors(t *testing.T) {
+	w := frames.NewWriter(io.Discard, frames.Config{MaxSize: 16})
+	if err := w.WriteFrame(frames.Header{StreamID: 1}, payload(17)); err != frames.ErrFrameTooLarge {
+		t.Fatalf("writing an oversized payload returned %v, expected %v", err, frames.ErrFrameTooLarge)
+	}
+	w.Close()
+	if err := w.WriteFrame(frames.Header{StreamID: 1}, payload(1)); err != frames.ErrWriterClosed {
+		t.Fatalf("writing after Close returned %v, expected %v", err, frames.ErrWriterClosed)
+	}
+
+	errWrite := errors.New("write failed")
+	w = frames.NewWriter(failingWriter{errWrite}, frames.Config{})
+	defer w.Close()
+	for i := 0; i < 2; i++ {
+		if err := w.WriteFrame(frames.Header{StreamID: 1}, payload(1)); err != errWrite {
+			t.Fatalf("write %d returned %v, expected %v", i, err, errWrite)
+		}
+	}
+}
+
+type failingWriter struct {
+	err error
+}
+
+func (w failingWriter) Write([]byte) (int, error) {
+	return 0, w.err
+}
+
+func TestSchedulers(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		sched      frames.WriteScheduler
+		priorities map[uint64]int
+		push       []uint64
+		want       []uint64
+	}{
+		{"round robin", frames.NewRoundRobinScheduler(), nil, []uint64{1, 1, 1, 2, 3}, []uint64{1, 2, 3, 1, 1}},
+		{"fifo", frames.NewFIFOScheduler(), nil, []uint64{1, 1, 1, 2, 3}, []uint64{1, 1, 1, 2, 3}},
+		{"priority", frames.NewPriorityScheduler(), map[uint64]int{3: 1, 4: -1}, []uint64{4, 1, 1, 2, 3, 3}, []uint64{3, 3, 1, 2, 1, 4}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for id, p := range tc.priorities {
+				tc.sched.SetPriority(id, p)
+			}
+			for _, id := range tc.push {
+				tc.sched.Push(id)
+			}
+			for i, want := range tc.want {
+				if id, ok := tc.sched.Pop(); !ok || id != want {
+					t.Fatalf("pop %d returned %d, %v, expected %d", i, id, ok, want)
+				}
+			}
+			if id, ok := tc.sched.Pop(); ok {
+				t.Fatalf("popped %d past the frames pushed", id)
+			}
+		})
+	}
+}
+
+func TestPrioritySchedulerMoves(t *testing.T) {
+	// the frames pushed already move along with their stream's priority.
+	s := frames.NewPriorityScheduler()
+	s.Push(1)
+	s.Push(2)
+	s.Push(2)
+	s.SetPriority(2, 5)
+	s.SetPriority(1, 7)
+	s.SetPriority(1, smux.DefaultPriority)
+	for i, want := range []uint64{2, 2, 1} {
+		if id, ok := s.Pop(); !ok || id != want {
+			t.Fatalf("pop %d returned %d, %v, expected %d", i, id, ok, want)
+		}
+	}
+}
+
+func TestNewScheduler(t *testing.T) {
+	// the names frames.NewScheduler takes are those smux.Options
+	// accepts.
+	for _, name := range []string{"", smux.RoundRobinScheduler, smux.FIFOScheduler, smux.PriorityScheduler, "lifo"} {
+		newScheduler, err := frames.NewScheduler(name)
+		valid := err == nil
+		if valid && newScheduler() == nil {
+			t.Fatalf("scheduler %q is nil", name)
+		}
+		if verr := (smux.Options{WriteScheduler: name}).Validate(); (verr == nil) != valid {
+			t.Fatalf("scheduler %q: NewScheduler returned %v, but Options.Validate %v", name, err, verr)
+		}
+		if name == "lifo" && valid {
+			t.Fatal("unknown scheduler \"lifo\" was accepted")
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package frames_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/dms3-p2p/go-stream-muxer/frames"
+)
+
+// fuzzMaxSize bounds the payloads of the fuzzed frames, so that inputs
+// claiming large ones are rejected rather than waited for.
+const fuzzMaxSize = 64 << 10
+
+// FuzzReader fuzzes the Readers of both Formats: data is read as frames,
+// and the frames read are written again by a Writer, which must encode
+// them as they were read.
+func FuzzReader(f *testing.F) {
+	for _, format := range []frames.Format{frames.Fixed, frames.Varint} {
+		var seed bytes.Buffer
+		w := frames.NewWriter(&seed, frames.Config{Format: format})
+		w.WriteFrame(frames.Header{StreamID: 1, Type: 1, Length: 5}, []byte("hello"))
+		w.WriteFrame(frames.Header{StreamID: 3}, nil)
+		w.Close()
+		f.Add(seed.Bytes())
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, format := range []frames.Format{frames.Fixed, frames.Varint} {
+			fuzzFormat(t, format, data)
+		}
+	})
+}
+
+func fuzzFormat(t *testing.T, format frames.Format, data []byte) {
+	cfg := frames.Config{Format: format, MaxSize: fuzzMaxSize}
+	r := frames.NewReader(bytes.NewReader(data), cfg)
+	var encoded bytes.Buffer
+	w := frames.NewWriter(&encoded, cfg)
+	defer w.Close()
+
+	var (
+		headers  []frames.Header
+		payloads [][]byte
+	)
+	for {
+		h, payload, err := r.ReadFrame()
+		if err != nil {
+			break
+		}
+		headers = append(headers, h)
+		payloads = append(payloads, append([]byte(nil), payload...))
+		if err := w.WriteFrame(h, payload); err != nil {
+			t.Fatalf("rewriting frame %+v: %v", h, err)
+		}
+		r.Release(payload)
+	}
+
+	// the Varint encodings of headers are not unique, so the frames are
+	// compared once read again rather than as bytes.
+	r = frames.NewReader(bytes.NewReader(encoded.Bytes()), cfg)
+	for i, h := range headers {
+		got, payload, err := r.ReadFrame()
+		if err != nil {
+			t.Fatalf("reading rewritten frame %d, %+v: %v", i, h, err)
+		}
+		if got != h || !bytes.Equal(payload, payloads[i]) {
+			t.Fatalf("rewritten frame %d is %+v, not %+v", i, got, h)
+		}
+		r.Release(payload)
+	}
+	if _, _, err := r.ReadFrame(); err != io.EOF {
+		t.Fatalf("reading past the rewritten frames returned %v, expected %v", err, io.EOF)
+	}
+}
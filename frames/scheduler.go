@@ -0,0 +1,189 @@
+package frames
+
+import (
+	"fmt"
+
+	smux "github.com/dms3-p2p/go-stream-muxer"
+)
+
+// WriteScheduler picks the order of the frames a Writer writes, among the
+// streams with frames queued. The frames of a stream are written in the
+// order they were queued whatever the scheduler. A Writer calls its
+// scheduler with its lock held, so schedulers need no locking of their
+// own.
+type WriteScheduler interface {
+	// Push records a frame queued for the stream id.
+	Push(id uint64)
+
+	// Pop returns the stream whose next frame is written now, taking
+	// one of the frames pushed for it, or false if there are none.
+	Pop() (id uint64, ok bool)
+
+	// SetPriority sets the priority of the stream id, as
+	// smux.PriorityStream does, for schedulers which have
+	// priorities. A priority is kept until set back to
+	// smux.DefaultPriority.
+	SetPriority(id uint64, p int)
+}
+
+// NewScheduler returns the constructor of the scheduler named name, one
+// of the smux.Options.WriteScheduler names, the empty name being round
+// robin, for muxers to honor the option, such as those building on Writer
+// and the http2 muxer.
+func NewScheduler(name string) (func() WriteScheduler, error) {
+	switch name {
+	case "", smux.RoundRobinScheduler:
+		return NewRoundRobinScheduler, nil
+	case smux.FIFOScheduler:
+		return NewFIFOScheduler, nil
+	case smux.PriorityScheduler:
+		return NewPriorityScheduler, nil
+	}
+	return nil, fmt.Errorf("frames: unknown write scheduler %q", name)
+}
+
+// NewRoundRobinScheduler returns a scheduler whose streams take turns, a
+// frame each, so that one writing bulk data does not hold up the others.
+// It is the scheduler of Writers unless configured otherwise.
+func NewRoundRobinScheduler() WriteScheduler {
+	return &roundRobinScheduler{pending: make(map[uint64]int)}
+}
+
+type roundRobinScheduler struct {
+	pending map[uint64]int // frames pushed per stream
+	turns   []uint64       // streams with frames pushed, in the order they take turns
+}
+
+func (s *roundRobinScheduler) Push(id uint64) {
+	if s.pending[id] == 0 {
+		s.turns = append(s.turns, id)
+	}
+	s.pending[id]++
+}
+
+func (s *roundRobinScheduler) Pop() (uint64, bool) {
+	if len(s.turns) == 0 {
+		return 0, false
+	}
+	id := s.turns[0]
+	s.turns = s.turns[1:]
+	if s.pending[id]--; s.pending[id] > 0 {
+		s.turns = append(s.turns, id)
+	} else {
+		delete(s.pending, id)
+	}
+	return id, true
+}
+
+func (*roundRobinScheduler) SetPriority(uint64, int) {}
+
+// remove takes all the frames pushed for id, and returns how many.
+func (s *roundRobinScheduler) remove(id uint64) int {
+	n := s.pending[id]
+	if n == 0 {
+		return 0
+	}
+	delete(s.pending, id)
+	for i, t := range s.turns {
+		if t == id {
+			s.turns = append(s.turns[:i], s.turns[i+1:]...)
+			break
+		}
+	}
+	return n
+}
+
+// NewFIFOScheduler returns a scheduler writing frames in the order they
+// were queued, whichever their stream.
+func NewFIFOScheduler() WriteScheduler {
+	return &fifoScheduler{}
+}
+
+type fifoScheduler struct {
+	queue []uint64
+}
+
+func (s *fifoScheduler) Push(id uint64) {
+	s.queue = append(s.queue, id)
+}
+
+func (s *fifoScheduler) Pop() (uint64, bool) {
+	if len(s.queue) == 0 {
+		return 0, false
+	}
+	id := s.queue[0]
+	s.queue = s.queue[1:]
+	return id, true
+}
+
+func (*fifoScheduler) SetPriority(uint64, int) {}
+
+// NewPriorityScheduler returns a scheduler writing the frames of the
+// streams of highest priority first, the streams of a priority taking
+// turns as with NewRoundRobinScheduler.
+func NewPriorityScheduler() WriteScheduler {
+	return &priorityScheduler{
+		priorities: make(map[uint64]int),
+		levels:     make(map[int]*roundRobinScheduler),
+	}
+}
+
+type priorityScheduler struct {
+	priorities map[uint64]int               // of the streams not at the default
+	levels     map[int]*roundRobinScheduler // of the priorities with frames pushed
+}
+
+func (s *priorityScheduler) push(id uint64, p, n int) {
+	l := s.levels[p]
+	if l == nil {
+		l = NewRoundRobinScheduler().(*roundRobinScheduler)
+		s.levels[p] = l
+	}
+	for ; n > 0; n-- {
+		l.Push(id)
+	}
+}
+
+func (s *priorityScheduler) Push(id uint64) {
+	s.push(id, s.priorities[id], 1)
+}
+
+func (s *priorityScheduler) Pop() (uint64, bool) {
+	var top *roundRobinScheduler
+	best := 0
+	for p, l := range s.levels {
+		if top == nil || p > best {
+			top, best = l, p
+		}
+	}
+	if top == nil {
+		return 0, false
+	}
+	id, ok := top.Pop()
+	if len(top.turns) == 0 {
+		delete(s.levels, best)
+	}
+	return id, ok
+}
+
+func (s *priorityScheduler) SetPriority(id uint64, p int) {
+	old := s.priorities[id]
+	if p == old {
+		return
+	}
+	if p == smux.DefaultPriority {
+		delete(s.priorities, id)
+	} else {
+		s.priorities[id] = p
+	}
+	// the frames already pushed move along.
+	if l := s.levels[old]; l != nil {
+		n := l.remove(id)
+		if len(l.turns) == 0 {
+			delete(s.levels, old)
+		}
+		if n > 0 {
+			s.push(id, p, n)
+		}
+	}
+}
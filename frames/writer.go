@@ -0,0 +1,199 @@
+package frames
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// ErrWriterClosed is returned by the writes of a closed Writer.
+var ErrWriterClosed = errors.New("frames: writer closed")
+
+// batchSize is how many bytes of frames the write loop coalesces into one
+// write, at most, unless a single frame is larger.
+const batchSize = 64 << 10
+
+// Writer writes frames from a write loop, with a queue of frames per
+// stream, in the order of its WriteScheduler.
+type Writer struct {
+	w   io.Writer
+	cfg Config
+
+	mu     sync.Mutex
+	queues map[uint64][]*frame
+	sched  WriteScheduler
+	err    error // set once the writer failed or closed
+
+	wake chan struct{}
+	done chan struct{}
+}
+
+type frame struct {
+	h       Header
+	payload []byte
+	written chan error
+}
+
+var framePool = sync.Pool{
+	New: func() interface{} { return &frame{written: make(chan error, 1)} },
+}
+
+// NewWriter returns a Writer of frames to w, and starts its write loop
+// until Close.
+func NewWriter(w io.Writer, cfg Config) *Writer {
+	cfg = cfg.withDefaults()
+	fw := &Writer{
+		w:      w,
+		cfg:    cfg,
+		queues: make(map[uint64][]*frame),
+		sched:  cfg.Scheduler(),
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	go fw.loop()
+	return fw
+}
+
+// WriteFrame queues a frame with the header h and payload, setting its
+// Length, and returns once it is written. The frames of a stream are
+// written in the order they are queued, and those of different streams
+// in the order of the scheduler. It returns ErrFrameTooLarge if payload is
+// over MaxSize, and the error of the underlying writer, which fails every
+// write after it, or ErrWriterClosed.
+func (w *Writer) WriteFrame(h Header, payload []byte) error {
+	if len(payload) > w.cfg.MaxSize {
+		return ErrFrameTooLarge
+	}
+	h.Length = len(payload)
+	if _, err := w.cfg.Format.AppendHeader(nil, h); err != nil {
+		return err
+	}
+
+	f := framePool.Get().(*frame)
+	f.h, f.payload = h, payload
+
+	w.mu.Lock()
+	if w.err != nil {
+		err := w.err
+		w.mu.Unlock()
+		framePool.Put(f)
+		return err
+	}
+	w.queues[h.StreamID] = append(w.queues[h.StreamID], f)
+	w.sched.Push(h.StreamID)
+	w.mu.Unlock()
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+	err := <-f.written
+	f.payload = nil
+	framePool.Put(f)
+	return err
+}
+
+// Close stops the write loop, once it wrote the frames it took already,
+// and fails the writes still queued with ErrWriterClosed. It does not
+// close the underlying writer.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	if w.err == nil {
+		w.err = ErrWriterClosed
+		close(w.done)
+	}
+	w.mu.Unlock()
+	return nil
+}
+
+// SetPriority sets the priority of the frames of the stream id, queued
+// and to come, for schedulers which have priorities.
+func (w *Writer) SetPriority(id uint64, p int) {
+	w.mu.Lock()
+	w.sched.SetPriority(id, p)
+	w.mu.Unlock()
+}
+
+// next takes the frames of the next batch, in the order of the scheduler.
+func (w *Writer) next() []*frame {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return nil
+	}
+	var batch []*frame
+	size := 0
+	for size < batchSize {
+		id, ok := w.sched.Pop()
+		if !ok {
+			break
+		}
+		q := w.queues[id]
+		f := q[0]
+		q[0] = nil
+		if len(q) == 1 {
+			delete(w.queues, id)
+		} else {
+			w.queues[id] = q[1:]
+		}
+		batch = append(batch, f)
+		size += len(f.payload)
+	}
+	return batch
+}
+
+// fail fails the queued frames with err, which every later write returns.
+func (w *Writer) fail(err error) {
+	w.mu.Lock()
+	if w.err == nil {
+		w.err = err
+		close(w.done)
+	}
+	err = w.err
+	queues := w.queues
+	w.queues = make(map[uint64][]*frame)
+	w.sched = w.cfg.Scheduler()
+	w.mu.Unlock()
+	for _, q := range queues {
+		for _, f := range q {
+			f.written <- err
+		}
+	}
+}
+
+func (w *Writer) loop() {
+	var buf []byte
+	for {
+		select {
+		case <-w.wake:
+		case <-w.done:
+			w.fail(ErrWriterClosed)
+			return
+		}
+
+		for {
+			batch := w.next()
+			if len(batch) == 0 {
+				break
+			}
+			buf = buf[:0]
+			for _, f := range batch {
+				// the header was checked by WriteFrame.
+				buf, _ = w.cfg.Format.AppendHeader(buf, f.h)
+				buf = append(buf, f.payload...)
+			}
+			_, err := w.w.Write(buf)
+			for _, f := range batch {
+				f.written <- err
+			}
+			if err != nil {
+				w.fail(err)
+				return
+			}
+			// a buffer grown by a large frame is not kept.
+			if cap(buf) > 2*batchSize {
+				buf = nil
+			}
+		}
+	}
+}
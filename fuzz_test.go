@@ -0,0 +1,53 @@
+package streammux_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	smux "github.com/dms3-p2p/go-stream-muxer"
+)
+
+// fuzzMaxMessageSize bounds the messages of the fuzzed inputs, so that
+// inputs claiming large ones are rejected rather than waited for.
+const fuzzMaxMessageSize = 64 << 10
+
+// FuzzPrefixed fuzzes ReadLengthPrefixed and ReadUint32Prefixed: data is
+// read as messages with either prefix, which must never be read past their
+// end, and which written again must be the bytes they were read from, as
+// the encoding of their lengths is unique.
+func FuzzPrefixed(f *testing.F) {
+	var seed bytes.Buffer
+	smux.WriteLengthPrefixed(&seed, []byte("hello"))
+	smux.WriteLengthPrefixed(&seed, bytes.Repeat([]byte{'x'}, 300))
+	f.Add(seed.Bytes())
+	seed.Reset()
+	smux.WriteUint32Prefixed(&seed, []byte("hello"))
+	f.Add(seed.Bytes())
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzMessages(t, data, smux.ReadLengthPrefixed, smux.WriteLengthPrefixed)
+		fuzzMessages(t, data, smux.ReadUint32Prefixed, smux.WriteUint32Prefixed)
+	})
+}
+
+func fuzzMessages(t *testing.T, data []byte, read func(io.Reader, int) ([]byte, error), write func(io.Writer, []byte) error) {
+	r := bytes.NewReader(data)
+	var rewritten bytes.Buffer
+	for n := 1; ; n++ {
+		msg, err := read(r, fuzzMaxMessageSize)
+		if err != nil {
+			return
+		}
+		if len(msg) > fuzzMaxMessageSize {
+			t.Fatalf("read a message of %d bytes, over the maximum", len(msg))
+		}
+		consumed := len(data) - r.Len()
+		if err := write(&rewritten, msg); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(rewritten.Bytes(), data[:consumed]) {
+			t.Fatalf("message %d written again as %x, read from %x", n, rewritten.Bytes(), data[:consumed])
+		}
+	}
+}
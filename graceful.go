@@ -0,0 +1,98 @@
+package streammux
+
+import (
+	"context"
+	"time"
+)
+
+// GracefulConn is implemented by Conns that can be drained before they are
+// closed.
+type GracefulConn interface {
+	Conn
+
+	// CloseGracefully stops accepting streams, telling the peer to open
+	// no more (e.g. with a GoAway frame) where the protocol allows,
+	// waits for the open streams to finish and closes the connection.
+	// If ctx is done first, the connection is closed right away and
+	// ctx.Err() is returned.
+	CloseGracefully(ctx context.Context) error
+}
+
+// GoAwayConn is implemented by Conns whose peer tells, as it shuts the
+// connection down (with a GoAway frame), the last of the streams opened
+// by this side that it accepted, so that the streams it did not can be
+// retried on a new connection.
+type GoAwayConn interface {
+	Conn
+
+	// LastAcceptedStreamID returns the StreamID of the last stream
+	// opened by this side that the peer accepted, as it told on
+	// shutting the connection down, and false until it did. The peer
+	// never saw the streams with higher IDs.
+	LastAcceptedStreamID() (id uint64, ok bool)
+}
+
+// LastAcceptedStreamID returns the ID of the last stream opened on c that
+// the peer accepted, if c is a GoAwayConn whose peer told it. ok is false
+// otherwise, as for the connections of WithGracefulClose, whose peer is
+// not told which streams were accepted, and which cannot tell either.
+func LastAcceptedStreamID(c Conn) (id uint64, ok bool) {
+	if gc, isGoAway := c.(GoAwayConn); isGoAway {
+		return gc.LastAcceptedStreamID()
+	}
+	return 0, false
+}
+
+// drainPollInterval is how often emulated graceful closes check whether
+// the streams finished.
+const drainPollInterval = 10 * time.Millisecond
+
+// WithGracefulClose returns c if it is a GracefulConn, and otherwise wraps
+// c to emulate CloseGracefully: it stops accepting like WithStopAccepting
+// and waits until the streams opened or accepted through the wrapper are
+// reset, or closed and read to EOF. The peer is not told; its new streams
+// are refused.
+func WithGracefulClose(c Conn) GracefulConn {
+	if gc, ok := c.(GracefulConn); ok {
+		return gc
+	}
+
+	tc := WithStreamTracking(c).(*trackingConn)
+	gc := &gracefulConn{tracking: tc}
+	if sc, ok := c.(StopAcceptingConn); ok {
+		gc.Conn, gc.stop = tc, sc.StopAccepting
+	} else {
+		sc := WithStopAccepting(tc)
+		gc.Conn, gc.stop = sc, sc.StopAccepting
+	}
+	return gc
+}
+
+type gracefulConn struct {
+	Conn
+	stop     func() error
+	tracking *trackingConn
+}
+
+func (c *gracefulConn) unwrapConn() Conn {
+	return c.Conn
+}
+
+func (c *gracefulConn) CloseGracefully(ctx context.Context) error {
+	if err := c.stop(); err != nil {
+		c.Close()
+		return err
+	}
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for c.tracking.NumStreams() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			c.Close()
+			return ctx.Err()
+		}
+	}
+	return c.Close()
+}
@@ -0,0 +1,191 @@
+package streammux
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// ErrGroupClosed is returned when opening or adding a stream to a closed
+// StreamGroup.
+var ErrGroupClosed = errors.New("stream group closed")
+
+// StreamGroup tracks the streams of one logical operation, such as a set
+// of parallel chunk downloads, so they can be cleaned up together. A
+// stream leaves the group once it was closed and read to EOF, or reset.
+type StreamGroup struct {
+	conn Conn
+
+	mu      sync.Mutex
+	streams map[*groupStream]struct{}
+	closed  bool
+	budget  uint32
+}
+
+// NewStreamGroup returns an empty group opening its streams on c.
+func NewStreamGroup(c Conn) *StreamGroup {
+	return &StreamGroup{
+		conn:    c,
+		streams: make(map[*groupStream]struct{}),
+	}
+}
+
+// OpenStream opens a stream on the group's Conn and adds it to the group.
+func (g *StreamGroup) OpenStream() (Stream, error) {
+	s, err := g.conn.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return g.Add(s)
+}
+
+// Add adds a stream, e.g. one accepted from the Conn, to the group and
+// returns the tracked stream to use in its place. If the group is closed,
+// s is reset and ErrGroupClosed is returned.
+func (g *StreamGroup) Add(s Stream) (Stream, error) {
+	gs := &groupStream{Stream: s, group: g}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		s.Reset()
+		return nil, ErrGroupClosed
+	}
+	if g.budget > 0 && !canSetReceiveWindow(s) {
+		s.Reset()
+		return nil, ErrNotSupported
+	}
+	g.streams[gs] = struct{}{}
+	if err := g.rebalance(); err != nil {
+		delete(g.streams, gs)
+		s.Reset()
+		return nil, err
+	}
+	return gs, nil
+}
+
+// SetReceiveBudget bounds the total receive window of all the streams in
+// the group to budget bytes, by dividing it evenly between them as streams
+// join and leave. A budget of 0 removes the bound, leaving the windows as
+// they are. It returns ErrNotSupported if a stream in the group cannot
+// change its receive window, and streams that cannot are rejected by Add
+// while a budget is set.
+func (g *StreamGroup) SetReceiveBudget(budget uint32) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if budget > 0 {
+		for gs := range g.streams {
+			if !canSetReceiveWindow(gs.Stream) {
+				return ErrNotSupported
+			}
+		}
+	}
+	g.budget = budget
+	return g.rebalance()
+}
+
+// rebalance divides the budget between the streams in the group. It must
+// be called with the lock held.
+func (g *StreamGroup) rebalance() error {
+	if g.budget == 0 || len(g.streams) == 0 {
+		return nil
+	}
+	window := g.budget / uint32(len(g.streams))
+	if window == 0 {
+		window = 1
+	}
+	var err error
+	for gs := range g.streams {
+		if werr := SetReceiveWindow(gs.Stream, window); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return err
+}
+
+// canSetReceiveWindow returns whether s, or a stream it wraps, is a
+// ReceiveWindowSetter.
+func canSetReceiveWindow(s Stream) bool {
+	_, ok := findStream(s, func(s Stream) bool {
+		_, ok := s.(ReceiveWindowSetter)
+		return ok
+	})
+	return ok
+}
+
+// Len returns the number of streams in the group.
+func (g *StreamGroup) Len() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.streams)
+}
+
+// Close resets every stream in the group. Once Close starts, no streams
+// can be added, so none escapes the reset.
+func (g *StreamGroup) Close() error {
+	g.mu.Lock()
+	streams := g.streams
+	g.streams = nil
+	g.closed = true
+	g.mu.Unlock()
+
+	for gs := range streams {
+		gs.Stream.Reset()
+	}
+	return nil
+}
+
+func (g *StreamGroup) remove(gs *groupStream) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.streams[gs]; !ok {
+		return
+	}
+	delete(g.streams, gs)
+	g.rebalance()
+}
+
+type groupStream struct {
+	Stream
+	group *StreamGroup
+
+	mu          sync.Mutex
+	writeClosed bool
+	readDone    bool
+}
+
+func (s *groupStream) unwrapStream() Stream {
+	return s.Stream
+}
+
+func (s *groupStream) Read(b []byte) (int, error) {
+	n, err := s.Stream.Read(b)
+	if err == io.EOF {
+		s.mu.Lock()
+		s.readDone = true
+		done := s.writeClosed
+		s.mu.Unlock()
+		if done {
+			s.group.remove(s)
+		}
+	}
+	return n, err
+}
+
+func (s *groupStream) Close() error {
+	err := s.Stream.Close()
+	s.mu.Lock()
+	s.writeClosed = true
+	done := s.readDone
+	s.mu.Unlock()
+	if done {
+		s.group.remove(s)
+	}
+	return err
+}
+
+func (s *groupStream) Reset() error {
+	err := s.Stream.Reset()
+	s.group.remove(s)
+	return err
+}
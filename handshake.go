@@ -0,0 +1,27 @@
+package streammux
+
+// HandshakeConn is implemented by Conns whose muxer handshakes with the
+// peer after NewConn returned, so that callers, such as FallbackTransport,
+// can tell whether the peer speaks the muxer before relying on it.
+type HandshakeConn interface {
+	Conn
+
+	// Handshake waits for the peer to answer the handshake of the muxer,
+	// and returns why it failed: the peer does not speak the muxer, or
+	// the connection was closed first.
+	Handshake() error
+}
+
+// Handshake waits for the handshake of c with the peer if c, or a
+// connection it wraps, is a HandshakeConn. Other Conns are taken to be
+// established once NewConn returned them, and Handshake returns nil.
+func Handshake(c Conn) error {
+	c, ok := findConn(c, func(c Conn) bool {
+		_, ok := c.(HandshakeConn)
+		return ok
+	})
+	if !ok {
+		return nil
+	}
+	return c.(HandshakeConn).Handshake()
+}
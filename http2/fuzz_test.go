@@ -0,0 +1,27 @@
+package http2_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dms3-p2p/go-stream-muxer/http2"
+	sm "github.com/dms3-p2p/go-stream-muxer/test"
+	xhttp2 "golang.org/x/net/http2"
+)
+
+// FuzzConn fuzzes the frame parser: data is read as the frames following
+// the client preface.
+func FuzzConn(f *testing.F) {
+	var seed bytes.Buffer
+	fr := xhttp2.NewFramer(&seed, nil)
+	fr.WriteSettings()
+	fr.WriteHeaders(xhttp2.HeadersFrameParam{StreamID: 1, EndHeaders: true})
+	fr.WriteData(1, true, []byte("hello"))
+	fr.WriteRSTStream(1, xhttp2.ErrCodeCancel)
+	f.Add(seed.Bytes())
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		sm.FuzzTransport(t, http2.DefaultTransport, []byte(xhttp2.ClientPreface), data)
+	})
+}
@@ -0,0 +1,1077 @@
+// Package http2 implements a stream muxer on the HTTP/2 framing layer of
+// golang.org/x/net/http2, so that muxed connections can cross HTTP/2
+// infrastructure.
+//
+// Each stream is an HTTP/2 stream. The opener sends a POST request header
+// block and the accepter answers with a 200 response header block before
+// any data; DATA frames then flow both ways until END_STREAM or
+// RST_STREAM. Both sides may open streams: the dialer with odd stream IDs
+// as an HTTP/2 client would, the listener with even ones, which plain
+// HTTP/2 servers do not accept. Stream IDs are not reused, so OpenStream
+// fails with smux.ErrTooManyStreams once a side used up those of its
+// parity, up to 2^31-1. Flow control follows RFC 7540.
+package http2
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	smux "github.com/dms3-p2p/go-stream-muxer"
+	"github.com/dms3-p2p/go-stream-muxer/frames"
+	"github.com/dms3-p2p/go-stream-muxer/internal/testhooks"
+	xhttp2 "golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// ProtocolID is the multistream protocol ID of the transport.
+const ProtocolID = "/http2/1.0.0"
+
+// ALPN is the TLS application protocol name of the transport, that of
+// HTTP/2 over TLS.
+const ALPN = "h2"
+
+const (
+	// streamWindow is the receive window advertised for every stream,
+	// unless Transport.ReceiveWindow says otherwise.
+	streamWindow = 256 << 10
+
+	// connWindow is the receive window of a whole connection, unless the
+	// window of a stream is larger.
+	connWindow = 16 << 20
+
+	// defaultWindow is the initial window of RFC 7540, before SETTINGS.
+	defaultWindow = 65535
+
+	// minFrameSize and maxFrameSize bound the SETTINGS_MAX_FRAME_SIZE of
+	// RFC 7540, the former being the initial one, and maxWindow bounds
+	// its windows.
+	minFrameSize = 16 << 10
+	maxFrameSize = 1<<24 - 1
+	maxWindow    = 1<<31 - 1
+
+	// maxStreamID is the last stream ID of RFC 7540.
+	maxStreamID = 1<<31 - 1
+
+	// defaultWeight is the weight streams start with in RFC 7540, 16,
+	// less one as frames carry it, which the default priority maps to.
+	defaultWeight = 15
+
+	// acceptBacklog is the number of streams opened by the peer waiting
+	// to be accepted, after which they queue in conn.pending.
+	acceptBacklog = 256
+
+	// maxPending is the number of streams conn.pending holds before the
+	// read loop waits for AcceptStream to make room, holding back the
+	// peer rather than queueing its streams without bound.
+	maxPending = 256
+
+	// closeTimeout bounds how long Close waits to send GOAWAY.
+	closeTimeout = time.Second
+)
+
+// errBadPreface is why connections whose peer is not an HTTP/2 client end.
+var errBadPreface = errors.New("http2: bad client preface")
+
+// errFlowControl is why connections whose peer sent past the connection's
+// receive window end.
+var errFlowControl = errors.New("http2: peer exceeded the receive window")
+
+func init() {
+	smux.Register(ProtocolID, DefaultTransport)
+	testhooks.RegisterStreamIDsLeft(func(tr smux.Transport, n uint32) (smux.Transport, bool) {
+		t, ok := tr.(Transport)
+		t.streamIDsLeft = n
+		return t, ok
+	})
+}
+
+// Transport is the HTTP/2 stream muxer transport.
+type Transport struct {
+	// BufferPool is the pool of the buffers of the data received on
+	// streams. Nil is smux.DefaultBufferPool.
+	BufferPool smux.BufferPool
+
+	// ReceiveWindow is the receive window of each stream, announced in
+	// SETTINGS_INITIAL_WINDOW_SIZE. Zero is 256KiB.
+	ReceiveWindow uint32
+
+	// MaxFrameSize is the largest DATA frame sent, if the peer's
+	// SETTINGS_MAX_FRAME_SIZE allows it, and the one announced if it is
+	// larger than the 16KiB every peer takes. Zero sends frames as large
+	// as the peer takes.
+	MaxFrameSize uint32
+
+	// MaxStreams is the number of streams open at once past which
+	// OpenStream fails with smux.ErrTooManyStreams and the streams the
+	// peer opens are refused, announced in
+	// SETTINGS_MAX_CONCURRENT_STREAMS. Zero is unlimited.
+	MaxStreams int
+
+	// WriteScheduler names the order the DATA frames of the streams
+	// writing at once are written in, one of the schedulers of
+	// frames.NewScheduler. Empty is smux.PriorityScheduler, under which
+	// streams take turns unless prioritized.
+	WriteScheduler string
+
+	// streamIDsLeft, if not zero, is the number of streams each side
+	// opens before it uses up its IDs, set by tests.
+	streamIDsLeft uint32
+}
+
+// DefaultTransport is the HTTP/2 transport.
+var DefaultTransport Transport
+
+// ProtocolID returns ProtocolID.
+func (Transport) ProtocolID() string {
+	return ProtocolID
+}
+
+// ALPN returns ALPN.
+func (Transport) ALPN() string {
+	return ALPN
+}
+
+// Features returns the features of HTTP/2 connections. Their streams are
+// smux.PriorityStreams: the DATA frames of the streams of higher
+// priorities are written first, under the default WriteScheduler, and
+// priorities are sent to the peer in PRIORITY frames, as weights of 16 plus
+// the priority, for its DATA frames of the stream.
+func (Transport) Features() smux.Features {
+	return smux.FeatureMultiplex | smux.FeatureReset | smux.FeatureHalfClose | smux.FeatureDeadlines | smux.FeatureStreamIDs | smux.FeatureGoAway | smux.FeatureEvents | smux.FeatureWait | smux.FeatureResetCodes | smux.FeatureLinger | smux.FeatureAbort | smux.FeaturePriority | smux.FeatureReceiveWindow
+}
+
+// WithBufferPool returns a copy of the transport using p.
+func (t Transport) WithBufferPool(p smux.BufferPool) smux.Transport {
+	t.BufferPool = p
+	return t
+}
+
+// WithConfig returns a copy of the transport using opts, which sets
+// ReceiveWindow, MaxFrameSize, MaxStreams and WriteScheduler, and wraps it
+// with smux.WithKeepAlive if KeepAliveInterval is set, pinging with PING
+// frames. Frames are written as they are sent, with no buffer, so
+// WriteBufferSize is not supported.
+func (t Transport) WithConfig(opts smux.Options) (smux.Transport, error) {
+	if opts.WriteBufferSize != 0 {
+		return nil, smux.ErrNotSupported
+	}
+	if _, err := frames.NewScheduler(opts.WriteScheduler); err != nil {
+		return nil, err
+	}
+	if opts.ReceiveWindow > maxWindow {
+		return nil, fmt.Errorf("http2: ReceiveWindow (%d) is larger than %d", opts.ReceiveWindow, maxWindow)
+	}
+	if opts.MaxFrameSize > maxFrameSize {
+		return nil, fmt.Errorf("http2: MaxFrameSize (%d) is larger than %d", opts.MaxFrameSize, maxFrameSize)
+	}
+	if opts.ReceiveWindow != 0 {
+		t.ReceiveWindow = opts.ReceiveWindow
+	}
+	if opts.MaxFrameSize != 0 {
+		t.MaxFrameSize = opts.MaxFrameSize
+	}
+	if opts.MaxStreams != 0 {
+		t.MaxStreams = opts.MaxStreams
+	}
+	if opts.WriteScheduler != "" {
+		t.WriteScheduler = opts.WriteScheduler
+	}
+	if opts.KeepAliveInterval != 0 {
+		return smux.WithKeepAlive(t, opts.KeepAliveInterval, opts.KeepAliveFailures), nil
+	}
+	return t, nil
+}
+
+// NewConn sends the connection preface and settings over c and returns the
+// muxed connection. The dialer's preface is read in the background, so
+// NewConn does not wait for the peer.
+func (t Transport) NewConn(c net.Conn, isServer bool) (smux.Conn, error) {
+	pool := t.BufferPool
+	if pool == nil {
+		pool = smux.DefaultBufferPool
+	}
+	window := streamWindow
+	if t.ReceiveWindow != 0 {
+		window = int(t.ReceiveWindow)
+	}
+	cwindow := connWindow
+	if window > cwindow {
+		cwindow = window
+	}
+	scheduler := t.WriteScheduler
+	if scheduler == "" {
+		scheduler = smux.PriorityScheduler
+	}
+	newScheduler, err := frames.NewScheduler(scheduler)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	conn := &conn{
+		nc:            c,
+		pool:          pool,
+		isServer:      isServer,
+		streams:       make(map[uint32]*stream),
+		nextID:        1,
+		sendWindow:    defaultWindow,
+		peerWindow:    defaultWindow,
+		peerMaxFrame:  minFrameSize,
+		recvWindow:    cwindow,
+		window:        window,
+		connWindow:    cwindow,
+		maxFrame:      int(t.MaxFrameSize),
+		maxStreams:    t.MaxStreams,
+		windowChanged: make(chan struct{}),
+		sched:         newScheduler(),
+		turns:         make(map[uint32]chan struct{}),
+		wrote:         make(chan struct{}),
+		accept:        make(chan *stream, acceptBacklog),
+		handshook:     make(chan struct{}),
+		closed:        make(chan struct{}),
+	}
+	var w io.Writer = c
+	if isServer {
+		conn.nextID = 2
+		conn.held = &heldWriter{w: c, held: true}
+		w = conn.held
+	}
+	if t.streamIDsLeft > 0 {
+		last := maxStreamID - 1 + conn.nextID%2
+		conn.nextID = last - 2*(t.streamIDsLeft-1)
+	}
+	br := bufio.NewReader(c)
+	conn.fr = xhttp2.NewFramer(w, br)
+	conn.fr.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	conn.henc = hpack.NewEncoder(&conn.hbuf)
+
+	if !isServer {
+		if _, err := io.WriteString(c, xhttp2.ClientPreface); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	settings := []xhttp2.Setting{{ID: xhttp2.SettingInitialWindowSize, Val: uint32(window)}}
+	if t.MaxFrameSize > minFrameSize {
+		settings = append(settings, xhttp2.Setting{ID: xhttp2.SettingMaxFrameSize, Val: t.MaxFrameSize})
+	}
+	if t.MaxStreams > 0 {
+		settings = append(settings, xhttp2.Setting{ID: xhttp2.SettingMaxConcurrentStreams, Val: uint32(t.MaxStreams)})
+	}
+	err = conn.fr.WriteSettings(settings...)
+	if err == nil {
+		err = conn.fr.WriteWindowUpdate(0, uint32(cwindow-defaultWindow))
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	go conn.readLoop(br)
+	return conn, nil
+}
+
+type conn struct {
+	nc       net.Conn
+	isServer bool
+	pool     smux.BufferPool
+
+	// wmu guards writes of frames.
+	wmu  sync.Mutex
+	fr   *xhttp2.Framer
+	henc *hpack.Encoder
+	hbuf bytes.Buffer
+
+	// window and connWindow are the receive windows of each stream and
+	// of the connection, maxFrame the largest DATA frame sent, and
+	// maxStreams the streams open at once, of the Transport, zero being
+	// unlimited for both.
+	window     int
+	connWindow int
+	maxFrame   int
+	maxStreams int
+
+	mu            sync.Mutex
+	streams       map[uint32]*stream
+	nextID        uint32
+	lastPeerID    uint32
+	lastAccepted  uint32 // of the streams of the peer, told in GOAWAY
+	peerAccepted  uint32 // of our streams, as the peer's GOAWAY told
+	sendWindow    int64
+	peerWindow    int64
+	peerMaxFrame  int
+	recvUnacked   int
+	recvWindow    int           // what the peer may still send on the connection
+	windowChanged chan struct{} // closed and replaced when sendWindow grows
+	goAway        bool
+	isClosed      bool
+	closeErr      error // why the connection ended, for Wait
+	eventHandler  func(smux.TraceEvent, smux.Stream)
+	pings         map[[8]byte]chan struct{} // closed once acknowledged
+	pingSeq       uint64
+	pending       []*stream     // opened by the peer past the accept backlog
+	pendingRoom   chan struct{} // closed once pending drops below maxPending
+	writing       int           // Writes in progress, which CloseTimeout waits for
+	wrote         chan struct{} // closed and replaced when writing drops to 0
+
+	// sched orders the DATA frames of the streams waiting for their turn
+	// while one is written, which closing their channel in turns gives
+	// them. They are guarded by mu too.
+	sched       frames.WriteScheduler
+	turns       map[uint32]chan struct{}
+	writingData bool
+
+	// held holds the frames of servers until the client preface is read.
+	held *heldWriter
+
+	accept    chan *stream
+	handshook chan struct{} // closed once the peer's SETTINGS are read
+	closed    chan struct{}
+}
+
+// heldWriter holds what is written until it is released, so that a peer
+// that is not an HTTP/2 client, which a smux.FallbackTransport may hand
+// over to another muxer, sees nothing of the server's frames.
+type heldWriter struct {
+	w io.Writer
+
+	mu   sync.Mutex
+	held bool
+	buf  []byte
+}
+
+func (h *heldWriter) Write(b []byte) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.held {
+		h.buf = append(h.buf, b...)
+		return len(b), nil
+	}
+	return h.w.Write(b)
+}
+
+// release writes what was held, and lets the next writes through.
+func (h *heldWriter) release() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	buf := h.buf
+	h.held, h.buf = false, nil
+	_, err := h.w.Write(buf)
+	return err
+}
+
+// Handshake waits for the peer's SETTINGS, which follow the client preface
+// of clients, and returns smux.ErrConnClosed, or why the connection ended,
+// if it ended first.
+func (c *conn) Handshake() error {
+	select {
+	case <-c.handshook:
+		return nil
+	case <-c.closed:
+	}
+	select {
+	case <-c.handshook:
+		return nil
+	default:
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closeErr != nil {
+		return c.closeErr
+	}
+	return smux.ErrConnClosed
+}
+
+// Close sends GOAWAY, with the last stream of the peer accepted, and
+// closes the underlying net.Conn. The writes of all
+// streams fail with smux.ErrConnClosed, and so do reads once the data
+// already received is read.
+func (c *conn) Close() error {
+	return c.closeBy(time.Now().Add(closeTimeout))
+}
+
+// CloseTimeout closes the connection like Close, but first waits up to
+// timeout for the Writes in progress on its streams, which the windows of
+// the peer may hold back, and then for GOAWAY to be sent.
+func (c *conn) CloseTimeout(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	c.waitWrites(deadline)
+	return c.closeBy(deadline)
+}
+
+// Abort closes the connection and the net.Conn at once, without sending
+// GOAWAY. The writes of its streams fail with
+// smux.ErrConnClosed, and so do reads once the data already received is
+// read, while the peer sees the net.Conn end rather than the connection
+// close.
+func (c *conn) Abort() error {
+	if !c.shutdown(nil) {
+		return nil
+	}
+	return c.nc.Close()
+}
+
+// closeBy closes the connection, giving up on sending GOAWAY at deadline.
+func (c *conn) closeBy(deadline time.Time) error {
+	c.mu.Lock()
+	if c.isClosed {
+		c.mu.Unlock()
+		return nil
+	}
+	lastAccepted := c.lastAccepted
+	c.mu.Unlock()
+
+	c.nc.SetWriteDeadline(deadline)
+	c.wmu.Lock()
+	c.fr.WriteGoAway(lastAccepted, xhttp2.ErrCodeNo, nil)
+	c.wmu.Unlock()
+
+	if !c.shutdown(nil) {
+		// the read loop closed the connection already, when the peer
+		// did.
+		return nil
+	}
+	return c.nc.Close()
+}
+
+// startWrite and endWrite count the Writes in progress on the streams, which
+// CloseTimeout waits for.
+func (c *conn) startWrite() {
+	c.mu.Lock()
+	c.writing++
+	c.mu.Unlock()
+}
+
+func (c *conn) endWrite() {
+	c.mu.Lock()
+	c.writing--
+	if c.writing == 0 {
+		close(c.wrote)
+		c.wrote = make(chan struct{})
+	}
+	c.mu.Unlock()
+}
+
+// waitTurn waits for the write scheduler to give s the turn to write a
+// DATA frame, so that the frames of the streams writing at once are
+// written in its order, and endTurn passes the turn on. Other frames are
+// written as they are sent.
+func (c *conn) waitTurn(s *stream) {
+	c.mu.Lock()
+	if !c.writingData {
+		c.writingData = true
+		c.mu.Unlock()
+		return
+	}
+	turn := make(chan struct{})
+	c.turns[s.id] = turn
+	c.sched.Push(uint64(s.id))
+	c.mu.Unlock()
+	<-turn
+}
+
+func (c *conn) endTurn() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id, ok := c.sched.Pop()
+	if !ok {
+		c.writingData = false
+		return
+	}
+	close(c.turns[uint32(id)])
+	delete(c.turns, uint32(id))
+}
+
+// waitWrites waits for the Writes in progress to be done, or for the
+// connection to close or deadline to pass.
+func (c *conn) waitWrites(deadline time.Time) {
+	c.mu.Lock()
+	writing, wrote := c.writing, c.wrote
+	c.mu.Unlock()
+	if writing == 0 {
+		return
+	}
+	t := time.NewTimer(time.Until(deadline))
+	defer t.Stop()
+	select {
+	case <-wrote:
+	case <-c.closed:
+	case <-t.C:
+	}
+}
+
+// shutdown marks the connection closed, for the reason err, and fails its
+// streams. It returns false if the connection was closed already, in which
+// case whoever closed it closes the underlying net.Conn.
+func (c *conn) shutdown(err error) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.isClosed {
+		return false
+	}
+	c.isClosed = true
+	c.closeErr = err
+	close(c.closed)
+	for id, s := range c.streams {
+		s.broadcast()
+		delete(c.streams, id)
+	}
+	close(c.windowChanged)
+	c.windowChanged = make(chan struct{})
+	return true
+}
+
+// Wait waits for the connection to be closed, and returns why:
+// smux.ErrGoAway if the peer sent GOAWAY before closing it.
+func (c *conn) Wait() error {
+	<-c.closed
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closeErr
+}
+
+func (c *conn) IsClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Ping sends a PING frame, and returns the time it took the peer to
+// acknowledge it.
+func (c *conn) Ping() (time.Duration, error) {
+	c.mu.Lock()
+	if c.isClosed {
+		c.mu.Unlock()
+		return 0, smux.ErrConnClosed
+	}
+	if c.pings == nil {
+		c.pings = make(map[[8]byte]chan struct{})
+	}
+	c.pingSeq++
+	var data [8]byte
+	binary.BigEndian.PutUint64(data[:], c.pingSeq)
+	pong := make(chan struct{})
+	c.pings[data] = pong
+	c.mu.Unlock()
+
+	start := time.Now()
+	c.wmu.Lock()
+	err := c.writeErr(c.fr.WritePing(false, data))
+	c.wmu.Unlock()
+	if err == nil {
+		select {
+		case <-pong:
+			return time.Since(start), nil
+		case <-c.closed:
+			err = smux.ErrConnClosed
+		}
+	}
+	c.mu.Lock()
+	delete(c.pings, data)
+	c.mu.Unlock()
+	return 0, err
+}
+
+// NumStreams returns the number of streams neither reset nor both closed
+// and read to EOF.
+func (c *conn) NumStreams() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.streams)
+}
+
+// NetConn returns the net.Conn the connection runs over.
+func (c *conn) NetConn() net.Conn {
+	return c.nc
+}
+
+func (c *conn) OpenStream() (smux.Stream, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.mu.Lock()
+	if c.isClosed || c.goAway {
+		c.mu.Unlock()
+		return nil, smux.ErrConnClosed
+	}
+	if c.maxStreams > 0 && len(c.streams) >= c.maxStreams {
+		c.mu.Unlock()
+		return nil, smux.ErrTooManyStreams
+	}
+	if c.nextID > maxStreamID {
+		c.mu.Unlock()
+		return nil, smux.ErrTooManyStreams
+	}
+	s := c.newStream(c.nextID)
+	s.sentHeaders = true
+	c.nextID += 2
+	c.mu.Unlock()
+
+	// stream IDs must be used in order, so the header block is sent
+	// under wmu with the ID allocation.
+	err := c.writeHeaders(s.id, false, [][2]string{
+		{":method", "POST"},
+		{":scheme", "http"},
+		{":authority", "smux"},
+		{":path", "/"},
+	})
+	if err != nil {
+		c.mu.Lock()
+		s.unregister()
+		c.mu.Unlock()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (c *conn) AcceptStream() (smux.Stream, error) {
+	select {
+	case s := <-c.accept:
+		return c.accepted(s)
+	case <-c.closed:
+		return nil, smux.ErrConnClosed
+	}
+}
+
+// AcceptStreamContext accepts a stream like AcceptStream, until ctx is
+// done.
+func (c *conn) AcceptStreamContext(ctx context.Context) (smux.Stream, error) {
+	select {
+	case s := <-c.accept:
+		return c.accepted(s)
+	case <-c.closed:
+		return nil, smux.ErrConnClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// accepted records s as accepted, for the GOAWAY of Close. Streams still
+// in the backlog then were not, and the peer may retry them, so that a
+// stream taken from the backlog of a connection closed meanwhile, as
+// select picks either, is not accepted.
+func (c *conn) accepted(s *stream) (smux.Stream, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.isClosed {
+		return nil, smux.ErrConnClosed
+	}
+	if s.id > c.lastAccepted {
+		c.lastAccepted = s.id
+	}
+	return s, nil
+}
+
+// SetEventHandler registers h to be told when the writes of streams stall
+// on the stream's or the connection's send window, and resume.
+func (c *conn) SetEventHandler(h func(ev smux.TraceEvent, s smux.Stream)) {
+	c.mu.Lock()
+	c.eventHandler = h
+	c.mu.Unlock()
+}
+
+// event reports ev to the handler of SetEventHandler, if any. It must be
+// called without c.mu held.
+func (c *conn) event(ev smux.TraceEvent, s smux.Stream) {
+	c.mu.Lock()
+	h := c.eventHandler
+	c.mu.Unlock()
+	if h != nil {
+		h(ev, s)
+	}
+}
+
+// LastAcceptedStreamID returns the last of our streams the peer accepted,
+// once it sent GOAWAY.
+func (c *conn) LastAcceptedStreamID() (uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return uint64(c.peerAccepted), c.goAway
+}
+
+// newStream registers a new stream. It must be called with c.mu held.
+func (c *conn) newStream(id uint32) *stream {
+	s := &stream{
+		conn:       c,
+		id:         id,
+		changed:    make(chan struct{}),
+		sendWindow: c.peerWindow,
+		recvWindow: c.window,
+		window:     c.window,
+	}
+	c.streams[id] = s
+	return s
+}
+
+// writeHeaders sends a header block. It must be called with c.wmu held.
+func (c *conn) writeHeaders(id uint32, endStream bool, fields [][2]string) error {
+	c.hbuf.Reset()
+	for _, f := range fields {
+		c.henc.WriteField(hpack.HeaderField{Name: f[0], Value: f[1]})
+	}
+	err := c.fr.WriteHeaders(xhttp2.HeadersFrameParam{
+		StreamID:      id,
+		BlockFragment: c.hbuf.Bytes(),
+		EndStream:     endStream,
+		EndHeaders:    true,
+	})
+	return c.writeErr(err)
+}
+
+// writeErr closes the connection after a failed write, whose error is
+// returned as smux.ErrConnClosed. It must be called with c.wmu held.
+func (c *conn) writeErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	if c.shutdown(err) {
+		c.nc.Close()
+	}
+	return smux.ErrConnClosed
+}
+
+// writeWindowUpdates gives the peer n more bytes of send window on stream
+// id and connN more on the connection, skipping zero values.
+func (c *conn) writeWindowUpdates(id uint32, n, connN int) {
+	if n == 0 && connN == 0 {
+		return
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if n > 0 {
+		if err := c.writeErr(c.fr.WriteWindowUpdate(id, uint32(n))); err != nil {
+			return
+		}
+	}
+	if connN > 0 {
+		c.writeErr(c.fr.WriteWindowUpdate(0, uint32(connN)))
+	}
+}
+
+// consumed records that n bytes received on the connection were read or
+// discarded, and returns the connection window increment to send, if it
+// is due. It must be called with c.mu held.
+func (c *conn) consumed(n int) int {
+	c.recvUnacked += n
+	if c.recvUnacked < c.connWindow/2 {
+		return 0
+	}
+	n, c.recvUnacked = c.recvUnacked, 0
+	c.recvWindow += n
+	return n
+}
+
+func (c *conn) readLoop(br *bufio.Reader) {
+	var err error
+	defer func() {
+		if c.shutdown(err) {
+			c.nc.Close()
+		}
+	}()
+
+	if c.isServer {
+		preface := make([]byte, len(xhttp2.ClientPreface))
+		if _, err = io.ReadFull(br, preface); err == nil && string(preface) != xhttp2.ClientPreface {
+			err = errBadPreface
+		}
+		if err != nil {
+			// not an HTTP/2 client.
+			return
+		}
+		if err = c.held.release(); err != nil {
+			return
+		}
+	}
+	for {
+		var f xhttp2.Frame
+		f, err = c.fr.ReadFrame()
+		if err != nil {
+			if se, ok := err.(xhttp2.StreamError); ok {
+				c.resetRemote(se.StreamID, xhttp2.ErrCodeProtocol, true)
+				continue
+			}
+			c.mu.Lock()
+			if c.goAway {
+				err = smux.ErrGoAway
+			}
+			c.mu.Unlock()
+			return
+		}
+		if !c.handleFrame(f) {
+			return
+		}
+	}
+}
+
+// queueAccept hands s, just opened by the peer, to AcceptStream. Past the
+// backlog, s waits in c.pending, which feedAccept moves to the backlog as
+// streams are accepted, so that a full backlog does not stop the read loop
+// and the streams already open keep flowing. Once c.pending holds
+// maxPending streams, queueAccept waits for room, stopping the read loop
+// until the application accepts.
+func (c *conn) queueAccept(s *stream) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.pending) == 0 {
+		select {
+		case c.accept <- s:
+			return
+		default:
+		}
+	}
+	c.pending = append(c.pending, s)
+	if len(c.pending) == 1 {
+		go c.feedAccept()
+	}
+	if len(c.pending) < maxPending {
+		return
+	}
+	room := make(chan struct{})
+	c.pendingRoom = room
+	c.mu.Unlock()
+	select {
+	case <-room:
+	case <-c.closed:
+	}
+	c.mu.Lock()
+}
+
+// feedAccept moves the streams of c.pending to the backlog, in order, until
+// none is left or the connection closes.
+func (c *conn) feedAccept() {
+	c.mu.Lock()
+	for len(c.pending) > 0 {
+		s := c.pending[0]
+		c.mu.Unlock()
+		select {
+		case c.accept <- s:
+		case <-c.closed:
+			return
+		}
+		c.mu.Lock()
+		c.pending[0] = nil
+		c.pending = c.pending[1:]
+		if c.pendingRoom != nil {
+			close(c.pendingRoom)
+			c.pendingRoom = nil
+		}
+	}
+	c.mu.Unlock()
+}
+
+// handleFrame processes a frame read from the peer, and returns false if
+// the connection must be closed.
+func (c *conn) handleFrame(f xhttp2.Frame) bool {
+	switch f := f.(type) {
+	case *xhttp2.SettingsFrame:
+		if f.IsAck() {
+			return true
+		}
+		select {
+		case <-c.handshook:
+		default:
+			close(c.handshook)
+		}
+		c.mu.Lock()
+		f.ForeachSetting(func(s xhttp2.Setting) error {
+			switch s.ID {
+			case xhttp2.SettingInitialWindowSize:
+				delta := int64(s.Val) - c.peerWindow
+				c.peerWindow = int64(s.Val)
+				for _, st := range c.streams {
+					st.sendWindow += delta
+					st.broadcast()
+				}
+			case xhttp2.SettingMaxFrameSize:
+				c.peerMaxFrame = int(s.Val)
+			}
+			return nil
+		})
+		c.mu.Unlock()
+		c.wmu.Lock()
+		err := c.writeErr(c.fr.WriteSettingsAck())
+		c.wmu.Unlock()
+		return err == nil
+
+	case *xhttp2.MetaHeadersFrame:
+		id := f.StreamID
+		c.mu.Lock()
+		s, ok := c.streams[id]
+		if !ok {
+			if id%2 == c.nextID%2 || id <= c.lastPeerID || c.isClosed {
+				// not a new stream of the peer: it was reset or
+				// ended already.
+				c.mu.Unlock()
+				return true
+			}
+			c.lastPeerID = id
+			if c.maxStreams > 0 && len(c.streams) >= c.maxStreams {
+				c.mu.Unlock()
+				c.wmu.Lock()
+				err := c.writeErr(c.fr.WriteRSTStream(id, xhttp2.ErrCodeRefusedStream))
+				c.wmu.Unlock()
+				return err == nil
+			}
+			s = c.newStream(id)
+			if f.StreamEnded() {
+				s.remoteEnd()
+			}
+			c.mu.Unlock()
+			c.queueAccept(s)
+			return true
+		}
+		if f.StreamEnded() {
+			s.remoteEnd()
+		}
+		c.mu.Unlock()
+		return true
+
+	case *xhttp2.DataFrame:
+		// padding counts against the windows like data.
+		length := int(f.Header().Length)
+		c.mu.Lock()
+		if length > c.recvWindow {
+			c.mu.Unlock()
+			c.fail(xhttp2.ErrCodeFlowControl, errFlowControl)
+			return false
+		}
+		c.recvWindow -= length
+		s, ok := c.streams[f.StreamID]
+		var streamN, connN int
+		switch {
+		case !ok:
+			connN = c.consumed(length)
+		case length > s.recvWindow:
+			// the peer ignores the window of the stream.
+			connN = c.consumed(length)
+			c.mu.Unlock()
+			c.writeWindowUpdates(0, 0, connN)
+			c.resetRemote(f.StreamID, xhttp2.ErrCodeFlowControl, true)
+			return true
+		case s.readClosed:
+			// discarded, and credited right away.
+			streamN, connN = s.credit(length), c.consumed(length)
+			if f.StreamEnded() {
+				s.remoteEnd()
+			}
+		default:
+			s.recvWindow -= length
+			s.queue(f.Data())
+			// padding is consumed right away.
+			if padding := length - len(f.Data()); padding > 0 {
+				streamN, connN = s.credit(padding), c.consumed(padding)
+			}
+			if f.StreamEnded() {
+				s.remoteEnd()
+			}
+			s.broadcast()
+		}
+		c.mu.Unlock()
+		c.writeWindowUpdates(f.StreamID, streamN, connN)
+		return true
+
+	case *xhttp2.WindowUpdateFrame:
+		c.mu.Lock()
+		if f.StreamID == 0 {
+			c.sendWindow += int64(f.Increment)
+			close(c.windowChanged)
+			c.windowChanged = make(chan struct{})
+		} else if s, ok := c.streams[f.StreamID]; ok {
+			s.sendWindow += int64(f.Increment)
+			s.broadcast()
+		}
+		c.mu.Unlock()
+		return true
+
+	case *xhttp2.RSTStreamFrame:
+		c.resetRemote(f.StreamID, f.ErrCode, false)
+		return true
+
+	case *xhttp2.PriorityFrame:
+		c.mu.Lock()
+		if _, ok := c.streams[f.StreamID]; ok {
+			c.sched.SetPriority(uint64(f.StreamID), int(f.Weight)-defaultWeight)
+		}
+		c.mu.Unlock()
+		return true
+
+	case *xhttp2.PingFrame:
+		if f.IsAck() {
+			c.mu.Lock()
+			if pong, ok := c.pings[f.Data]; ok {
+				close(pong)
+				delete(c.pings, f.Data)
+			}
+			c.mu.Unlock()
+			return true
+		}
+		c.wmu.Lock()
+		err := c.writeErr(c.fr.WritePing(true, f.Data))
+		c.wmu.Unlock()
+		return err == nil
+
+	case *xhttp2.GoAwayFrame:
+		c.mu.Lock()
+		c.goAway = true
+		c.peerAccepted = f.LastStreamID
+		c.mu.Unlock()
+		return true
+	}
+	return true
+}
+
+// fail sends GOAWAY with code, for the connection error err, which the
+// connection is then shut down for.
+func (c *conn) fail(code xhttp2.ErrCode, err error) {
+	c.mu.Lock()
+	lastPeerID := c.lastPeerID
+	c.mu.Unlock()
+	c.nc.SetWriteDeadline(time.Now().Add(closeTimeout))
+	c.wmu.Lock()
+	c.fr.WriteGoAway(lastPeerID, code, nil)
+	c.wmu.Unlock()
+	if c.shutdown(err) {
+		c.nc.Close()
+	}
+}
+
+// resetRemote resets stream id after the peer reset it with code, or after
+// a stream error which is then reported to the peer with code.
+func (c *conn) resetRemote(id uint32, code xhttp2.ErrCode, report bool) {
+	var err error = smux.StreamError{Code: uint32(code)}
+	if report || code == xhttp2.ErrCodeCancel || code == xhttp2.ErrCodeNo {
+		err = smux.ErrReset
+	}
+	c.mu.Lock()
+	s, ok := c.streams[id]
+	var connN int
+	switch {
+	case !ok:
+	case code == xhttp2.ErrCodeNo && s.recvEOF && !report:
+		// the peer has all it wants, and stops us sending, as it may
+		// once it sent a complete response: what it sent stays
+		// readable.
+		s.writeClosed = true
+		s.forgetIfDone()
+		s.broadcast()
+	default:
+		connN = s.reset(err)
+	}
+	c.mu.Unlock()
+	if report {
+		c.wmu.Lock()
+		c.writeErr(c.fr.WriteRSTStream(id, code))
+		c.wmu.Unlock()
+	}
+	c.writeWindowUpdates(0, 0, connN)
+}
@@ -0,0 +1,530 @@
+package http2
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	smux "github.com/dms3-p2p/go-stream-muxer"
+	xhttp2 "golang.org/x/net/http2"
+)
+
+// stream is an HTTP/2 stream. Its state is guarded by conn.mu.
+type stream struct {
+	conn *conn
+	id   uint32
+
+	// wlock serializes Write and Close, so that the header block and
+	// END_STREAM are sent in order with DATA frames.
+	wlock sync.Mutex
+
+	changed     chan struct{} // closed and replaced on every change
+	recv        []byte        // unread, in recvBuf
+	recvBuf     []byte        // from conn.pool, while there is data to read
+	recvEOF     bool          // the peer sent END_STREAM
+	unacked     int           // bytes read but not credited to the peer yet
+	recvWindow  int           // what the peer may still send on the stream
+	window      int           // the receive window, of SetReceiveWindow
+	sendWindow  int64
+	sentHeaders bool
+	writeClosed bool
+	readClosed  bool // by CloseRead: data received is discarded
+	isReset     bool
+	resetErr    error // of reads and writes once reset
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// ID returns the HTTP/2 stream ID.
+func (s *stream) ID() uint64 {
+	return uint64(s.id)
+}
+
+// Conn returns the connection of the stream.
+func (s *stream) Conn() smux.Conn {
+	return s.conn
+}
+
+// broadcast wakes the reads and writes waiting on s. It must be called
+// with conn.mu held.
+func (s *stream) broadcast() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// wait waits for s to change, or for the connection send window to grow
+// if sending is true, or for deadline to pass, and returns
+// smux.ErrTimeout if it already has. It must be called with conn.mu held.
+func (s *stream) wait(deadline time.Time, sending bool) error {
+	c := s.conn
+	ch := s.changed
+	var windowChanged chan struct{}
+	if sending {
+		windowChanged = c.windowChanged
+	}
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return smux.ErrTimeout
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+	c.mu.Unlock()
+	select {
+	case <-ch:
+	case <-windowChanged:
+	case <-timeout:
+	}
+	c.mu.Lock()
+	return nil
+}
+
+// credit records that n bytes received on s were read or discarded, and
+// returns the stream window increment to send, if it is due. It must be
+// called with conn.mu held.
+func (s *stream) credit(n int) int {
+	if s.recvEOF {
+		// the peer sends nothing more.
+		return 0
+	}
+	s.unacked += n
+	if s.unacked < s.window/2 {
+		return 0
+	}
+	n, s.unacked = s.unacked, 0
+	s.recvWindow += n
+	return n
+}
+
+// SetReceiveWindow sets the receive window of the stream to n bytes, which
+// the WINDOW_UPDATEs of the reads that follow grow to, so that a window set
+// on a stream nothing reads grants the peer nothing it cannot take back.
+// A smaller window withholds credit until the data the peer was allowed
+// already is read down to it. Empty windows are not supported.
+func (s *stream) SetReceiveWindow(n uint32) error {
+	c := s.conn
+	if n == 0 || n > maxWindow {
+		return smux.ErrNotSupported
+	}
+	c.mu.Lock()
+	s.unacked += int(n) - s.window
+	s.window = int(n)
+	c.mu.Unlock()
+	return nil
+}
+
+// SetPriority sets the priority of the DATA frames of the stream, and
+// sends it to the peer in a PRIORITY frame, clamped to the weights of RFC
+// 7540.
+func (s *stream) SetPriority(p int) error {
+	c := s.conn
+	c.mu.Lock()
+	if c.streams[s.id] != s {
+		// reset or ended: nothing more is written.
+		c.mu.Unlock()
+		return nil
+	}
+	c.sched.SetPriority(uint64(s.id), p)
+	c.mu.Unlock()
+
+	weight := defaultWeight + p
+	if weight < 0 {
+		weight = 0
+	} else if weight > 255 {
+		weight = 255
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.writeErr(c.fr.WritePriority(s.id, xhttp2.PriorityParam{Weight: uint8(weight)}))
+}
+
+// remoteEnd records END_STREAM from the peer. It must be called with
+// conn.mu held.
+func (s *stream) remoteEnd() {
+	s.recvEOF = true
+	s.forgetIfDone()
+	s.broadcast()
+}
+
+// forgetIfDone unregisters s once both sides sent END_STREAM. It must be
+// called with conn.mu held.
+func (s *stream) forgetIfDone() {
+	if s.writeClosed && s.recvEOF {
+		s.unregister()
+	}
+}
+
+// unregister forgets s, and its priority. It must be called with conn.mu
+// held.
+func (s *stream) unregister() {
+	delete(s.conn.streams, s.id)
+	s.conn.sched.SetPriority(uint64(s.id), smux.DefaultPriority)
+}
+
+// reset discards the received data and unregisters s, failing its reads
+// and writes with err, and returns the connection window increment to
+// send, if it is due. It must be called with conn.mu held.
+func (s *stream) reset(err error) int {
+	if s.isReset {
+		return 0
+	}
+	s.isReset = true
+	s.resetErr = err
+	n := len(s.recv)
+	s.releaseRecv()
+	s.unregister()
+	s.broadcast()
+	return s.conn.consumed(n)
+}
+
+// queue appends p to the data to read, moving it to a larger buffer of
+// the pool if it does not fit. The buffer at least doubles, so that
+// appending to a large backlog, past the size classes of the pool, does not
+// copy it all again for every frame. It must be called with conn.mu held.
+func (s *stream) queue(p []byte) {
+	if len(s.recv)+len(p) > cap(s.recv) {
+		size := len(s.recv) + len(p)
+		if size < 2*len(s.recv) {
+			size = 2 * len(s.recv)
+		}
+		buf := s.conn.pool.Get(size)
+		n := copy(buf, s.recv)
+		s.releaseRecv()
+		s.recvBuf, s.recv = buf, buf[:n]
+	}
+	s.recv = append(s.recv, p...)
+}
+
+// releaseRecv discards the data to read and puts its buffer back in the
+// pool. It must be called with conn.mu held.
+func (s *stream) releaseRecv() {
+	if s.recvBuf != nil {
+		s.conn.pool.Put(s.recvBuf)
+	}
+	s.recvBuf, s.recv = nil, nil
+}
+
+func (s *stream) Read(b []byte) (int, error) {
+	n, _, err := s.read(b, false)
+	return n, err
+}
+
+// ReadBuffer returns the data received next in the buffer it was received
+// in, without copying it. The caller owns the buffer until it hands it
+// back with ReleaseBuffer.
+func (s *stream) ReadBuffer() ([]byte, error) {
+	_, buf, err := s.read(nil, true)
+	return buf, err
+}
+
+// ReleaseBuffer puts a buffer returned by ReadBuffer back in the pool.
+func (s *stream) ReleaseBuffer(b []byte) {
+	s.conn.pool.Put(b)
+}
+
+// read copies the data received next to b, or with take, hands out the
+// buffer it is in instead.
+func (s *stream) read(b []byte, take bool) (int, []byte, error) {
+	c := s.conn
+	c.mu.Lock()
+	for {
+		switch {
+		case s.isReset:
+			c.mu.Unlock()
+			return 0, nil, s.resetErr
+		case s.readClosed:
+			c.mu.Unlock()
+			return 0, nil, smux.ErrReset
+		case len(s.recv) > 0:
+			var n int
+			var buf []byte
+			if take {
+				buf, n = s.recv, len(s.recv)
+				s.recvBuf, s.recv = nil, nil
+			} else {
+				n = copy(b, s.recv)
+				s.recv = s.recv[n:]
+				if len(s.recv) == 0 {
+					// idle streams hold no buffer.
+					s.releaseRecv()
+				}
+			}
+			streamN, connN := s.credit(n), c.consumed(n)
+			closed := c.isClosed
+			c.mu.Unlock()
+			if !closed {
+				c.writeWindowUpdates(s.id, streamN, connN)
+			}
+			return n, buf, nil
+		case s.recvEOF:
+			c.mu.Unlock()
+			return 0, nil, io.EOF
+		case c.isClosed:
+			c.mu.Unlock()
+			return 0, nil, smux.ErrConnClosed
+		case len(b) == 0 && !take:
+			c.mu.Unlock()
+			return 0, nil, nil
+		}
+		if err := s.wait(s.readDeadline, false); err != nil {
+			c.mu.Unlock()
+			return 0, nil, err
+		}
+	}
+}
+
+// Write sends b in DATA frames as the stream and connection send windows
+// allow.
+func (s *stream) Write(b []byte) (int, error) {
+	s.wlock.Lock()
+	defer s.wlock.Unlock()
+
+	c := s.conn
+	c.startWrite()
+	defer c.endWrite()
+	n := 0
+	// stalled is set while waiting for the send windows, which ends with
+	// EventWindowResume, also when the write fails meanwhile.
+	stalled := false
+	defer func() {
+		if stalled {
+			c.event(smux.EventWindowResume, s)
+		}
+	}()
+	c.mu.Lock()
+	for {
+		switch {
+		case s.isReset:
+			c.mu.Unlock()
+			return n, s.resetErr
+		case c.isClosed:
+			c.mu.Unlock()
+			return n, smux.ErrConnClosed
+		case s.writeClosed:
+			c.mu.Unlock()
+			return n, smux.ErrStreamClosed
+		case n == len(b):
+			c.mu.Unlock()
+			return n, nil
+		}
+
+		chunk := int64(len(b) - n)
+		if max := int64(c.peerMaxFrame); chunk > max {
+			chunk = max
+		}
+		if max := int64(c.maxFrame); max > 0 && chunk > max {
+			chunk = max
+		}
+		if chunk > s.sendWindow {
+			chunk = s.sendWindow
+		}
+		if chunk > c.sendWindow {
+			chunk = c.sendWindow
+		}
+		if chunk <= 0 {
+			if !stalled {
+				stalled = true
+				c.mu.Unlock()
+				c.event(smux.EventWindowStall, s)
+				c.mu.Lock()
+				continue
+			}
+			if err := s.wait(s.writeDeadline, true); err != nil {
+				c.mu.Unlock()
+				return n, err
+			}
+			continue
+		}
+		s.sendWindow -= chunk
+		c.sendWindow -= chunk
+		headers := !s.sentHeaders
+		s.sentHeaders = true
+		c.mu.Unlock()
+		if stalled {
+			stalled = false
+			c.event(smux.EventWindowResume, s)
+		}
+
+		c.waitTurn(s)
+		err := s.writeData(headers, b[n:n+int(chunk)], false)
+		c.endTurn()
+		if err != nil {
+			return n, err
+		}
+		n += int(chunk)
+		c.mu.Lock()
+	}
+}
+
+// writeData sends the response header block first if headers is true,
+// then data, and END_STREAM if end is true.
+func (s *stream) writeData(headers bool, data []byte, end bool) error {
+	c := s.conn
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	// nothing is sent after RST_STREAM, which Reset sends under wmu.
+	c.mu.Lock()
+	reset, err := s.isReset, s.resetErr
+	c.mu.Unlock()
+	if reset {
+		return err
+	}
+
+	if headers {
+		endStream := end && len(data) == 0
+		if err := c.writeHeaders(s.id, endStream, [][2]string{{":status", "200"}}); err != nil || endStream {
+			return err
+		}
+	}
+	return c.writeErr(c.fr.WriteData(s.id, end, data))
+}
+
+// Close sends END_STREAM.
+func (s *stream) Close() error {
+	s.wlock.Lock()
+	defer s.wlock.Unlock()
+
+	c := s.conn
+	c.mu.Lock()
+	switch {
+	case s.isReset || s.writeClosed:
+		c.mu.Unlock()
+		return nil
+	case c.isClosed:
+		c.mu.Unlock()
+		return smux.ErrConnClosed
+	}
+	s.writeClosed = true
+	headers := !s.sentHeaders
+	s.sentHeaders = true
+	s.forgetIfDone()
+	c.mu.Unlock()
+
+	if err := s.writeData(headers, nil, true); err != nil {
+		return err
+	}
+	s.stopIfDone()
+	return nil
+}
+
+// CloseWrite sends END_STREAM, like Close.
+func (s *stream) CloseWrite() error {
+	return s.Close()
+}
+
+// CloseRead discards the data received on the stream, and that the peer
+// sends later, still crediting it to the flow control windows, and fails
+// reads with smux.ErrReset, while writing keeps working. Once the stream is
+// closed for writing too, RST_STREAM with NO_ERROR tells the peer to stop
+// sending, as RFC 7540 lets a server do after a complete response.
+func (s *stream) CloseRead() error {
+	c := s.conn
+	c.mu.Lock()
+	if s.isReset || s.readClosed {
+		c.mu.Unlock()
+		return nil
+	}
+	s.readClosed = true
+	n := len(s.recv)
+	s.releaseRecv()
+	streamN, connN := s.credit(n), c.consumed(n)
+	s.broadcast()
+	closed := c.isClosed
+	c.mu.Unlock()
+
+	if closed {
+		return nil
+	}
+	c.writeWindowUpdates(s.id, streamN, connN)
+	s.stopIfDone()
+	return nil
+}
+
+// stopIfDone sends RST_STREAM with NO_ERROR once s is closed for reading
+// and writing before the peer sent END_STREAM, and unregisters it.
+func (s *stream) stopIfDone() {
+	c := s.conn
+	c.mu.Lock()
+	if !s.readClosed || !s.writeClosed || s.recvEOF || s.isReset {
+		c.mu.Unlock()
+		return
+	}
+	connN := s.reset(smux.ErrReset)
+	c.mu.Unlock()
+
+	c.wmu.Lock()
+	c.writeErr(c.fr.WriteRSTStream(s.id, xhttp2.ErrCodeNo))
+	c.wmu.Unlock()
+	c.writeWindowUpdates(0, 0, connN)
+}
+
+// Reset sends RST_STREAM, unless both sides sent END_STREAM already, and
+// fails the reads and writes of the stream with smux.ErrReset.
+func (s *stream) Reset() error {
+	return s.resetWith(xhttp2.ErrCodeCancel)
+}
+
+// ResetWithError resets the stream like Reset, with code as the error code
+// of RST_STREAM. The peer reads the codes of HTTP/2, CANCEL, which Reset
+// sends, and NO_ERROR, as smux.ErrReset, and all others as a
+// smux.StreamError.
+func (s *stream) ResetWithError(code uint32) error {
+	if code == 0 {
+		return s.Reset()
+	}
+	return s.resetWith(xhttp2.ErrCode(code))
+}
+
+func (s *stream) resetWith(code xhttp2.ErrCode) error {
+	c := s.conn
+	c.mu.Lock()
+	if s.isReset {
+		c.mu.Unlock()
+		return nil
+	}
+	ended := s.writeClosed && s.recvEOF
+	connN := s.reset(smux.ErrReset)
+	closed := c.isClosed
+	c.mu.Unlock()
+
+	if closed {
+		return nil
+	}
+	if !ended {
+		c.wmu.Lock()
+		c.writeErr(c.fr.WriteRSTStream(s.id, code))
+		c.wmu.Unlock()
+	}
+	c.writeWindowUpdates(0, 0, connN)
+	return nil
+}
+
+func (s *stream) SetDeadline(t time.Time) error {
+	s.conn.mu.Lock()
+	defer s.conn.mu.Unlock()
+	s.readDeadline = t
+	s.writeDeadline = t
+	s.broadcast()
+	return nil
+}
+
+func (s *stream) SetReadDeadline(t time.Time) error {
+	s.conn.mu.Lock()
+	defer s.conn.mu.Unlock()
+	s.readDeadline = t
+	s.broadcast()
+	return nil
+}
+
+func (s *stream) SetWriteDeadline(t time.Time) error {
+	s.conn.mu.Lock()
+	defer s.conn.mu.Unlock()
+	s.writeDeadline = t
+	s.broadcast()
+	return nil
+}
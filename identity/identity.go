@@ -0,0 +1,138 @@
+// Package identity provides a degenerate stream muxer carrying exactly one
+// stream directly on the underlying net.Conn, without any framing. The
+// dialing side opens the stream and the listening side accepts it.
+//
+// It is a baseline to measure muxers against, a fallback for negotiation
+// with peers that cannot mux, and a minimal reference implementation of
+// the interfaces. Of the conformance suite, it passes the subtests using a
+// single stream per connection.
+package identity
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	smux "github.com/dms3-p2p/go-stream-muxer"
+)
+
+// ErrOneStream is returned when opening or accepting a second stream, or
+// opening one on the listening side.
+var ErrOneStream = errors.New("identity transport supports a single stream")
+
+// Transport is the identity transport.
+type Transport struct{}
+
+// DefaultTransport is the identity transport.
+var DefaultTransport Transport
+
+// Features returns the features of identity connections: the deadlines of
+// the net.Conn, and nothing a multiplexer adds.
+func (Transport) Features() smux.Features {
+	return smux.FeatureDeadlines
+}
+
+// NewConn wraps c as a connection carrying a single stream.
+func (Transport) NewConn(c net.Conn, isServer bool) (smux.Conn, error) {
+	conn := &Conn{
+		stream: Stream{c},
+		accept: isServer,
+		closed: make(chan struct{}),
+		taken:  make(chan struct{}, 1),
+	}
+	conn.taken <- struct{}{}
+	return conn, nil
+}
+
+// Conn is a connection of the identity transport.
+type Conn struct {
+	stream Stream
+	accept bool
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	taken     chan struct{}
+}
+
+// Close closes the underlying net.Conn.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.stream.Conn.Close()
+}
+
+// IsClosed returns whether Close was called.
+func (c *Conn) IsClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// NetConn returns the underlying net.Conn.
+func (c *Conn) NetConn() net.Conn {
+	return c.stream.Conn
+}
+
+// OpenStream returns the stream on the dialing side, once.
+func (c *Conn) OpenStream() (smux.Stream, error) {
+	if c.accept {
+		return nil, ErrOneStream
+	}
+	select {
+	case <-c.taken:
+		return c.stream, nil
+	default:
+		return nil, ErrOneStream
+	}
+}
+
+// AcceptStream returns the stream on the listening side, once. Further
+// calls, and all calls on the dialing side, block until the connection is
+// closed.
+func (c *Conn) AcceptStream() (smux.Stream, error) {
+	if c.accept {
+		select {
+		case <-c.taken:
+			return c.stream, nil
+		case <-c.closed:
+		}
+	} else {
+		<-c.closed
+	}
+	return nil, ErrOneStream
+}
+
+// LocalAddr returns the local address of the underlying net.Conn.
+func (c *Conn) LocalAddr() net.Addr {
+	return c.stream.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the underlying net.Conn.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.stream.RemoteAddr()
+}
+
+// Stream is the stream of an identity connection: the net.Conn itself.
+type Stream struct {
+	net.Conn
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Close closes the stream for writing if the net.Conn supports it, like
+// *net.TCPConn, and closes the net.Conn otherwise.
+func (s Stream) Close() error {
+	if cw, ok := s.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return s.Conn.Close()
+}
+
+// Reset closes the net.Conn.
+func (s Stream) Reset() error {
+	return s.Conn.Close()
+}
@@ -0,0 +1,173 @@
+package streammux
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// WithIdleTimeout wraps c to reset the streams it opens and accepts once
+// no data was read or written on them for timeout, which reaps the
+// streams long-lived sessions accumulate as applications forget them. The
+// reads and writes of a stream reset that way return ErrTimeout, and the
+// peer's ErrReset. Streams closed and read to EOF are not reaped. It
+// enforces Options.StreamIdleTimeout.
+func WithIdleTimeout(c Conn, timeout time.Duration) Conn {
+	return &idleTimeoutConn{Conn: c, timeout: timeout}
+}
+
+type idleTimeoutConn struct {
+	Conn
+	timeout time.Duration
+}
+
+func (c *idleTimeoutConn) unwrapConn() Conn {
+	return c.Conn
+}
+
+func (c *idleTimeoutConn) OpenStream() (Stream, error) {
+	s, err := c.Conn.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return newIdleStream(s, c), nil
+}
+
+func (c *idleTimeoutConn) AcceptStream() (Stream, error) {
+	s, err := c.Conn.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return newIdleStream(s, c), nil
+}
+
+// idleWriteChunk is the most an idleStream passes on to its stream in one
+// write. It is below the receive windows streams start with, so that a
+// write waiting for the peer to read records activity as its chunks go
+// out, rather than only once it returns.
+const idleWriteChunk = 16 << 10
+
+type idleStream struct {
+	Stream
+	conn    *idleTimeoutConn
+	timeout time.Duration
+	end     streamEnd
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	last    time.Time
+	expired bool
+	stopped bool
+}
+
+func newIdleStream(s Stream, c *idleTimeoutConn) *idleStream {
+	is := &idleStream{Stream: s, conn: c, timeout: c.timeout, last: time.Now()}
+	is.mu.Lock()
+	is.timer = time.AfterFunc(c.timeout, is.check)
+	is.mu.Unlock()
+	return is
+}
+
+func (s *idleStream) unwrapStream() Stream {
+	return s.Stream
+}
+
+func (s *idleStream) Conn() Conn {
+	return s.conn
+}
+
+// check resets the stream if it has been idle for the timeout, and waits
+// for the rest of it otherwise. Activity only records its time, rather
+// than rearming the timer on every read and write.
+func (s *idleStream) check() {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return
+	}
+	if idle := time.Since(s.last); idle < s.timeout {
+		s.timer.Reset(s.timeout - idle)
+		s.mu.Unlock()
+		return
+	}
+	s.expired = true
+	s.stopped = true
+	s.mu.Unlock()
+	s.Stream.Reset()
+}
+
+func (s *idleStream) active() {
+	s.mu.Lock()
+	s.last = time.Now()
+	s.mu.Unlock()
+}
+
+// translate returns ErrTimeout for the errors of a stream reset as idle.
+func (s *idleStream) translate(err error) error {
+	if err == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.expired {
+		return ErrTimeout
+	}
+	return err
+}
+
+func (s *idleStream) finish(write, read, reset bool) {
+	if s.end.done(write, read, reset) {
+		s.mu.Lock()
+		s.stopped = true
+		s.timer.Stop()
+		s.mu.Unlock()
+	}
+}
+
+func (s *idleStream) Read(b []byte) (int, error) {
+	n, err := s.Stream.Read(b)
+	if n > 0 {
+		s.active()
+	}
+	switch {
+	case err == io.EOF:
+		s.finish(false, true, false)
+	case isReset(err):
+		s.finish(false, false, true)
+	}
+	return n, s.translate(err)
+}
+
+func (s *idleStream) Write(b []byte) (int, error) {
+	written := 0
+	for {
+		p := b
+		if len(p) > idleWriteChunk {
+			p = p[:idleWriteChunk]
+		}
+		n, err := s.Stream.Write(p)
+		written += n
+		if n > 0 {
+			s.active()
+		}
+		if err != nil {
+			return written, s.translate(err)
+		}
+		b = b[len(p):]
+		if len(b) == 0 {
+			return written, nil
+		}
+	}
+}
+
+func (s *idleStream) Close() error {
+	err := s.Stream.Close()
+	s.finish(true, false, false)
+	return s.translate(err)
+}
+
+func (s *idleStream) Reset() error {
+	err := s.Stream.Reset()
+	s.finish(false, false, true)
+	return err
+}
@@ -0,0 +1,42 @@
+package streammux
+
+// StreamIDer is implemented by Streams exposing the ID their muxer assigned
+// them. Both sides of a connection see the same ID for a stream, and IDs
+// are unique per connection.
+type StreamIDer interface {
+	ID() uint64
+}
+
+// streamWrapper is implemented by the Stream wrappers of this package, so
+// that the optional interfaces of the streams they wrap can still be found.
+type streamWrapper interface {
+	unwrapStream() Stream
+}
+
+// findStream returns the first of s and the streams it wraps for which is
+// returns true.
+func findStream(s Stream, is func(Stream) bool) (Stream, bool) {
+	for {
+		if is(s) {
+			return s, true
+		}
+		w, ok := s.(streamWrapper)
+		if !ok {
+			return nil, false
+		}
+		s = w.unwrapStream()
+	}
+}
+
+// StreamID returns the muxer-assigned ID of s, looking through the
+// wrappers of this package. ok is false if the muxer does not expose IDs.
+func StreamID(s Stream) (id uint64, ok bool) {
+	s, ok = findStream(s, func(s Stream) bool {
+		_, ok := s.(StreamIDer)
+		return ok
+	})
+	if !ok {
+		return 0, false
+	}
+	return s.(StreamIDer).ID(), true
+}
@@ -0,0 +1,31 @@
+// Package testhooks lets the tests of the module reach states of the
+// bundled muxers that take too long to reach through their API, without
+// adding to it.
+package testhooks
+
+import (
+	smux "github.com/dms3-p2p/go-stream-muxer"
+)
+
+// streamIDsLeft are the functions of RegisterStreamIDsLeft.
+var streamIDsLeft []func(tr smux.Transport, n uint32) (smux.Transport, bool)
+
+// RegisterStreamIDsLeft registers f, which returns a copy of tr whose
+// connections can open n streams from each side before they use up the
+// stream IDs of their wire format, or false if tr is not a transport of
+// the muxer registering f. Muxers register in their init.
+func RegisterStreamIDsLeft(f func(tr smux.Transport, n uint32) (smux.Transport, bool)) {
+	streamIDsLeft = append(streamIDsLeft, f)
+}
+
+// WithStreamIDsLeft returns a copy of tr whose connections can open n
+// streams from each side before they use up their stream IDs, or false
+// if the muxer of tr registered no function for it.
+func WithStreamIDsLeft(tr smux.Transport, n uint32) (smux.Transport, bool) {
+	for _, f := range streamIDsLeft {
+		if tr, ok := f(tr, n); ok {
+			return tr, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,160 @@
+package streammux
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultKeepAliveFailures is the number of consecutive unanswered pings
+// after which the connections of WithKeepAlive are found dead, unless
+// given another.
+const DefaultKeepAliveFailures = 3
+
+// WithKeepAlive wraps tr so that its connections ping the peer every
+// interval, as Options.KeepAliveInterval has muxers with keepalives of
+// their own do, and are closed once failures pings in a row went
+// unanswered for an interval each, which closes their CloseChan and fails
+// the streams, and makes their Wait return ErrKeepAliveTimeout. Zero
+// failures means DefaultKeepAliveFailures. The connections are PingConns,
+// pinging with the muxer's native pings if it has them, and over the
+// control stream of WithPing otherwise, in which case both sides must be
+// wrapped.
+func WithKeepAlive(tr Transport, interval time.Duration, failures int) Transport {
+	if failures == 0 {
+		failures = DefaultKeepAliveFailures
+	}
+	t := &keepAliveTransport{inner: tr, interval: interval, failures: failures}
+	if _, ok := tr.(FeatureTransport); ok {
+		return featureKeepAliveTransport{t}
+	}
+	return t
+}
+
+type keepAliveTransport struct {
+	inner    Transport
+	interval time.Duration
+	failures int
+}
+
+// featureKeepAliveTransport is the keepAliveTransport of a
+// FeatureTransport, which has the same features but for those of
+// connections, Wait excepted.
+type featureKeepAliveTransport struct {
+	*keepAliveTransport
+}
+
+func (t featureKeepAliveTransport) Features() Features {
+	f, _ := TransportFeatures(t.inner)
+	return f &^ (connFeatures &^ FeatureWait)
+}
+
+func (t *keepAliveTransport) NewConn(c net.Conn, isServer bool) (Conn, error) {
+	return t.wrap(t.inner.NewConn(c, isServer))
+}
+
+func (t *keepAliveTransport) NewConnRWC(rwc io.ReadWriteCloser, isServer bool) (Conn, error) {
+	return t.wrap(NewConnRWC(t.inner, rwc, isServer))
+}
+
+func (t *keepAliveTransport) wrap(c Conn, err error) (Conn, error) {
+	if err != nil {
+		return nil, err
+	}
+	pc, ok := c.(PingConn)
+	if !ok {
+		if pc, err = WithPing(c); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	kc := &keepAliveConn{
+		PingConn: pc,
+		interval: t.interval,
+		failures: t.failures,
+		done:     make(chan struct{}),
+		expired:  make(chan struct{}),
+	}
+	go kc.loop()
+	return kc, nil
+}
+
+type keepAliveConn struct {
+	PingConn
+	interval time.Duration
+	failures int
+
+	closeOnce sync.Once
+	done      chan struct{} // closed by Close
+	expired   chan struct{} // closed by loop before it closes the connection
+
+	chanOnce sync.Once
+	closeCh  <-chan struct{}
+}
+
+func (c *keepAliveConn) unwrapConn() Conn {
+	return c.PingConn
+}
+
+// loop pings the peer every interval, one ping at a time, and closes the
+// connection once failures ticks in a row found the last ping unanswered
+// or failed.
+func (c *keepAliveConn) loop() {
+	t := time.NewTicker(c.interval)
+	defer t.Stop()
+
+	var pong chan error // of the ping in flight, if any
+	missed := 0
+	for {
+		select {
+		case <-c.done:
+			return
+		case err := <-pong:
+			pong = nil
+			if err == nil {
+				missed = 0
+				continue
+			}
+			missed++
+		case <-t.C:
+			if pong != nil {
+				missed++
+				break
+			}
+			pong = make(chan error, 1)
+			go func(pong chan<- error) {
+				_, err := c.PingConn.Ping()
+				pong <- err
+			}(pong)
+		}
+		if missed >= c.failures {
+			close(c.expired)
+			c.Close()
+			return
+		}
+	}
+}
+
+func (c *keepAliveConn) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+	return c.PingConn.Close()
+}
+
+func (c *keepAliveConn) CloseChan() <-chan struct{} {
+	c.chanOnce.Do(func() { c.closeCh = CloseChan(c.PingConn) })
+	return c.closeCh
+}
+
+// Wait waits for the connection to be closed, and returns
+// ErrKeepAliveTimeout if it was for its pings going unanswered, and why
+// the inner connection ended otherwise.
+func (c *keepAliveConn) Wait() error {
+	err := Wait(c.PingConn)
+	select {
+	case <-c.expired:
+		return ErrKeepAliveTimeout
+	default:
+		return err
+	}
+}
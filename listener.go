@@ -0,0 +1,78 @@
+package streammux
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// ErrListenerClosed is returned by the Accept method of NetListeners that
+// were closed.
+var ErrListenerClosed = errors.New("stream listener closed")
+
+// NetListener returns a net.Listener accepting the streams of c as
+// net.Conns, e.g. to serve HTTP or gRPC over a muxed connection. Closing
+// the listener stops accepting streams, resetting those the peer opens
+// from then on, but does not close c. The listener owns c's AcceptStream.
+func NetListener(c Conn) net.Listener {
+	l := &streamListener{
+		conn:     c,
+		accepted: make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+type streamListener struct {
+	conn     Conn
+	accepted chan net.Conn
+
+	// done is closed with err set once accepting stopped.
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+func (l *streamListener) stop(err error) {
+	l.closeOnce.Do(func() {
+		l.err = err
+		close(l.done)
+	})
+}
+
+func (l *streamListener) acceptLoop() {
+	for {
+		s, err := l.conn.AcceptStream()
+		if err != nil {
+			l.stop(err)
+			return
+		}
+		select {
+		case l.accepted <- NetConn(l.conn, s):
+		case <-l.done:
+			s.Reset()
+		}
+	}
+}
+
+func (l *streamListener) Accept() (net.Conn, error) {
+	select {
+	case nc := <-l.accepted:
+		return nc, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+func (l *streamListener) Close() error {
+	l.stop(ErrListenerClosed)
+	return nil
+}
+
+func (l *streamListener) Addr() net.Addr {
+	if ac, ok := l.conn.(AddrConn); ok {
+		return ac.LocalAddr()
+	}
+	return muxAddr{}
+}
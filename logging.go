@@ -0,0 +1,204 @@
+package streammux
+
+import (
+	"encoding/hex"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Logger is the logging interface of LoggingTransport, satisfied by
+// *log.Logger.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// DefaultDumpRate is the rate at which LoggingTransports hex dump data by
+// default, in bytes per second.
+const DefaultDumpRate = 64 << 10
+
+// LoggingTransport wraps a transport to log the life of its connections
+// and streams, for debugging misbehaving muxers.
+type LoggingTransport struct {
+	inner  Transport
+	logger Logger
+
+	// HexDump makes the transport also dump the data read and written
+	// on every stream.
+	HexDump bool
+
+	// DumpRate limits hex dumps to that many bytes per second across the
+	// transport; data beyond it is only counted. Zero means
+	// DefaultDumpRate.
+	DumpRate int
+
+	conns uint64
+
+	mu         sync.Mutex
+	dumpBudget int
+	refilled   time.Time
+}
+
+// NewLoggingTransport returns a transport establishing connections with
+// inner and logging their events to logger.
+func NewLoggingTransport(inner Transport, logger Logger) *LoggingTransport {
+	return &LoggingTransport{inner: inner, logger: logger}
+}
+
+// dumpAllowance returns how many of n bytes may be dumped now.
+func (t *LoggingTransport) dumpAllowance(n int) int {
+	rate := t.DumpRate
+	if rate == 0 {
+		rate = DefaultDumpRate
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if elapsed := now.Sub(t.refilled); elapsed > 0 {
+		t.dumpBudget += int(elapsed.Seconds() * float64(rate))
+		if t.dumpBudget > rate {
+			t.dumpBudget = rate
+		}
+		t.refilled = now
+	}
+	if n > t.dumpBudget {
+		n = t.dumpBudget
+	}
+	t.dumpBudget -= n
+	return n
+}
+
+// NewConn establishes a connection with the inner transport and logs it.
+func (t *LoggingTransport) NewConn(c net.Conn, isServer bool) (Conn, error) {
+	conn, err := t.inner.NewConn(c, isServer)
+	return t.wrap(conn, err, c.RemoteAddr(), isServer)
+}
+
+// NewConnRWC establishes a connection over rwc with the inner transport,
+// as NewConnRWC would, and logs it.
+func (t *LoggingTransport) NewConnRWC(rwc io.ReadWriteCloser, isServer bool) (Conn, error) {
+	conn, err := NewConnRWC(t.inner, rwc, isServer)
+	return t.wrap(conn, err, RWCNetConn(rwc).RemoteAddr(), isServer)
+}
+
+func (t *LoggingTransport) wrap(conn Conn, err error, remote net.Addr, isServer bool) (Conn, error) {
+	id := atomic.AddUint64(&t.conns, 1)
+	if err != nil {
+		t.logger.Printf("smux: conn %d to %s: failed: %s", id, remote, err)
+		return nil, err
+	}
+	t.logger.Printf("smux: conn %d to %s: established (server: %t)", id, remote, isServer)
+	return &loggingConn{Conn: conn, tr: t, id: id}, nil
+}
+
+type loggingConn struct {
+	Conn
+	tr      *LoggingTransport
+	id      uint64
+	streams uint64
+}
+
+func (c *loggingConn) unwrapConn() Conn {
+	return c.Conn
+}
+
+func (c *loggingConn) logf(format string, v ...interface{}) {
+	c.tr.logger.Printf("smux: conn %d: "+format, append([]interface{}{c.id}, v...)...)
+}
+
+func (c *loggingConn) Close() error {
+	err := c.Conn.Close()
+	c.logf("closed (error: %v)", err)
+	return err
+}
+
+func (c *loggingConn) wrap(s Stream, how string) Stream {
+	id, ok := StreamID(s)
+	if !ok {
+		id = atomic.AddUint64(&c.streams, 1)
+	}
+	ls := &loggingStream{Stream: s, conn: c, id: id}
+	ls.logf("%s", how)
+	return ls
+}
+
+func (c *loggingConn) OpenStream() (Stream, error) {
+	s, err := c.Conn.OpenStream()
+	if err != nil {
+		c.logf("opening stream failed: %s", err)
+		return nil, err
+	}
+	return c.wrap(s, "opened"), nil
+}
+
+func (c *loggingConn) AcceptStream() (Stream, error) {
+	s, err := c.Conn.AcceptStream()
+	if err != nil {
+		c.logf("accepting stream failed: %s", err)
+		return nil, err
+	}
+	return c.wrap(s, "accepted"), nil
+}
+
+type loggingStream struct {
+	Stream
+	conn *loggingConn
+	id   uint64
+}
+
+func (s *loggingStream) unwrapStream() Stream {
+	return s.Stream
+}
+
+func (s *loggingStream) Conn() Conn {
+	return s.conn
+}
+
+func (s *loggingStream) logf(format string, v ...interface{}) {
+	s.conn.logf("stream %d: "+format, append([]interface{}{s.id}, v...)...)
+}
+
+func (s *loggingStream) logData(op string, b []byte, err error) {
+	if err != nil {
+		s.logf("%s %d bytes, error: %s", op, len(b), err)
+	}
+	if !s.conn.tr.HexDump || len(b) == 0 {
+		return
+	}
+	n := s.conn.tr.dumpAllowance(len(b))
+	switch {
+	case n == 0:
+		s.logf("%s %d bytes (not dumped, rate limited)", op, len(b))
+	case n < len(b):
+		s.logf("%s %d bytes (%d not dumped, rate limited):\n%s", op, len(b), len(b)-n, hex.Dump(b[:n]))
+	default:
+		s.logf("%s %d bytes:\n%s", op, len(b), hex.Dump(b))
+	}
+}
+
+func (s *loggingStream) Read(b []byte) (int, error) {
+	n, err := s.Stream.Read(b)
+	s.logData("read", b[:n], err)
+	return n, err
+}
+
+func (s *loggingStream) Write(b []byte) (int, error) {
+	n, err := s.Stream.Write(b)
+	s.logData("wrote", b[:n], err)
+	return n, err
+}
+
+func (s *loggingStream) Close() error {
+	err := s.Stream.Close()
+	s.logf("closed (error: %v)", err)
+	return err
+}
+
+func (s *loggingStream) Reset() error {
+	err := s.Stream.Reset()
+	s.logf("reset (error: %v)", err)
+	return err
+}
@@ -0,0 +1,127 @@
+package streammux
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// ErrTooManyStreams is returned by OpenStream on connections wrapped by
+// WithMaxStreams which have as many streams open as they allow, and by the
+// muxers enforcing Options.MaxStreams themselves. Muxers whose connections
+// used up their stream IDs return it too, as they can open no more.
+var ErrTooManyStreams = errors.New("too many streams open on the connection")
+
+// WithMaxStreams wraps c to allow at most max streams open at once, opened
+// and accepted together, for muxers that do not enforce Options.MaxStreams
+// themselves. Past it, OpenStream fails with ErrTooManyStreams without
+// reaching the peer, and the streams the peer opens are reset as they are
+// accepted, which defends servers against peers opening streams forever.
+// As with WithStreamTracking, a stream is open until it is reset, or
+// closed and read to EOF.
+func WithMaxStreams(c Conn, max int) Conn {
+	return &maxStreamsConn{Conn: c, max: max}
+}
+
+type maxStreamsConn struct {
+	Conn
+	max int
+
+	mu   sync.Mutex
+	open int
+}
+
+func (c *maxStreamsConn) unwrapConn() Conn {
+	return c.Conn
+}
+
+// acquire counts a stream as open, if there is room for it.
+func (c *maxStreamsConn) acquire() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.open >= c.max {
+		return false
+	}
+	c.open++
+	return true
+}
+
+func (c *maxStreamsConn) release() {
+	c.mu.Lock()
+	c.open--
+	c.mu.Unlock()
+}
+
+func (c *maxStreamsConn) OpenStream() (Stream, error) {
+	if !c.acquire() {
+		return nil, ErrTooManyStreams
+	}
+	s, err := c.Conn.OpenStream()
+	if err != nil {
+		c.release()
+		return nil, err
+	}
+	return &limitedStream{Stream: s, conn: c}, nil
+}
+
+func (c *maxStreamsConn) AcceptStream() (Stream, error) {
+	for {
+		s, err := c.Conn.AcceptStream()
+		if err != nil {
+			return nil, err
+		}
+		if c.acquire() {
+			return &limitedStream{Stream: s, conn: c}, nil
+		}
+		s.Reset()
+	}
+}
+
+func (c *maxStreamsConn) NumStreams() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.open
+}
+
+type limitedStream struct {
+	Stream
+	conn *maxStreamsConn
+	end  streamEnd
+}
+
+func (s *limitedStream) unwrapStream() Stream {
+	return s.Stream
+}
+
+func (s *limitedStream) Conn() Conn {
+	return s.conn
+}
+
+func (s *limitedStream) finish(write, read, reset bool) {
+	if s.end.done(write, read, reset) {
+		s.conn.release()
+	}
+}
+
+func (s *limitedStream) Read(b []byte) (int, error) {
+	n, err := s.Stream.Read(b)
+	switch {
+	case err == io.EOF:
+		s.finish(false, true, false)
+	case isReset(err):
+		s.finish(false, false, true)
+	}
+	return n, err
+}
+
+func (s *limitedStream) Close() error {
+	err := s.Stream.Close()
+	s.finish(true, false, false)
+	return err
+}
+
+func (s *limitedStream) Reset() error {
+	err := s.Stream.Reset()
+	s.finish(false, false, true)
+	return err
+}
@@ -0,0 +1,355 @@
+// Package memconn provides an in-process stream muxer whose streams are
+// buffered in-memory pipes, without any framing or copying through a
+// net.Conn. It is a fast, dependency-free fake for unit tests of code
+// using streams, and a baseline for benchmarking muxers.
+//
+// Pair returns two connected Conns directly. The Transport instead
+// pairs up the Conns it creates over the two ends of a net.Conn, by
+// their addresses, so it also works with code that dials and listens and
+// with the test suite. The net.Conn itself carries no data, so wrappers of
+// it, injecting latency for example, have no effect, as the
+// smux.FeatureNoWire of the Transport declares; closing it closes the
+// Conns.
+package memconn
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	smux "github.com/dms3-p2p/go-stream-muxer"
+)
+
+// DefaultBufferSize is the default size of the buffer of each direction of
+// a stream, playing the part of a muxer's receive window.
+const DefaultBufferSize = 256 << 10
+
+// acceptBacklog is the number of streams opened by a peer that can wait to
+// be accepted before OpenStream blocks.
+const acceptBacklog = 256
+
+// Transport pairs up Conns established over the two ends of a net.Conn,
+// which must have distinct local and remote addresses, as those of TCP
+// do. Both ends must be established with the same Transport, in the same
+// process.
+type Transport struct {
+	// BufferSize is the size of the buffer of each direction of a stream.
+	// Zero means DefaultBufferSize.
+	BufferSize int
+
+	mu      sync.Mutex
+	pending map[string]*Conn
+}
+
+// DefaultTransport is the Transport with default settings.
+var DefaultTransport = &Transport{}
+
+// Pair returns two connected Conns, a dialer and a listener, with default
+// settings.
+func Pair() (*Conn, *Conn) {
+	return DefaultTransport.Pair()
+}
+
+// Pair returns two connected Conns, a dialer and a listener.
+func (t *Transport) Pair() (*Conn, *Conn) {
+	a, b := t.newConn(nil, false), t.newConn(nil, true)
+	link(a, b)
+	return a, b
+}
+
+// Features returns the features of in-memory connections.
+func (t *Transport) Features() smux.Features {
+	return smux.FeatureMultiplex | smux.FeatureReset | smux.FeatureDeadlines |
+		smux.FeatureHalfClose | smux.FeatureStreamIDs | smux.FeatureReceiveWindow |
+		smux.FeatureResetCodes | smux.FeatureNoWire | smux.FeatureLinger | smux.FeatureAbort
+}
+
+// NewConn establishes a Conn over c, connected to the one established over
+// the other end of c once there is one. Until then, opening streams
+// blocks.
+func (t *Transport) NewConn(c net.Conn, isServer bool) (smux.Conn, error) {
+	conn := t.newConn(c, isServer)
+	local, remote := c.LocalAddr().String(), c.RemoteAddr().String()
+	key := local + " " + remote
+
+	t.mu.Lock()
+	if t.pending == nil {
+		t.pending = make(map[string]*Conn)
+	}
+	peer, ok := t.pending[remote+" "+local]
+	if ok {
+		delete(t.pending, remote+" "+local)
+	} else {
+		t.pending[key] = conn
+	}
+	t.mu.Unlock()
+
+	if ok {
+		link(conn, peer)
+	}
+	go func() {
+		// Nothing is written to c, so reading it only ends when it is
+		// closed, by either side.
+		io.Copy(ioutil.Discard, c)
+		conn.Close()
+		t.mu.Lock()
+		if t.pending[key] == conn {
+			delete(t.pending, key)
+		}
+		t.mu.Unlock()
+	}()
+	return conn, nil
+}
+
+func (t *Transport) newConn(c net.Conn, isServer bool) *Conn {
+	size := t.BufferSize
+	if size == 0 {
+		size = DefaultBufferSize
+	}
+	conn := &Conn{
+		nc:      c,
+		size:    size,
+		linked:  make(chan struct{}),
+		accept:  make(chan *Stream, acceptBacklog),
+		closed:  make(chan struct{}),
+		streams: make(map[*Stream]struct{}),
+		nextID:  1,
+	}
+	if isServer {
+		conn.nextID = 2
+	}
+	return conn
+}
+
+func link(a, b *Conn) {
+	a.mu.Lock()
+	a.peer = b
+	a.mu.Unlock()
+	b.mu.Lock()
+	b.peer = a
+	b.mu.Unlock()
+	close(a.linked)
+	close(b.linked)
+}
+
+// Conn is a memconn connection.
+type Conn struct {
+	nc     net.Conn
+	size   int
+	linked chan struct{}
+	accept chan *Stream
+	closed chan struct{}
+
+	mu       sync.Mutex
+	peer     *Conn
+	streams  map[*Stream]struct{}
+	nextID   uint64
+	isClosed bool
+}
+
+// Close closes the connection, its peer and the net.Conn, if any. The
+// writes of all their streams fail with smux.ErrConnClosed, and so do
+// reads once the data already written is read.
+func (c *Conn) Close() error {
+	return c.close(false)
+}
+
+// Abort closes the connection, its peer and the net.Conn, if any, like
+// Close, but discards the data buffered on their streams, which fail at
+// once with smux.ErrConnClosed.
+func (c *Conn) Abort() error {
+	return c.close(true)
+}
+
+// close closes the connection like Close, or like Abort if abort is true.
+func (c *Conn) close(abort bool) error {
+	c.mu.Lock()
+	if c.isClosed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.isClosed = true
+	close(c.closed)
+	streams := c.streams
+	c.streams = nil
+	peer := c.peer
+	c.mu.Unlock()
+
+	for s := range streams {
+		if abort {
+			s.abort(smux.ErrConnClosed)
+		} else {
+			s.fail(smux.ErrConnClosed)
+		}
+	}
+	if peer != nil {
+		peer.close(abort)
+	}
+	if c.nc != nil {
+		return c.nc.Close()
+	}
+	return nil
+}
+
+// CloseTimeout closes the connection like Close, but first waits up to
+// timeout for the writes in progress on its streams to fit in the buffers
+// of the peer, where the data stays readable once the connection is
+// closed.
+func (c *Conn) CloseTimeout(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	c.mu.Lock()
+	streams := make([]*Stream, 0, len(c.streams))
+	for s := range c.streams {
+		streams = append(streams, s)
+	}
+	c.mu.Unlock()
+	for _, s := range streams {
+		s.out.drain(deadline)
+	}
+	return c.Close()
+}
+
+// IsClosed returns whether the connection is closed.
+func (c *Conn) IsClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// NetConn returns the net.Conn the connection was established over, which
+// carries none of its data, or nil for the Conns of Pair.
+func (c *Conn) NetConn() net.Conn {
+	return c.nc
+}
+
+// OpenStream opens a stream, blocking until the peer is connected and has
+// room in its accept backlog.
+func (c *Conn) OpenStream() (smux.Stream, error) {
+	select {
+	case <-c.linked:
+	case <-c.closed:
+		return nil, smux.ErrConnClosed
+	}
+
+	c.mu.Lock()
+	if c.isClosed {
+		c.mu.Unlock()
+		return nil, smux.ErrConnClosed
+	}
+	id := c.nextID
+	c.nextID += 2
+	peer := c.peer
+	c.mu.Unlock()
+
+	out, in := newPipe(peer.size), newPipe(c.size)
+	local := &Stream{id: id, conn: c, in: in, out: out}
+	remote := &Stream{id: id, conn: peer, in: out, out: in}
+	if !c.track(local) || !peer.track(remote) {
+		local.fail(smux.ErrConnClosed)
+		return nil, smux.ErrConnClosed
+	}
+	select {
+	case peer.accept <- remote:
+		return local, nil
+	case <-c.closed:
+	case <-peer.closed:
+	}
+	local.fail(smux.ErrConnClosed)
+	return nil, smux.ErrConnClosed
+}
+
+// AcceptStream accepts a stream opened by the peer.
+func (c *Conn) AcceptStream() (smux.Stream, error) {
+	select {
+	case s := <-c.accept:
+		return c.accepted(s)
+	case <-c.closed:
+		return nil, smux.ErrConnClosed
+	}
+}
+
+// accepted returns s, a stream taken from the accept queue, unless the
+// connection was closed meanwhile, which already failed s.
+func (c *Conn) accepted(s smux.Stream) (smux.Stream, error) {
+	if c.IsClosed() {
+		return nil, smux.ErrConnClosed
+	}
+	return s, nil
+}
+
+// AcceptStreamContext accepts a stream opened by the peer, until ctx is
+// done.
+func (c *Conn) AcceptStreamContext(ctx context.Context) (smux.Stream, error) {
+	select {
+	case s := <-c.accept:
+		return c.accepted(s)
+	case <-c.closed:
+		return nil, smux.ErrConnClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// NumStreams returns the number of streams neither reset nor both closed
+// and read to EOF.
+func (c *Conn) NumStreams() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.streams)
+}
+
+// Streams returns the streams counted by NumStreams.
+func (c *Conn) Streams() []smux.Stream {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	streams := make([]smux.Stream, 0, len(c.streams))
+	for s := range c.streams {
+		streams = append(streams, s)
+	}
+	return streams
+}
+
+// LocalAddr returns the local address of the net.Conn, or a placeholder
+// "memconn" address for Conns returned by Pair.
+func (c *Conn) LocalAddr() net.Addr {
+	if c.nc == nil {
+		return memAddr{}
+	}
+	return c.nc.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the net.Conn, or a
+// placeholder "memconn" address for Conns returned by Pair.
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.nc == nil {
+		return memAddr{}
+	}
+	return c.nc.RemoteAddr()
+}
+
+func (c *Conn) track(s *Stream) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.isClosed {
+		return false
+	}
+	c.streams[s] = struct{}{}
+	return true
+}
+
+func (c *Conn) forget(s *Stream) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.streams, s)
+}
+
+type memAddr struct{}
+
+func (memAddr) Network() string { return "memconn" }
+func (memAddr) String() string  { return "memconn" }
@@ -0,0 +1,326 @@
+package memconn
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	smux "github.com/dms3-p2p/go-stream-muxer"
+)
+
+// pipe is one direction of a stream: a buffer of at most size bytes
+// written by one end and read by the other.
+type pipe struct {
+	mu      sync.Mutex
+	changed chan struct{} // closed and replaced on every change
+
+	data     []byte
+	size     int
+	writers  int   // writes in progress, which drain waits for
+	eof      bool  // the writer closed, data is followed by EOF
+	closeErr error // the connection closed, data is followed by closeErr
+	resetErr error // the stream was reset, data was discarded
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newPipe(size int) *pipe {
+	return &pipe{changed: make(chan struct{}), size: size}
+}
+
+// broadcast wakes all the reads and writes waiting on p. It must be called
+// with p.mu held.
+func (p *pipe) broadcast() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// wait waits for p to change or for deadline to pass, and returns
+// smux.ErrTimeout if it already has. It must be called with p.mu held.
+func (p *pipe) wait(deadline time.Time) error {
+	ch := p.changed
+	if deadline.IsZero() {
+		p.mu.Unlock()
+		<-ch
+		p.mu.Lock()
+		return nil
+	}
+	d := time.Until(deadline)
+	if d <= 0 {
+		return smux.ErrTimeout
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	p.mu.Unlock()
+	select {
+	case <-ch:
+	case <-t.C:
+	}
+	p.mu.Lock()
+	return nil
+}
+
+func (p *pipe) read(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		switch {
+		case p.resetErr != nil:
+			return 0, p.resetErr
+		case len(p.data) > 0:
+			n := copy(b, p.data)
+			p.data = p.data[n:]
+			p.broadcast()
+			return n, nil
+		case p.eof:
+			return 0, io.EOF
+		case p.closeErr != nil:
+			return 0, p.closeErr
+		case len(b) == 0:
+			return 0, nil
+		}
+		if err := p.wait(p.readDeadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (p *pipe) write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.writers++
+	defer func() {
+		p.writers--
+		if p.writers == 0 {
+			p.broadcast()
+		}
+	}()
+	n := 0
+	for {
+		switch {
+		case p.resetErr != nil:
+			return n, p.resetErr
+		case p.closeErr != nil:
+			return n, p.closeErr
+		case p.eof:
+			return n, smux.ErrStreamClosed
+		case n == len(b):
+			return n, nil
+		}
+		if space := p.size - len(p.data); space > 0 {
+			if space > len(b)-n {
+				space = len(b) - n
+			}
+			p.data = append(p.data, b[n:n+space]...)
+			n += space
+			p.broadcast()
+			continue
+		}
+		if err := p.wait(p.writeDeadline); err != nil {
+			return n, err
+		}
+	}
+}
+
+// drain waits for the writes in progress to be done, as the reader makes
+// room for their data, or for deadline to pass.
+func (p *pipe) drain(deadline time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.writers > 0 {
+		if err := p.wait(deadline); err != nil {
+			return
+		}
+	}
+}
+
+// closeWrite makes the reader get EOF after the data written so far.
+func (p *pipe) closeWrite() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.eof {
+		p.eof = true
+		p.broadcast()
+	}
+}
+
+// fail fails all writes with err, and reads once the buffered data is
+// read.
+func (p *pipe) fail(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closeErr == nil {
+		p.closeErr = err
+		p.broadcast()
+	}
+}
+
+// reset discards the buffered data and fails all reads and writes with
+// err.
+func (p *pipe) reset(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.resetErr == nil {
+		p.resetErr = err
+		p.data = nil
+		p.broadcast()
+	}
+}
+
+func (p *pipe) setSize(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.size = n
+	p.broadcast()
+}
+
+func (p *pipe) setReadDeadline(t time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.readDeadline = t
+	p.broadcast()
+}
+
+func (p *pipe) setWriteDeadline(t time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.writeDeadline = t
+	p.broadcast()
+}
+
+// Stream is a stream of a memconn connection, made of one pipe in each
+// direction.
+type Stream struct {
+	id   uint64
+	conn *Conn
+	in   *pipe
+	out  *pipe
+
+	mu          sync.Mutex
+	writeClosed bool
+	readDone    bool
+	ended       bool
+}
+
+// ID returns the ID of the stream, which is the same on both ends.
+func (s *Stream) ID() uint64 {
+	return s.id
+}
+
+// Conn returns the connection of the stream.
+func (s *Stream) Conn() smux.Conn {
+	return s.conn
+}
+
+// Read reads data written by the other end.
+func (s *Stream) Read(b []byte) (int, error) {
+	n, err := s.in.read(b)
+	if err == io.EOF {
+		s.end(false, true)
+	}
+	return n, err
+}
+
+// Write writes data for the other end to read. It blocks while the other
+// end's buffer is full.
+func (s *Stream) Write(b []byte) (int, error) {
+	return s.out.write(b)
+}
+
+// Close closes the stream for writing.
+func (s *Stream) Close() error {
+	s.out.closeWrite()
+	s.end(true, false)
+	return nil
+}
+
+// CloseWrite closes the stream for writing, like Close.
+func (s *Stream) CloseWrite() error {
+	return s.Close()
+}
+
+// CloseRead fails the writes of the other end with smux.ErrReset and
+// discards the data it wrote.
+func (s *Stream) CloseRead() error {
+	s.in.reset(smux.ErrReset)
+	s.end(false, true)
+	return nil
+}
+
+// Reset fails the reads and writes of both ends with smux.ErrReset.
+func (s *Stream) Reset() error {
+	s.in.reset(smux.ErrReset)
+	s.out.reset(smux.ErrReset)
+	s.end(true, true)
+	return nil
+}
+
+// ResetWithError fails the reads and writes of both ends with a
+// smux.StreamError of code, or with smux.ErrReset if code is 0.
+func (s *Stream) ResetWithError(code uint32) error {
+	if code == 0 {
+		return s.Reset()
+	}
+	err := smux.StreamError{Code: code}
+	s.in.reset(err)
+	s.out.reset(err)
+	s.end(true, true)
+	return nil
+}
+
+// SetReceiveWindow sets the buffer size of the data written by the other
+// end.
+func (s *Stream) SetReceiveWindow(n uint32) error {
+	s.in.setSize(int(n))
+	return nil
+}
+
+// SetDeadline sets both the read and write deadlines.
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.in.setReadDeadline(t)
+	s.out.setWriteDeadline(t)
+	return nil
+}
+
+// SetReadDeadline sets the read deadline.
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.in.setReadDeadline(t)
+	return nil
+}
+
+// SetWriteDeadline sets the write deadline.
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.out.setWriteDeadline(t)
+	return nil
+}
+
+// end records that the stream was closed for writing or read to its end,
+// and forgets the stream once both happened.
+func (s *Stream) end(write, read bool) {
+	s.mu.Lock()
+	s.writeClosed = s.writeClosed || write
+	s.readDone = s.readDone || read
+	ended := !s.ended && s.writeClosed && s.readDone
+	if ended {
+		s.ended = true
+	}
+	s.mu.Unlock()
+	if ended {
+		s.conn.forget(s)
+	}
+}
+
+// fail fails both directions of the stream with err, as when its
+// connection is closed, once the data already written is read.
+func (s *Stream) fail(err error) {
+	s.in.fail(err)
+	s.out.fail(err)
+}
+
+// abort discards the data of both directions of the stream, and fails
+// their reads and writes with err, as when its connection is aborted.
+func (s *Stream) abort(err error) {
+	s.in.reset(err)
+	s.out.reset(err)
+}
@@ -0,0 +1,240 @@
+package streammux
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// Names of the metrics reported to a MetricsReporter.
+const (
+	MetricBytesSent       = "bytes_sent"
+	MetricBytesReceived   = "bytes_received"
+	MetricFramesSent      = "frames_sent"
+	MetricFramesReceived  = "frames_received"
+	MetricStreamsOpened   = "streams_opened"
+	MetricStreamsAccepted = "streams_accepted"
+	MetricStreamsReset    = "streams_reset"
+	MetricErrors          = "errors"
+
+	// MetricOpenStreams is a gauge, all others are counters.
+	MetricOpenStreams = "open_streams"
+)
+
+// MetricsReporter receives the metrics of connections, to export them to
+// systems such as Prometheus or statsd. It must be safe for concurrent use
+// and should not block.
+type MetricsReporter interface {
+	// Count adds delta to the counter name.
+	Count(name string, delta uint64)
+	// Gauge sets the gauge name to value.
+	Gauge(name string, value int64)
+}
+
+// MetricsConn is implemented by Conns that report their metrics natively,
+// including the frame counts wrappers cannot see.
+type MetricsConn interface {
+	Conn
+	SetMetricsReporter(m MetricsReporter)
+}
+
+// WithMetrics makes c report to m. A MetricsConn is configured and
+// returned; other Conns are wrapped to report the streams opened and
+// accepted through the wrapper and their data, but no frames. Errors are
+// the stream operations failing other than by EOF or a reset.
+func WithMetrics(c Conn, m MetricsReporter) Conn {
+	return withMetrics(c, &metricsState{m: m})
+}
+
+// metricsState is shared by the connections reporting to a reporter, so
+// that the open streams gauge covers them all.
+type metricsState struct {
+	m MetricsReporter
+
+	// mu orders the gauge updates.
+	mu   sync.Mutex
+	open int64
+}
+
+func (ms *metricsState) addOpen(delta int64) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.open += delta
+	ms.m.Gauge(MetricOpenStreams, ms.open)
+}
+
+func (ms *metricsState) streamStarted(metric string) {
+	ms.m.Count(metric, 1)
+	ms.addOpen(1)
+}
+
+func (ms *metricsState) streamEnded() {
+	ms.addOpen(-1)
+}
+
+func (ms *metricsState) error(err error) {
+	if err != nil && err != io.EOF && !isReset(err) {
+		ms.m.Count(MetricErrors, 1)
+	}
+}
+
+func withMetrics(c Conn, ms *metricsState) Conn {
+	if mc, ok := c.(MetricsConn); ok {
+		mc.SetMetricsReporter(ms.m)
+		return mc
+	}
+	return &metricsConn{Conn: c, ms: ms, streams: make(map[*metricsStream]struct{})}
+}
+
+// MetricsTransport wraps tr so that all its connections report to m, like
+// WithMetrics.
+func MetricsTransport(tr Transport, m MetricsReporter) Transport {
+	return &metricsTransport{tr: tr, ms: &metricsState{m: m}}
+}
+
+type metricsTransport struct {
+	tr Transport
+	ms *metricsState
+}
+
+func (t *metricsTransport) NewConn(c net.Conn, isServer bool) (Conn, error) {
+	return t.wrap(t.tr.NewConn(c, isServer))
+}
+
+func (t *metricsTransport) NewConnRWC(rwc io.ReadWriteCloser, isServer bool) (Conn, error) {
+	return t.wrap(NewConnRWC(t.tr, rwc, isServer))
+}
+
+func (t *metricsTransport) wrap(conn Conn, err error) (Conn, error) {
+	if err != nil {
+		t.ms.error(err)
+		return nil, err
+	}
+	return withMetrics(conn, t.ms), nil
+}
+
+type metricsConn struct {
+	Conn
+	ms *metricsState
+
+	mu      sync.Mutex
+	streams map[*metricsStream]struct{}
+}
+
+func (c *metricsConn) unwrapConn() Conn {
+	return c.Conn
+}
+
+func (c *metricsConn) track(s Stream, metric string) Stream {
+	ms := &metricsStream{Stream: s, conn: c}
+	c.mu.Lock()
+	c.streams[ms] = struct{}{}
+	c.mu.Unlock()
+	c.ms.streamStarted(metric)
+	return ms
+}
+
+// Close ends the streams still open, so that they leave the open streams
+// gauge.
+func (c *metricsConn) Close() error {
+	c.mu.Lock()
+	streams := c.streams
+	c.streams = make(map[*metricsStream]struct{})
+	c.mu.Unlock()
+	for s := range streams {
+		if s.end.done(true, true, false) {
+			c.ms.streamEnded()
+		}
+	}
+	err := c.Conn.Close()
+	c.ms.error(err)
+	return err
+}
+
+func (c *metricsConn) OpenStream() (Stream, error) {
+	s, err := c.Conn.OpenStream()
+	if err != nil {
+		c.ms.error(err)
+		return nil, err
+	}
+	return c.track(s, MetricStreamsOpened), nil
+}
+
+func (c *metricsConn) AcceptStream() (Stream, error) {
+	s, err := c.Conn.AcceptStream()
+	if err != nil {
+		c.ms.error(err)
+		return nil, err
+	}
+	return c.track(s, MetricStreamsAccepted), nil
+}
+
+type metricsStream struct {
+	Stream
+	conn *metricsConn
+	end  streamEnd
+}
+
+func (s *metricsStream) unwrapStream() Stream {
+	return s.Stream
+}
+
+func (s *metricsStream) Conn() Conn {
+	return s.conn
+}
+
+func (s *metricsStream) finish(write, read, reset bool) {
+	if !s.end.done(write, read, reset) {
+		return
+	}
+	c := s.conn
+	c.mu.Lock()
+	delete(c.streams, s)
+	c.mu.Unlock()
+	if reset {
+		c.ms.m.Count(MetricStreamsReset, 1)
+	}
+	c.ms.streamEnded()
+}
+
+func (s *metricsStream) Read(b []byte) (int, error) {
+	n, err := s.Stream.Read(b)
+	if n > 0 {
+		s.conn.ms.m.Count(MetricBytesReceived, uint64(n))
+	}
+	switch {
+	case err == io.EOF:
+		s.finish(false, true, false)
+	case isReset(err):
+		s.finish(false, false, true)
+	default:
+		s.conn.ms.error(err)
+	}
+	return n, err
+}
+
+func (s *metricsStream) Write(b []byte) (int, error) {
+	n, err := s.Stream.Write(b)
+	if n > 0 {
+		s.conn.ms.m.Count(MetricBytesSent, uint64(n))
+	}
+	if isReset(err) {
+		s.finish(false, false, true)
+	}
+	s.conn.ms.error(err)
+	return n, err
+}
+
+func (s *metricsStream) Close() error {
+	err := s.Stream.Close()
+	s.finish(true, false, false)
+	s.conn.ms.error(err)
+	return err
+}
+
+func (s *metricsStream) Reset() error {
+	err := s.Stream.Reset()
+	s.finish(false, false, true)
+	s.conn.ms.error(err)
+	return err
+}
@@ -0,0 +1,31 @@
+package multistream_test
+
+import (
+	"bytes"
+	"testing"
+
+	smux "github.com/dms3-p2p/go-stream-muxer"
+	"github.com/dms3-p2p/go-stream-muxer/http2"
+	"github.com/dms3-p2p/go-stream-muxer/multistream"
+	sm "github.com/dms3-p2p/go-stream-muxer/test"
+	xhttp2 "golang.org/x/net/http2"
+)
+
+// FuzzNegotiate fuzzes the negotiation parser: data is read as the
+// dialer's proposals following the multistream header, for a listener
+// offering http2.
+func FuzzNegotiate(f *testing.F) {
+	var header, seed bytes.Buffer
+	smux.WriteLengthPrefixed(&header, []byte(multistream.ProtocolID+"\n"))
+	smux.WriteLengthPrefixed(&seed, []byte("/unknown/1.0.0\n"))
+	smux.WriteLengthPrefixed(&seed, []byte(http2.ProtocolID+"\n"))
+	seed.WriteString(xhttp2.ClientPreface)
+	f.Add(seed.Bytes())
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		tr := multistream.NewTransport()
+		tr.AddTransport(http2.ProtocolID, http2.DefaultTransport)
+		sm.FuzzTransport(t, tr, header.Bytes(), data)
+	})
+}
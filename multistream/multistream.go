@@ -0,0 +1,422 @@
+// Package multistream provides a Transport negotiating which stream muxer
+// to use with multistream-select, so that peers supporting different sets
+// of muxers can interoperate.
+//
+// The handshake follows multistream-select 1.0.0: every message is a
+// uvarint length followed by the message and "\n". Both sides send the
+// "/multistream/1.0.0" header, then the dialer proposes muxer protocol IDs
+// in its order of preference until the listener echoes one back; the
+// listener answers "na" to those it does not support. The dialer's
+// preferences win. The handshake runs in the background of NewConn, so
+// that both sides of a connection can be established from one goroutine.
+package multistream
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	smux "github.com/dms3-p2p/go-stream-muxer"
+)
+
+// ProtocolID is the multistream-select header.
+const ProtocolID = "/multistream/1.0.0"
+
+// DefaultNegotiateTimeout bounds the handshake of Transports without a
+// NegotiateTimeout.
+const DefaultNegotiateTimeout = 60 * time.Second
+
+// maxMessageSize is the longest handshake message accepted.
+const maxMessageSize = 1024
+
+var (
+	// ErrNoMuxer is returned when the peers have no muxer in common.
+	ErrNoMuxer = errors.New("multistream: no muxer in common with the peer")
+
+	// ErrNoTransports is returned by NewConn on a Transport without muxers.
+	ErrNoTransports = errors.New("multistream: no muxers to negotiate")
+
+	errMessageTooLarge = errors.New("multistream: handshake message too large")
+	errBadMessage      = errors.New("multistream: handshake message not terminated by a newline")
+)
+
+// ErrBadHeader is returned when the peer does not speak multistream-select.
+type ErrBadHeader struct {
+	Header string
+}
+
+func (e ErrBadHeader) Error() string {
+	return fmt.Sprintf("multistream: peer sent header %q, expected %q", e.Header, ProtocolID)
+}
+
+// Transport negotiates one of its muxers on each new connection. It is
+// safe for concurrent use.
+type Transport struct {
+	// NegotiateTimeout bounds the handshake. Zero means
+	// DefaultNegotiateTimeout.
+	NegotiateTimeout time.Duration
+
+	mu    sync.RWMutex
+	order []string
+	trs   map[string]smux.Transport
+}
+
+// NewTransport returns a Transport without muxers.
+func NewTransport() *Transport {
+	return &Transport{trs: make(map[string]smux.Transport)}
+}
+
+// AddTransport adds tr under the protocol id. Muxers are preferred in the
+// order they were added; adding an id again replaces its transport and
+// keeps its rank.
+func (t *Transport) AddTransport(id string, tr smux.Transport) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.trs[id]; !ok {
+		t.order = append(t.order, id)
+	}
+	t.trs[id] = tr
+}
+
+// Protocols returns the protocol IDs of the muxers, in order of preference.
+func (t *Transport) Protocols() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return append([]string(nil), t.order...)
+}
+
+func (t *Transport) get(id string) (smux.Transport, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	tr, ok := t.trs[id]
+	return tr, ok
+}
+
+// Features returns the features all the muxers have, as any of them may be
+// negotiated. Muxers that do not declare their features have none.
+func (t *Transport) Features() smux.Features {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if len(t.trs) == 0 {
+		return 0
+	}
+	f := ^smux.Features(0)
+	for _, tr := range t.trs {
+		trf, _ := smux.TransportFeatures(tr)
+		f &= trf
+	}
+	return f
+}
+
+// WithConfig returns a Transport negotiating the muxers of t, each of them
+// configured with opts, or smux.ErrNotSupported if one of them is not a
+// smux.ConfigurableTransport.
+func (t *Transport) WithConfig(opts smux.Options) (smux.Transport, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	ct := NewTransport()
+	ct.NegotiateTimeout = t.NegotiateTimeout
+	for _, id := range t.order {
+		tr, ok := t.trs[id].(smux.ConfigurableTransport)
+		if !ok {
+			return nil, smux.ErrNotSupported
+		}
+		configured, err := tr.WithConfig(opts)
+		if err != nil {
+			return nil, err
+		}
+		ct.AddTransport(id, configured)
+	}
+	return ct, nil
+}
+
+// NewConn negotiates a muxer with the peer over c in the background, so
+// that it does not wait for the peer, and returns the connection, which
+// establishes the connection of the muxer agreed on once the handshake is
+// done. Opening and accepting streams wait for the handshake, and fail if
+// it failed. The server side is the multistream listener.
+func (t *Transport) NewConn(c net.Conn, isServer bool) (smux.Conn, error) {
+	if len(t.Protocols()) == 0 {
+		return nil, ErrNoTransports
+	}
+	nc := &conn{nc: c, ready: make(chan struct{})}
+	go func() {
+		defer close(nc.ready)
+		id, err := t.Negotiate(c, isServer)
+		if err != nil {
+			nc.mu.Lock()
+			if nc.closing {
+				err = smux.ErrConnClosed
+			}
+			nc.mu.Unlock()
+			nc.err = err
+			c.Close()
+			return
+		}
+		tr, _ := t.get(id)
+		mc, err := tr.NewConn(c, isServer)
+		if err != nil {
+			nc.err = err
+			c.Close()
+			return
+		}
+		nc.mu.Lock()
+		nc.id, nc.Conn = id, mc
+		if er, ok := mc.(smux.EventReporter); ok && nc.eventHandler != nil {
+			er.SetEventHandler(nc.eventHandler)
+		}
+		nc.mu.Unlock()
+	}()
+	return nc, nil
+}
+
+// conn is a connection whose handshake may still be running. Conn, id and
+// err are set once ready is closed. The optional interfaces of connections
+// are those of the muxer agreed on, which Features only declares when all
+// muxers have them.
+type conn struct {
+	smux.Conn
+	id    string
+	err   error
+	nc    net.Conn
+	ready chan struct{}
+
+	mu           sync.Mutex
+	closing      bool                               // Close aborted the handshake
+	eventHandler func(smux.TraceEvent, smux.Stream) // for the muxer agreed on
+
+	closeOnce sync.Once
+}
+
+func (c *conn) wait() error {
+	<-c.ready
+	return c.err
+}
+
+// Handshake waits for the handshake, and for that of the muxer agreed on,
+// and returns why either failed.
+func (c *conn) Handshake() error {
+	if err := c.wait(); err != nil {
+		return err
+	}
+	return smux.Handshake(c.Conn)
+}
+
+// Protocol waits for the handshake, and returns the protocol ID of the
+// muxer agreed on, or why the handshake failed.
+func (c *conn) Protocol() (string, error) {
+	if err := c.wait(); err != nil {
+		return "", err
+	}
+	return c.id, nil
+}
+
+// Close aborts the handshake if it is still running, and closes the
+// connection of the muxer agreed on otherwise.
+func (c *conn) Close() error {
+	return c.closeWith(smux.Conn.Close)
+}
+
+// CloseTimeout closes the connection like Close, lingering as the muxer
+// agreed on does.
+func (c *conn) CloseTimeout(timeout time.Duration) error {
+	return c.closeWith(func(mc smux.Conn) error { return smux.CloseTimeout(mc, timeout) })
+}
+
+// Abort aborts the handshake or the connection of the muxer agreed on.
+func (c *conn) Abort() error {
+	return c.closeWith(smux.Abort)
+}
+
+func (c *conn) closeWith(close func(smux.Conn) error) error {
+	var err error
+	c.closeOnce.Do(func() {
+		select {
+		case <-c.ready:
+		default:
+			c.mu.Lock()
+			c.closing = true
+			c.mu.Unlock()
+			c.nc.Close()
+		}
+		<-c.ready
+		if c.Conn != nil {
+			err = close(c.Conn)
+		}
+	})
+	return err
+}
+
+// SetEventHandler registers h with the muxer agreed on, once it is.
+func (c *conn) SetEventHandler(h func(ev smux.TraceEvent, s smux.Stream)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.eventHandler = h
+	if er, ok := c.Conn.(smux.EventReporter); ok {
+		er.SetEventHandler(h)
+	}
+}
+
+// Wait waits for the connection to be closed, and returns why the
+// handshake failed, nil if Close aborted it, or why the connection of the
+// muxer agreed on ended.
+func (c *conn) Wait() error {
+	switch err := c.wait(); err {
+	case nil:
+		return smux.Wait(c.Conn)
+	case smux.ErrConnClosed:
+		return nil
+	default:
+		return err
+	}
+}
+
+// LastAcceptedStreamID returns that of the muxer agreed on, and false
+// until the handshake is done or if it does not tell.
+func (c *conn) LastAcceptedStreamID() (uint64, bool) {
+	select {
+	case <-c.ready:
+	default:
+		return 0, false
+	}
+	if gc, ok := c.Conn.(smux.GoAwayConn); ok {
+		return gc.LastAcceptedStreamID()
+	}
+	return 0, false
+}
+
+func (c *conn) IsClosed() bool {
+	select {
+	case <-c.ready:
+	default:
+		return false
+	}
+	return c.Conn == nil || c.Conn.IsClosed()
+}
+
+// NetConn returns the net.Conn the handshake and the muxer run over.
+func (c *conn) NetConn() net.Conn {
+	return c.nc
+}
+
+func (c *conn) OpenStream() (smux.Stream, error) {
+	if err := c.wait(); err != nil {
+		return nil, err
+	}
+	return c.Conn.OpenStream()
+}
+
+func (c *conn) AcceptStream() (smux.Stream, error) {
+	if err := c.wait(); err != nil {
+		return nil, err
+	}
+	return c.Conn.AcceptStream()
+}
+
+// Negotiate runs the handshake over c and returns the protocol ID of the
+// muxer agreed on, without establishing the connection.
+func (t *Transport) Negotiate(c net.Conn, isServer bool) (string, error) {
+	protos := t.Protocols()
+	if len(protos) == 0 {
+		return "", ErrNoTransports
+	}
+
+	timeout := t.NegotiateTimeout
+	if timeout == 0 {
+		timeout = DefaultNegotiateTimeout
+	}
+	// Connections over io.ReadWriteClosers without deadlines negotiate
+	// without a timeout.
+	if err := c.SetDeadline(time.Now().Add(timeout)); err != nil && err != smux.ErrNotSupported {
+		return "", err
+	}
+	defer c.SetDeadline(time.Time{})
+
+	if err := handshakeHeader(c); err != nil {
+		return "", err
+	}
+	if isServer {
+		return t.listen(c)
+	}
+	return dial(c, protos)
+}
+
+func handshakeHeader(c net.Conn) error {
+	// send and receive concurrently, so that unbuffered connections do
+	// not deadlock with both sides writing first.
+	sent := make(chan error, 1)
+	go func() { sent <- writeMessage(c, ProtocolID) }()
+	header, err := readMessage(c)
+	if err != nil {
+		return err
+	}
+	if err := <-sent; err != nil {
+		return err
+	}
+	if header != ProtocolID {
+		return ErrBadHeader{header}
+	}
+	return nil
+}
+
+func dial(c net.Conn, protos []string) (string, error) {
+	for _, id := range protos {
+		if err := writeMessage(c, id); err != nil {
+			return "", err
+		}
+		resp, err := readMessage(c)
+		if err != nil {
+			return "", err
+		}
+		switch resp {
+		case id:
+			return id, nil
+		case "na":
+		default:
+			return "", fmt.Errorf("multistream: unexpected answer %q to proposal %q", resp, id)
+		}
+	}
+	return "", ErrNoMuxer
+}
+
+func (t *Transport) listen(c net.Conn) (string, error) {
+	for {
+		id, err := readMessage(c)
+		if err == io.EOF {
+			// the dialer gave up after all its proposals were refused.
+			return "", ErrNoMuxer
+		}
+		if err != nil {
+			return "", err
+		}
+		if _, ok := t.get(id); ok {
+			return id, writeMessage(c, id)
+		}
+		if err := writeMessage(c, "na"); err != nil {
+			return "", err
+		}
+	}
+}
+
+func writeMessage(w io.Writer, msg string) error {
+	return smux.WriteLengthPrefixed(w, []byte(msg+"\n"))
+}
+
+// readMessage reads a message without consuming the data the muxer sends
+// right after the handshake.
+func readMessage(r io.Reader) (string, error) {
+	buf, err := smux.ReadLengthPrefixed(r, maxMessageSize)
+	if err == smux.ErrMessageTooLarge {
+		return "", errMessageTooLarge
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(buf) == 0 || buf[len(buf)-1] != '\n' {
+		return "", errBadMessage
+	}
+	return string(buf[:len(buf)-1]), nil
+}
@@ -7,16 +7,47 @@ import (
 	"time"
 )
 
-// ErrReset is returned when reading or writing on a reset stream.
+// ErrReset is returned when reading or writing on a stream reset by either
+// side.
 var ErrReset = errors.New("stream reset")
 
+// ErrStreamReset is another name for ErrReset.
+var ErrStreamReset = ErrReset
+
+// ErrConnClosed is returned when opening or accepting streams on a closed
+// connection, and by reads and writes of its streams once either side
+// closed it.
+var ErrConnClosed = errors.New("connection closed")
+
+// ErrStreamClosed is returned when writing on a stream closed for writing
+// with Close.
+var ErrStreamClosed = errors.New("write on closed stream")
+
+// ErrTimeout is returned by reads and writes past a stream's deadline.
+var ErrTimeout net.Error = timeoutError{}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o deadline exceeded" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
 // Stream is a bidirectional io pipe within a connection.
+//
+// Streams are safe for concurrent use: a goroutine may read while others
+// write, close, reset or set deadlines. Concurrent Writes each write all
+// their data in order, but the data of one may interleave with that of
+// another unless the muxer's writes are atomic, as those of http2,
+// websocket and quic are; concurrent Reads likewise split the data between
+// them.
 type Stream interface {
 	io.Reader
 	io.Writer
 
 	// Close closes the stream for writing. Reading will still work (that
-	// is, the remote side can still write).
+	// is, the remote side can still write). Once the remote side has read
+	// everything written before Close, its reads return io.EOF. Closing a
+	// closed stream returns nil.
 	io.Closer
 
 	// Reset closes both ends of the stream. Use this to tell the remote
@@ -28,8 +59,15 @@ type Stream interface {
 	SetWriteDeadline(time.Time) error
 }
 
+// ReceiveWindowSetter is implemented by Streams whose receive window, the
+// amount of data the peer may send before it is read, can be changed at
+// runtime.
+type ReceiveWindowSetter interface {
+	SetReceiveWindow(n uint32) error
+}
+
 // NoOpHandler do nothing. Resets streams as soon as they are opened.
-var NoOpHandler = func(s Stream) { s.Reset() }
+var NoOpHandler StreamHandler = func(s Stream) { s.Reset() }
 
 // Conn is a stream-multiplexing connection to a remote peer.
 type Conn interface {
@@ -47,9 +85,184 @@ type Conn interface {
 	AcceptStream() (Stream, error)
 }
 
+// LingerConn is implemented by Conns that can wait for data queued on
+// their streams, and the frames closing them, to be flushed before closing
+// the underlying net.Conn.
+type LingerConn interface {
+	Conn
+
+	// CloseTimeout closes the connection like Close, but waits up to
+	// timeout for queued data and close frames to be sent first.
+	CloseTimeout(timeout time.Duration) error
+}
+
+// CloseTimeout closes c, waiting up to timeout for queued data to be
+// flushed if c is a LingerConn, looking through the wrappers of this
+// package, which are then closed as with Close. Other Conns are closed
+// immediately.
+func CloseTimeout(c Conn, timeout time.Duration) error {
+	if lc, ok := c.(LingerConn); ok {
+		return lc.CloseTimeout(timeout)
+	}
+	inner, ok := findConn(c, func(c Conn) bool {
+		_, ok := c.(LingerConn)
+		return ok
+	})
+	if !ok {
+		return c.Close()
+	}
+	err := inner.(LingerConn).CloseTimeout(timeout)
+	// the inner connection is closed already, and closes no further.
+	c.Close()
+	return err
+}
+
+// AbortConn is implemented by Conns that can be torn down abortively.
+type AbortConn interface {
+	Conn
+
+	// Abort closes the connection and the underlying net.Conn
+	// immediately, discarding queued data and without sending close
+	// frames. Blocked operations on its streams return errors.
+	Abort() error
+}
+
+// Abort tears c down abortively if it is an AbortConn, looking through the
+// wrappers of this package, which are then closed as with Close, and
+// closes it otherwise.
+func Abort(c Conn) error {
+	if ac, ok := c.(AbortConn); ok {
+		return ac.Abort()
+	}
+	inner, ok := findConn(c, func(c Conn) bool {
+		_, ok := c.(AbortConn)
+		return ok
+	})
+	if !ok {
+		return c.Close()
+	}
+	err := inner.(AbortConn).Abort()
+	// the inner connection is closed already, and closes no further.
+	c.Close()
+	return err
+}
+
+// StreamCounter is implemented by Conns that can cheaply report how many
+// streams they have open, e.g. for connection managers deciding which
+// session to evict.
+type StreamCounter interface {
+	// NumStreams returns the number of streams currently open on the
+	// connection.
+	NumStreams() int
+}
+
+// StreamLister is implemented by Conns that can list their open streams,
+// e.g. for debugging pages.
+type StreamLister interface {
+	// Streams returns the streams currently open on the connection, in
+	// no particular order.
+	Streams() []Stream
+}
+
+// StreamConner is implemented by Streams that know the Conn they were
+// opened or accepted on, so that code holding only a stream, such as a
+// StreamHandler, can reach the connection's stats, pings or graceful
+// close, or the peer's address.
+type StreamConner interface {
+	// Conn returns the connection of the stream, or nil if it does not
+	// know it.
+	Conn() Conn
+}
+
+// StreamConn returns the connection s was opened or accepted on, looking
+// through the wrappers of this package, or ErrNotSupported if s does not
+// know it. Streams of the wrappers of this package return the wrapper,
+// with its facilities; those handing out the streams of the connection
+// they wrap as they are, such as WithOpenTimeout, WithKeepAlive and
+// WithGracefulClose, are not seen, and are reached through the
+// connection they return.
+func StreamConn(s Stream) (Conn, error) {
+	var c Conn
+	_, ok := findStream(s, func(s Stream) bool {
+		if sc, ok := s.(StreamConner); ok {
+			c = sc.Conn()
+		}
+		return c != nil
+	})
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return c, nil
+}
+
 // Transport constructs go-stream-muxer compatible connections.
 type Transport interface {
 
-	// NewConn constructs a new connection
+	// NewConn constructs a new connection. To mux over an
+	// io.ReadWriteCloser that is not a net.Conn, use NewConnRWC.
 	NewConn(c net.Conn, isServer bool) (Conn, error)
 }
+
+// ProtocolTransport is implemented by Transports that know the multistream
+// protocol ID of their wire format (e.g. "/yamux/1.0.0"), so negotiation,
+// registries and metrics can all refer to a muxer by the same name.
+type ProtocolTransport interface {
+	Transport
+
+	// ProtocolID returns the transport's protocol ID.
+	ProtocolID() string
+}
+
+// ProtocolID returns the protocol ID of tr, or "" if tr does not report
+// one.
+func ProtocolID(tr Transport) string {
+	if pt, ok := tr.(ProtocolTransport); ok {
+		return pt.ProtocolID()
+	}
+	return ""
+}
+
+// HalfCloser is implemented by Streams that can close each direction
+// separately.
+type HalfCloser interface {
+	// CloseWrite closes the stream for writing, like Close. The remote
+	// side reads EOF once it has read everything written before.
+	CloseWrite() error
+
+	// CloseRead closes the stream for reading. Reads return an error and
+	// data the remote side sends is discarded, while writing keeps
+	// working.
+	CloseRead() error
+}
+
+// CloseWrite closes s for writing. Close already only closes the writing
+// side, so it is used for Streams that are not HalfClosers.
+func CloseWrite(s Stream) error {
+	if hc, ok := s.(HalfCloser); ok {
+		return hc.CloseWrite()
+	}
+	return s.Close()
+}
+
+// CloseRead closes s for reading, or returns ErrNotSupported if s is not
+// a HalfCloser.
+func CloseRead(s Stream) error {
+	if hc, ok := s.(HalfCloser); ok {
+		return hc.CloseRead()
+	}
+	return ErrNotSupported
+}
+
+// SetReceiveWindow sets the receive window of s, looking through the
+// wrappers of this package, or returns ErrNotSupported if it is not a
+// ReceiveWindowSetter.
+func SetReceiveWindow(s Stream, n uint32) error {
+	s, ok := findStream(s, func(s Stream) bool {
+		_, ok := s.(ReceiveWindowSetter)
+		return ok
+	})
+	if !ok {
+		return ErrNotSupported
+	}
+	return s.(ReceiveWindowSetter).SetReceiveWindow(n)
+}
@@ -0,0 +1,146 @@
+package streammux
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// MaxStreamNameSize is the longest stream name WithStreamNames can send.
+const MaxStreamNameSize = 1<<16 - 1
+
+// ErrNameTooLong is returned when opening a stream with a name longer than
+// MaxStreamNameSize.
+var ErrNameTooLong = errors.New("stream name too long")
+
+// NamedStream is implemented by Streams carrying a label set by the side
+// that opened them, such as the protocol spoken on them.
+type NamedStream interface {
+	Name() string
+}
+
+// NamedStreamConn is implemented by Conns that can label the streams they
+// open, so that the acceptor knows the name before reading any data.
+type NamedStreamConn interface {
+	Conn
+	OpenNamedStream(name string) (Stream, error)
+}
+
+// StreamName returns the name of s, or "" if it has none.
+func StreamName(s Stream) string {
+	if ns, ok := s.(NamedStream); ok {
+		return ns.Name()
+	}
+	return ""
+}
+
+// OpenNamedStream opens a stream named name on c, or returns
+// ErrNotSupported if c is not a NamedStreamConn.
+func OpenNamedStream(c Conn, name string) (Stream, error) {
+	if nc, ok := c.(NamedStreamConn); ok {
+		return nc.OpenNamedStream(name)
+	}
+	return nil, ErrNotSupported
+}
+
+// WithStreamNames wraps c to emulate named streams, for muxers without
+// stream headers: every stream starts with its name, prefixed by its
+// length as a big-endian uint16. Both sides of the connection must be
+// wrapped. Streams opened with OpenStream are named "".
+func WithStreamNames(c Conn) NamedStreamConn {
+	return &namingConn{Conn: c, acceptor: newAcceptor(0)}
+}
+
+type namingConn struct {
+	Conn
+
+	once     sync.Once
+	acceptor *acceptor
+}
+
+func (c *namingConn) unwrapConn() Conn {
+	return c.Conn
+}
+
+type namedStream struct {
+	Stream
+	conn *namingConn
+	name string
+}
+
+func (s *namedStream) unwrapStream() Stream {
+	return s.Stream
+}
+
+func (s *namedStream) Conn() Conn {
+	return s.conn
+}
+
+func (s *namedStream) ReadFrom(r io.Reader) (int64, error) {
+	return streamReadFrom(s.Stream, r)
+}
+
+func (s *namedStream) WriteTo(w io.Writer) (int64, error) {
+	return streamWriteTo(s.Stream, w)
+}
+
+func (s *namedStream) WriteBuffers(bufs net.Buffers) (int64, error) {
+	return WriteBuffers(s.Stream, bufs)
+}
+
+func (s *namedStream) Name() string {
+	return s.name
+}
+
+func (c *namingConn) OpenStream() (Stream, error) {
+	return c.OpenNamedStream("")
+}
+
+func (c *namingConn) OpenNamedStream(name string) (Stream, error) {
+	if len(name) > MaxStreamNameSize {
+		return nil, ErrNameTooLong
+	}
+	s, err := c.Conn.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	preamble := make([]byte, 2+len(name))
+	binary.BigEndian.PutUint16(preamble, uint16(len(name)))
+	copy(preamble[2:], name)
+	if _, err := s.Write(preamble); err != nil {
+		s.Reset()
+		return nil, err
+	}
+	return &namedStream{Stream: s, conn: c, name: name}, nil
+}
+
+// acceptLoop accepts streams and reads their names concurrently.
+func (c *namingConn) acceptLoop() {
+	c.acceptor.prepareLoop(c.Conn, func(s Stream) (Stream, error) {
+		name, err := readStreamName(s)
+		if err != nil {
+			return nil, err
+		}
+		return &namedStream{Stream: s, conn: c, name: name}, nil
+	})
+}
+
+func readStreamName(r io.Reader) (string, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return "", err
+	}
+	name := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(r, name); err != nil {
+		return "", err
+	}
+	return string(name), nil
+}
+
+func (c *namingConn) AcceptStream() (Stream, error) {
+	c.once.Do(func() { go c.acceptLoop() })
+	return c.acceptor.accept(context.Background())
+}
@@ -0,0 +1,74 @@
+package streammux
+
+import (
+	"context"
+	"io"
+	"net"
+)
+
+// AddrConn is implemented by Conns that know the addresses of the
+// connection they are muxing over.
+type AddrConn interface {
+	Conn
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+}
+
+// muxAddr stands in for the address of Conns that do not report theirs.
+type muxAddr struct{}
+
+func (muxAddr) Network() string { return "smux" }
+func (muxAddr) String() string  { return "smux" }
+
+// NetConn returns s, a stream of c, as a net.Conn, for libraries such as
+// crypto/tls that take one. Streams that already implement net.Conn are
+// returned as is. Others report the addresses of c if it is an AddrConn,
+// and a placeholder "smux" address otherwise.
+func NetConn(c Conn, s Stream) net.Conn {
+	if nc, ok := s.(net.Conn); ok {
+		return nc
+	}
+	ns := &netStream{Stream: s, local: muxAddr{}, remote: muxAddr{}}
+	if ac, ok := c.(AddrConn); ok {
+		ns.local, ns.remote = ac.LocalAddr(), ac.RemoteAddr()
+	}
+	return ns
+}
+
+type netStream struct {
+	Stream
+	local, remote net.Addr
+}
+
+func (s *netStream) unwrapStream() Stream {
+	return s.Stream
+}
+
+func (s *netStream) ReadFrom(r io.Reader) (int64, error) {
+	return streamReadFrom(s.Stream, r)
+}
+
+func (s *netStream) WriteTo(w io.Writer) (int64, error) {
+	return streamWriteTo(s.Stream, w)
+}
+
+func (s *netStream) WriteBuffers(bufs net.Buffers) (int64, error) {
+	return WriteBuffers(s.Stream, bufs)
+}
+
+func (s *netStream) LocalAddr() net.Addr  { return s.local }
+func (s *netStream) RemoteAddr() net.Addr { return s.remote }
+
+// NetDialer returns a dial function opening a new stream of c as a
+// net.Conn on every call, regardless of the network and address, for
+// clients such as http.Transport's DialContext. Together with NetListener
+// on the peer, it tunnels a client and server over one connection.
+func NetDialer(c Conn) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		s, err := OpenStreamContext(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		return NetConn(c, s), nil
+	}
+}
@@ -0,0 +1,154 @@
+package streammux
+
+import (
+	"io"
+	"sync"
+)
+
+// StreamObserver is notified of the life cycle of the streams of a
+// connection, e.g. for accounting or admission control. Every stream is
+// reported opened or accepted once, then closed or reset once. Callbacks
+// run synchronously on the goroutine causing the event and must not block.
+type StreamObserver interface {
+	StreamOpened(s Stream)
+	StreamAccepted(s Stream)
+	// StreamClosed is called once a stream is closed in both
+	// directions.
+	StreamClosed(s Stream)
+	// StreamReset is called once a stream is reset by either side.
+	StreamReset(s Stream)
+}
+
+// ObservableConn is implemented by Conns that report the life cycle of
+// their streams to an observer.
+type ObservableConn interface {
+	Conn
+
+	// SetStreamObserver makes the connection report to o, or to nobody
+	// if o is nil. It applies to streams opened or accepted afterwards.
+	SetStreamObserver(o StreamObserver)
+}
+
+// SetStreamObserver sets the stream observer of c, or returns
+// ErrNotSupported if c is not an ObservableConn. Conns can be made
+// ObservableConns with WithStreamObserver.
+func SetStreamObserver(c Conn, o StreamObserver) error {
+	oc, ok := c.(ObservableConn)
+	if !ok {
+		return ErrNotSupported
+	}
+	oc.SetStreamObserver(o)
+	return nil
+}
+
+// WithStreamObserver returns c if it is an ObservableConn, and otherwise
+// wraps c to report the streams opened and accepted through the wrapper.
+// A stream is closed once it was closed and read to EOF.
+func WithStreamObserver(c Conn) ObservableConn {
+	if oc, ok := c.(ObservableConn); ok {
+		return oc
+	}
+	return &observedConn{Conn: c}
+}
+
+type observedConn struct {
+	Conn
+
+	mu       sync.Mutex
+	observer StreamObserver
+}
+
+func (c *observedConn) unwrapConn() Conn {
+	return c.Conn
+}
+
+func (c *observedConn) SetStreamObserver(o StreamObserver) {
+	c.mu.Lock()
+	c.observer = o
+	c.mu.Unlock()
+}
+
+func (c *observedConn) getObserver() StreamObserver {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.observer
+}
+
+func (c *observedConn) OpenStream() (Stream, error) {
+	s, err := c.Conn.OpenStream()
+	o := c.getObserver()
+	if err != nil || o == nil {
+		return s, err
+	}
+	os := &observedStream{Stream: s, conn: c, observer: o}
+	os.observer.StreamOpened(os)
+	return os, nil
+}
+
+func (c *observedConn) AcceptStream() (Stream, error) {
+	s, err := c.Conn.AcceptStream()
+	o := c.getObserver()
+	if err != nil || o == nil {
+		return s, err
+	}
+	os := &observedStream{Stream: s, conn: c, observer: o}
+	os.observer.StreamAccepted(os)
+	return os, nil
+}
+
+type observedStream struct {
+	Stream
+	conn     *observedConn
+	observer StreamObserver
+	end      streamEnd
+}
+
+func (s *observedStream) unwrapStream() Stream {
+	return s.Stream
+}
+
+func (s *observedStream) Conn() Conn {
+	return s.conn
+}
+
+func (s *observedStream) finish(write, read, reset bool) {
+	if !s.end.done(write, read, reset) {
+		return
+	}
+	if reset {
+		s.observer.StreamReset(s)
+	} else {
+		s.observer.StreamClosed(s)
+	}
+}
+
+func (s *observedStream) Read(b []byte) (int, error) {
+	n, err := s.Stream.Read(b)
+	switch {
+	case err == io.EOF:
+		s.finish(false, true, false)
+	case isReset(err):
+		s.finish(false, false, true)
+	}
+	return n, err
+}
+
+func (s *observedStream) Write(b []byte) (int, error) {
+	n, err := s.Stream.Write(b)
+	if isReset(err) {
+		s.finish(false, false, true)
+	}
+	return n, err
+}
+
+func (s *observedStream) Close() error {
+	err := s.Stream.Close()
+	s.finish(true, false, false)
+	return err
+}
+
+func (s *observedStream) Reset() error {
+	err := s.Stream.Reset()
+	s.finish(false, false, true)
+	return err
+}
@@ -0,0 +1,41 @@
+package streammux
+
+import (
+	"context"
+	"time"
+)
+
+// WithOpenTimeout wraps c so that opening a stream gives up after timeout,
+// returning ErrTimeout, so that a peer which stopped reading cannot hang
+// every caller that did not set a deadline of its own. OpenStreamContext
+// applies the timeout only to contexts without a deadline, and returns
+// ctx.Err() as usual otherwise. It enforces Options.OpenTimeout.
+func WithOpenTimeout(c Conn, timeout time.Duration) ContextOpenConn {
+	return &openTimeoutConn{Conn: c, timeout: timeout}
+}
+
+type openTimeoutConn struct {
+	Conn
+	timeout time.Duration
+}
+
+func (c *openTimeoutConn) unwrapConn() Conn {
+	return c.Conn
+}
+
+func (c *openTimeoutConn) OpenStream() (Stream, error) {
+	return c.OpenStreamContext(context.Background())
+}
+
+func (c *openTimeoutConn) OpenStreamContext(ctx context.Context) (Stream, error) {
+	if _, ok := ctx.Deadline(); ok {
+		return OpenStreamContext(ctx, c.Conn)
+	}
+	tctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	s, err := OpenStreamContext(tctx, c.Conn)
+	if err == context.DeadlineExceeded && ctx.Err() == nil {
+		err = ErrTimeout
+	}
+	return s, err
+}
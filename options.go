@@ -0,0 +1,223 @@
+package streammux
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// ErrNotSupported is returned when a muxer does not support a requested
+// feature or setting.
+var ErrNotSupported = errors.New("not supported by this stream muxer")
+
+// Options are muxer-agnostic connection settings. The zero value of every
+// field means "use the muxer's default".
+type Options struct {
+	// ReceiveWindow is the initial per-stream receive window, in bytes.
+	ReceiveWindow uint32
+
+	// MaxFrameSize is the largest data frame the muxer sends, in bytes.
+	MaxFrameSize uint32
+
+	// KeepAliveInterval is how often keepalive pings are sent on an
+	// otherwise idle connection.
+	KeepAliveInterval time.Duration
+
+	// KeepAliveFailures is the number of consecutive unanswered
+	// keepalive pings after which the connection is considered dead.
+	KeepAliveFailures int
+
+	// MaxStreams is the maximum number of streams open at once on a
+	// connection, past which OpenStream fails and the streams the peer
+	// opens are rejected. WithMaxStreams enforces it for muxers which
+	// do not.
+	MaxStreams int
+
+	// WriteBufferSize is the amount of outgoing data, in bytes, the muxer
+	// queues per connection before writes block.
+	WriteBufferSize int
+
+	// WriteScheduler names the order the muxer writes the frames of
+	// different streams in, such as RoundRobinScheduler, for muxers whose
+	// write loop takes a scheduler, like the http2 muxer and those built
+	// on the frames package.
+	WriteScheduler string
+
+	// StreamIdleTimeout is how long a stream may go without a read or
+	// write returning data before it is reset, and its reads and writes
+	// return ErrTimeout. Zero never resets idle streams. Muxers need not
+	// implement it: NewConnWithOptions enforces it with WithIdleTimeout,
+	// and WithConfig leaves it out of the options it passes them.
+	StreamIdleTimeout time.Duration
+
+	// ConnIdleTimeout is how long a connection may go without a stream
+	// open and without a read or write returning data on its streams
+	// before it is closed, which closes its CloseChan. Zero never closes
+	// idle connections. Like StreamIdleTimeout, NewConnWithOptions
+	// enforces it, with WithConnIdleTimeout.
+	ConnIdleTimeout time.Duration
+
+	// OpenTimeout is how long opening a stream may take before it fails
+	// with ErrTimeout, when the context of OpenStreamContext has no
+	// deadline of its own. Zero waits as long as the muxer does. Like
+	// StreamIdleTimeout, NewConnWithOptions enforces it, with
+	// WithOpenTimeout.
+	OpenTimeout time.Duration
+
+	// AcceptBacklog is the number of streams opened by the peer that may
+	// wait to be accepted, past which AcceptOverflow applies. The
+	// bundled muxers have backlogs of 256, and queue the streams past
+	// them without stopping reading the connection. Like
+	// StreamIdleTimeout, NewConnWithOptions enforces it, with
+	// WithAcceptBacklog.
+	AcceptBacklog int
+
+	// AcceptOverflow names what happens to the streams the peer opens
+	// past AcceptBacklog, BlockOverflow or ResetOverflow. Empty is
+	// BlockOverflow.
+	AcceptOverflow string
+
+	// RateLimits limit the throughput of the connection and of each of
+	// its streams. NewConnWithOptions enforces them with WithRateLimits,
+	// last, so that the connection it returns is a RateLimitedConn.
+	RateLimits RateLimits
+}
+
+// Validate checks that the options make sense together, so that mistakes
+// are reported when a transport is configured rather than as stalls at
+// runtime. Options left to their defaults are not checked against each
+// other, since the defaults are up to each muxer.
+func (o Options) Validate() error {
+	if o.ReceiveWindow != 0 && o.MaxFrameSize != 0 && o.ReceiveWindow < o.MaxFrameSize {
+		return fmt.Errorf("smux: ReceiveWindow (%d) is smaller than MaxFrameSize (%d), so full frames can never be sent", o.ReceiveWindow, o.MaxFrameSize)
+	}
+	if o.KeepAliveInterval < 0 {
+		return fmt.Errorf("smux: KeepAliveInterval (%s) is negative", o.KeepAliveInterval)
+	}
+	if o.KeepAliveFailures < 0 {
+		return fmt.Errorf("smux: KeepAliveFailures (%d) is negative", o.KeepAliveFailures)
+	}
+	if o.KeepAliveFailures > 0 && o.KeepAliveInterval == 0 {
+		return fmt.Errorf("smux: KeepAliveFailures is set but KeepAliveInterval is not, so failures would never be detected")
+	}
+	if o.MaxStreams < 0 {
+		return fmt.Errorf("smux: MaxStreams (%d) is negative, so no stream could ever be opened", o.MaxStreams)
+	}
+	if o.WriteBufferSize < 0 {
+		return fmt.Errorf("smux: WriteBufferSize (%d) is negative", o.WriteBufferSize)
+	}
+	if o.StreamIdleTimeout < 0 {
+		return fmt.Errorf("smux: StreamIdleTimeout (%s) is negative", o.StreamIdleTimeout)
+	}
+	if o.ConnIdleTimeout < 0 {
+		return fmt.Errorf("smux: ConnIdleTimeout (%s) is negative", o.ConnIdleTimeout)
+	}
+	if o.OpenTimeout < 0 {
+		return fmt.Errorf("smux: OpenTimeout (%s) is negative", o.OpenTimeout)
+	}
+	if o.AcceptBacklog < 0 {
+		return fmt.Errorf("smux: AcceptBacklog (%d) is negative", o.AcceptBacklog)
+	}
+	switch o.AcceptOverflow {
+	case "", BlockOverflow, ResetOverflow:
+	default:
+		return fmt.Errorf("smux: unknown AcceptOverflow %q", o.AcceptOverflow)
+	}
+	// the names frames.NewScheduler takes, which this package, imported
+	// by frames, cannot call.
+	switch o.WriteScheduler {
+	case "", RoundRobinScheduler, FIFOScheduler, PriorityScheduler:
+	default:
+		return fmt.Errorf("smux: unknown WriteScheduler %q", o.WriteScheduler)
+	}
+	if o.AcceptOverflow != "" && o.AcceptBacklog == 0 {
+		return fmt.Errorf("smux: AcceptOverflow is set but AcceptBacklog is not, so it would never apply")
+	}
+	for name, l := range map[string]RateLimit{
+		"StreamRead":  o.RateLimits.StreamRead,
+		"StreamWrite": o.RateLimits.StreamWrite,
+		"ConnRead":    o.RateLimits.ConnRead,
+		"ConnWrite":   o.RateLimits.ConnWrite,
+	} {
+		if l.Rate < 0 || l.Burst < 0 {
+			return fmt.Errorf("smux: RateLimits.%s (%d bytes/s, burst %d) is negative", name, l.Rate, l.Burst)
+		}
+	}
+	return nil
+}
+
+// ConfigurableTransport is implemented by Transports that can derive a
+// copy of themselves with different settings, so that one process can use
+// different settings for different peers without mutating a shared
+// Transport.
+type ConfigurableTransport interface {
+	Transport
+
+	// WithConfig returns a copy of the transport using opts. The receiver
+	// is left unchanged. It returns an error if the muxer cannot honor
+	// one of the settings. Callers should use the WithConfig function,
+	// which validates opts first.
+	WithConfig(opts Options) (Transport, error)
+}
+
+// WithConfig validates opts and derives a copy of tr using them. It
+// returns ErrNotSupported if tr is not a ConfigurableTransport.
+func WithConfig(tr Transport, opts Options) (Transport, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	ct, ok := tr.(ConfigurableTransport)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	opts.StreamIdleTimeout = 0
+	opts.ConnIdleTimeout = 0
+	opts.OpenTimeout = 0
+	opts.AcceptBacklog, opts.AcceptOverflow = 0, ""
+	opts.RateLimits = RateLimits{}
+	return ct.WithConfig(opts)
+}
+
+// NewConnWithOptions validates opts and establishes a muxed connection over
+// c with them, as tr.NewConn would with tr configured by WithConfig, and
+// wrapped by WithAcceptBacklog, WithConnIdleTimeout, WithIdleTimeout,
+// WithOpenTimeout and WithRateLimits if AcceptBacklog, ConnIdleTimeout,
+// StreamIdleTimeout, OpenTimeout and RateLimits are set. Options that are
+// zero but for those use tr as is, so they work with every transport.
+func NewConnWithOptions(tr Transport, c net.Conn, isServer bool, opts Options) (Conn, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	streamIdle, connIdle, openTimeout, limits := opts.StreamIdleTimeout, opts.ConnIdleTimeout, opts.OpenTimeout, opts.RateLimits
+	backlog, overflow := opts.AcceptBacklog, opts.AcceptOverflow
+	opts.StreamIdleTimeout, opts.ConnIdleTimeout, opts.OpenTimeout, opts.RateLimits = 0, 0, 0, RateLimits{}
+	opts.AcceptBacklog, opts.AcceptOverflow = 0, ""
+	if opts != (Options{}) {
+		var err error
+		if tr, err = WithConfig(tr, opts); err != nil {
+			return nil, err
+		}
+	}
+	conn, err := tr.NewConn(c, isServer)
+	if err != nil {
+		return nil, err
+	}
+	if backlog != 0 {
+		// the other wrappers see streams as they are accepted.
+		conn = WithAcceptBacklog(conn, backlog, overflow)
+	}
+	if connIdle != 0 {
+		conn = WithConnIdleTimeout(conn, connIdle)
+	}
+	if streamIdle != 0 {
+		conn = WithIdleTimeout(conn, streamIdle)
+	}
+	if openTimeout != 0 {
+		conn = WithOpenTimeout(conn, openTimeout)
+	}
+	if limits != (RateLimits{}) {
+		conn = WithRateLimits(conn, limits)
+	}
+	return conn, nil
+}
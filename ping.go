@@ -0,0 +1,139 @@
+package streammux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrBadPong is returned by emulated pings answered with the wrong data.
+var ErrBadPong = errors.New("ping answered with the wrong payload")
+
+// PingConn is implemented by Conns that can measure the round trip time to
+// the peer.
+type PingConn interface {
+	Conn
+
+	// Ping sends a ping to the peer and returns the time it took to be
+	// answered.
+	Ping() (time.Duration, error)
+}
+
+// Ping measures the round trip time to the peer of c, or returns
+// ErrNotSupported if c is not a PingConn. Conns can be made PingConns with
+// WithPing.
+func Ping(c Conn) (time.Duration, error) {
+	if pc, ok := c.(PingConn); ok {
+		return pc.Ping()
+	}
+	return 0, ErrNotSupported
+}
+
+// pingHello announces the control stream of WithPing.
+var pingHello = []byte("smux-ping/1\n")
+
+// WithPing wraps c to emulate pings over a dedicated control stream, for
+// muxers without native pings. Both sides of the connection must be
+// wrapped, before any other stream is opened: each side opens its control
+// stream right away and takes the first stream it accepts to be the peer's.
+func WithPing(c Conn) (PingConn, error) {
+	ctl, err := c.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := ctl.Write(pingHello); err != nil {
+		ctl.Reset()
+		return nil, err
+	}
+
+	pc := &pingConn{Conn: c, ctl: ctl, accepted: make(chan struct{})}
+	go pc.answer()
+	return pc, nil
+}
+
+type pingConn struct {
+	Conn
+
+	mu    sync.Mutex
+	ctl   Stream
+	nonce uint64
+
+	// accepted is closed once the peer's control stream was accepted, or
+	// failed to be.
+	accepted  chan struct{}
+	acceptErr error
+}
+
+func (c *pingConn) unwrapConn() Conn {
+	return c.Conn
+}
+
+// answer accepts the peer's control stream and echoes its pings.
+func (c *pingConn) answer() {
+	peer, err := c.Conn.AcceptStream()
+	c.acceptErr = err
+	close(c.accepted)
+	if err != nil {
+		return
+	}
+	defer peer.Reset()
+
+	hello := make([]byte, len(pingHello))
+	if _, err := io.ReadFull(peer, hello); err != nil || !bytes.Equal(hello, pingHello) {
+		return
+	}
+	ping := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(peer, ping); err != nil {
+			return
+		}
+		if _, err := peer.Write(ping); err != nil {
+			return
+		}
+	}
+}
+
+func (c *pingConn) AcceptStream() (Stream, error) {
+	<-c.accepted
+	if c.acceptErr != nil {
+		return nil, c.acceptErr
+	}
+	return c.Conn.AcceptStream()
+}
+
+func (c *pingConn) Ping() (time.Duration, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.nonce++
+	ping := make([]byte, 8)
+	binary.BigEndian.PutUint64(ping, c.nonce)
+	pong := make([]byte, 8)
+
+	start := time.Now()
+	if _, err := c.ctl.Write(ping); err != nil {
+		return 0, err
+	}
+	if _, err := io.ReadFull(c.ctl, pong); err != nil {
+		return 0, err
+	}
+	rtt := time.Since(start)
+	if !bytes.Equal(ping, pong) {
+		return 0, ErrBadPong
+	}
+	return rtt, nil
+}
+
+func (c *pingConn) Close() error {
+	c.ctl.Reset()
+	return c.Conn.Close()
+}
+
+// Wait waits for the connection to be closed, and returns why, as Wait of
+// the connection it wraps does.
+func (c *pingConn) Wait() error {
+	return Wait(c.Conn)
+}
@@ -0,0 +1,86 @@
+package streammux
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrPoolClosed is returned by StreamPool.Get after the pool was closed.
+var ErrPoolClosed = errors.New("stream pool closed")
+
+// StreamPool keeps idle streams of a Conn open and hands them out instead
+// of opening new ones, amortizing stream setup for request heavy
+// workloads. The application protocol must allow a stream to carry
+// several requests one after another; streams are returned to the pool
+// with Put once a request is complete.
+type StreamPool struct {
+	conn Conn
+	size int
+
+	mu     sync.Mutex
+	idle   []Stream
+	closed bool
+}
+
+// NewStreamPool returns a pool keeping up to size idle streams of c.
+func NewStreamPool(c Conn, size int) *StreamPool {
+	return &StreamPool{conn: c, size: size}
+}
+
+// Get returns an idle stream from the pool, or opens a new one if there is
+// none.
+func (p *StreamPool) Get() (Stream, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrPoolClosed
+	}
+	if n := len(p.idle); n > 0 {
+		s := p.idle[n-1]
+		p.idle[n-1] = nil
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return s, nil
+	}
+	p.mu.Unlock()
+	return p.conn.OpenStream()
+}
+
+// Put returns a stream obtained from Get to the pool. If the pool is full
+// or closed, the stream is closed instead. Streams that failed must be
+// Reset rather than returned.
+func (p *StreamPool) Put(s Stream) {
+	p.mu.Lock()
+	if p.closed || len(p.idle) >= p.size {
+		p.mu.Unlock()
+		s.Close()
+		return
+	}
+	p.idle = append(p.idle, s)
+	p.mu.Unlock()
+}
+
+// Len returns the number of idle streams in the pool.
+func (p *StreamPool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.idle)
+}
+
+// Close closes all idle streams. Streams handed out by Get stay open and
+// are closed when they are Put back.
+func (p *StreamPool) Close() error {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	p.mu.Unlock()
+
+	var err error
+	for _, s := range idle {
+		if cerr := s.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
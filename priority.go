@@ -0,0 +1,47 @@
+package streammux
+
+// DefaultPriority is the priority streams are opened with.
+const DefaultPriority = 0
+
+// The write schedulers of Options.WriteScheduler, which muxers owning the
+// write loop of their connections may offer.
+const (
+	// RoundRobinScheduler has the streams with data to write take
+	// turns, a frame each.
+	RoundRobinScheduler = "round-robin"
+
+	// FIFOScheduler writes frames in the order they were queued,
+	// whichever their stream.
+	FIFOScheduler = "fifo"
+
+	// PriorityScheduler writes the frames of the streams of highest
+	// priority first, set with SetPriority, the streams of a priority
+	// taking turns.
+	PriorityScheduler = "priority"
+)
+
+// PriorityStream is implemented by Streams whose writes can be prioritized
+// over those of other streams of the same connection, so that bulk
+// transfers do not starve latency-sensitive streams. Muxers map priorities
+// to their own scheme, such as spdystream's priority levels or the weights
+// of a write scheduler.
+type PriorityStream interface {
+	// SetPriority sets the priority of the stream. Streams with higher
+	// priorities are written first; negative priorities are for
+	// background traffic.
+	SetPriority(p int) error
+}
+
+// SetPriority sets the priority of s, looking through the wrappers of this
+// package. It returns ErrNotSupported if the muxer does not prioritize
+// streams.
+func SetPriority(s Stream, p int) error {
+	s, ok := findStream(s, func(s Stream) bool {
+		_, ok := s.(PriorityStream)
+		return ok
+	})
+	if !ok {
+		return ErrNotSupported
+	}
+	return s.(PriorityStream).SetPriority(p)
+}
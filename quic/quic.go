@@ -0,0 +1,176 @@
+// Package quic adapts the streams of a QUIC connection of
+// github.com/quic-go/quic-go to smux.Conn and smux.Stream, with the QUIC
+// connection, which runs over UDP, standing in for the muxed net.Conn.
+//
+// NewConn wraps an established QUIC connection. The Transport instead
+// runs QUIC over a net.Conn, carrying each UDP datagram in a length
+// prefixed record, which is mostly useful to run the test suite against
+// the adapter.
+package quic
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	smux "github.com/dms3-p2p/go-stream-muxer"
+	quicgo "github.com/quic-go/quic-go"
+)
+
+// NewConn returns qc as a muxed connection. QUIC announces a stream to the
+// peer with its first data, so the peer accepts a new stream only once it
+// is written to or closed; the connections of the Transport announce
+// their streams as they open them. Closing the connection is abrupt: data
+// not yet acknowledged by the peer is lost.
+func NewConn(qc *quicgo.Conn) smux.Conn {
+	return &conn{qc: qc}
+}
+
+type conn struct {
+	qc *quicgo.Conn
+
+	// outer is the connection handed out for qc, if not conn itself, as
+	// the handshakeConn of Transport connections.
+	outer smux.Conn
+
+	// announce is set for Transport connections, whose streams start
+	// with a zero byte, so that the peer accepts them once opened.
+	announce bool
+}
+
+func (c *conn) Close() error {
+	return c.qc.CloseWithError(0, "")
+}
+
+func (c *conn) IsClosed() bool {
+	select {
+	case <-c.qc.Context().Done():
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *conn) LocalAddr() net.Addr  { return c.qc.LocalAddr() }
+func (c *conn) RemoteAddr() net.Addr { return c.qc.RemoteAddr() }
+
+func (c *conn) OpenStream() (smux.Stream, error) {
+	s, err := c.qc.OpenStreamSync(context.Background())
+	if err != nil {
+		return nil, c.translate(err)
+	}
+	if c.announce {
+		if _, err := s.Write([]byte{0}); err != nil {
+			return nil, c.translate(err)
+		}
+	}
+	return &stream{Stream: s, conn: c}, nil
+}
+
+func (c *conn) AcceptStream() (smux.Stream, error) {
+	s, err := c.qc.AcceptStream(context.Background())
+	if err != nil {
+		return nil, c.translate(err)
+	}
+	return &stream{Stream: s, conn: c, header: c.announce}, nil
+}
+
+// translate maps the errors of quic-go to those of package smux.
+func (c *conn) translate(err error) error {
+	switch e := err.(type) {
+	case nil:
+		return nil
+	case *quicgo.StreamError:
+		if e.Remote && e.ErrorCode != 0 {
+			return smux.StreamError{Code: uint32(e.ErrorCode)}
+		}
+		return smux.ErrReset
+	}
+	if err != io.EOF && c.IsClosed() {
+		return smux.ErrConnClosed
+	}
+	return err
+}
+
+// stream is a QUIC stream; Close of quicgo.Stream closes it for writing.
+type stream struct {
+	*quicgo.Stream
+	conn   *conn
+	closed int32 // set atomically by Close
+
+	hmu    sync.Mutex
+	header bool // the byte announcing the stream is still to be read
+}
+
+// ID returns the QUIC stream ID.
+func (s *stream) ID() uint64 {
+	return uint64(s.StreamID())
+}
+
+// Conn returns the connection of the stream.
+func (s *stream) Conn() smux.Conn {
+	if s.conn.outer != nil {
+		return s.conn.outer
+	}
+	return s.conn
+}
+
+func (s *stream) Read(b []byte) (int, error) {
+	s.hmu.Lock()
+	if s.header {
+		var h [1]byte
+		if _, err := io.ReadFull(s.Stream, h[:]); err != nil {
+			s.hmu.Unlock()
+			return 0, s.conn.translate(err)
+		}
+		s.header = false
+	}
+	s.hmu.Unlock()
+	n, err := s.Stream.Read(b)
+	return n, s.conn.translate(err)
+}
+
+func (s *stream) Write(b []byte) (int, error) {
+	n, err := s.Stream.Write(b)
+	if err == nil {
+		return n, nil
+	}
+	if terr := s.conn.translate(err); terr != err || atomic.LoadInt32(&s.closed) == 0 {
+		return n, terr
+	}
+	// quic-go has no error of its own for writes after Close.
+	return n, smux.ErrStreamClosed
+}
+
+func (s *stream) Close() error {
+	atomic.StoreInt32(&s.closed, 1)
+	return s.conn.translate(s.Stream.Close())
+}
+
+// CloseWrite closes the stream for writing, like Close.
+func (s *stream) CloseWrite() error {
+	return s.Close()
+}
+
+// CloseRead stops the peer from sending with STOP_SENDING.
+func (s *stream) CloseRead() error {
+	s.Stream.CancelRead(0)
+	return nil
+}
+
+// Reset aborts both directions with RESET_STREAM and STOP_SENDING.
+func (s *stream) Reset() error {
+	s.Stream.CancelWrite(0)
+	s.Stream.CancelRead(0)
+	return nil
+}
+
+// ResetWithError resets the stream like Reset, with code as the
+// application error code of both frames.
+func (s *stream) ResetWithError(code uint32) error {
+	s.Stream.CancelWrite(quicgo.StreamErrorCode(code))
+	s.Stream.CancelRead(quicgo.StreamErrorCode(code))
+	return nil
+}
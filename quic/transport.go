@@ -0,0 +1,215 @@
+package quic
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	smux "github.com/dms3-p2p/go-stream-muxer"
+	quicgo "github.com/quic-go/quic-go"
+)
+
+// DefaultALPN is the TLS application protocol negotiated by the Transport
+// when its TLS configuration sets none.
+const DefaultALPN = "smux"
+
+// DefaultMaxIncomingStreams is the limit of concurrent streams opened by
+// the peer when the Transport has no QUIC configuration. It is above
+// quic-go's default, since a QUIC stream only ends once it is read to EOF
+// or reset, and streams which are only closed count against it.
+const DefaultMaxIncomingStreams = 1 << 16
+
+// Transport runs QUIC over net.Conns. The handshake runs in the
+// background, so NewConn does not wait for the peer; opening and
+// accepting streams wait for it, and fail with its error. Unlike those of
+// NewConn, the streams of its connections start with a zero byte, which
+// the peer drops, so that they are announced, and accepted, as soon as
+// they are opened, and a stream reset before it carried any data still
+// reaches the peer.
+type Transport struct {
+	// TLSConfig is used as the server configuration by the listening
+	// side, which needs a certificate, and as the client configuration by
+	// the dialing side.
+	TLSConfig *tls.Config
+
+	// Config is the QUIC configuration. Nil means quic-go's defaults,
+	// with MaxIncomingStreams set to DefaultMaxIncomingStreams.
+	Config *quicgo.Config
+}
+
+// Features returns the features of QUIC connections.
+func (t *Transport) Features() smux.Features {
+	return smux.FeatureMultiplex | smux.FeatureReset | smux.FeatureDeadlines |
+		smux.FeatureHalfClose | smux.FeatureStreamIDs | smux.FeatureResetCodes
+}
+
+// NewConn starts a QUIC handshake over c.
+func (t *Transport) NewConn(c net.Conn, isServer bool) (smux.Conn, error) {
+	tlsConf := t.TLSConfig.Clone()
+	if tlsConf == nil {
+		tlsConf = &tls.Config{}
+	}
+	if len(tlsConf.NextProtos) == 0 {
+		tlsConf.NextProtos = []string{DefaultALPN}
+	}
+
+	conf := t.Config
+	if conf == nil {
+		conf = &quicgo.Config{MaxIncomingStreams: DefaultMaxIncomingStreams}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pc := newPacketConn(c)
+	hc := &handshakeConn{
+		nc:     c,
+		tr:     &quicgo.Transport{Conn: pc},
+		cancel: cancel,
+		ready:  make(chan struct{}),
+	}
+	go func() {
+		defer close(hc.ready)
+		var qc *quicgo.Conn
+		var err error
+		if isServer {
+			var l *quicgo.Listener
+			l, err = hc.tr.Listen(tlsConf, conf)
+			if err == nil {
+				qc, err = l.Accept(ctx)
+			}
+		} else {
+			qc, err = hc.tr.Dial(ctx, c.RemoteAddr(), tlsConf, conf)
+		}
+		if err != nil {
+			hc.err = err
+			hc.tr.Close()
+			pc.Close()
+			return
+		}
+		hc.Conn = &conn{qc: qc, outer: hc, announce: true}
+	}()
+	return hc, nil
+}
+
+// handshakeConn is a connection whose handshake may still be running.
+// Conn and err are set once ready is closed.
+type handshakeConn struct {
+	smux.Conn
+	err    error
+	nc     net.Conn
+	tr     *quicgo.Transport
+	cancel context.CancelFunc
+	ready  chan struct{}
+
+	closeOnce sync.Once
+}
+
+func (c *handshakeConn) wait() error {
+	<-c.ready
+	return c.err
+}
+
+// Handshake waits for the QUIC handshake, and returns why it failed.
+func (c *handshakeConn) Handshake() error {
+	return c.wait()
+}
+
+func (c *handshakeConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.cancel()
+		<-c.ready
+		if c.Conn != nil {
+			err = c.Conn.Close()
+		}
+		// closing the quic-go Transport leaves its Conn open.
+		c.tr.Close()
+		c.tr.Conn.Close()
+	})
+	return err
+}
+
+func (c *handshakeConn) IsClosed() bool {
+	select {
+	case <-c.ready:
+	default:
+		return false
+	}
+	return c.Conn == nil || c.Conn.IsClosed()
+}
+
+// NetConn returns the net.Conn the QUIC packets are carried over.
+func (c *handshakeConn) NetConn() net.Conn {
+	return c.nc
+}
+
+func (c *handshakeConn) OpenStream() (smux.Stream, error) {
+	if err := c.wait(); err != nil {
+		return nil, err
+	}
+	return c.Conn.OpenStream()
+}
+
+func (c *handshakeConn) AcceptStream() (smux.Stream, error) {
+	if err := c.wait(); err != nil {
+		return nil, err
+	}
+	return c.Conn.AcceptStream()
+}
+
+// packetConn carries the datagrams of a net.PacketConn over a net.Conn,
+// each prefixed with its length as a big endian uint16.
+type packetConn struct {
+	c  net.Conn
+	br *bufio.Reader
+
+	wmu  sync.Mutex
+	wbuf []byte
+}
+
+func newPacketConn(c net.Conn) *packetConn {
+	return &packetConn{c: c, br: bufio.NewReader(c)}
+}
+
+// ReadFrom reads a datagram, truncating it to the size of b.
+func (pc *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(pc.br, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	size := int(binary.BigEndian.Uint16(hdr[:]))
+	n := size
+	if n > len(b) {
+		n = len(b)
+	}
+	if _, err := io.ReadFull(pc.br, b[:n]); err != nil {
+		return 0, nil, err
+	}
+	if _, err := pc.br.Discard(size - n); err != nil {
+		return 0, nil, err
+	}
+	return n, pc.c.RemoteAddr(), nil
+}
+
+// WriteTo writes a datagram to the peer, regardless of addr.
+func (pc *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	pc.wmu.Lock()
+	defer pc.wmu.Unlock()
+	pc.wbuf = append(pc.wbuf[:0], 0, 0)
+	binary.BigEndian.PutUint16(pc.wbuf, uint16(len(b)))
+	pc.wbuf = append(pc.wbuf, b...)
+	if _, err := pc.c.Write(pc.wbuf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (pc *packetConn) Close() error                       { return pc.c.Close() }
+func (pc *packetConn) LocalAddr() net.Addr                { return pc.c.LocalAddr() }
+func (pc *packetConn) SetDeadline(t time.Time) error      { return pc.c.SetDeadline(t) }
+func (pc *packetConn) SetReadDeadline(t time.Time) error  { return pc.c.SetReadDeadline(t) }
+func (pc *packetConn) SetWriteDeadline(t time.Time) error { return pc.c.SetWriteDeadline(t) }
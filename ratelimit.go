@@ -0,0 +1,372 @@
+package streammux
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// RateLimit is a token bucket limit on the throughput of a direction of a
+// stream or connection.
+type RateLimit struct {
+	// Rate is the number of bytes per second let through on average.
+	// Zero means no limit.
+	Rate int
+
+	// Burst is the number of bytes let through at once after a pause,
+	// and the largest write passed on in one piece. Zero means a tenth
+	// of Rate.
+	Burst int
+}
+
+func (l RateLimit) burst() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	if b := l.Rate / 10; b > 0 {
+		return b
+	}
+	return 1
+}
+
+// RateLimits are the limits of WithRateLimits. Each limits the reads or
+// writes of every stream on its own, or of all the streams of the
+// connection together.
+type RateLimits struct {
+	StreamRead, StreamWrite RateLimit
+	ConnRead, ConnWrite     RateLimit
+}
+
+// RateLimitedConn is a Conn of WithRateLimits, whose limits can change
+// while it is in use.
+type RateLimitedConn interface {
+	Conn
+
+	// SetRateLimits replaces the limits of the connection, and those of
+	// its streams but for the streams given their own with
+	// SetStreamRateLimit, from now on.
+	SetRateLimits(l RateLimits)
+}
+
+// RateLimitedStream is implemented by the streams of WithRateLimits.
+type RateLimitedStream interface {
+	// SetRateLimit replaces the limits of the stream's reads and writes,
+	// which the limits of its connection still apply to.
+	SetRateLimit(read, write RateLimit)
+}
+
+// SetStreamRateLimit replaces the limits of the reads and writes of s,
+// looking through the wrappers of this package. It returns
+// ErrNotSupported if s is not a stream of WithRateLimits.
+func SetStreamRateLimit(s Stream, read, write RateLimit) error {
+	s, ok := findStream(s, func(s Stream) bool {
+		_, ok := s.(RateLimitedStream)
+		return ok
+	})
+	if !ok {
+		return ErrNotSupported
+	}
+	s.(RateLimitedStream).SetRateLimit(read, write)
+	return nil
+}
+
+// WithRateLimits wraps c so that the reads and writes of its streams are
+// limited by l, each stream's on its own and all together, so that one
+// stream moving bulk data cannot take all of a link shared with others.
+// Writes wait for their bytes to be let through, writing no more than a
+// burst at a time, and reads for the bytes they returned, which leaves
+// the data unread in the muxer's receive window, and so slows the peer
+// down too. Waits end with the stream's deadlines, returning ErrTimeout,
+// and when the stream is reset or the connection closed.
+func WithRateLimits(c Conn, l RateLimits) RateLimitedConn {
+	rc := &rateLimitConn{
+		Conn:    c,
+		limits:  l,
+		streams: make(map[*rateLimitStream]struct{}),
+		done:    make(chan struct{}),
+	}
+	rc.read.set(l.ConnRead)
+	rc.write.set(l.ConnWrite)
+	return rc
+}
+
+// tokenBucket lets bytes through at its limit. Takers may overdraw it,
+// and wait for it to refill to zero.
+type tokenBucket struct {
+	mu     sync.Mutex
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens of the time since the last refill.
+func (b *tokenBucket) refill(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * float64(b.limit.Rate)
+	}
+	b.last = now
+	if burst := float64(b.limit.burst()); b.tokens > burst {
+		b.tokens = burst
+	}
+}
+
+func (b *tokenBucket) set(l RateLimit) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.limit.Rate > 0 {
+		b.refill(time.Now())
+	}
+	b.limit = l
+	if l.Rate == 0 {
+		b.tokens, b.last = 0, time.Time{}
+		return
+	}
+	if b.last.IsZero() {
+		// a new limit starts with a full burst.
+		b.tokens = float64(l.burst())
+	}
+	b.refill(time.Now())
+}
+
+// chunk returns the most bytes to take at once, or 0 for no limit.
+func (b *tokenBucket) chunk() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.limit.Rate == 0 {
+		return 0
+	}
+	return b.limit.burst()
+}
+
+// take takes n bytes from the bucket, and returns how long to wait for
+// them to be let through.
+func (b *tokenBucket) take(n int, now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.limit.Rate == 0 {
+		return 0
+	}
+	b.refill(now)
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(b.limit.Rate) * float64(time.Second))
+}
+
+// minChunk returns the smaller chunk of a and b, ignoring those without a
+// limit.
+func minChunk(a, b int) int {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+type rateLimitConn struct {
+	Conn
+	read, write tokenBucket
+
+	mu      sync.Mutex
+	limits  RateLimits
+	streams map[*rateLimitStream]struct{}
+
+	closeOnce sync.Once
+	done      chan struct{} // closed by Close
+}
+
+func (c *rateLimitConn) unwrapConn() Conn {
+	return c.Conn
+}
+
+func (c *rateLimitConn) wrap(s Stream) Stream {
+	rs := &rateLimitStream{Stream: s, conn: c, reset: make(chan struct{})}
+	c.mu.Lock()
+	rs.read.set(c.limits.StreamRead)
+	rs.write.set(c.limits.StreamWrite)
+	c.streams[rs] = struct{}{}
+	c.mu.Unlock()
+	return rs
+}
+
+func (c *rateLimitConn) OpenStream() (Stream, error) {
+	s, err := c.Conn.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return c.wrap(s), nil
+}
+
+func (c *rateLimitConn) AcceptStream() (Stream, error) {
+	s, err := c.Conn.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return c.wrap(s), nil
+}
+
+func (c *rateLimitConn) SetRateLimits(l RateLimits) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.limits = l
+	c.read.set(l.ConnRead)
+	c.write.set(l.ConnWrite)
+	for s := range c.streams {
+		if !s.custom {
+			s.read.set(l.StreamRead)
+			s.write.set(l.StreamWrite)
+		}
+	}
+}
+
+func (c *rateLimitConn) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
+
+type rateLimitStream struct {
+	Stream
+	conn        *rateLimitConn
+	read, write tokenBucket
+	custom      bool // guarded by conn.mu
+	end         streamEnd
+
+	mu                          sync.Mutex
+	readDeadline, writeDeadline time.Time
+
+	resetOnce sync.Once
+	reset     chan struct{} // closed by Reset
+}
+
+func (s *rateLimitStream) unwrapStream() Stream {
+	return s.Stream
+}
+
+func (s *rateLimitStream) Conn() Conn {
+	return s.conn
+}
+
+func (s *rateLimitStream) SetRateLimit(read, write RateLimit) {
+	s.conn.mu.Lock()
+	defer s.conn.mu.Unlock()
+	s.custom = true
+	s.read.set(read)
+	s.write.set(write)
+}
+
+func (s *rateLimitStream) finish(write, read, reset bool) {
+	if s.end.done(write, read, reset) {
+		s.conn.mu.Lock()
+		delete(s.conn.streams, s)
+		s.conn.mu.Unlock()
+	}
+}
+
+// wait waits for n bytes to be let through by the buckets of the stream
+// and the connection, or for the deadline.
+func (s *rateLimitStream) wait(stream, conn *tokenBucket, n int, deadline time.Time) error {
+	now := time.Now()
+	d := stream.take(n, now)
+	if cd := conn.take(n, now); cd > d {
+		d = cd
+	}
+	if d <= 0 {
+		return nil
+	}
+	var err error
+	if !deadline.IsZero() && now.Add(d).After(deadline) {
+		d, err = deadline.Sub(now), ErrTimeout
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return err
+	case <-s.reset:
+		return ErrReset
+	case <-s.conn.done:
+		return ErrConnClosed
+	}
+}
+
+func (s *rateLimitStream) deadlines() (read, write time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.readDeadline, s.writeDeadline
+}
+
+func (s *rateLimitStream) Read(b []byte) (int, error) {
+	if chunk := minChunk(s.read.chunk(), s.conn.read.chunk()); chunk > 0 && len(b) > chunk {
+		b = b[:chunk]
+	}
+	n, err := s.Stream.Read(b)
+	if n > 0 {
+		deadline, _ := s.deadlines()
+		if werr := s.wait(&s.read, &s.conn.read, n, deadline); werr != nil && err == nil {
+			// the bytes were read all the same.
+			err = werr
+		}
+	}
+	switch {
+	case err == io.EOF:
+		s.finish(false, true, false)
+	case isReset(err):
+		s.finish(false, false, true)
+	}
+	return n, err
+}
+
+func (s *rateLimitStream) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		p := b
+		if chunk := minChunk(s.write.chunk(), s.conn.write.chunk()); chunk > 0 && len(p) > chunk {
+			p = p[:chunk]
+		}
+		_, deadline := s.deadlines()
+		if err := s.wait(&s.write, &s.conn.write, len(p), deadline); err != nil {
+			return written, err
+		}
+		n, err := s.Stream.Write(p)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[len(p):]
+	}
+	return written, nil
+}
+
+func (s *rateLimitStream) SetDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.readDeadline, s.writeDeadline = t, t
+	s.mu.Unlock()
+	return s.Stream.SetDeadline(t)
+}
+
+func (s *rateLimitStream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.readDeadline = t
+	s.mu.Unlock()
+	return s.Stream.SetReadDeadline(t)
+}
+
+func (s *rateLimitStream) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.writeDeadline = t
+	s.mu.Unlock()
+	return s.Stream.SetWriteDeadline(t)
+}
+
+func (s *rateLimitStream) Close() error {
+	err := s.Stream.Close()
+	s.finish(true, false, false)
+	return err
+}
+
+func (s *rateLimitStream) Reset() error {
+	s.resetOnce.Do(func() { close(s.reset) })
+	err := s.Stream.Reset()
+	s.finish(false, false, true)
+	return err
+}
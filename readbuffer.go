@@ -0,0 +1,43 @@
+package streammux
+
+// BufferReader is implemented by Streams that can hand out the buffers
+// they received data in, typically pooled frame payloads, rather than copy
+// them into the caller's slice as Read does. Proxies copying streams
+// elsewhere skip a copy of everything they forward.
+type BufferReader interface {
+	// ReadBuffer returns the data received next, at least a byte, and
+	// blocks, fails and observes deadlines as Read does. The caller owns
+	// the buffer until it hands it back with ReleaseBuffer.
+	ReadBuffer() ([]byte, error)
+
+	// ReleaseBuffer hands back a buffer returned by ReadBuffer, which
+	// must not be used afterwards.
+	ReleaseBuffer(b []byte)
+}
+
+// ReadBuffer returns the data read next from s, in a buffer of s if it is
+// a BufferReader, and otherwise read into a CopyBufferSize buffer of
+// DefaultBufferPool. Either way, the buffer is handed back with
+// ReleaseBuffer once done with.
+func ReadBuffer(s Stream) ([]byte, error) {
+	if br, ok := s.(BufferReader); ok {
+		return br.ReadBuffer()
+	}
+	buf := DefaultBufferPool.Get(CopyBufferSize)
+	n, err := s.Read(buf)
+	if n == 0 {
+		DefaultBufferPool.Put(buf)
+		return nil, err
+	}
+	// the error, if any, is returned by the next read.
+	return buf[:n], nil
+}
+
+// ReleaseBuffer hands back a buffer returned by ReadBuffer(s).
+func ReleaseBuffer(s Stream, b []byte) {
+	if br, ok := s.(BufferReader); ok {
+		br.ReleaseBuffer(b)
+		return
+	}
+	DefaultBufferPool.Put(b[:cap(b)])
+}
@@ -0,0 +1,90 @@
+package streammux
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// ErrNoProtocolID is returned when registering a transport that does not
+// report its protocol ID under that ID.
+var ErrNoProtocolID = errors.New("transport does not report a protocol ID")
+
+// Registry maps protocol IDs (e.g. "/yamux/1.0.0") to Transports, so that
+// negotiation layers and command line tools can be configured by name.
+// It is safe for concurrent use.
+type Registry struct {
+	mu         sync.RWMutex
+	transports map[string]Transport
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{transports: make(map[string]Transport)}
+}
+
+// Register registers tr under id, replacing any transport previously
+// registered under it.
+func (r *Registry) Register(id string, tr Transport) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.transports[id] = tr
+}
+
+// RegisterTransport registers tr under the protocol ID it reports.
+func (r *Registry) RegisterTransport(tr Transport) error {
+	id := ProtocolID(tr)
+	if id == "" {
+		return ErrNoProtocolID
+	}
+	r.Register(id, tr)
+	return nil
+}
+
+// Unregister removes the transport registered under id, if any.
+func (r *Registry) Unregister(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.transports, id)
+}
+
+// Get returns the transport registered under id.
+func (r *Registry) Get(id string) (Transport, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	tr, ok := r.transports[id]
+	return tr, ok
+}
+
+// IDs returns the sorted protocol IDs of all registered transports.
+func (r *Registry) IDs() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ids := make([]string, 0, len(r.transports))
+	for id := range r.transports {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// DefaultRegistry is the process-wide registry. Muxer packages register
+// their default transport in it when imported, and applications may
+// override any entry.
+var DefaultRegistry = NewRegistry()
+
+// Register registers tr under id in the DefaultRegistry.
+func Register(id string, tr Transport) {
+	DefaultRegistry.Register(id, tr)
+}
+
+// RegisterTransport registers tr under the protocol ID it reports in the
+// DefaultRegistry.
+func RegisterTransport(tr Transport) error {
+	return DefaultRegistry.RegisterTransport(tr)
+}
+
+// Get returns the transport registered under id in the DefaultRegistry.
+func Get(id string) (Transport, bool) {
+	return DefaultRegistry.Get(id)
+}
@@ -0,0 +1,70 @@
+package streammux
+
+import "io"
+
+// MaxRequestSize is the largest request or response DoRequest and
+// RequestHandler accept.
+const MaxRequestSize = 1 << 22
+
+// StreamHandler handles a stream, typically one accepted from a Conn.
+type StreamHandler func(Stream)
+
+func writeMessage(w io.Writer, msg []byte) error {
+	if len(msg) > MaxRequestSize {
+		return ErrMessageTooLarge
+	}
+	return WriteUint32Prefixed(w, msg)
+}
+
+func readMessage(r io.Reader) ([]byte, error) {
+	return ReadUint32Prefixed(r, MaxRequestSize)
+}
+
+// DoRequest opens a stream on c, sends req as a length-prefixed message,
+// closes the stream for writing and returns the length-prefixed response
+// read back. The stream is reset on any error. It is the client side of
+// RequestHandler.
+func DoRequest(c Conn, req []byte) ([]byte, error) {
+	s, err := c.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeMessage(s, req); err != nil {
+		s.Reset()
+		return nil, err
+	}
+	if err := s.Close(); err != nil {
+		s.Reset()
+		return nil, err
+	}
+	resp, err := readMessage(s)
+	if err != nil {
+		s.Reset()
+		return nil, err
+	}
+	return resp, nil
+}
+
+// RequestHandler returns a StreamHandler that reads a length-prefixed
+// request from each stream, answers with the length-prefixed response
+// returned by handle and closes the stream. If reading the request or
+// handle fails, the stream is reset, which DoRequest reports as an error.
+func RequestHandler(handle func(req []byte) ([]byte, error)) StreamHandler {
+	return func(s Stream) {
+		req, err := readMessage(s)
+		if err != nil {
+			s.Reset()
+			return
+		}
+		resp, err := handle(req)
+		if err != nil {
+			s.Reset()
+			return
+		}
+		if err := writeMessage(s, resp); err != nil {
+			s.Reset()
+			return
+		}
+		s.Close()
+	}
+}
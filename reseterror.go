@@ -0,0 +1,71 @@
+package streammux
+
+import (
+	"errors"
+	"fmt"
+)
+
+// StreamError is the error of the reads and writes of a stream the peer
+// reset with ResetWithError, carrying the code it gave. It is ErrReset to
+// errors.Is, so that code checking for resets that way need not know of
+// codes.
+type StreamError struct {
+	Code uint32
+}
+
+func (e StreamError) Error() string {
+	return fmt.Sprintf("stream reset by the peer with error code %d", e.Code)
+}
+
+// Is returns whether target is ErrReset.
+func (e StreamError) Is(target error) bool {
+	return target == ErrReset
+}
+
+// ErrorResetter is implemented by Streams whose muxer carries an
+// application error code with resets, so that protocols on streams can
+// tell why a stream was given up, e.g. cancelled or out of resources,
+// without a message of their own.
+type ErrorResetter interface {
+	// ResetWithError resets the stream like Reset, failing the reads and
+	// writes of the peer with a StreamError of code rather than ErrReset.
+	// Code 0 is a plain Reset.
+	ResetWithError(code uint32) error
+}
+
+// ResetWithError resets s with the application error code, looking through
+// the wrappers of this package, which are then reset as with Reset. It
+// returns ErrNotSupported, leaving s as it is, if s is not an
+// ErrorResetter.
+func ResetWithError(s Stream, code uint32) error {
+	if er, ok := s.(ErrorResetter); ok {
+		return er.ResetWithError(code)
+	}
+	inner, ok := findStream(s, func(s Stream) bool {
+		_, ok := s.(ErrorResetter)
+		return ok
+	})
+	if !ok {
+		return ErrNotSupported
+	}
+	err := inner.(ErrorResetter).ResetWithError(code)
+	// the inner stream is reset already, and resets no further.
+	s.Reset()
+	return err
+}
+
+// ResetCode returns the code of a StreamError, the error of a stream the
+// peer reset with ResetWithError, and false for other errors.
+func ResetCode(err error) (uint32, bool) {
+	var se StreamError
+	if errors.As(err, &se) {
+		return se.Code, true
+	}
+	return 0, false
+}
+
+// isReset returns whether err is that of a reset stream: ErrReset, or a
+// StreamError.
+func isReset(err error) bool {
+	return errors.Is(err, ErrReset)
+}
@@ -0,0 +1,60 @@
+package results
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+)
+
+// StartProfiles starts a CPU profile of the process, for the test
+// package's -smux.profile and cmd/benchmux's -profile, written to dir,
+// which is created if need be, along with a heap profile once the
+// returned function is called. The files are named after name, usually
+// the muxer and the workload, as name.cpu.pprof and name.heap.pprof, with
+// the slashes of benchmark names and protocol IDs replaced, so that the
+// profiles of a run sit next to its results. Only one CPU profile can run
+// at once in a process.
+func StartProfiles(dir, name string) (stop func() error, err error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	base := filepath.Join(dir, profileName(name))
+	f, err := os.Create(base + ".cpu.pprof")
+	if err != nil {
+		return nil, err
+	}
+	if err := pprof.StartCPUProfile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() error {
+		pprof.StopCPUProfile()
+		if err := f.Close(); err != nil {
+			return err
+		}
+		return writeHeapProfile(base + ".heap.pprof")
+	}, nil
+}
+
+// profileName returns name as a file name.
+func profileName(name string) string {
+	name = strings.Trim(name, "/")
+	return strings.NewReplacer("/", "_", string(filepath.Separator), "_", " ", "_").Replace(name)
+}
+
+// writeHeapProfile writes the heap profile as of the last garbage
+// collection, which it runs first, to path.
+func writeHeapProfile(path string) error {
+	runtime.GC()
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
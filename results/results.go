@@ -0,0 +1,171 @@
+// Package results is the JSON format of the results of the test package's
+// subtests and benchmarks, with -smux.json, and of cmd/benchmux, with
+// -json, so that muxer implementers can keep the results of their runs to
+// track regressions over time, and compare them in a table:
+//
+//	benchmux -compare before.json,after.json
+//
+// StartProfiles writes the CPU and heap profiles of the runs next to them.
+package results
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// The metrics recorded by the test package and cmd/benchmux. Benchmarks
+// may report others, such as latency percentiles in "p99-ns".
+const (
+	MBPerSec    = "MB/s"
+	NsPerOp     = "ns/op"
+	AllocsPerOp = "allocs/op"
+	Allocs      = "allocs"     // of a whole subtest or workload
+	Goroutines  = "goroutines" // peak, above those running before
+)
+
+// The statuses of results.
+const (
+	Pass = "pass"
+	Fail = "FAIL"
+	Skip = "skip"
+)
+
+// Result is the outcome of a subtest, benchmark or benchmux workload run
+// against a transport. Error is what a failed run failed with, and
+// Features the smux.Features the transport declares, if it does.
+type Result struct {
+	Transport string             `json:"transport,omitempty"`
+	Network   string             `json:"network,omitempty"` // if several are run
+	Features  string             `json:"features,omitempty"`
+	Name      string             `json:"name"`
+	Status    string             `json:"status"`
+	Error     string             `json:"error,omitempty"`
+	Duration  time.Duration      `json:"duration_ns"`
+	Metrics   map[string]float64 `json:"metrics,omitempty"`
+}
+
+// Column returns the name of the column of tables r is in: its transport,
+// and its network if any.
+func (r Result) Column() string {
+	if r.Network == "" {
+		return r.Transport
+	}
+	return r.Transport + "/" + r.Network
+}
+
+// Write writes rs to w as indented JSON.
+func Write(w io.Writer, rs []Result) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(rs)
+}
+
+// Read reads results written by Write from r.
+func Read(r io.Reader) ([]Result, error) {
+	var rs []Result
+	if err := json.NewDecoder(r).Decode(&rs); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+// WriteFile writes rs to the file path, replacing it.
+func WriteFile(path string, rs []Result) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := Write(f, rs); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ReadFile reads the results written to the file path.
+func ReadFile(path string) ([]Result, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rs, err := Read(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return rs, nil
+}
+
+// Table writes a table of rs to w, with a row per name and metric, a
+// status row per name, and a column per Column, in the order they come in
+// rs. Results of several runs are compared by giving their columns
+// different names, such as the files they were read from.
+func Table(w io.Writer, rs []Result) error {
+	var columns, names []string
+	seenColumn := make(map[string]bool)
+	seenName := make(map[string]bool)
+	seenMetric := make(map[[2]string]bool)
+	metrics := make(map[string][]string) // by name
+	cells := make(map[[3]string]string)  // by name, metric and column
+	for _, r := range rs {
+		col := r.Column()
+		if !seenColumn[col] {
+			seenColumn[col] = true
+			columns = append(columns, col)
+		}
+		if !seenName[r.Name] {
+			seenName[r.Name] = true
+			names = append(names, r.Name)
+		}
+		cells[[3]string{r.Name, "", col}] = r.Status
+		for m, v := range r.Metrics {
+			if !seenMetric[[2]string{r.Name, m}] {
+				seenMetric[[2]string{r.Name, m}] = true
+				metrics[r.Name] = append(metrics[r.Name], m)
+			}
+			cells[[3]string{r.Name, m, col}] = formatMetric(v)
+		}
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprint(tw, "NAME\tMETRIC")
+	for _, col := range columns {
+		fmt.Fprintf(tw, "\t%s", col)
+	}
+	fmt.Fprintln(tw)
+	for _, name := range names {
+		ms := metrics[name]
+		sort.Strings(ms)
+		for _, m := range append([]string{""}, ms...) {
+			label := m
+			if m == "" {
+				label = "status"
+			}
+			fmt.Fprintf(tw, "%s\t%s", name, label)
+			for _, col := range columns {
+				cell, ok := cells[[3]string{name, m, col}]
+				if !ok {
+					cell = "-"
+				}
+				fmt.Fprintf(tw, "\t%s", cell)
+			}
+			fmt.Fprintln(tw)
+		}
+	}
+	return tw.Flush()
+}
+
+// formatMetric formats v with 4 significant digits, or as a whole number
+// from 1000 on.
+func formatMetric(v float64) string {
+	if math.Abs(v) >= 1000 {
+		return fmt.Sprintf("%.0f", v)
+	}
+	return fmt.Sprintf("%.4g", v)
+}
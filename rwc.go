@@ -0,0 +1,92 @@
+package streammux
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// Addresser is implemented by io.ReadWriteClosers that know the addresses
+// of their endpoints, like SSH channels or WebRTC data channels.
+type Addresser interface {
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+}
+
+// RWCTransport is implemented by Transports that can mux over any
+// io.ReadWriteCloser natively, rather than over a net.Conn.
+type RWCTransport interface {
+	Transport
+
+	// NewConnRWC constructs a new connection over rwc.
+	NewConnRWC(rwc io.ReadWriteCloser, isServer bool) (Conn, error)
+}
+
+// NewConnRWC establishes a muxed connection over rwc, such as stdio, an
+// SSH channel or a serial port. Natively if tr is an RWCTransport,
+// otherwise through RWCNetConn.
+func NewConnRWC(tr Transport, rwc io.ReadWriteCloser, isServer bool) (Conn, error) {
+	if rt, ok := tr.(RWCTransport); ok {
+		return rt.NewConnRWC(rwc, isServer)
+	}
+	return tr.NewConn(RWCNetConn(rwc), isServer)
+}
+
+// RWCNetConn returns rwc as a net.Conn. An rwc that already implements
+// net.Conn is returned as is. Others report their addresses if they are an
+// Addresser, and a placeholder "smux" address otherwise. Deadlines are
+// passed through to the rwc if it has the methods, and return
+// ErrNotSupported otherwise.
+func RWCNetConn(rwc io.ReadWriteCloser) net.Conn {
+	if nc, ok := rwc.(net.Conn); ok {
+		return nc
+	}
+	return rwcConn{rwc}
+}
+
+type rwcConn struct {
+	io.ReadWriteCloser
+}
+
+type readDeadliner interface {
+	SetReadDeadline(time.Time) error
+}
+
+type writeDeadliner interface {
+	SetWriteDeadline(time.Time) error
+}
+
+func (c rwcConn) LocalAddr() net.Addr {
+	if a, ok := c.ReadWriteCloser.(Addresser); ok {
+		return a.LocalAddr()
+	}
+	return muxAddr{}
+}
+
+func (c rwcConn) RemoteAddr() net.Addr {
+	if a, ok := c.ReadWriteCloser.(Addresser); ok {
+		return a.RemoteAddr()
+	}
+	return muxAddr{}
+}
+
+func (c rwcConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c rwcConn) SetReadDeadline(t time.Time) error {
+	if d, ok := c.ReadWriteCloser.(readDeadliner); ok {
+		return d.SetReadDeadline(t)
+	}
+	return ErrNotSupported
+}
+
+func (c rwcConn) SetWriteDeadline(t time.Time) error {
+	if d, ok := c.ReadWriteCloser.(writeDeadliner); ok {
+		return d.SetWriteDeadline(t)
+	}
+	return ErrNotSupported
+}
@@ -0,0 +1,104 @@
+package streammux
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Serve accepts streams from c and calls h on each in its own goroutine,
+// for code written against a callback rather than an accept loop, like
+// ServeContext without a context.
+func Serve(c Conn, h StreamHandler) error {
+	return ServeContext(context.Background(), c, h)
+}
+
+// ServeContext accepts streams from c and calls h on each in its own
+// goroutine, until ctx is done, which closes c, or AcceptStream fails,
+// typically once c is closed. It returns ctx.Err() or the error
+// AcceptStream failed with, once h returned on every stream, so that a
+// server stopped by cancelling ctx leaves no goroutines behind.
+func ServeContext(ctx context.Context, c Conn, h StreamHandler) error {
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-stopped:
+		}
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		s, err := c.AcceptStream()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h(s)
+		}()
+	}
+}
+
+// ServeConn muxes nc with tr, as the server if isServer, and serves the
+// streams the peer opens with h in the background, with ServeContext,
+// until ctx is done or the returned Conn is closed.
+func ServeConn(ctx context.Context, tr Transport, nc net.Conn, isServer bool, h StreamHandler) (Conn, error) {
+	c, err := tr.NewConn(nc, isServer)
+	if err != nil {
+		return nil, err
+	}
+	go ServeContext(ctx, c, h)
+	return c, nil
+}
+
+// EchoHandler writes back everything it reads from streams, and closes
+// them once the peer closes them for writing.
+var EchoHandler StreamHandler = func(s Stream) {
+	defer s.Close()
+	io.Copy(s, s)
+}
+
+// DiscardHandler reads and discards everything from streams, and closes
+// them once the peer closes them for writing.
+var DiscardHandler StreamHandler = func(s Stream) {
+	defer s.Close()
+	io.Copy(ioutil.Discard, s)
+}
+
+// CloseHandler closes streams as soon as they are opened, without reading
+// them.
+var CloseHandler StreamHandler = func(s Stream) { s.Close() }
+
+// RandomLatencyEchoHandler returns a StreamHandler like EchoHandler which
+// waits up to max, at random, before writing back every read, as a server
+// doing some work on every request would.
+func RandomLatencyEchoHandler(max time.Duration) StreamHandler {
+	return func(s Stream) {
+		defer s.Close()
+		buf := make([]byte, 32<<10)
+		for {
+			n, err := s.Read(buf)
+			if n > 0 {
+				time.Sleep(time.Duration(rand.Int63n(int64(max) + 1)))
+				if _, err := s.Write(buf[:n]); err != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+}
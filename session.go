@@ -0,0 +1,96 @@
+package streammux
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrSessionClosed is the error of a Session that was closed locally while
+// a stream was waiting to be received.
+var ErrSessionClosed = errors.New("session closed")
+
+// Session presents a Conn as channels, for applications built around
+// select loops: accepted streams arrive on Streams and Done is closed once
+// the connection can no longer accept streams.
+type Session struct {
+	Conn
+
+	streams chan Stream
+	done    chan struct{}
+	closing chan struct{}
+	once    sync.Once
+	err     error
+}
+
+// NewSession starts accepting streams on c and returns the channel view
+// of it. The session owns accepting on c; AcceptStream must not be called
+// on c concurrently.
+func NewSession(c Conn) *Session {
+	s := &Session{
+		Conn:    c,
+		streams: make(chan Stream),
+		done:    make(chan struct{}),
+		closing: make(chan struct{}),
+	}
+	go s.acceptLoop()
+	return s
+}
+
+func (s *Session) acceptLoop() {
+	defer close(s.done)
+	defer close(s.streams)
+	for {
+		str, err := s.Conn.AcceptStream()
+		if err != nil {
+			s.err = err
+			return
+		}
+		select {
+		case s.streams <- str:
+		case <-s.closing:
+			str.Reset()
+			s.err = ErrSessionClosed
+			return
+		}
+	}
+}
+
+// Streams returns the channel on which accepted streams are delivered. It
+// is closed when accepting fails.
+func (s *Session) Streams() <-chan Stream {
+	return s.streams
+}
+
+// Done returns a channel that is closed when the session stopped
+// accepting streams, usually because the connection was closed.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns the reason the session stopped accepting streams, or nil if
+// Done is not closed yet.
+func (s *Session) Err() error {
+	select {
+	case <-s.done:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+// AcceptStream receives the next stream from Streams, so a Session can
+// still be used as a regular Conn.
+func (s *Session) AcceptStream() (Stream, error) {
+	str, ok := <-s.streams
+	if !ok {
+		<-s.done
+		return nil, s.err
+	}
+	return str, nil
+}
+
+// Close closes the connection and stops delivering streams.
+func (s *Session) Close() error {
+	s.once.Do(func() { close(s.closing) })
+	return s.Conn.Close()
+}
@@ -0,0 +1,311 @@
+package streammux
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnStat are the statistics of a connection since it was established.
+type ConnStat struct {
+	// BytesSent and BytesReceived count stream data, without the
+	// muxer's framing.
+	BytesSent     uint64
+	BytesReceived uint64
+
+	// FramesSent and FramesReceived count the muxer's frames, or are
+	// zero if it does not report them.
+	FramesSent     uint64
+	FramesReceived uint64
+
+	StreamsOpened   uint64
+	StreamsAccepted uint64
+	// StreamsReset counts the streams reset by either side.
+	StreamsReset uint64
+
+	// OpenStreams is the number of streams currently open.
+	OpenStreams int
+
+	// WindowStalls counts the times writes of the streams blocked on
+	// the peer's flow control window, and WindowStalled is how long
+	// they did, summed over the streams, those stalled now included.
+	// Both are zero for muxers which do not report stalls.
+	WindowStalls  uint64
+	WindowStalled time.Duration
+}
+
+// StatConn is implemented by Conns that keep statistics.
+type StatConn interface {
+	Conn
+	Stat() ConnStat
+}
+
+// StreamStat are the statistics and state of a stream.
+type StreamStat struct {
+	BytesSent     uint64
+	BytesReceived uint64
+
+	// Opened is when the stream was opened or accepted.
+	Opened time.Time
+
+	// WriteClosed is set once the stream was closed for writing, and
+	// ReadClosed once EOF was read. Both are set once it was reset.
+	WriteClosed bool
+	ReadClosed  bool
+	Reset       bool
+
+	// WindowStalls and WindowStalled are those of the stream's writes,
+	// as in ConnStat.
+	WindowStalls  uint64
+	WindowStalled time.Duration
+}
+
+// StatStream is implemented by Streams that keep statistics.
+type StatStream interface {
+	Stat() StreamStat
+}
+
+// StreamStats returns the statistics of s, looking through the wrappers of
+// this package. ok is false if s does not keep statistics.
+func StreamStats(s Stream) (st StreamStat, ok bool) {
+	s, ok = findStream(s, func(s Stream) bool {
+		_, ok := s.(StatStream)
+		return ok
+	})
+	if !ok {
+		return StreamStat{}, false
+	}
+	return s.(StatStream).Stat(), true
+}
+
+// WithStats returns c if it is a StatConn, and otherwise wraps c to count
+// the data and streams going through the wrapper, whose streams are then
+// StatStreams. Frames are not visible to it, so their counts stay zero.
+// Window stalls are counted if c is an EventReporter, in which case the
+// wrapper is one too, passing the events on with its own streams.
+func WithStats(c Conn) StatConn {
+	if sc, ok := c.(StatConn); ok {
+		return sc
+	}
+	sc := &statConn{Conn: c}
+	if er, ok := c.(EventReporter); ok {
+		sc.streams = make(map[Stream]*statStream)
+		er.SetEventHandler(sc.internalEvent)
+	}
+	return sc
+}
+
+type statConn struct {
+	// the counters come first to be 64-bit aligned for atomic access.
+	bytesSent, bytesReceived          uint64
+	opened, accepted, reset, finished uint64
+	stalls, stalled                   uint64 // stalled in nanoseconds, of the stalls over
+
+	Conn
+
+	mu      sync.Mutex
+	streams map[Stream]*statStream // by the streams of Conn, if it reports events
+	handler func(ev TraceEvent, s Stream)
+}
+
+func (c *statConn) unwrapConn() Conn {
+	return c.Conn
+}
+
+func (c *statConn) SetEventHandler(h func(ev TraceEvent, s Stream)) {
+	c.mu.Lock()
+	c.handler = h
+	c.mu.Unlock()
+}
+
+// internalEvent counts the window stalls of the streams, and passes ev on
+// to the handler of SetEventHandler with the wrapper's stream.
+func (c *statConn) internalEvent(ev TraceEvent, s Stream) {
+	c.mu.Lock()
+	ss := c.streams[s]
+	h := c.handler
+	c.mu.Unlock()
+	if ss != nil {
+		switch ev {
+		case EventWindowStall:
+			ss.stall()
+		case EventWindowResume:
+			ss.resume()
+		}
+		s = ss
+	}
+	if h != nil {
+		h(ev, s)
+	}
+}
+
+func (c *statConn) track(s Stream) Stream {
+	ss := &statStream{Stream: s, conn: c, opened: time.Now()}
+	if c.streams != nil {
+		c.mu.Lock()
+		c.streams[s] = ss
+		c.mu.Unlock()
+	}
+	return ss
+}
+
+func (c *statConn) Stat() ConnStat {
+	opened := atomic.LoadUint64(&c.opened)
+	accepted := atomic.LoadUint64(&c.accepted)
+	stalled := time.Duration(atomic.LoadUint64(&c.stalled))
+	c.mu.Lock()
+	for _, s := range c.streams {
+		stalled += s.stalledNow()
+	}
+	c.mu.Unlock()
+	return ConnStat{
+		BytesSent:       atomic.LoadUint64(&c.bytesSent),
+		BytesReceived:   atomic.LoadUint64(&c.bytesReceived),
+		StreamsOpened:   opened,
+		StreamsAccepted: accepted,
+		StreamsReset:    atomic.LoadUint64(&c.reset),
+		OpenStreams:     int(opened + accepted - atomic.LoadUint64(&c.finished)),
+		WindowStalls:    atomic.LoadUint64(&c.stalls),
+		WindowStalled:   stalled,
+	}
+}
+
+func (c *statConn) OpenStream() (Stream, error) {
+	s, err := c.Conn.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddUint64(&c.opened, 1)
+	return c.track(s), nil
+}
+
+func (c *statConn) AcceptStream() (Stream, error) {
+	s, err := c.Conn.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddUint64(&c.accepted, 1)
+	return c.track(s), nil
+}
+
+type statStream struct {
+	bytesSent, bytesReceived uint64
+
+	Stream
+	conn   *statConn
+	opened time.Time
+	end    streamEnd
+
+	stallMu      sync.Mutex
+	stalls       uint64
+	stalled      time.Duration // of the stalls over
+	stalledSince time.Time     // zero unless stalled now
+}
+
+func (s *statStream) stall() {
+	s.stallMu.Lock()
+	defer s.stallMu.Unlock()
+	if s.stalledSince.IsZero() {
+		s.stalledSince = time.Now()
+		s.stalls++
+		atomic.AddUint64(&s.conn.stalls, 1)
+	}
+}
+
+func (s *statStream) resume() {
+	s.stallMu.Lock()
+	defer s.stallMu.Unlock()
+	if !s.stalledSince.IsZero() {
+		d := time.Since(s.stalledSince)
+		s.stalledSince = time.Time{}
+		s.stalled += d
+		atomic.AddUint64(&s.conn.stalled, uint64(d))
+	}
+}
+
+// stalledNow returns how long the stream has been stalled, if it is.
+func (s *statStream) stalledNow() time.Duration {
+	s.stallMu.Lock()
+	defer s.stallMu.Unlock()
+	if s.stalledSince.IsZero() {
+		return 0
+	}
+	return time.Since(s.stalledSince)
+}
+
+func (s *statStream) unwrapStream() Stream {
+	return s.Stream
+}
+
+func (s *statStream) Conn() Conn {
+	return s.conn
+}
+
+func (s *statStream) Stat() StreamStat {
+	writeClosed, readDone, ended := s.end.state()
+	reset := ended && !(writeClosed && readDone)
+	s.stallMu.Lock()
+	stalls, stalled := s.stalls, s.stalled
+	s.stallMu.Unlock()
+	return StreamStat{
+		BytesSent:     atomic.LoadUint64(&s.bytesSent),
+		BytesReceived: atomic.LoadUint64(&s.bytesReceived),
+		Opened:        s.opened,
+		WriteClosed:   writeClosed || reset,
+		ReadClosed:    readDone || reset,
+		Reset:         reset,
+		WindowStalls:  stalls,
+		WindowStalled: stalled + s.stalledNow(),
+	}
+}
+
+func (s *statStream) finish(write, read, reset bool) {
+	if s.end.done(write, read, reset) {
+		if reset {
+			atomic.AddUint64(&s.conn.reset, 1)
+		}
+		atomic.AddUint64(&s.conn.finished, 1)
+		if s.conn.streams != nil {
+			s.resume()
+			s.conn.mu.Lock()
+			delete(s.conn.streams, s.Stream)
+			s.conn.mu.Unlock()
+		}
+	}
+}
+
+func (s *statStream) Read(b []byte) (int, error) {
+	n, err := s.Stream.Read(b)
+	atomic.AddUint64(&s.bytesReceived, uint64(n))
+	atomic.AddUint64(&s.conn.bytesReceived, uint64(n))
+	switch {
+	case err == io.EOF:
+		s.finish(false, true, false)
+	case isReset(err):
+		s.finish(false, false, true)
+	}
+	return n, err
+}
+
+func (s *statStream) Write(b []byte) (int, error) {
+	n, err := s.Stream.Write(b)
+	atomic.AddUint64(&s.bytesSent, uint64(n))
+	atomic.AddUint64(&s.conn.bytesSent, uint64(n))
+	if isReset(err) {
+		s.finish(false, false, true)
+	}
+	return n, err
+}
+
+func (s *statStream) Close() error {
+	err := s.Stream.Close()
+	s.finish(true, false, false)
+	return err
+}
+
+func (s *statStream) Reset() error {
+	err := s.Stream.Reset()
+	s.finish(false, false, true)
+	return err
+}
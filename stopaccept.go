@@ -0,0 +1,110 @@
+package streammux
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrAcceptStopped is returned by AcceptStream after StopAccepting.
+var ErrAcceptStopped = errors.New("connection stopped accepting streams")
+
+// StopAcceptingConn is implemented by Conns that can refuse new inbound
+// streams while keeping existing streams and outbound opens working, e.g.
+// to shed load.
+type StopAcceptingConn interface {
+	Conn
+
+	// StopAccepting makes the connection refuse streams opened by the
+	// peer from now on, such that the peer can retry them elsewhere.
+	// Pending and future AcceptStream calls return ErrAcceptStopped.
+	StopAccepting() error
+}
+
+// RefusedStreamCode is the error code streams refused by the
+// WithStopAccepting emulation are reset with, where the muxer carries codes
+// with resets: that of REFUSED_STREAM in HTTP/2, telling the peer the
+// stream was not processed and can be retried.
+const RefusedStreamCode uint32 = 0x7
+
+// WithStopAccepting returns c if it is a StopAcceptingConn, and otherwise
+// wraps c to emulate StopAccepting by resetting every stream the peer
+// opens after it was called, with RefusedStreamCode if the muxer carries
+// error codes.
+func WithStopAccepting(c Conn) StopAcceptingConn {
+	if sc, ok := c.(StopAcceptingConn); ok {
+		return sc
+	}
+	return &stopAcceptingConn{
+		Conn:     c,
+		stopped:  make(chan struct{}),
+		acceptor: newAcceptor(0),
+	}
+}
+
+type stopAcceptingConn struct {
+	Conn
+
+	start    sync.Once
+	once     sync.Once
+	stopped  chan struct{}
+	acceptor *acceptor
+}
+
+func (c *stopAcceptingConn) unwrapConn() Conn {
+	return c.Conn
+}
+
+// startLoop takes the streams of the muxer in the background from the
+// first AcceptStream or StopAccepting on, handing them to AcceptStream
+// until StopAccepting and refusing them after it.
+func (c *stopAcceptingConn) startLoop() {
+	c.start.Do(func() {
+		go c.acceptor.loop(c.Conn, func(s Stream) {
+			select {
+			case c.acceptor.accepted <- s:
+			case <-c.stopped:
+				refuse(s)
+			}
+		})
+	})
+}
+
+func (c *stopAcceptingConn) AcceptStream() (Stream, error) {
+	select {
+	case <-c.stopped:
+		return nil, ErrAcceptStopped
+	default:
+	}
+
+	c.startLoop()
+	select {
+	case s := <-c.acceptor.accepted:
+		select {
+		case <-c.stopped:
+			refuse(s)
+			return nil, ErrAcceptStopped
+		default:
+			return s, nil
+		}
+	case <-c.acceptor.done:
+		return nil, c.acceptor.err
+	case <-c.stopped:
+		return nil, ErrAcceptStopped
+	}
+}
+
+func (c *stopAcceptingConn) StopAccepting() error {
+	c.once.Do(func() {
+		close(c.stopped)
+		c.startLoop()
+	})
+	return nil
+}
+
+// refuse resets s with RefusedStreamCode, or plainly if its muxer carries
+// no error codes.
+func refuse(s Stream) {
+	if ResetWithError(s, RefusedStreamCode) == ErrNotSupported {
+		s.Reset()
+	}
+}
@@ -0,0 +1,198 @@
+package streammux
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"sync"
+)
+
+// WithStreamTLS wraps tr so that every stream of its connections runs a
+// TLS session of its own, end to end, for deployments where the
+// connection is shared with, or relayed by, parties that must not read or
+// alter what the streams carry. The side opening a stream is the TLS
+// client, with client, typically naming the peer in ServerName, and the
+// side accepting it the server, with server, which needs a certificate.
+// Both sides of a connection must be wrapped, and each needs both
+// configurations to open streams and to accept them.
+//
+// OpenStream returns once the handshake is done, and AcceptStream returns
+// streams whose handshake is done; the streams failing it are reset on
+// the accepting side, and their opening fails. Close sends TLS's
+// close_notify before closing the stream for writing. As with
+// WithCompression, a write past its deadline fails all that follow, as
+// TLS cannot resume a record midway; the transport does not declare
+// FeatureDeadlines, nor FeatureHalfClose, TLS having no way to close a
+// session for reading, nor FeatureReceiveWindow, the windows of the muxer
+// counting the bytes of TLS records rather than those of the stream.
+//
+// Every stream costs a handshake, a round trip and public key operations,
+// and its TLS state, so protocols opening many short streams are better
+// off encrypting their connection instead.
+func WithStreamTLS(tr Transport, client, server *tls.Config) Transport {
+	t := &streamTLSTransport{inner: tr, client: client, server: server}
+	if _, ok := tr.(FeatureTransport); ok {
+		return featureStreamTLSTransport{t}
+	}
+	return t
+}
+
+type streamTLSTransport struct {
+	inner          Transport
+	client, server *tls.Config
+}
+
+// featureStreamTLSTransport is the streamTLSTransport of a
+// FeatureTransport, with its features but those its streams lose, and
+// those of connections.
+type featureStreamTLSTransport struct {
+	*streamTLSTransport
+}
+
+func (t featureStreamTLSTransport) Features() Features {
+	f, _ := TransportFeatures(t.inner)
+	return f &^ (FeatureDeadlines | FeatureHalfClose | FeatureReceiveWindow | connFeatures)
+}
+
+func (t *streamTLSTransport) NewConn(c net.Conn, isServer bool) (Conn, error) {
+	return t.wrap(t.inner.NewConn(c, isServer))
+}
+
+func (t *streamTLSTransport) NewConnRWC(rwc io.ReadWriteCloser, isServer bool) (Conn, error) {
+	return t.wrap(NewConnRWC(t.inner, rwc, isServer))
+}
+
+func (t *streamTLSTransport) wrap(c Conn, err error) (Conn, error) {
+	if err != nil {
+		return nil, err
+	}
+	tc := &streamTLSConn{
+		Conn:     c,
+		client:   t.client,
+		server:   t.server,
+		acceptor: newAcceptor(0),
+	}
+	go tc.acceptLoop()
+	return tc, nil
+}
+
+type streamTLSConn struct {
+	Conn
+	client, server *tls.Config
+	acceptor       *acceptor
+}
+
+func (c *streamTLSConn) unwrapConn() Conn {
+	return c.Conn
+}
+
+func (c *streamTLSConn) OpenStream() (Stream, error) {
+	return c.OpenStreamContext(context.Background())
+}
+
+// OpenStreamContext opens a stream and runs its handshake, giving up on
+// both once ctx is done, and resetting the stream then.
+func (c *streamTLSConn) OpenStreamContext(ctx context.Context) (Stream, error) {
+	s, err := OpenStreamContext(ctx, c.Conn)
+	if err != nil {
+		return nil, err
+	}
+	tc := tls.Client(NetConn(c.Conn, s), c.client)
+	// closing its net.Conn, as HandshakeContext does, only closes the
+	// stream for writing, so the handshake is unblocked by a reset.
+	stop := make(chan struct{})
+	canceled := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Reset()
+			canceled <- true
+		case <-stop:
+			canceled <- false
+		}
+	}()
+	err = tc.Handshake()
+	close(stop)
+	if <-canceled {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		s.Reset()
+		return nil, err
+	}
+	return &tlsStream{Stream: s, conn: c, tc: tc}, nil
+}
+
+// acceptLoop accepts streams and runs their handshakes concurrently, as
+// WithStreamNames reads their names. It runs from the start, rather than
+// once the application accepts, so that opening a stream, which waits for
+// the handshake, does not wait for the peer to accept too.
+func (c *streamTLSConn) acceptLoop() {
+	c.acceptor.prepareLoop(c.Conn, func(s Stream) (Stream, error) {
+		tc := tls.Server(NetConn(c.Conn, s), c.server)
+		if err := tc.Handshake(); err != nil {
+			return nil, err
+		}
+		return &tlsStream{Stream: s, conn: c, tc: tc}, nil
+	})
+}
+
+func (c *streamTLSConn) AcceptStream() (Stream, error) {
+	return c.acceptor.accept(context.Background())
+}
+
+// tlsStream reads and writes through the TLS session tc over Stream,
+// which it resets, and whose deadlines it sets, directly.
+type tlsStream struct {
+	Stream
+	conn *streamTLSConn
+	tc   *tls.Conn
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func (s *tlsStream) unwrapStream() Stream {
+	return s.Stream
+}
+
+func (s *tlsStream) Conn() Conn {
+	return s.conn
+}
+
+func (s *tlsStream) Read(b []byte) (int, error) {
+	return s.tc.Read(b)
+}
+
+func (s *tlsStream) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	closed := s.closed
+	s.mu.Unlock()
+	if closed {
+		// the stream is closed for writing, and fails the write.
+		return s.Stream.Write(b)
+	}
+	return s.tc.Write(b)
+}
+
+// ConnectionState returns the state of the stream's TLS session, with the
+// certificates of the peer.
+func (s *tlsStream) ConnectionState() tls.ConnectionState {
+	return s.tc.ConnectionState()
+}
+
+func (s *tlsStream) Close() error {
+	s.mu.Lock()
+	closed := s.closed
+	s.closed = true
+	s.mu.Unlock()
+	if closed {
+		return nil
+	}
+	err := s.tc.CloseWrite()
+	if cerr := s.Stream.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,191 @@
+package streammux
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// ErrStreamRejected is returned by OpenStreamSync when the peer reset the
+// stream rather than accept it, e.g. as it stopped accepting or has too
+// many streams open.
+var ErrStreamRejected = errors.New("stream rejected by the peer")
+
+// SyncOpenConn is implemented by Conns that can open a stream and wait for
+// the peer to accept it, where OpenStream may return before the peer even
+// learns of the stream, as muxers opening streams lazily on the first
+// write do.
+type SyncOpenConn interface {
+	Conn
+
+	// OpenStreamSync opens a stream and returns it once the peer accepted
+	// it. It returns ErrStreamRejected if the peer rejected it, and
+	// ctx.Err() if ctx is done first.
+	OpenStreamSync(ctx context.Context) (Stream, error)
+}
+
+// OpenStreamSync opens a stream on c and waits for the peer to accept it,
+// or returns ErrNotSupported if c is not a SyncOpenConn. Conns can be made
+// SyncOpenConns with WithSyncOpen.
+func OpenStreamSync(ctx context.Context, c Conn) (Stream, error) {
+	if sc, ok := c.(SyncOpenConn); ok {
+		return sc.OpenStreamSync(ctx)
+	}
+	return nil, ErrNotSupported
+}
+
+// errNotSyncOpen is returned by the streams of WithSyncOpen when the peer
+// does not wrap its side of the connection too.
+var errNotSyncOpen = errors.New("stream not started by WithSyncOpen")
+
+// syncOpenByte starts both directions of the streams of WithSyncOpen: the
+// opener's announces the stream, the accepter's acknowledges it.
+const syncOpenByte = 1
+
+// WithSyncOpen wraps c to emulate OpenStreamSync for muxers that cannot
+// tell when the peer accepted a stream. Both sides of the connection must
+// be wrapped: every stream starts with a byte each way, announcing it from
+// the opening side and acknowledging it from the side accepting it, once
+// AcceptStream returns it there. Streams the peer resets without
+// acknowledging them were rejected.
+func WithSyncOpen(c Conn) SyncOpenConn {
+	return &syncOpenConn{Conn: c}
+}
+
+type syncOpenConn struct {
+	Conn
+}
+
+func (c *syncOpenConn) unwrapConn() Conn {
+	return c.Conn
+}
+
+func (c *syncOpenConn) OpenStream() (Stream, error) {
+	s, err := c.Conn.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.Write([]byte{syncOpenByte}); err != nil {
+		s.Reset()
+		return nil, err
+	}
+	return &syncStream{Stream: s, conn: c}, nil
+}
+
+func (c *syncOpenConn) OpenStreamSync(ctx context.Context) (Stream, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s, err := OpenStreamContext(ctx, c.Conn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.Write([]byte{syncOpenByte}); err != nil {
+		// the peer may reset the stream before the announcement is even
+		// written.
+		return nil, c.rejected(s, err)
+	}
+
+	// resetting the stream once ctx is done unblocks the read of the
+	// acknowledgement.
+	var (
+		mu       sync.Mutex
+		finished bool
+		reset    bool
+	)
+	done := make(chan struct{})
+	defer close(done)
+	finish := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		finished = true
+		return !reset
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			mu.Lock()
+			if !finished {
+				reset = true
+				s.Reset()
+			}
+			mu.Unlock()
+		case <-done:
+		}
+	}()
+
+	ss := &syncStream{Stream: s, conn: c}
+	err = ss.readPrefix()
+	if !finish() {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, c.rejected(s, err)
+	}
+	return ss, nil
+}
+
+// rejected resets s, which failed with err before the peer accepted it,
+// and returns ErrStreamRejected unless the connection is closed.
+func (c *syncOpenConn) rejected(s Stream, err error) error {
+	s.Reset()
+	if c.Conn.IsClosed() {
+		return err
+	}
+	return ErrStreamRejected
+}
+
+// AcceptStream accepts the next stream and acknowledges it. Streams whose
+// acknowledgement cannot be written, as their opener reset them once
+// OpenStreamSync gave up, are reset and skipped.
+func (c *syncOpenConn) AcceptStream() (Stream, error) {
+	for {
+		s, err := c.Conn.AcceptStream()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := s.Write([]byte{syncOpenByte}); err != nil {
+			s.Reset()
+			continue
+		}
+		return &syncStream{Stream: s, conn: c}, nil
+	}
+}
+
+// syncStream strips the byte starting what it reads from the peer.
+type syncStream struct {
+	Stream
+	conn *syncOpenConn
+
+	once sync.Once
+	err  error
+}
+
+func (s *syncStream) unwrapStream() Stream {
+	return s.Stream
+}
+
+func (s *syncStream) Conn() Conn {
+	return s.conn
+}
+
+// readPrefix reads the byte starting the stream, once.
+func (s *syncStream) readPrefix() error {
+	s.once.Do(func() {
+		var b [1]byte
+		if _, err := io.ReadFull(s.Stream, b[:]); err != nil {
+			s.err = err
+		} else if b[0] != syncOpenByte {
+			s.err = errNotSyncOpen
+		}
+	})
+	return s.err
+}
+
+func (s *syncStream) Read(b []byte) (int, error) {
+	if err := s.readPrefix(); err != nil {
+		return 0, err
+	}
+	return s.Stream.Read(b)
+}
@@ -0,0 +1,734 @@
+package sm_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	smux "github.com/dms3-p2p/go-stream-muxer"
+	"github.com/dms3-p2p/go-stream-muxer/identity"
+)
+
+// ScalingStreamCounts are the open-stream counts measured by
+// BenchmarkStreamScaling, growing by decades.
+var ScalingStreamCounts = []int{1, 10, 100, 1000, 10000, 100000}
+
+// scalingWorkers bounds the number of goroutines driving round trips in
+// BenchmarkStreamScaling, independently of the number of open streams.
+const scalingWorkers = 100
+
+func benchConnPair(b *testing.B, tr smux.Transport) (client smux.Conn, done func()) {
+	a, bc := connPipe(b)
+
+	server, err := smux.ServeConn(context.Background(), tr, bc, true, smux.EchoHandler)
+	checkErr(b, err)
+
+	client, err = tr.NewConn(a, false)
+	checkErr(b, err)
+	go client.AcceptStream()
+
+	return client, func() {
+		client.Close()
+		server.Close()
+	}
+}
+
+// percentile returns the p-th percentile (0 < p <= 1) of the sorted
+// durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted))*p+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// BenchmarkStreamScaling measures aggregate echo throughput and p99 round
+// trip latency with increasing numbers of open streams on a single
+// connection. Muxers that scan all streams per write or contend on a
+// session-wide lock show up as throughput dropping with the stream count.
+func BenchmarkStreamScaling(b *testing.B, tr smux.Transport) {
+	for _, n := range ScalingStreamCounts {
+		b.Run(fmt.Sprintf("%dStreams", n), func(b *testing.B) {
+			benchStreamScaling(b, tr, n)
+		})
+	}
+}
+
+func benchStreamScaling(b *testing.B, tr smux.Transport, n int) {
+	const msgsize = 1 << 10
+
+	c, done := benchConnPair(b, tr)
+	defer done()
+
+	streams := make([]smux.Stream, n)
+	for i := range streams {
+		s, err := c.OpenStream()
+		checkErr(b, err)
+		streams[i] = s
+	}
+	defer func() {
+		for _, s := range streams {
+			s.Close()
+		}
+	}()
+
+	workers := scalingWorkers
+	if n < workers {
+		workers = n
+	}
+
+	var (
+		mu        sync.Mutex
+		latencies = make([]time.Duration, 0, b.N)
+		errs      = make(chan error, workers)
+		wg        sync.WaitGroup
+	)
+
+	stop := measureBench(b, 2*msgsize)
+
+	for w := 0; w < workers; w++ {
+		// worker w owns streams w, w+workers, ... and drives its share of
+		// the round trips over them, round robin.
+		var owned []smux.Stream
+		for i := w; i < n; i += workers {
+			owned = append(owned, streams[i])
+		}
+		iters := b.N / workers
+		if w < b.N%workers {
+			iters++
+		}
+
+		wg.Add(1)
+		go func(owned []smux.Stream, iters int) {
+			defer wg.Done()
+
+			out := randBuf(msgsize)
+			in := make([]byte, msgsize)
+			local := make([]time.Duration, 0, iters)
+			for i := 0; i < iters; i++ {
+				s := owned[i%len(owned)]
+
+				start := time.Now()
+				if _, err := s.Write(out); err != nil {
+					errs <- err
+					return
+				}
+				if _, err := io.ReadFull(s, in); err != nil {
+					errs <- err
+					return
+				}
+				local = append(local, time.Since(start))
+			}
+
+			mu.Lock()
+			latencies = append(latencies, local...)
+			mu.Unlock()
+		}(owned, iters)
+	}
+	wg.Wait()
+	stop()
+
+	close(errs)
+	for err := range errs {
+		b.Fatal(err)
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	reportMetric(b, float64(percentile(latencies, 0.99).Nanoseconds()), "p99-ns")
+}
+
+// IdleStreamCounts are the open-stream counts measured by
+// BenchmarkIdleStreams.
+var IdleStreamCounts = []int{1000, 10000, 100000}
+
+// BenchmarkIdleStreams measures what each open stream costs while idle:
+// the heap bytes and goroutines of both sides of the connection, once n
+// streams were opened, written a byte and accepted, over the baseline of
+// the connection alone. The peer keeps the streams it accepts without a
+// goroutine of its own for each, so the goroutines are the muxer's. Each
+// op opens the streams on a new connection, and ns/op is the time it took.
+func BenchmarkIdleStreams(b *testing.B, tr smux.Transport) {
+	for _, n := range IdleStreamCounts {
+		b.Run(fmt.Sprintf("%dStreams", n), func(b *testing.B) {
+			benchIdleStreams(b, tr, n)
+		})
+	}
+}
+
+// BenchmarkRegistryIdleStreams runs BenchmarkIdleStreams against every
+// transport registered in smux.DefaultRegistry, recording the results of
+// -smux.json under the transport's ID, so that results.Table, and
+// benchmux -compare, print them side by side.
+func BenchmarkRegistryIdleStreams(b *testing.B) {
+	trs := RegistryTransports(smux.DefaultRegistry)
+	if len(trs) == 0 {
+		b.Skip("no transports registered")
+	}
+	for _, ntr := range trs {
+		ntr := ntr
+		b.Run(ntr.Name, func(b *testing.B) {
+			for _, n := range IdleStreamCounts {
+				name := fmt.Sprintf("%dStreams", n)
+				b.Run(name, func(b *testing.B) {
+					benchIdleStreams(b, ntr.Transport, n)
+					labelResult(b, ntr.Name, "IdleStreams/"+name)
+				})
+			}
+		})
+	}
+}
+
+func benchIdleStreams(b *testing.B, tr smux.Transport, n int) {
+	var heap, goroutines float64
+	stop := measureBench(b, 0)
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		h, g := idleStreamCost(b, tr, n)
+		heap += h
+		goroutines += g
+	}
+	stop()
+	reportMetric(b, heap/float64(b.N), "heap-bytes/stream")
+	reportMetric(b, goroutines/float64(b.N), "goroutines/stream")
+}
+
+// idleStreamCost opens n streams on a new connection muxed with tr, with
+// the timer of b running, and returns the heap bytes and goroutines each
+// of them takes.
+func idleStreamCost(b *testing.B, tr smux.Transport, n int) (heap, goroutines float64) {
+	a, bc := connPipe(b)
+	defer a.Close()
+	defer bc.Close()
+
+	// the server side is established concurrently, for transports which
+	// handshake in NewConn.
+	type established struct {
+		c   smux.Conn
+		err error
+	}
+	listened := make(chan established, 1)
+	go func() {
+		c, err := tr.NewConn(bc, true)
+		listened <- established{c, err}
+	}()
+	client, err := tr.NewConn(a, false)
+	checkErr(b, err)
+	defer client.Close()
+	l := <-listened
+	checkErr(b, l.err)
+	server := l.c
+	defer server.Close()
+
+	// the slices of the streams are allocated before the baseline, which
+	// the goroutine accepting the streams is not part of either.
+	opened := make([]smux.Stream, 0, n)
+	accepted := make([]smux.Stream, 0, n)
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	base := runtime.NumGoroutine()
+
+	var wg sync.WaitGroup
+	var acceptErr error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for len(accepted) < n {
+			s, err := server.AcceptStream()
+			if err == nil {
+				_, err = io.ReadFull(s, make([]byte, 1))
+			}
+			if err != nil {
+				acceptErr = err
+				return
+			}
+			accepted = append(accepted, s)
+		}
+	}()
+
+	b.StartTimer()
+	out := []byte{1}
+	for i := 0; i < n; i++ {
+		s, err := client.OpenStream()
+		checkErr(b, err)
+		_, err = s.Write(out)
+		checkErr(b, err)
+		opened = append(opened, s)
+	}
+	wg.Wait()
+	b.StopTimer()
+	checkErr(b, acceptErr)
+
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	goroutines = float64(runtime.NumGoroutine()-base) / float64(n)
+	heap = (float64(after.HeapAlloc) - float64(before.HeapAlloc)) / float64(n)
+
+	for _, s := range append(opened, accepted...) {
+		s.Reset()
+	}
+	return heap, goroutines
+}
+
+// OverheadMessageSizes are the message sizes measured by
+// BenchmarkRawOverhead.
+var OverheadMessageSizes = []int{1 << 4, 1 << 10, 1 << 16}
+
+// BenchmarkRawOverhead runs the same single stream echo workload over the
+// target transport and over the bare net.Conn, and reports the muxer's
+// overhead as a percentage of the raw TCP round trip time.
+func BenchmarkRawOverhead(b *testing.B, tr smux.Transport) {
+	for _, size := range OverheadMessageSizes {
+		b.Run(fmt.Sprintf("%dBytes", size), func(b *testing.B) {
+			benchRawOverhead(b, tr, size)
+		})
+	}
+}
+
+func benchRawOverhead(b *testing.B, tr smux.Transport, size int) {
+	run := func(tr smux.Transport) time.Duration {
+		c, done := benchConnPair(b, tr)
+		defer done()
+
+		s, err := c.OpenStream()
+		checkErr(b, err)
+		defer s.Close()
+
+		out := randBuf(size)
+		in := make([]byte, size)
+		start := time.Now()
+		for i := 0; i < b.N; i++ {
+			_, err := s.Write(out)
+			checkErr(b, err)
+			_, err = io.ReadFull(s, in)
+			checkErr(b, err)
+		}
+		return time.Since(start)
+	}
+
+	b.StopTimer()
+	raw := run(identity.Transport{})
+
+	stop := measureBench(b, 2*int64(size))
+	b.StartTimer()
+	muxed := run(tr)
+	stop()
+
+	reportMetric(b, float64(raw.Nanoseconds())/float64(b.N), "raw-ns/op")
+	reportMetric(b, 100*float64(muxed-raw)/float64(raw), "overhead-%")
+}
+
+// BenchmarkStreamPool compares opening a stream per request with reusing
+// streams from a smux.StreamPool, for small echoed requests.
+func BenchmarkStreamPool(b *testing.B, tr smux.Transport) {
+	const reqsize = 64
+
+	request := func(b *testing.B, s smux.Stream) {
+		out := randBuf(reqsize)
+		in := make([]byte, reqsize)
+		_, err := s.Write(out)
+		checkErr(b, err)
+		_, err = io.ReadFull(s, in)
+		checkErr(b, err)
+	}
+
+	b.Run("Open", func(b *testing.B) {
+		c, done := benchConnPair(b, tr)
+		defer done()
+
+		defer measureBench(b, 0)()
+		for i := 0; i < b.N; i++ {
+			s, err := c.OpenStream()
+			checkErr(b, err)
+			request(b, s)
+			s.Close()
+		}
+	})
+
+	b.Run("Pooled", func(b *testing.B) {
+		c, done := benchConnPair(b, tr)
+		defer done()
+		pool := smux.NewStreamPool(c, 1)
+		defer pool.Close()
+
+		defer measureBench(b, 0)()
+		for i := 0; i < b.N; i++ {
+			s, err := pool.Get()
+			checkErr(b, err)
+			request(b, s)
+			pool.Put(s)
+		}
+	})
+}
+
+// ReceiveWindowSizes are the receive windows measured by
+// BenchmarkReceiveWindow. Zero is the muxer's default.
+var ReceiveWindowSizes = []uint32{0, 1 << 20, 16 << 20}
+
+// windowBenchRTT is the round trip time of the link simulated by
+// BenchmarkReceiveWindow, typical of intercontinental paths.
+const windowBenchRTT = 100 * time.Millisecond
+
+// BenchmarkReceiveWindow measures single stream throughput over a simulated
+// high latency link with the receive windows in ReceiveWindowSizes, set
+// through smux.Options. Windows smaller than the bandwidth-delay product
+// cap throughput at one window per round trip.
+func BenchmarkReceiveWindow(b *testing.B, tr smux.Transport) {
+	for _, window := range ReceiveWindowSizes {
+		name := "Default"
+		switch {
+		case window >= 1<<20:
+			name = fmt.Sprintf("%dMB", window>>20)
+		case window != 0:
+			name = fmt.Sprintf("%dKB", window>>10)
+		}
+		b.Run(name, func(b *testing.B) {
+			benchReceiveWindow(b, tr, window)
+		})
+	}
+}
+
+func benchReceiveWindow(b *testing.B, tr smux.Transport, window uint32) {
+	skipNoWire(b, tr)
+	const chunk = 1 << 16
+
+	a, bc := connPipe(b)
+	defer a.Close()
+	defer bc.Close()
+
+	opts := smux.Options{ReceiveWindow: window}
+	server, err := smux.NewConnWithOptions(tr, newDelayConn(bc, windowBenchRTT/2), true, opts)
+	if err == smux.ErrNotSupported {
+		b.Skip("transport does not support setting the receive window")
+	}
+	checkErr(b, err)
+	defer server.Close()
+	go func() {
+		str, err := server.AcceptStream()
+		if err != nil {
+			return
+		}
+		defer str.Close()
+		if _, err := io.Copy(ioutil.Discard, str); err == nil {
+			str.Write([]byte{1})
+		}
+	}()
+
+	client, err := smux.NewConnWithOptions(tr, newDelayConn(a, windowBenchRTT/2), false, opts)
+	checkErr(b, err)
+	defer client.Close()
+	go client.AcceptStream()
+
+	s, err := client.OpenStream()
+	checkErr(b, err)
+	defer s.Reset()
+
+	buf := randBuf(chunk)
+	stop := measureBench(b, chunk)
+	for i := 0; i < b.N; i++ {
+		_, err := s.Write(buf)
+		checkErr(b, err)
+	}
+	checkErr(b, smux.CloseWrite(s))
+	// wait for the last byte to arrive.
+	_, err = io.ReadFull(s, make([]byte, 1))
+	checkErr(b, err)
+	stop()
+}
+
+// patternReader reads n bytes of repeated random data.
+type patternReader struct {
+	n int64
+}
+
+func (r *patternReader) Read(b []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(b)) > r.n {
+		b = b[:r.n]
+	}
+	n := copy(b, randomBytes())
+	r.n -= int64(n)
+	return n, nil
+}
+
+// writerOnly hides the io.ReaderFrom of a writer from io.Copy.
+type writerOnly struct {
+	io.Writer
+}
+
+// BenchmarkCopy compares io.Copy to a stream through its plain Write, in
+// io.Copy's default 32KB chunks, with io.Copy to the stream as a
+// smux.NetConn, which goes through its ReadFrom.
+func BenchmarkCopy(b *testing.B, tr smux.Transport) {
+	const chunk = 1 << 16
+
+	run := func(b *testing.B, dst func(c smux.Conn, s smux.Stream) io.Writer) {
+		c, done := benchConnPair(b, tr)
+		defer done()
+		s, err := c.OpenStream()
+		checkErr(b, err)
+		defer s.Reset()
+		w := dst(c, s)
+		go io.Copy(ioutil.Discard, s)
+
+		defer measureBench(b, chunk)()
+		_, err = io.Copy(w, &patternReader{int64(b.N) * chunk})
+		checkErr(b, err)
+	}
+
+	b.Run("Write", func(b *testing.B) {
+		run(b, func(c smux.Conn, s smux.Stream) io.Writer { return writerOnly{s} })
+	})
+	b.Run("ReadFrom", func(b *testing.B) {
+		run(b, func(c smux.Conn, s smux.Stream) io.Writer { return smux.NetConn(c, s) })
+	})
+}
+
+// BenchmarkWriteBuffers compares ways of writing a small header followed by
+// a payload: two writes, concatenating them first, and
+// smux.WriteBuffers.
+func BenchmarkWriteBuffers(b *testing.B, tr smux.Transport) {
+	const (
+		headerSize  = 16
+		payloadSize = 4 << 10
+	)
+
+	run := func(b *testing.B, write func(s smux.Stream, header, payload []byte) error) {
+		c, done := benchConnPair(b, tr)
+		defer done()
+		s, err := c.OpenStream()
+		checkErr(b, err)
+		defer s.Reset()
+		go io.Copy(ioutil.Discard, s)
+
+		header, payload := randBuf(headerSize), randBuf(payloadSize)
+		defer measureBench(b, headerSize+payloadSize)()
+		for i := 0; i < b.N; i++ {
+			checkErr(b, write(s, header, payload))
+		}
+	}
+
+	b.Run("TwoWrites", func(b *testing.B) {
+		run(b, func(s smux.Stream, header, payload []byte) error {
+			if _, err := s.Write(header); err != nil {
+				return err
+			}
+			_, err := s.Write(payload)
+			return err
+		})
+	})
+	b.Run("Concat", func(b *testing.B) {
+		run(b, func(s smux.Stream, header, payload []byte) error {
+			msg := make([]byte, 0, len(header)+len(payload))
+			_, err := s.Write(append(append(msg, header...), payload...))
+			return err
+		})
+	})
+	b.Run("WriteBuffers", func(b *testing.B) {
+		run(b, func(s smux.Stream, header, payload []byte) error {
+			_, err := smux.WriteBuffers(s, net.Buffers{header, payload})
+			return err
+		})
+	})
+}
+
+// bufferPoolMessage is the size of the messages BenchmarkBufferPool echoes,
+// about a frame of common muxers.
+const bufferPoolMessage = 16 << 10
+
+// BenchmarkBufferPool measures the allocations of echoing messages of 16KB
+// over a stream, with the transport drawing its buffers from
+// smux.DefaultBufferPool and from smux.NoBufferPool, which shows what
+// pooling saves. Transports that are not smux.BufferPoolTransports are
+// skipped.
+func BenchmarkBufferPool(b *testing.B, tr smux.Transport) {
+	if _, err := smux.WithBufferPool(tr, smux.NoBufferPool); err == smux.ErrNotSupported {
+		b.Skip("transport does not take a buffer pool")
+	}
+
+	run := func(b *testing.B, pool smux.BufferPool) {
+		ptr, err := smux.WithBufferPool(tr, pool)
+		checkErr(b, err)
+		c, done := benchConnPair(b, ptr)
+		defer done()
+		s, err := c.OpenStream()
+		checkErr(b, err)
+		defer s.Reset()
+
+		out, in := randBuf(bufferPoolMessage), make([]byte, bufferPoolMessage)
+		defer measureBench(b, bufferPoolMessage)()
+		for i := 0; i < b.N; i++ {
+			_, err := s.Write(out)
+			checkErr(b, err)
+			_, err = io.ReadFull(s, in)
+			checkErr(b, err)
+		}
+	}
+
+	b.Run("Default", func(b *testing.B) { run(b, smux.DefaultBufferPool) })
+	b.Run("None", func(b *testing.B) { run(b, smux.NoBufferPool) })
+}
+
+// BenchmarkReadBuffer compares reading a stream into a slice with Read, as
+// io.Copy does, with smux.ReadBuffer, which hands out the buffers of
+// streams implementing smux.BufferReader rather than copying them.
+func BenchmarkReadBuffer(b *testing.B, tr smux.Transport) {
+	const chunk = 1 << 16
+
+	run := func(b *testing.B, read func(s smux.Stream, buf []byte) (int, error)) {
+		c, done := benchConnPair(b, tr)
+		defer done()
+		s, err := c.OpenStream()
+		checkErr(b, err)
+		defer s.Reset()
+		go io.Copy(s, &patternReader{int64(b.N) * chunk})
+
+		buf := make([]byte, chunk)
+		defer measureBench(b, chunk)()
+		for remaining := int64(b.N) * chunk; remaining > 0; {
+			n, err := read(s, buf)
+			checkErr(b, err)
+			remaining -= int64(n)
+		}
+	}
+
+	b.Run("Read", func(b *testing.B) {
+		run(b, func(s smux.Stream, buf []byte) (int, error) { return s.Read(buf) })
+	})
+	b.Run("ReadBuffer", func(b *testing.B) {
+		run(b, func(s smux.Stream, _ []byte) (int, error) {
+			buf, err := smux.ReadBuffer(s)
+			smux.ReleaseBuffer(s, buf)
+			return len(buf), err
+		})
+	})
+}
+
+// BenchmarkSimpleWrite runs SubtestSimpleWrite b.N times, each over a new
+// connection. It is a smoke benchmark, which checks that the subtests, all
+// taking a testing.TB, run as benchmarks too.
+func BenchmarkSimpleWrite(b *testing.B, tr smux.Transport) {
+	for i := 0; i < b.N; i++ {
+		SubtestSimpleWrite(b, tr)
+	}
+}
+
+// throughputChunk is the size of the writes of BenchmarkThroughput1Stream.
+const throughputChunk = 1 << 16
+
+// BenchmarkThroughput1Stream measures the throughput of a single stream,
+// writing 64KB chunks echoed back by the peer, once they are all echoed.
+// Its MB/s counts the data written, not the echo.
+func BenchmarkThroughput1Stream(b *testing.B, tr smux.Transport) {
+	c, done := benchConnPair(b, tr)
+	defer done()
+	s, err := c.OpenStream()
+	checkErr(b, err)
+	defer s.Reset()
+
+	echoed := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(ioutil.Discard, s)
+		echoed <- err
+	}()
+
+	buf := randBuf(throughputChunk)
+	stop := measureBench(b, throughputChunk)
+	for i := 0; i < b.N; i++ {
+		_, err := s.Write(buf)
+		checkErr(b, err)
+	}
+	checkErr(b, smux.CloseWrite(s))
+	checkErr(b, <-echoed)
+	stop()
+}
+
+// BenchmarkStreamOpenAccept measures the latency of opening a stream: each
+// op opens one, and writes a byte which the peer accepts and echoes back,
+// as muxers which open streams lazily only tell the peer with the first
+// data.
+func BenchmarkStreamOpenAccept(b *testing.B, tr smux.Transport) {
+	c, done := benchConnPair(b, tr)
+	defer done()
+
+	out, in := []byte{1}, make([]byte, 1)
+	defer measureBench(b, 0)()
+	for i := 0; i < b.N; i++ {
+		s, err := c.OpenStream()
+		checkErr(b, err)
+		_, err = s.Write(out)
+		checkErr(b, err)
+		_, err = io.ReadFull(s, in)
+		checkErr(b, err)
+		s.Close()
+	}
+}
+
+// The shape of the workload of Benchmark1kStreams1kMessages.
+const (
+	smallStreams     = 1000
+	smallMessages    = 1000
+	smallMessageSize = 64
+)
+
+// Benchmark1kStreams1kMessages measures the rate of small messages over
+// many concurrent streams: each op writes 1000 messages of 64 bytes over
+// each of 1000 streams at once, and waits for the peer to echo them all
+// back. Muxers spending a frame, a syscall or a lock round trip per message
+// show up here rather than in the throughput of large writes.
+func Benchmark1kStreams1kMessages(b *testing.B, tr smux.Transport) {
+	c, done := benchConnPair(b, tr)
+	defer done()
+
+	streams := make([]smux.Stream, smallStreams)
+	bufs := make([][]byte, smallStreams)
+	for i := range streams {
+		s, err := c.OpenStream()
+		checkErr(b, err)
+		defer s.Reset()
+		streams[i] = s
+		bufs[i] = make([]byte, smallMessages*smallMessageSize)
+	}
+
+	msg := randBuf(smallMessageSize)
+	stop := measureBench(b, smallStreams*smallMessages*smallMessageSize)
+	for i := 0; i < b.N; i++ {
+		errs := make(chan error, 2*smallStreams)
+		for k, s := range streams {
+			go func(s smux.Stream) {
+				for j := 0; j < smallMessages; j++ {
+					if _, err := s.Write(msg); err != nil {
+						errs <- err
+						return
+					}
+				}
+				errs <- nil
+			}(s)
+			go func(s smux.Stream, buf []byte) {
+				_, err := io.ReadFull(s, buf)
+				errs <- err
+			}(s, bufs[k])
+		}
+		for range streams {
+			checkErr(b, <-errs)
+			checkErr(b, <-errs)
+		}
+	}
+	stop()
+}
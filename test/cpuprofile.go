@@ -0,0 +1,64 @@
+package sm_test
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"strings"
+	"testing"
+
+	"github.com/dms3-p2p/go-stream-muxer/results"
+)
+
+var cpuProfileDir = flag.String("smux.cpuprofile", "", "write a CPU profile of each benchmark workload to this directory")
+
+var profileDir = flag.String("smux.profile", "", "write a CPU and a heap profile of each benchmark workload, named after it, to this directory, created if need be, as cmd/benchmux -profile does")
+
+// ProfileCPU starts a CPU profile of the calling benchmark when
+// -smux.cpuprofile is set, written to a file named after the benchmark
+// (which includes its transport and message size sub-benchmarks) once the
+// returned function is called. It does nothing when the flag is not set.
+// Profiles cannot be captured while go test's own -cpuprofile is active.
+func ProfileCPU(b testing.TB) (stop func()) {
+	if *cpuProfileDir == "" {
+		return func() {}
+	}
+
+	name := strings.Replace(b.Name(), "/", "_", -1) + ".cpu.pprof"
+	f, err := os.Create(filepath.Join(*cpuProfileDir, name))
+	if err != nil {
+		b.Error(err)
+		return func() {}
+	}
+	if err := pprof.StartCPUProfile(f); err != nil {
+		f.Close()
+		b.Error(err)
+		return func() {}
+	}
+	return func() {
+		pprof.StopCPUProfile()
+		if err := f.Close(); err != nil {
+			b.Error(err)
+		}
+	}
+}
+
+// profileBench starts the profiles of the benchmark b: those of
+// -smux.profile if set, and otherwise the CPU profile of ProfileCPU. The
+// returned function stops them, and writes the heap profile.
+func profileBench(b testing.TB) (stop func()) {
+	if *profileDir == "" {
+		return ProfileCPU(b)
+	}
+	stopProfiles, err := results.StartProfiles(*profileDir, b.Name())
+	if err != nil {
+		b.Error(err)
+		return func() {}
+	}
+	return func() {
+		if err := stopProfiles(); err != nil {
+			b.Error(err)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package sm_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	smux "github.com/dms3-p2p/go-stream-muxer"
+	"github.com/dms3-p2p/go-stream-muxer/http2"
+	"github.com/dms3-p2p/go-stream-muxer/websocket"
+)
+
+// SubtestBundledFallback checks smux.FallbackTransport against peers
+// speaking only its secondary transport, with the http2 and websocket
+// muxers: servers fall back over the same connection, as neither primary
+// answers before reading the client's handshake, clients redial with
+// Redial, and fail with a FallbackError without it. Both sides are
+// established from the same goroutine, the dialer first, as NewConn does
+// not wait for the handshake.
+func SubtestBundledFallback(t testing.TB) {
+	h2, ws := http2.DefaultTransport, websocket.DefaultTransport
+	run(t, "primary", func(t testing.TB) {
+		a, b := connPipe(t)
+		subtestFallbackEcho(t, smux.NewFallbackTransport(h2, ws), a, smux.NewFallbackTransport(h2, ws), b)
+	})
+	run(t, "server-http2-primary", func(t testing.TB) {
+		a, b := connPipe(t)
+		subtestFallbackEcho(t, ws, a, smux.NewFallbackTransport(h2, ws), b)
+	})
+	run(t, "server-websocket-primary", func(t testing.TB) {
+		a, b := connPipe(t)
+		subtestFallbackEcho(t, h2, a, smux.NewFallbackTransport(ws, h2), b)
+	})
+	run(t, "client-redial", func(t testing.TB) {
+		a, b := connPipe(t)
+		defer a.Close()
+		defer b.Close()
+		// the first connection only tells the dialer the listener does
+		// not speak http2.
+		mb, err := ws.NewConn(b, true)
+		checkErr(t, err)
+		defer mb.Close()
+
+		ra, rb := connPipe(t)
+		tr := smux.NewFallbackTransport(h2, ws)
+		tr.Redial = func(c net.Conn) (net.Conn, error) {
+			if c != a {
+				t.Errorf("redialing %v, expected the first connection", c)
+			}
+			return ra, nil
+		}
+		subtestFallbackEcho(t, tr, a, ws, rb)
+	})
+	run(t, "client-no-redial", func(t testing.TB) {
+		a, b := connPipe(t)
+		defer a.Close()
+		defer b.Close()
+		ca, err := smux.NewFallbackTransport(h2, ws).NewConn(a, false)
+		checkErr(t, err)
+		defer ca.Close()
+		cb, err := ws.NewConn(b, true)
+		checkErr(t, err)
+		defer cb.Close()
+
+		_, err = ca.OpenStream()
+		if _, ok := err.(*smux.FallbackError); !ok {
+			t.Fatalf("opening a stream after the primary wrote to the connection returned %v, expected a FallbackError", err)
+		}
+	})
+}
+
+// subtestFallbackEcho establishes the dialer with tra over a and the
+// listener with trb over b, and echoes a message through a stream of the
+// dialer.
+func subtestFallbackEcho(t testing.TB, tra smux.Transport, a net.Conn, trb smux.Transport, b net.Conn) {
+	defer a.Close()
+	defer b.Close()
+	ca, err := tra.NewConn(a, false)
+	checkErr(t, err)
+	defer ca.Close()
+	cb, err := trb.NewConn(b, true)
+	checkErr(t, err)
+	defer cb.Close()
+
+	stop := serveConn(t, cb, echoStream)
+	defer stop()
+	s, err := ca.OpenStream()
+	checkErr(t, err)
+	msg := []byte("hello after falling back")
+	_, err = s.Write(msg)
+	checkErr(t, err)
+	checkErr(t, s.Close())
+	got, err := ioutil.ReadAll(s)
+	checkErr(t, err)
+	if !bytes.Equal(got, msg) {
+		t.Fatalf("echoed %q, expected %q", got, msg)
+	}
+}
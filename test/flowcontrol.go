@@ -0,0 +1,243 @@
+package sm_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/dms3-p2p/go-stream-muxer/http2"
+	"github.com/dms3-p2p/go-stream-muxer/websocket"
+	xhttp2 "golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// floodFrameSize is the size of the DATA frames of peers ignoring flow
+// control, the largest frames HTTP/2 allows by default.
+const floodFrameSize = 16 << 10
+
+// SubtestBundledFlowControl checks that the muxers of this repository with
+// a wire format of their own hold peers ignoring flow control to their
+// receive windows, rather than buffering all they send: a stream sent past
+// its window is reset, and a connection sent past its window closed, both
+// with a flow control error. It also checks that websocket ignores the
+// streams announced again once forgotten.
+func SubtestBundledFlowControl(t testing.TB) {
+	run(t, "http2", subtestHTTP2FlowControl)
+	run(t, "websocket", subtestWebSocketFlowControl)
+}
+
+// subtestHTTP2FlowControl floods an http2 server from a raw HTTP/2 client,
+// first on a single stream, then across streams none of which exceeds its
+// own window.
+func subtestHTTP2FlowControl(t testing.TB) {
+	a, b := connPipe(t)
+	defer a.Close()
+	defer b.Close()
+
+	muxb, err := http2.DefaultTransport.NewConn(b, true)
+	checkErr(t, err)
+	defer muxb.Close()
+	// the streams are accepted, and never read.
+	go func() {
+		for {
+			if _, err := muxb.AcceptStream(); err != nil {
+				return
+			}
+		}
+	}()
+
+	_, err = io.WriteString(a, xhttp2.ClientPreface)
+	checkErr(t, err)
+	fr := xhttp2.NewFramer(a, a)
+	checkErr(t, fr.WriteSettings())
+
+	// the server's frames are read in the background, reporting its
+	// RST_STREAMs and GOAWAY.
+	resets := make(chan xhttp2.ErrCode, 1)
+	goAway := make(chan xhttp2.ErrCode, 1)
+	go func() {
+		for {
+			f, err := fr.ReadFrame()
+			if err != nil {
+				return
+			}
+			switch f := f.(type) {
+			case *xhttp2.RSTStreamFrame:
+				if f.StreamID == 1 {
+					resets <- f.ErrCode
+				}
+			case *xhttp2.GoAwayFrame:
+				goAway <- f.ErrCode
+				return
+			}
+		}
+	}()
+
+	var hbuf bytes.Buffer
+	henc := hpack.NewEncoder(&hbuf)
+	for _, f := range [][2]string{{":method", "POST"}, {":scheme", "http"}, {":authority", "smux"}, {":path", "/"}} {
+		henc.WriteField(hpack.HeaderField{Name: f[0], Value: f[1]})
+	}
+	open := func(id uint32) error {
+		return fr.WriteHeaders(xhttp2.HeadersFrameParam{StreamID: id, BlockFragment: hbuf.Bytes(), EndHeaders: true})
+	}
+	data := make([]byte, floodFrameSize)
+	// flood sends n bytes on stream id, or until the server closes the
+	// connection.
+	flood := func(id uint32, n int) {
+		for ; n > 0; n -= len(data) {
+			if err := fr.WriteData(id, false, data); err != nil {
+				return
+			}
+		}
+	}
+
+	checkErr(t, open(1))
+	flood(1, 1<<20)
+	select {
+	case code := <-resets:
+		if code != xhttp2.ErrCodeFlowControl {
+			t.Fatalf("stream sent past its window reset with %v, expected %v", code, xhttp2.ErrCodeFlowControl)
+		}
+	case <-time.After(scaleTimeout(10 * time.Second)):
+		t.Fatal("stream sent past its window was not reset")
+	}
+
+	// streams each within their window, together past that of the
+	// connection.
+	go func() {
+		for id := uint32(3); id < 3+2*100; id += 2 {
+			if open(id) != nil {
+				return
+			}
+			flood(id, 192<<10)
+		}
+	}()
+	select {
+	case code := <-goAway:
+		if code != xhttp2.ErrCodeFlowControl {
+			t.Fatalf("connection sent past its window closed with %v, expected %v", code, xhttp2.ErrCodeFlowControl)
+		}
+	case <-time.After(scaleTimeout(10 * time.Second)):
+		t.Fatal("connection sent past its window was not closed")
+	}
+}
+
+// subtestWebSocketFlowControl floods a stream of a websocket server from a
+// raw WebSocket client, then announces it again once reset.
+func subtestWebSocketFlowControl(t testing.TB) {
+	a, b := connPipe(t)
+	defer a.Close()
+	defer b.Close()
+
+	muxb, err := websocket.DefaultTransport.NewConn(b, true)
+	checkErr(t, err)
+	defer muxb.Close()
+	// the IDs of the streams accepted, which are never read.
+	accepted := make(chan uint64, 4)
+	go func() {
+		for {
+			s, err := muxb.AcceptStream()
+			if err != nil {
+				return
+			}
+			accepted <- s.(interface{ ID() uint64 }).ID()
+		}
+	}()
+
+	_, err = io.WriteString(a, "GET / HTTP/1.1\r\n"+
+		"Host: smux\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+		"Sec-WebSocket-Version: 13\r\n"+
+		"Sec-WebSocket-Protocol: "+websocket.Subprotocol+"\r\n\r\n")
+	checkErr(t, err)
+	br := bufio.NewReader(a)
+	resp, err := http.ReadResponse(br, nil)
+	checkErr(t, err)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade answered with %v", resp.Status)
+	}
+
+	// the frames of the muxer, 4 bytes of stream ID then the type, go in
+	// binary messages, which clients mask; with a zero key, as the server
+	// does not care.
+	const typeOpen, typeData, typeReset = 0, 1, 3
+	writeFrame := func(id uint32, typ byte, payload []byte) error {
+		msg := []byte{0x82, 0x80 | 127, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint64(msg[2:], uint64(5+len(payload)))
+		msg = append(msg, 0, 0, 0, 0)
+		msg = append(msg, 0, 0, 0, 0, typ)
+		binary.BigEndian.PutUint32(msg[len(msg)-5:], id)
+		_, err := a.Write(append(msg, payload...))
+		return err
+	}
+
+	// the server's messages are read in the background, reporting the
+	// resets of stream 1.
+	resets := make(chan struct{}, 1)
+	go func() {
+		for {
+			var hdr [2]byte
+			if _, err := io.ReadFull(br, hdr[:]); err != nil {
+				return
+			}
+			size := uint64(hdr[1])
+			switch size {
+			case 126:
+				var ext [2]byte
+				if _, err := io.ReadFull(br, ext[:]); err != nil {
+					return
+				}
+				size = uint64(binary.BigEndian.Uint16(ext[:]))
+			case 127:
+				var ext [8]byte
+				if _, err := io.ReadFull(br, ext[:]); err != nil {
+					return
+				}
+				size = binary.BigEndian.Uint64(ext[:])
+			}
+			msg := make([]byte, size)
+			if _, err := io.ReadFull(br, msg); err != nil {
+				return
+			}
+			if len(msg) >= 5 && binary.BigEndian.Uint32(msg) == 1 && msg[4] == typeReset {
+				resets <- struct{}{}
+			}
+		}
+	}()
+
+	expectAccepted := func(id uint64) {
+		select {
+		case got := <-accepted:
+			if got != id {
+				t.Fatalf("accepted stream %d, expected %d", got, id)
+			}
+		case <-time.After(scaleTimeout(10 * time.Second)):
+			t.Fatalf("stream %d was not accepted", id)
+		}
+	}
+
+	checkErr(t, writeFrame(1, typeOpen, nil))
+	expectAccepted(1)
+	data := make([]byte, floodFrameSize)
+	for n := 0; n < 1<<20; n += len(data) {
+		checkErr(t, writeFrame(1, typeData, data))
+	}
+	select {
+	case <-resets:
+	case <-time.After(scaleTimeout(10 * time.Second)):
+		t.Fatal("stream sent past its window was not reset")
+	}
+
+	// stream 1, reset and forgotten, is not opened again.
+	checkErr(t, writeFrame(1, typeOpen, nil))
+	checkErr(t, writeFrame(3, typeOpen, nil))
+	expectAccepted(3)
+}
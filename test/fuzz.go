@@ -0,0 +1,79 @@
+package sm_test
+
+import (
+	"io"
+	"io/ioutil"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	smux "github.com/dms3-p2p/go-stream-muxer"
+)
+
+const (
+	// fuzzTimeout is how long a muxer may take to give up on a connection
+	// once its input ends.
+	fuzzTimeout = 5 * time.Second
+
+	// fuzzMaxMemory bounds the heap a muxer may grow while parsing an input.
+	fuzzMaxMemory = 64 << 20
+)
+
+// FuzzTransport feeds prefix and then data to the listening side of a
+// connection muxed by tr, as if written by the peer, accepting and draining
+// every stream, and discards what the muxer writes. prefix holds what the
+// fuzzer would hardly guess, such as a handshake. It is the body of the
+// fuzz tests of the muxer packages, run with go test -fuzz.
+//
+// It fails t if the muxer grows the heap by more than 64MB or if the
+// connection or a stream does not fail once the input ends.
+func FuzzTransport(t testing.TB, tr smux.Transport, prefix, data []byte) {
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	input := append(append([]byte(nil), prefix...), data...)
+	rc := smux.NewReplayConn(&smux.Capture{
+		Server:  true,
+		Records: []smux.CaptureRecord{{Data: input}},
+	})
+	c, err := tr.NewConn(rc, true)
+	if err != nil {
+		return
+	}
+
+	var peak uint64
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			s, err := c.AcceptStream()
+			if err != nil {
+				break
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				io.Copy(ioutil.Discard, s)
+			}()
+		}
+		var after runtime.MemStats
+		runtime.ReadMemStats(&after)
+		peak = after.HeapAlloc
+		wg.Wait()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(fuzzTimeout):
+		buf := make([]byte, 1<<20)
+		buf = buf[:runtime.Stack(buf, true)]
+		t.Fatalf("muxer did not fail after %d bytes of input\n%s", len(input), buf)
+	}
+	c.Close()
+
+	if peak > before.HeapAlloc && peak-before.HeapAlloc > fuzzMaxMemory {
+		t.Fatalf("muxer grew the heap by %d bytes on %d bytes of input", peak-before.HeapAlloc, len(input))
+	}
+}
@@ -0,0 +1,430 @@
+package sm_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	smux "github.com/dms3-p2p/go-stream-muxer"
+	"github.com/dms3-p2p/go-stream-muxer/http2"
+	"github.com/dms3-p2p/go-stream-muxer/websocket"
+)
+
+var goldenUpdate = flag.Bool("smux.golden.update", false, "rewrite golden wire transcripts instead of verifying them")
+
+// GoldenWorkload is the scripted session recorded by SubtestGolden. Every
+// op is a full round trip, so the bytes a deterministic muxer puts on the
+// wire in each direction do not depend on scheduling.
+var GoldenWorkload = Workload{
+	{Kind: OpOpen, Stream: 0},
+	{Kind: OpWrite, Stream: 0, Size: 1},
+	{Kind: OpWrite, Stream: 0, Size: 100},
+	{Kind: OpOpen, Stream: 1},
+	{Kind: OpWrite, Stream: 1, Size: 4096},
+	{Kind: OpWrite, Stream: 0, Size: 10},
+	{Kind: OpClose, Stream: 0},
+	{Kind: OpWrite, Stream: 1, Size: 70000},
+	{Kind: OpClose, Stream: 1},
+	{Kind: OpOpen, Stream: 2},
+	{Kind: OpWrite, Stream: 2, Size: 5},
+	{Kind: OpReset, Stream: 2},
+}
+
+// goldenData returns deterministic payloads for the golden session.
+func goldenData(size int) []byte {
+	buf := make([]byte, size)
+	for i := range buf {
+		buf[i] = byte(i % 251)
+	}
+	return buf
+}
+
+// transcript is the bytes a client and server wrote to each other, in the
+// order they were written.
+type transcript struct {
+	mu      sync.Mutex
+	records []wireRecord
+}
+
+// wireRecord is a single write by the client or the server.
+type wireRecord struct {
+	server bool
+	data   []byte
+}
+
+func (tr *transcript) record(server bool, b []byte) {
+	tr.mu.Lock()
+	tr.records = append(tr.records, wireRecord{server, append([]byte(nil), b...)})
+	tr.mu.Unlock()
+}
+
+// side returns everything one side wrote.
+func (tr *transcript) side(server bool) []byte {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	var buf bytes.Buffer
+	for _, r := range tr.records {
+		if r.server == server {
+			buf.Write(r.data)
+		}
+	}
+	return buf.Bytes()
+}
+
+// Transcripts are stored as a sequence of records, each a direction byte
+// ('c' for the client, 's' for the server), a big endian uint32 length and
+// that many bytes of data.
+func (tr *transcript) marshal() []byte {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	var buf bytes.Buffer
+	for _, r := range tr.records {
+		dir := byte('c')
+		if r.server {
+			dir = 's'
+		}
+		var hdr [5]byte
+		hdr[0] = dir
+		binary.BigEndian.PutUint32(hdr[1:], uint32(len(r.data)))
+		buf.Write(hdr[:])
+		buf.Write(r.data)
+	}
+	return buf.Bytes()
+}
+
+func unmarshalTranscript(b []byte) (*transcript, error) {
+	tr := new(transcript)
+	for len(b) > 0 {
+		if len(b) < 5 {
+			return nil, fmt.Errorf("truncated record header")
+		}
+		if b[0] != 'c' && b[0] != 's' {
+			return nil, fmt.Errorf("bad record direction %q", b[0])
+		}
+		n := binary.BigEndian.Uint32(b[1:5])
+		if uint32(len(b)-5) < n {
+			return nil, fmt.Errorf("truncated record")
+		}
+		tr.records = append(tr.records, wireRecord{b[0] == 's', b[5 : 5+n]})
+		b = b[5+n:]
+	}
+	return tr, nil
+}
+
+// recordConn records everything written to the wrapped net.Conn in a
+// transcript. Writes are recorded before they are sent, so the peer's
+// reaction to them is always recorded after them.
+type recordConn struct {
+	net.Conn
+	server bool
+	tr     *transcript
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	c.tr.record(c.server, b)
+	return c.Conn.Write(b)
+}
+
+// GoldenSession is a canonical session, recorded by
+// SubtestGoldenSessions in a transcript of its own.
+type GoldenSession struct {
+	Name     string
+	Workload Workload
+
+	// GoAway closes the dialing side once the workload ran, recording
+	// how the muxer tells its peer that the connection is going away.
+	GoAway bool
+}
+
+// GoldenSessions are the sessions recorded by SubtestGoldenSessions, each
+// exercising one part of the wire protocol, so that a change to it shows
+// up in the transcript it belongs to. They stay within the initial flow
+// control windows of the bundled muxers, as when a window update reaches
+// a writer waiting for one depends on scheduling.
+var GoldenSessions = []GoldenSession{
+	{Name: "open", Workload: Workload{
+		{Kind: OpOpen, Stream: 0},
+		{Kind: OpWrite, Stream: 0, Size: 1},
+	}},
+	{Name: "write", Workload: Workload{
+		{Kind: OpOpen, Stream: 0},
+		{Kind: OpWrite, Stream: 0, Size: 100},
+		{Kind: OpOpen, Stream: 1},
+		{Kind: OpWrite, Stream: 1, Size: 4096},
+		{Kind: OpWrite, Stream: 0, Size: 20000},
+		{Kind: OpClose, Stream: 1},
+		{Kind: OpClose, Stream: 0},
+	}},
+	{Name: "halfclose", Workload: Workload{
+		{Kind: OpOpen, Stream: 0},
+		{Kind: OpWrite, Stream: 0, Size: 10},
+		{Kind: OpClose, Stream: 0},
+	}},
+	{Name: "reset", Workload: Workload{
+		{Kind: OpOpen, Stream: 0},
+		{Kind: OpWrite, Stream: 0, Size: 5},
+		{Kind: OpReset, Stream: 0},
+	}},
+	{Name: "goaway", Workload: Workload{
+		{Kind: OpOpen, Stream: 0},
+		{Kind: OpWrite, Stream: 0, Size: 5},
+		{Kind: OpClose, Stream: 0},
+	}, GoAway: true},
+}
+
+// SubtestGolden runs GoldenWorkload through the transport and compares the
+// bytes each side wrote with the transcript stored at path (typically
+// under testdata). It then replays the recorded client writes, paced as
+// recorded, into a fresh server and checks it answers with the recorded
+// server bytes, so transcripts from older versions keep being consumed
+// correctly. With -smux.golden.update, the transcript is rewritten
+// instead.
+func SubtestGolden(t testing.TB, tr smux.Transport, path string) {
+	checkGolden(t, tr, path, GoldenSession{Workload: GoldenWorkload})
+}
+
+// SubtestGoldenSessions checks each of GoldenSessions like SubtestGolden,
+// against the transcript stored in dir as <name>.golden.
+func SubtestGoldenSessions(t testing.TB, tr smux.Transport, dir string) {
+	for _, gs := range GoldenSessions {
+		checkGolden(t, tr, filepath.Join(dir, gs.Name+".golden"), gs)
+	}
+}
+
+// SubtestBundledGolden runs SubtestGoldenSessions for the muxers of this
+// repository with a wire format of their own, against the transcripts
+// checked in under the testdata directory of their package, so that any
+// change to what they send or how they read older peers is caught. The
+// websocket dialer is given a fixed Host and source of masking keys, to
+// make its writes deterministic. With -smux.golden.update, it rewrites the
+// transcripts of the source tree the test package was built from.
+func SubtestBundledGolden(t testing.TB) {
+	_, file, _, ok := runtime.Caller(0)
+	if !ok {
+		t.Skip("cannot locate the source tree")
+	}
+	root := filepath.Dir(filepath.Dir(file))
+
+	SubtestGoldenSessions(t, http2.DefaultTransport, filepath.Join(root, "http2", "testdata"))
+	ws := websocket.Transport{Rand: constReader(0x5a), Host: "smux.test"}
+	SubtestGoldenSessions(t, ws, filepath.Join(root, "websocket", "testdata"))
+}
+
+// constReader reads as an endless run of the same byte.
+type constReader byte
+
+func (r constReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = byte(r)
+	}
+	return len(b), nil
+}
+
+func checkGolden(t testing.TB, tr smux.Transport, path string, gs GoldenSession) {
+	live := recordSession(t, tr, gs)
+
+	if *goldenUpdate {
+		checkErr(t, ioutil.WriteFile(path, live.marshal(), 0644))
+		return
+	}
+
+	b, err := ioutil.ReadFile(path)
+	checkErr(t, err)
+	golden, err := unmarshalTranscript(b)
+	if err != nil {
+		t.Fatalf("%s: %s", path, err)
+	}
+
+	if err := compareWire(golden.side(false), live.side(false)); err != nil {
+		t.Errorf("client bytes differ from %s: %s", path, err)
+	}
+	if err := compareWire(golden.side(true), live.side(true)); err != nil {
+		t.Errorf("server bytes differ from %s: %s", path, err)
+	}
+
+	replayed := replayServer(t, tr, golden)
+	if err := compareWire(golden.side(true), replayed); err != nil {
+		t.Errorf("replaying %s: server bytes differ: %s", path, err)
+	}
+}
+
+// recordSession runs the session and returns the transcript of what the
+// client and the server wrote. It runs over TCP whatever -smux.net is, as
+// what a muxer writes may depend on how its reads are split.
+func recordSession(t testing.TB, tr smux.Transport, gs GoldenSession) *transcript {
+	a, b := networkPipe(t, TCPNetwork)
+	rec := new(transcript)
+
+	muxb, err := tr.NewConn(&recordConn{Conn: b, server: true, tr: rec}, true)
+	checkErr(t, err)
+	serverDone := make(chan struct{})
+	go func() {
+		defer close(serverDone)
+		for {
+			str, err := muxb.AcceptStream()
+			if err != nil {
+				return
+			}
+			go echoStream(str)
+		}
+	}()
+
+	muxa, err := tr.NewConn(&recordConn{Conn: a, tr: rec}, false)
+	checkErr(t, err)
+	go muxa.AcceptStream()
+
+	runWorkload(t, muxa, gs.Workload, goldenData)
+
+	if gs.GoAway {
+		checkErr(t, muxa.Close())
+		select {
+		case <-serverDone:
+		case <-time.After(5 * time.Second):
+			t.Fatal("server did not notice the client going away")
+		}
+	}
+
+	// snapshot the transcript before tearing down, so it does not depend
+	// on how fast each side notices the close.
+	time.Sleep(50 * time.Millisecond)
+	rec.mu.Lock()
+	snapshot := &transcript{records: append([]wireRecord(nil), rec.records...)}
+	rec.mu.Unlock()
+
+	muxa.Close()
+	muxb.Close()
+	<-serverDone
+	return snapshot
+}
+
+// replayConn feeds chunks of input to a muxer, records its output and then
+// blocks reads until closed.
+type replayConn struct {
+	net.Conn
+
+	in     chan []byte
+	buf    []byte
+	closed chan struct{}
+	once   sync.Once
+
+	mu      sync.Mutex
+	written bytes.Buffer
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	if len(c.buf) == 0 {
+		select {
+		case c.buf = <-c.in:
+		case <-c.closed:
+			return 0, io.EOF
+		}
+	}
+	n := copy(b, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *replayConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.written.Write(b)
+}
+
+func (c *replayConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *replayConn) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.written.Len()
+}
+
+func (c *replayConn) Bytes() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]byte(nil), c.written.Bytes()...)
+}
+
+func (c *replayConn) SetDeadline(time.Time) error      { return nil }
+func (c *replayConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *replayConn) SetWriteDeadline(time.Time) error { return nil }
+
+// replayServer feeds the client writes of the transcript to a fresh server
+// side connection that echoes all streams. Each write is fed once the
+// server wrote as much as it had when the write was recorded. It returns
+// everything the server wrote.
+func replayServer(t testing.TB, tr smux.Transport, golden *transcript) []byte {
+	a, _ := net.Pipe()
+	defer a.Close()
+	rc := &replayConn{Conn: a, in: make(chan []byte), closed: make(chan struct{})}
+	defer rc.Close()
+
+	c, err := tr.NewConn(rc, true)
+	checkErr(t, err)
+	defer c.Close()
+	go func() {
+		for {
+			str, err := c.AcceptStream()
+			if err != nil {
+				return
+			}
+			go echoStream(str)
+		}
+	}()
+
+	limit := time.After(5 * time.Second)
+	waitFor := func(n int) bool {
+		for rc.Len() < n {
+			select {
+			case <-limit:
+				t.Errorf("replay: server wrote %d bytes, expected at least %d", rc.Len(), n)
+				return false
+			case <-time.After(time.Millisecond):
+			}
+		}
+		return true
+	}
+
+	expected := 0
+	for _, r := range golden.records {
+		if r.server {
+			expected += len(r.data)
+			continue
+		}
+		if !waitFor(expected) {
+			return rc.Bytes()
+		}
+		select {
+		case rc.in <- r.data:
+		case <-limit:
+			t.Errorf("replay: server stopped reading")
+			return rc.Bytes()
+		}
+	}
+	waitFor(expected)
+
+	time.Sleep(50 * time.Millisecond)
+	return rc.Bytes()
+}
+func compareWire(want, got []byte) error {
+	for i := 0; i < len(want) && i < len(got); i++ {
+		if want[i] != got[i] {
+			return fmt.Errorf("first difference at offset %d: %#02x != %#02x", i, got[i], want[i])
+		}
+	}
+	if len(want) != len(got) {
+		return fmt.Errorf("got %d bytes, expected %d", len(got), len(want))
+	}
+	return nil
+}
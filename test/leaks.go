@@ -0,0 +1,94 @@
+package sm_test
+
+import (
+	"bytes"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// leakSettle is how long goroutines may take to exit after a subtest
+// returned before they are reported as leaked.
+const leakSettle = 5 * time.Second
+
+// ignoredStacks are substrings of the stacks of goroutines which are not
+// the muxer's, and may come and go during a subtest.
+var ignoredStacks = []string{
+	"testing.(*T).Run(",
+	"testing.tRunner(",
+	"testing.runTests(",
+	"os/signal.signal_recv(",
+	"runtime.ensureSigM(",
+	"runtime/pprof.profileWriter(",
+}
+
+// allStacks returns the stacks of all the live goroutines.
+func allStacks() []byte {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// goroutines returns the stacks of the live goroutines which are not
+// ignored, by goroutine header, such as "goroutine 12 [chan receive]:".
+func goroutines() map[string]string {
+	stacks := make(map[string]string)
+next:
+	for _, g := range bytes.Split(allStacks(), []byte("\n\n")) {
+		stack := string(g)
+		for _, ignored := range ignoredStacks {
+			if strings.Contains(stack, ignored) {
+				continue next
+			}
+		}
+		// the state in the header changes while a goroutine lives, so the
+		// ID alone identifies it.
+		id := stack
+		if i := strings.Index(stack, " ["); i >= 0 {
+			id = stack[:i]
+		}
+		stacks[id] = stack
+	}
+	return stacks
+}
+
+// checkLeaks snapshots the live goroutines, and returns a function which
+// fails t if goroutines started since are still running a few seconds
+// after it is called. Subtests defer it, so that it runs after the
+// connections they established are closed:
+//
+//	defer checkLeaks(t)()
+//
+// Leaks are not reported for subtests which failed, since their
+// connections may not have been closed.
+func checkLeaks(t testing.TB) func() {
+	before := goroutines()
+	return func() {
+		if t.Failed() {
+			return
+		}
+		deadline := time.Now().Add(scaleTimeout(leakSettle))
+		for {
+			var leaked []string
+			for id, stack := range goroutines() {
+				if _, ok := before[id]; !ok {
+					leaked = append(leaked, stack)
+				}
+			}
+			if len(leaked) == 0 {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Errorf("%d goroutines still running after the subtest:\n\n%s", len(leaked), strings.Join(leaked, "\n\n"))
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
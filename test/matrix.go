@@ -0,0 +1,294 @@
+package sm_test
+
+import (
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"text/tabwriter"
+	"time"
+
+	smux "github.com/dms3-p2p/go-stream-muxer"
+	"github.com/dms3-p2p/go-stream-muxer/results"
+	"github.com/dms3-p2p/go-stream-muxer/transports"
+)
+
+// NamedTransport is a transport with a name to report it under.
+type NamedTransport struct {
+	Name      string
+	Transport smux.Transport
+}
+
+// MatrixOutput is where RunMatrix prints its summary table.
+var MatrixOutput io.Writer = os.Stdout
+
+var matrixJUnit = flag.String("smux.junit", "", "write RunMatrix results as JUnit XML to this file")
+
+// SubtestResult is the outcome of one subtest against one transport, named
+// by Name, with the allocations and the peak goroutines of the process
+// while it ran in its Metrics.
+type SubtestResult = results.Result
+
+// subtestStatus reports how a finished test went.
+func subtestStatus(t testing.TB) string {
+	switch {
+	case t.Skipped():
+		return results.Skip
+	case t.Failed():
+		return results.Fail
+	default:
+		return results.Pass
+	}
+}
+
+// shortFunctionName strips the package path from a function name.
+func shortFunctionName(i interface{}) string {
+	name := getFunctionName(i)
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+// RunMatrix runs all the subtests against each of the transports, then
+// prints a table of the pass/fail/skip status of every subtest per
+// transport to MatrixOutput. When -smux.net lists several networks, every
+// transport is run over each of them, in a column of its own. When the
+// -smux.json or -smux.junit flags are set, the results are also written
+// to those files, with the features each transport declares, and the
+// metrics of the subtests and what those failing failed with.
+func RunMatrix(t *testing.T, trs []NamedTransport) {
+	var rs []SubtestResult
+	for _, ntr := range trs {
+		t.Run(ntr.Name, func(t *testing.T) {
+			forEachNetwork(t, func(t testing.TB) {
+				for _, f := range Subtests {
+					f := f
+					res := measureSubtest(t, ntr.Name, ntr.Transport, shortFunctionName(f), func(t testing.TB) {
+						skipUndeclared(t, ntr.Transport, f)
+						defer startWatchdog(t)()
+						defer checkLeaks(t)()
+						f(t, ntr.Transport)
+					})
+					// subtests -test.run leaves out have no result.
+					if res.Name != "" {
+						rs = append(rs, res)
+					}
+				}
+			})
+		})
+	}
+
+	printMatrix(MatrixOutput, rs)
+	if *matrixJUnit != "" {
+		if err := writeMatrixFile(*matrixJUnit, rs, writeMatrixJUnit); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func printMatrix(out io.Writer, rs []SubtestResult) {
+	var columns []string
+	status := make(map[string]string)
+	for _, res := range rs {
+		col := res.Column()
+		if len(columns) == 0 || columns[len(columns)-1] != col {
+			columns = append(columns, col)
+		}
+		status[col+"/"+res.Name] = res.Status
+	}
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprint(w, "SUBTEST")
+	for _, col := range columns {
+		fmt.Fprintf(w, "\t%s", col)
+	}
+	fmt.Fprintln(w)
+	for _, f := range Subtests {
+		name := shortFunctionName(f)
+		fmt.Fprint(w, name)
+		for _, col := range columns {
+			st, ok := status[col+"/"+name]
+			if !ok {
+				st = "-"
+			}
+			fmt.Fprintf(w, "\t%s", st)
+		}
+		fmt.Fprintln(w)
+	}
+	w.Flush()
+}
+
+func writeMatrixFile(path string, rs []SubtestResult, write func(io.Writer, []SubtestResult) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := write(f, rs); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+// junitTestSuite is the suite of the results of a column of the matrix,
+// with the features its transport declares in its properties.
+type junitTestSuite struct {
+	Name       string           `xml:"name,attr"`
+	Tests      int              `xml:"tests,attr"`
+	Failures   int              `xml:"failures,attr"`
+	Skipped    int              `xml:"skipped,attr"`
+	Time       string           `xml:"time,attr"`
+	Properties *junitProperties `xml:"properties"`
+	Cases      []junitTestCase  `xml:"testcase"`
+}
+
+// junitTestCase is the result of a subtest, with its metrics in its
+// properties.
+type junitTestCase struct {
+	Name       string           `xml:"name,attr"`
+	Classname  string           `xml:"classname,attr"`
+	Time       string           `xml:"time,attr"`
+	Properties *junitProperties `xml:"properties"`
+	Failure    *junitFailure    `xml:"failure,omitempty"`
+	Skipped    *struct{}        `xml:"skipped,omitempty"`
+}
+
+type junitProperties struct {
+	Property []junitProperty `xml:"property"`
+}
+
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+// junitFailure has the first message a subtest failed with as its message,
+// and all of them as its text.
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Output  string `xml:",chardata"`
+}
+
+func junitSeconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// junitMetrics returns the metrics of res as properties, by name, or nil
+// if it has none.
+func junitMetrics(res SubtestResult) *junitProperties {
+	if len(res.Metrics) == 0 {
+		return nil
+	}
+	props := new(junitProperties)
+	for name, v := range res.Metrics {
+		props.Property = append(props.Property, junitProperty{Name: name, Value: strconv.FormatFloat(v, 'g', -1, 64)})
+	}
+	sort.Slice(props.Property, func(i, j int) bool { return props.Property[i].Name < props.Property[j].Name })
+	return props
+}
+
+func writeMatrixJUnit(w io.Writer, rs []SubtestResult) error {
+	var doc junitTestSuites
+	suites := make(map[string]int)
+	var total []time.Duration
+	for _, res := range rs {
+		i, ok := suites[res.Column()]
+		if !ok {
+			i = len(doc.Suites)
+			suites[res.Column()] = i
+			suite := junitTestSuite{Name: res.Column()}
+			if res.Features != "" {
+				suite.Properties = &junitProperties{Property: []junitProperty{{Name: "features", Value: res.Features}}}
+			}
+			doc.Suites = append(doc.Suites, suite)
+			total = append(total, 0)
+		}
+
+		tc := junitTestCase{
+			Name:       res.Name,
+			Classname:  res.Column(),
+			Time:       junitSeconds(res.Duration),
+			Properties: junitMetrics(res),
+		}
+		suite := &doc.Suites[i]
+		suite.Tests++
+		switch res.Status {
+		case results.Fail:
+			suite.Failures++
+			msg := res.Error
+			if nl := strings.IndexByte(msg, '\n'); nl >= 0 {
+				msg = msg[:nl]
+			}
+			if msg == "" {
+				msg = "failed"
+			}
+			tc.Failure = &junitFailure{Message: msg, Output: res.Error}
+		case results.Skip:
+			suite.Skipped++
+			tc.Skipped = &struct{}{}
+		}
+		suite.Cases = append(suite.Cases, tc)
+		total[i] += res.Duration
+	}
+	for i := range doc.Suites {
+		doc.Suites[i].Time = junitSeconds(total[i])
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// RegistryTransports returns the transports registered in r, named by
+// their IDs, in ID order.
+func RegistryTransports(r *smux.Registry) []NamedTransport {
+	var trs []NamedTransport
+	for _, id := range r.IDs() {
+		if tr, ok := r.Get(id); ok {
+			trs = append(trs, NamedTransport{Name: id, Transport: tr})
+		}
+	}
+	return trs
+}
+
+// BundledTransports returns transports.AllTransports, the muxers of this
+// repository, named as there, in name order.
+func BundledTransports() []NamedTransport {
+	var trs []NamedTransport
+	for _, name := range transports.Names() {
+		trs = append(trs, NamedTransport{Name: name, Transport: transports.AllTransports[name]})
+	}
+	return trs
+}
+
+// RunBundled runs RunMatrix against BundledTransports, so that every muxer
+// listed in transports.AllTransports passes the suite.
+func RunBundled(t *testing.T) {
+	RunMatrix(t, BundledTransports())
+}
+
+// RunRegistry runs RunMatrix against every transport registered in
+// smux.DefaultRegistry, so that importing a muxer package for its side
+// effect is enough to run the conformance suite against it.
+func RunRegistry(t *testing.T) {
+	trs := RegistryTransports(smux.DefaultRegistry)
+	if len(trs) == 0 {
+		t.Skip("no transports registered")
+	}
+	RunMatrix(t, trs)
+}
@@ -0,0 +1,121 @@
+package sm_test
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var memProfileDir = flag.String("smux.memprofile", "", "write heap profiles before and after each stress test to this directory, and log the top allocation sites")
+
+// memProfileTop is the number of allocation sites logged per stress test.
+const memProfileTop = 10
+
+// harnessPkg is the import path prefix of this package's functions, whose
+// frames are not attributed allocations.
+var harnessPkg = func() string {
+	name := getFunctionName(checkErr)
+	return name[:strings.LastIndex(name, ".")+1]
+}()
+
+// allocSite returns the allocating frame of a stack: the innermost frame
+// that is not in the runtime, the testing package or this harness, which
+// is normally in the muxer or a library it uses.
+func allocSite(stk []uintptr) string {
+	frames := runtime.CallersFrames(stk)
+	for {
+		f, more := frames.Next()
+		fn := f.Function
+		if !strings.HasPrefix(fn, "runtime.") && !strings.HasPrefix(fn, "testing.") && !strings.HasPrefix(fn, harnessPkg) {
+			return fmt.Sprintf("%s (%s:%d)", fn, filepath.Base(f.File), f.Line)
+		}
+		if !more {
+			return "<harness>"
+		}
+	}
+}
+
+// allocsBySite returns the cumulative bytes allocated per allocation site.
+func allocsBySite() map[string]int64 {
+	var records []runtime.MemProfileRecord
+	n, ok := runtime.MemProfile(nil, true)
+	for !ok {
+		records = make([]runtime.MemProfileRecord, n+50)
+		n, ok = runtime.MemProfile(records, true)
+	}
+	sites := make(map[string]int64)
+	for _, r := range records[:n] {
+		sites[allocSite(r.Stack())] += r.AllocBytes
+	}
+	return sites
+}
+
+// settleMemProfile runs the garbage collector until the memory profile
+// includes all allocations so far; it lags up to two cycles behind.
+func settleMemProfile() {
+	runtime.GC()
+	runtime.GC()
+}
+
+func writeHeapProfile(t testing.TB, suffix string) {
+	name := strings.Replace(t.Name(), "/", "_", -1) + "-" + suffix + ".pprof"
+	f, err := os.Create(filepath.Join(*memProfileDir, name))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer f.Close()
+	if err := pprof.Lookup("heap").WriteTo(f, 0); err != nil {
+		t.Error(err)
+	}
+}
+
+// startMemProfile snapshots the heap when -smux.memprofile is set. The
+// returned function snapshots it again, and logs the sites that allocated
+// the most in between, per stream of the test. It does nothing when the
+// flag is not set.
+func startMemProfile(t testing.TB) (stop func(streams int)) {
+	if *memProfileDir == "" {
+		return func(int) {}
+	}
+	settleMemProfile()
+
+	writeHeapProfile(t, "before")
+	settleMemProfile()
+	before := allocsBySite()
+
+	return func(streams int) {
+		settleMemProfile()
+		after := allocsBySite()
+		writeHeapProfile(t, "after")
+
+		type site struct {
+			name  string
+			bytes int64
+		}
+		var sites []site
+		for name, b := range after {
+			if d := b - before[name]; d > 0 {
+				sites = append(sites, site{name, d})
+			}
+		}
+		sort.Slice(sites, func(i, j int) bool { return sites[i].bytes > sites[j].bytes })
+		if len(sites) > memProfileTop {
+			sites = sites[:memProfileTop]
+		}
+
+		if streams < 1 {
+			streams = 1
+		}
+		log("top allocation sites (sampled, per stream over %d streams):", streams)
+		for _, s := range sites {
+			log("  %10d B/stream  %s", s.bytes/int64(streams), s.name)
+		}
+	}
+}
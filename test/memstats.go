@@ -0,0 +1,96 @@
+package sm_test
+
+import (
+	"io"
+	"runtime"
+	"testing"
+	"time"
+
+	smux "github.com/dms3-p2p/go-stream-muxer"
+)
+
+// memStatsInterval is how often the heap is sampled for its peak.
+const memStatsInterval = 10 * time.Millisecond
+
+// startMemStats returns a function logging the allocations, the peak heap
+// and the garbage collections of the process since startMemStats was
+// called. Like log, it does nothing unless the tests are verbose.
+func startMemStats() (stop func()) {
+	if !testing.Verbose() {
+		return func() {}
+	}
+
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+	done := make(chan struct{})
+	peak := make(chan uint64)
+	go func() {
+		max := before.HeapAlloc
+		t := time.NewTicker(memStatsInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				var m runtime.MemStats
+				runtime.ReadMemStats(&m)
+				if m.HeapAlloc > max {
+					max = m.HeapAlloc
+				}
+			case <-done:
+				peak <- max
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		max := <-peak
+		var after runtime.MemStats
+		runtime.ReadMemStats(&after)
+		if after.HeapAlloc > max {
+			max = after.HeapAlloc
+		}
+		log("memory: %d allocations of %d bytes, peak heap %d bytes, %d GC cycles",
+			after.Mallocs-before.Mallocs, after.TotalAlloc-before.TotalAlloc, max, after.NumGC-before.NumGC)
+	}
+}
+
+// logAllocsPerMessage logs the allocations of echoing a message of msgsize
+// bytes over a stream of a connection muxed with tr, counting both sides.
+// Like log, it does nothing unless the tests are verbose.
+func logAllocsPerMessage(t testing.TB, tr smux.Transport, msgsize int) {
+	if !testing.Verbose() {
+		return
+	}
+
+	a, b := connPipe(t)
+	defer a.Close()
+	defer b.Close()
+
+	muxb, err := tr.NewConn(b, true)
+	checkErr(t, err)
+	defer muxb.Close()
+	defer serveConn(t, muxb, echoStream)()
+	muxa, err := tr.NewConn(a, false)
+	checkErr(t, err)
+	defer muxa.Close()
+
+	s, err := muxa.OpenStream()
+	checkErr(t, err)
+	defer s.Reset()
+	s.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+	out := randBuf(msgsize)
+	in := make([]byte, msgsize)
+	var echoErr error
+	allocs := testing.AllocsPerRun(100, func() {
+		if echoErr != nil {
+			return
+		}
+		if _, echoErr = s.Write(out); echoErr == nil {
+			_, echoErr = io.ReadFull(s, in)
+		}
+	})
+	checkErr(t, echoErr)
+	log("%.1f allocations per %d byte message echoed", allocs, msgsize)
+}
@@ -0,0 +1,97 @@
+package sm_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	smux "github.com/dms3-p2p/go-stream-muxer"
+	"github.com/dms3-p2p/go-stream-muxer/http2"
+	"github.com/dms3-p2p/go-stream-muxer/identity"
+	"github.com/dms3-p2p/go-stream-muxer/multistream"
+	"github.com/dms3-p2p/go-stream-muxer/websocket"
+)
+
+// multistreamMuxers are the muxers the peers of SubtestBundledMultistream
+// pick from, by protocol ID. yamux stands for a muxer only one side has.
+var multistreamMuxers = map[string]smux.Transport{
+	http2.ProtocolID:     http2.DefaultTransport,
+	websocket.ProtocolID: websocket.DefaultTransport,
+	"/yamux/1.0.0":       identity.DefaultTransport,
+}
+
+// SubtestBundledMultistream checks that multistream Transports with
+// overlapping but different preference lists agree on the dialer's
+// preferred muxer among those the listener has, and carry streams with
+// it, and that peers with no muxer in common fail with ErrNoMuxer. Both
+// sides are established from the same goroutine, the dialer first, as
+// NewConn does not wait for the handshake.
+func SubtestBundledMultistream(t testing.TB) {
+	for _, tc := range []struct {
+		name             string
+		dialer, listener []string
+		want             string // "" for no muxer in common
+	}{
+		{"dialer-wins", []string{websocket.ProtocolID, http2.ProtocolID}, []string{http2.ProtocolID, websocket.ProtocolID}, websocket.ProtocolID},
+		{"listener-lacks-first", []string{"/yamux/1.0.0", http2.ProtocolID, websocket.ProtocolID}, []string{websocket.ProtocolID, http2.ProtocolID}, http2.ProtocolID},
+		{"dialer-lacks-first", []string{websocket.ProtocolID}, []string{"/yamux/1.0.0", http2.ProtocolID, websocket.ProtocolID}, websocket.ProtocolID},
+		{"none-in-common", []string{"/yamux/1.0.0"}, []string{http2.ProtocolID, websocket.ProtocolID}, ""},
+	} {
+		tc := tc
+		run(t, tc.name, func(t testing.TB) {
+			subtestMultistream(t, tc.dialer, tc.listener, tc.want)
+		})
+	}
+}
+
+func subtestMultistream(t testing.TB, dialer, listener []string, want string) {
+	transport := func(ids []string) *multistream.Transport {
+		tr := multistream.NewTransport()
+		for _, id := range ids {
+			tr.AddTransport(id, multistreamMuxers[id])
+		}
+		return tr
+	}
+
+	a, b := connPipe(t)
+	ca, err := transport(dialer).NewConn(a, false)
+	checkErr(t, err)
+	defer ca.Close()
+	cb, err := transport(listener).NewConn(b, true)
+	checkErr(t, err)
+	defer cb.Close()
+
+	for _, c := range []smux.Conn{ca, cb} {
+		id, err := c.(interface{ Protocol() (string, error) }).Protocol()
+		switch {
+		case want == "":
+			if err != multistream.ErrNoMuxer {
+				t.Fatalf("negotiated %q, %v, expected %v", id, err, multistream.ErrNoMuxer)
+			}
+		case err != nil:
+			t.Fatal(err)
+		case id != want:
+			t.Fatalf("negotiated %q, expected %q", id, want)
+		}
+	}
+	if want == "" {
+		if _, err := ca.OpenStream(); err != multistream.ErrNoMuxer {
+			t.Fatalf("opening a stream without a muxer returned %v, expected %v", err, multistream.ErrNoMuxer)
+		}
+		return
+	}
+
+	stop := serveConn(t, cb, echoStream)
+	defer stop()
+	s, err := ca.OpenStream()
+	checkErr(t, err)
+	msg := []byte("hello over " + want)
+	_, err = s.Write(msg)
+	checkErr(t, err)
+	checkErr(t, s.Close())
+	got, err := ioutil.ReadAll(s)
+	checkErr(t, err)
+	if !bytes.Equal(got, msg) {
+		t.Fatalf("echoed %q, expected %q", got, msg)
+	}
+}
@@ -0,0 +1,502 @@
+package sm_test
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	smux "github.com/dms3-p2p/go-stream-muxer"
+	"github.com/dms3-p2p/go-stream-muxer/testnet"
+)
+
+// Network establishes the net.Conns the subtests run muxers over.
+type Network struct {
+	Name string
+
+	// Listen listens on a new address.
+	Listen func() (net.Listener, error)
+
+	// Dial connects to the address of a listener returned by Listen.
+	Dial func(addr net.Addr) (net.Conn, error)
+}
+
+// TCPNetwork connects over TCP on the loopback interface.
+var TCPNetwork = Network{
+	Name: "tcp",
+	Listen: func() (net.Listener, error) {
+		return net.Listen("tcp", "localhost:0")
+	},
+	Dial: dialAddr,
+}
+
+// UnixNetwork connects over unix domain sockets in the temporary
+// directory, whose writes and reads are split differently from TCP's.
+var UnixNetwork = Network{
+	Name:   "unix",
+	Listen: listenUnix,
+	Dial:   dialAddr,
+}
+
+// MemNetwork connects over in-memory pipes, buffered like sockets but much
+// faster to set up, and available without networking.
+var MemNetwork = Network{
+	Name:   "mem",
+	Listen: listenMem,
+	Dial:   dialMem,
+}
+
+// Networks are the networks -smux.net selects, by name.
+var Networks = map[string]Network{
+	TCPNetwork.Name:  TCPNetwork,
+	TLSNetwork.Name:  TLSNetwork,
+	UnixNetwork.Name: UnixNetwork,
+	MemNetwork.Name:  MemNetwork,
+}
+
+var networkFlag = flag.String("smux.net", TCPNetwork.Name, "network the subtests run muxers over, or a comma separated list of networks for SubtestAll and RunMatrix to run them over each: "+networkNames())
+
+func networkNames() string {
+	var names []string
+	for name := range Networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// WithConditions returns n with the data written to both ends of its
+// connections delivered under cond, by testnet.Wrap.
+func (n Network) WithConditions(cond testnet.Conditions) Network {
+	return n.Wrap("testnet", func(c net.Conn) net.Conn {
+		return testnet.Wrap(c, cond)
+	})
+}
+
+// WithDribble returns n with both ends of its connections split and
+// merging their reads and writes at random, by testnet.Dribble.
+func (n Network) WithDribble(seed int64) Network {
+	return n.Wrap("dribble", func(c net.Conn) net.Conn {
+		return testnet.Dribble(c, seed)
+	})
+}
+
+// Wrap returns n with both ends of its connections wrapped by wrap, named
+// after n and name.
+func (n Network) Wrap(name string, wrap func(net.Conn) net.Conn) Network {
+	listen := n.Listen
+	dial := n.Dial
+	n.Name += "+" + name
+	n.Listen = func() (net.Listener, error) {
+		l, err := listen()
+		if err != nil {
+			return nil, err
+		}
+		return wrapListener{l, wrap}, nil
+	}
+	n.Dial = func(addr net.Addr) (net.Conn, error) {
+		c, err := dial(addr)
+		if err != nil {
+			return nil, err
+		}
+		return wrap(c), nil
+	}
+	return n
+}
+
+type wrapListener struct {
+	net.Listener
+	wrap func(net.Conn) net.Conn
+}
+
+func (l wrapListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.wrap(c), nil
+}
+
+// WithNetwork returns a copy of the options that runs over n rather than
+// the network selected by -smux.net.
+func (o Options) WithNetwork(n Network) Options {
+	o.network = n
+	return o
+}
+
+// WithListen returns a copy of the options whose listeners are created by
+// listen, rather than by the Listen of their network, such as to run over
+// connections of a transport of one's own. Dial must connect to their
+// addresses.
+func (o Options) WithListen(listen func() (net.Listener, error)) Options {
+	o.listen = listen
+	return o
+}
+
+// WithDial returns a copy of the options whose connections are dialed by
+// dial, rather than by the Dial of their network.
+func (o Options) WithDial(dial func(addr net.Addr) (net.Conn, error)) Options {
+	o.dial = dial
+	return o
+}
+
+// optionsNetwork returns the network the options run over: that of
+// WithNetwork, or else the one the subtests run over, with the functions
+// of WithListen and WithDial.
+func optionsNetwork(t testing.TB, o Options) Network {
+	n := o.network
+	if n.Listen == nil {
+		n = testNetwork(t)
+	}
+	if o.listen != nil {
+		n.Listen = o.listen
+	}
+	if o.dial != nil {
+		n.Dial = o.dial
+	}
+	return n
+}
+
+// activeNetwork is the network of the -smux.net list the subtests run
+// over, while forEachNetwork runs them, or the one of RunOverNetwork.
+var activeNetwork *Network
+
+// testNetworks returns the networks listed by -smux.net.
+func testNetworks(t testing.TB) []Network {
+	var ns []Network
+	for _, name := range strings.Split(*networkFlag, ",") {
+		n, ok := Networks[strings.TrimSpace(name)]
+		if !ok {
+			t.Fatalf("unknown -smux.net %q, want one of %s", name, networkNames())
+		}
+		ns = append(ns, n)
+	}
+	return ns
+}
+
+// testNetwork returns the network the subtests run over: the one
+// forEachNetwork is running them over, or else the first one listed by
+// -smux.net.
+func testNetwork(t testing.TB) Network {
+	if activeNetwork != nil {
+		return *activeNetwork
+	}
+	return testNetworks(t)[0]
+}
+
+// forEachNetwork runs f over each of the networks listed by -smux.net, as
+// a subtest named after the network if there are several.
+func forEachNetwork(t testing.TB, f func(t testing.TB)) {
+	ns := testNetworks(t)
+	if len(ns) == 1 {
+		f(t)
+		return
+	}
+	for _, n := range ns {
+		n := n
+		run(t, n.Name, func(t testing.TB) {
+			activeNetwork = &n
+			defer func() { activeNetwork = nil }()
+			f(t)
+		})
+	}
+}
+
+// RunOverNetwork runs f with the subtests it runs, such as
+// SubtestSimpleWrite or SubtestStress, and the listeners of GoServe they
+// serve, over n rather than the networks listed by -smux.net. n can
+// establish connections of any kind, such as TLS, SSH channels or
+// in-memory fakes.
+func RunOverNetwork(t testing.TB, n Network, f func(t testing.TB)) {
+	prev := activeNetwork
+	activeNetwork = &n
+	defer func() { activeNetwork = prev }()
+	f(t)
+}
+
+func dialAddr(addr net.Addr) (net.Conn, error) {
+	return net.Dial(addr.Network(), addr.String())
+}
+
+var unixSockets uint64
+
+// listenUnix listens on a new socket in the temporary directory, which is
+// removed when the listener is closed.
+func listenUnix() (net.Listener, error) {
+	name := fmt.Sprintf("smux-%d-%d.sock", os.Getpid(), atomic.AddUint64(&unixSockets, 1))
+	return net.Listen("unix", filepath.Join(os.TempDir(), name))
+}
+
+// connPipe returns the two ends of a connection over the network selected
+// by -smux.net.
+func connPipe(t testing.TB) (net.Conn, net.Conn) {
+	return networkPipe(t, testNetwork(t))
+}
+
+// networkPipe returns the two ends of a connection over n.
+func networkPipe(t testing.TB, n Network) (net.Conn, net.Conn) {
+	l, err := n.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			c = nil
+		}
+		accepted <- c
+	}()
+
+	con1, err := n.Dial(l.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	con2 := <-accepted
+	if con2 == nil {
+		con1.Close()
+		t.Fatal("accepting the connection failed")
+	}
+	return watch(con1), watch(con2)
+}
+
+// memPipeSize is the buffer of each direction of a MemNetwork connection.
+const memPipeSize = 1 << 20
+
+var (
+	errMemRefused = errors.New("mem: connection refused")
+
+	// errMemClosed reads like the error of a closed socket, which some
+	// subtests look for.
+	errMemClosed = errors.New("mem: use of closed network connection")
+)
+
+var (
+	memMu        sync.Mutex
+	memListeners = make(map[string]*memListener)
+	memAddrs     uint64
+)
+
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return string(a) }
+
+type memListener struct {
+	addr   memAddr
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func listenMem() (net.Listener, error) {
+	l := &memListener{
+		addr:   memAddr(fmt.Sprintf("mem:%d", atomic.AddUint64(&memAddrs, 1))),
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+	memMu.Lock()
+	memListeners[l.addr.String()] = l
+	memMu.Unlock()
+	return l, nil
+}
+
+func dialMem(addr net.Addr) (net.Conn, error) {
+	memMu.Lock()
+	l, ok := memListeners[addr.String()]
+	memMu.Unlock()
+	if !ok {
+		return nil, errMemRefused
+	}
+
+	a, b := newMemBuffer(), newMemBuffer()
+	local := memAddr(fmt.Sprintf("mem:%d", atomic.AddUint64(&memAddrs, 1)))
+	client := &memConn{rx: a, tx: b, local: local, remote: l.addr}
+	server := &memConn{rx: b, tx: a, local: l.addr, remote: local}
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, errMemRefused
+	}
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, smux.ErrConnClosed
+	}
+}
+
+func (l *memListener) Close() error {
+	l.once.Do(func() {
+		memMu.Lock()
+		delete(memListeners, l.addr.String())
+		memMu.Unlock()
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+	return l.addr
+}
+
+// memBuffer is one direction of a memConn, written by one end and read by
+// the other.
+type memBuffer struct {
+	mu      sync.Mutex
+	changed chan struct{} // closed and replaced on every change
+
+	data          []byte
+	readClosed    bool      // the reading end closed, writes fail
+	writeClosed   bool      // the writing end closed, data is followed by EOF
+	readDeadline  time.Time // of the reading end
+	writeDeadline time.Time // of the writing end
+}
+
+func newMemBuffer() *memBuffer {
+	return &memBuffer{changed: make(chan struct{})}
+}
+
+// broadcast wakes the reads and writes waiting on b. It must be called
+// with b.mu held.
+func (b *memBuffer) broadcast() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// wait waits for b to change or for deadline to pass, and returns
+// smux.ErrTimeout if it already has. It must be called with b.mu held.
+func (b *memBuffer) wait(deadline time.Time) error {
+	ch := b.changed
+	if deadline.IsZero() {
+		b.mu.Unlock()
+		<-ch
+		b.mu.Lock()
+		return nil
+	}
+	d := time.Until(deadline)
+	if d <= 0 {
+		return smux.ErrTimeout
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	b.mu.Unlock()
+	select {
+	case <-ch:
+	case <-t.C:
+	}
+	b.mu.Lock()
+	return nil
+}
+
+func (b *memBuffer) read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for {
+		switch {
+		case b.readClosed:
+			return 0, errMemClosed
+		case len(b.data) > 0:
+			n := copy(p, b.data)
+			b.data = b.data[n:]
+			b.broadcast()
+			return n, nil
+		case b.writeClosed:
+			return 0, io.EOF
+		case len(p) == 0:
+			return 0, nil
+		}
+		if err := b.wait(b.readDeadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (b *memBuffer) write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := 0
+	for {
+		switch {
+		case b.writeClosed:
+			return n, errMemClosed
+		case b.readClosed:
+			return n, io.ErrClosedPipe
+		case n == len(p):
+			return n, nil
+		}
+		if space := memPipeSize - len(b.data); space > 0 {
+			if space > len(p)-n {
+				space = len(p) - n
+			}
+			b.data = append(b.data, p[n:n+space]...)
+			n += space
+			b.broadcast()
+			continue
+		}
+		if err := b.wait(b.writeDeadline); err != nil {
+			return n, err
+		}
+	}
+}
+
+// update runs f to change b, and wakes the reads and writes waiting on it.
+func (b *memBuffer) update(f func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f()
+	b.broadcast()
+}
+
+// memConn is an end of a MemNetwork connection.
+type memConn struct {
+	rx, tx        *memBuffer
+	local, remote memAddr
+}
+
+func (c *memConn) Read(p []byte) (int, error)  { return c.rx.read(p) }
+func (c *memConn) Write(p []byte) (int, error) { return c.tx.write(p) }
+
+// Close fails the reads and writes of c, and makes the reads of the other
+// end return io.EOF once they read everything written before.
+func (c *memConn) Close() error {
+	c.rx.update(func() {
+		c.rx.readClosed = true
+		c.rx.data = nil
+	})
+	c.tx.update(func() { c.tx.writeClosed = true })
+	return nil
+}
+
+func (c *memConn) LocalAddr() net.Addr  { return c.local }
+func (c *memConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *memConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *memConn) SetReadDeadline(t time.Time) error {
+	c.rx.update(func() { c.rx.readDeadline = t })
+	return nil
+}
+
+func (c *memConn) SetWriteDeadline(t time.Time) error {
+	c.tx.update(func() { c.tx.writeDeadline = t })
+	return nil
+}
@@ -0,0 +1,113 @@
+package sm_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"testing"
+	"time"
+
+	smux "github.com/dms3-p2p/go-stream-muxer"
+)
+
+// SubtestNodeInterop runs script, a reference implementation of the muxer
+// of tr in JavaScript, under node, and checks that the two interoperate.
+// tr is the listening side and the script dials it, invoked as
+//
+//	node script host:port
+//
+// The script must open a stream on which it sends "hello from node" and
+// closes, echo every stream tr opens until it is closed, and exit once the
+// connection closes. The subtest is skipped when node is not installed.
+func SubtestNodeInterop(t testing.TB, tr smux.Transport, script string) {
+	node, err := exec.LookPath("node")
+	if err != nil {
+		t.Skip("node not found")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	checkErr(t, err)
+	defer l.Close()
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(node, script, l.Addr().String())
+	cmd.Stderr = &stderr
+	checkErr(t, cmd.Start())
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	defer func() {
+		select {
+		case <-exited:
+		case <-time.After(scaleTimeout(5 * time.Second)):
+			cmd.Process.Kill()
+			<-exited
+			t.Error("node did not exit after the connection closed")
+		}
+		if stderr.Len() > 0 {
+			log("node: %s", stderr.String())
+		}
+	}()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- c
+	}()
+	var c net.Conn
+	select {
+	case c = <-accepted:
+	case <-time.After(scaleTimeout(10 * time.Second)):
+		cmd.Process.Kill()
+		t.Fatal("node did not connect")
+	}
+	if c == nil {
+		t.Fatal("accept failed")
+	}
+
+	mc, err := tr.NewConn(c, true)
+	checkErr(t, err)
+	defer mc.Close()
+
+	greeting, err := mc.AcceptStream()
+	checkErr(t, err)
+	greeting.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+	b, err := ioutil.ReadAll(greeting)
+	checkErr(t, err)
+	if string(b) != "hello from node" {
+		t.Fatalf("greeting: got %q", b)
+	}
+	greeting.Close()
+
+	for _, size := range []int{0, 1, 1 << 10, 1 << 19} {
+		run(t, fmt.Sprint(size), func(t testing.TB) {
+			s, err := mc.OpenStream()
+			checkErr(t, err)
+			s.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+
+			var msg []byte
+			if size > 0 {
+				msg = randBuf(size)
+			}
+			werr := make(chan error, 1)
+			go func() {
+				_, err := s.Write(msg)
+				if err == nil {
+					err = s.Close()
+				}
+				werr <- err
+			}()
+			echo, err := ioutil.ReadAll(s)
+			checkErr(t, err)
+			checkErr(t, <-werr)
+			if !bytes.Equal(echo, msg) {
+				t.Fatalf("echo of %d bytes: got %d bytes, or different ones", size, len(echo))
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+package sm_test
+
+import (
+	"bytes"
+	"os/exec"
+	"testing"
+
+	smux "github.com/dms3-p2p/go-stream-muxer"
+	"github.com/dms3-p2p/go-stream-muxer/conformance"
+)
+
+// SubtestExecConformance runs the conformance checks with tr against a
+// responder process started as name with args, over its stdin and stdout,
+// as in conformance.ExecDrive. The subtest is skipped when name is not
+// found.
+func SubtestExecConformance(t testing.TB, tr smux.Transport, name string, args ...string) {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		t.Skipf("%s not found", name)
+	}
+
+	var out, stderr bytes.Buffer
+	cmd := exec.Command(path, args...)
+	cmd.Stderr = &stderr
+	err = conformance.ExecDrive(tr, cmd, &out)
+	log("%s", out.String())
+	if err != nil {
+		t.Fatalf("%s\n%s%s", err, out.String(), stderr.String())
+	}
+}
@@ -0,0 +1,8 @@
+//go:build race
+// +build race
+
+package sm_test
+
+// raceEnabled reports whether the race detector is enabled. Its runtime
+// is limited to 8128 live goroutines and makes everything a lot slower.
+const raceEnabled = true
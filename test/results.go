@@ -0,0 +1,265 @@
+package sm_test
+
+import (
+	"flag"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	smux "github.com/dms3-p2p/go-stream-muxer"
+	"github.com/dms3-p2p/go-stream-muxer/results"
+)
+
+var resultsFile = flag.String("smux.json", "", "write the results of the subtests and benchmarks run, with their metrics, as JSON to this file")
+
+var (
+	resultsMu sync.Mutex
+	// the results of the run, by the full name of their test or benchmark,
+	// which is rerun with a larger b.N until it runs long enough.
+	resultsByTest = make(map[string]*results.Result)
+	resultsOrder  []string
+)
+
+// resultLocked returns the result of the test or benchmark named name,
+// adding it. It must be called with resultsMu held.
+func resultLocked(name string) *results.Result {
+	res, ok := resultsByTest[name]
+	if !ok {
+		res = &results.Result{Name: name, Metrics: make(map[string]float64)}
+		resultsByTest[name] = res
+		resultsOrder = append(resultsOrder, name)
+	}
+	return res
+}
+
+// writeResults writes the results so far to the -smux.json file, if set.
+// It rewrites the whole file every time, as benchmarks have no hook to
+// write it once they have all run.
+func writeResults(t testing.TB) {
+	if *resultsFile == "" {
+		return
+	}
+	resultsMu.Lock()
+	rs := make([]results.Result, len(resultsOrder))
+	for i, name := range resultsOrder {
+		rs[i] = *resultsByTest[name]
+	}
+	resultsMu.Unlock()
+	if err := results.WriteFile(*resultsFile, rs); err != nil {
+		t.Error(err)
+	}
+}
+
+// reportMetric reports a metric of t in its -smux.json result, and with
+// ReportMetric if t is a benchmark.
+func reportMetric(t testing.TB, v float64, unit string) {
+	if l, ok := t.(*failureLog); ok {
+		t = l.TB
+	}
+	if b, ok := t.(*testing.B); ok {
+		b.ReportMetric(v, unit)
+	}
+	resultsMu.Lock()
+	_, known := resultsByTest[t.Name()]
+	resultLocked(t.Name()).Metrics[unit] = v
+	resultsMu.Unlock()
+	writeResults(t)
+
+	if !known {
+		// tests run by measureSubtest or measureBench get their status
+		// from those, others once they finish.
+		t.Cleanup(func() {
+			resultsMu.Lock()
+			if r := resultLocked(t.Name()); r.Status == "" {
+				r.Status = subtestStatus(t)
+			}
+			resultsMu.Unlock()
+			writeResults(t)
+		})
+	}
+}
+
+// labelResult records the -smux.json result of t as that of the test
+// name run against the transport named transport, so that a table of the
+// results of several transports has them on the same row.
+func labelResult(t testing.TB, transport, name string) {
+	resultsMu.Lock()
+	r := resultLocked(t.Name())
+	r.Transport = transport
+	r.Name = name
+	resultsMu.Unlock()
+	writeResults(t)
+}
+
+// sampler measures the allocations and the peak number of goroutines of
+// the process while it runs.
+type sampler struct {
+	before runtime.MemStats
+	base   int
+	done   chan struct{}
+	peak   chan int
+}
+
+func startSampler() *sampler {
+	s := &sampler{done: make(chan struct{}), peak: make(chan int)}
+	s.base = runtime.NumGoroutine()
+	runtime.ReadMemStats(&s.before)
+	go func() {
+		max := 0
+		t := time.NewTicker(memStatsInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				// the sampler itself is not counted.
+				if n := runtime.NumGoroutine() - s.base - 1; n > max {
+					max = n
+				}
+			case <-s.done:
+				s.peak <- max
+				return
+			}
+		}
+	}()
+	return s
+}
+
+// stop returns the allocations and the peak number of goroutines above
+// those running when s started.
+func (s *sampler) stop() (allocs uint64, goroutines int) {
+	close(s.done)
+	goroutines = <-s.peak
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+	return after.Mallocs - s.before.Mallocs, goroutines
+}
+
+// failureLog is the testing.TB measureSubtest passes its subtests, keeping
+// the messages they fail with, and those of the subtests they run, in
+// failures.
+type failureLog struct {
+	testing.TB
+	failures *failures
+}
+
+type failures struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (f *failures) add(msg string) {
+	f.mu.Lock()
+	f.msgs = append(f.msgs, strings.TrimSuffix(msg, "\n"))
+	f.mu.Unlock()
+}
+
+func (f *failures) String() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return strings.Join(f.msgs, "\n")
+}
+
+func (l *failureLog) Error(args ...interface{}) {
+	l.Helper()
+	l.failures.add(fmt.Sprintln(args...))
+	l.TB.Error(args...)
+}
+
+func (l *failureLog) Errorf(format string, args ...interface{}) {
+	l.Helper()
+	l.failures.add(fmt.Sprintf(format, args...))
+	l.TB.Errorf(format, args...)
+}
+
+func (l *failureLog) Fatal(args ...interface{}) {
+	l.Helper()
+	l.failures.add(fmt.Sprintln(args...))
+	l.TB.Fatal(args...)
+}
+
+func (l *failureLog) Fatalf(format string, args ...interface{}) {
+	l.Helper()
+	l.failures.add(fmt.Sprintf(format, args...))
+	l.TB.Fatalf(format, args...)
+}
+
+// measureSubtest runs f as the subtest name of t, against tr, named
+// transport, and records its status, what it failed with, duration,
+// allocations and peak goroutines, and the features tr declares, for
+// -smux.json, which it returns.
+func measureSubtest(t testing.TB, transport string, tr smux.Transport, name string, f func(t testing.TB)) results.Result {
+	var network string
+	if activeNetwork != nil {
+		network = activeNetwork.Name
+	}
+	var features string
+	if has, ok := declaredFeatures(tr); ok {
+		features = has.String()
+	}
+	var res results.Result
+	run(t, name, func(t testing.TB) {
+		l := &failureLog{TB: t, failures: new(failures)}
+		s := startSampler()
+		start := time.Now()
+		defer func() {
+			elapsed := time.Since(start)
+			allocs, goroutines := s.stop()
+			resultsMu.Lock()
+			r := resultLocked(t.Name())
+			r.Transport = transport
+			r.Network = network
+			r.Features = features
+			r.Name = name
+			r.Status = subtestStatus(t)
+			if r.Status == results.Fail {
+				r.Error = l.failures.String()
+			}
+			r.Duration = elapsed
+			r.Metrics[results.Allocs] = float64(allocs)
+			r.Metrics[results.Goroutines] = float64(goroutines)
+			res = *r
+			resultsMu.Unlock()
+		}()
+		f(l)
+	})
+	writeResults(t)
+	return res
+}
+
+// measureBench sets up b to report the throughput of bytesPerOp bytes per
+// op, if not 0, and allocations, starts its profiles and resets its
+// timer. The function returned stops the timer and the profiles, and
+// records the ns/op, MB/s, allocs/op and peak goroutines of b for
+// -smux.json.
+func measureBench(b *testing.B, bytesPerOp int64) (stop func()) {
+	if bytesPerOp > 0 {
+		b.SetBytes(bytesPerOp)
+	}
+	b.ReportAllocs()
+	stopProfile := profileBench(b)
+	s := startSampler()
+	b.ResetTimer()
+	start := time.Now()
+	return func() {
+		b.StopTimer()
+		elapsed := time.Since(start)
+		allocs, goroutines := s.stop()
+		stopProfile()
+
+		resultsMu.Lock()
+		r := resultLocked(b.Name())
+		r.Status = subtestStatus(b)
+		r.Duration = elapsed
+		r.Metrics[results.NsPerOp] = float64(elapsed.Nanoseconds()) / float64(b.N)
+		if bytesPerOp > 0 {
+			r.Metrics[results.MBPerSec] = float64(bytesPerOp) * float64(b.N) / elapsed.Seconds() / 1e6
+		}
+		r.Metrics[results.AllocsPerOp] = float64(allocs) / float64(b.N)
+		r.Metrics[results.Goroutines] = float64(goroutines)
+		resultsMu.Unlock()
+		writeResults(b)
+	}
+}
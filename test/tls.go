@@ -0,0 +1,97 @@
+package sm_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+// TLSNetwork connects over TCP on the loopback interface with TLS, as
+// deployed muxers mostly run, whose record sized reads and writes change
+// how the muxer's data is split. The certificate is self-signed, made up
+// for the process.
+var TLSNetwork = Network{
+	Name:   "tls",
+	Listen: listenTLS,
+	Dial:   dialTLS,
+}
+
+var (
+	tlsOnce   sync.Once
+	tlsServer *tls.Config
+	tlsClient *tls.Config
+	tlsErr    error
+)
+
+// tlsConfigs returns the server and client configurations of TLSNetwork,
+// generating its certificate the first time.
+func tlsConfigs() (server, client *tls.Config, err error) {
+	tlsOnce.Do(func() {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+		if err != nil {
+			tlsErr = err
+			return
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: "smux test"},
+			DNSNames:     []string{"localhost"},
+			IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(24 * time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		der, err := x509.CreateCertificate(crand.Reader, tmpl, tmpl, &key.PublicKey, key)
+		if err != nil {
+			tlsErr = err
+			return
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			tlsErr = err
+			return
+		}
+		roots := x509.NewCertPool()
+		roots.AddCert(cert)
+		tlsServer = &tls.Config{
+			Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		}
+		tlsClient = &tls.Config{RootCAs: roots, ServerName: "localhost"}
+	})
+	return tlsServer, tlsClient, tlsErr
+}
+
+func listenTLS() (net.Listener, error) {
+	server, _, err := tlsConfigs()
+	if err != nil {
+		return nil, err
+	}
+	l, err := TCPNetwork.Listen()
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(l, server), nil
+}
+
+// dialTLS returns a TLS client connection over a new TCP connection to
+// addr. The handshake happens with the first read or write, so that it
+// does not wait for the listener to read.
+func dialTLS(addr net.Addr) (net.Conn, error) {
+	_, client, err := tlsConfigs()
+	if err != nil {
+		return nil, err
+	}
+	c, err := TCPNetwork.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	return tls.Client(c, client), nil
+}
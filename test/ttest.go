@@ -1,34 +1,80 @@
 package sm_test
 
 import (
+	"bufio"
 	"bytes"
-	crand "crypto/rand"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"flag"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
+	"math"
 	mrand "math/rand"
 	"net"
+	"net/http"
 	"os"
 	"reflect"
 	"runtime"
 	"runtime/debug"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	smux "github.com/dms3-p2p/go-stream-muxer"
+	"github.com/dms3-p2p/go-stream-muxer/internal/testhooks"
+	"github.com/dms3-p2p/go-stream-muxer/testnet"
 )
 
-var randomness []byte
+var seedFlag = flag.Int64("smux.seed", 0, "seed of the random data and message sizes of the tests (default a new one every run, which SubtestStress logs)")
 
-func init() {
-	// read 1MB of randomness
-	randomness = make([]byte, 1<<20)
-	if _, err := crand.Read(randomness); err != nil {
-		panic(err)
-	}
+var (
+	seedOnce   sync.Once
+	randSeed   int64
+	randomness []byte
+)
+
+// testSeed returns the seed of the randomness of the tests: -smux.seed, or
+// one taken from the clock if it is not set. The first call seeds
+// math/rand and fills 1MB of random data from it, so it must come after
+// the flags are parsed.
+func testSeed() int64 {
+	seedOnce.Do(func() {
+		randSeed = *seedFlag
+		if randSeed == 0 {
+			randSeed = time.Now().UnixNano()
+		}
+		mrand.Seed(randSeed)
+		randomness = make([]byte, 1<<20)
+		mrand.New(mrand.NewSource(randSeed)).Read(randomness)
+	})
+	return randSeed
+}
+
+// randomBytes returns the 1MB of random data derived from the seed.
+func randomBytes() []byte {
+	testSeed()
+	return randomness
 }
 
+// Options are the profile of a SubtestStress run. Custom profiles start
+// from one of the presets, such as Stress1Conn100Stream100Msg, changed by
+// the With methods:
+//
+//	opt := Stress1Conn100Stream100Msg.WithStreams(1000).
+//		WithMessageSizes(1, 64<<10).WithSizes(LogUniformSizes)
+//	SubtestStress(t, opt.WithTransport(tr))
+//
+// Counts are scaled by -smux.scale and under -race, durations are not.
 type Options struct {
 	tr        smux.Transport
 	connNum   int
@@ -36,19 +82,332 @@ type Options struct {
 	msgNum    int
 	msgMin    int
 	msgMax    int
+	network   Network
+	maxErrors int // reported one by one; 0 is stressMaxErrors, < 0 all
+	failFast  bool
+
+	sizes       SizeDistribution // nil is UniformSizes
+	duration    time.Duration    // of every stream, rather than msgNum
+	concurrency int              // streams at once; 0 is goroutines
+	goroutines  int              // stress workers at once; 0 is stressGoroutines
+	duplex      bool             // the listener opens streamNum streams too
+
+	listen func() (net.Listener, error)     // nil is the Listen of network
+	dial   func(net.Addr) (net.Conn, error) // nil is the Dial of network
+}
+
+// WithTransport returns a copy of the options that runs against tr.
+func (o Options) WithTransport(tr smux.Transport) Options {
+	o.tr = tr
+	return o
+}
+
+// WithMaxErrors returns a copy of the options that reports at most n
+// errors one by one, and only counts the others, or reports them all if n
+// is negative.
+func (o Options) WithMaxErrors(n int) Options {
+	o.maxErrors = n
+	return o
+}
+
+// WithFailFast returns a copy of the options that stops all the streams
+// and connections at the first error, rather than letting them finish.
+func (o Options) WithFailFast() Options {
+	o.failFast = true
+	return o
+}
+
+// WithConns returns a copy of the options that runs n connections.
+func (o Options) WithConns(n int) Options {
+	o.connNum = n
+	return o
+}
+
+// WithStreams returns a copy of the options that runs n streams on each
+// connection.
+func (o Options) WithStreams(n int) Options {
+	o.streamNum = n
+	return o
+}
+
+// WithMessages returns a copy of the options that echoes n messages on
+// each stream, besides a few of boundary sizes.
+func (o Options) WithMessages(n int) Options {
+	o.msgNum = n
+	return o
+}
+
+// WithMessageSizes returns a copy of the options whose messages are
+// between min and max bytes, at most 1MB.
+func (o Options) WithMessageSizes(min, max int) Options {
+	o.msgMin, o.msgMax = min, max
+	return o
+}
+
+// WithSizes returns a copy of the options drawing the sizes of its
+// messages from d.
+func (o Options) WithSizes(d SizeDistribution) Options {
+	o.sizes = d
+	return o
+}
+
+// WithDuration returns a copy of the options whose streams keep echoing
+// messages for d, rather than a number of them.
+func (o Options) WithDuration(d time.Duration) Options {
+	o.duration = d
+	return o
+}
+
+// WithConcurrency returns a copy of the options that reads and writes on
+// at most n streams at once, of all the connections, and opens the others
+// as those finish.
+func (o Options) WithConcurrency(n int) Options {
+	o.concurrency = n
+	return o
+}
+
+// WithGoroutines returns a copy of the options that runs at most n stress
+// workers at once, reading and writing streams, rather than a bound
+// derived from GOMAXPROCS. It also bounds the connections at once, to one
+// per stressGoroutinesPerConn workers. Under -race, n is at most 1000.
+func (o Options) WithGoroutines(n int) Options {
+	o.goroutines = n
+	return o
+}
+
+// WithDuplex returns a copy of the options whose listening side opens as
+// many streams toward the dialing side as the dialing side opens toward
+// it, at the same time, each echoed by the other side.
+func (o Options) WithDuplex() Options {
+	o.duplex = true
+	return o
+}
+
+// SizeDistribution draws the size of a message from r, between min and
+// max bytes.
+type SizeDistribution func(r *mrand.Rand, min, max int) int
+
+// UniformSizes draws sizes with the same probability between min and max.
+func UniformSizes(r *mrand.Rand, min, max int) int {
+	return min + r.Intn(max-min+1)
+}
+
+// LogUniformSizes draws sizes uniformly on a logarithmic scale, so that as
+// many are under 100 bytes as between 100 and 10000, like the small
+// messages of most protocols, among few large transfers.
+func LogUniformSizes(r *mrand.Rand, min, max int) int {
+	lo, hi := math.Log(float64(min+1)), math.Log(float64(max+1))
+	size := int(math.Exp(lo+r.Float64()*(hi-lo))) - 1
+	switch {
+	case size < min:
+		return min
+	case size > max:
+		return max
+	}
+	return size
+}
+
+// drawSize draws the size of a message from r.
+func (o Options) drawSize(r *mrand.Rand) int {
+	if o.sizes != nil {
+		return o.sizes(r, o.msgMin, o.msgMax)
+	}
+	return UniformSizes(r, o.msgMin, o.msgMax)
+}
+
+// stressMaxErrors is the number of errors SubtestStress reports one by one
+// by default, past which a corrupted stream would bury the first ones.
+const stressMaxErrors = 20
+
+// stressError is an error of SubtestStress, of a kind errors are counted
+// by in its summary.
+type stressError struct {
+	kind string
+	err  error
+}
+
+const (
+	// stressGoroutinesPerProc is the number of concurrent stress workers
+	// per GOMAXPROCS, so that small CI machines are not swamped and big
+	// ones still load the muxer's scheduler.
+	stressGoroutinesPerProc = 512
+	// maxRaceStressGoroutines bounds them under -race, leaving room
+	// below its 8128 goroutine limit for the ones the muxer spawns.
+	maxRaceStressGoroutines = 1000
+	// stressGoroutinesPerConn is the number of stress workers each
+	// connection set up at once counts for. Each holds a listener and
+	// both ends of a connection open, so bounding them keeps profiles of
+	// many connections within low file descriptor limits.
+	stressGoroutinesPerConn = 32
+	// raceSlowdown scales timeouts and divides message counts under
+	// -race.
+	raceSlowdown = 10
+)
+
+// stressGoroutines returns the maximum number of concurrent stress
+// workers.
+func stressGoroutines() int {
+	return limitStressGoroutines(runtime.GOMAXPROCS(0) * stressGoroutinesPerProc)
+}
+
+// limitStressGoroutines bounds n concurrent stress workers under -race.
+func limitStressGoroutines(n int) int {
+	if raceEnabled && n > maxRaceStressGoroutines {
+		return maxRaceStressGoroutines
+	}
+	return n
+}
+
+// scaleTimeout scales a watchdog timeout for the race detector's
+// slowdown.
+func scaleTimeout(d time.Duration) time.Duration {
+	if raceEnabled {
+		return d * raceSlowdown
+	}
+	return d
+}
+
+// The defaults of -smux.long and -smux.scale come from SMUX_LONG and
+// SMUX_SCALE, so that CI runs, such as nightly soaks, can scale up the
+// suites of downstream muxers without changing how those run their tests.
+var longTests = flag.Bool("smux.long", os.Getenv("SMUX_LONG") != "", "run the long tests, such as SubtestLargeTransfer, which can take minutes (default true if $SMUX_LONG is set)")
+
+var stressScale = flag.String("smux.scale", os.Getenv("SMUX_SCALE"), "stress test scale: quick, normal, heavy or a multiplier, such as 0.5 or 10 (default $SMUX_SCALE, or normal, or quick with -short)")
+
+// stressScales are the count multipliers of the -smux.scale settings.
+var stressScales = map[string]float64{
+	"quick":  0.1,
+	"normal": 1,
+	"heavy":  3,
+}
+
+// scaleFactor returns the multiplier of the stress test scale.
+func scaleFactor(t testing.TB) float64 {
+	scale := *stressScale
+	if scale == "" {
+		scale = "normal"
+		if testing.Short() {
+			scale = "quick"
+		}
+	}
+	f, ok := stressScales[scale]
+	if !ok {
+		var err error
+		f, err = strconv.ParseFloat(scale, 64)
+		if err != nil || !(f > 0) || math.IsInf(f, 0) {
+			t.Fatalf("unknown -smux.scale %q", scale)
+		}
+	}
+	return f
+}
+
+// scaleSize multiplies a connection or stream count by the stress test
+// scale, keeping it at least 1.
+func scaleSize(t testing.TB, n int) int {
+	n = int(float64(n) * scaleFactor(t))
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// scaleCount scales an iteration count by the stress test scale and
+// reduces it under -race, keeping it at least 1.
+func scaleCount(t testing.TB, n int) int {
+	n = scaleSize(t, n)
+	if raceEnabled {
+		n /= raceSlowdown
+		if n < 1 {
+			n = 1
+		}
+	}
+	return n
 }
 
 func randBuf(size int) []byte {
-	n := len(randomness) - size
-	if size < 1 {
-		panic(fmt.Errorf("requested too large buffer (%d). max is %d", size, len(randomness)))
+	return randBufFrom(nil, size)
+}
+
+// randBufFrom returns size bytes of the random data at an offset drawn from
+// r, or from math/rand if r is nil. Goroutines drawing from their own r
+// get the same buffers for a seed however they are scheduled.
+func randBufFrom(r *mrand.Rand, size int) []byte {
+	random := randomBytes()
+	n := len(random) - size
+	if size < 0 || n < 0 {
+		panic(fmt.Errorf("requested too large buffer (%d). max is %d", size, len(random)))
+	}
+
+	var start int
+	if r != nil {
+		start = r.Intn(n + 1)
+	} else {
+		start = mrand.Intn(n + 1)
+	}
+	return random[start : start+size]
+}
+
+// stressBoundarySizes are message sizes SubtestStress writes once on every
+// stream, besides the ones it draws between msgMin and msgMax: empty and
+// single byte writes, and writes one byte over the 16KB frames many
+// muxers split data into.
+var stressBoundarySizes = []int{0, 1, 16<<10 + 1}
+
+// stressMessageSizes returns the sizes of the messages SubtestStress
+// writes on a stream: opt.msgNum drawn from r between opt.msgMin and
+// opt.msgMax, and stressBoundarySizes at random positions among them.
+func stressMessageSizes(opt Options, r *mrand.Rand) []int {
+	sizes := make([]int, opt.msgNum, opt.msgNum+len(stressBoundarySizes))
+	for i := range sizes {
+		sizes[i] = opt.drawSize(r)
 	}
+	for _, size := range stressBoundarySizes {
+		i := r.Intn(len(sizes) + 1)
+		sizes = append(sizes, 0)
+		copy(sizes[i+1:], sizes[i:])
+		sizes[i] = size
+	}
+	return sizes
+}
+
+// stressMessages are the messages SubtestStress writes on a stream, drawn
+// from r: those of stressMessageSizes, followed by more drawn one at a
+// time in runs with a duration.
+type stressMessages struct {
+	opt   Options
+	r     *mrand.Rand
+	sizes []int
+}
+
+func newStressMessages(opt Options, r *mrand.Rand) *stressMessages {
+	return &stressMessages{opt: opt, r: r, sizes: stressMessageSizes(opt, r)}
+}
+
+// next returns the next message, or false after those of
+// stressMessageSizes in runs without a duration.
+func (m *stressMessages) next() ([]byte, bool) {
+	var size int
+	switch {
+	case len(m.sizes) > 0:
+		size, m.sizes = m.sizes[0], m.sizes[1:]
+	case m.opt.duration > 0:
+		size = m.opt.drawSize(m.r)
+	default:
+		return nil, false
+	}
+	return randBufFrom(m.r, size), true
+}
 
-	start := mrand.Intn(n)
-	return randomness[start : start+size]
+// msgPrefix returns the first bytes of a message, which identify it in
+// logs.
+func msgPrefix(buf []byte) []byte {
+	if len(buf) > 3 {
+		return buf[:3]
+	}
+	return buf
 }
 
-func checkErr(t *testing.T, err error) {
+func checkErr(t testing.TB, err error) {
 	if err != nil {
 		debug.PrintStack()
 		t.Fatal(err)
@@ -79,52 +438,138 @@ func (lw *LogWriter) Write(buf []byte) (int, error) {
 	return lw.W.Write(buf)
 }
 
-func GoServe(t *testing.T, tr smux.Transport, l net.Listener) (done func()) {
-	closed := make(chan struct{}, 1)
+// GoServe echoes the streams of the connections accepted on l, until done
+// is called, which closes l.
+func GoServe(t testing.TB, tr smux.Transport, l net.Listener) (done func()) {
+	return GoServeHandler(t, tr, l, echoStream)
+}
+
+// GoServeHandler serves the streams of the connections accepted on l with
+// h, such as smux.DiscardHandler or smux.RandomLatencyEchoHandler, until
+// done is called, which closes l and the connections, and waits for their
+// handlers to return.
+func GoServeHandler(t testing.TB, tr smux.Transport, l net.Listener, h smux.StreamHandler) (done func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
 
+	wg.Add(1)
 	go func() {
+		defer wg.Done()
 		for {
 			c1, err := l.Accept()
 			if err != nil {
-				select {
-				case <-closed:
-					return // closed naturally.
-				default:
-					checkErr(t, err)
+				if ctx.Err() == nil {
+					t.Error(err)
 				}
+				return // closed naturally once done.
 			}
 
 			log("accepted connection")
-			sc1, err := tr.NewConn(c1, true)
-			checkErr(t, err)
+			c, err := tr.NewConn(watch(c1), true)
+			if err != nil {
+				t.Error(err)
+				c1.Close()
+				continue
+			}
+			wg.Add(1)
 			go func() {
-				for {
-					str, err := sc1.AcceptStream()
-					if err != nil {
-						break
-					}
-					go echoStream(str)
-				}
+				defer wg.Done()
+				smux.ServeContext(ctx, c, h)
 			}()
 		}
 	}()
 
 	return func() {
-		closed <- struct{}{}
+		cancel()
+		l.Close()
+		waitServers(t, &wg)
+	}
+}
+
+// serveConn serves the streams the peer of c opens with h, until stop is
+// called, which closes c and waits for the handlers to return.
+func serveConn(t testing.TB, c smux.Conn, h smux.StreamHandler) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		smux.ServeContext(ctx, c, h)
+	}()
+	return func() {
+		cancel()
+		waitServers(t, &wg)
+	}
+}
+
+// muxPair muxes the ends of a connection of connPipe with tr, as with
+// muxConns.
+func muxPair(t testing.TB, tr smux.Transport, h smux.StreamHandler) (muxa, muxb smux.Conn, done func()) {
+	a, b := connPipe(t)
+	return muxConns(t, tr, a, b, h)
+}
+
+// muxConns muxes a with tr as the client and b as the server, which serves
+// the streams the client opens with h unless h is nil, until done is
+// called, which stops the server and closes muxa, muxb, a and b.
+func muxConns(t testing.TB, tr smux.Transport, a, b net.Conn, h smux.StreamHandler) (muxa, muxb smux.Conn, done func()) {
+	muxb, err := tr.NewConn(b, true)
+	if err != nil {
+		a.Close()
+		b.Close()
+		t.Fatal(err)
+	}
+	stop := func() {}
+	if h != nil {
+		stop = serveConn(t, muxb, h)
+	}
+	muxa, err = tr.NewConn(a, false)
+	if err != nil {
+		stop()
+		muxb.Close()
+		a.Close()
+		b.Close()
+		t.Fatal(err)
+	}
+	return muxa, muxb, func() {
+		stop()
+		muxa.Close()
+		muxb.Close()
+		a.Close()
+		b.Close()
+	}
+}
+
+// waitServers waits for the servers counted by wg to return after they
+// were stopped, failing t if they do not, as their handlers are stuck.
+func waitServers(t testing.TB, wg *sync.WaitGroup) {
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(scaleTimeout(10 * time.Second)):
+		t.Errorf("servers did not return 10s after they were stopped; goroutines:\n\n%s", allStacks())
 	}
 }
 
-func SubtestSimpleWrite(t *testing.T, tr smux.Transport) {
-	l, err := net.Listen("tcp", "localhost:0")
+func SubtestSimpleWrite(t testing.TB, tr smux.Transport) {
+	simpleWrite(t, tr, testNetwork(t))
+}
+
+func simpleWrite(t testing.TB, tr smux.Transport, n Network) {
+	l, err := n.Listen()
 	checkErr(t, err)
 	log("listening at %s", l.Addr().String())
 	done := GoServe(t, tr, l)
 	defer done()
 
 	log("dialing to %s", l.Addr().String())
-	nc1, err := net.Dial("tcp", l.Addr().String())
+	nc1, err := n.Dial(l.Addr())
 	checkErr(t, err)
-	defer nc1.Close()
+	defer watch(nc1).Close()
 
 	log("wrapping conn")
 	c1, err := tr.NewConn(nc1, false)
@@ -139,6 +584,7 @@ func SubtestSimpleWrite(t *testing.T, tr smux.Transport) {
 	s1, err := c1.OpenStream()
 	checkErr(t, err)
 	defer s1.Close()
+	s1.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
 
 	buf1 := randBuf(4096)
 	log("writing %d bytes to stream", len(buf1))
@@ -147,7 +593,7 @@ func SubtestSimpleWrite(t *testing.T, tr smux.Transport) {
 
 	buf2 := make([]byte, len(buf1))
 	log("reading %d bytes from stream (echoed)", len(buf2))
-	_, err = s1.Read(buf2)
+	_, err = io.ReadFull(s1, buf2)
 	checkErr(t, err)
 
 	if string(buf2) != string(buf1) {
@@ -156,95 +602,211 @@ func SubtestSimpleWrite(t *testing.T, tr smux.Transport) {
 	log("done")
 }
 
-func SubtestStress(t *testing.T, opt Options) {
-	msgsize := 1 << 11
-	errs := make(chan error, 0) // dont block anything.
+// stressStreamTimeout bounds how long a stream of SubtestStress may take to
+// echo its messages.
+const stressStreamTimeout = time.Minute
 
-	rateLimitN := 5000 // max of 5k funcs, because -race has 8k max.
-	rateLimitChan := make(chan struct{}, rateLimitN)
-	for i := 0; i < rateLimitN; i++ {
-		rateLimitChan <- struct{}{}
+func SubtestStress(t testing.TB, opt Options) {
+	maxsize := opt.msgMax
+	for _, size := range stressBoundarySizes {
+		if size > maxsize {
+			maxsize = size
+		}
+	}
+	errs := make(chan stressError, 0) // dont block anything.
+	fail := func(kind string, err error) {
+		errs <- stressError{kind, err}
+	}
+
+	// with failFast, the first error closes every connection, which makes
+	// the streams fail, and the workers stop.
+	var (
+		connsMu  sync.Mutex
+		conns    []smux.Conn
+		stopped  = make(chan struct{})
+		stopOnce sync.Once
+	)
+	stop := func() {
+		stopOnce.Do(func() {
+			close(stopped)
+			connsMu.Lock()
+			for _, c := range conns {
+				c.Close()
+			}
+			connsMu.Unlock()
+		})
+	}
+	isStopped := func() bool {
+		select {
+		case <-stopped:
+			return true
+		default:
+			return false
+		}
+	}
+
+	opt.connNum = scaleSize(t, opt.connNum)
+	opt.streamNum = scaleSize(t, opt.streamNum)
+	opt.msgNum = scaleCount(t, opt.msgNum)
+	opt.network = optionsNetwork(t, opt)
+
+	// every stream draws its messages from its own source, so a failing
+	// one writes the same messages again with the same seed. Its reader
+	// draws them again from a source of the same seed to check the data
+	// echoed, rather than keeping what was written until it is read back.
+	seed := testSeed()
+	t.Logf("random seed %d, rerun with -smux.seed=%d", seed, seed)
+	// with duplex, the streams of the listener follow those of the dialer.
+	streamsPerConn := opt.streamNum
+	if opt.duplex {
+		streamsPerConn *= 2
 	}
+	streamRand := func(conn, stream int) *mrand.Rand {
+		return mrand.New(mrand.NewSource(seed + int64(conn*streamsPerConn+stream)))
+	}
+
+	stopMemProfile := startMemProfile(t)
+	defer func() { stopMemProfile(opt.connNum * opt.streamNum) }()
 
+	logAllocsPerMessage(t, opt.tr, opt.msgMax)
+	stopMemStats := startMemStats()
+	defer stopMemStats()
+
+	rateLimitN := stressGoroutines()
+	if opt.goroutines > 0 {
+		rateLimitN = limitStressGoroutines(opt.goroutines)
+	}
+	rateLimitChan := make(chan struct{}, rateLimitN)
 	rateLimit := func(f func()) {
+		rateLimitChan <- struct{}{}
+		f()
 		<-rateLimitChan
+	}
+
+	// connLimit bounds the connections set up and running at once, apart
+	// from the streams, so that connections waiting for their streams to
+	// get workers hold none.
+	connLimitN := rateLimitN / stressGoroutinesPerConn
+	if connLimitN < 1 {
+		connLimitN = 1
+	}
+	connLimitChan := make(chan struct{}, connLimitN)
+	connLimit := func(f func()) {
+		connLimitChan <- struct{}{}
 		f()
-		rateLimitChan <- struct{}{}
+		<-connLimitChan
+	}
+
+	// streamLimit bounds the streams of all the connections reading and
+	// writing at once.
+	streamLimit := func(f func()) { f() }
+	if opt.concurrency > 0 {
+		streams := make(chan struct{}, opt.concurrency)
+		streamLimit = func(f func()) {
+			streams <- struct{}{}
+			f()
+			<-streams
+		}
 	}
 
-	writeStream := func(s smux.Stream, bufs chan<- []byte) {
-		log("writeStream %p, %d msgNum", s, opt.msgNum)
+	// writeStream writes the messages drawn from r, and with a duration,
+	// closes the stream for writing once it is over.
+	writeStream := func(s smux.Stream, r *mrand.Rand) {
+		log("writeStream %p, %d messages", s, opt.msgNum)
 
-		for i := 0; i < opt.msgNum; i++ {
-			buf := randBuf(msgsize)
-			bufs <- buf
-			log("%p writing %d bytes (message %d/%d #%x)", s, len(buf), i, opt.msgNum, buf[:3])
+		msgs := newStressMessages(opt, r)
+		end := time.Now().Add(opt.duration)
+		for i := 0; opt.duration == 0 || time.Now().Before(end); i++ {
+			if isStopped() {
+				return
+			}
+			buf, ok := msgs.next()
+			if !ok {
+				return
+			}
+			log("%p writing %d bytes (message %d #%x)", s, len(buf), i, msgPrefix(buf))
 			if _, err := s.Write(buf); err != nil {
-				errs <- fmt.Errorf("s.Write(buf): %s", err)
-				continue
+				fail("write", fmt.Errorf("s.Write(buf): %s", err))
+				return
 			}
 		}
+		if err := smux.CloseWrite(s); err != nil {
+			fail("write", fmt.Errorf("closing the stream for writing: %s", err))
+		}
 	}
 
-	readStream := func(s smux.Stream, bufs <-chan []byte) {
-		log("readStream %p, %d msgNum", s, opt.msgNum)
+	// readStream reads back the messages writeStream writes with a source
+	// of the same seed as r. It returns false if reading failed or was
+	// stopped, leaving messages unread.
+	readStream := func(s smux.Stream, name string, r *mrand.Rand) bool {
+		log("readStream %p, %d messages", s, opt.msgNum)
 
-		buf2 := make([]byte, msgsize)
-		i := 0
-		for buf1 := range bufs {
-			i++
-			log("%p reading %d bytes (message %d/%d #%x)", s, len(buf1), i-1, opt.msgNum, buf1[:3])
+		msgs := newStressMessages(opt, r)
+		buf := make([]byte, maxsize)
+		for i := 0; ; i++ {
+			if isStopped() {
+				return false
+			}
+			buf1, ok := msgs.next()
+			if !ok {
+				return true
+			}
+			log("%p reading %d bytes (message %d #%x)", s, len(buf1), i, msgPrefix(buf1))
 
-			if _, err := io.ReadFull(s, buf2); err != nil {
-				errs <- fmt.Errorf("io.ReadFull(s, buf2): %s", err)
-				log("%p failed to read %d bytes (message %d/%d #%x)", s, len(buf1), i-1, opt.msgNum, buf1[:3])
-				continue
+			buf2 := buf[:len(buf1)]
+			_, err := io.ReadFull(s, buf2)
+			if err == io.EOF && opt.duration > 0 {
+				// the writer closed the stream between two messages.
+				return true
+			}
+			if err != nil {
+				fail("read", fmt.Errorf("%s: io.ReadFull(s, buf2): %s", name, err))
+				log("%p failed to read %d bytes (message %d #%x)", s, len(buf1), i, msgPrefix(buf1))
+				return false
 			}
 			if !bytes.Equal(buf1, buf2) {
-				errs <- fmt.Errorf("buffers not equal (%x != %x)", buf1[:3], buf2[:3])
+				fail("mismatch", fmt.Errorf("%s: message %d: %d byte buffers not equal (%x != %x)", name, i, len(buf1), msgPrefix(buf1), msgPrefix(buf2)))
 			}
 		}
 	}
 
-	openStreamAndRW := func(c smux.Conn) {
+	openStreamAndRW := func(c smux.Conn, conn, stream int) {
 		log("openStreamAndRW %p, %d opt.msgNum", c, opt.msgNum)
 
+		if isStopped() {
+			return
+		}
 		s, err := c.OpenStream()
 		if err != nil {
-			errs <- fmt.Errorf("Failed to create NewStream: %s", err)
+			fail("open", fmt.Errorf("Failed to create NewStream: %s", err))
 			return
 		}
+		// a wedged muxer fails the stream rather than hang the test.
+		s.SetDeadline(time.Now().Add(opt.duration + scaleTimeout(stressStreamTimeout)))
 
-		bufs := make(chan []byte, opt.msgNum)
+		written := make(chan struct{})
 		go func() {
-			writeStream(s, bufs)
-			close(bufs)
+			writeStream(s, streamRand(conn, stream))
+			close(written)
 		}()
 
-		readStream(s, bufs)
+		if !readStream(s, fmt.Sprintf("conn %d stream %d", conn, stream), streamRand(conn, stream)) {
+			// unblock a write waiting for the unread echo to drain.
+			s.Reset()
+		}
+		<-written
 		s.Close()
 	}
 
-	openConnAndRW := func() {
-		log("openConnAndRW")
-
-		l, err := net.Listen("tcp", "localhost:0")
-		checkErr(t, err)
-		done := GoServe(t, opt.tr, l)
-		defer done()
-
-		nla := l.Addr()
-		nc, err := net.Dial(nla.Network(), nla.String())
-		checkErr(t, err)
-		if err != nil {
-			t.Fatal(fmt.Errorf("net.Dial(%s, %s): %s", nla.Network(), nla.String(), err))
-			return
-		}
-
-		c, err := opt.tr.NewConn(nc, false)
-		if err != nil {
-			t.Fatal(fmt.Errorf("a.AddConn(%s <--> %s): %s", nc.LocalAddr(), nc.RemoteAddr(), err))
-			return
+	// serveAndRW echoes the streams the peer of c opens, and opens
+	// opt.streamNum streams of its own, numbered from first, on which it
+	// reads and writes until they are done.
+	serveAndRW := func(c smux.Conn, conn, first int) {
+		connsMu.Lock()
+		conns = append(conns, c)
+		connsMu.Unlock()
+		if isStopped() {
+			c.Close()
 		}
 
 		// serve the outgoing conn, because some muxers assume
@@ -262,14 +824,83 @@ func SubtestStress(t *testing.T, opt Options) {
 
 		var wg sync.WaitGroup
 		for i := 0; i < opt.streamNum; i++ {
+			i := i
 			wg.Add(1)
 			go rateLimit(func() {
 				defer wg.Done()
-				openStreamAndRW(c)
+				streamLimit(func() { openStreamAndRW(c, conn, first+i) })
 			})
 		}
 		wg.Wait()
+	}
+
+	openConnAndRW := func(conn int) {
+		log("openConnAndRW")
+
+		l, err := opt.network.Listen()
+		checkErr(t, err)
+		var accepted chan smux.Conn
+		if opt.duplex {
+			// the listener opens streams too, rather than only echoing.
+			defer l.Close()
+			accepted = make(chan smux.Conn, 1)
+			go func() {
+				defer close(accepted)
+				nc, err := l.Accept()
+				if err != nil {
+					fail("open", fmt.Errorf("l.Accept(): %s", err))
+					return
+				}
+				c, err := opt.tr.NewConn(watch(nc), true)
+				if err != nil {
+					fail("open", fmt.Errorf("a.AddConn(%s <--> %s): %s", nc.LocalAddr(), nc.RemoteAddr(), err))
+					nc.Close()
+					return
+				}
+				accepted <- c
+			}()
+		} else {
+			done := GoServe(t, opt.tr, l)
+			defer done()
+		}
+
+		nla := l.Addr()
+		nc, err := opt.network.Dial(nla)
+		checkErr(t, err)
+		watch(nc)
+		if err != nil {
+			t.Fatal(fmt.Errorf("net.Dial(%s, %s): %s", nla.Network(), nla.String(), err))
+			return
+		}
+
+		c, err := opt.tr.NewConn(nc, false)
+		if err != nil {
+			t.Fatal(fmt.Errorf("a.AddConn(%s <--> %s): %s", nc.LocalAddr(), nc.RemoteAddr(), err))
+			return
+		}
+		if !opt.duplex {
+			serveAndRW(c, conn, 0)
+			c.Close()
+			return
+		}
+
+		sc, ok := <-accepted
+		if !ok {
+			c.Close()
+			return
+		}
+		// both sides open their streams at once, and close the connection
+		// only once the streams of the other side are done too.
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serveAndRW(sc, conn, opt.streamNum)
+		}()
+		serveAndRW(c, conn, 0)
+		wg.Wait()
 		c.Close()
+		sc.Close()
 	}
 
 	openConnsAndRW := func() {
@@ -277,10 +908,11 @@ func SubtestStress(t *testing.T, opt Options) {
 
 		var wg sync.WaitGroup
 		for i := 0; i < opt.connNum; i++ {
+			i := i
 			wg.Add(1)
-			go rateLimit(func() {
+			go connLimit(func() {
 				defer wg.Done()
-				openConnAndRW()
+				openConnAndRW(i)
 			})
 		}
 		wg.Wait()
@@ -291,51 +923,270 @@ func SubtestStress(t *testing.T, opt Options) {
 		close(errs) // done
 	}()
 
-	for err := range errs {
-		t.Error(err)
+	maxErrors := opt.maxErrors
+	if maxErrors == 0 {
+		maxErrors = stressMaxErrors
 	}
-
-}
-
-func tcpPipe(t *testing.T) (net.Conn, net.Conn) {
-	list, err := net.Listen("tcp", "0.0.0.0:0")
-	if err != nil {
-		t.Fatal(err)
+	total, afterStop := 0, 0
+	kinds := make(map[string]int)
+	for e := range errs {
+		if isStopped() {
+			// the errors of closing the connections, not of the muxer.
+			afterStop++
+			continue
+		}
+		total++
+		kinds[e.kind]++
+		if maxErrors < 0 || total <= maxErrors {
+			t.Error(e.err)
+		}
+		if opt.failFast {
+			stop()
+		}
 	}
 
-	con1, err := net.Dial("tcp", list.Addr().String())
-	if err != nil {
-		t.Fatal(err)
+	if total > 1 {
+		var names []string
+		for kind := range kinds {
+			names = append(names, kind)
+		}
+		sort.Strings(names)
+		var counts []string
+		for _, kind := range names {
+			counts = append(counts, fmt.Sprintf("%d %s", kinds[kind], kind))
+		}
+		summary := fmt.Sprintf("%d errors: %s", total, strings.Join(counts, ", "))
+		if maxErrors >= 0 && total > maxErrors {
+			summary += fmt.Sprintf(", of which the first %d are reported", maxErrors)
+		}
+		t.Error(summary)
 	}
-
-	con2, err := list.Accept()
-	if err != nil {
-		t.Fatal(err)
+	if afterStop > 0 {
+		t.Logf("stopped at the first error, ignoring the %d errors which followed", afterStop)
 	}
+}
 
-	return con1, con2
+// pipeTransport establishes the connections of a transport over
+// io.ReadWriteClosers made of io.Pipes, bridged to the net.Conns the
+// tests create, so the muxer sees neither deadlines nor addresses nor
+// half-closes.
+type pipeTransport struct {
+	smux.Transport
 }
 
-func SubtestStreamOpenStress(t *testing.T, tr smux.Transport) {
-	a, b := tcpPipe(t)
-	defer a.Close()
-	defer b.Close()
+func (t pipeTransport) NewConn(c net.Conn, isServer bool) (smux.Conn, error) {
+	return smux.NewConnRWC(t.Transport, newPipeRWC(c), isServer)
+}
 
-	count := 10000
-	go func() {
-		muxa, err := tr.NewConn(a, true)
-		if err != nil {
-			t.Fatal(err)
-		}
-		stress := func() {
-			for i := 0; i < count; i++ {
-				s, err := muxa.OpenStream()
-				if err != nil {
-					panic(err)
-				}
-				s.Close()
-			}
-		}
+type pipeRWC struct {
+	r *io.PipeReader
+	w *io.PipeWriter
+	c net.Conn
+}
+
+func newPipeRWC(c net.Conn) *pipeRWC {
+	rr, rw := io.Pipe()
+	wr, ww := io.Pipe()
+	go func() {
+		_, err := io.Copy(rw, c)
+		rw.CloseWithError(err)
+	}()
+	go func() {
+		_, err := io.Copy(c, wr)
+		wr.CloseWithError(err)
+	}()
+	return &pipeRWC{r: rr, w: ww, c: c}
+}
+
+func (p *pipeRWC) Read(b []byte) (int, error)  { return p.r.Read(b) }
+func (p *pipeRWC) Write(b []byte) (int, error) { return p.w.Write(b) }
+
+func (p *pipeRWC) Close() error {
+	p.r.Close()
+	p.w.Close()
+	return p.c.Close()
+}
+
+// delayConn delays the data written to a net.Conn by a fixed one-way
+// latency, to measure muxers over slower links.
+type delayConn struct {
+	net.Conn
+	delay   time.Duration
+	queue   chan delayedWrite
+	closed  chan struct{}
+	once    sync.Once
+	written int64 // bytes written, atomically
+}
+
+type delayedWrite struct {
+	due  time.Time
+	data []byte
+}
+
+func newDelayConn(c net.Conn, delay time.Duration) *delayConn {
+	dc := &delayConn{
+		Conn:   c,
+		delay:  delay,
+		queue:  make(chan delayedWrite, 1024),
+		closed: make(chan struct{}),
+	}
+	go dc.deliver()
+	return dc
+}
+
+func (c *delayConn) deliver() {
+	for {
+		select {
+		case w := <-c.queue:
+			time.Sleep(time.Until(w.due))
+			if _, err := c.Conn.Write(w.data); err != nil {
+				c.Close()
+				return
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (c *delayConn) Write(b []byte) (int, error) {
+	atomic.AddInt64(&c.written, int64(len(b)))
+	w := delayedWrite{time.Now().Add(c.delay), append([]byte(nil), b...)}
+	select {
+	case c.queue <- w:
+		return len(b), nil
+	case <-c.closed:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+func (c *delayConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+// wedgeConn is a net.Conn which, once wedged, drops everything written to
+// it and discards everything read, as if the peer had died without
+// closing the connection.
+type wedgeConn struct {
+	net.Conn
+	wedged  chan struct{}
+	once    sync.Once
+	written int64 // bytes written before wedging, atomically
+}
+
+func newWedgeConn(c net.Conn) *wedgeConn {
+	return &wedgeConn{Conn: c, wedged: make(chan struct{})}
+}
+
+func (c *wedgeConn) wedge() {
+	c.once.Do(func() { close(c.wedged) })
+}
+
+func (c *wedgeConn) isWedged() bool {
+	select {
+	case <-c.wedged:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *wedgeConn) Read(b []byte) (int, error) {
+	for {
+		n, err := c.Conn.Read(b)
+		if !c.isWedged() || err != nil {
+			return n, err
+		}
+	}
+}
+
+func (c *wedgeConn) Write(b []byte) (int, error) {
+	if c.isWedged() {
+		return len(b), nil
+	}
+	atomic.AddInt64(&c.written, int64(len(b)))
+	return c.Conn.Write(b)
+}
+
+// stallConn is a net.Conn whose writes, once stalled, block until it is
+// closed, as if the peer had stopped reading and the network buffers had
+// filled up.
+type stallConn struct {
+	net.Conn
+	stalled, closed chan struct{}
+	stallOnce       sync.Once
+	closeOnce       sync.Once
+}
+
+func newStallConn(c net.Conn) *stallConn {
+	return &stallConn{Conn: c, stalled: make(chan struct{}), closed: make(chan struct{})}
+}
+
+func (c *stallConn) stall() {
+	c.stallOnce.Do(func() { close(c.stalled) })
+}
+
+func (c *stallConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.stalled:
+		<-c.closed
+		return 0, io.ErrClosedPipe
+	default:
+		return c.Conn.Write(b)
+	}
+}
+
+func (c *stallConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+// countConn counts the bytes read from and written to a net.Conn.
+type countConn struct {
+	net.Conn
+	r, w int64
+}
+
+func newCountConn(c net.Conn) *countConn {
+	return &countConn{Conn: c}
+}
+
+func (c *countConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.r, int64(n))
+	return n, err
+}
+
+func (c *countConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.w, int64(n))
+	return n, err
+}
+
+func (c *countConn) read() int64    { return atomic.LoadInt64(&c.r) }
+func (c *countConn) written() int64 { return atomic.LoadInt64(&c.w) }
+
+func SubtestStreamOpenStress(t testing.TB, tr smux.Transport) {
+	a, b := connPipe(t)
+	defer a.Close()
+	defer b.Close()
+
+	count := scaleCount(t, 10000)
+	go func() {
+		muxa, err := tr.NewConn(a, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stress := func() {
+			for i := 0; i < count; i++ {
+				s, err := muxa.OpenStream()
+				if err != nil {
+					panic(err)
+				}
+				s.Close()
+			}
+		}
 
 		go stress()
 		go stress()
@@ -365,7 +1216,7 @@ func SubtestStreamOpenStress(t *testing.T, tr smux.Transport) {
 		}
 	}()
 
-	limit := time.After(time.Second * 10)
+	limit := time.After(scaleTimeout(time.Second * 10))
 	for i := 0; i < count*5; i++ {
 		select {
 		case <-recv:
@@ -375,8 +1226,8 @@ func SubtestStreamOpenStress(t *testing.T, tr smux.Transport) {
 	}
 }
 
-func SubtestStreamReset(t *testing.T, tr smux.Transport) {
-	a, b := tcpPipe(t)
+func SubtestStreamReset(t testing.TB, tr smux.Transport) {
+	a, b := connPipe(t)
 	defer a.Close()
 	defer b.Close()
 
@@ -419,8 +1270,8 @@ func SubtestStreamReset(t *testing.T, tr smux.Transport) {
 }
 
 // check that Close also closes the underlying net.Conn
-func SubtestWriteAfterClose(t *testing.T, tr smux.Transport) {
-	a, b := tcpPipe(t)
+func SubtestWriteAfterClose(t testing.TB, tr smux.Transport) {
+	a, b := connPipe(t)
 
 	muxa, err := tr.NewConn(a, true)
 	checkErr(t, err)
@@ -442,99 +1293,5963 @@ func SubtestWriteAfterClose(t *testing.T, tr smux.Transport) {
 	}
 }
 
-func SubtestStress1Conn1Stream1Msg(t *testing.T, tr smux.Transport) {
-	SubtestStress(t, Options{
-		tr:        tr,
-		connNum:   1,
-		streamNum: 1,
-		msgNum:    1,
-		msgMax:    100,
-		msgMin:    100,
-	})
-}
+// SubtestGroupReceiveBudget checks that a smux.StreamGroup receive budget
+// bounds how much the peer can send on the group's streams while nothing
+// reads them, the streams being opened through a wrapper of the
+// connection. It is skipped for muxers whose streams cannot change their
+// receive window.
+func SubtestGroupReceiveBudget(t testing.TB, tr smux.Transport) {
+	const (
+		budget  = 4 << 20
+		streams = 8
+		chunk   = 1 << 10
+	)
 
-func SubtestStress1Conn1Stream100Msg(t *testing.T, tr smux.Transport) {
-	SubtestStress(t, Options{
-		tr:        tr,
-		connNum:   1,
-		streamNum: 1,
-		msgNum:    100,
-		msgMax:    100,
-		msgMin:    100,
-	})
-}
+	var (
+		mu      sync.Mutex
+		written int
+		blocked = make(chan struct{}, streams)
+	)
+	muxa, _, done := muxPair(t, tr, func(str smux.Stream) {
+		defer func() { blocked <- struct{}{} }()
+		defer str.Reset()
 
-func SubtestStress1Conn100Stream100Msg(t *testing.T, tr smux.Transport) {
-	SubtestStress(t, Options{
-		tr:        tr,
-		connNum:   1,
-		streamNum: 100,
-		msgNum:    100,
-		msgMax:    100,
-		msgMin:    100,
+		// wait for the go-ahead, sent once the window is set.
+		if _, err := io.ReadFull(str, make([]byte, 1)); err != nil {
+			return
+		}
+		str.SetWriteDeadline(time.Now().Add(500 * time.Millisecond))
+		buf := randBuf(chunk)
+		for {
+			n, err := str.Write(buf)
+			mu.Lock()
+			written += n
+			mu.Unlock()
+			if err != nil {
+				return
+			}
+		}
 	})
+	defer done()
+
+	g := smux.NewStreamGroup(smux.WithStreamTracking(muxa))
+	defer g.Close()
+	if err := g.SetReceiveBudget(budget); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < streams; i++ {
+		s, err := g.OpenStream()
+		if err == smux.ErrNotSupported {
+			missingFeature(t, tr, smux.FeatureReceiveWindow, "streams cannot change their receive window")
+		}
+		checkErr(t, err)
+		_, err = s.Write([]byte{1})
+		checkErr(t, err)
+	}
+
+	// every writer blocks on the window until its deadline.
+	limit := time.After(scaleTimeout(10 * time.Second))
+	for i := 0; i < streams; i++ {
+		select {
+		case <-blocked:
+		case <-limit:
+			t.Fatal("timed out waiting for writers to block")
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	log("peer wrote %d bytes against a budget of %d", written, budget)
+	if written > budget+streams*chunk {
+		t.Fatalf("peer wrote %d bytes, more than the %d byte budget", written, budget)
+	}
 }
 
-func SubtestStress50Conn10Stream50Msg(t *testing.T, tr smux.Transport) {
-	SubtestStress(t, Options{
-		tr:        tr,
-		connNum:   50,
-		streamNum: 10,
-		msgNum:    50,
-		msgMax:    100,
-		msgMin:    100,
-	})
+// SubtestReceiveWindowShrink checks that a receive window set below the
+// one streams start with holds once the data the peer was allowed before
+// is read: after reading past it, the peer writes at most the smaller
+// window more while nothing reads. It is skipped for muxers whose streams
+// cannot change their receive window.
+func SubtestReceiveWindowShrink(t testing.TB, tr smux.Transport) {
+	const (
+		window = 16 << 10
+		read   = 1 << 20
+		chunk  = 1 << 10
+	)
+
+	muxa, muxb, done := muxPair(t, tr, nil)
+	defer done()
+
+	var written int64
+	go func() {
+		str, err := muxb.AcceptStream()
+		if err != nil {
+			return
+		}
+		defer str.Reset()
+		// wait for the go-ahead, sent once the window is set.
+		if _, err := io.ReadFull(str, make([]byte, 1)); err != nil {
+			return
+		}
+		str.SetWriteDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+		buf := randBuf(chunk)
+		for {
+			n, err := str.Write(buf)
+			atomic.AddInt64(&written, int64(n))
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	s, err := muxa.OpenStream()
+	checkErr(t, err)
+	defer s.Reset()
+	if err := smux.SetReceiveWindow(s, window); err == smux.ErrNotSupported {
+		missingFeature(t, tr, smux.FeatureReceiveWindow, "streams cannot change their receive window")
+	} else {
+		checkErr(t, err)
+	}
+	_, err = s.Write([]byte{1})
+	checkErr(t, err)
+
+	s.SetReadDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+	_, err = io.ReadFull(s, make([]byte, read))
+	checkErr(t, err)
+
+	// the writer blocks on the window once nothing reads.
+	deadline := time.Now().Add(scaleTimeout(10 * time.Second))
+	for last := int64(-1); ; {
+		time.Sleep(100 * time.Millisecond)
+		n := atomic.LoadInt64(&written)
+		if n == last {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("peer kept writing past %d bytes while nothing read", n)
+		}
+		last = n
+	}
+	ahead := atomic.LoadInt64(&written) - read
+	log("peer wrote %d bytes ahead of the reads, against a window of %d", ahead, window)
+	if ahead > window+chunk {
+		t.Fatalf("peer wrote %d bytes ahead of the reads, more than the window of %d", ahead, window)
+	}
 }
 
-func SubtestStress1Conn1000Stream10Msg(t *testing.T, tr smux.Transport) {
-	SubtestStress(t, Options{
-		tr:        tr,
-		connNum:   1,
-		streamNum: 1000,
-		msgNum:    10,
-		msgMax:    100,
-		msgMin:    100,
+// SubtestCloseLinger checks that closing a connection with CloseTimeout
+// still delivers data just written on its streams, with smux.CloseTimeout
+// reaching the connection through a wrapper. It is skipped for muxers that
+// are not a smux.LingerConn.
+func SubtestCloseLinger(t testing.TB, tr smux.Transport) {
+	received := make(chan []byte, 1)
+	muxa, _, done := muxPair(t, tr, func(str smux.Stream) {
+		buf, _ := ioutil.ReadAll(str)
+		received <- buf
 	})
+	defer done()
+	if _, ok := muxa.(smux.LingerConn); !ok {
+		missingFeature(t, tr, smux.FeatureLinger, "connection does not implement CloseTimeout")
+	}
+	wrapped := smux.WithStreamTracking(muxa)
+
+	s, err := wrapped.OpenStream()
+	checkErr(t, err)
+	buf := randBuf(1 << 19)
+	_, err = s.Write(buf)
+	checkErr(t, err)
+	checkErr(t, s.Close())
+	checkErr(t, smux.CloseTimeout(wrapped, 10*time.Second))
+
+	select {
+	case got := <-received:
+		if !bytes.Equal(got, buf) {
+			t.Fatalf("received %d bytes of the %d written before closing", len(got), len(buf))
+		}
+	case <-time.After(scaleTimeout(10 * time.Second)):
+		t.Fatal("timed out waiting for the stream data")
+	}
 }
 
-func SubtestStress1Conn100Stream100Msg10MB(t *testing.T, tr smux.Transport) {
-	SubtestStress(t, Options{
-		tr:        tr,
-		connNum:   1,
-		streamNum: 100,
-		msgNum:    100,
-		msgMax:    10000,
-		msgMin:    1000,
+// SubtestAbort checks that Abort returns promptly even with writes blocked
+// on flow control, that the blocked writes fail, and that the peer sees
+// its streams fail rather than end with io.EOF, with smux.Abort reaching
+// the connection through a wrapper. It is skipped for muxers that are not
+// a smux.AbortConn.
+func SubtestAbort(t testing.TB, tr smux.Transport) {
+	accepted := make(chan smux.Stream, 1)
+	muxa, _, done := muxPair(t, tr, func(str smux.Stream) {
+		accepted <- str
 	})
-}
+	defer done()
+	if _, ok := muxa.(smux.AbortConn); !ok {
+		missingFeature(t, tr, smux.FeatureAbort, "connection does not implement Abort")
+	}
+	wrapped := smux.WithStreamTracking(muxa)
 
-// Subtests are all the subtests run by SubtestAll
-var Subtests = []TransportTest{
-	SubtestSimpleWrite,
-	SubtestWriteAfterClose,
-	SubtestStress1Conn1Stream1Msg,
-	SubtestStress1Conn1Stream100Msg,
-	SubtestStress1Conn100Stream100Msg,
-	SubtestStress50Conn10Stream50Msg,
-	SubtestStress1Conn1000Stream10Msg,
-	SubtestStress1Conn100Stream100Msg10MB,
-	SubtestStreamOpenStress,
-	SubtestStreamReset,
+	s, err := wrapped.OpenStream()
+	checkErr(t, err)
+
+	// nothing reads on the other side, so this eventually blocks.
+	writeErr := make(chan error, 1)
+	go func() {
+		buf := randBuf(1 << 16)
+		for {
+			if _, err := s.Write(buf); err != nil {
+				writeErr <- err
+				return
+			}
+		}
+	}()
+
+	var str smux.Stream
+	select {
+	case str = <-accepted:
+	case <-time.After(scaleTimeout(10 * time.Second)):
+		t.Fatal("failed to accept stream")
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	aborted := make(chan error, 1)
+	go func() { aborted <- smux.Abort(wrapped) }()
+	select {
+	case err := <-aborted:
+		checkErr(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Abort blocked")
+	}
+	select {
+	case <-writeErr:
+	case <-time.After(time.Second):
+		t.Fatal("blocked Write did not fail after Abort")
+	}
+	if !muxa.IsClosed() {
+		t.Error("connection not closed after Abort")
+	}
+
+	str.SetReadDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+	if _, err := io.Copy(ioutil.Discard, str); err == nil {
+		t.Error("expected the peer's stream to fail, got EOF")
+	}
 }
 
-func getFunctionName(i interface{}) string {
-	return runtime.FuncForPC(reflect.ValueOf(i).Pointer()).Name()
+// SubtestStopAccepting checks that after StopAccepting, streams opened by
+// the peer are refused, with smux.RefusedStreamCode if they carry a code,
+// and an AcceptStream blocked at the time returns, while an existing
+// stream and streams opened by the stopped side keep working. Muxers
+// without native support are tested through the smux.WithStopAccepting
+// emulation.
+func SubtestStopAccepting(t testing.TB, tr smux.Transport) {
+	muxa, nb, done := muxPair(t, tr, nil)
+	defer done()
+	muxb := smux.WithStopAccepting(nb)
+	defer muxb.Close()
+
+	existing, err := muxa.OpenStream()
+	checkErr(t, err)
+	_, err = existing.Write([]byte("hello"))
+	checkErr(t, err)
+	str, err := muxb.AcceptStream()
+	checkErr(t, err)
+	go echoStream(str)
+
+	pending := make(chan error, 1)
+	go func() {
+		_, err := muxb.AcceptStream()
+		pending <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	checkErr(t, muxb.StopAccepting())
+	select {
+	case err := <-pending:
+		if err != smux.ErrAcceptStopped {
+			t.Fatalf("expected a blocked AcceptStream to return ErrAcceptStopped, got %v", err)
+		}
+	case <-time.After(scaleTimeout(10 * time.Second)):
+		t.Fatal("AcceptStream blocked before StopAccepting did not return")
+	}
+
+	if _, err := muxb.AcceptStream(); err != smux.ErrAcceptStopped {
+		t.Fatalf("expected AcceptStream to return ErrAcceptStopped, got %v", err)
+	}
+
+	refused, err := muxa.OpenStream()
+	if err == nil {
+		refused.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+		refused.Write([]byte("hello"))
+		_, err := refused.Read(make([]byte, 1))
+		if err == nil {
+			t.Error("stream opened after StopAccepting was not refused")
+		}
+		if code, ok := smux.ResetCode(err); ok && code != smux.RefusedStreamCode {
+			t.Errorf("refused stream reset with code %d, expected %d", code, smux.RefusedStreamCode)
+		}
+	}
+
+	// the existing stream still echoes.
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(existing, buf)
+	checkErr(t, err)
+	if string(buf) != "hello" {
+		t.Fatalf("unexpected echo %q", buf)
+	}
+
+	// and the stopped side can still open streams.
+	accepted := make(chan error, 1)
+	go func() {
+		s, err := muxa.AcceptStream()
+		if err == nil {
+			_, err = io.ReadFull(s, make([]byte, 5))
+		}
+		accepted <- err
+	}()
+	out, err := muxb.OpenStream()
+	checkErr(t, err)
+	_, err = out.Write([]byte("world"))
+	checkErr(t, err)
+	select {
+	case err := <-accepted:
+		checkErr(t, err)
+	case <-time.After(scaleTimeout(10 * time.Second)):
+		t.Fatal("timed out waiting for the stopped side's stream")
+	}
 }
 
-// SubtestAll runs all the stream multiplexer tests against the target
-// transport.
-func SubtestAll(t *testing.T, tr smux.Transport) {
-	for _, f := range Subtests {
-		t.Run(getFunctionName(f), func(t *testing.T) {
-			f(t, tr)
+// SubtestDeadlineUnderLoad checks that read and write deadlines fire on time
+// while other streams saturate the connection, rather than being delayed
+// behind the muxer's write queue.
+func SubtestDeadlineUnderLoad(t testing.TB, tr smux.Transport) {
+	const (
+		bulkStreams = 10
+		deadline    = 100 * time.Millisecond
+		probes      = 5
+	)
+	slack := scaleTimeout(500 * time.Millisecond)
+
+	muxa, _, done := muxPair(t, tr, func(str smux.Stream) {
+		// 'e' streams are echoed, others are never read.
+		mode := make([]byte, 1)
+		if _, err := io.ReadFull(str, mode); err != nil || mode[0] != 'e' {
+			return
+		}
+		echoStream(str)
+	})
+	defer done()
+
+	open := func(mode byte) smux.Stream {
+		s, err := muxa.OpenStream()
+		checkErr(t, err)
+		_, err = s.Write([]byte{mode})
+		checkErr(t, err)
+		return s
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer close(stop)
+	for i := 0; i < bulkStreams; i++ {
+		s := open('e')
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			defer s.Close()
+			buf := randBuf(1 << 16)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if _, err := s.Write(buf); err != nil {
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			io.Copy(ioutil.Discard, s)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	checkTimeout := func(op string, err error, elapsed time.Duration) {
+		if err == nil {
+			t.Fatalf("%s: expected a timeout", op)
+		}
+		if ne, ok := err.(net.Error); ok && !ne.Timeout() {
+			t.Errorf("%s: expected a timeout error, got %s", op, err)
+		}
+		if elapsed > deadline+slack {
+			t.Errorf("%s: deadline of %s fired after %s", op, deadline, elapsed)
+		}
+		log("%s deadline of %s fired after %s", op, deadline, elapsed)
+	}
+
+	for i := 0; i < probes; i++ {
+		s := open('e')
+		start := time.Now()
+		checkErr(t, s.SetReadDeadline(start.Add(deadline)))
+		_, err := s.Read(make([]byte, 1))
+		checkTimeout("Read", err, time.Since(start))
+		s.Reset()
+	}
+
+	for i := 0; i < probes; i++ {
+		s := open('s')
+		start := time.Now()
+		checkErr(t, s.SetWriteDeadline(start.Add(deadline)))
+		buf := randBuf(1 << 16)
+		var err error
+		for err == nil && time.Since(start) < deadline+slack {
+			_, err = s.Write(buf)
+		}
+		checkTimeout("Write", err, time.Since(start))
+		s.Reset()
+	}
+}
+
+// SubtestAcceptStyles checks that inbound streams can be received both from
+// an AcceptStream loop and through smux.Serve, on either side of the
+// connection, and that smux.ServeContext stops once its context is done.
+func SubtestAcceptStyles(t testing.TB, tr smux.Transport) {
+	muxa, muxb, done := muxPair(t, tr, nil)
+	defer done()
+
+	// the listener serves with a callback, the dialer with a loop.
+	served := make(chan error, 1)
+	go func() { served <- smux.Serve(muxb, echoStream) }()
+	go func() {
+		for {
+			str, err := muxa.AcceptStream()
+			if err != nil {
+				return
+			}
+			go echoStream(str)
+		}
+	}()
+
+	roundTrip := func(c smux.Conn, msg string) {
+		s, err := c.OpenStream()
+		checkErr(t, err)
+		defer s.Reset()
+		s.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+		_, err = s.Write([]byte(msg))
+		checkErr(t, err)
+		checkErr(t, s.Close())
+		buf, err := ioutil.ReadAll(s)
+		checkErr(t, err)
+		if string(buf) != msg {
+			t.Fatalf("unexpected echo %q, expected %q", buf, msg)
+		}
+	}
+	roundTrip(muxa, "to the callback")
+	roundTrip(muxb, "to the loop")
+
+	muxb.Close()
+	select {
+	case err := <-served:
+		if err == nil {
+			t.Fatal("Serve returned a nil error")
+		}
+	case <-time.After(scaleTimeout(10 * time.Second)):
+		t.Fatal("Serve did not return after the connection was closed")
+	}
+
+	// a server stopped through its context closes the connection, and
+	// returns the context's error once the handler of a stream still open
+	// returned.
+	muxc, muxd, done := muxPair(t, tr, nil)
+	defer done()
+	go muxc.AcceptStream()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handling := make(chan struct{})
+	go func() {
+		served <- smux.ServeContext(ctx, muxd, func(s smux.Stream) {
+			close(handling)
+			echoStream(s)
+		})
+	}()
+	s, err := muxc.OpenStream()
+	checkErr(t, err)
+	defer s.Reset()
+	_, err = s.Write([]byte("to be cancelled"))
+	checkErr(t, err)
+	select {
+	case <-handling:
+	case <-time.After(scaleTimeout(10 * time.Second)):
+		t.Fatal("ServeContext did not call the handler")
+	}
+
+	cancel()
+	select {
+	case err := <-served:
+		if err != context.Canceled {
+			t.Fatalf("ServeContext returned %v, expected %v", err, context.Canceled)
+		}
+	case <-time.After(scaleTimeout(10 * time.Second)):
+		t.Fatal("ServeContext did not return after its context was cancelled")
+	}
+	if !muxd.IsClosed() {
+		t.Fatal("ServeContext did not close the connection")
+	}
+}
+
+// SubtestOpenStreamContext checks that smux.OpenStreamContext fails fast
+// with the context's error once it is done, including against a peer that
+// never runs a muxer and so never answers.
+func SubtestOpenStreamContext(t testing.TB, tr smux.Transport) {
+	a, b := connPipe(t)
+	defer a.Close()
+	defer b.Close()
+
+	muxa, err := tr.NewConn(a, false)
+	checkErr(t, err)
+	defer muxa.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if s, err := smux.OpenStreamContext(ctx, muxa); err != context.Canceled {
+		if s != nil {
+			s.Reset()
+		}
+		t.Fatalf("expected open with a cancelled context to fail with %v, got %v", context.Canceled, err)
+	}
+
+	const timeout = 100 * time.Millisecond
+	ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	s, err := smux.OpenStreamContext(ctx, muxa)
+	switch {
+	case err == nil:
+		// muxers that open without a round trip succeed right away.
+		s.Reset()
+	case err != context.DeadlineExceeded:
+		t.Fatalf("expected open to fail with %v, got %v", context.DeadlineExceeded, err)
+	}
+	if d := time.Since(start); d > scaleTimeout(timeout+time.Second) {
+		t.Fatalf("open took %s with a %s deadline", d, timeout)
+	}
+}
+
+// SubtestHalfClose checks that after one side closes a stream for writing,
+// the remote side reads EOF and can still write back, and that a stream
+// closed for reading keeps writing.
+func SubtestHalfClose(t testing.TB, tr smux.Transport) {
+	muxa, muxb, done := muxPair(t, tr, nil)
+	defer done()
+
+	remote := make(chan error, 1)
+	go func() {
+		str, err := muxb.AcceptStream()
+		if err != nil {
+			remote <- err
+			return
+		}
+		defer str.Close()
+		req, err := ioutil.ReadAll(str)
+		if err == nil {
+			_, err = str.Write(append(req, " back"...))
+		}
+		remote <- err
+	}()
+
+	s, err := muxa.OpenStream()
+	checkErr(t, err)
+	defer s.Reset()
+	s.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+	_, err = s.Write([]byte("there"))
+	checkErr(t, err)
+	checkErr(t, smux.CloseWrite(s))
+	checkErr(t, <-remote)
+	resp, err := ioutil.ReadAll(s)
+	checkErr(t, err)
+	if string(resp) != "there back" {
+		t.Fatalf("unexpected response %q", resp)
+	}
+
+	// the other direction.
+	go func() {
+		str, err := muxb.AcceptStream()
+		if err != nil {
+			remote <- err
+			return
+		}
+		defer str.Close()
+		_, err = ioutil.ReadAll(str)
+		remote <- err
+	}()
+
+	s, err = muxa.OpenStream()
+	checkErr(t, err)
+	defer s.Reset()
+	s.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+	err = smux.CloseRead(s)
+	if err == smux.ErrNotSupported {
+		missingFeature(t, tr, smux.FeatureHalfClose, "stream does not implement CloseRead")
+	}
+	checkErr(t, err)
+	if _, err := s.Read(make([]byte, 1)); err == nil {
+		t.Error("read succeeded after CloseRead")
+	}
+	_, err = s.Write([]byte("still writing"))
+	checkErr(t, err)
+	checkErr(t, s.Close())
+	checkErr(t, <-remote)
+}
+
+// SubtestResetUnblocks checks that resetting a stream promptly fails the
+// peer's blocked Read and Write, and discards data already buffered
+// locally.
+func SubtestResetUnblocks(t testing.TB, tr smux.Transport) {
+	muxa, muxb, done := muxPair(t, tr, nil)
+	defer done()
+
+	failed := make(chan error, 2)
+	go func() {
+		// the peer reads on the first stream and writes on the second
+		// until they fail.
+		str, err := muxb.AcceptStream()
+		if err != nil {
+			failed <- err
+			return
+		}
+		go func(str smux.Stream) {
+			_, err := ioutil.ReadAll(str)
+			if err == nil {
+				err = io.EOF
+			}
+			failed <- err
+		}(str)
+
+		str, err = muxb.AcceptStream()
+		if err != nil {
+			failed <- err
+			return
+		}
+		buf := randBuf(1 << 16)
+		for {
+			if _, err := str.Write(buf); err != nil {
+				failed <- err
+				return
+			}
+		}
+	}()
+
+	reading, err := muxa.OpenStream()
+	checkErr(t, err)
+	_, err = reading.Write([]byte("x"))
+	checkErr(t, err)
+	writing, err := muxa.OpenStream()
+	checkErr(t, err)
+	_, err = writing.Write([]byte("x"))
+	checkErr(t, err)
+
+	// let the peer block and some of its writes get buffered here.
+	time.Sleep(100 * time.Millisecond)
+	checkErr(t, reading.Reset())
+	checkErr(t, writing.Reset())
+
+	if _, err := writing.Read(make([]byte, 1)); err == nil {
+		t.Error("read buffered data after reset")
+	}
+
+	timeout := time.After(scaleTimeout(5 * time.Second))
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-failed:
+			if err == io.EOF {
+				t.Error("peer read EOF from a reset stream")
+			}
+		case <-timeout:
+			t.Fatal("peer's blocked read or write did not fail after reset")
+		}
+	}
+}
+
+// isTimeout reports whether err is a net.Error timeout.
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// SubtestDeadline checks that reads and writes blocked past a stream's
+// deadlines fail with timeout errors, and that clearing the deadline lets
+// them succeed again.
+func SubtestDeadline(t testing.TB, tr smux.Transport) {
+	// the peer holds on to the streams without reading or writing.
+	peer := make(chan smux.Stream, 2)
+	muxa, _, done := muxPair(t, tr, func(str smux.Stream) {
+		peer <- str
+	})
+	defer done()
+
+	const deadline = 50 * time.Millisecond
+	grace := scaleTimeout(2 * time.Second)
+
+	s, err := muxa.OpenStream()
+	checkErr(t, err)
+	defer s.Reset()
+	checkErr(t, s.SetReadDeadline(time.Now().Add(deadline)))
+	start := time.Now()
+	_, err = s.Read(make([]byte, 1))
+	if !isTimeout(err) {
+		t.Fatalf("expected a timeout error from a blocked read, got %v", err)
+	}
+	if d := time.Since(start); d > deadline+grace {
+		t.Fatalf("read timed out after %s with a %s deadline", d, deadline)
+	}
+
+	// clearing the deadline makes the stream readable again.
+	checkErr(t, s.SetReadDeadline(time.Time{}))
+	_, err = s.Write([]byte("x"))
+	checkErr(t, err)
+	str := <-peer
+	defer str.Reset()
+	_, err = str.Write([]byte("y"))
+	checkErr(t, err)
+	_, err = io.ReadFull(s, make([]byte, 1))
+	checkErr(t, err)
+
+	// writes fail once the deadline passed, at the latest when flow
+	// control blocks them.
+	s, err = muxa.OpenStream()
+	checkErr(t, err)
+	defer s.Reset()
+	checkErr(t, s.SetWriteDeadline(time.Now().Add(deadline)))
+	start = time.Now()
+	buf := randBuf(1 << 14)
+	for {
+		_, err := s.Write(buf)
+		if err != nil {
+			if !isTimeout(err) {
+				t.Fatalf("expected a timeout error from a blocked write, got %v", err)
+			}
+			break
+		}
+		if d := time.Since(start); d > deadline+grace {
+			t.Fatalf("writes still succeeded %s after a %s deadline", d, deadline)
+		}
+	}
+}
+
+// SubtestNetConn checks that streams converted with smux.NetConn work as
+// net.Conns.
+func SubtestNetConn(t testing.TB, tr smux.Transport) {
+	muxa, _, done := muxPair(t, tr, echoStream)
+	defer done()
+
+	s, err := muxa.OpenStream()
+	checkErr(t, err)
+	defer s.Reset()
+	nc := smux.NetConn(muxa, s)
+	if nc.LocalAddr() == nil || nc.RemoteAddr() == nil {
+		t.Fatal("net.Conn of a stream has nil addresses")
+	}
+	checkErr(t, nc.SetDeadline(time.Now().Add(scaleTimeout(10*time.Second))))
+
+	out := randBuf(1 << 12)
+	_, err = nc.Write(out)
+	checkErr(t, err)
+	in := make([]byte, len(out))
+	_, err = io.ReadFull(nc, in)
+	checkErr(t, err)
+	if !bytes.Equal(in, out) {
+		t.Fatal("echoed data does not match")
+	}
+}
+
+// SubtestCloseChan checks that killing the underlying net.Conn closes the
+// muxed connection, firing its smux.CloseChan.
+func SubtestCloseChan(t testing.TB, tr smux.Transport) {
+	a, b := connPipe(t)
+	muxa, _, done := muxConns(t, tr, a, b, nil)
+	defer done()
+	go muxa.AcceptStream()
+
+	closed := smux.CloseChan(muxa)
+	select {
+	case <-closed:
+		t.Fatal("close channel fired on a live connection")
+	default:
+	}
+
+	b.Close()
+	select {
+	case <-closed:
+	case <-time.After(scaleTimeout(5 * time.Second)):
+		t.Fatal("close channel did not fire after the net.Conn died")
+	}
+	if !muxa.IsClosed() {
+		t.Error("IsClosed is false after the close channel fired")
+	}
+}
+
+// SubtestStreamCount checks that the number of streams reported by the
+// connection goes up as streams are opened and down as they are closed or
+// reset. Connections that report neither count nor list are checked
+// through smux.WithStreamTracking.
+func SubtestStreamCount(t testing.TB, tr smux.Transport) {
+	muxa, _, done := muxPair(t, tr, echoStream)
+	defer done()
+	_, counts := muxa.(smux.StreamCounter)
+	_, lists := muxa.(smux.StreamLister)
+	if !counts && !lists {
+		log("connection does not count streams, using smux.WithStreamTracking")
+		muxa = smux.WithStreamTracking(muxa)
+	}
+
+	// eventually, as the count may lag behind frames being processed.
+	expect := func(n int) {
+		deadline := time.Now().Add(scaleTimeout(5 * time.Second))
+		for {
+			got := -1
+			if sc, ok := muxa.(smux.StreamCounter); ok {
+				got = sc.NumStreams()
+			}
+			if sl, ok := muxa.(smux.StreamLister); ok {
+				listed := len(sl.Streams())
+				if got >= 0 && got != listed {
+					t.Fatalf("NumStreams reports %d streams, but Streams lists %d", got, listed)
+				}
+				got = listed
+			}
+			if got == n {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d open streams, got %d", n, got)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	const n = 10
+	streams := make([]smux.Stream, n)
+	for i := range streams {
+		s, err := muxa.OpenStream()
+		checkErr(t, err)
+		defer s.Reset()
+		streams[i] = s
+		expect(i + 1)
+	}
+
+	for i, s := range streams[:n/2] {
+		checkErr(t, s.Close())
+		_, err := ioutil.ReadAll(s)
+		checkErr(t, err)
+		expect(n - i - 1)
+	}
+	for i, s := range streams[n/2:] {
+		checkErr(t, s.Reset())
+		expect(n/2 - i - 1)
+	}
+}
+
+// SubtestErrors checks that the connection reports the standard errors:
+// smux.ErrReset on streams reset by the peer, a net.Error timeout past
+// deadlines, and smux.ErrConnClosed on a closed connection. It also checks
+// that smux.WithErrorTranslation leaves the errors of the readers copied to
+// its streams as they are.
+func SubtestErrors(t testing.TB, tr smux.Transport) {
+	muxa, muxb, done := muxPair(t, tr, nil)
+	defer done()
+
+	go func() {
+		str, err := muxb.AcceptStream()
+		if err != nil {
+			return
+		}
+		str.Reset()
+	}()
+
+	s, err := muxa.OpenStream()
+	checkErr(t, err)
+	s.SetDeadline(time.Now().Add(scaleTimeout(5 * time.Second)))
+	_, err = s.Write([]byte("x"))
+	checkErr(t, err)
+	if _, err := s.Read(make([]byte, 1)); err != smux.ErrReset {
+		t.Errorf("expected %v reading a stream reset by the peer, got %v", smux.ErrReset, err)
+	}
+
+	s, err = muxa.OpenStream()
+	checkErr(t, err)
+	s.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := s.Read(make([]byte, 1)); !isTimeout(err) {
+		t.Errorf("expected a timeout reading past the deadline, got %v", err)
+	}
+
+	// the errors of a reader copied to a stream are not the muxer's, and
+	// smux.WithErrorTranslation leaves them as they are.
+	errSource := errors.New("source failed")
+	tc := smux.WithErrorTranslation(muxa, func(error) error { return smux.ErrReset })
+	s, err = tc.OpenStream()
+	checkErr(t, err)
+	if _, err := s.(io.ReaderFrom).ReadFrom(iotest.ErrReader(errSource)); err != errSource {
+		t.Errorf("expected %v copying from a failing reader, got %v", errSource, err)
+	}
+	s.Reset()
+
+	checkErr(t, muxa.Close())
+	if _, err := muxa.OpenStream(); err != smux.ErrConnClosed {
+		t.Errorf("expected %v opening a stream on a closed connection, got %v", smux.ErrConnClosed, err)
+	}
+	if _, err := muxa.AcceptStream(); err != smux.ErrConnClosed {
+		t.Errorf("expected %v accepting a stream on a closed connection, got %v", smux.ErrConnClosed, err)
+	}
+}
+
+// SubtestConnOptions checks smux.NewConnWithOptions: zero options always
+// work, invalid ones are rejected, and connections configured with valid
+// ones carry streams. The last part is skipped for transports that do not
+// support the settings.
+func SubtestConnOptions(t testing.TB, tr smux.Transport) {
+	a, b := connPipe(t)
+	defer a.Close()
+	defer b.Close()
+
+	for _, opts := range []smux.Options{{MaxStreams: -1}, {WriteScheduler: "lifo"}} {
+		if _, err := smux.NewConnWithOptions(tr, a, false, opts); err == nil {
+			t.Fatalf("invalid options %+v were accepted", opts)
+		}
+	}
+
+	muxb, err := smux.NewConnWithOptions(tr, b, true, smux.Options{})
+	checkErr(t, err)
+	defer muxb.Close()
+	defer serveConn(t, muxb, echoStream)()
+
+	opts := smux.Options{
+		ReceiveWindow:     1 << 20,
+		MaxFrameSize:      1 << 14,
+		KeepAliveInterval: 10 * time.Second,
+		MaxStreams:        100,
+	}
+	muxa, err := smux.NewConnWithOptions(tr, a, false, opts)
+	if err == smux.ErrNotSupported {
+		t.Skip("transport does not support these options")
+	}
+	checkErr(t, err)
+	defer muxa.Close()
+
+	s, err := muxa.OpenStream()
+	checkErr(t, err)
+	defer s.Reset()
+	s.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+	out := randBuf(1 << 16)
+	_, err = s.Write(out)
+	checkErr(t, err)
+	in := make([]byte, len(out))
+	_, err = io.ReadFull(s, in)
+	checkErr(t, err)
+	if !bytes.Equal(in, out) {
+		t.Fatal("echoed data does not match")
+	}
+}
+
+// SubtestPing checks that pings measure the round trip time over a
+// connection with injected one-way latency. Connections that are not
+// smux.PingConns are checked through smux.WithPing.
+func SubtestPing(t testing.TB, tr smux.Transport) {
+	skipNoWire(t, tr)
+	const latency = 50 * time.Millisecond
+
+	a, b := connPipe(t)
+	da, db := newDelayConn(a, latency), newDelayConn(b, latency)
+	muxa, muxb, done := muxConns(t, tr, da, db, nil)
+	defer done()
+
+	pa, ok := muxa.(smux.PingConn)
+	if !ok {
+		log("connection does not implement Ping, using smux.WithPing")
+		var pb smux.PingConn
+		emulated := make(chan error, 1)
+		go func() {
+			var err error
+			pb, err = smux.WithPing(muxb)
+			emulated <- err
+		}()
+		var err error
+		pa, err = smux.WithPing(muxa)
+		checkErr(t, err)
+		checkErr(t, <-emulated)
+		defer serveConn(t, pb, echoStream)()
+	} else {
+		defer serveConn(t, muxb, echoStream)()
+	}
+	go pa.AcceptStream()
+
+	for i := 0; i < 3; i++ {
+		rtt, err := pa.Ping()
+		checkErr(t, err)
+		log("ping %d: %s", i, rtt)
+		if atomic.LoadInt64(&da.written) == 0 || atomic.LoadInt64(&db.written) == 0 {
+			missingWire(t, tr)
+		}
+		if rtt < 2*latency {
+			t.Fatalf("ping of %s is below the injected round trip latency of %s", rtt, 2*latency)
+		}
+		if rtt > 2*latency+scaleTimeout(time.Second) {
+			t.Fatalf("ping of %s is way above the injected round trip latency of %s", rtt, 2*latency)
+		}
+	}
+
+	// streams still work next to the emulated control streams.
+	s, err := pa.OpenStream()
+	checkErr(t, err)
+	defer s.Reset()
+	_, err = s.Write([]byte("hello"))
+	checkErr(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(s, buf)
+	checkErr(t, err)
+	if string(buf) != "hello" {
+		t.Fatalf("unexpected echo %q", buf)
+	}
+}
+
+// SubtestCloseGracefully checks that while a connection is closed
+// gracefully, its in-flight streams complete and the peer's new streams
+// fail cleanly. Connections that are not smux.GracefulConns are checked
+// through smux.WithGracefulClose.
+func SubtestCloseGracefully(t testing.TB, tr smux.Transport) {
+	muxa, nb, done := muxPair(t, tr, nil)
+	defer done()
+	muxb := smux.WithGracefulClose(nb)
+	defer muxb.Close()
+	go muxa.AcceptStream()
+
+	// the in-flight stream is answered slowly.
+	accepted := make(chan struct{})
+	go func() {
+		str, err := muxb.AcceptStream()
+		close(accepted)
+		if err != nil {
+			return
+		}
+		defer str.Close()
+		req, err := ioutil.ReadAll(str)
+		if err != nil {
+			str.Reset()
+			return
+		}
+		time.Sleep(200 * time.Millisecond)
+		str.Write(append(req, " done"...))
+	}()
+
+	inflight, err := muxa.OpenStream()
+	checkErr(t, err)
+	defer inflight.Reset()
+	inflight.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+	_, err = inflight.Write([]byte("work"))
+	checkErr(t, err)
+	checkErr(t, inflight.Close())
+	<-accepted
+
+	ctx, cancel := context.WithTimeout(context.Background(), scaleTimeout(10*time.Second))
+	defer cancel()
+	closed := make(chan error, 1)
+	go func() { closed <- muxb.CloseGracefully(ctx) }()
+	time.Sleep(50 * time.Millisecond)
+
+	late, err := muxa.OpenStream()
+	if err == nil {
+		defer late.Reset()
+		late.SetDeadline(time.Now().Add(scaleTimeout(5 * time.Second)))
+		late.Write([]byte("late"))
+		if _, err := late.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+			t.Errorf("stream opened while closing gracefully did not fail cleanly: %v", err)
+		}
+	}
+
+	resp, err := ioutil.ReadAll(inflight)
+	checkErr(t, err)
+	if string(resp) != "work done" {
+		t.Fatalf("unexpected response %q", resp)
+	}
+
+	select {
+	case err := <-closed:
+		checkErr(t, err)
+	case <-time.After(scaleTimeout(10 * time.Second)):
+		t.Fatal("CloseGracefully did not return after the streams finished")
+	}
+	if !muxb.IsClosed() {
+		t.Error("connection is not closed after CloseGracefully")
+	}
+}
+
+// SubtestNamedStreams checks that the acceptor of a stream sees the name it
+// was opened with before reading any data. Connections that are not
+// smux.NamedStreamConns are checked through smux.WithStreamNames.
+func SubtestNamedStreams(t testing.TB, tr smux.Transport) {
+	muxa, muxb, done := muxPair(t, tr, nil)
+	defer done()
+	if _, ok := muxa.(smux.NamedStreamConn); !ok {
+		log("connection does not implement OpenNamedStream, using smux.WithStreamNames")
+		muxa, muxb = smux.WithStreamNames(muxa), smux.WithStreamNames(muxb)
+	}
+
+	names := make(chan string, 2)
+	defer serveConn(t, muxb, func(s smux.Stream) {
+		names <- smux.StreamName(s)
+		echoStream(s)
+	})()
+
+	for _, name := range []string{"/echo/1.0.0", ""} {
+		var (
+			s   smux.Stream
+			err error
+		)
+		if name == "" {
+			s, err = muxa.OpenStream()
+		} else {
+			s, err = smux.OpenNamedStream(muxa, name)
+		}
+		checkErr(t, err)
+		defer s.Reset()
+		if got := smux.StreamName(s); got != name {
+			t.Fatalf("opened stream is named %q, expected %q", got, name)
+		}
+
+		select {
+		case got := <-names:
+			if got != name {
+				t.Fatalf("accepted stream is named %q, expected %q", got, name)
+			}
+		case <-time.After(scaleTimeout(5 * time.Second)):
+			t.Fatal("stream was not accepted")
+		}
+
+		_, err = s.Write([]byte("hello"))
+		checkErr(t, err)
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(s, buf)
+		checkErr(t, err)
+		if string(buf) != "hello" {
+			t.Fatalf("unexpected echo %q", buf)
+		}
+	}
+}
+
+// SubtestStreamIDs checks that stream IDs are unique per connection, the
+// same on both sides, and of one parity for the streams each side opens
+// and of the other for the streams its peer opens.
+func SubtestStreamIDs(t testing.TB, tr smux.Transport) {
+	muxa, muxb, done := muxPair(t, tr, nil)
+	defer done()
+
+	const n = 10
+	seen := make(map[uint64]bool)
+	// open opens n streams on from and checks their IDs against the
+	// streams accepted on to, returning their parity.
+	open := func(from, to smux.Conn) uint64 {
+		accepted := make(chan smux.Stream, n)
+		go func() {
+			for i := 0; i < n; i++ {
+				s, err := to.AcceptStream()
+				if err != nil {
+					close(accepted)
+					return
+				}
+				accepted <- s
+			}
+		}()
+
+		var parity uint64
+		for i := 0; i < n; i++ {
+			s, err := from.OpenStream()
+			checkErr(t, err)
+			defer s.Reset()
+			id, ok := smux.StreamID(s)
+			if !ok {
+				missingFeature(t, tr, smux.FeatureStreamIDs, "streams do not implement ID")
+			}
+			if seen[id] {
+				t.Fatalf("stream ID %d used twice", id)
+			}
+			seen[id] = true
+			if i == 0 {
+				parity = id % 2
+			} else if id%2 != parity {
+				t.Fatalf("stream ID %d does not have the parity of the first stream this side opened", id)
+			}
+
+			// the first write announces the stream to lazy muxers.
+			_, err = s.Write([]byte("x"))
+			checkErr(t, err)
+			rs, ok := <-accepted
+			if !ok {
+				t.Fatal("failed to accept stream")
+			}
+			defer rs.Reset()
+			if rid, _ := smux.StreamID(rs); rid != id {
+				t.Fatalf("stream opened with ID %d was accepted with ID %d", id, rid)
+			}
+		}
+		return parity
+	}
+
+	if open(muxa, muxb) == open(muxb, muxa) {
+		t.Fatal("streams opened by both sides have the same ID parity")
+	}
+}
+
+// SubtestPriority checks that, next to bulk transfers saturating a slow
+// link, a high-priority stream has a lower tail round trip latency than a
+// default-priority one.
+func SubtestPriority(t testing.TB, tr smux.Transport) {
+	a, b := connPipe(t)
+	// over a fast link, the bulk data waits in socket buffers, which no
+	// scheduler reorders, rather than in the muxers.
+	muxa, _, done := muxConns(t, tr, slowLink{a, 32 << 20}, slowLink{b, 32 << 20}, echoStream)
+	defer done()
+	go muxa.AcceptStream()
+
+	high, err := muxa.OpenStream()
+	checkErr(t, err)
+	defer high.Reset()
+	err = smux.SetPriority(high, smux.DefaultPriority+1)
+	if err == smux.ErrNotSupported {
+		missingFeature(t, tr, smux.FeaturePriority, "streams do not implement SetPriority")
+	}
+	checkErr(t, err)
+	low, err := muxa.OpenStream()
+	checkErr(t, err)
+	defer low.Reset()
+
+	// several bulk streams, so that the writes of a stream of the default
+	// priority wait for theirs.
+	for i := 0; i < 4; i++ {
+		bulk, err := muxa.OpenStream()
+		checkErr(t, err)
+		defer bulk.Reset()
+		go io.Copy(ioutil.Discard, bulk)
+		go func() {
+			buf := randBuf(1 << 16)
+			for {
+				if _, err := bulk.Write(buf); err != nil {
+					return
+				}
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	roundTrip := func(s smux.Stream, out, in []byte) time.Duration {
+		start := time.Now()
+		_, err := s.Write(out)
+		checkErr(t, err)
+		_, err = io.ReadFull(s, in)
+		checkErr(t, err)
+		return time.Since(start)
+	}
+
+	// muxers buffering a lot of bulk data make round trips slow, so stop
+	// early rather than at the rounds count.
+	rounds := scaleCount(t, 200)
+	stop := time.Now().Add(scaleTimeout(5 * time.Second))
+	out, in := randBuf(64), make([]byte, 64)
+	var highRTTs, lowRTTs []time.Duration
+	for i := 0; i < rounds && time.Now().Before(stop); i++ {
+		highRTTs = append(highRTTs, roundTrip(high, out, in))
+		lowRTTs = append(lowRTTs, roundTrip(low, out, in))
+	}
+
+	p99 := func(d []time.Duration) time.Duration {
+		sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
+		return percentile(d, 0.99)
+	}
+	highP99, lowP99 := p99(highRTTs), p99(lowRTTs)
+	log("p99 round trip: %s at high priority, %s at default priority", highP99, lowP99)
+	if highP99 > lowP99 {
+		t.Fatalf("high-priority p99 round trip of %s is above the default-priority one of %s", highP99, lowP99)
+	}
+}
+
+// slowLink is a net.Conn whose writes take as long as sending their data
+// at rate bytes per second, as over a saturated link with no buffer.
+type slowLink struct {
+	net.Conn
+	rate int
+}
+
+func (l slowLink) Write(b []byte) (int, error) {
+	n, err := l.Conn.Write(b)
+	time.Sleep(time.Duration(n) * time.Second / time.Duration(l.rate))
+	return n, err
+}
+
+// SubtestConnStat checks the statistics of a connection after a known
+// transfer. Connections that are not smux.StatConns are checked through
+// smux.WithStats.
+func SubtestConnStat(t testing.TB, tr smux.Transport) {
+	nc, _, done := muxPair(t, tr, echoStream)
+	defer done()
+	muxa := smux.WithStats(nc)
+	go muxa.AcceptStream()
+
+	const size = 1000
+	for i := 0; i < 2; i++ {
+		s, err := muxa.OpenStream()
+		checkErr(t, err)
+		s.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+		_, err = s.Write(randBuf(size))
+		checkErr(t, err)
+		checkErr(t, s.Close())
+		echo, err := ioutil.ReadAll(s)
+		checkErr(t, err)
+		if len(echo) != size {
+			t.Fatalf("echoed %d bytes, expected %d", len(echo), size)
+		}
+	}
+	s, err := muxa.OpenStream()
+	checkErr(t, err)
+	checkErr(t, s.Reset())
+
+	st := muxa.Stat()
+	log("connection statistics: %+v", st)
+	if st.BytesSent != 2*size || st.BytesReceived != 2*size {
+		t.Errorf("sent %d and received %d bytes, expected %d each", st.BytesSent, st.BytesReceived, 2*size)
+	}
+	if st.StreamsOpened != 3 || st.StreamsAccepted != 0 || st.StreamsReset != 1 {
+		t.Errorf("opened %d, accepted %d and reset %d streams, expected 3, 0 and 1", st.StreamsOpened, st.StreamsAccepted, st.StreamsReset)
+	}
+	if st.OpenStreams != 0 {
+		t.Errorf("%d streams still open, expected none", st.OpenStreams)
+	}
+}
+
+// SubtestStreamStat checks the statistics and state of a stream through a
+// transfer. Streams that are not smux.StatStreams are checked through
+// smux.WithStats.
+func SubtestStreamStat(t testing.TB, tr smux.Transport) {
+	muxa, _, done := muxPair(t, tr, echoStream)
+	defer done()
+	go muxa.AcceptStream()
+
+	start := time.Now()
+	s, err := muxa.OpenStream()
+	checkErr(t, err)
+	defer s.Reset()
+	if _, ok := smux.StreamStats(s); !ok {
+		log("stream does not implement Stat, using smux.WithStats")
+		s.Reset()
+		s, err = smux.WithStats(muxa).OpenStream()
+		checkErr(t, err)
+		defer s.Reset()
+	}
+	s.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+
+	stat := func() smux.StreamStat {
+		st, _ := smux.StreamStats(s)
+		log("stream statistics: %+v", st)
+		return st
+	}
+	st := stat()
+	if st.Opened.Before(start) || st.Opened.After(time.Now()) {
+		t.Errorf("stream opened at %s, between %s and now", st.Opened, start)
+	}
+	if st.WriteClosed || st.ReadClosed || st.Reset {
+		t.Error("new stream is not fully open")
+	}
+
+	const size = 100
+	_, err = s.Write(randBuf(size))
+	checkErr(t, err)
+	checkErr(t, s.Close())
+	if st := stat(); !st.WriteClosed || st.ReadClosed {
+		t.Error("stream is not closed for writing only after Close")
+	}
+	_, err = ioutil.ReadAll(s)
+	checkErr(t, err)
+
+	st = stat()
+	if st.BytesSent != size || st.BytesReceived != size {
+		t.Errorf("sent %d and received %d bytes, expected %d each", st.BytesSent, st.BytesReceived, size)
+	}
+	if !st.WriteClosed || !st.ReadClosed || st.Reset {
+		t.Error("stream is not closed in both directions after reading EOF")
+	}
+}
+
+// SubtestWriteBuffers checks that smux.WriteBuffers delivers the
+// concatenation of the buffers, for small and large buffers.
+func SubtestWriteBuffers(t testing.TB, tr smux.Transport) {
+	muxa, _, done := muxPair(t, tr, echoStream)
+	defer done()
+	go muxa.AcceptStream()
+
+	s, err := muxa.OpenStream()
+	checkErr(t, err)
+	defer s.Reset()
+	s.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+
+	bufs := net.Buffers{randBuf(16), randBuf(smux.CopyBufferSize + 100), nil, randBuf(1)}
+	var want []byte
+	for _, buf := range bufs {
+		want = append(want, buf...)
+	}
+	go func() {
+		n, err := smux.WriteBuffers(s, bufs)
+		if err != nil || n != int64(len(want)) {
+			s.Reset()
+		}
+	}()
+
+	got := make([]byte, len(want))
+	_, err = io.ReadFull(s, got)
+	checkErr(t, err)
+	if !bytes.Equal(got, want) {
+		t.Fatal("echoed data does not match the buffers")
+	}
+}
+
+// countingObserver counts the stream events it observes, per stream.
+type countingObserver struct {
+	mu     sync.Mutex
+	events map[string]int
+	// per stream, how many times each of closed and reset fired.
+	ends map[smux.Stream]int
+}
+
+func newCountingObserver() *countingObserver {
+	return &countingObserver{events: make(map[string]int), ends: make(map[smux.Stream]int)}
+}
+
+func (o *countingObserver) count(ev string, s smux.Stream, end bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events[ev]++
+	if end {
+		o.ends[s]++
+	}
+}
+
+func (o *countingObserver) StreamOpened(s smux.Stream)   { o.count("opened", s, false) }
+func (o *countingObserver) StreamAccepted(s smux.Stream) { o.count("accepted", s, false) }
+func (o *countingObserver) StreamClosed(s smux.Stream)   { o.count("closed", s, true) }
+func (o *countingObserver) StreamReset(s smux.Stream)    { o.count("reset", s, true) }
+
+// SubtestStreamObserver checks that a stream observer is told of every
+// stream opened and accepted, and of every stream ending, exactly once.
+// Connections that are not smux.ObservableConns are checked through
+// smux.WithStreamObserver.
+func SubtestStreamObserver(t testing.TB, tr smux.Transport) {
+	nc, muxb, done := muxPair(t, tr, echoStream)
+	defer done()
+	muxa := smux.WithStreamObserver(nc)
+	o := newCountingObserver()
+	muxa.SetStreamObserver(o)
+
+	// a stream closed both ways, closed twice.
+	s, err := muxa.OpenStream()
+	checkErr(t, err)
+	s.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+	_, err = s.Write([]byte("hello"))
+	checkErr(t, err)
+	checkErr(t, s.Close())
+	_, err = ioutil.ReadAll(s)
+	checkErr(t, err)
+	s.Close()
+
+	// a stream reset, twice.
+	s, err = muxa.OpenStream()
+	checkErr(t, err)
+	checkErr(t, s.Reset())
+	s.Reset()
+
+	// a stream accepted from the peer and closed both ways.
+	go func() {
+		s, err := muxb.OpenStream()
+		if err != nil {
+			return
+		}
+		s.Write([]byte("world"))
+		s.Close()
+	}()
+	s, err = muxa.AcceptStream()
+	checkErr(t, err)
+	s.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+	_, err = ioutil.ReadAll(s)
+	checkErr(t, err)
+	checkErr(t, s.Close())
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	expected := map[string]int{"opened": 2, "accepted": 1, "closed": 2, "reset": 1}
+	for ev, n := range expected {
+		if o.events[ev] != n {
+			t.Errorf("observed %d streams %s, expected %d", o.events[ev], ev, n)
+		}
+	}
+	for s, n := range o.ends {
+		if n != 1 {
+			t.Errorf("end of stream %p observed %d times", s, n)
+		}
+	}
+}
+
+// SubtestNetListener checks that an HTTP server can serve the streams of a
+// connection through smux.NetListener.
+func SubtestNetListener(t testing.TB, tr smux.Transport) {
+	muxa, muxb, done := muxPair(t, tr, nil)
+	defer done()
+	go muxa.AcceptStream()
+
+	l := smux.NetListener(muxb)
+	defer l.Close()
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello %s", r.URL.Path[1:])
+	})}
+	go srv.Serve(l)
+
+	for _, name := range []string{"first", "second"} {
+		s, err := muxa.OpenStream()
+		checkErr(t, err)
+		defer s.Reset()
+		s.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+
+		req, err := http.NewRequest("GET", "http://smux/"+name, nil)
+		checkErr(t, err)
+		req.Close = true
+		checkErr(t, req.Write(s))
+		resp, err := http.ReadResponse(bufio.NewReader(s), req)
+		checkErr(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		checkErr(t, err)
+		if resp.StatusCode != http.StatusOK || string(body) != "hello "+name {
+			t.Fatalf("unexpected response %s %q", resp.Status, body)
+		}
+	}
+
+	checkErr(t, l.Close())
+	if _, err := l.Accept(); err != smux.ErrListenerClosed {
+		t.Fatalf("expected %v accepting on a closed listener, got %v", smux.ErrListenerClosed, err)
+	}
+}
+
+// SubtestHTTPTunnel checks that an HTTP client and server can talk over a
+// connection through smux.NetDialer and smux.NetListener, with keep-alive
+// connections and concurrent requests.
+func SubtestHTTPTunnel(t testing.TB, tr smux.Transport) {
+	muxa, muxb, done := muxPair(t, tr, nil)
+	defer done()
+	go muxa.AcceptStream()
+
+	l := smux.NetListener(muxb)
+	defer l.Close()
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+
+	transport := &http.Transport{DialContext: smux.NetDialer(muxa)}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport, Timeout: scaleTimeout(10 * time.Second)}
+
+	const requests = 20
+	errs := make(chan error, requests)
+	for i := 0; i < requests; i++ {
+		go func(i int) {
+			body := fmt.Sprintf("request %d", i)
+			resp, err := client.Post("http://smux/echo", "text/plain", strings.NewReader(body))
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer resp.Body.Close()
+			echo, err := ioutil.ReadAll(resp.Body)
+			if err == nil && string(echo) != body {
+				err = fmt.Errorf("unexpected response %q to %q", echo, body)
+			}
+			errs <- err
+		}(i)
+	}
+	for i := 0; i < requests; i++ {
+		checkErr(t, <-errs)
+	}
+}
+
+// garbageInputs returns the inputs SubtestGarbageInput writes at the
+// listening side: random bytes, and the bytes a client of tr sends in a
+// short session truncated, corrupted and followed by random bytes.
+func garbageInputs(t testing.TB, tr smux.Transport) map[string][]byte {
+	a, b := connPipe(t)
+	rec := new(transcript)
+	muxa, _, done := muxConns(t, tr, &recordConn{Conn: a, tr: rec}, b, echoStream)
+	defer done()
+	s, err := muxa.OpenStream()
+	checkErr(t, err)
+	s.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+	msg := randBuf(1 << 10)
+	_, err = s.Write(msg)
+	checkErr(t, err)
+	checkErr(t, s.Close())
+	_, err = io.ReadFull(s, make([]byte, len(msg)))
+	checkErr(t, err)
+	muxa.Close()
+	valid := rec.side(false)
+
+	corrupted := append([]byte(nil), valid...)
+	for i := len(corrupted) / 4; i < len(corrupted); i += 1 + mrand.Intn(16) {
+		corrupted[i] ^= byte(1 + mrand.Intn(255))
+	}
+	return map[string][]byte{
+		"random":    randBuf(64 << 10),
+		"truncated": valid[:len(valid)/2],
+		"corrupted": corrupted,
+		"trailing":  append(valid[:len(valid)/2:len(valid)/2], randBuf(4<<10)...),
+	}
+}
+
+// SubtestGarbageInput writes garbage at the listening side of a
+// connection from a raw TCP client, then hangs up, and checks that the
+// connection fails and closes, rather than panicking or hanging, and that
+// none of its goroutines are left behind.
+func SubtestGarbageInput(t testing.TB, tr smux.Transport) {
+	inputs := garbageInputs(t, tr)
+	before := runtime.NumGoroutine()
+
+	for name, input := range inputs {
+		a, b := connPipe(t)
+		go func(input []byte) {
+			a.Write(input)
+			a.Close()
+		}(input)
+
+		c, err := tr.NewConn(b, true)
+		if err != nil {
+			// rejected during the handshake.
+			b.Close()
+			continue
+		}
+		failed := make(chan struct{})
+		go func() {
+			defer close(failed)
+			for {
+				s, err := c.AcceptStream()
+				if err != nil {
+					return
+				}
+				s.SetDeadline(time.Now().Add(scaleTimeout(5 * time.Second)))
+				go func() {
+					io.Copy(ioutil.Discard, s)
+					s.Reset()
+				}()
+			}
+		}()
+		select {
+		case <-failed:
+		case <-time.After(scaleTimeout(10 * time.Second)):
+			c.Close()
+			t.Fatalf("%s input: connection did not fail after the peer hung up", name)
+		}
+		if !c.IsClosed() {
+			t.Errorf("%s input: connection failed but is not closed", name)
+		}
+		c.Close()
+	}
+
+	deadline := time.Now().Add(scaleTimeout(5 * time.Second))
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines left behind", runtime.NumGoroutine()-before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// writeUntilError writes to s until a write fails, and returns that
+// error, or an error describing how writing went on.
+func writeUntilError(s smux.Stream) error {
+	buf := randBuf(1 << 10)
+	deadline := time.Now().Add(scaleTimeout(10 * time.Second))
+	s.SetWriteDeadline(deadline)
+	for time.Now().Before(deadline) {
+		if _, err := s.Write(buf); err != nil {
+			if isTimeout(err) {
+				return fmt.Errorf("write blocked until the deadline")
+			}
+			return err
+		}
+	}
+	return fmt.Errorf("writes kept succeeding")
+}
+
+// SubtestWriteAfterRemoteClose checks what writes to a stream do once the
+// peer is done with it: they keep working after the peer closes the
+// stream, which only closes its writing side, and eventually fail with
+// smux.ErrReset after it resets the stream, or with smux.ErrConnClosed
+// after it closes the connection. Writes are not silently discarded, and
+// never block forever.
+func SubtestWriteAfterRemoteClose(t testing.TB, tr smux.Transport) {
+	muxa, muxb, done := muxPair(t, tr, nil)
+	defer done()
+
+	// open announces a stream with a first write, and returns it with the
+	// peer's end once accepted.
+	open := func(t testing.TB, c smux.Conn, peer smux.Conn) (smux.Stream, smux.Stream) {
+		s, err := c.OpenStream()
+		checkErr(t, err)
+		s.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+		_, err = s.Write([]byte("x"))
+		checkErr(t, err)
+		ps, err := peer.AcceptStream()
+		checkErr(t, err)
+		ps.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+		_, err = io.ReadFull(ps, make([]byte, 1))
+		checkErr(t, err)
+		return s, ps
+	}
+
+	run(t, "close", func(t testing.TB) {
+		s, ps := open(t, muxa, muxb)
+		checkErr(t, ps.Close())
+		if _, err := s.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("expected EOF once the peer closed, got %v", err)
+		}
+		msg := randBuf(64 << 10)
+		werr := make(chan error, 1)
+		go func() {
+			_, err := s.Write(msg)
+			if err == nil {
+				err = s.Close()
+			}
+			werr <- err
+		}()
+		got, err := ioutil.ReadAll(ps)
+		checkErr(t, err)
+		checkErr(t, <-werr)
+		if !bytes.Equal(got, msg) {
+			t.Fatalf("peer read %d bytes of the %d written after it closed", len(got), len(msg))
+		}
+	})
+
+	run(t, "reset", func(t testing.TB) {
+		s, ps := open(t, muxa, muxb)
+		checkErr(t, ps.Reset())
+		if err := writeUntilError(s); err != smux.ErrReset {
+			t.Fatalf("expected %v writing after the peer reset the stream, got %v", smux.ErrReset, err)
+		}
+	})
+
+	run(t, "conn", func(t testing.TB) {
+		s, _ := open(t, muxa, muxb)
+		checkErr(t, muxb.Close())
+		if err := writeUntilError(s); err != smux.ErrConnClosed {
+			t.Fatalf("expected %v writing after the peer closed the connection, got %v", smux.ErrConnClosed, err)
+		}
+	})
+}
+
+// SubtestCloseEOF checks that once a writer closes a stream, the reader
+// gets all the data written before Close, however much of it is buffered,
+// and then io.EOF on every read. Closing the stream again returns nil.
+func SubtestCloseEOF(t testing.TB, tr smux.Transport) {
+	muxa, muxb, done := muxPair(t, tr, nil)
+	defer done()
+
+	// small enough to fit in the receive window of any muxer, so the
+	// writes complete before anything is read.
+	msgs := [][]byte{randBuf(1), randBuf(100), randBuf(4 << 10), randBuf(16 << 10)}
+	var want []byte
+	for _, msg := range msgs {
+		want = append(want, msg...)
+	}
+
+	s, err := muxa.OpenStream()
+	checkErr(t, err)
+	defer s.Reset()
+	s.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+	for _, msg := range msgs {
+		_, err := s.Write(msg)
+		checkErr(t, err)
+	}
+	checkErr(t, s.Close())
+	if err := s.Close(); err != nil {
+		t.Fatalf("closing a closed stream: %v", err)
+	}
+
+	ps, err := muxb.AcceptStream()
+	checkErr(t, err)
+	defer ps.Reset()
+	ps.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+	// give the close time to arrive behind the data.
+	time.Sleep(50 * time.Millisecond)
+
+	var got []byte
+	buf := make([]byte, 1<<10)
+	for {
+		n, err := ps.Read(buf)
+		got = append(got, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("read after %d of %d bytes: %v", len(got), len(want), err)
+		}
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("read %d bytes before EOF, expected the %d written", len(got), len(want))
+	}
+	for i := 0; i < 3; i++ {
+		if n, err := ps.Read(buf); n != 0 || err != io.EOF {
+			t.Fatalf("expected EOF reading again, got %d bytes and %v", n, err)
+		}
+	}
+
+	// the reading side can still write and close, twice.
+	_, err = ps.Write([]byte("bye"))
+	checkErr(t, err)
+	checkErr(t, ps.Close())
+	if err := ps.Close(); err != nil {
+		t.Fatalf("closing a closed stream: %v", err)
+	}
+	resp, err := ioutil.ReadAll(s)
+	checkErr(t, err)
+	if string(resp) != "bye" {
+		t.Fatalf("unexpected response %q", resp)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("closing a stream closed by both sides: %v", err)
+	}
+}
+
+// SubtestCloseRace closes streams, both ends of them and both ends of the
+// connection from several goroutines at once, while other goroutines read,
+// write, open and accept streams. Every call must return, with an error or
+// not, without panicking; run it with -race to catch unsynchronized state.
+func SubtestCloseRace(t testing.TB, tr smux.Transport) {
+	const (
+		streams = 20
+		closers = 4
+	)
+
+	muxa, muxb, done := muxPair(t, tr, nil)
+	defer done()
+
+	var wg sync.WaitGroup
+	spawn := func(f func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f()
+		}()
+	}
+	buf := randBuf(4 << 10)
+	readAll := func(s smux.Stream) {
+		io.Copy(ioutil.Discard, s)
+	}
+	// writes are paced so that muxers which copy in memory do not starve
+	// the closing goroutines of the CPU.
+	writeAll := func(s smux.Stream) {
+		for {
+			if _, err := s.Write(buf); err != nil {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// accepted streams are written to but not read, so that writes of the
+	// opened ones are blocked on a full window while reads of them are
+	// in progress.
+	spawn(func() {
+		for {
+			s, err := muxb.AcceptStream()
+			if err != nil {
+				return
+			}
+			spawn(func() { writeAll(s) })
+		}
+	})
+
+	var opened []smux.Stream
+	for i := 0; i < streams; i++ {
+		s, err := muxa.OpenStream()
+		checkErr(t, err)
+		opened = append(opened, s)
+		spawn(func() { readAll(s) })
+		spawn(func() { writeAll(s) })
+	}
+	// keep opening streams while the connection closes.
+	spawn(func() {
+		for {
+			s, err := muxa.OpenStream()
+			if err != nil {
+				return
+			}
+			s.Write(buf)
+			s.Reset()
+		}
+	})
+	time.Sleep(50 * time.Millisecond)
+
+	start := make(chan struct{})
+	for i := 0; i < closers; i++ {
+		i := i
+		spawn(func() {
+			<-start
+			for _, s := range opened {
+				if i%2 == 0 {
+					s.Close()
+				} else {
+					s.Reset()
+				}
+			}
+		})
+		spawn(func() {
+			<-start
+			muxa.Close()
+		})
+		spawn(func() {
+			<-start
+			muxb.Close()
+		})
+	}
+	close(start)
+
+	returned := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(scaleTimeout(10 * time.Second)):
+		stacks := make([]byte, 1<<20)
+		stacks = stacks[:runtime.Stack(stacks, true)]
+		t.Fatalf("calls blocked after closing the connection\n%s", stacks)
+	}
+	if !muxa.IsClosed() || !muxb.IsClosed() {
+		t.Fatal("connection not closed after Close")
+	}
+
+	// closing again after the dust settles is harmless.
+	for _, s := range opened {
+		s.Close()
+		s.Reset()
+	}
+	muxa.Close()
+	muxb.Close()
+}
+
+const (
+	// backpressureDuration is how long SubtestBackpressure reads slowly.
+	backpressureDuration = 3 * time.Second
+
+	// backpressureMaxHeap bounds how much the heap may grow while a
+	// writer is held back by a slow reader. It is well above the windows
+	// of the muxers in this repository, and far below what an unbounded
+	// buffer takes in the time the test runs.
+	backpressureMaxHeap = 32 << 20
+)
+
+// SubtestBackpressure writes to a stream as fast as possible while the
+// peer reads it at 1KB a second, and checks that flow control holds the
+// writer back: the heap of the process, holding both muxers, must not
+// grow by more than 32MB.
+func SubtestBackpressure(t testing.TB, tr smux.Transport) {
+	muxa, muxb, done := muxPair(t, tr, nil)
+	defer done()
+
+	var before runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	s, err := muxa.OpenStream()
+	checkErr(t, err)
+	defer s.Reset()
+	var written int64
+	werr := make(chan error, 1)
+	go func() {
+		buf := randBuf(32 << 10)
+		for {
+			n, err := s.Write(buf)
+			atomic.AddInt64(&written, int64(n))
+			if err != nil {
+				werr <- err
+				return
+			}
+		}
+	}()
+
+	ps, err := muxb.AcceptStream()
+	checkErr(t, err)
+	defer ps.Reset()
+	buf := make([]byte, 100)
+	read := 0
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+	for end := time.Now().Add(backpressureDuration); time.Now().Before(end); {
+		<-tick.C
+		ps.SetReadDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+		n, err := io.ReadFull(ps, buf)
+		read += n
+		checkErr(t, err)
+	}
+
+	var after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	n := atomic.LoadInt64(&written)
+	log("wrote %d bytes, read %d, heap grew by %d", n, read, int64(after.HeapAlloc)-int64(before.HeapAlloc))
+	select {
+	case err := <-werr:
+		t.Fatalf("write failed while the peer was reading: %v", err)
+	default:
+	}
+	if after.HeapAlloc > before.HeapAlloc && after.HeapAlloc-before.HeapAlloc > backpressureMaxHeap {
+		t.Fatalf("heap grew by %d bytes while %d bytes were written and %d read", after.HeapAlloc-before.HeapAlloc, n, read)
+	}
+
+	// the writer is unblocked once the stream is gone.
+	checkErr(t, ps.Reset())
+	select {
+	case <-werr:
+	case <-time.After(scaleTimeout(10 * time.Second)):
+		t.Fatal("blocked Write did not fail after the peer reset the stream")
+	}
+}
+
+// largeTransferSize is how much SubtestLargeTransfer sends, past the 4GB
+// which 32-bit lengths and counters wrap at.
+const largeTransferSize = 5 << 30
+
+// SubtestLargeTransfer sends 5GB through a single stream, in writes of
+// varying size, and checks that the peer reads exactly the bytes written,
+// by length and CRC-32. It catches truncated lengths, lost window updates
+// and wrapped counters which the stress tests are too short to reach. It
+// can take minutes, so it is skipped unless -smux.long is set.
+func SubtestLargeTransfer(t testing.TB, tr smux.Transport) {
+	if !*longTests {
+		t.Skip("long test, enable with -smux.long")
+	}
+
+	muxa, muxb, done := muxPair(t, tr, nil)
+	defer done()
+
+	start := time.Now()
+	deadline := start.Add(scaleTimeout(30 * time.Minute))
+	s, err := muxa.OpenStream()
+	checkErr(t, err)
+	defer s.Reset()
+	s.SetDeadline(deadline)
+
+	type summary struct {
+		n   int64
+		sum uint32
+		err error
+	}
+	sent := make(chan summary, 1)
+	random := randomBytes()
+	go func() {
+		h := crc32.NewIEEE()
+		var n int64
+		for i := 0; n < largeTransferSize; i++ {
+			size := 32<<10 + i%32<<10
+			if rest := largeTransferSize - n; int64(size) > rest {
+				size = int(rest)
+			}
+			off := i * 7919 % (len(random) - size)
+			chunk := random[off : off+size]
+			if _, err := s.Write(chunk); err != nil {
+				sent <- summary{n, h.Sum32(), err}
+				return
+			}
+			h.Write(chunk)
+			n += int64(size)
+		}
+		sent <- summary{n, h.Sum32(), s.Close()}
+	}()
+
+	ps, err := muxb.AcceptStream()
+	checkErr(t, err)
+	defer ps.Reset()
+	ps.SetDeadline(deadline)
+	h := crc32.NewIEEE()
+	n, err := io.Copy(h, ps)
+	if err != nil {
+		t.Fatalf("read failed after %d bytes: %v", n, err)
+	}
+	w := <-sent
+	checkErr(t, w.err)
+	if n != w.n {
+		t.Fatalf("read %d bytes, expected %d", n, w.n)
+	}
+	if sum := h.Sum32(); sum != w.sum {
+		t.Fatalf("read bytes with CRC-32 %08x, expected %08x", sum, w.sum)
+	}
+	elapsed := time.Since(start)
+	log("sent %d bytes in %s, %.1f MB/s", n, elapsed.Round(time.Second), float64(n)/elapsed.Seconds()/(1<<20))
+}
+
+// idleStreams is the number of streams SubtestIdleStreams opens.
+const idleStreams = 50000
+
+// SubtestIdleStreams opens 50000 streams, sends a byte on each and leaves
+// them idle, and reports what they cost: the heap and goroutines of both
+// muxers, per stream. Muxers running goroutines for each stream show up
+// with a goroutine or more per stream. The count is scaled by -smux.scale,
+// and bounded under -race to stay below its goroutine limit.
+func SubtestIdleStreams(t testing.TB, tr smux.Transport) {
+	n := scaleSize(t, idleStreams)
+	if raceEnabled && n > maxRaceStressGoroutines {
+		n = maxRaceStressGoroutines
+	}
+
+	muxa, muxb, done := muxPair(t, tr, nil)
+	defer done()
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	goroutines := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithTimeout(context.Background(), scaleTimeout(time.Minute))
+	defer cancel()
+	accepted := make(chan []smux.Stream, 1)
+	acceptErr := make(chan error, 1)
+	go func() {
+		streams := make([]smux.Stream, 0, n)
+		buf := make([]byte, 1)
+		for len(streams) < n {
+			s, err := muxb.AcceptStream()
+			if err == nil {
+				_, err = io.ReadFull(s, buf)
+			}
+			if err != nil {
+				acceptErr <- fmt.Errorf("accepted %d streams: %v", len(streams), err)
+				return
+			}
+			streams = append(streams, s)
+		}
+		accepted <- streams
+	}()
+
+	opened := make([]smux.Stream, 0, n)
+	for len(opened) < n {
+		s, err := smux.OpenStreamContext(ctx, muxa)
+		if err == nil {
+			_, err = s.Write([]byte("x"))
+		}
+		if err != nil {
+			t.Fatalf("opened %d streams of %d: %v", len(opened), n, err)
+		}
+		opened = append(opened, s)
+	}
+	var streams []smux.Stream
+	select {
+	case streams = <-accepted:
+	case err := <-acceptErr:
+		t.Fatal(err)
+	case <-ctx.Done():
+		t.Fatalf("accepting %d streams timed out", n)
+	}
+
+	// let the muxers settle, such as goroutines started for the streams.
+	time.Sleep(100 * time.Millisecond)
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	perStream := float64(int64(after.HeapAlloc)-int64(before.HeapAlloc)) / float64(n)
+	perStreamGoroutines := float64(runtime.NumGoroutine()-goroutines) / float64(n)
+	log("%d idle streams: %.0f bytes and %.2f goroutines per stream", n, perStream, perStreamGoroutines)
+
+	for i := range opened {
+		opened[i].Reset()
+		streams[i].Reset()
+	}
+}
+
+const (
+	// churnStreams is the number of streams SubtestStreamChurn opens.
+	churnStreams = 200000
+	// longChurnStreams is the number it opens with -smux.long, past the
+	// 2^24 streams wire formats with IDs of 24 bits or fewer run out at.
+	longChurnStreams = 1<<24 + 1<<10
+	// churnWorkers is the number of streams open at once.
+	churnWorkers = 16
+)
+
+// SubtestStreamChurn opens, echoes and closes 200000 short-lived streams,
+// 16 at a time, or over 2^24 with -smux.long, while a first stream stays
+// open. Every stream must get its own data back, and no stream may reuse
+// the ID of the first one, so IDs wrapping around are caught rather than
+// silently misrouting data. With -smux.long, a muxer running out of IDs
+// may also refuse to open more streams, with an error, as long as the
+// first stream keeps working; SubtestStreamIDLimit covers wire formats
+// with 31 or 32 bit IDs. The count is scaled by -smux.scale and reduced
+// under -race, outside of long mode.
+func SubtestStreamChurn(t testing.TB, tr smux.Transport) {
+	n := int64(scaleCount(t, churnStreams))
+	if *longTests {
+		n = longChurnStreams
+	}
+
+	muxa, muxb, done := muxPair(t, tr, nil)
+	defer done()
+
+	errs := make(chan error, churnWorkers+1)
+	report := func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+
+	first, err := muxa.OpenStream()
+	checkErr(t, err)
+	defer first.Reset()
+	firstID, hasIDs := smux.StreamID(first)
+	// the first stream is echoed before the others are opened, so it is
+	// the first accepted.
+	var accepted int64
+	defer serveConn(t, muxb, func(s smux.Stream) {
+		if id, _ := smux.StreamID(s); atomic.AddInt64(&accepted, 1) > 1 && hasIDs && id == firstID {
+			report(fmt.Errorf("accepted a stream with the ID %d of the first stream", id))
+		}
+		io.Copy(s, s)
+		s.Close()
+	})()
+
+	echo := func(s smux.Stream, msg []byte) error {
+		s.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+		if _, err := s.Write(msg); err != nil {
+			return err
+		}
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(s, got); err != nil {
+			return err
+		}
+		if !bytes.Equal(got, msg) {
+			return fmt.Errorf("stream echoed %x, expected %x", got, msg)
+		}
+		return nil
+	}
+	checkErr(t, echo(first, []byte("first")))
+
+	var (
+		next    int64
+		wg      sync.WaitGroup
+		refused = make(chan error, 1)
+	)
+	for w := 0; w < churnWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			msg := make([]byte, 8)
+			for {
+				i := atomic.AddInt64(&next, 1)
+				if i > n {
+					return
+				}
+				s, err := muxa.OpenStream()
+				if err != nil {
+					select {
+					case refused <- fmt.Errorf("opening stream %d: %v", i, err):
+					default:
+					}
+					atomic.StoreInt64(&next, n)
+					return
+				}
+				if id, _ := smux.StreamID(s); hasIDs && id == firstID {
+					report(fmt.Errorf("stream %d reused the ID %d of the first stream", i, id))
+				}
+				binary.BigEndian.PutUint64(msg, uint64(i))
+				err = echo(s, msg)
+				if err == nil {
+					err = s.Close()
+				}
+				if err == nil {
+					_, err = ioutil.ReadAll(s)
+				}
+				if err != nil {
+					s.Reset()
+					report(fmt.Errorf("stream %d: %v", i, err))
+					atomic.StoreInt64(&next, n)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		t.Fatal(err)
+	default:
+	}
+	select {
+	case err := <-refused:
+		if !*longTests {
+			t.Fatal(err)
+		}
+		log("muxer stopped opening streams: %v", err)
+	default:
+	}
+
+	// the first stream still gets its own data back, and only that.
+	checkErr(t, echo(first, []byte("first again")))
+	first.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := first.Read(make([]byte, 1)); n > 0 || !isTimeout(err) {
+		t.Fatalf("first stream read %d unexpected bytes, error %v", n, err)
+	}
+}
+
+// streamIDsLeft is the number of streams SubtestStreamIDLimit lets each
+// side open before it uses up its stream IDs.
+const streamIDsLeft = 4
+
+// SubtestStreamIDLimit starts the connections of the bundled muxers whose
+// stream IDs take too long to use up, those of 31 or 32 bits, 4 streams
+// short of their last ID, and opens 6 streams from each side. The first 4
+// must open; past them, opening must either fail or wrap around to IDs no
+// open stream holds, and every stream opened must keep getting its own
+// data back. Other transports are skipped.
+func SubtestStreamIDLimit(t testing.TB, tr smux.Transport) {
+	tr, ok := testhooks.WithStreamIDsLeft(tr, streamIDsLeft)
+	if !ok {
+		t.Skip("transport cannot start near its last stream ID")
+	}
+
+	muxa, muxb, done := muxPair(t, tr, nil)
+	defer done()
+	defer serveConn(t, muxb, echoStream)()
+	defer serveConn(t, muxa, echoStream)()
+
+	echo := func(s smux.Stream, msg string) error {
+		s.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+		if _, err := s.Write([]byte(msg)); err != nil {
+			return err
+		}
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(s, got); err != nil {
+			return err
+		}
+		if string(got) != msg {
+			return fmt.Errorf("stream echoed %q, expected %q", got, msg)
+		}
+		return nil
+	}
+
+	for _, side := range []struct {
+		name string
+		c    smux.Conn
+	}{{"client", muxa}, {"server", muxb}} {
+		var opened []smux.Stream
+		ids := make(map[uint64]bool)
+		for i := 0; i < streamIDsLeft+2; i++ {
+			s, err := side.c.OpenStream()
+			if err != nil {
+				if i < streamIDsLeft {
+					t.Fatalf("%s stream %d failed to open with IDs left: %v", side.name, i, err)
+				}
+				log("%s stopped opening streams: %v", side.name, err)
+				break
+			}
+			defer s.Reset()
+			if id, ok := smux.StreamID(s); ok {
+				if ids[id] {
+					t.Fatalf("%s stream %d reused the ID %d of an open stream", side.name, i, id)
+				}
+				ids[id] = true
+			}
+			checkErr(t, echo(s, fmt.Sprintf("%s stream %d", side.name, i)))
+			opened = append(opened, s)
+		}
+		// the streams opened keep their data apart after the last ID.
+		for i, s := range opened {
+			checkErr(t, echo(s, fmt.Sprintf("%s stream %d again", side.name, i)))
+		}
+	}
+}
+
+const (
+	// keepAliveInterval and keepAliveFailures are the keepalive settings
+	// of SubtestKeepAlive.
+	keepAliveInterval = 100 * time.Millisecond
+	keepAliveFailures = 3
+)
+
+// SubtestKeepAlive checks that a connection with keepalives enabled stays
+// open while the peer answers them, and is closed once the peer goes
+// silent without closing the connection, within the configured interval
+// times the number of failures, give or take an interval. A Read blocked
+// on one of its streams then fails. It is skipped for muxers which do not
+// support the keepalive Options.
+func SubtestKeepAlive(t testing.TB, tr smux.Transport) {
+	skipNoWire(t, tr)
+	ktr, err := smux.WithConfig(tr, smux.Options{
+		KeepAliveInterval: keepAliveInterval,
+		KeepAliveFailures: keepAliveFailures,
+	})
+	if err == smux.ErrNotSupported {
+		t.Skip("transport does not support keepalive options")
+	}
+	checkErr(t, err)
+
+	a, b := connPipe(t)
+	defer a.Close()
+	defer b.Close()
+	wa := newWedgeConn(a)
+
+	muxb, err := tr.NewConn(b, true)
+	checkErr(t, err)
+	defer muxb.Close()
+	muxa, err := ktr.NewConn(wa, false)
+	checkErr(t, err)
+	defer muxa.Close()
+
+	s, err := muxa.OpenStream()
+	checkErr(t, err)
+	defer s.Reset()
+	_, err = s.Write([]byte("x"))
+	checkErr(t, err)
+	ps, err := muxb.AcceptStream()
+	checkErr(t, err)
+	defer ps.Reset()
+	ps.SetReadDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+	_, err = io.ReadFull(ps, make([]byte, 1))
+	checkErr(t, err)
+
+	deadAfter := keepAliveInterval * (keepAliveFailures + 1)
+	time.Sleep(2 * deadAfter)
+	if muxa.IsClosed() {
+		t.Fatal("keepalive closed a connection whose peer answers")
+	}
+
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := s.Read(make([]byte, 1))
+		readErr <- err
+	}()
+
+	wa.wedge()
+	start := time.Now()
+	limit := time.After(scaleTimeout(deadAfter + keepAliveInterval))
+	for !muxa.IsClosed() {
+		select {
+		case <-limit:
+			t.Fatalf("connection to a dead peer still open after %s", time.Since(start))
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	log("dead peer detected after %s", time.Since(start))
+
+	select {
+	case err := <-readErr:
+		if err == nil || err == io.EOF {
+			t.Fatalf("expected a blocked Read to fail once the peer is found dead, got %v", err)
+		}
+	case <-time.After(scaleTimeout(time.Second)):
+		t.Fatal("blocked Read did not return once the peer was found dead")
+	}
+}
+
+// SubtestKeepAliveEmulated checks the keepalives of smux.WithKeepAlive,
+// with the keepalive settings of SubtestKeepAlive on both sides: the
+// connection stays open and answers pings while the peer answers, and once
+// one side goes silent without closing the connection, both are closed
+// within the interval times the number of failures, give or take an
+// interval, closing their CloseChan and failing a Read blocked on one of
+// their streams.
+func SubtestKeepAliveEmulated(t testing.TB, tr smux.Transport) {
+	skipNoWire(t, tr)
+	ktr := smux.WithKeepAlive(tr, keepAliveInterval, keepAliveFailures)
+
+	a, b := connPipe(t)
+	defer a.Close()
+	defer b.Close()
+	wa := newWedgeConn(a)
+
+	type established struct {
+		c   smux.Conn
+		err error
+	}
+	listened := make(chan established, 1)
+	go func() {
+		c, err := ktr.NewConn(b, true)
+		listened <- established{c, err}
+	}()
+	muxa, err := ktr.NewConn(wa, false)
+	checkErr(t, err)
+	defer muxa.Close()
+	l := <-listened
+	checkErr(t, l.err)
+	muxb := l.c
+	defer muxb.Close()
+
+	s, err := muxa.OpenStream()
+	checkErr(t, err)
+	defer s.Reset()
+	_, err = s.Write([]byte("x"))
+	checkErr(t, err)
+	ps, err := muxb.AcceptStream()
+	checkErr(t, err)
+	defer ps.Reset()
+	ps.SetReadDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+	_, err = io.ReadFull(ps, make([]byte, 1))
+	checkErr(t, err)
+
+	deadAfter := keepAliveInterval * (keepAliveFailures + 1)
+	time.Sleep(2 * deadAfter)
+	if muxa.IsClosed() || muxb.IsClosed() {
+		t.Fatal("keepalive closed a connection whose peer answers")
+	}
+	rtt, err := smux.Ping(muxa)
+	checkErr(t, err)
+	log("ping next to the keepalives: %s", rtt)
+	if atomic.LoadInt64(&wa.written) == 0 {
+		missingWire(t, tr)
+	}
+
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := s.Read(make([]byte, 1))
+		readErr <- err
+	}()
+
+	wa.wedge()
+	start := time.Now()
+	limit := time.After(scaleTimeout(deadAfter + keepAliveInterval))
+	for _, c := range []smux.Conn{muxa, muxb} {
+		select {
+		case <-smux.CloseChan(c):
+		case <-limit:
+			t.Fatalf("connection to a dead peer still open after %s", time.Since(start))
+		}
+	}
+	log("dead peer detected on both sides after %s", time.Since(start))
+	// the first side closed was closed by its keepalive, the other maybe
+	// by the first.
+	if erra, errb := smux.Wait(muxa), smux.Wait(muxb); erra != smux.ErrKeepAliveTimeout && errb != smux.ErrKeepAliveTimeout {
+		t.Errorf("connections to a dead peer ended with %v and %v, expected %v", erra, errb, smux.ErrKeepAliveTimeout)
+	}
+
+	select {
+	case err := <-readErr:
+		if err == nil || err == io.EOF {
+			t.Fatalf("expected a blocked Read to fail once the peer is found dead, got %v", err)
+		}
+	case <-time.After(scaleTimeout(time.Second)):
+		t.Fatal("blocked Read did not return once the peer was found dead")
+	}
+}
+
+// SubtestCompression checks that smux.WithCompression echoes data the
+// same, in either of two formats the sides list in a different order, in
+// a fraction of the bytes on the wire, and that it resets the streams of
+// a format the peer does not have.
+func SubtestCompression(t testing.TB, tr smux.Transport) {
+	a, b := connPipe(t)
+	defer a.Close()
+	defer b.Close()
+	ca := newCountConn(a)
+
+	muxb, err := smux.WithCompression(tr, smux.Deflate, smux.Gzip).NewConn(b, true)
+	checkErr(t, err)
+	defer muxb.Close()
+	defer serveConn(t, muxb, echoStream)()
+
+	muxa, err := smux.WithCompression(tr, smux.Gzip, smux.Deflate).NewConn(ca, false)
+	checkErr(t, err)
+	defer muxa.Close()
+
+	msg := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog; "), 20000)
+	s, err := muxa.OpenStream()
+	checkErr(t, err)
+	defer s.Reset()
+	s.SetDeadline(time.Now().Add(scaleTimeout(20 * time.Second)))
+	werr := make(chan error, 1)
+	go func() {
+		_, err := s.Write(msg)
+		if err == nil {
+			err = s.Close()
+		}
+		werr <- err
+	}()
+	got, err := ioutil.ReadAll(s)
+	checkErr(t, err)
+	checkErr(t, <-werr)
+	if !bytes.Equal(got, msg) {
+		t.Fatalf("compressed stream echoed %d bytes different from the %d written", len(got), len(msg))
+	}
+	wire := ca.written() + ca.read()
+	log("echoed %d bytes each way in %d bytes on the wire", len(msg), wire)
+	if wire == 0 {
+		log("connection does not go over the net.Conn, not checking the bytes on the wire")
+	} else if wire > int64(len(msg))/2 {
+		t.Fatalf("echoing %d bytes each way took %d bytes on the wire, expected under a quarter", len(msg), wire)
+	}
+
+	c, d := connPipe(t)
+	defer c.Close()
+	defer d.Close()
+	muxd, err := smux.WithCompression(tr, smux.Gzip).NewConn(d, true)
+	checkErr(t, err)
+	defer muxd.Close()
+	defer serveConn(t, muxd, echoStream)()
+	muxc, err := smux.WithCompression(tr, smux.Deflate).NewConn(c, false)
+	checkErr(t, err)
+	defer muxc.Close()
+
+	s, err = muxc.OpenStream()
+	checkErr(t, err)
+	defer s.Reset()
+	s.SetDeadline(time.Now().Add(scaleTimeout(5 * time.Second)))
+	_, err = s.Write([]byte("x"))
+	checkErr(t, err)
+	if _, err := s.Read(make([]byte, 1)); err != smux.ErrReset {
+		log("reading a stream in a format the peer does not have: %v", err)
+		missingFeature(t, tr, smux.FeatureReset, "stream in an unknown format not reset")
+	}
+}
+
+// SubtestRateLimits checks that smux.WithRateLimits holds the writes of a
+// stream, of the streams of a connection together, and the reads of a
+// stream to their limits, set when wrapping the connection, with
+// SetRateLimits and with SetStreamRateLimit.
+func SubtestRateLimits(t testing.TB, tr smux.Transport) {
+	const rate = 1 << 20
+	limit := smux.RateLimit{Rate: rate, Burst: 16 << 10}
+
+	na, nb, done := muxPair(t, tr, nil)
+	defer done()
+	muxb := smux.WithRateLimits(nb, smux.RateLimits{})
+	defer muxb.Close()
+	defer serveConn(t, muxb, func(s smux.Stream) {
+		io.Copy(ioutil.Discard, s)
+		s.Close()
+	})()
+	muxa := smux.WithRateLimits(na, smux.RateLimits{StreamWrite: limit})
+	defer muxa.Close()
+
+	// send sends the streams of n bytes each together, and returns once
+	// the peer read them all.
+	send := func(n int, streams int, setup func(s smux.Stream)) time.Duration {
+		start := time.Now()
+		errs := make(chan error, streams)
+		for i := 0; i < streams; i++ {
+			go func() {
+				s, err := muxa.OpenStream()
+				if err != nil {
+					errs <- err
+					return
+				}
+				defer s.Reset()
+				if setup != nil {
+					setup(s)
+				}
+				s.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+				if _, err := s.Write(make([]byte, n)); err != nil {
+					errs <- err
+					return
+				}
+				s.Close()
+				_, err = ioutil.ReadAll(s)
+				errs <- err
+			}()
+		}
+		for i := 0; i < streams; i++ {
+			checkErr(t, <-errs)
+		}
+		return time.Since(start)
+	}
+	// expect fails t if sending n bytes in all took less than the limit
+	// allows, with some slack for the timers.
+	expect := func(what string, n int, took time.Duration) {
+		min := time.Duration(n-limit.Burst) * time.Second / rate * 8 / 10
+		log("%s: %d bytes in %s, limited to at least %s", what, n, took, min)
+		if took < min {
+			t.Fatalf("%s: %d bytes sent in %s, faster than the limit of %d bytes/s allows", what, n, took, rate)
+		}
+	}
+
+	const size = 256 << 10
+	expect("stream write limit", size, send(size, 1, nil))
+
+	muxa.SetRateLimits(smux.RateLimits{ConnWrite: limit})
+	expect("connection write limit", 2*size, send(size, 2, nil))
+
+	muxa.SetRateLimits(smux.RateLimits{})
+	expect("SetStreamRateLimit", size, send(size, 1, func(s smux.Stream) {
+		checkErr(t, smux.SetStreamRateLimit(s, smux.RateLimit{}, limit))
+	}))
+
+	muxb.SetRateLimits(smux.RateLimits{StreamRead: limit})
+	expect("stream read limit", size, send(size, 1, nil))
+}
+
+// SubtestGoAway checks that a connection whose peer closes it after
+// accepting one of two streams reports, from the peer's GoAway, the first
+// as the last accepted, so that the second can be retried elsewhere.
+func SubtestGoAway(t testing.TB, tr smux.Transport) {
+	muxa, muxb, done := muxPair(t, tr, nil)
+	defer done()
+	if _, ok := muxa.(smux.GoAwayConn); !ok {
+		missingFeature(t, tr, smux.FeatureGoAway, "connection does not implement LastAcceptedStreamID")
+	}
+	if _, ok := smux.LastAcceptedStreamID(muxa); ok {
+		t.Fatal("LastAcceptedStreamID reported before the peer shut the connection down")
+	}
+
+	var ids []uint64
+	for i := 0; i < 2; i++ {
+		s, err := muxa.OpenStream()
+		checkErr(t, err)
+		defer s.Reset()
+		_, err = s.Write([]byte("x"))
+		checkErr(t, err)
+		id, ok := smux.StreamID(s)
+		if !ok {
+			t.Fatal("streams of a GoAwayConn do not implement ID")
+		}
+		ids = append(ids, id)
+	}
+	ps, err := muxb.AcceptStream()
+	checkErr(t, err)
+	ps.SetReadDeadline(time.Now().Add(scaleTimeout(5 * time.Second)))
+	_, err = io.ReadFull(ps, make([]byte, 1))
+	checkErr(t, err)
+	muxb.Close()
+
+	deadline := time.Now().Add(scaleTimeout(5 * time.Second))
+	for {
+		last, ok := smux.LastAcceptedStreamID(muxa)
+		if ok {
+			if last != ids[0] {
+				t.Fatalf("peer accepted stream %d of %v, but LastAcceptedStreamID reports %d", ids[0], ids, last)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("LastAcceptedStreamID not reported after the peer closed the connection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// stallTracer records the window stalls and resumes reported to it.
+type stallTracer struct {
+	mu      sync.Mutex
+	stalls  int
+	stalled time.Duration
+}
+
+func (*stallTracer) StreamOpened(smux.StreamEvent)  {}
+func (*stallTracer) FirstByteRead(smux.StreamEvent) {}
+func (*stallTracer) StreamClosed(smux.StreamEvent)  {}
+
+func (t *stallTracer) WindowStalled(smux.StreamEvent) {
+	t.mu.Lock()
+	t.stalls++
+	t.mu.Unlock()
+}
+
+func (t *stallTracer) WindowResumed(ev smux.StreamEvent) {
+	t.mu.Lock()
+	t.stalled += ev.Stalled
+	t.mu.Unlock()
+}
+
+// SubtestWindowStall checks that a write waiting for the peer to read is
+// counted as a window stall, for as long as it waited, by the statistics
+// of smux.WithStats and by a smux.WindowResumeTracer of smux.WithTracer
+// on top of them, for muxers declaring smux.FeatureEvents.
+func SubtestWindowStall(t testing.TB, tr smux.Transport) {
+	c, muxb, done := muxPair(t, tr, nil)
+	defer done()
+	if _, ok := c.(smux.EventReporter); !ok {
+		missingFeature(t, tr, smux.FeatureEvents, "connection does not report window stalls")
+	}
+	stats := smux.WithStats(c)
+	tracer := &stallTracer{}
+	muxa := smux.WithTracer(stats, tracer)
+
+	s, err := muxa.OpenStream()
+	checkErr(t, err)
+	defer s.Reset()
+	s.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+	const size = 4 << 20
+	werr := make(chan error, 1)
+	go func() {
+		buf := randBuf(size / 4)
+		for i := 0; i < 4; i++ {
+			if _, err := s.Write(buf); err != nil {
+				werr <- err
+				return
+			}
+		}
+		werr <- nil
+	}()
+
+	ps, err := muxb.AcceptStream()
+	checkErr(t, err)
+	defer ps.Reset()
+	const pause = 200 * time.Millisecond
+	time.Sleep(pause)
+	st, _ := smux.StreamStats(s)
+	if st.WindowStalls == 0 {
+		t.Fatal("write blocked on the peer not reported as a window stall")
+	}
+	ps.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+	_, err = io.ReadFull(ps, make([]byte, size))
+	checkErr(t, err)
+	checkErr(t, <-werr)
+
+	st, _ = smux.StreamStats(s)
+	cst := stats.Stat()
+	log("stream stalled %d times for %s, connection %d times for %s", st.WindowStalls, st.WindowStalled, cst.WindowStalls, cst.WindowStalled)
+	if st.WindowStalled < pause/2 || cst.WindowStalled < pause/2 {
+		t.Errorf("writes stalled %s by the stream's statistics and %s by the connection's, expected over %s", st.WindowStalled, cst.WindowStalled, pause/2)
+	}
+	if cst.WindowStalls < st.WindowStalls {
+		t.Errorf("connection counts %d window stalls, fewer than the %d of its stream", cst.WindowStalls, st.WindowStalls)
+	}
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	if tracer.stalls < int(st.WindowStalls) || tracer.stalled < pause/2 {
+		t.Errorf("tracer told of %d stalls for %s, expected %d for over %s", tracer.stalls, tracer.stalled, st.WindowStalls, pause/2)
+	}
+}
+
+// checkClosedOp checks that op, an operation on a stream or connection
+// closed locally, returns want at once, rather than blocking, panicking or
+// succeeding.
+func checkClosedOp(t testing.TB, what string, want error, op func() (int, error)) {
+	type result struct {
+		n   int
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- result{err: fmt.Errorf("panic: %v", r)}
+			}
+		}()
+		n, err := op()
+		done <- result{n, err}
+	}()
+	select {
+	case r := <-done:
+		if r.n != 0 || r.err != want {
+			t.Errorf("%s returned (%d, %v), expected (0, %v)", what, r.n, r.err, want)
+		}
+	case <-time.After(scaleTimeout(time.Second)):
+		t.Errorf("%s blocked, expected %v", what, want)
+	}
+}
+
+// SubtestLocalClose checks that operations after a local Close, Reset or
+// connection Close return the standard errors immediately: writes on a
+// closed stream smux.ErrStreamClosed, reads and writes on a reset stream
+// smux.ErrReset, and everything on a closed connection
+// smux.ErrConnClosed.
+func SubtestLocalClose(t testing.TB, tr smux.Transport) {
+	muxa, _, done := muxPair(t, tr, func(s smux.Stream) {
+		io.Copy(ioutil.Discard, s)
+	})
+	defer done()
+
+	buf := []byte("foo")
+	read := func(s smux.Stream) func() (int, error) {
+		return func() (int, error) { return s.Read(make([]byte, len(buf))) }
+	}
+	write := func(s smux.Stream) func() (int, error) {
+		return func() (int, error) { return s.Write(buf) }
+	}
+
+	closed, err := muxa.OpenStream()
+	checkErr(t, err)
+	_, err = closed.Write(buf)
+	checkErr(t, err)
+	checkErr(t, closed.Close())
+	checkClosedOp(t, "Write after Close", smux.ErrStreamClosed, write(closed))
+	checkClosedOp(t, "second Write after Close", smux.ErrStreamClosed, write(closed))
+	checkErr(t, closed.Close())
+
+	reset, err := muxa.OpenStream()
+	checkErr(t, err)
+	_, err = reset.Write(buf)
+	checkErr(t, err)
+	reset.Reset()
+	checkClosedOp(t, "Write after Reset", smux.ErrReset, write(reset))
+	checkClosedOp(t, "Read after Reset", smux.ErrReset, read(reset))
+
+	open, err := muxa.OpenStream()
+	checkErr(t, err)
+	_, err = open.Write(buf)
+	checkErr(t, err)
+	checkErr(t, muxa.Close())
+	checkClosedOp(t, "Write after the connection's Close", smux.ErrConnClosed, write(open))
+	checkClosedOp(t, "Read after the connection's Close", smux.ErrConnClosed, read(open))
+	checkClosedOp(t, "OpenStream after Close", smux.ErrConnClosed, func() (int, error) {
+		_, err := muxa.OpenStream()
+		return 0, err
+	})
+	checkClosedOp(t, "AcceptStream after Close", smux.ErrConnClosed, func() (int, error) {
+		_, err := muxa.AcceptStream()
+		return 0, err
+	})
+}
+
+// SubtestOpenBeforeServe checks that a stream opened and written to right
+// after NewConn on the client, before the server side of the connection
+// called NewConn, delivers its data once the server starts, whether the
+// client's OpenStream and Write buffered or blocked until then.
+func SubtestOpenBeforeServe(t testing.TB, tr smux.Transport) {
+	a, b := connPipe(t)
+	defer a.Close()
+	defer b.Close()
+
+	msg := randBuf(16 << 10)
+	type result struct {
+		c   smux.Conn
+		err error
+	}
+	opened := make(chan struct{})
+	done := make(chan result, 1)
+	go func() {
+		muxa, err := tr.NewConn(a, false)
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		s, err := muxa.OpenStream()
+		if err == nil {
+			s.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+			if _, err = s.Write(msg); err == nil {
+				close(opened)
+				err = s.Close()
+			}
+		}
+		done <- result{muxa, err}
+	}()
+
+	select {
+	case <-opened:
+		log("stream opened and written before the server started")
+	case <-time.After(50 * time.Millisecond):
+		log("stream open or write waits for the server")
+	}
+
+	muxb, err := tr.NewConn(b, true)
+	checkErr(t, err)
+	defer muxb.Close()
+	str, err := muxb.AcceptStream()
+	checkErr(t, err)
+	defer str.Reset()
+	str.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+	got, err := ioutil.ReadAll(str)
+	checkErr(t, err)
+	if !bytes.Equal(got, msg) {
+		t.Fatalf("server read %d bytes, expected the %d written before it started", len(got), len(msg))
+	}
+
+	select {
+	case r := <-done:
+		checkErr(t, r.err)
+		r.c.Close()
+	case <-time.After(scaleTimeout(10 * time.Second)):
+		t.Fatal("client still blocked once the server read its data")
+	}
+}
+
+// SubtestWait checks that smux.Wait blocks until the connection ends, and
+// returns nil on a connection closed with Close, smux.ErrGoAway on its
+// peer, and an error other than those when the underlying net.Conn
+// failed. It is skipped for muxers that are not a smux.WaitConn.
+func SubtestWait(t testing.TB, tr smux.Transport) {
+	pair := func() (smux.Conn, smux.Conn, net.Conn) {
+		a, b := connPipe(t)
+		muxb, err := tr.NewConn(b, true)
+		checkErr(t, err)
+		muxa, err := tr.NewConn(a, false)
+		checkErr(t, err)
+		// the connection is up once a stream went through.
+		go func() {
+			if s, err := muxb.AcceptStream(); err == nil {
+				echoStream(s)
+			}
+		}()
+		s, err := muxa.OpenStream()
+		checkErr(t, err)
+		s.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+		_, err = s.Write([]byte("x"))
+		checkErr(t, err)
+		_, err = io.ReadFull(s, make([]byte, 1))
+		checkErr(t, err)
+		s.Close()
+		return muxa, muxb, a
+	}
+	wait := func(c smux.Conn) <-chan error {
+		waited := make(chan error, 1)
+		go func() { waited <- smux.Wait(c) }()
+		return waited
+	}
+	ended := func(what string, waited <-chan error) error {
+		select {
+		case err := <-waited:
+			return err
+		case <-time.After(scaleTimeout(5 * time.Second)):
+			t.Fatalf("Wait of %s did not return once it ended", what)
+			return nil
+		}
+	}
+
+	muxa, muxb, a := pair()
+	defer a.Close()
+	defer muxa.Close()
+	defer muxb.Close()
+	if _, ok := muxa.(smux.WaitConn); !ok {
+		missingFeature(t, tr, smux.FeatureWait, "connection does not tell why it ended")
+	}
+	waita, waitb := wait(muxa), wait(muxb)
+	select {
+	case err := <-waita:
+		t.Fatalf("Wait returned %v on an open connection", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	checkErr(t, muxa.Close())
+	if err := ended("a closed connection", waita); err != nil {
+		t.Errorf("Wait returned %v on a connection closed with Close, expected nil", err)
+	}
+	if err := ended("the peer of a closed connection", waitb); err != smux.ErrGoAway {
+		t.Errorf("Wait returned %v on a connection closed by its peer, expected %v", err, smux.ErrGoAway)
+	}
+
+	muxa, muxb, a = pair()
+	defer a.Close()
+	defer muxa.Close()
+	defer muxb.Close()
+	waita, waitb = wait(muxa), wait(muxb)
+	a.Close()
+	for _, w := range []struct {
+		side   string
+		waited <-chan error
+	}{{"the failed side", waita}, {"its peer", waitb}} {
+		err := ended("a connection whose net.Conn failed", w.waited)
+		log("connection whose net.Conn failed ended on %s with %v", w.side, err)
+		if err == nil || err == smux.ErrGoAway {
+			t.Errorf("Wait returned %v on %s of a connection whose net.Conn failed, expected its error", err, w.side)
+		}
+	}
+}
+
+// SubtestResetCodes checks that the peer of a stream reset with
+// ResetWithError reads the code, in an error which is smux.ErrReset to
+// errors.Is, and that code 0 is read as a plain reset.
+func SubtestResetCodes(t testing.TB, tr smux.Transport) {
+	readErrs := make(chan error, 2)
+	muxa, _, done := muxPair(t, tr, func(s smux.Stream) {
+		_, err := io.Copy(ioutil.Discard, s)
+		readErrs <- err
+	})
+	defer done()
+
+	reset := func(code uint32) error {
+		s, err := muxa.OpenStream()
+		checkErr(t, err)
+		_, err = s.Write([]byte("foo"))
+		checkErr(t, err)
+		// the peer has the stream before it is reset.
+		time.Sleep(50 * time.Millisecond)
+		if err := smux.ResetWithError(s, code); err == smux.ErrNotSupported {
+			s.Reset()
+			missingFeature(t, tr, smux.FeatureResetCodes, "stream does not implement ResetWithError")
+		} else {
+			checkErr(t, err)
+		}
+		select {
+		case err := <-readErrs:
+			return err
+		case <-time.After(scaleTimeout(5 * time.Second)):
+			t.Fatalf("peer did not read the reset of a stream reset with code %d", code)
+			return nil
+		}
+	}
+
+	err := reset(42)
+	log("peer of a stream reset with code 42 read %v", err)
+	if code, ok := smux.ResetCode(err); !ok || code != 42 {
+		t.Errorf("peer of a stream reset with code 42 read %v, expected a smux.StreamError of code 42", err)
+	}
+	if !errors.Is(err, smux.ErrReset) {
+		t.Errorf("error %v of a stream reset with a code is not smux.ErrReset to errors.Is", err)
+	}
+
+	if err := reset(0); err != smux.ErrReset {
+		t.Errorf("peer of a stream reset with code 0 read %v, expected %v", err, smux.ErrReset)
+	}
+}
+
+// SubtestOpenTimeout checks Options.OpenTimeout, as
+// smux.NewConnWithOptions enforces it: that opening a stream towards a
+// server which stopped reading fails with a net.Error timeout once the
+// timeout passed, and that the deadline of the context of
+// smux.OpenStreamContext takes precedence. Muxers which open streams
+// without writing succeed instead.
+func SubtestOpenTimeout(t testing.TB, tr smux.Transport) {
+	timeout := scaleTimeout(100 * time.Millisecond)
+	a, b := connPipe(t)
+	defer a.Close()
+	defer b.Close()
+
+	muxb, err := tr.NewConn(b, true)
+	checkErr(t, err)
+	defer muxb.Close()
+	defer serveConn(t, muxb, smux.EchoHandler)()
+	sa := newStallConn(a)
+	muxa, err := smux.NewConnWithOptions(tr, sa, false, smux.Options{OpenTimeout: timeout})
+	checkErr(t, err)
+	defer muxa.Close()
+	// closing the connection first unblocks the writes of Close.
+	defer sa.Close()
+
+	s, err := muxa.OpenStream()
+	checkErr(t, err)
+	s.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+	_, err = s.Write([]byte("x"))
+	checkErr(t, err)
+	_, err = io.ReadFull(s, make([]byte, 1))
+	checkErr(t, err)
+	s.Close()
+
+	// the first opens may still fit in the buffers below the muxer, and
+	// the streams opened are left to the connection's Close, as their
+	// resets would block.
+	sa.stall()
+	var start time.Time
+	for i := 0; ; i++ {
+		if i == 8 {
+			// muxers that open without writing succeed right away.
+			log("%d opens succeeded over a stalled connection", i)
+			return
+		}
+		start = time.Now()
+		if _, err = muxa.OpenStream(); err != nil {
+			break
+		}
+	}
+	d := time.Since(start)
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("open over a stalled connection failed with %v, expected a net.Error timeout", err)
+	}
+	if d < timeout {
+		t.Errorf("open failed after %s, before its %s timeout", d, timeout)
+	}
+	if d > timeout+scaleTimeout(time.Second) {
+		t.Errorf("open failed after %s with a %s timeout", d, timeout)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*timeout)
+	defer cancel()
+	start = time.Now()
+	_, err = smux.OpenStreamContext(ctx, muxa)
+	d = time.Since(start)
+	if err == nil {
+		t.Fatal("open over a stalled connection succeeded after another failed")
+	}
+	if err != context.DeadlineExceeded {
+		t.Errorf("open with a context deadline failed with %v, expected %v", err, context.DeadlineExceeded)
+	}
+	if d < 3*timeout {
+		t.Errorf("open with a %s context deadline failed after %s, at the %s open timeout", 3*timeout, d, timeout)
+	}
+}
+
+// backlogTestStreams and backlogTestSize are the streams opened by
+// SubtestAcceptBacklog, and the AcceptBacklog of its server, and
+// backlogTestData the data written to each, which in all is more than the
+// buffers of the networks hold.
+const (
+	backlogTestStreams = 2000
+	backlogTestSize    = 16
+	backlogTestData    = 16 << 10
+)
+
+// SubtestAcceptBacklog checks Options.AcceptBacklog and
+// Options.AcceptOverflow, as smux.NewConnWithOptions enforces them, against
+// a server which does not accept while the client opens thousands of
+// streams: with smux.ResetOverflow, that the streams past the backlog are
+// reset and the backlog is accepted afterwards, and with
+// smux.BlockOverflow, that the opens of the client stall short of the
+// last stream but every stream is accepted in the end.
+func SubtestAcceptBacklog(t testing.TB, tr smux.Transport) {
+	pair := func(overflow string) (smux.Conn, smux.ContextAcceptConn, func()) {
+		a, b := connPipe(t)
+		muxb, err := smux.NewConnWithOptions(tr, b, true, smux.Options{
+			AcceptBacklog:  backlogTestSize,
+			AcceptOverflow: overflow,
+		})
+		checkErr(t, err)
+		muxa, err := tr.NewConn(a, false)
+		checkErr(t, err)
+		return muxa, muxb.(smux.ContextAcceptConn), func() {
+			muxa.Close()
+			muxb.Close()
+			a.Close()
+			b.Close()
+		}
+	}
+	// open opens the streams, writing their index first, and reports
+	// how the reads of the streams end until the connection closes.
+	var opens int64
+	open := func(muxa smux.Conn, read bool) (<-chan error, error) {
+		readErrs := make(chan error, backlogTestStreams)
+		for i := 0; i < backlogTestStreams; i++ {
+			s, err := muxa.OpenStream()
+			if err != nil {
+				return readErrs, err
+			}
+			atomic.AddInt64(&opens, 1)
+			data := make([]byte, backlogTestData)
+			binary.BigEndian.PutUint32(data, uint32(i))
+			if _, err := s.Write(data); err != nil && !errors.Is(err, smux.ErrReset) {
+				return readErrs, err
+			}
+			if read {
+				go func() {
+					_, err := s.Read(make([]byte, 1))
+					readErrs <- err
+				}()
+			} else {
+				s.Close()
+			}
+		}
+		return readErrs, nil
+	}
+
+	muxa, muxb, done := pair(smux.ResetOverflow)
+	defer done()
+	readErrs, err := open(muxa, true)
+	checkErr(t, err)
+	for i := 0; i < backlogTestStreams-backlogTestSize; i++ {
+		select {
+		case err := <-readErrs:
+			if !errors.Is(err, smux.ErrReset) {
+				t.Fatalf("read of a stream past the backlog failed with %v, expected %v", err, smux.ErrReset)
+			}
+		case <-time.After(scaleTimeout(10 * time.Second)):
+			t.Fatalf("%d streams past a backlog of %d were reset, expected %d", i, backlogTestSize, backlogTestStreams-backlogTestSize)
+		}
+	}
+	select {
+	case err := <-readErrs:
+		t.Fatalf("a stream of the backlog failed with %v before it was accepted", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	for i := 0; i < backlogTestSize; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), scaleTimeout(5*time.Second))
+		s, err := muxb.AcceptStreamContext(ctx)
+		cancel()
+		checkErr(t, err)
+		s.Reset()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	if s, err := muxb.AcceptStreamContext(ctx); err == nil {
+		s.Reset()
+		t.Errorf("accepted more streams than the backlog of %d held", backlogTestSize)
+	}
+	cancel()
+	done()
+
+	muxa, muxb, done = pair(smux.BlockOverflow)
+	defer done()
+	atomic.StoreInt64(&opens, 0)
+	opened := make(chan error, 1)
+	go func() {
+		_, err := open(muxa, false)
+		opened <- err
+	}()
+	// the opens stall, nothing being accepted, short of the last stream.
+	deadline := time.Now().Add(scaleTimeout(10 * time.Second))
+	for last := int64(-1); ; {
+		time.Sleep(100 * time.Millisecond)
+		n := atomic.LoadInt64(&opens)
+		if n == last {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("opens went on past %d streams while none was accepted", n)
+		}
+		last = n
+	}
+	select {
+	case err := <-opened:
+		t.Fatalf("opened all %d streams past a backlog of %d while none was accepted (%v)", backlogTestStreams, backlogTestSize, err)
+	default:
+	}
+	log("opens held back after %d streams", atomic.LoadInt64(&opens))
+	seen := make(map[uint32]bool)
+	for len(seen) < backlogTestStreams {
+		ctx, cancel := context.WithTimeout(context.Background(), scaleTimeout(10*time.Second))
+		s, err := muxb.AcceptStreamContext(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("accepting failed with %v after %d of %d streams", err, len(seen), backlogTestStreams)
+		}
+		s.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+		data, err := ioutil.ReadAll(s)
+		checkErr(t, err)
+		if len(data) != backlogTestData {
+			t.Fatalf("stream read %d bytes, expected %d", len(data), backlogTestData)
+		}
+		seen[binary.BigEndian.Uint32(data)] = true
+		s.Close()
+	}
+	select {
+	case err := <-opened:
+		checkErr(t, err)
+	case <-time.After(scaleTimeout(10 * time.Second)):
+		t.Fatal("opens did not finish once every stream was accepted")
+	}
+}
+
+// concurrentTestSize is the data each goroutine of
+// SubtestConcurrentReadWrite writes.
+const concurrentTestSize = 4 << 20
+
+// SubtestConcurrentReadWrite checks the concurrency contract of
+// smux.Stream: that a stream reads in one goroutine while it writes in
+// another, past the windows of the muxer, and that two goroutines writing
+// at once lose and reorder none of the data of either, however it
+// interleaves.
+func SubtestConcurrentReadWrite(t testing.TB, tr smux.Transport) {
+	muxa, _, done := muxPair(t, tr, echoStream)
+	defer done()
+
+	open := func() smux.Stream {
+		s, err := muxa.OpenStream()
+		checkErr(t, err)
+		s.SetDeadline(time.Now().Add(scaleTimeout(30 * time.Second)))
+		return s
+	}
+	// write writes data in pieces of varied sizes, and closes s if last.
+	write := func(s smux.Stream, data []byte, done chan<- error) {
+		for i := 0; len(data) > 0; i++ {
+			n := 1 + (i*7919)%(64<<10)
+			if n > len(data) {
+				n = len(data)
+			}
+			if _, err := s.Write(data[:n]); err != nil {
+				done <- err
+				return
+			}
+			data = data[n:]
+		}
+		done <- nil
+	}
+
+	s := open()
+	data := make([]byte, 0, concurrentTestSize)
+	for len(data) < concurrentTestSize {
+		data = append(data, randBuf(1<<20)...)
+	}
+	written := make(chan error, 1)
+	go func() {
+		write(s, data, written)
+		s.Close()
+	}()
+	echoed, err := ioutil.ReadAll(s)
+	if err != nil {
+		t.Fatalf("reading while writing failed after %d bytes with %v", len(echoed), err)
+	}
+	checkErr(t, <-written)
+	if !bytes.Equal(echoed, data) {
+		t.Fatal("the data read while writing differs from the data written")
+	}
+
+	// the writers write bytes counting on in their own halves of the
+	// byte values, which tells their data apart once echoed.
+	s = open()
+	written = make(chan error, 2)
+	var writers sync.WaitGroup
+	for _, base := range []byte{0, 128} {
+		data := make([]byte, concurrentTestSize)
+		for i := range data {
+			data[i] = base + byte(i%128)
+		}
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+			write(s, data, written)
+		}()
+	}
+	go func() {
+		writers.Wait()
+		s.Close()
+	}()
+	echoed, err = ioutil.ReadAll(s)
+	if err != nil {
+		t.Fatalf("reading the data of concurrent writers failed after %d bytes with %v", len(echoed), err)
+	}
+	for i := 0; i < 2; i++ {
+		checkErr(t, <-written)
+	}
+	var next [2]int
+	for i, c := range echoed {
+		w := int(c >> 7)
+		if int(c&127) != next[w]%128 {
+			t.Fatalf("byte %d of writer %d is read at %d out of order", next[w], w, i)
+		}
+		next[w]++
+	}
+	if next[0] != concurrentTestSize || next[1] != concurrentTestSize {
+		t.Fatalf("read %d and %d bytes of concurrent writers writing %d each", next[0], next[1], concurrentTestSize)
+	}
+}
+
+// SubtestUnderlyingConn checks that smux.UnderlyingConn returns the net.Conn a muxer
+// runs over, with its addresses, and finds it through the wrappers of the
+// smux package. It is skipped for muxers that are not a smux.NetConner.
+func SubtestUnderlyingConn(t testing.TB, tr smux.Transport) {
+	a, b := connPipe(t)
+	muxa, _, done := muxConns(t, tr, a, b, echoStream)
+	defer done()
+
+	nc, err := smux.UnderlyingConn(muxa)
+	if err == smux.ErrNotSupported {
+		t.Skip("the muxer does not expose its net.Conn")
+	}
+	checkErr(t, err)
+	// over pipes, the muxer runs over a bridge without addresses.
+	if _, piped := tr.(pipeTransport); !piped {
+		if nc.LocalAddr().String() != a.LocalAddr().String() || nc.RemoteAddr().String() != a.RemoteAddr().String() {
+			t.Errorf("UnderlyingConn is %s <--> %s, expected %s <--> %s", nc.LocalAddr(), nc.RemoteAddr(), a.LocalAddr(), a.RemoteAddr())
+		}
+	}
+
+	wrapped := smux.WithOpenTimeout(smux.WithIdleTimeout(smux.WithStats(smux.WithStreamTracking(muxa)), time.Minute), time.Minute)
+	wnc, err := smux.UnderlyingConn(wrapped)
+	checkErr(t, err)
+	if wnc != nc {
+		t.Errorf("UnderlyingConn of the wrapped connection is %T, expected %T of the muxer", wnc, nc)
+	}
+
+	// the connection is unaffected.
+	s, err := wrapped.OpenStream()
+	checkErr(t, err)
+	defer s.Reset()
+	s.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+	_, err = s.Write([]byte("x"))
+	checkErr(t, err)
+	_, err = io.ReadFull(s, make([]byte, 1))
+	checkErr(t, err)
+}
+
+// SubtestStreamTLS checks that smux.WithStreamTLS echoes data the same,
+// with none of it in the clear on the wire, over streams authenticating
+// the accepting side, and that opening a stream to a peer whose
+// certificate is not trusted fails without the peer accepting it.
+func SubtestStreamTLS(t testing.TB, tr smux.Transport) {
+	server, client, err := tlsConfigs()
+	checkErr(t, err)
+	a, b := connPipe(t)
+	wire := &transcript{}
+	muxa, _, done := muxConns(t, smux.WithStreamTLS(tr, client, server),
+		&recordConn{Conn: a, tr: wire}, &recordConn{Conn: b, server: true, tr: wire}, echoStream)
+	defer done()
+
+	msg := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog; "), 1000)
+	s, err := muxa.OpenStream()
+	checkErr(t, err)
+	defer s.Reset()
+	s.SetDeadline(time.Now().Add(scaleTimeout(20 * time.Second)))
+	if cs, ok := s.(interface{ ConnectionState() tls.ConnectionState }); !ok {
+		t.Errorf("stream is %T, expected the TLS state of its session", s)
+	} else if state := cs.ConnectionState(); !state.HandshakeComplete || len(state.PeerCertificates) == 0 {
+		t.Errorf("stream returned before authenticating the peer")
+	}
+	werr := make(chan error, 1)
+	go func() {
+		_, err := s.Write(msg)
+		if err == nil {
+			err = s.Close()
+		}
+		werr <- err
+	}()
+	got, err := ioutil.ReadAll(s)
+	checkErr(t, err)
+	checkErr(t, <-werr)
+	if !bytes.Equal(got, msg) {
+		t.Fatalf("stream echoed %d bytes different from the %d written", len(got), len(msg))
+	}
+	sent, echoed := wire.side(false), wire.side(true)
+	if len(sent) == 0 && len(echoed) == 0 {
+		log("connection does not go over the net.Conn, not checking the bytes on the wire")
+	} else if bytes.Contains(sent, msg[:64]) || bytes.Contains(echoed, msg[:64]) {
+		t.Fatal("data of the stream found in the clear on the wire")
+	}
+
+	c, d := connPipe(t)
+	defer c.Close()
+	defer d.Close()
+	muxd, err := smux.WithStreamTLS(tr, client, server).NewConn(d, true)
+	checkErr(t, err)
+	defer muxd.Close()
+	accepted := make(chan struct{}, 1)
+	defer serveConn(t, muxd, func(s smux.Stream) {
+		accepted <- struct{}{}
+		s.Reset()
+	})()
+	// a client trusting no certificate at all.
+	untrusting := client.Clone()
+	untrusting.RootCAs = x509.NewCertPool()
+	muxc, err := smux.WithStreamTLS(tr, untrusting, server).NewConn(c, false)
+	checkErr(t, err)
+	defer muxc.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), scaleTimeout(10*time.Second))
+	defer cancel()
+	if s, err := smux.OpenStreamContext(ctx, muxc); err == nil {
+		s.Reset()
+		t.Fatal("opened a stream to a peer with an untrusted certificate")
+	} else if ctx.Err() != nil {
+		t.Fatalf("opening a stream to a peer with an untrusted certificate did not fail: %v", err)
+	}
+	select {
+	case <-accepted:
+		t.Fatal("accepted a stream whose handshake failed")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// SubtestStreamConn checks that smux.StreamConn returns the wrapper of the
+// smux package a stream was opened or accepted on, so that a handler can
+// reach the connection's stats from the stream alone, and that the
+// connection a muxer's streams know reaches the same peer.
+func SubtestStreamConn(t testing.TB, tr smux.Transport) {
+	ca, cb, done := muxPair(t, tr, nil)
+	defer done()
+	muxb := smux.WithStats(cb)
+	defer muxb.Close()
+	accepted := make(chan uint64, 1)
+	defer serveConn(t, muxb, func(s smux.Stream) {
+		c, err := smux.StreamConn(s)
+		if err != nil {
+			t.Errorf("StreamConn of an accepted stream: %v", err)
+			s.Reset()
+			return
+		}
+		if c != smux.Conn(muxb) {
+			t.Errorf("StreamConn of an accepted stream is %T, expected the %T it was accepted on", c, muxb)
+		} else {
+			select {
+			case accepted <- c.(smux.StatConn).Stat().StreamsAccepted:
+			default:
+			}
+		}
+		echoStream(s)
+	})()
+	muxa := smux.WithStats(ca)
+
+	s, err := muxa.OpenStream()
+	checkErr(t, err)
+	defer s.Reset()
+	s.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+	c, err := smux.StreamConn(s)
+	checkErr(t, err)
+	if c != smux.Conn(muxa) {
+		t.Errorf("StreamConn of an opened stream is %T, expected the %T it was opened on", c, muxa)
+	}
+	_, err = s.Write([]byte("x"))
+	checkErr(t, err)
+	_, err = io.ReadFull(s, make([]byte, 1))
+	checkErr(t, err)
+	select {
+	case n := <-accepted:
+		if n == 0 {
+			t.Error("the handler's connection counted no accepted streams")
+		}
+	case <-time.After(scaleTimeout(5 * time.Second)):
+		t.Fatal("the handler did not reach its connection")
+	}
+
+	// streams of wrappers handing out those of the connection they wrap
+	// report the latter.
+	s, err = smux.WithOpenTimeout(muxa, time.Minute).OpenStream()
+	checkErr(t, err)
+	defer s.Reset()
+	if c, err := smux.StreamConn(s); err != nil || c != smux.Conn(muxa) {
+		t.Errorf("StreamConn through WithOpenTimeout is %T, %v, expected the %T it wraps", c, err, muxa)
+	}
+
+	s, err = ca.OpenStream()
+	checkErr(t, err)
+	defer s.Reset()
+	c, err = smux.StreamConn(s)
+	if err == smux.ErrNotSupported {
+		t.Skip("the muxer's streams do not know their connection")
+	}
+	checkErr(t, err)
+	// the connection opens streams to the same peer.
+	s, err = c.OpenStream()
+	checkErr(t, err)
+	defer s.Reset()
+	s.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+	_, err = s.Write([]byte("y"))
+	checkErr(t, err)
+	buf := make([]byte, 1)
+	_, err = io.ReadFull(s, buf)
+	checkErr(t, err)
+	if buf[0] != 'y' {
+		t.Fatalf("echoed %q through the stream's connection, expected \"y\"", buf)
+	}
+}
+
+// SubtestAsyncOpener checks that the opens of smux.AsyncOpeners complete,
+// with usable streams, including those of an opener created with no
+// workers, on a connection hiding smux.AsyncOpenConn so that the workers
+// open the streams, and that Close fails the opens still queued.
+func SubtestAsyncOpener(t testing.TB, tr smux.Transport) {
+	muxa, _, done := muxPair(t, tr, echoStream)
+	defer done()
+	c := struct{ smux.Conn }{muxa}
+
+	for _, workers := range []int{0, 2} {
+		o := smux.NewAsyncOpener(workers)
+		var fs []*smux.StreamFuture
+		for i := 0; i < 8; i++ {
+			fs = append(fs, o.Open(c))
+		}
+		for i, f := range fs {
+			select {
+			case <-f.Done():
+			case <-time.After(scaleTimeout(10 * time.Second)):
+				t.Fatalf("open %d of an opener with %d workers did not complete", i, workers)
+			}
+			s, err := f.Wait()
+			checkErr(t, err)
+			s.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+			_, err = s.Write([]byte("x"))
+			checkErr(t, err)
+			_, err = io.ReadFull(s, make([]byte, 1))
+			checkErr(t, err)
+			s.Reset()
+		}
+		o.Close()
+		if _, err := o.Open(c).Wait(); err != smux.ErrOpenerClosed {
+			t.Fatalf("open on a closed opener returned %v, expected %v", err, smux.ErrOpenerClosed)
+		}
+	}
+}
+
+// wanNetwork returns the network selected by -smux.net, with the latency
+// and losses of testnet.WAN.
+func wanNetwork(t testing.TB) Network {
+	cond := testnet.WAN
+	cond.Seed = testSeed()
+	return testNetwork(t).WithConditions(cond)
+}
+
+// SubtestSimpleWriteWAN runs SubtestSimpleWrite over connections with the
+// latency and losses of testnet.WAN.
+func SubtestSimpleWriteWAN(t testing.TB, tr smux.Transport) {
+	simpleWrite(t, tr, wanNetwork(t))
+}
+
+// StressWAN is the stress preset of SubtestStressWAN, small enough to run
+// in seconds over a 100ms link.
+var StressWAN = Options{
+	connNum:   2,
+	streamNum: 50,
+	msgNum:    50,
+	msgMin:    100,
+	msgMax:    10000,
+}
+
+// SubtestStressWAN runs SubtestStress with StressWAN over connections with
+// the latency and losses of testnet.WAN, where windows updated late or
+// streams starving each other show up as stalls.
+func SubtestStressWAN(t testing.TB, tr smux.Transport) {
+	SubtestStress(t, StressWAN.WithTransport(tr).WithNetwork(wanNetwork(t)))
+}
+
+// SubtestSimpleWriteDribble runs SubtestSimpleWrite over connections
+// reading 1 to 7 bytes at a time and merging writes, by testnet.Dribble.
+func SubtestSimpleWriteDribble(t testing.TB, tr smux.Transport) {
+	simpleWrite(t, tr, testNetwork(t).WithDribble(testSeed()))
+}
+
+// StressDribble is the stress preset of SubtestStressDribble, with
+// messages from 1 byte, small enough for data read a few bytes at a time.
+var StressDribble = Options{
+	connNum:   2,
+	streamNum: 10,
+	msgNum:    20,
+	msgMin:    1,
+	msgMax:    1000,
+}
+
+// SubtestStressDribble runs SubtestStress with StressDribble over
+// connections reading 1 to 7 bytes at a time and merging writes, which
+// fails muxers assuming a whole frame header, or frame, arrives in one
+// read.
+func SubtestStressDribble(t testing.TB, tr smux.Transport) {
+	SubtestStress(t, StressDribble.WithTransport(tr).WithNetwork(testNetwork(t).WithDribble(testSeed())))
+}
+
+const (
+	// severStreams is the number of streams with reads and writes in
+	// flight when SubtestSeverConn severs the connection.
+	severStreams = 32
+
+	// severTimeout bounds how long operations may stay blocked once the
+	// connection is severed.
+	severTimeout = 5 * time.Second
+)
+
+// SubtestSeverConn closes the net.Conn under a connection while dozens of
+// streams have reads and writes in flight on both sides, as when a TCP
+// connection dies, and checks that every blocked read, write and accept
+// fails within 5 seconds, that reads do not end with io.EOF as if the
+// data was complete, that both sides end up closed and that no goroutine
+// keeps running.
+func SubtestSeverConn(t testing.TB, tr smux.Transport) {
+	defer checkLeaks(t)()
+
+	a, b := connPipe(t)
+	muxa, muxb, done := muxConns(t, tr, a, b, nil)
+	defer done()
+
+	type result struct {
+		op  string
+		err error
+	}
+	blocked := make(map[string]bool)
+	results := make(chan result, 4*severStreams+2)
+	start := func(op string, f func() error) {
+		blocked[op] = true
+		go func() { results <- result{op, f()} }()
+	}
+	read := func(s smux.Stream) func() error {
+		return func() error {
+			_, err := io.Copy(ioutil.Discard, s)
+			if err == nil {
+				err = io.EOF
+			}
+			return err
+		}
+	}
+	write := func(s smux.Stream) func() error {
+		return func() error {
+			buf := randBuf(64 << 10)
+			for {
+				if _, err := s.Write(buf); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for i := 0; i < severStreams; i++ {
+		s, err := muxa.OpenStream()
+		checkErr(t, err)
+		_, err = s.Write([]byte{byte(i)})
+		checkErr(t, err)
+		ps, err := muxb.AcceptStream()
+		checkErr(t, err)
+		_, err = io.ReadFull(ps, make([]byte, 1))
+		checkErr(t, err)
+
+		// nothing is written back on the first half of the streams, and
+		// nothing is read on the second half, so the operations block.
+		if i%2 == 0 {
+			start(fmt.Sprintf("read on opened stream %d", i), read(s))
+			start(fmt.Sprintf("write on accepted stream %d", i), write(ps))
+		} else {
+			start(fmt.Sprintf("write on opened stream %d", i), write(s))
+			start(fmt.Sprintf("read on accepted stream %d", i), read(ps))
+		}
+	}
+	accept := func(c smux.Conn) func() error {
+		return func() error {
+			s, err := c.AcceptStream()
+			if err == nil {
+				s.Reset()
+			}
+			return err
+		}
+	}
+	start("accept on the dialer", accept(muxa))
+	start("accept on the listener", accept(muxb))
+
+	time.Sleep(100 * time.Millisecond)
+	ops := len(blocked)
+	log("severing the connection with %d operations in flight", ops)
+	checkErr(t, a.Close())
+
+	timeout := time.After(scaleTimeout(severTimeout))
+	for len(blocked) > 0 {
+		select {
+		case r := <-results:
+			delete(blocked, r.op)
+			switch {
+			case r.err == nil:
+				t.Errorf("%s succeeded after the connection was severed", r.op)
+			case r.err == io.EOF && strings.HasPrefix(r.op, "read"):
+				t.Errorf("%s ended with io.EOF after the connection was severed", r.op)
+			}
+		case <-timeout:
+			var names []string
+			for op := range blocked {
+				names = append(names, op)
+			}
+			sort.Strings(names)
+			t.Fatalf("%d of %d operations still blocked %s after the connection was severed: %s", len(names), ops, severTimeout, strings.Join(names, ", "))
+		}
+	}
+
+	deadline := time.Now().Add(scaleTimeout(severTimeout))
+	for !muxa.IsClosed() || !muxb.IsClosed() {
+		if time.Now().After(deadline) {
+			t.Fatalf("connections not closed %s after being severed: dialer %v, listener %v", severTimeout, muxa.IsClosed(), muxb.IsClosed())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// The workload of SubtestEchoLatency.
+const (
+	echoLatencyStreams  = 16
+	echoLatencyMessages = 200
+	echoLatencySize     = 64
+)
+
+// SubtestEchoLatency measures the round trip latency of small messages,
+// echoed one at a time on each of 16 concurrent streams, and reports its
+// 50th, 95th and 99th percentiles in the log and as metrics, of the
+// benchmark it runs as or of its -smux.json result. Muxers whose write
+// loops block all streams behind one, or delay small frames, show up as a
+// long tail rather than in their throughput.
+func SubtestEchoLatency(t testing.TB, tr smux.Transport) {
+	// not echoStream, whose logging would add to the latency.
+	muxa, _, done := muxPair(t, tr, smux.EchoHandler)
+	defer done()
+
+	msgs := scaleCount(t, echoLatencyMessages)
+	errs := make(chan error, echoLatencyStreams)
+	latencies := make(chan []time.Duration, echoLatencyStreams)
+	for i := 0; i < echoLatencyStreams; i++ {
+		go func(i int) {
+			s, err := muxa.OpenStream()
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer s.Close()
+			s.SetDeadline(time.Now().Add(scaleTimeout(stressStreamTimeout)))
+
+			out := randBuf(echoLatencySize)
+			in := make([]byte, len(out))
+			local := make([]time.Duration, 0, msgs)
+			for j := 0; j < msgs; j++ {
+				start := time.Now()
+				if _, err := s.Write(out); err != nil {
+					errs <- fmt.Errorf("stream %d message %d: %v", i, j, err)
+					return
+				}
+				if _, err := io.ReadFull(s, in); err != nil {
+					errs <- fmt.Errorf("stream %d message %d: %v", i, j, err)
+					return
+				}
+				local = append(local, time.Since(start))
+				if !bytes.Equal(in, out) {
+					errs <- fmt.Errorf("stream %d message %d: echoed data differs", i, j)
+					return
+				}
+			}
+			latencies <- local
+		}(i)
+	}
+
+	var all []time.Duration
+	for i := 0; i < echoLatencyStreams; i++ {
+		select {
+		case err := <-errs:
+			t.Fatal(err)
+		case l := <-latencies:
+			all = append(all, l...)
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+	p50, p95, p99 := percentile(all, 0.50), percentile(all, 0.95), percentile(all, 0.99)
+	reportMetric(t, float64(p50.Nanoseconds()), "p50-ns")
+	reportMetric(t, float64(p95.Nanoseconds()), "p95-ns")
+	reportMetric(t, float64(p99.Nanoseconds()), "p99-ns")
+	t.Logf("echo latency over %d messages on %d streams: p50 %s, p95 %s, p99 %s", len(all), echoLatencyStreams, p50, p95, p99)
+}
+
+// serverStreams is the number of streams SubtestServerOpensStream opens
+// from the listening side.
+const serverStreams = 5
+
+// SubtestServerOpensStream checks that the listening side of a connection
+// can open streams toward the dialing side, which accepts and echoes them,
+// and, for muxers exposing stream IDs, that the IDs are the same on both
+// sides and that those of the streams each side opens have their own
+// parity.
+func SubtestServerOpensStream(t testing.TB, tr smux.Transport) {
+	client, server, done := muxPair(t, tr, nil)
+	defer done()
+
+	// the dialer echoes the streams the listener opens, passing on the IDs
+	// it sees them with.
+	clientIDs := make(chan uint64, serverStreams)
+	defer serveConn(t, client, func(s smux.Stream) {
+		if id, ok := smux.StreamID(s); ok {
+			clientIDs <- id
+		}
+		echoStream(s)
+	})()
+
+	var parity uint64
+	hasIDs := false
+	for i := 0; i < serverStreams; i++ {
+		s, err := server.OpenStream()
+		checkErr(t, err)
+		defer s.Reset()
+		s.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+
+		out := randBuf(4096)
+		_, err = s.Write(out)
+		checkErr(t, err)
+		in := make([]byte, len(out))
+		_, err = io.ReadFull(s, in)
+		checkErr(t, err)
+		if !bytes.Equal(in, out) {
+			t.Fatalf("stream %d opened by the listener: echoed data differs", i)
+		}
+
+		id, ok := smux.StreamID(s)
+		if !ok {
+			continue
+		}
+		hasIDs = true
+		if cid := <-clientIDs; cid != id {
+			t.Fatalf("stream opened by the listener with ID %d was accepted with ID %d", id, cid)
+		}
+		if i == 0 {
+			parity = id % 2
+		} else if id%2 != parity {
+			t.Fatalf("stream ID %d does not have the parity of the first stream the listener opened", id)
+		}
+	}
+	if !hasIDs {
+		return
+	}
+
+	// a stream the dialer opens must not have the listener's parity.
+	inbound := make(chan smux.Stream, 1)
+	go func() {
+		s, err := server.AcceptStream()
+		if err != nil {
+			close(inbound)
+			return
+		}
+		inbound <- s
+	}()
+	s, err := client.OpenStream()
+	checkErr(t, err)
+	defer s.Reset()
+	// the first write announces the stream to lazy muxers.
+	_, err = s.Write([]byte("x"))
+	checkErr(t, err)
+	rs, ok := <-inbound
+	if !ok {
+		t.Fatal("failed to accept the stream the dialer opened")
+	}
+	defer rs.Reset()
+	id, _ := smux.StreamID(s)
+	if rid, _ := smux.StreamID(rs); rid != id {
+		t.Fatalf("stream opened by the dialer with ID %d was accepted with ID %d", id, rid)
+	}
+	if id%2 == parity {
+		t.Fatalf("stream ID %d opened by the dialer has the parity of those the listener opened", id)
+	}
+}
+
+// The workload of SubtestFairness, and the bound on the round trips of its
+// small streams.
+const (
+	fairnessStreams  = 16
+	fairnessMessages = 50
+	fairnessBound    = 2 * time.Second
+)
+
+// SubtestFairness checks that a stream continuously writing bulk data does
+// not starve the others: small messages echoed on 16 concurrent streams
+// next to it must all make their round trip within 2s, scaled under -race.
+// It reports their 50th and 99th percentiles and maximum, which tell how
+// evenly write schedulers share the connection, in the log and as metrics.
+func SubtestFairness(t testing.TB, tr smux.Transport) {
+	muxa, _, done := muxPair(t, tr, smux.EchoHandler)
+	defer done()
+	go muxa.AcceptStream()
+
+	// the bulk stream keeps the connection busy both ways, as its data is
+	// echoed back, until the small streams are done.
+	bulk, err := muxa.OpenStream()
+	checkErr(t, err)
+	defer bulk.Reset()
+	go io.Copy(ioutil.Discard, bulk)
+	go func() {
+		buf := randBuf(1 << 16)
+		for {
+			if _, err := bulk.Write(buf); err != nil {
+				return
+			}
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	bound := scaleTimeout(fairnessBound)
+	msgs := scaleCount(t, fairnessMessages)
+	errs := make(chan error, fairnessStreams)
+	latencies := make(chan []time.Duration, fairnessStreams)
+	for i := 0; i < fairnessStreams; i++ {
+		go func(i int) {
+			s, err := muxa.OpenStream()
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer s.Reset()
+			// a starved stream fails by its deadline rather than hang.
+			s.SetDeadline(time.Now().Add(time.Duration(msgs) * bound))
+
+			out, in := randBuf(echoLatencySize), make([]byte, echoLatencySize)
+			local := make([]time.Duration, 0, msgs)
+			for j := 0; j < msgs; j++ {
+				start := time.Now()
+				if _, err := s.Write(out); err != nil {
+					errs <- fmt.Errorf("stream %d message %d: %s", i, j, err)
+					return
+				}
+				if _, err := io.ReadFull(s, in); err != nil {
+					errs <- fmt.Errorf("stream %d message %d: %s", i, j, err)
+					return
+				}
+				local = append(local, time.Since(start))
+			}
+			latencies <- local
+		}(i)
+	}
+
+	var all []time.Duration
+	for i := 0; i < fairnessStreams; i++ {
+		select {
+		case err := <-errs:
+			t.Fatal(err)
+		case l := <-latencies:
+			all = append(all, l...)
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+	p50, p99, max := percentile(all, 0.50), percentile(all, 0.99), all[len(all)-1]
+	reportMetric(t, float64(p50.Nanoseconds()), "p50-ns")
+	reportMetric(t, float64(p99.Nanoseconds()), "p99-ns")
+	reportMetric(t, float64(max.Nanoseconds()), "max-ns")
+	t.Logf("round trips of %d messages on %d streams next to a bulk transfer: p50 %s, p99 %s, max %s", len(all), fairnessStreams, p50, p99, max)
+	if max > bound {
+		t.Fatalf("a round trip next to a bulk transfer took %s, above %s", max, bound)
+	}
+}
+
+// maxStreamsLimit is the limit SubtestMaxStreams sets, of which a
+// misbehaving peer opens 10 times as many streams.
+const maxStreamsLimit = 16
+
+// SubtestMaxStreams checks smux.WithMaxStreams: that OpenStream fails
+// locally past the limit, and that a server limited to 16 streams resets
+// the others a peer opens, 10 times as many, without its memory growing
+// with them, as the muxer must free the state of the streams it resets.
+func SubtestMaxStreams(t testing.TB, tr smux.Transport) {
+	muxa, nb, done := muxPair(t, tr, nil)
+	defer done()
+	muxb := smux.WithMaxStreams(nb, maxStreamsLimit)
+	defer muxb.Close()
+	go muxa.AcceptStream()
+
+	// the server acknowledges the streams it keeps with a byte, and holds
+	// them until the peer resets them.
+	defer serveConn(t, muxb, func(s smux.Stream) {
+		defer s.Reset()
+		if _, err := s.Write([]byte("k")); err != nil {
+			return
+		}
+		io.Copy(ioutil.Discard, s)
+	})()
+
+	// open opens n streams, announced by a write, and returns those the
+	// server acknowledged, having dropped the ones it reset.
+	open := func(n int) []smux.Stream {
+		var kept []smux.Stream
+		for i := 0; i < n; i++ {
+			s, err := muxa.OpenStream()
+			checkErr(t, err)
+			s.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+			if _, err := s.Write(randBuf(1024)); err != nil {
+				s.Reset()
+				continue
+			}
+			if _, err := s.Read(make([]byte, 1)); err != nil {
+				s.Reset()
+				continue
+			}
+			kept = append(kept, s)
+		}
+		return kept
+	}
+	heap := func() uint64 {
+		var ms runtime.MemStats
+		runtime.GC()
+		runtime.GC()
+		runtime.ReadMemStats(&ms)
+		return ms.HeapAlloc
+	}
+
+	start := heap()
+	kept := open(maxStreamsLimit)
+	defer func() {
+		for _, s := range kept {
+			s.Reset()
+		}
+	}()
+	if len(kept) != maxStreamsLimit {
+		t.Fatalf("the server kept %d of the first %d streams, below its limit", len(kept), maxStreamsLimit)
+	}
+	full := heap()
+
+	if more := open(9 * maxStreamsLimit); len(more) > 0 {
+		for _, s := range more {
+			s.Reset()
+		}
+		t.Fatalf("the server kept %d streams past its limit of %d", len(more), maxStreamsLimit)
+	}
+	if n := muxb.(smux.StreamCounter).NumStreams(); n != maxStreamsLimit {
+		t.Fatalf("the server counts %d open streams, expected %d", n, maxStreamsLimit)
+	}
+	// the 9 times as many streams reset must not cost more than the ones
+	// kept, with some slack for the runtime.
+	after := heap()
+	var keptGrowth, resetGrowth int64 = int64(full) - int64(start), int64(after) - int64(full)
+	log("heap grew by %d bytes with %d kept streams, and %d bytes with %d reset ones", keptGrowth, maxStreamsLimit, resetGrowth, 9*maxStreamsLimit)
+	if resetGrowth > keptGrowth+256<<10 {
+		t.Fatalf("heap grew by %d bytes with %d reset streams, against %d bytes with %d kept ones", resetGrowth, 9*maxStreamsLimit, keptGrowth, maxStreamsLimit)
+	}
+
+	// OpenStream fails locally past the limit, until a stream is reset.
+	if _, err := muxb.OpenStream(); err != smux.ErrTooManyStreams {
+		t.Fatalf("OpenStream past the limit returned %v, expected %v", err, smux.ErrTooManyStreams)
+	}
+	kept[0].Reset()
+	kept = kept[1:]
+	deadline := time.Now().Add(scaleTimeout(10 * time.Second))
+	for {
+		s, err := muxb.OpenStream()
+		if err == nil {
+			s.Reset()
+			break
+		}
+		if err != smux.ErrTooManyStreams || time.Now().After(deadline) {
+			t.Fatalf("OpenStream after a stream was reset returned %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// SubtestReadBuffer checks that smux.ReadBuffer returns the data written
+// to a stream, in order, interleaved with plain Reads, with the buffers of
+// streams implementing smux.BufferReader or through a copy for the
+// others, and then io.EOF once the peer closed the stream.
+func SubtestReadBuffer(t testing.TB, tr smux.Transport) {
+	muxa, muxb, done := muxPair(t, tr, nil)
+	defer done()
+	go muxa.AcceptStream()
+
+	out := randBuf(1 << 20)
+	written := make(chan error, 1)
+	go func() {
+		s, err := muxa.OpenStream()
+		if err != nil {
+			written <- err
+			return
+		}
+		if _, err := s.Write(out); err != nil {
+			s.Reset()
+			written <- err
+			return
+		}
+		written <- s.Close()
+	}()
+
+	s, err := muxb.AcceptStream()
+	checkErr(t, err)
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+	if _, ok := s.(smux.BufferReader); !ok {
+		log("stream does not implement BufferReader, checking the copying fallback")
+	}
+
+	var in []byte
+	small := make([]byte, 100)
+	for i := 0; ; i++ {
+		if i%4 == 3 {
+			n, err := s.Read(small)
+			in = append(in, small[:n]...)
+			if err == io.EOF {
+				break
+			}
+			checkErr(t, err)
+			continue
+		}
+		buf, err := smux.ReadBuffer(s)
+		if err == io.EOF {
+			break
+		}
+		checkErr(t, err)
+		if len(buf) == 0 {
+			t.Fatal("ReadBuffer returned an empty buffer and no error")
+		}
+		in = append(in, buf...)
+		smux.ReleaseBuffer(s, buf)
+	}
+	checkErr(t, <-written)
+	if !bytes.Equal(in, out) {
+		t.Fatalf("read %d bytes differing from the %d written", len(in), len(out))
+	}
+	if buf, err := smux.ReadBuffer(s); err != io.EOF {
+		t.Fatalf("ReadBuffer after EOF returned %d bytes and %v, expected io.EOF", len(buf), err)
+	}
+}
+
+// SubtestSyncOpen checks smux.OpenStreamSync over connections wrapped with
+// smux.WithSyncOpen: that it returns streams once the peer accepted them,
+// which carry data as others do, that it reports streams a peer which
+// stopped accepting rejects, which a lazy OpenStream does not, and that it
+// gives up once its context is done against a peer which never accepts.
+func SubtestSyncOpen(t testing.TB, tr smux.Transport) {
+	pair := func(server func(smux.Conn) smux.Conn) (client, muxb smux.Conn, done func()) {
+		na, nb, done := muxPair(t, tr, nil)
+		go na.AcceptStream()
+		return smux.WithSyncOpen(na), server(nb), done
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), scaleTimeout(10*time.Second))
+	defer cancel()
+
+	// accepted streams, opened synchronously or not, echo.
+	client, server, done := pair(func(c smux.Conn) smux.Conn { return smux.WithSyncOpen(c) })
+	stop := serveConn(t, server, echoStream)
+	roundTrip := func(s smux.Stream, msg string) {
+		defer s.Reset()
+		s.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+		_, err := s.Write([]byte(msg))
+		checkErr(t, err)
+		checkErr(t, s.Close())
+		buf, err := ioutil.ReadAll(s)
+		checkErr(t, err)
+		if string(buf) != msg {
+			t.Fatalf("unexpected echo %q, expected %q", buf, msg)
+		}
+	}
+	s, err := smux.OpenStreamSync(ctx, client)
+	checkErr(t, err)
+	roundTrip(s, "opened synchronously")
+	s, err = client.OpenStream()
+	checkErr(t, err)
+	roundTrip(s, "opened lazily")
+	stop()
+	done()
+
+	// a peer which stopped accepting rejects streams.
+	client, server, done = pair(func(c smux.Conn) smux.Conn {
+		sc := smux.WithStopAccepting(c)
+		checkErr(t, sc.StopAccepting())
+		return smux.WithSyncOpen(sc)
+	})
+	if _, err := smux.OpenStreamSync(ctx, client); err != smux.ErrStreamRejected {
+		t.Fatalf("OpenStreamSync to a peer which stopped accepting returned %v, expected %v", err, smux.ErrStreamRejected)
+	}
+	if s, err := client.OpenStream(); err == nil {
+		log("lazy OpenStream to a peer which stopped accepting succeeded")
+		s.Reset()
+	}
+	done()
+
+	// a peer which never accepts makes OpenStreamSync wait for its
+	// context.
+	client, server, done = pair(func(c smux.Conn) smux.Conn { return smux.WithSyncOpen(c) })
+	defer done()
+	short, cancelShort := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancelShort()
+	start := time.Now()
+	if _, err := smux.OpenStreamSync(short, client); err != context.DeadlineExceeded {
+		t.Fatalf("OpenStreamSync to a peer which never accepts returned %v, expected %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > scaleTimeout(5*time.Second) {
+		t.Fatalf("OpenStreamSync returned %s after its context was done", elapsed)
+	}
+
+	// the stream abandoned meanwhile, whose reset reaches the peer before
+	// it accepts, does not stop it serving the next ones.
+	time.Sleep(50 * time.Millisecond)
+	defer serveConn(t, server, echoStream)()
+	s, err = smux.OpenStreamSync(ctx, client)
+	checkErr(t, err)
+	roundTrip(s, "opened after an abandoned stream")
+}
+
+// SubtestALPN checks that smux.NewConnTLS establishes connections with the
+// muxer a TLS handshake negotiated among those of a registry, and that
+// handshakes negotiating none fail with smux.ErrNoALPN on both sides.
+// Transports without a protocol ID or ALPN name are skipped.
+func SubtestALPN(t testing.TB, tr smux.Transport) {
+	id := smux.ProtocolID(tr)
+	proto := smux.ALPN(id, tr)
+	if proto == "" {
+		t.Skip("transport has no protocol to negotiate")
+	}
+	r := smux.NewRegistry()
+	r.Register(id, tr)
+	r.Register("/smux-test-unused/1.0.0", unusedTransport{t})
+	server, client, err := tlsConfigs()
+	checkErr(t, err)
+	server = server.Clone()
+	server.NextProtos = r.ALPNProtocols()
+
+	// pair establishes connections over a TLS handshake in which the
+	// client offers protos.
+	pair := func(protos []string) (muxa, muxb smux.Conn, erra, errb error) {
+		a, b := connPipe(t)
+		cc := client.Clone()
+		cc.NextProtos = protos
+		accepted := make(chan error, 1)
+		go func() {
+			var err error
+			muxb, err = r.NewConnTLS(tls.Server(b, server), true)
+			if err != nil {
+				b.Close()
+			}
+			accepted <- err
+		}()
+		muxa, erra = r.NewConnTLS(tls.Client(a, cc), false)
+		if erra != nil {
+			a.Close()
+		}
+		errb = <-accepted
+		return muxa, muxb, erra, errb
+	}
+
+	muxa, muxb, erra, errb := pair([]string{proto})
+	checkErr(t, erra)
+	defer muxa.Close()
+	checkErr(t, errb)
+	defer muxb.Close()
+	defer serveConn(t, muxb, echoStream)()
+	go muxa.AcceptStream()
+
+	s, err := muxa.OpenStream()
+	checkErr(t, err)
+	defer s.Reset()
+	s.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+	out := []byte("negotiated " + proto)
+	_, err = s.Write(out)
+	checkErr(t, err)
+	in := make([]byte, len(out))
+	_, err = io.ReadFull(s, in)
+	checkErr(t, err)
+	if !bytes.Equal(in, out) {
+		t.Fatalf("echoed %q over the negotiated muxer, expected %q", in, out)
+	}
+
+	// a client offering no protocol negotiates none.
+	_, _, erra, errb = pair(nil)
+	if erra != smux.ErrNoALPN || errb != smux.ErrNoALPN {
+		t.Fatalf("NewConnTLS without a negotiated protocol returned %v and %v, expected %v", erra, errb, smux.ErrNoALPN)
+	}
+}
+
+// unusedTransport is registered next to the transport under test, and
+// fails the subtest establishing a connection with it.
+type unusedTransport struct {
+	t testing.TB
+}
+
+func (u unusedTransport) NewConn(c net.Conn, isServer bool) (smux.Conn, error) {
+	u.t.Error("established a connection with a muxer which was not negotiated")
+	return nil, smux.ErrNotSupported
+}
+
+// SubtestAcceptStreamContext checks AcceptStreamContext, of the transport's
+// connections if they implement it and as smux.WithAcceptContext emulates
+// it otherwise: that it gives up once its context is done without closing
+// the connection, that a server stopping its accept loop that way keeps
+// serving the streams it accepted, and that streams arriving as accepts
+// are cancelled are accepted by later calls rather than dropped.
+func SubtestAcceptStreamContext(t testing.TB, tr smux.Transport) {
+	check := func(wrap func(smux.Conn) smux.ContextAcceptConn) {
+		muxa, muxb, done := muxPair(t, tr, nil)
+		defer done()
+		go muxa.AcceptStream()
+		server := wrap(muxb)
+
+		// nothing to accept.
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		start := time.Now()
+		_, err := server.AcceptStreamContext(ctx)
+		cancel()
+		if err != context.DeadlineExceeded {
+			t.Fatalf("AcceptStreamContext without streams returned %v, expected %v", err, context.DeadlineExceeded)
+		}
+		if elapsed := time.Since(start); elapsed > scaleTimeout(5*time.Second) {
+			t.Fatalf("AcceptStreamContext returned %s after its context was done", elapsed)
+		}
+		if muxb.IsClosed() {
+			t.Fatal("cancelling AcceptStreamContext closed the connection")
+		}
+
+		// an accept loop stopped by its context.
+		ctx, cancel = context.WithCancel(context.Background())
+		defer cancel()
+		var wg sync.WaitGroup
+		stopped := make(chan error, 1)
+		go func() {
+			for {
+				s, err := server.AcceptStreamContext(ctx)
+				if err != nil {
+					stopped <- err
+					return
+				}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					echoStream(s)
+				}()
+			}
+		}()
+		served, err := muxa.OpenStream()
+		checkErr(t, err)
+		defer served.Reset()
+		served.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+		roundTrip := func(msg string) {
+			_, err := served.Write([]byte(msg))
+			checkErr(t, err)
+			buf := make([]byte, len(msg))
+			_, err = io.ReadFull(served, buf)
+			checkErr(t, err)
+			if string(buf) != msg {
+				t.Fatalf("unexpected echo %q, expected %q", buf, msg)
+			}
+		}
+		roundTrip("before the shutdown")
+		cancel()
+		if err := <-stopped; err != context.Canceled {
+			t.Fatalf("accept loop stopped with %v, expected %v", err, context.Canceled)
+		}
+		roundTrip("after the shutdown")
+
+		// streams opened as accepts are cancelled, one byte each.
+		const streams = 20
+		for i := 0; i < streams; i++ {
+			s, err := muxa.OpenStream()
+			checkErr(t, err)
+			defer s.Reset()
+			_, err = s.Write([]byte{byte(i)})
+			checkErr(t, err)
+		}
+		accepted := make(map[byte]bool)
+		deadline := time.Now().Add(scaleTimeout(10 * time.Second))
+		for len(accepted) < streams {
+			if time.Now().After(deadline) {
+				t.Fatalf("accepted %d streams of %d", len(accepted), streams)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(mrand.Intn(1000))*time.Microsecond)
+			s, err := server.AcceptStreamContext(ctx)
+			cancel()
+			if err == context.DeadlineExceeded {
+				continue
+			}
+			checkErr(t, err)
+			defer s.Reset()
+			s.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+			var b [1]byte
+			_, err = io.ReadFull(s, b[:])
+			checkErr(t, err)
+			if accepted[b[0]] {
+				t.Fatalf("stream %d accepted twice", b[0])
+			}
+			accepted[b[0]] = true
+		}
+
+		checkErr(t, served.Close())
+		_, err = ioutil.ReadAll(served)
+		checkErr(t, err)
+		wg.Wait()
+	}
+
+	check(smux.WithAcceptContext)
+	// hiding AcceptStreamContext makes WithAcceptContext emulate it.
+	check(func(c smux.Conn) smux.ContextAcceptConn {
+		return smux.WithAcceptContext(struct{ smux.Conn }{c})
+	})
+}
+
+const (
+	// soakWorkers open streams one after the other once the soak test
+	// ramped up, echoing soakMessages messages of up to soakMessageSize
+	// bytes on each.
+	soakWorkers     = 16
+	soakMessages    = 8
+	soakMessageSize = 16 << 10
+
+	// soakMaxWarmup bounds the ramp up, which is otherwise a quarter of
+	// the steady state.
+	soakMaxWarmup = 30 * time.Second
+
+	// soakSamples are taken of the goroutines and the heap over the
+	// steady state, and soakWindow of them at either end are compared.
+	soakSamples = 20
+	soakWindow  = 5
+
+	// soakMaxGoroutineDrift and soakMaxHeapDrift bound how much more
+	// goroutines and heap the end of the steady state may take than its
+	// start.
+	soakMaxGoroutineDrift = 4 * soakWorkers
+	soakMaxHeapDrift      = 8 << 20
+
+	// soakLongDuration is the steady state of SubtestSoakLong.
+	soakLongDuration = time.Minute
+)
+
+// SubtestSoak churns streams echoing messages over a connection for
+// duration, after ramping the number of streams at once up to soakWorkers
+// over a warmup, and fails if the goroutines or the heap drift up over
+// the steady state, as slow leaks the fixed-iteration stress tests finish
+// too fast to notice do. Either is compared at the least of the first and
+// the last samples, after garbage collecting, as a leak raises the floor
+// the streams in flight come and go above.
+func SubtestSoak(t testing.TB, tr smux.Transport, duration time.Duration) {
+	warmup := duration / 4
+	if warmup > soakMaxWarmup {
+		warmup = soakMaxWarmup
+	}
+
+	muxa, _, done := muxPair(t, tr, smux.EchoHandler)
+	defer done()
+	go muxa.AcceptStream()
+
+	errs := make(chan error, soakWorkers)
+	stopped := make(chan struct{})
+	var (
+		wg      sync.WaitGroup
+		streams int64
+		echoed  int64
+	)
+	// soak opens streams until the test stops, each echoing messages of
+	// random sizes and closed once they are echoed.
+	soak := func(r *mrand.Rand) error {
+		for {
+			select {
+			case <-stopped:
+				return nil
+			default:
+			}
+			s, err := muxa.OpenStream()
+			if err != nil {
+				return err
+			}
+			s.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+			for i := 0; i < soakMessages; i++ {
+				out := randBufFrom(r, 1+r.Intn(soakMessageSize))
+				if _, err := s.Write(out); err != nil {
+					s.Reset()
+					return err
+				}
+				in := make([]byte, len(out))
+				if _, err := io.ReadFull(s, in); err != nil {
+					s.Reset()
+					return err
+				}
+				if !bytes.Equal(in, out) {
+					s.Reset()
+					return fmt.Errorf("stream echoed %d bytes differing from those written", len(in))
+				}
+				atomic.AddInt64(&echoed, int64(len(out)))
+			}
+			if err := s.Close(); err != nil {
+				s.Reset()
+				return err
+			}
+			if _, err := ioutil.ReadAll(s); err != nil {
+				return err
+			}
+			atomic.AddInt64(&streams, 1)
+		}
+	}
+	defer func() {
+		close(stopped)
+		wg.Wait()
+	}()
+	seed := testSeed()
+	start := time.Now()
+	for w := 0; w < soakWorkers; w++ {
+		// the workers start evenly over the warmup.
+		time.Sleep(warmup / soakWorkers)
+		wg.Add(1)
+		go func(r *mrand.Rand) {
+			defer wg.Done()
+			if err := soak(r); err != nil {
+				errs <- err
+			}
+		}(mrand.New(mrand.NewSource(seed + int64(w))))
+	}
+	log("ramped up to %d streams at once in %s", soakWorkers, time.Since(start))
+
+	type sample struct {
+		goroutines int
+		heap       uint64
+	}
+	samples := make([]sample, 0, soakSamples)
+	ticker := time.NewTicker(duration / soakSamples)
+	defer ticker.Stop()
+	for len(samples) < soakSamples {
+		select {
+		case err := <-errs:
+			t.Fatalf("after %d streams: %v", atomic.LoadInt64(&streams), err)
+		case <-ticker.C:
+		}
+		runtime.GC()
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		samples = append(samples, sample{runtime.NumGoroutine(), m.HeapAlloc})
+		log("soak: %d streams, %d goroutines, heap %d bytes", atomic.LoadInt64(&streams), runtime.NumGoroutine(), m.HeapAlloc)
+	}
+
+	floor := func(samples []sample) sample {
+		min := samples[0]
+		for _, s := range samples[1:] {
+			if s.goroutines < min.goroutines {
+				min.goroutines = s.goroutines
+			}
+			if s.heap < min.heap {
+				min.heap = s.heap
+			}
+		}
+		return min
+	}
+	first, last := floor(samples[:soakWindow]), floor(samples[len(samples)-soakWindow:])
+	goroutineDrift := last.goroutines - first.goroutines
+	heapDrift := int64(last.heap) - int64(first.heap)
+	reportMetric(t, float64(atomic.LoadInt64(&streams))/time.Since(start).Seconds(), "streams/s")
+	reportMetric(t, float64(atomic.LoadInt64(&echoed))/time.Since(start).Seconds()/1e6, "MB/s")
+	reportMetric(t, float64(goroutineDrift), "goroutine-drift")
+	reportMetric(t, float64(heapDrift), "heap-drift-B")
+	if goroutineDrift > soakMaxGoroutineDrift {
+		t.Errorf("goroutines drifted from %d to %d over %s", first.goroutines, last.goroutines, duration)
+	}
+	if heapDrift > soakMaxHeapDrift {
+		t.Errorf("heap drifted from %d to %d bytes over %s", first.heap, last.heap, duration)
+	}
+}
+
+// SubtestSoakLong runs SubtestSoak for soakLongDuration. It is skipped
+// unless -smux.long is set.
+func SubtestSoakLong(t testing.TB, tr smux.Transport) {
+	if !*longTests {
+		t.Skip("long test, enable with -smux.long")
+	}
+	SubtestSoak(t, tr, soakLongDuration)
+}
+
+// idleTestTimeout is the StreamIdleTimeout of SubtestStreamIdleTimeout.
+const idleTestTimeout = 200 * time.Millisecond
+
+// SubtestStreamIdleTimeout checks Options.StreamIdleTimeout, as
+// smux.NewConnWithOptions enforces it: that streams reading and writing
+// more often than the timeout live on, even through a write the peer takes
+// longer than the timeout to read, and that an idle one is reset, failing
+// its reads and writes with a timeout error and the peer's reads.
+func SubtestStreamIdleTimeout(t testing.TB, tr smux.Transport) {
+	timeout := scaleTimeout(idleTestTimeout)
+	a, b := connPipe(t)
+	defer a.Close()
+	defer b.Close()
+
+	muxb, err := tr.NewConn(b, true)
+	checkErr(t, err)
+	defer muxb.Close()
+	// the server reports how each stream ended: 'e' streams are echoed,
+	// 's' streams are read slowly.
+	ended := make(chan error, 3)
+	defer serveConn(t, muxb, func(s smux.Stream) {
+		defer s.Close()
+		mode := make([]byte, 1)
+		_, err := io.ReadFull(s, mode)
+		switch {
+		case err != nil:
+		case mode[0] == 's':
+			buf := make([]byte, 64<<10)
+			for err == nil {
+				_, err = io.ReadFull(s, buf)
+				time.Sleep(timeout / 8)
+			}
+			if err == io.EOF {
+				err = nil
+			}
+		default:
+			_, err = io.Copy(s, s)
+		}
+		ended <- err
+	})()
+	muxa, err := smux.NewConnWithOptions(tr, a, false, smux.Options{StreamIdleTimeout: timeout})
+	checkErr(t, err)
+	defer muxa.Close()
+	go muxa.AcceptStream()
+
+	open := func(mode byte) smux.Stream {
+		s, err := muxa.OpenStream()
+		checkErr(t, err)
+		s.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+		_, err = s.Write([]byte{mode})
+		checkErr(t, err)
+		return s
+	}
+
+	echo := func(s smux.Stream, msg string) error {
+		if _, err := s.Write([]byte(msg)); err != nil {
+			return err
+		}
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(s, buf); err != nil {
+			return err
+		}
+		if string(buf) != msg {
+			return fmt.Errorf("unexpected echo %q, expected %q", buf, msg)
+		}
+		return nil
+	}
+
+	// a stream echoing every quarter of the timeout outlives it.
+	busy := open('e')
+	defer busy.Reset()
+	for i := 0; i < 12; i++ {
+		checkErr(t, echo(busy, fmt.Sprintf("busy %d", i)))
+		time.Sleep(timeout / 4)
+	}
+	checkErr(t, busy.Close())
+	_, err = ioutil.ReadAll(busy)
+	checkErr(t, err)
+	checkErr(t, <-ended)
+
+	// a stream written to for longer than the timeout, as the peer reads
+	// a quarter of the data each timeout, outlives it.
+	slow := open('s')
+	defer slow.Reset()
+	_, err = slow.Write(make([]byte, 32*64<<10))
+	checkErr(t, err)
+	checkErr(t, slow.Close())
+	checkErr(t, <-ended)
+
+	// an idle stream is reset, unblocking its read.
+	idle := open('e')
+	defer idle.Reset()
+	checkErr(t, echo(idle, "then idle"))
+	start := time.Now()
+	_, err = idle.Read(make([]byte, 1))
+	elapsed := time.Since(start)
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("read of an idle stream returned %v, expected a timeout", err)
+	}
+	if elapsed < timeout/2 {
+		t.Fatalf("idle stream reset after %s, with a timeout of %s", elapsed, timeout)
+	}
+	if elapsed > timeout+scaleTimeout(5*time.Second) {
+		t.Fatalf("idle stream reset after %s, with a timeout of %s", elapsed, timeout)
+	}
+	if _, err := idle.Write([]byte("too late")); err != smux.ErrTimeout {
+		t.Fatalf("write to a stream reset as idle returned %v, expected %v", err, smux.ErrTimeout)
+	}
+	select {
+	case err := <-ended:
+		if err == nil {
+			t.Fatal("the peer read EOF from a stream reset as idle")
+		}
+	case <-time.After(scaleTimeout(10 * time.Second)):
+		t.Fatal("the peer of a stream reset as idle still reads it")
+	}
+}
+
+// SubtestConnIdleTimeout checks Options.ConnIdleTimeout, as
+// smux.NewConnWithOptions enforces it: that connections with a stream open,
+// or opening streams more often than the timeout, live on, and that a
+// connection left without streams is closed, closing its smux.CloseChan.
+func SubtestConnIdleTimeout(t testing.TB, tr smux.Transport) {
+	timeout := scaleTimeout(idleTestTimeout)
+	a, b := connPipe(t)
+	defer a.Close()
+	defer b.Close()
+
+	muxb, err := tr.NewConn(b, true)
+	checkErr(t, err)
+	defer muxb.Close()
+	defer serveConn(t, muxb, smux.EchoHandler)()
+	muxa, err := smux.NewConnWithOptions(tr, a, false, smux.Options{ConnIdleTimeout: timeout})
+	checkErr(t, err)
+	defer muxa.Close()
+	go muxa.AcceptStream()
+	closed := smux.CloseChan(muxa)
+
+	echo := func(s smux.Stream, msg string) {
+		s.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+		_, err := s.Write([]byte(msg))
+		checkErr(t, err)
+		buf := make([]byte, len(msg))
+		_, err = io.ReadFull(s, buf)
+		checkErr(t, err)
+		if string(buf) != msg {
+			t.Fatalf("unexpected echo %q, expected %q", buf, msg)
+		}
+	}
+	finish := func(s smux.Stream) {
+		checkErr(t, s.Close())
+		_, err := ioutil.ReadAll(s)
+		checkErr(t, err)
+	}
+
+	// streams opened every quarter of the timeout keep it open.
+	for i := 0; i < 12; i++ {
+		s, err := muxa.OpenStream()
+		checkErr(t, err)
+		echo(s, fmt.Sprintf("stream %d", i))
+		finish(s)
+		time.Sleep(timeout / 4)
+	}
+
+	// so does a stream left open without traffic.
+	held, err := muxa.OpenStream()
+	checkErr(t, err)
+	defer held.Reset()
+	echo(held, "held")
+	select {
+	case <-closed:
+		t.Fatal("a connection with a stream open was closed as idle")
+	case <-time.After(3 * timeout):
+	}
+	echo(held, "still held")
+	finish(held)
+
+	// without streams, the connection is closed.
+	start := time.Now()
+	select {
+	case <-closed:
+	case <-time.After(timeout + scaleTimeout(10*time.Second)):
+		t.Fatalf("the idle connection is still open after %s, with a timeout of %s", time.Since(start), timeout)
+	}
+	if elapsed := time.Since(start); elapsed < timeout/2 {
+		t.Fatalf("connection closed as idle after %s, with a timeout of %s", elapsed, timeout)
+	}
+	if !muxa.IsClosed() {
+		t.Fatal("CloseChan fired before the connection was closed")
+	}
+	if _, err := muxa.OpenStream(); err == nil {
+		t.Fatal("opened a stream on a connection closed as idle")
+	}
+}
+
+const (
+	// chaosOps operations are run by SubtestChaos, on at most
+	// chaosMaxStreams streams at once.
+	chaosOps        = 1000
+	chaosMaxStreams = 16
+
+	// chaosMaxPending bounds the bytes written and not read yet in each
+	// direction of a stream, under the receive windows of muxers, so that
+	// writes do not block; chaosMaxWrite bounds the size of a write.
+	chaosMaxPending = 32 << 10
+	chaosMaxWrite   = 4 << 10
+)
+
+// chaosDir models the direction of a stream of SubtestChaos written by one
+// side.
+type chaosDir struct {
+	pending []byte // written and not read yet
+	closed  bool   // closed for writing
+	eof     bool   // read to EOF
+}
+
+// chaosStream models a stream of SubtestChaos. Its ends and directions are
+// indexed by side, 0 for the dialer and 1 for the listener.
+type chaosStream struct {
+	id   int
+	ends [2]smux.Stream
+	dirs [2]chaosDir
+}
+
+// SubtestChaos drives both sides of connections with a random schedule of
+// operations, seeded like the stress tests: opening streams from either
+// side, writing messages of random sizes, reading them, closing streams for
+// writing, resetting them, and closing connections to reconnect. It checks
+// every observation against a model of the streams: reads return exactly
+// the bytes written and not read yet, EOF only once those are read after
+// a close, and streams reset or on a closed connection fail rather than
+// read EOF early. Failures report the seed and the operations before.
+func SubtestChaos(t testing.TB, tr smux.Transport) {
+	seed := testSeed()
+	r := mrand.New(mrand.NewSource(seed))
+	var (
+		history []string
+		done    int
+	)
+	fail := func(format string, args ...interface{}) {
+		t.Fatalf("seed %d, operation %d: %s; previous operations:\n%s", seed, done, fmt.Sprintf(format, args...), strings.Join(history, "\n"))
+	}
+	record := func(format string, args ...interface{}) {
+		done++
+		history = append(history, fmt.Sprintf(format, args...))
+		if len(history) > 20 {
+			history = history[1:]
+		}
+	}
+	timeout := scaleTimeout(10 * time.Second)
+
+	var (
+		conns    [2]smux.Conn
+		accepted [2]chan smux.Stream
+		nets     [2]net.Conn
+		stop     chan struct{}
+		streams  []*chaosStream
+		nextID   int
+	)
+	connect := func() {
+		a, b := connPipe(t)
+		nets = [2]net.Conn{a, b}
+		muxb, err := tr.NewConn(b, true)
+		checkErr(t, err)
+		muxa, err := tr.NewConn(a, false)
+		checkErr(t, err)
+		conns = [2]smux.Conn{muxa, muxb}
+		stop = make(chan struct{})
+		for side := range conns {
+			c, ch, stop := conns[side], make(chan smux.Stream), stop
+			accepted[side] = ch
+			go func() {
+				defer close(ch)
+				for {
+					s, err := c.AcceptStream()
+					if err != nil {
+						return
+					}
+					select {
+					case ch <- s:
+					case <-stop:
+						s.Reset()
+						return
+					}
+				}
+			}()
+		}
+		streams = nil
+	}
+	disconnect := func() {
+		close(stop)
+		for side := range conns {
+			conns[side].Close()
+			nets[side].Close()
+		}
+	}
+	connect()
+	defer func() { disconnect() }()
+
+	// readData reads len(want) bytes from s, which must be want.
+	readData := func(s smux.Stream, want []byte) {
+		s.SetDeadline(time.Now().Add(timeout))
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(s, got); err != nil {
+			fail("reading %d bytes: %v", len(want), err)
+		}
+		if !bytes.Equal(got, want) {
+			fail("read %d bytes differing from those written", len(want))
+		}
+	}
+	// readFailure reads s until it fails, as its peer reset it or closed
+	// the connection: it may read some of the bytes written and not read
+	// yet, but EOF only once it read them all from a stream closed for
+	// writing.
+	readFailure := func(s smux.Stream, d chaosDir) error {
+		s.SetDeadline(time.Now().Add(timeout))
+		var got []byte
+		buf := make([]byte, 32<<10)
+		for {
+			n, err := s.Read(buf)
+			got = append(got, buf[:n]...)
+			if !bytes.HasPrefix(d.pending, got) {
+				fail("read %d bytes which were not written", len(got))
+			}
+			if err == io.EOF && !(d.closed && len(got) == len(d.pending)) {
+				fail("read EOF after %d of %d bytes, without a close", len(got), len(d.pending))
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	// pick returns a stream and a side for which ok holds, at random.
+	pick := func(ok func(s *chaosStream, side int) bool) (*chaosStream, int, bool) {
+		type candidate struct {
+			s    *chaosStream
+			side int
+		}
+		var cs []candidate
+		for _, s := range streams {
+			for side := 0; side < 2; side++ {
+				if ok(s, side) {
+					cs = append(cs, candidate{s, side})
+				}
+			}
+		}
+		if len(cs) == 0 {
+			return nil, 0, false
+		}
+		c := cs[r.Intn(len(cs))]
+		return c.s, c.side, true
+	}
+	remove := func(s *chaosStream) {
+		for i := range streams {
+			if streams[i] == s {
+				streams = append(streams[:i], streams[i+1:]...)
+				return
+			}
+		}
+	}
+
+	// the operations return whether they applied to the model's state.
+	ops := []struct {
+		weight int
+		run    func() bool
+	}{
+		{15, func() bool { // open a stream, announced by a first write
+			if len(streams) >= chaosMaxStreams {
+				return false
+			}
+			side := r.Intn(2)
+			s, err := conns[side].OpenStream()
+			if err != nil {
+				fail("opening a stream from side %d: %v", side, err)
+			}
+			s.SetDeadline(time.Now().Add(timeout))
+			msg := randBufFrom(r, 1+r.Intn(chaosMaxWrite))
+			if _, err := s.Write(msg); err != nil {
+				fail("writing %d bytes to a new stream: %v", len(msg), err)
+			}
+			var rs smux.Stream
+			select {
+			case rs = <-accepted[1-side]:
+			case <-time.After(timeout):
+			}
+			if rs == nil {
+				fail("stream opened by side %d not accepted", side)
+			}
+			cs := &chaosStream{id: nextID}
+			nextID++
+			cs.ends[side], cs.ends[1-side] = s, rs
+			// msg is shared randomness, which appending must not overwrite.
+			cs.dirs[side].pending = append([]byte(nil), msg...)
+			streams = append(streams, cs)
+			record("open stream %d from side %d, writing %d bytes", cs.id, side, len(msg))
+			return true
+		}},
+		{30, func() bool { // write
+			size := 1 + r.Intn(chaosMaxWrite)
+			s, side, ok := pick(func(s *chaosStream, side int) bool {
+				d := s.dirs[side]
+				return !d.closed && len(d.pending)+size <= chaosMaxPending
+			})
+			if !ok {
+				return false
+			}
+			msg := randBufFrom(r, size)
+			s.ends[side].SetDeadline(time.Now().Add(timeout))
+			if _, err := s.ends[side].Write(msg); err != nil {
+				fail("writing %d bytes to stream %d from side %d: %v", size, s.id, side, err)
+			}
+			s.dirs[side].pending = append(s.dirs[side].pending, msg...)
+			record("write %d bytes to stream %d from side %d", size, s.id, side)
+			return true
+		}},
+		{30, func() bool { // read, some of the bytes pending or EOF
+			s, side, ok := pick(func(s *chaosStream, side int) bool {
+				d := s.dirs[side]
+				return len(d.pending) > 0 || (d.closed && !d.eof)
+			})
+			if !ok {
+				return false
+			}
+			d := &s.dirs[side]
+			reader := s.ends[1-side]
+			if len(d.pending) > 0 {
+				n := 1 + r.Intn(len(d.pending))
+				record("read %d of %d bytes of stream %d from side %d", n, len(d.pending), s.id, side)
+				readData(reader, d.pending[:n])
+				d.pending = d.pending[n:]
+				return true
+			}
+			record("read EOF of stream %d from side %d", s.id, side)
+			reader.SetDeadline(time.Now().Add(timeout))
+			if n, err := reader.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+				fail("read of stream %d closed by side %d returned %d bytes and %v, expected EOF", s.id, side, n, err)
+			}
+			d.eof = true
+			if s.dirs[1-side].eof {
+				remove(s)
+			}
+			return true
+		}},
+		{10, func() bool { // close for writing
+			s, side, ok := pick(func(s *chaosStream, side int) bool { return !s.dirs[side].closed })
+			if !ok {
+				return false
+			}
+			record("close stream %d from side %d", s.id, side)
+			if err := s.ends[side].Close(); err != nil {
+				fail("closing stream %d from side %d: %v", s.id, side, err)
+			}
+			s.dirs[side].closed = true
+			return true
+		}},
+		{8, func() bool { // reset
+			s, side, ok := pick(func(s *chaosStream, side int) bool { return true })
+			if !ok {
+				return false
+			}
+			record("reset stream %d from side %d", s.id, side)
+			s.ends[side].Reset()
+			if _, err := s.ends[side].Write([]byte{1}); err == nil {
+				fail("write to stream %d after resetting it succeeded", s.id)
+			}
+			if d := s.dirs[side]; !d.eof {
+				if err := readFailure(s.ends[1-side], d); err != io.EOF && err != smux.ErrReset {
+					fail("read of stream %d reset by side %d failed with %v, expected %v", s.id, side, err, smux.ErrReset)
+				}
+			}
+			remove(s)
+			return true
+		}},
+		{2, func() bool { // close a connection, and reconnect
+			side := r.Intn(2)
+			record("close the connection of side %d, with %d streams", side, len(streams))
+			checkErr(t, conns[side].Close())
+			if _, err := conns[side].OpenStream(); err == nil {
+				fail("opened a stream on a closed connection")
+			}
+			for _, s := range streams {
+				if d := s.dirs[side]; !d.eof {
+					readFailure(s.ends[1-side], d)
+				}
+			}
+			select {
+			case _, ok := <-accepted[1-side]:
+				if ok {
+					fail("accepted a stream from a closed connection")
+				}
+			case <-time.After(timeout):
+				fail("the peer of a closed connection still accepts streams")
+			}
+			disconnect()
+			connect()
+			return true
+		}},
+	}
+	total := 0
+	for _, op := range ops {
+		total += op.weight
+	}
+	for n := scaleCount(t, chaosOps); n > 0; {
+		w := r.Intn(total)
+		for _, op := range ops {
+			if w -= op.weight; w < 0 {
+				if op.run() {
+					n--
+				}
+				break
+			}
+		}
+	}
+
+	// what is left is read, closed and read to EOF.
+	for _, s := range streams {
+		for side := 0; side < 2; side++ {
+			d := &s.dirs[side]
+			if d.eof {
+				continue
+			}
+			readData(s.ends[1-side], d.pending)
+			if !d.closed {
+				checkErr(t, s.ends[side].Close())
+			}
+			if n, err := s.ends[1-side].Read(make([]byte, 1)); n != 0 || err != io.EOF {
+				fail("final read of stream %d from side %d returned %d bytes and %v, expected EOF", s.id, side, n, err)
+			}
+		}
+	}
+}
+
+// Stress presets run by the SubtestStress* tests. Downstream muxers can
+// run them directly with SubtestStress(t, preset.WithTransport(tr)).
+var (
+	Stress1Conn1Stream1Msg = Options{
+		connNum:   1,
+		streamNum: 1,
+		msgNum:    1,
+		msgMax:    100,
+		msgMin:    100,
+	}
+	Stress1Conn1Stream100Msg = Options{
+		connNum:   1,
+		streamNum: 1,
+		msgNum:    100,
+		msgMax:    100,
+		msgMin:    100,
+	}
+	Stress1Conn100Stream100Msg = Options{
+		connNum:   1,
+		streamNum: 100,
+		msgNum:    100,
+		msgMax:    100,
+		msgMin:    100,
+	}
+	Stress50Conn10Stream50Msg = Options{
+		connNum:   50,
+		streamNum: 10,
+		msgNum:    50,
+		msgMax:    100,
+		msgMin:    100,
+	}
+	Stress1Conn1000Stream10Msg = Options{
+		connNum:   1,
+		streamNum: 1000,
+		msgNum:    10,
+		msgMax:    100,
+		msgMin:    100,
+	}
+	Stress1Conn100Stream100Msg10MB = Options{
+		connNum:   1,
+		streamNum: 100,
+		msgNum:    100,
+		msgMax:    10000,
+		msgMin:    1000,
+	}
+	// both sides open their streams toward each other at once.
+	StressDuplex1Conn200Stream20Msg = Options{
+		connNum:   1,
+		streamNum: 200,
+		msgNum:    20,
+		msgMax:    1000,
+		msgMin:    100,
+		duplex:    true,
+	}
+)
+
+// StressPresets maps the name of each stress preset to its Options.
+var StressPresets = map[string]Options{
+	"1Conn1Stream1Msg":          Stress1Conn1Stream1Msg,
+	"1Conn1Stream100Msg":        Stress1Conn1Stream100Msg,
+	"1Conn100Stream100Msg":      Stress1Conn100Stream100Msg,
+	"50Conn10Stream50Msg":       Stress50Conn10Stream50Msg,
+	"1Conn1000Stream10Msg":      Stress1Conn1000Stream10Msg,
+	"1Conn100Stream100Msg10MB":  Stress1Conn100Stream100Msg10MB,
+	"Duplex1Conn200Stream20Msg": StressDuplex1Conn200Stream20Msg,
+}
+
+func SubtestStress1Conn1Stream1Msg(t testing.TB, tr smux.Transport) {
+	SubtestStress(t, Stress1Conn1Stream1Msg.WithTransport(tr))
+}
+
+func SubtestStress1Conn1Stream100Msg(t testing.TB, tr smux.Transport) {
+	SubtestStress(t, Stress1Conn1Stream100Msg.WithTransport(tr))
+}
+
+func SubtestStress1Conn100Stream100Msg(t testing.TB, tr smux.Transport) {
+	SubtestStress(t, Stress1Conn100Stream100Msg.WithTransport(tr))
+}
+
+func SubtestStress50Conn10Stream50Msg(t testing.TB, tr smux.Transport) {
+	SubtestStress(t, Stress50Conn10Stream50Msg.WithTransport(tr))
+}
+
+func SubtestStress1Conn1000Stream10Msg(t testing.TB, tr smux.Transport) {
+	SubtestStress(t, Stress1Conn1000Stream10Msg.WithTransport(tr))
+}
+
+func SubtestStress1Conn100Stream100Msg10MB(t testing.TB, tr smux.Transport) {
+	SubtestStress(t, Stress1Conn100Stream100Msg10MB.WithTransport(tr))
+}
+
+// SubtestStressDuplex has both sides of a connection open hundreds of
+// streams toward each other at once, with data flowing both ways on all of
+// them, which stresses the accept backlogs, the allocation of the IDs of
+// streams opened simultaneously and the fairness of the write loops.
+func SubtestStressDuplex(t testing.TB, tr smux.Transport) {
+	SubtestStress(t, StressDuplex1Conn200Stream20Msg.WithTransport(tr))
+}
+
+// SubtestAcceptDeadline checks that the streams accepted through
+// smux.WithAcceptDeadline time out once idle past its timeout from being
+// accepted, and that clearing the deadline keeps them open.
+func SubtestAcceptDeadline(t testing.TB, tr smux.Transport) {
+	const timeout = 100 * time.Millisecond
+	grace := scaleTimeout(2 * time.Second)
+	muxa, muxb, done := muxPair(t, tr, nil)
+	defer done()
+	c := smux.WithAcceptDeadline(muxb, timeout)
+
+	// accept opens a stream writing a byte, and returns it accepted, with
+	// its byte read.
+	accept := func() (smux.Stream, smux.Stream) {
+		s, err := muxa.OpenStream()
+		checkErr(t, err)
+		_, err = s.Write([]byte("x"))
+		checkErr(t, err)
+		str, err := c.AcceptStream()
+		checkErr(t, err)
+		_, err = io.ReadFull(str, make([]byte, 1))
+		checkErr(t, err)
+		return s, str
+	}
+
+	s, str := accept()
+	defer s.Reset()
+	defer str.Reset()
+	start := time.Now()
+	if _, err := str.Read(make([]byte, 1)); !isTimeout(err) {
+		t.Fatalf("reading an idle accepted stream returned %v, expected a timeout", err)
+	}
+	if d := time.Since(start); d > timeout+grace {
+		t.Fatalf("idle accepted stream timed out after %s with a %s timeout", d, timeout)
+	}
+
+	s, str = accept()
+	defer s.Reset()
+	defer str.Reset()
+	checkErr(t, str.SetDeadline(time.Time{}))
+	go func() {
+		time.Sleep(3 * timeout)
+		s.Write([]byte("y"))
+	}()
+	_, err := io.ReadFull(str, make([]byte, 1))
+	checkErr(t, err)
+}
+
+// SubtestRequest checks that smux.DoRequest gets back the response of a
+// smux.RequestHandler, an error when the handler fails, and
+// smux.ErrMessageTooLarge for requests past smux.MaxRequestSize, after
+// which the connection still carries requests.
+func SubtestRequest(t testing.TB, tr smux.Transport) {
+	errRefused := errors.New("request refused")
+	muxa, _, done := muxPair(t, tr, smux.RequestHandler(func(req []byte) ([]byte, error) {
+		if string(req) == "refuse" {
+			return nil, errRefused
+		}
+		return bytes.ToUpper(req), nil
+	}))
+	defer done()
+
+	req := bytes.Repeat([]byte("request "), 10000)
+	resp, err := smux.DoRequest(muxa, req)
+	checkErr(t, err)
+	if !bytes.Equal(resp, bytes.ToUpper(req)) {
+		t.Fatalf("request of %d bytes answered with %d bytes different from the %d expected", len(req), len(resp), len(req))
+	}
+	if resp, err := smux.DoRequest(muxa, []byte("refuse")); err == nil {
+		t.Fatalf("request the handler failed answered with %q, expected an error", resp)
+	}
+	if _, err := smux.DoRequest(muxa, make([]byte, smux.MaxRequestSize+1)); err != smux.ErrMessageTooLarge {
+		t.Fatalf("request past MaxRequestSize returned %v, expected %v", err, smux.ErrMessageTooLarge)
+	}
+	resp, err = smux.DoRequest(muxa, []byte("again"))
+	checkErr(t, err)
+	if string(resp) != "AGAIN" {
+		t.Fatalf("request after the failed ones answered with %q, expected %q", resp, "AGAIN")
+	}
+}
+
+// SubtestCopyBoth checks that smux.CopyBoth tunnels a stream to a TCP
+// connection: each side's close for writing reaches the other as EOF,
+// with what was written before it, and a reset of the stream closes the
+// connection and is returned.
+func SubtestCopyBoth(t testing.TB, tr smux.Transport) {
+	// the tunnels of muxb end at the near sides of TCP connections, whose
+	// far sides go to far. They are connected up front, as networkPipe
+	// fails t, which the handlers must not.
+	near := make(chan net.Conn, 2)
+	far := make(chan net.Conn, 2)
+	for i := 0; i < 2; i++ {
+		n, f := networkPipe(t, TCPNetwork)
+		defer n.Close()
+		defer f.Close()
+		near <- n
+		far <- f
+	}
+	copied := make(chan error, 2)
+	muxa, _, done := muxPair(t, tr, func(s smux.Stream) {
+		copied <- smux.CopyBoth(s, <-near)
+	})
+	defer done()
+
+	s, err := muxa.OpenStream()
+	checkErr(t, err)
+	s.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+	msg := []byte("through the tunnel")
+	_, err = s.Write(msg)
+	checkErr(t, err)
+	checkErr(t, s.Close())
+	f := <-far
+	f.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+	got, err := ioutil.ReadAll(f)
+	checkErr(t, err)
+	if !bytes.Equal(got, msg) {
+		t.Fatalf("tunnel delivered %q, expected %q", got, msg)
+	}
+	reply := []byte("and back")
+	_, err = f.Write(reply)
+	checkErr(t, err)
+	checkErr(t, f.(*net.TCPConn).CloseWrite())
+	got, err = ioutil.ReadAll(s)
+	checkErr(t, err)
+	if !bytes.Equal(got, reply) {
+		t.Fatalf("tunnel delivered %q back, expected %q", got, reply)
+	}
+	select {
+	case err := <-copied:
+		checkErr(t, err)
+	case <-time.After(scaleTimeout(10 * time.Second)):
+		t.Fatal("CopyBoth did not return once both sides closed")
+	}
+
+	s, err = muxa.OpenStream()
+	checkErr(t, err)
+	_, err = s.Write(msg)
+	checkErr(t, err)
+	f = <-far
+	f.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+	_, err = io.ReadFull(f, make([]byte, len(msg)))
+	checkErr(t, err)
+	s.Reset()
+	select {
+	case err := <-copied:
+		if err == nil {
+			t.Fatal("CopyBoth of a stream reset returned nil, expected an error")
+		}
+	case <-time.After(scaleTimeout(5 * time.Second)):
+		missingFeature(t, tr, smux.FeatureReset, "CopyBoth did not return once the stream was reset")
+	}
+	if _, err := f.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("reading the connection of a stream reset returned %v, expected %v", err, io.EOF)
+	}
+}
+
+// SubtestSession checks that a smux.Session delivers the streams the peer
+// opens on Streams to a select loop, and once the peer closed the
+// connection closes Streams and Done and reports why from Err and
+// AcceptStream, as it does when closed locally.
+func SubtestSession(t testing.TB, tr smux.Transport) {
+	muxa, muxb, done := muxPair(t, tr, nil)
+	defer done()
+	sess := smux.NewSession(muxb)
+	defer sess.Close()
+
+	if err := sess.Err(); err != nil {
+		t.Fatalf("Err of an open session returned %v, expected nil", err)
+	}
+	const n = 3
+	go func() {
+		for i := 0; i < n; i++ {
+			s, err := muxa.OpenStream()
+			if err != nil {
+				return
+			}
+			s.Write([]byte{byte(i)})
+		}
+	}()
+	seen := make(map[byte]bool)
+	timeout := time.After(scaleTimeout(10 * time.Second))
+	for len(seen) < n {
+		select {
+		case s := <-sess.Streams():
+			s.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+			var b [1]byte
+			_, err := io.ReadFull(s, b[:])
+			checkErr(t, err)
+			seen[b[0]] = true
+			s.Reset()
+		case <-sess.Done():
+			t.Fatalf("session done with %v after %d streams, expected %d", sess.Err(), len(seen), n)
+		case <-timeout:
+			t.Fatalf("session received %d streams, expected %d", len(seen), n)
+		}
+	}
+
+	checkErr(t, muxa.Close())
+	select {
+	case <-sess.Done():
+	case <-time.After(scaleTimeout(10 * time.Second)):
+		t.Fatal("session not done once the peer closed the connection")
+	}
+	if _, ok := <-sess.Streams(); ok {
+		t.Fatal("Streams delivered a stream once the session was done")
+	}
+	if sess.Err() == nil {
+		t.Fatal("Err of a session done returned nil")
+	}
+	if _, err := sess.AcceptStream(); err != sess.Err() {
+		t.Fatalf("AcceptStream of a session done returned %v, expected %v", err, sess.Err())
+	}
+
+	c, d := connPipe(t)
+	defer c.Close()
+	defer d.Close()
+	muxd, err := tr.NewConn(d, true)
+	checkErr(t, err)
+	sess = smux.NewSession(muxd)
+	checkErr(t, sess.Close())
+	select {
+	case <-sess.Done():
+	case <-time.After(scaleTimeout(10 * time.Second)):
+		t.Fatal("session not done once closed")
+	}
+	if sess.Err() == nil {
+		t.Fatal("Err of a session closed returned nil")
+	}
+}
+
+// batchOpenConn is a smux.BatchOpenConn counting the batches it opens.
+type batchOpenConn struct {
+	smux.Conn
+	batches int32
+}
+
+func (c *batchOpenConn) OpenStreams(n int) ([]smux.Stream, error) {
+	atomic.AddInt32(&c.batches, 1)
+	var streams []smux.Stream
+	for i := 0; i < n; i++ {
+		s, err := c.OpenStream()
+		if err != nil {
+			return nil, err
+		}
+		streams = append(streams, s)
+	}
+	return streams, nil
+}
+
+// SubtestOpenStreams checks that smux.OpenStreams opens as many distinct
+// streams as asked, each carrying data, natively through a
+// smux.BatchOpenConn and one at a time otherwise, and none once the
+// connection is closed.
+func SubtestOpenStreams(t testing.TB, tr smux.Transport) {
+	muxa, _, done := muxPair(t, tr, echoStream)
+	defer done()
+
+	batch := &batchOpenConn{Conn: muxa}
+	for _, c := range []smux.Conn{muxa, batch} {
+		streams, err := smux.OpenStreams(c, 16)
+		checkErr(t, err)
+		if len(streams) != 16 {
+			t.Fatalf("OpenStreams opened %d streams, expected 16", len(streams))
+		}
+		for i, s := range streams {
+			s.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+			_, err := s.Write([]byte{byte(i)})
+			checkErr(t, err)
+		}
+		for i, s := range streams {
+			var b [1]byte
+			_, err := io.ReadFull(s, b[:])
+			checkErr(t, err)
+			if b[0] != byte(i) {
+				t.Fatalf("stream %d of a batch echoed %d", i, b[0])
+			}
+			s.Reset()
+		}
+	}
+	if n := atomic.LoadInt32(&batch.batches); n != 1 {
+		t.Fatalf("OpenStreams of a BatchOpenConn opened %d batches, expected 1", n)
+	}
+	streams, err := smux.OpenStreams(muxa, 0)
+	checkErr(t, err)
+	if len(streams) != 0 {
+		t.Fatalf("OpenStreams of no streams opened %d", len(streams))
+	}
+
+	checkErr(t, muxa.Close())
+	if streams, err := smux.OpenStreams(muxa, 4); err == nil || streams != nil {
+		t.Fatalf("OpenStreams on a closed connection returned %d streams and %v, expected none and an error", len(streams), err)
+	}
+}
+
+// lyingStream breaks the Stream contract: its writes succeed once it is
+// closed, and it reads data after io.EOF.
+type lyingStream struct {
+	smux.Stream
+	closed, eof bool
+}
+
+func (s *lyingStream) Close() error {
+	s.closed = true
+	return s.Stream.Close()
+}
+
+func (s *lyingStream) Write(b []byte) (int, error) {
+	if s.closed {
+		return len(b), nil
+	}
+	return s.Stream.Write(b)
+}
+
+func (s *lyingStream) Read(b []byte) (int, error) {
+	if s.eof {
+		return copy(b, "more"), nil
+	}
+	n, err := s.Stream.Read(b)
+	s.eof = err == io.EOF
+	return n, err
+}
+
+// lyingConn breaks the Conn contract: it opens neither a stream nor
+// returns an error.
+type lyingConn struct {
+	smux.Conn
+}
+
+func (lyingConn) OpenStream() (smux.Stream, error) { return nil, nil }
+
+// expectViolation fails t unless f panics with a *smux.ContractViolation
+// of op.
+func expectViolation(t testing.TB, op string, f func()) {
+	defer func() {
+		v, ok := recover().(*smux.ContractViolation)
+		if !ok || v.Op != op {
+			t.Fatalf("expected a contract violation in %s, got %v", op, v)
+		}
+		log("%v", v)
+	}()
+	f()
+}
+
+// SubtestVerify checks that smux.VerifyConn carries the streams of a
+// connection keeping the contract of the interfaces as they are, and that
+// smux.VerifyConn and smux.VerifyStream panic with a
+// *smux.ContractViolation on connections and streams breaking it.
+func SubtestVerify(t testing.TB, tr smux.Transport) {
+	muxa, muxb, done := muxPair(t, tr, nil)
+	defer done()
+	defer serveConn(t, smux.VerifyConn(muxb), echoStream)()
+	c := smux.VerifyConn(muxa)
+
+	s, err := c.OpenStream()
+	checkErr(t, err)
+	s.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+	msg := []byte("verified")
+	_, err = s.Write(msg)
+	checkErr(t, err)
+	checkErr(t, s.Close())
+	got, err := ioutil.ReadAll(s)
+	checkErr(t, err)
+	if !bytes.Equal(got, msg) {
+		t.Fatalf("verified stream echoed %q, expected %q", got, msg)
+	}
+
+	s, err = muxa.OpenStream()
+	checkErr(t, err)
+	defer s.Reset()
+	s.SetDeadline(time.Now().Add(scaleTimeout(10 * time.Second)))
+	vs := smux.VerifyStream(&lyingStream{Stream: s})
+	_, err = vs.Write(msg)
+	checkErr(t, err)
+	checkErr(t, vs.Close())
+	expectViolation(t, "Write", func() { vs.Write(msg) })
+	_, err = ioutil.ReadAll(vs)
+	checkErr(t, err)
+	expectViolation(t, "Read", func() { vs.Read(make([]byte, 8)) })
+
+	expectViolation(t, "OpenStream", func() { smux.VerifyConn(lyingConn{muxa}).OpenStream() })
+	checkErr(t, c.Close())
+	if _, err := c.OpenStream(); err == nil {
+		t.Fatal("OpenStream on a closed verified connection succeeded")
+	}
+}
+
+// Subtests are all the subtests run by SubtestAll
+var Subtests = []TransportTest{
+	SubtestSimpleWrite,
+	SubtestWriteAfterClose,
+	SubtestStress1Conn1Stream1Msg,
+	SubtestStress1Conn1Stream100Msg,
+	SubtestStress1Conn100Stream100Msg,
+	SubtestStress50Conn10Stream50Msg,
+	SubtestStress1Conn1000Stream10Msg,
+	SubtestStress1Conn100Stream100Msg10MB,
+	SubtestStressDuplex,
+	SubtestStreamOpenStress,
+	SubtestStreamReset,
+	SubtestAcceptDeadline,
+	SubtestRequest,
+	SubtestCopyBoth,
+	SubtestSession,
+	SubtestOpenStreams,
+	SubtestGroupReceiveBudget,
+	SubtestReceiveWindowShrink,
+	SubtestCloseLinger,
+	SubtestAbort,
+	SubtestStopAccepting,
+	SubtestVerify,
+	SubtestDeadlineUnderLoad,
+	SubtestAcceptStyles,
+	SubtestOpenStreamContext,
+	SubtestHalfClose,
+	SubtestResetUnblocks,
+	SubtestDeadline,
+	SubtestNetConn,
+	SubtestCloseChan,
+	SubtestStreamCount,
+	SubtestErrors,
+	SubtestConnOptions,
+	SubtestPing,
+	SubtestCloseGracefully,
+	SubtestNamedStreams,
+	SubtestStreamIDs,
+	SubtestPriority,
+	SubtestConnStat,
+	SubtestStreamStat,
+	SubtestWriteBuffers,
+	SubtestStreamObserver,
+	SubtestNetListener,
+	SubtestHTTPTunnel,
+	SubtestGarbageInput,
+	SubtestWriteAfterRemoteClose,
+	SubtestCloseEOF,
+	SubtestCloseRace,
+	SubtestBackpressure,
+	SubtestLargeTransfer,
+	SubtestIdleStreams,
+	SubtestStreamChurn,
+	SubtestStreamIDLimit,
+	SubtestKeepAlive,
+	SubtestSimpleWriteWAN,
+	SubtestStressWAN,
+	SubtestSeverConn,
+	SubtestSimpleWriteDribble,
+	SubtestStressDribble,
+	SubtestEchoLatency,
+	SubtestServerOpensStream,
+	SubtestFairness,
+	SubtestMaxStreams,
+	SubtestReadBuffer,
+	SubtestSyncOpen,
+	SubtestALPN,
+	SubtestAcceptStreamContext,
+	SubtestSoakLong,
+	SubtestStreamIdleTimeout,
+	SubtestConnIdleTimeout,
+	SubtestChaos,
+	SubtestKeepAliveEmulated,
+	SubtestCompression,
+	SubtestRateLimits,
+	SubtestGoAway,
+	SubtestWindowStall,
+	SubtestLocalClose,
+	SubtestOpenBeforeServe,
+	SubtestWait,
+	SubtestResetCodes,
+	SubtestOpenTimeout,
+	SubtestAcceptBacklog,
+	SubtestConcurrentReadWrite,
+	SubtestUnderlyingConn,
+	SubtestStreamTLS,
+	SubtestStreamConn,
+	SubtestAsyncOpener,
+}
+
+func getFunctionName(i interface{}) string {
+	return runtime.FuncForPC(reflect.ValueOf(i).Pointer()).Name()
+}
+
+// SingleStreamSubtests are the tests of Subtests that only open streams
+// from the dialing side, one per connection, which transports carrying a
+// single stream like the identity transport can pass.
+var SingleStreamSubtests = []TransportTest{
+	SubtestSimpleWrite,
+	SubtestWriteAfterClose,
+	SubtestStress1Conn1Stream1Msg,
+	SubtestStress1Conn1Stream100Msg,
+	SubtestOpenStreamContext,
+	SubtestNetConn,
+	SubtestCloseGracefully,
+	SubtestWriteBuffers,
+}
+
+// subtestFeatures are the features subtests rely on, besides
+// FeatureMultiplex, which all but SingleStreamSubtests rely on.
+var subtestFeatures = map[string]smux.Features{
+	getFunctionName(SubtestStreamReset):         smux.FeatureReset,
+	getFunctionName(SubtestResetUnblocks):       smux.FeatureReset,
+	getFunctionName(SubtestDeadline):            smux.FeatureDeadlines,
+	getFunctionName(SubtestDeadlineUnderLoad):   smux.FeatureDeadlines,
+	getFunctionName(SubtestAcceptDeadline):      smux.FeatureDeadlines,
+	getFunctionName(SubtestStreamIDs):           smux.FeatureStreamIDs,
+	getFunctionName(SubtestPriority):            smux.FeaturePriority,
+	getFunctionName(SubtestGroupReceiveBudget):  smux.FeatureReceiveWindow,
+	getFunctionName(SubtestReceiveWindowShrink): smux.FeatureReceiveWindow,
+	getFunctionName(SubtestCloseLinger):         smux.FeatureLinger,
+	getFunctionName(SubtestAbort):               smux.FeatureAbort,
+	getFunctionName(SubtestChaos):               smux.FeatureReset,
+}
+
+// requiredFeatures returns the features the subtest f relies on.
+func requiredFeatures(f TransportTest) smux.Features {
+	name := getFunctionName(f)
+	for _, g := range SingleStreamSubtests {
+		if getFunctionName(g) == name {
+			return subtestFeatures[name]
+		}
+	}
+	return subtestFeatures[name] | smux.FeatureMultiplex
+}
+
+// declaredFeatures returns the features tr declares, looking through the
+// pipeTransport wrapper.
+func declaredFeatures(tr smux.Transport) (smux.Features, bool) {
+	if pt, ok := tr.(pipeTransport); ok {
+		tr = pt.Transport
+	}
+	return smux.TransportFeatures(tr)
+}
+
+// skipUndeclared skips the subtest f if tr declares its features, and not
+// all of those f relies on. Subtests of transports declaring nothing run,
+// and skip themselves on finding a feature missing.
+func skipUndeclared(t testing.TB, tr smux.Transport, f TransportTest) {
+	has, ok := declaredFeatures(tr)
+	if !ok {
+		return
+	}
+	if missing := requiredFeatures(f) &^ has; missing != 0 {
+		t.Skipf("transport does not declare %s", missing)
+	}
+}
+
+// missingFeature skips t on finding the feature f missing, as msg says,
+// unless tr declares f, which fails t instead.
+func missingFeature(t testing.TB, tr smux.Transport, f smux.Features, msg string) {
+	if has, _ := declaredFeatures(tr); has.Has(f) {
+		t.Fatalf("transport declares %s, but %s", f, msg)
+	}
+	t.Skip(msg)
+}
+
+// skipNoWire skips t if tr declares smux.FeatureNoWire, as what t does to
+// the net.Conn of a connection does not reach its streams.
+func skipNoWire(t testing.TB, tr smux.Transport) {
+	if has, _ := declaredFeatures(tr); has.Has(smux.FeatureNoWire) {
+		t.Skip("transport carries no data over its net.Conn")
+	}
+}
+
+// missingWire skips t on finding that the connections of tr carry no data
+// over their net.Conn, unless tr declares its features without
+// smux.FeatureNoWire, which fails t instead.
+func missingWire(t testing.TB, tr smux.Transport) {
+	const msg = "connections carry no data over their net.Conn"
+	if _, ok := declaredFeatures(tr); ok {
+		t.Fatalf("transport does not declare %s, but %s", smux.FeatureNoWire, msg)
+	}
+	t.Skip(msg)
+}
+
+// SubtestAll runs all the stream multiplexer tests against the target
+// transport.
+func SubtestAll(t testing.TB, tr smux.Transport) {
+	runSubtests(t, tr, Subtests)
+}
+
+// SubtestSingleStream runs SingleStreamSubtests against the target
+// transport.
+func SubtestSingleStream(t testing.TB, tr smux.Transport) {
+	runSubtests(t, tr, SingleStreamSubtests)
+}
+
+// SubtestAllPipes runs all the stream multiplexer tests against the target
+// transport, with its connections established by smux.NewConnRWC over
+// io.Pipe pairs instead of directly over net.Conns.
+func SubtestAllPipes(t testing.TB, tr smux.Transport) {
+	runSubtests(t, pipeTransport{tr}, Subtests)
+}
+
+// SubtestAllStreamTLS runs all the stream multiplexer tests against the
+// target transport wrapped by smux.WithStreamTLS, with the certificate of
+// TLSNetwork, to check that encrypting every stream is transparent. Every
+// stream costing a handshake, SubtestStreamOpenStress can outlast its
+// timeout at the normal scale on small machines; run the suite with -short
+// or -smux.scale quick there.
+func SubtestAllStreamTLS(t testing.TB, tr smux.Transport) {
+	server, client, err := tlsConfigs()
+	checkErr(t, err)
+	// streams resume the sessions of the first, as deployments should.
+	client = client.Clone()
+	client.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	runSubtests(t, smux.WithStreamTLS(tr, client, server), Subtests)
+}
+
+// SubtestAllNetwork runs all the stream multiplexer tests against the
+// target transport over n, rather than the networks listed by -smux.net.
+func SubtestAllNetwork(t testing.TB, tr smux.Transport, n Network) {
+	RunOverNetwork(t, n, func(t testing.TB) {
+		runTests(t, tr, Subtests)
+	})
+}
+
+func runSubtests(t testing.TB, tr smux.Transport, tests []TransportTest) {
+	forEachNetwork(t, func(t testing.TB) {
+		runTests(t, tr, tests)
+	})
+}
+
+// runTests runs tests against tr over the network the subtests run over.
+func runTests(t testing.TB, tr smux.Transport, tests []TransportTest) {
+	for _, f := range tests {
+		f := f
+		measureSubtest(t, "", tr, getFunctionName(f), func(t testing.TB) {
+			skipUndeclared(t, tr, f)
+			defer startWatchdog(t)()
+			defer checkLeaks(t)()
+			f(t, tr)
+		})
+	}
+}
+
+// run runs f as a subtest or a sub-benchmark of t, named name, or directly
+// if t is neither a *testing.T nor a *testing.B. The subtests of those
+// measureSubtest runs keep their failures with theirs.
+func run(t testing.TB, name string, f func(t testing.TB)) {
+	switch t := t.(type) {
+	case *failureLog:
+		run(t.TB, name, func(tb testing.TB) {
+			f(&failureLog{TB: tb, failures: t.failures})
 		})
+	case *testing.T:
+		t.Run(name, func(t *testing.T) { f(t) })
+	case *testing.B:
+		t.Run(name, func(b *testing.B) { f(b) })
+	default:
+		f(t)
 	}
 }
 
 // TransportTest is a stream multiplex transport test case
-type TransportTest func(t *testing.T, tr smux.Transport)
+type TransportTest func(t testing.TB, tr smux.Transport)
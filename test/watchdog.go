@@ -0,0 +1,95 @@
+package sm_test
+
+import (
+	"flag"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+var subtestTimeout = flag.Duration("smux.timeout", 2*time.Minute, "fail subtests run by SubtestAll and RunMatrix still running after this long, dumping the stacks of all goroutines and closing their connections so that the others can run; 0 disables it, and -smux.long subtests may need more")
+
+// watchdog closes the connections of a subtest which timed out.
+type watchdog struct {
+	mu      sync.Mutex
+	stopped bool
+	fired   bool
+	conns   []net.Conn
+}
+
+var (
+	watchdogMu sync.Mutex
+	// the watchdog of the running subtest. The subtests run one at a
+	// time, so the connections established meanwhile are theirs.
+	activeWatchdog *watchdog
+)
+
+// startWatchdog fails t once it runs for longer than -smux.timeout, with
+// the stacks of all goroutines, and closes the connections watched since,
+// which unblocks the muxers reading and writing them, so that t returns
+// and the other subtests run. The returned function stops the watchdog.
+// It does nothing if -smux.timeout is 0.
+func startWatchdog(t testing.TB) (stop func()) {
+	if *subtestTimeout <= 0 {
+		return func() {}
+	}
+
+	w := &watchdog{}
+	watchdogMu.Lock()
+	activeWatchdog = w
+	watchdogMu.Unlock()
+
+	timeout := scaleTimeout(*subtestTimeout)
+	timer := time.AfterFunc(timeout, func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if w.stopped {
+			return
+		}
+		t.Errorf("still running after %s, closing its %d connections; goroutines:\n\n%s", timeout, len(w.conns), allStacks())
+		for _, c := range w.conns {
+			c.Close()
+		}
+		w.conns = nil
+		w.fired = true
+	})
+
+	return func() {
+		timer.Stop()
+		// wait for the timer's function if it is running, since t must
+		// not be failed once it returned.
+		w.mu.Lock()
+		w.stopped = true
+		w.conns = nil
+		w.mu.Unlock()
+
+		watchdogMu.Lock()
+		if activeWatchdog == w {
+			activeWatchdog = nil
+		}
+		watchdogMu.Unlock()
+	}
+}
+
+// watch returns c, which the watchdog of the running subtest closes if it
+// times out, or closed if it already has.
+func watch(c net.Conn) net.Conn {
+	watchdogMu.Lock()
+	w := activeWatchdog
+	watchdogMu.Unlock()
+	if w == nil {
+		return c
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	switch {
+	case w.stopped:
+	case w.fired:
+		c.Close()
+	default:
+		w.conns = append(w.conns, c)
+	}
+	return c
+}
@@ -0,0 +1,157 @@
+package sm_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	mrand "math/rand"
+	"testing"
+
+	smux "github.com/dms3-p2p/go-stream-muxer"
+)
+
+// OpKind is the kind of operation in a Workload.
+type OpKind int
+
+const (
+	// OpOpen opens a new stream in the op's slot.
+	OpOpen OpKind = iota
+	// OpWrite writes Size bytes on the slot's stream and reads back the
+	// echo.
+	OpWrite
+	// OpClose closes the slot's stream and waits for the echo side to
+	// close too.
+	OpClose
+	// OpReset resets the slot's stream.
+	OpReset
+)
+
+func (k OpKind) String() string {
+	switch k {
+	case OpOpen:
+		return "open"
+	case OpWrite:
+		return "write"
+	case OpClose:
+		return "close"
+	case OpReset:
+		return "reset"
+	default:
+		return fmt.Sprintf("OpKind(%d)", int(k))
+	}
+}
+
+// Op is a single step of a Workload. Stream is the slot the op applies to;
+// a slot holds at most one open stream at a time and can be reused after
+// the stream in it is closed or reset.
+type Op struct {
+	Kind   OpKind
+	Stream int
+	Size   int
+}
+
+func (op Op) String() string {
+	if op.Kind == OpWrite {
+		return fmt.Sprintf("%s(%d, %d)", op.Kind, op.Stream, op.Size)
+	}
+	return fmt.Sprintf("%s(%d)", op.Kind, op.Stream)
+}
+
+// Workload is a sequence of stream operations run by SubtestWorkload, from
+// the dialing side of a connection against an echoing listener. Workloads
+// let regression scenarios be written down as data.
+type Workload []Op
+
+// RandomWorkload generates a valid workload of n ops over at most slots
+// concurrently open streams, writing up to maxSize bytes at a time.
+func RandomWorkload(r *mrand.Rand, n, slots, maxSize int) Workload {
+	open := make([]bool, slots)
+	w := make(Workload, 0, n)
+	for len(w) < n {
+		slot := r.Intn(slots)
+		if !open[slot] {
+			w = append(w, Op{Kind: OpOpen, Stream: slot})
+			open[slot] = true
+			continue
+		}
+
+		switch p := r.Intn(10); {
+		case p < 7:
+			w = append(w, Op{Kind: OpWrite, Stream: slot, Size: 1 + r.Intn(maxSize)})
+		case p < 9:
+			w = append(w, Op{Kind: OpClose, Stream: slot})
+			open[slot] = false
+		default:
+			w = append(w, Op{Kind: OpReset, Stream: slot})
+			open[slot] = false
+		}
+	}
+	return w
+}
+
+// SubtestWorkload runs the workload against the transport and fails on the
+// first op that does not behave as expected.
+func SubtestWorkload(t testing.TB, tr smux.Transport, w Workload) {
+	muxa, _, done := muxPair(t, tr, echoStream)
+	defer done()
+	go muxa.AcceptStream()
+
+	runWorkload(t, muxa, w, randBuf)
+}
+
+// runWorkload runs the workload over c, whose remote side echoes all
+// streams, writing payloads returned by data.
+func runWorkload(t testing.TB, c smux.Conn, w Workload, data func(size int) []byte) {
+	streams := make(map[int]smux.Stream)
+	defer func() {
+		for _, s := range streams {
+			s.Reset()
+		}
+	}()
+
+	for i, op := range w {
+		log("workload op %d: %s", i, op)
+
+		s, ok := streams[op.Stream]
+		if ok == (op.Kind == OpOpen) {
+			t.Fatalf("op %d (%s): slot in wrong state (open: %t)", i, op, ok)
+		}
+
+		switch op.Kind {
+		case OpOpen:
+			s, err := c.OpenStream()
+			if err != nil {
+				t.Fatalf("op %d (%s): %s", i, op, err)
+			}
+			streams[op.Stream] = s
+		case OpWrite:
+			out := data(op.Size)
+			if _, err := s.Write(out); err != nil {
+				t.Fatalf("op %d (%s): write: %s", i, op, err)
+			}
+			in := make([]byte, op.Size)
+			if _, err := io.ReadFull(s, in); err != nil {
+				t.Fatalf("op %d (%s): read: %s", i, op, err)
+			}
+			if !bytes.Equal(in, out) {
+				t.Fatalf("op %d (%s): echoed data does not match", i, op)
+			}
+		case OpClose:
+			delete(streams, op.Stream)
+			if err := s.Close(); err != nil {
+				t.Fatalf("op %d (%s): %s", i, op, err)
+			}
+			if _, err := io.Copy(ioutil.Discard, s); err != nil {
+				t.Fatalf("op %d (%s): expected EOF from echo side: %s", i, op, err)
+			}
+		case OpReset:
+			delete(streams, op.Stream)
+			if err := s.Reset(); err != nil {
+				t.Fatalf("op %d (%s): %s", i, op, err)
+			}
+		default:
+			t.Fatalf("op %d: unknown op kind %s", i, op.Kind)
+		}
+	}
+}
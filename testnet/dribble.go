@@ -0,0 +1,104 @@
+package testnet
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxDribble is the most bytes a read of a Dribble connection returns.
+const maxDribble = 7
+
+// coalesceDelay is how long a Dribble connection holds written data back
+// at most, waiting for more to send along.
+const coalesceDelay = time.Millisecond
+
+// Dribble returns c returning 1 to 7 bytes from every read, and holding
+// back some of the data written to it to send it along with later writes,
+// so that the muxer sees its frames split and merged at arbitrary
+// offsets, which loopback connections hardly do. seed seeds the sizes and
+// the writes held back; 0 seeds them from the clock.
+func Dribble(c net.Conn, seed int64) net.Conn {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &dribbleConn{Conn: c, rand: rand.New(rand.NewSource(seed))}
+}
+
+type dribbleConn struct {
+	net.Conn
+
+	mu      sync.Mutex
+	rand    *rand.Rand
+	pending []byte // written, not sent yet
+	flush   *time.Timer
+	err     error // of the last send
+
+	sending sync.Mutex // keeps sends in order
+}
+
+func (c *dribbleConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	n := 1 + c.rand.Intn(maxDribble)
+	c.mu.Unlock()
+	if len(b) > n {
+		b = b[:n]
+	}
+	return c.Conn.Read(b)
+}
+
+// Write sends the data held back and b together, or holds b back too, for
+// at most a millisecond. An error sending data held back is returned by
+// the next Write.
+func (c *dribbleConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	if err := c.err; err != nil {
+		c.mu.Unlock()
+		return 0, err
+	}
+	c.pending = append(c.pending, b...)
+	if c.rand.Intn(2) == 0 {
+		if c.flush == nil {
+			c.flush = time.AfterFunc(coalesceDelay, func() { c.send() })
+		}
+		c.mu.Unlock()
+		return len(b), nil
+	}
+	c.mu.Unlock()
+	if err := c.send(); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// send writes the data held back to c.Conn.
+func (c *dribbleConn) send() error {
+	c.sending.Lock()
+	defer c.sending.Unlock()
+	c.mu.Lock()
+	data := c.pending
+	c.pending = nil
+	if c.flush != nil {
+		c.flush.Stop()
+		c.flush = nil
+	}
+	c.mu.Unlock()
+	if len(data) == 0 {
+		return nil
+	}
+
+	_, err := c.Conn.Write(data)
+	if err != nil {
+		c.mu.Lock()
+		c.err = err
+		c.mu.Unlock()
+	}
+	return err
+}
+
+// Close sends the data held back, and closes c.Conn.
+func (c *dribbleConn) Close() error {
+	c.send()
+	return c.Conn.Close()
+}
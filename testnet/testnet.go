@@ -0,0 +1,214 @@
+// Package testnet simulates imperfect networks for tests, with a net.Conn
+// wrapper adding latency, jitter, limited bandwidth, loss and random
+// resets to the data written to a connection, and one splitting and
+// merging the data read and written at random.
+//
+// Flow control bugs of muxers, such as windows updated too late or
+// deadlocks between streams, mostly show up over such networks, rather
+// than over loopback connections:
+//
+//	a, b := net.Pipe()
+//	ca, cb := testnet.Wrap(a, testnet.WAN), testnet.Wrap(b, testnet.WAN)
+package testnet
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrReset is returned by the reads and writes of a connection reset by
+// its Conditions.
+var ErrReset = errors.New("testnet: connection reset")
+
+// RetransmitTimeout is how much longer than the latency lost writes take
+// to be delivered, like TCP segments retransmitted after Linux's minimum
+// retransmission timeout.
+const RetransmitTimeout = 200 * time.Millisecond
+
+// queueWrites is the number of writes queued for delivery, after which
+// writes block, as on a full socket buffer.
+const queueWrites = 1024
+
+// Conditions describe the network a connection simulates, in the direction
+// of the data written to it.
+type Conditions struct {
+	// Latency delays the data of every write.
+	Latency time.Duration
+
+	// Jitter adds up to that much more delay, at random. As on a TCP
+	// connection, data is never reordered: data written after a more
+	// delayed write waits for it.
+	Jitter time.Duration
+
+	// Bandwidth is the rate data is delivered at, in bytes per second, or
+	// 0 for no limit.
+	Bandwidth int
+
+	// Loss is the fraction of writes lost and retransmitted, which
+	// delays them by RetransmitTimeout.
+	Loss float64
+
+	// ResetRate is the fraction of writes which reset the connection
+	// instead, so that its reads and writes fail with ErrReset.
+	ResetRate float64
+
+	// Seed seeds the random delays, losses and resets, so that a run
+	// can be reproduced. 0 seeds them from the clock.
+	Seed int64
+}
+
+// WAN is a long distance link over a congested network: 100ms one way,
+// with up to 10ms of jitter and 1% of writes lost.
+var WAN = Conditions{
+	Latency: 100 * time.Millisecond,
+	Jitter:  10 * time.Millisecond,
+	Loss:    0.01,
+}
+
+// Wrap returns c delivering the data written to it under the conditions
+// cond. Reads are not changed; wrap both ends of a connection to simulate
+// both directions. Closing the returned net.Conn closes c at once, losing
+// the data not delivered yet.
+func Wrap(c net.Conn, cond Conditions) net.Conn {
+	seed := cond.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	tc := &conn{
+		Conn:   c,
+		cond:   cond,
+		rand:   rand.New(rand.NewSource(seed)),
+		queue:  make(chan delayedWrite, queueWrites),
+		closed: make(chan struct{}),
+	}
+	return tc
+}
+
+type conn struct {
+	net.Conn
+	cond Conditions
+
+	mu         sync.Mutex
+	rand       *rand.Rand
+	due        time.Time // of the last write queued
+	err        error     // ErrReset once reset
+	delivering bool      // deliver is running
+
+	queue  chan delayedWrite
+	closed chan struct{}
+	once   sync.Once
+}
+
+type delayedWrite struct {
+	due  time.Time
+	data []byte
+}
+
+// deliver writes the queued data to c.Conn when it is due. It runs while
+// data is queued, so that idle connections which are never closed, as
+// the kernel would close their sockets, do not leave it running.
+func (c *conn) deliver() {
+	for {
+		select {
+		case w := <-c.queue:
+			time.Sleep(time.Until(w.due))
+			if _, err := c.Conn.Write(w.data); err != nil {
+				c.Close()
+				return
+			}
+			if c.cond.Bandwidth > 0 {
+				time.Sleep(time.Duration(len(w.data)) * time.Second / time.Duration(c.cond.Bandwidth))
+			}
+		case <-c.closed:
+			return
+		default:
+			c.mu.Lock()
+			if len(c.queue) == 0 {
+				c.delivering = false
+				c.mu.Unlock()
+				return
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+// schedule returns when the data of a write made now is due, or ErrReset
+// if the write resets the connection.
+func (c *conn) schedule() (time.Time, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return time.Time{}, c.err
+	}
+	if c.cond.ResetRate > 0 && c.rand.Float64() < c.cond.ResetRate {
+		c.err = ErrReset
+		return time.Time{}, c.err
+	}
+
+	delay := c.cond.Latency
+	if c.cond.Jitter > 0 {
+		delay += time.Duration(c.rand.Int63n(int64(c.cond.Jitter)))
+	}
+	if c.cond.Loss > 0 && c.rand.Float64() < c.cond.Loss {
+		delay += RetransmitTimeout
+	}
+	due := time.Now().Add(delay)
+	if due.Before(c.due) {
+		due = c.due
+	}
+	c.due = due
+	return due, nil
+}
+
+func (c *conn) reset() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if rerr := c.reset(); rerr != nil && err != nil {
+		err = rerr
+	}
+	return n, err
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	due, err := c.schedule()
+	if err != nil {
+		c.Close()
+		return 0, err
+	}
+	select {
+	case <-c.closed:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	w := delayedWrite{due, append([]byte(nil), b...)}
+	select {
+	case c.queue <- w:
+		c.mu.Lock()
+		if !c.delivering {
+			c.delivering = true
+			go c.deliver()
+		}
+		c.mu.Unlock()
+		return len(b), nil
+	case <-c.closed:
+		if err := c.reset(); err != nil {
+			return 0, err
+		}
+		return 0, io.ErrClosedPipe
+	}
+}
+
+func (c *conn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
@@ -0,0 +1,197 @@
+package streammux
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"runtime/trace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TraceEvent is an event in the life of a muxed connection.
+type TraceEvent string
+
+// Events traced by TraceConn. The stream and connection events that go
+// through the interface are traced by the wrapper itself; the others can
+// only be reported by muxers implementing EventReporter.
+const (
+	EventStreamOpen   TraceEvent = "stream-open"
+	EventStreamAccept TraceEvent = "stream-accept"
+	EventStreamClose  TraceEvent = "stream-close"
+	EventStreamEOF    TraceEvent = "stream-eof"
+	EventStreamReset  TraceEvent = "stream-reset"
+	EventConnClose    TraceEvent = "conn-close"
+	EventWindowStall  TraceEvent = "window-stall"
+	EventWindowResume TraceEvent = "window-resume"
+	EventGoAway       TraceEvent = "goaway"
+	EventPing         TraceEvent = "ping"
+)
+
+// EventReporter is implemented by Conns that can report events happening
+// inside the muxer, such as flow control stalls, which are invisible
+// through the Conn and Stream interfaces.
+type EventReporter interface {
+	// SetEventHandler registers h to be called on every internal event.
+	// s is the stream the event concerns, or nil for events of the
+	// whole connection.
+	SetEventHandler(h func(ev TraceEvent, s Stream))
+}
+
+// TraceConn wraps c to emit its events to the Go execution tracer, so
+// that go tool trace shows them: every stream is a "smux.stream" task,
+// with each event logged in the "smux" category. If file is not nil, each
+// event is also written to it as a line of JSON with the fields time, conn,
+// stream (0 for connection events) and event.
+func TraceConn(c Conn, file io.Writer) Conn {
+	tc := &traceConn{
+		Conn:    c,
+		id:      atomic.AddUint64(&traceConnIDs, 1),
+		file:    file,
+		streams: make(map[Stream]*traceStream),
+	}
+	if er, ok := c.(EventReporter); ok {
+		er.SetEventHandler(tc.internalEvent)
+	}
+	return tc
+}
+
+var traceConnIDs uint64
+
+type traceConn struct {
+	Conn
+	id uint64
+
+	fileMu sync.Mutex
+	file   io.Writer
+
+	mu        sync.Mutex
+	streams   map[Stream]*traceStream
+	streamIDs uint64
+}
+
+func (c *traceConn) unwrapConn() Conn {
+	return c.Conn
+}
+
+type traceRecord struct {
+	Time   time.Time  `json:"time"`
+	Conn   uint64     `json:"conn"`
+	Stream uint64     `json:"stream"`
+	Event  TraceEvent `json:"event"`
+}
+
+func (c *traceConn) emit(ctx context.Context, stream uint64, ev TraceEvent) {
+	trace.Log(ctx, "smux", string(ev))
+	if c.file == nil {
+		return
+	}
+	b, err := json.Marshal(traceRecord{time.Now(), c.id, stream, ev})
+	if err != nil {
+		return
+	}
+	c.fileMu.Lock()
+	defer c.fileMu.Unlock()
+	c.file.Write(append(b, '\n'))
+}
+
+func (c *traceConn) internalEvent(ev TraceEvent, s Stream) {
+	if s == nil {
+		c.emit(context.Background(), 0, ev)
+		return
+	}
+	c.mu.Lock()
+	ts := c.streams[s]
+	c.mu.Unlock()
+	if ts == nil {
+		c.emit(context.Background(), 0, ev)
+		return
+	}
+	c.emit(ts.ctx, ts.id, ev)
+}
+
+func (c *traceConn) track(s Stream, ev TraceEvent) Stream {
+	ctx, task := trace.NewTask(context.Background(), "smux.stream")
+	c.mu.Lock()
+	c.streamIDs++
+	ts := &traceStream{Stream: s, conn: c, id: c.streamIDs, ctx: ctx, task: task}
+	c.streams[s] = ts
+	c.mu.Unlock()
+	c.emit(ctx, ts.id, ev)
+	return ts
+}
+
+func (c *traceConn) untrack(ts *traceStream) {
+	c.mu.Lock()
+	delete(c.streams, ts.Stream)
+	c.mu.Unlock()
+	ts.task.End()
+}
+
+func (c *traceConn) OpenStream() (Stream, error) {
+	s, err := c.Conn.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return c.track(s, EventStreamOpen), nil
+}
+
+func (c *traceConn) AcceptStream() (Stream, error) {
+	s, err := c.Conn.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return c.track(s, EventStreamAccept), nil
+}
+
+func (c *traceConn) Close() error {
+	c.emit(context.Background(), 0, EventConnClose)
+	return c.Conn.Close()
+}
+
+type traceStream struct {
+	Stream
+	conn *traceConn
+	id   uint64
+	ctx  context.Context
+	task *trace.Task
+	end  streamEnd
+}
+
+func (s *traceStream) unwrapStream() Stream {
+	return s.Stream
+}
+
+func (s *traceStream) Conn() Conn {
+	return s.conn
+}
+
+func (s *traceStream) finish(write, read, reset bool) {
+	if s.end.done(write, read, reset) {
+		s.conn.untrack(s)
+	}
+}
+
+func (s *traceStream) Read(b []byte) (int, error) {
+	n, err := s.Stream.Read(b)
+	if err == io.EOF {
+		s.conn.emit(s.ctx, s.id, EventStreamEOF)
+		s.finish(false, true, false)
+	}
+	return n, err
+}
+
+func (s *traceStream) Close() error {
+	s.conn.emit(s.ctx, s.id, EventStreamClose)
+	err := s.Stream.Close()
+	s.finish(true, false, false)
+	return err
+}
+
+func (s *traceStream) Reset() error {
+	s.conn.emit(s.ctx, s.id, EventStreamReset)
+	err := s.Stream.Reset()
+	s.finish(false, false, true)
+	return err
+}
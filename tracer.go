@@ -0,0 +1,222 @@
+package streammux
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// StreamEvent describes an event in the life of a stream reported to a
+// Tracer.
+type StreamEvent struct {
+	Time time.Time
+
+	// StreamID is the muxer's ID of the stream when StreamID finds one,
+	// and otherwise a number assigned by the tracing wrapper, unique per
+	// connection.
+	StreamID uint64
+
+	// Inbound is set on streams opened by the peer.
+	Inbound bool
+
+	// Reset is set on StreamClosed events of reset streams.
+	Reset bool
+
+	// Stalled is how long the writes of the stream waited for flow
+	// control, on WindowResumed events.
+	Stalled time.Duration
+}
+
+// Tracer receives the events in the lives of streams, e.g. to attach
+// distributed tracing spans to them. Methods are called synchronously and
+// must not block.
+type Tracer interface {
+	// StreamOpened is called once a stream is opened or accepted.
+	StreamOpened(ev StreamEvent)
+	// FirstByteRead is called when the first data is read from a
+	// stream.
+	FirstByteRead(ev StreamEvent)
+	// StreamClosed is called once a stream is closed in both directions
+	// or reset.
+	StreamClosed(ev StreamEvent)
+	// WindowStalled is called when writes to a stream block on flow
+	// control. Only muxers reporting it natively, or through
+	// EventReporter, call it.
+	WindowStalled(ev StreamEvent)
+}
+
+// WindowResumeTracer is implemented by Tracers told when the writes of a
+// stream stalled on flow control resume, which WindowStalled alone cannot
+// tell how long they waited for.
+type WindowResumeTracer interface {
+	Tracer
+	WindowResumed(ev StreamEvent)
+}
+
+// TracedConn is implemented by Conns that report their streams to a Tracer
+// natively.
+type TracedConn interface {
+	Conn
+	SetTracer(t Tracer)
+}
+
+// WithTracer makes c report to t. A TracedConn is configured and returned;
+// other Conns are wrapped to trace the streams opened and accepted through
+// the wrapper. Window stalls are then only reported if c is an
+// EventReporter.
+func WithTracer(c Conn, t Tracer) Conn {
+	if tc, ok := c.(TracedConn); ok {
+		tc.SetTracer(t)
+		return tc
+	}
+	tc := &tracerConn{Conn: c, tracer: t, streams: make(map[Stream]*tracerStream)}
+	if er, ok := c.(EventReporter); ok {
+		er.SetEventHandler(tc.internalEvent)
+	}
+	return tc
+}
+
+type tracerConn struct {
+	Conn
+	tracer Tracer
+
+	mu      sync.Mutex
+	streams map[Stream]*tracerStream
+	nextID  uint64
+}
+
+func (c *tracerConn) unwrapConn() Conn {
+	return c.Conn
+}
+
+func (c *tracerConn) internalEvent(ev TraceEvent, s Stream) {
+	if s == nil {
+		return
+	}
+	c.mu.Lock()
+	ts := c.streams[s]
+	c.mu.Unlock()
+	if ts == nil {
+		return
+	}
+	switch ev {
+	case EventWindowStall:
+		ts.stallMu.Lock()
+		if ts.stalledSince.IsZero() {
+			ts.stalledSince = time.Now()
+		}
+		ts.stallMu.Unlock()
+		c.tracer.WindowStalled(ts.event())
+	case EventWindowResume:
+		ts.stallMu.Lock()
+		since := ts.stalledSince
+		ts.stalledSince = time.Time{}
+		ts.stallMu.Unlock()
+		if rt, ok := c.tracer.(WindowResumeTracer); ok && !since.IsZero() {
+			ev := ts.event()
+			ev.Stalled = ev.Time.Sub(since)
+			rt.WindowResumed(ev)
+		}
+	}
+}
+
+func (c *tracerConn) track(s Stream, inbound bool) Stream {
+	c.mu.Lock()
+	c.nextID++
+	id, ok := StreamID(s)
+	if !ok {
+		id = c.nextID
+	}
+	ts := &tracerStream{Stream: s, conn: c, id: id, inbound: inbound}
+	c.streams[s] = ts
+	c.mu.Unlock()
+	c.tracer.StreamOpened(ts.event())
+	return ts
+}
+
+func (c *tracerConn) OpenStream() (Stream, error) {
+	s, err := c.Conn.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return c.track(s, false), nil
+}
+
+func (c *tracerConn) AcceptStream() (Stream, error) {
+	s, err := c.Conn.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return c.track(s, true), nil
+}
+
+type tracerStream struct {
+	Stream
+	conn    *tracerConn
+	id      uint64
+	inbound bool
+	end     streamEnd
+
+	readOnce sync.Once
+
+	stallMu      sync.Mutex
+	stalledSince time.Time // zero unless stalled now
+}
+
+func (s *tracerStream) unwrapStream() Stream {
+	return s.Stream
+}
+
+func (s *tracerStream) Conn() Conn {
+	return s.conn
+}
+
+func (s *tracerStream) event() StreamEvent {
+	return StreamEvent{Time: time.Now(), StreamID: s.id, Inbound: s.inbound}
+}
+
+func (s *tracerStream) finish(write, read, reset bool) {
+	if !s.end.done(write, read, reset) {
+		return
+	}
+	s.conn.mu.Lock()
+	delete(s.conn.streams, s.Stream)
+	s.conn.mu.Unlock()
+	ev := s.event()
+	ev.Reset = reset
+	s.conn.tracer.StreamClosed(ev)
+}
+
+func (s *tracerStream) Read(b []byte) (int, error) {
+	n, err := s.Stream.Read(b)
+	if n > 0 {
+		s.readOnce.Do(func() { s.conn.tracer.FirstByteRead(s.event()) })
+	}
+	switch {
+	case err == io.EOF:
+		s.finish(false, true, false)
+	case isReset(err):
+		s.finish(false, false, true)
+	}
+	return n, err
+}
+
+func (s *tracerStream) Write(b []byte) (int, error) {
+	n, err := s.Stream.Write(b)
+	if isReset(err) {
+		s.finish(false, false, true)
+	}
+	return n, err
+}
+
+func (s *tracerStream) Close() error {
+	err := s.Stream.Close()
+	s.finish(true, false, false)
+	return err
+}
+
+func (s *tracerStream) Reset() error {
+	err := s.Stream.Reset()
+	s.finish(false, false, true)
+	return err
+}
@@ -0,0 +1,146 @@
+package streammux
+
+import (
+	"io"
+	"sync"
+)
+
+// streamEnd tracks when both directions of a stream are done, or it was
+// reset.
+type streamEnd struct {
+	mu          sync.Mutex
+	writeClosed bool
+	readDone    bool
+	ended       bool
+}
+
+// done marks directions of the stream done and reports whether this ended
+// the stream. It returns true at most once.
+func (e *streamEnd) done(write, read, reset bool) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.writeClosed = e.writeClosed || write
+	e.readDone = e.readDone || read
+	if e.ended || !(reset || (e.writeClosed && e.readDone)) {
+		return false
+	}
+	e.ended = true
+	return true
+}
+
+// state returns which directions of the stream are done.
+func (e *streamEnd) state() (writeClosed, readDone, ended bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.writeClosed, e.readDone, e.ended
+}
+
+// WithStreamTracking wraps c to keep a registry of its open streams, for
+// Conns that implement neither StreamCounter nor StreamLister. A stream is
+// open until it is reset, or closed and read to EOF.
+func WithStreamTracking(c Conn) Conn {
+	return &trackingConn{Conn: c, streams: make(map[*trackedStream]struct{})}
+}
+
+type trackingConn struct {
+	Conn
+
+	mu      sync.Mutex
+	streams map[*trackedStream]struct{}
+}
+
+func (c *trackingConn) unwrapConn() Conn {
+	return c.Conn
+}
+
+func (c *trackingConn) track(s Stream) Stream {
+	ts := &trackedStream{Stream: s, conn: c}
+	c.mu.Lock()
+	c.streams[ts] = struct{}{}
+	c.mu.Unlock()
+	return ts
+}
+
+func (c *trackingConn) OpenStream() (Stream, error) {
+	s, err := c.Conn.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return c.track(s), nil
+}
+
+func (c *trackingConn) AcceptStream() (Stream, error) {
+	s, err := c.Conn.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return c.track(s), nil
+}
+
+func (c *trackingConn) Close() error {
+	c.mu.Lock()
+	c.streams = make(map[*trackedStream]struct{})
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+func (c *trackingConn) NumStreams() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.streams)
+}
+
+func (c *trackingConn) Streams() []Stream {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	streams := make([]Stream, 0, len(c.streams))
+	for s := range c.streams {
+		streams = append(streams, s)
+	}
+	return streams
+}
+
+type trackedStream struct {
+	Stream
+	conn *trackingConn
+	end  streamEnd
+}
+
+func (s *trackedStream) unwrapStream() Stream {
+	return s.Stream
+}
+
+func (s *trackedStream) Conn() Conn {
+	return s.conn
+}
+
+func (s *trackedStream) finish(write, read, reset bool) {
+	if s.end.done(write, read, reset) {
+		s.conn.mu.Lock()
+		delete(s.conn.streams, s)
+		s.conn.mu.Unlock()
+	}
+}
+
+func (s *trackedStream) Read(b []byte) (int, error) {
+	n, err := s.Stream.Read(b)
+	switch {
+	case err == io.EOF:
+		s.finish(false, true, false)
+	case isReset(err):
+		s.finish(false, false, true)
+	}
+	return n, err
+}
+
+func (s *trackedStream) Close() error {
+	err := s.Stream.Close()
+	s.finish(true, false, false)
+	return err
+}
+
+func (s *trackedStream) Reset() error {
+	err := s.Stream.Reset()
+	s.finish(false, false, true)
+	return err
+}
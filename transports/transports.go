@@ -0,0 +1,63 @@
+// Package transports lists the stream muxers of this repository by name,
+// so that downstream tests, cmd/benchmux and interop harnesses can iterate
+// over all of them rather than keep lists of their own.
+//
+// The yamux, spdystream, muxado and multiplex adapters live in
+// repositories of their own, which depend on this one, so they cannot be
+// listed here; programs importing them add them to AllTransports. Neither
+// is quic, whose Transport needs a TLS configuration with a certificate.
+// RunBundled of the test package runs the conformance suite against all of
+// AllTransports.
+package transports
+
+import (
+	"sort"
+
+	smux "github.com/dms3-p2p/go-stream-muxer"
+	"github.com/dms3-p2p/go-stream-muxer/http2"
+	"github.com/dms3-p2p/go-stream-muxer/identity"
+	"github.com/dms3-p2p/go-stream-muxer/memconn"
+	"github.com/dms3-p2p/go-stream-muxer/multistream"
+	"github.com/dms3-p2p/go-stream-muxer/websocket"
+)
+
+// AllTransports are the muxers of this repository, with their default
+// settings, by name. The multistream transport negotiates http2 or
+// websocket.
+var AllTransports = map[string]smux.Transport{
+	"http2":       http2.DefaultTransport,
+	"websocket":   websocket.DefaultTransport,
+	"memconn":     memconn.DefaultTransport,
+	"identity":    identity.DefaultTransport,
+	"multistream": newMultistream(),
+}
+
+func newMultistream() smux.Transport {
+	t := multistream.NewTransport()
+	t.AddTransport(http2.ProtocolID, http2.DefaultTransport)
+	t.AddTransport(websocket.ProtocolID, websocket.DefaultTransport)
+	return t
+}
+
+// Names returns the sorted names of AllTransports.
+func Names() []string {
+	names := make([]string, 0, len(AllTransports))
+	for name := range AllTransports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Multiplexing returns the sorted names of the transports of AllTransports
+// carrying more than one stream per connection: those declaring
+// smux.FeatureMultiplex, and those declaring no features at all.
+func Multiplexing() []string {
+	var names []string
+	for _, name := range Names() {
+		if f, ok := smux.TransportFeatures(AllTransports[name]); !ok || f.Has(smux.FeatureMultiplex) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
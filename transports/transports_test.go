@@ -0,0 +1,27 @@
+package transports_test
+
+import (
+	"testing"
+
+	sm "github.com/dms3-p2p/go-stream-muxer/test"
+)
+
+func TestBundled(t *testing.T) {
+	sm.RunBundled(t)
+}
+
+func TestBundledMultistream(t *testing.T) {
+	sm.SubtestBundledMultistream(t)
+}
+
+func TestBundledFallback(t *testing.T) {
+	sm.SubtestBundledFallback(t)
+}
+
+func TestBundledFlowControl(t *testing.T) {
+	sm.SubtestBundledFlowControl(t)
+}
+
+func TestBundledGolden(t *testing.T) {
+	sm.SubtestBundledGolden(t)
+}
@@ -0,0 +1,60 @@
+package streammux
+
+import "net"
+
+// NetConner is implemented by Conns exposing the net.Conn they run over.
+type NetConner interface {
+	// NetConn returns the net.Conn the connection runs over, or nil if
+	// there is none. Reading from it or writing to it corrupts the
+	// connection.
+	NetConn() net.Conn
+}
+
+// connWrapper is implemented by the Conn wrappers of this package, so that
+// the optional interfaces of the connections they wrap can still be found.
+type connWrapper interface {
+	unwrapConn() Conn
+}
+
+// findConn returns the first of c and the connections it wraps for which
+// is returns true.
+func findConn(c Conn, is func(Conn) bool) (Conn, bool) {
+	for {
+		if is(c) {
+			return c, true
+		}
+		w, ok := c.(connWrapper)
+		if !ok {
+			return nil, false
+		}
+		c = w.unwrapConn()
+	}
+}
+
+// UnderlyingConn returns the net.Conn c runs over, looking through the
+// wrappers of this package, so that callers can read socket-level details,
+// such as TCP_INFO or the TLS state of the peer, or set TCP keepalives,
+// without keeping a reference of their own:
+//
+//	if nc, err := smux.UnderlyingConn(c); err == nil {
+//		if tc, ok := nc.(*net.TCPConn); ok {
+//			tc.SetKeepAlivePeriod(time.Minute)
+//		}
+//	}
+//
+// It returns ErrNotSupported if the muxer does not expose it, or runs over
+// no net.Conn.
+func UnderlyingConn(c Conn) (net.Conn, error) {
+	c, ok := findConn(c, func(c Conn) bool {
+		_, ok := c.(NetConner)
+		return ok
+	})
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	nc := c.(NetConner).NetConn()
+	if nc == nil {
+		return nil, ErrNotSupported
+	}
+	return nc, nil
+}
@@ -0,0 +1,218 @@
+package streammux
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// ContractViolation is the panic value of the Verify wrappers when the
+// wrapped implementation breaks the contract of the interfaces in this
+// package.
+type ContractViolation struct {
+	Op  string
+	Msg string
+}
+
+func (v *ContractViolation) Error() string {
+	return fmt.Sprintf("smux contract violation in %s: %s", v.Op, v.Msg)
+}
+
+func violation(op, format string, args ...interface{}) {
+	panic(&ContractViolation{Op: op, Msg: fmt.Sprintf(format, args...)})
+}
+
+// VerifyTransport wraps tr so that every Conn it creates is checked with
+// VerifyConn.
+func VerifyTransport(tr Transport) Transport {
+	return verifyTransport{tr}
+}
+
+type verifyTransport struct {
+	Transport
+}
+
+func (tr verifyTransport) NewConn(c net.Conn, isServer bool) (Conn, error) {
+	return verifyNewConn(tr.Transport.NewConn(c, isServer))
+}
+
+func (tr verifyTransport) NewConnRWC(rwc io.ReadWriteCloser, isServer bool) (Conn, error) {
+	return verifyNewConn(NewConnRWC(tr.Transport, rwc, isServer))
+}
+
+func verifyNewConn(mc Conn, err error) (Conn, error) {
+	if err != nil {
+		if mc != nil {
+			violation("NewConn", "returned a connection with error %q", err)
+		}
+		return nil, err
+	}
+	if mc == nil {
+		violation("NewConn", "returned neither a connection nor an error")
+	}
+	return VerifyConn(mc), nil
+}
+
+// VerifyConn wraps c to check at runtime that it and its streams honor
+// the interface contracts, panicking with a *ContractViolation when they
+// do not. It is meant for muxer CI and staging, not production.
+func VerifyConn(c Conn) Conn {
+	return &verifyConn{Conn: c}
+}
+
+type verifyConn struct {
+	Conn
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func (c *verifyConn) unwrapConn() Conn {
+	return c.Conn
+}
+
+func (c *verifyConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func (c *verifyConn) checkStream(op string, wasClosed bool, s Stream, err error) (Stream, error) {
+	switch {
+	case err != nil && s != nil:
+		violation(op, "returned a stream with error %q", err)
+	case err == nil && s == nil:
+		violation(op, "returned neither a stream nor an error")
+	case err == nil && wasClosed:
+		violation(op, "succeeded on a closed connection")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &verifyStream{Stream: s, conn: c}, nil
+}
+
+func (c *verifyConn) OpenStream() (Stream, error) {
+	closed := c.isClosed()
+	s, err := c.Conn.OpenStream()
+	return c.checkStream("OpenStream", closed, s, err)
+}
+
+func (c *verifyConn) AcceptStream() (Stream, error) {
+	closed := c.isClosed()
+	s, err := c.Conn.AcceptStream()
+	return c.checkStream("AcceptStream", closed, s, err)
+}
+
+func (c *verifyConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+func (c *verifyConn) IsClosed() bool {
+	closed := c.Conn.IsClosed()
+	if !closed && c.isClosed() {
+		violation("IsClosed", "returned false after Close")
+	}
+	return closed
+}
+
+// VerifyStream wraps s to check at runtime that it honors the Stream
+// contract, panicking with a *ContractViolation when it does not:
+//
+//   - Read and Write return counts within the buffer, and Write only
+//     returns a short count with an error;
+//   - Read returns no data after it returned io.EOF;
+//   - Write fails after Close or Reset;
+//   - Read and Write on a reset stream return ErrReset.
+func VerifyStream(s Stream) Stream {
+	return &verifyStream{Stream: s}
+}
+
+type verifyStream struct {
+	Stream
+	conn *verifyConn // nil for streams wrapped by VerifyStream
+
+	mu     sync.Mutex
+	eof    bool
+	closed bool
+	reset  bool
+}
+
+func (s *verifyStream) unwrapStream() Stream {
+	return s.Stream
+}
+
+// Conn returns the verifyConn of the stream, or, for those wrapped by
+// VerifyStream, nil, so that StreamConn looks through them.
+func (s *verifyStream) Conn() Conn {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn
+}
+
+// state returns whether the stream was closed or reset, before starting an
+// operation on it. Operations racing with Close or Reset are not checked.
+func (s *verifyStream) state() (closed, reset bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed, s.reset
+}
+
+func (s *verifyStream) Read(b []byte) (int, error) {
+	_, reset := s.state()
+	n, err := s.Stream.Read(b)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n < 0 || n > len(b) {
+		violation("Read", "returned count %d for a %d byte buffer", n, len(b))
+	}
+	if n > 0 && s.eof {
+		violation("Read", "returned %d bytes after io.EOF", n)
+	}
+	if reset && !isReset(err) {
+		violation("Read", "returned (%d, %v) instead of ErrReset on a reset stream", n, err)
+	}
+	if err == io.EOF {
+		s.eof = true
+	}
+	return n, err
+}
+
+func (s *verifyStream) Write(b []byte) (int, error) {
+	closed, reset := s.state()
+	n, err := s.Stream.Write(b)
+
+	if n < 0 || n > len(b) {
+		violation("Write", "returned count %d for a %d byte buffer", n, len(b))
+	}
+	if n < len(b) && err == nil {
+		violation("Write", "returned short count %d of %d without an error", n, len(b))
+	}
+	if err == nil && closed {
+		violation("Write", "succeeded after Close")
+	}
+	if reset && !isReset(err) {
+		violation("Write", "returned (%d, %v) instead of ErrReset on a reset stream", n, err)
+	}
+	return n, err
+}
+
+func (s *verifyStream) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	return s.Stream.Close()
+}
+
+func (s *verifyStream) Reset() error {
+	s.mu.Lock()
+	s.reset = true
+	s.mu.Unlock()
+	return s.Stream.Reset()
+}
@@ -0,0 +1,37 @@
+package streammux
+
+import "errors"
+
+// ErrGoAway is the reason WaitConns give for a connection the peer closed,
+// having said so with GOAWAY or its muxer's equivalent.
+var ErrGoAway = errors.New("connection closed by the peer")
+
+// ErrKeepAliveTimeout is the reason the connections of WithKeepAlive give
+// once they were closed for their pings going unanswered.
+var ErrKeepAliveTimeout = errors.New("keepalive pings unanswered")
+
+// WaitConn is implemented by Conns that can tell why they ended.
+type WaitConn interface {
+	Conn
+
+	// Wait blocks until the connection is closed, and returns why: nil
+	// if it was closed with Close, ErrGoAway if the peer closed it, and
+	// the error of the underlying net.Conn if it failed, io.EOF if it
+	// was closed without a word.
+	Wait() error
+}
+
+// Wait blocks until c is closed, and returns why if c is a WaitConn, so that
+// servers can log why their sessions end:
+//
+//	go func() { log.Println(smux.Wait(c)) }()
+//
+// Other Conns are waited for with CloseChan, and give ErrConnClosed, their
+// reason being unknown.
+func Wait(c Conn) error {
+	if wc, ok := c.(WaitConn); ok {
+		return wc.Wait()
+	}
+	<-CloseChan(c)
+	return ErrConnClosed
+}
@@ -0,0 +1,34 @@
+package websocket_test
+
+import (
+	"testing"
+
+	sm "github.com/dms3-p2p/go-stream-muxer/test"
+	"github.com/dms3-p2p/go-stream-muxer/websocket"
+)
+
+// fuzzUpgrade is the upgrade request the fuzzed frames follow.
+const fuzzUpgrade = "GET / HTTP/1.1\r\n" +
+	"Host: fuzz\r\n" +
+	"Upgrade: websocket\r\n" +
+	"Connection: Upgrade\r\n" +
+	"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+	"Sec-WebSocket-Version: 13\r\n" +
+	"Sec-WebSocket-Protocol: " + websocket.Subprotocol + "\r\n\r\n"
+
+// FuzzConn fuzzes the WebSocket and muxer frame parsers: data is read as
+// the frames following the opening handshake.
+func FuzzConn(f *testing.F) {
+	// binary messages masked with a zero key: stream 1 is opened, sent
+	// "hi" and closed.
+	f.Add([]byte{
+		0x82, 0x85, 0, 0, 0, 0, 0, 0, 0, 1, 0,
+		0x82, 0x87, 0, 0, 0, 0, 0, 0, 0, 1, 1, 'h', 'i',
+		0x82, 0x85, 0, 0, 0, 0, 0, 0, 0, 1, 2,
+	})
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		sm.FuzzTransport(t, websocket.DefaultTransport, []byte(fuzzUpgrade), data)
+	})
+}
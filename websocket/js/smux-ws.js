@@ -0,0 +1,205 @@
+// smux-ws.js is a reference implementation of the muxer of package
+// websocket, for browsers and node.
+//
+// Run under node as
+//
+//	node smux-ws.js host:port
+//
+// it dials ws://host:port/, echoes every stream the peer opens, and opens a
+// stream of its own on which it sends "hello from node". It exits once the
+// WebSocket closes. Node before 22 needs --experimental-websocket, with
+// which the script restarts itself when WebSocket is missing.
+'use strict';
+
+const SUBPROTOCOL = 'smux';
+const STREAM_WINDOW = 256 << 10;
+const MAX_PAYLOAD = 16 << 10;
+
+const TYPE_OPEN = 0;
+const TYPE_DATA = 1;
+const TYPE_CLOSE = 2;
+const TYPE_RESET = 3;
+const TYPE_WINDOW = 4;
+
+class Stream {
+  constructor(mux, id) {
+    this.mux = mux;
+    this.id = id;
+    this.sendWindow = STREAM_WINDOW;
+    this.pending = []; // Uint8Arrays waiting for send window
+    this.closing = false; // close once pending is sent
+    this.writeClosed = false;
+    this.isReset = false;
+    this.ondata = null;
+    this.onend = null;
+    this.onreset = null;
+  }
+
+  write(data) {
+    if (this.closing || this.isReset) {
+      throw new Error('write on closed stream');
+    }
+    this.pending.push(data);
+    this.flush();
+  }
+
+  close() {
+    this.closing = true;
+    this.flush();
+  }
+
+  reset() {
+    if (this.isReset) {
+      return;
+    }
+    this.isReset = true;
+    this.pending = [];
+    this.mux.send(this.id, TYPE_RESET);
+    this.mux.streams.delete(this.id);
+  }
+
+  flush() {
+    while (this.pending.length > 0 && this.sendWindow > 0) {
+      let chunk = this.pending[0];
+      const n = Math.min(chunk.length, this.sendWindow, MAX_PAYLOAD);
+      if (n < chunk.length) {
+        this.pending[0] = chunk.subarray(n);
+        chunk = chunk.subarray(0, n);
+      } else {
+        this.pending.shift();
+      }
+      this.sendWindow -= n;
+      this.mux.send(this.id, TYPE_DATA, chunk);
+    }
+    if (this.closing && !this.writeClosed && this.pending.length === 0) {
+      this.writeClosed = true;
+      this.mux.send(this.id, TYPE_CLOSE);
+    }
+  }
+}
+
+class Muxer {
+  constructor(ws, isServer) {
+    this.ws = ws;
+    this.streams = new Map();
+    this.nextID = isServer ? 2 : 1;
+    this.lastPeerID = 0;
+    this.onstream = null;
+    ws.binaryType = 'arraybuffer';
+    ws.onmessage = (ev) => this.receive(new Uint8Array(ev.data));
+  }
+
+  openStream() {
+    const s = new Stream(this, this.nextID);
+    this.nextID += 2;
+    this.streams.set(s.id, s);
+    this.send(s.id, TYPE_OPEN);
+    return s;
+  }
+
+  send(id, type, payload) {
+    const size = payload ? payload.length : 0;
+    const msg = new Uint8Array(5 + size);
+    new DataView(msg.buffer).setUint32(0, id);
+    msg[4] = type;
+    if (payload) {
+      msg.set(payload, 5);
+    }
+    this.ws.send(msg);
+  }
+
+  receive(msg) {
+    if (msg.length < 5) {
+      return;
+    }
+    const view = new DataView(msg.buffer, msg.byteOffset, msg.byteLength);
+    const id = view.getUint32(0);
+    const payload = msg.subarray(5);
+    let s = this.streams.get(id);
+    switch (msg[4]) {
+      case TYPE_OPEN:
+        if (s || id % 2 === this.nextID % 2 || id <= this.lastPeerID) {
+          return;
+        }
+        this.lastPeerID = id;
+        s = new Stream(this, id);
+        this.streams.set(id, s);
+        if (this.onstream) {
+          this.onstream(s);
+        }
+        break;
+      case TYPE_DATA:
+        if (!s) {
+          return;
+        }
+        // the data is consumed as soon as it is delivered, so the window
+        // is given back right away.
+        if (payload.length > 0) {
+          const inc = new Uint8Array(4);
+          new DataView(inc.buffer).setUint32(0, payload.length);
+          this.send(id, TYPE_WINDOW, inc);
+        }
+        if (s.ondata) {
+          s.ondata(payload);
+        }
+        break;
+      case TYPE_CLOSE:
+        if (!s) {
+          return;
+        }
+        if (s.writeClosed) {
+          this.streams.delete(id);
+        }
+        if (s.onend) {
+          s.onend();
+        }
+        break;
+      case TYPE_RESET:
+        if (!s) {
+          return;
+        }
+        s.isReset = true;
+        s.pending = [];
+        this.streams.delete(id);
+        if (s.onreset) {
+          s.onreset();
+        }
+        break;
+      case TYPE_WINDOW:
+        if (!s || payload.length !== 4) {
+          return;
+        }
+        s.sendWindow += view.getUint32(5);
+        s.flush();
+        break;
+    }
+  }
+}
+
+function main(addr) {
+  const ws = new WebSocket('ws://' + addr + '/', SUBPROTOCOL);
+  const mux = new Muxer(ws, false);
+  mux.onstream = (s) => {
+    s.ondata = (data) => s.write(data.slice());
+    s.onend = () => s.close();
+  };
+  ws.onopen = () => {
+    const s = mux.openStream();
+    s.write(new TextEncoder().encode('hello from node'));
+    s.close();
+  };
+  ws.onerror = (ev) => console.error('smux-ws:', ev.message || ev.type);
+  ws.onclose = () => process.exit(0);
+}
+
+if (typeof module !== 'undefined' && require.main === module) {
+  if (typeof WebSocket === 'undefined') {
+    const { spawnSync } = require('child_process');
+    const args = ['--experimental-websocket', ...process.argv.slice(1)];
+    const res = spawnSync(process.execPath, args, { stdio: 'inherit' });
+    process.exit(res.status === null ? 1 : res.status);
+  }
+  main(process.argv[2]);
+} else if (typeof module !== 'undefined') {
+  module.exports = { Muxer, Stream, SUBPROTOCOL };
+}
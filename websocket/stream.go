@@ -0,0 +1,379 @@
+package websocket
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	smux "github.com/dms3-p2p/go-stream-muxer"
+)
+
+// stream is a stream of the muxer. Its state is guarded by conn.mu.
+type stream struct {
+	conn *conn
+	id   uint32
+
+	// wlock serializes Write and Close, so that the close frame follows
+	// the data frames.
+	wlock sync.Mutex
+
+	changed     chan struct{} // closed and replaced on every change
+	recv        []byte        // unread, in recvBuf
+	recvBuf     []byte        // from conn.pool, while there is data to read
+	recvEOF     bool          // the peer sent a close frame
+	unacked     int           // bytes read but not credited to the peer yet
+	recvWindow  int           // bytes the peer may still send
+	window      int           // the receive window, of SetReceiveWindow
+	sendWindow  int64
+	writeClosed bool
+	isReset     bool
+	resetErr    error // of reads and writes once reset
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// ID returns the stream ID.
+func (s *stream) ID() uint64 {
+	return uint64(s.id)
+}
+
+// Conn returns the connection of the stream.
+func (s *stream) Conn() smux.Conn {
+	return s.conn
+}
+
+// broadcast wakes the reads and writes waiting on s. It must be called
+// with conn.mu held.
+func (s *stream) broadcast() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// wait waits for s to change, or for deadline to pass, and returns
+// smux.ErrTimeout if it already has. It must be called with conn.mu held.
+func (s *stream) wait(deadline time.Time) error {
+	c := s.conn
+	ch := s.changed
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return smux.ErrTimeout
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+	c.mu.Unlock()
+	select {
+	case <-ch:
+	case <-timeout:
+	}
+	c.mu.Lock()
+	return nil
+}
+
+// SetReceiveWindow sets the receive window of the stream to n bytes, which
+// the window frames of the reads that follow grow to, so that a window set
+// on a stream nothing reads grants the peer nothing it cannot take back.
+// A smaller window withholds credit until the data the peer was allowed
+// already is read down to it. Empty windows are not supported.
+func (s *stream) SetReceiveWindow(n uint32) error {
+	c := s.conn
+	if n == 0 {
+		return smux.ErrNotSupported
+	}
+	c.mu.Lock()
+	s.unacked += int(n) - s.window
+	s.window = int(n)
+	c.mu.Unlock()
+	return nil
+}
+
+// remoteEnd records the close frame of the peer. It must be called with
+// conn.mu held.
+func (s *stream) remoteEnd() {
+	s.recvEOF = true
+	s.forgetIfDone()
+	s.broadcast()
+}
+
+// forgetIfDone unregisters s once both sides sent a close frame. It must
+// be called with conn.mu held.
+func (s *stream) forgetIfDone() {
+	if s.writeClosed && s.recvEOF {
+		delete(s.conn.streams, s.id)
+	}
+}
+
+// reset discards the received data and unregisters s, failing its reads
+// and writes with err. It must be called with conn.mu held.
+func (s *stream) reset(err error) {
+	if s.isReset {
+		return
+	}
+	s.isReset = true
+	s.resetErr = err
+	s.releaseRecv()
+	delete(s.conn.streams, s.id)
+	s.broadcast()
+}
+
+// queue appends p to the data to read, moving it to a larger buffer of
+// the pool if it does not fit. The buffer at least doubles, so that
+// appending to a large backlog, past the size classes of the pool, does not
+// copy it all again for every frame. It must be called with conn.mu held.
+func (s *stream) queue(p []byte) {
+	if len(s.recv)+len(p) > cap(s.recv) {
+		size := len(s.recv) + len(p)
+		if size < 2*len(s.recv) {
+			size = 2 * len(s.recv)
+		}
+		buf := s.conn.pool.Get(size)
+		n := copy(buf, s.recv)
+		s.releaseRecv()
+		s.recvBuf, s.recv = buf, buf[:n]
+	}
+	s.recv = append(s.recv, p...)
+}
+
+// releaseRecv discards the data to read and puts its buffer back in the
+// pool. It must be called with conn.mu held.
+func (s *stream) releaseRecv() {
+	if s.recvBuf != nil {
+		s.conn.pool.Put(s.recvBuf)
+	}
+	s.recvBuf, s.recv = nil, nil
+}
+
+func (s *stream) Read(b []byte) (int, error) {
+	n, _, err := s.read(b, false)
+	return n, err
+}
+
+// ReadBuffer returns the data received next in the buffer it was received
+// in, without copying it. The caller owns the buffer until it hands it
+// back with ReleaseBuffer.
+func (s *stream) ReadBuffer() ([]byte, error) {
+	_, buf, err := s.read(nil, true)
+	return buf, err
+}
+
+// ReleaseBuffer puts a buffer returned by ReadBuffer back in the pool.
+func (s *stream) ReleaseBuffer(b []byte) {
+	s.conn.pool.Put(b)
+}
+
+// read copies the data received next to b, or with take, hands out the
+// buffer it is in instead.
+func (s *stream) read(b []byte, take bool) (int, []byte, error) {
+	c := s.conn
+	c.mu.Lock()
+	for {
+		switch {
+		case s.isReset:
+			c.mu.Unlock()
+			return 0, nil, s.resetErr
+		case len(s.recv) > 0:
+			var n int
+			var buf []byte
+			if take {
+				buf, n = s.recv, len(s.recv)
+				s.recvBuf, s.recv = nil, nil
+			} else {
+				n = copy(b, s.recv)
+				s.recv = s.recv[n:]
+				if len(s.recv) == 0 {
+					// idle streams hold no buffer.
+					s.releaseRecv()
+				}
+			}
+			var inc int
+			if !s.recvEOF {
+				s.unacked += n
+				if s.unacked >= s.window/2 {
+					inc, s.unacked = s.unacked, 0
+					s.recvWindow += inc
+				}
+			}
+			closed := c.isClosed
+			c.mu.Unlock()
+			if inc > 0 && !closed {
+				c.writeWindow(s.id, inc)
+			}
+			return n, buf, nil
+		case s.recvEOF:
+			c.mu.Unlock()
+			return 0, nil, io.EOF
+		case c.isClosed:
+			c.mu.Unlock()
+			return 0, nil, smux.ErrConnClosed
+		case len(b) == 0 && !take:
+			c.mu.Unlock()
+			return 0, nil, nil
+		}
+		if err := s.wait(s.readDeadline); err != nil {
+			c.mu.Unlock()
+			return 0, nil, err
+		}
+	}
+}
+
+// Write sends b in data frames as the send window allows.
+func (s *stream) Write(b []byte) (int, error) {
+	s.wlock.Lock()
+	defer s.wlock.Unlock()
+
+	c := s.conn
+	c.startWrite()
+	defer c.endWrite()
+	n := 0
+	// stalled is set while waiting for the send window, which ends with
+	// EventWindowResume, also when the write fails meanwhile.
+	stalled := false
+	defer func() {
+		if stalled {
+			c.event(smux.EventWindowResume, s)
+		}
+	}()
+	c.mu.Lock()
+	for {
+		switch {
+		case s.isReset:
+			c.mu.Unlock()
+			return n, s.resetErr
+		case c.isClosed:
+			c.mu.Unlock()
+			return n, smux.ErrConnClosed
+		case s.writeClosed:
+			c.mu.Unlock()
+			return n, smux.ErrStreamClosed
+		case n == len(b):
+			c.mu.Unlock()
+			return n, nil
+		}
+
+		chunk := int64(len(b) - n)
+		if max := int64(c.maxPayload); chunk > max {
+			chunk = max
+		}
+		if chunk > s.sendWindow {
+			chunk = s.sendWindow
+		}
+		if chunk <= 0 {
+			if !stalled {
+				stalled = true
+				c.mu.Unlock()
+				c.event(smux.EventWindowStall, s)
+				c.mu.Lock()
+				continue
+			}
+			if err := s.wait(s.writeDeadline); err != nil {
+				c.mu.Unlock()
+				return n, err
+			}
+			continue
+		}
+		s.sendWindow -= chunk
+		c.mu.Unlock()
+		if stalled {
+			stalled = false
+			c.event(smux.EventWindowResume, s)
+		}
+
+		if err := c.writeFrame(s.id, typeData, b[n:n+int(chunk)]); err != nil {
+			return n, err
+		}
+		n += int(chunk)
+		c.mu.Lock()
+	}
+}
+
+// Close sends a close frame, after which the stream is closed for writing.
+func (s *stream) Close() error {
+	s.wlock.Lock()
+	defer s.wlock.Unlock()
+
+	c := s.conn
+	c.mu.Lock()
+	switch {
+	case s.isReset || s.writeClosed:
+		c.mu.Unlock()
+		return nil
+	case c.isClosed:
+		c.mu.Unlock()
+		return smux.ErrConnClosed
+	}
+	s.writeClosed = true
+	s.forgetIfDone()
+	c.mu.Unlock()
+
+	return c.writeFrame(s.id, typeClose, nil)
+}
+
+// CloseWrite sends a close frame, like Close.
+func (s *stream) CloseWrite() error {
+	return s.Close()
+}
+
+// Reset sends a reset frame, unless both sides sent a close frame already,
+// and fails the reads and writes of the stream with smux.ErrReset.
+func (s *stream) Reset() error {
+	return s.resetWith(nil)
+}
+
+// ResetWithError resets the stream like Reset, with code in the payload of
+// the reset frame.
+func (s *stream) ResetWithError(code uint32) error {
+	if code == 0 {
+		return s.Reset()
+	}
+	var payload [4]byte
+	binary.BigEndian.PutUint32(payload[:], code)
+	return s.resetWith(payload[:])
+}
+
+func (s *stream) resetWith(payload []byte) error {
+	c := s.conn
+	c.mu.Lock()
+	if s.isReset {
+		c.mu.Unlock()
+		return nil
+	}
+	ended := s.writeClosed && s.recvEOF
+	s.reset(smux.ErrReset)
+	closed := c.isClosed
+	c.mu.Unlock()
+
+	if !closed && !ended {
+		c.writeFrame(s.id, typeReset, payload)
+	}
+	return nil
+}
+
+func (s *stream) SetDeadline(t time.Time) error {
+	s.conn.mu.Lock()
+	defer s.conn.mu.Unlock()
+	s.readDeadline = t
+	s.writeDeadline = t
+	s.broadcast()
+	return nil
+}
+
+func (s *stream) SetReadDeadline(t time.Time) error {
+	s.conn.mu.Lock()
+	defer s.conn.mu.Unlock()
+	s.readDeadline = t
+	s.broadcast()
+	return nil
+}
+
+func (s *stream) SetWriteDeadline(t time.Time) error {
+	s.conn.mu.Lock()
+	defer s.conn.mu.Unlock()
+	s.writeDeadline = t
+	s.broadcast()
+	return nil
+}
@@ -0,0 +1,787 @@
+// Package websocket implements a stream muxer over a WebSocket connection,
+// so that browsers and JavaScript peers can take part.
+//
+// The dialer sends an RFC 6455 upgrade request for the "smux" subprotocol
+// and the listener accepts it; Upgrade accepts one received by an
+// http.Handler instead. Every binary message then carries one frame of the
+// muxer:
+//
+//	stream ID (uint32, big endian) | type (byte) | payload
+//
+// The types are open, data (the payload is stream data), close (no more
+// data will be sent), reset (abort both directions; the payload is empty,
+// or the uint32 big endian application error code of ResetWithError) and
+// window (the payload is a uint32 big endian increment of the send
+// window). The dialer opens streams with odd IDs, the listener with even
+// ones, announcing them in increasing order; an open frame for an ID at or
+// below the last one the peer opened is ignored. IDs are never reused, so
+// OpenStream fails with smux.ErrTooManyStreams once a side used up the
+// uint32 IDs of its parity. Every stream starts with a send window of
+// StreamWindow bytes in each direction, which receivers with larger windows
+// grow with a window frame right away, and a stream sent data past its
+// window is reset.
+//
+// js/smux-ws.js is a reference implementation in JavaScript, used by
+// SubtestNodeInterop of the test package.
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	smux "github.com/dms3-p2p/go-stream-muxer"
+	"github.com/dms3-p2p/go-stream-muxer/internal/testhooks"
+)
+
+// Subprotocol is the WebSocket subprotocol of the muxer.
+const Subprotocol = "smux"
+
+// ProtocolID is the multistream protocol ID of the transport.
+const ProtocolID = "/smux-websocket/1.0.0"
+
+// StreamWindow is the initial send window of every stream, in bytes.
+const StreamWindow = 256 << 10
+
+// Frame types.
+const (
+	typeOpen byte = iota
+	typeData
+	typeClose
+	typeReset
+	typeWindow
+)
+
+const (
+	headerSize = 5
+
+	// maxStreamID is the last stream ID.
+	maxStreamID = 1<<32 - 1
+
+	// maxPayload is the largest data payload sent in one message.
+	maxPayload = 16 << 10
+
+	// acceptBacklog is the number of streams opened by the peer waiting
+	// to be accepted, after which they queue in conn.pending.
+	acceptBacklog = 256
+
+	// maxPending is the number of streams conn.pending holds before the
+	// read loop waits for AcceptStream to make room, holding back the
+	// peer rather than queueing its streams without bound.
+	maxPending = 256
+
+	// closeTimeout bounds how long Close waits to send the close frame.
+	closeTimeout = time.Second
+)
+
+func init() {
+	smux.Register(ProtocolID, DefaultTransport)
+	testhooks.RegisterStreamIDsLeft(func(tr smux.Transport, n uint32) (smux.Transport, bool) {
+		t, ok := tr.(Transport)
+		t.streamIDsLeft = n
+		return t, ok
+	})
+}
+
+// ReferenceScript returns the path of js/smux-ws.js, the JavaScript
+// reference implementation, in the source tree of the package.
+func ReferenceScript() string {
+	_, file, _, _ := runtime.Caller(0)
+	return filepath.Join(filepath.Dir(file), "js", "smux-ws.js")
+}
+
+// Transport is the WebSocket stream muxer transport.
+type Transport struct {
+	// BufferPool is the pool of the buffers of the data received on
+	// streams and of the frames sent. Nil is smux.DefaultBufferPool.
+	BufferPool smux.BufferPool
+
+	// Rand is the source of the handshake nonces and of the masking keys
+	// of the frames sent by dialers. Nil is crypto/rand. Only tests
+	// recording wire transcripts set it, as masking keys must not be
+	// predictable.
+	Rand io.Reader
+
+	// Host is the Host header of the upgrade requests sent by dialers.
+	// Empty is the remote address of the connection.
+	Host string
+
+	// ReceiveWindow is the receive window of each stream, granted past
+	// StreamWindow with a window frame once the stream is open. Zero is
+	// StreamWindow, and so is any smaller window, which peers may fill
+	// from the start.
+	ReceiveWindow uint32
+
+	// MaxFrameSize is the largest data payload sent in one message. Zero
+	// is 16KiB.
+	MaxFrameSize uint32
+
+	// MaxStreams is the number of streams open at once past which
+	// OpenStream fails with smux.ErrTooManyStreams and the streams the
+	// peer opens are reset. Zero is unlimited.
+	MaxStreams int
+
+	// streamIDsLeft, if not zero, is the number of streams each side
+	// opens before it uses up its IDs, set by tests.
+	streamIDsLeft uint32
+}
+
+// DefaultTransport is the WebSocket transport.
+var DefaultTransport Transport
+
+// ProtocolID returns ProtocolID.
+func (Transport) ProtocolID() string {
+	return ProtocolID
+}
+
+// Features returns the features of WebSocket connections.
+func (Transport) Features() smux.Features {
+	return smux.FeatureMultiplex | smux.FeatureReset | smux.FeatureDeadlines | smux.FeatureStreamIDs | smux.FeatureEvents | smux.FeatureWait | smux.FeatureResetCodes | smux.FeatureLinger | smux.FeatureAbort | smux.FeatureReceiveWindow
+}
+
+// WithBufferPool returns a copy of the transport using p.
+func (t Transport) WithBufferPool(p smux.BufferPool) smux.Transport {
+	t.BufferPool = p
+	return t
+}
+
+// WithConfig returns a copy of the transport using opts, which sets
+// ReceiveWindow, MaxFrameSize and MaxStreams, and wraps it with
+// smux.WithKeepAlive if KeepAliveInterval is set, pinging with WebSocket
+// pings. Receive windows smaller than StreamWindow cannot be honored, and
+// messages are written as they are sent, with no buffer nor scheduler, so
+// neither are WriteBufferSize and WriteScheduler.
+func (t Transport) WithConfig(opts smux.Options) (smux.Transport, error) {
+	if opts.WriteBufferSize != 0 || opts.WriteScheduler != "" {
+		return nil, smux.ErrNotSupported
+	}
+	if opts.ReceiveWindow != 0 && opts.ReceiveWindow < StreamWindow {
+		return nil, fmt.Errorf("websocket: ReceiveWindow (%d) is smaller than StreamWindow (%d)", opts.ReceiveWindow, StreamWindow)
+	}
+	if opts.MaxFrameSize > maxMessageSize-headerSize {
+		return nil, fmt.Errorf("websocket: MaxFrameSize (%d) is larger than %d", opts.MaxFrameSize, maxMessageSize-headerSize)
+	}
+	if opts.ReceiveWindow != 0 {
+		t.ReceiveWindow = opts.ReceiveWindow
+	}
+	if opts.MaxFrameSize != 0 {
+		t.MaxFrameSize = opts.MaxFrameSize
+	}
+	if opts.MaxStreams != 0 {
+		t.MaxStreams = opts.MaxStreams
+	}
+	if opts.KeepAliveInterval != 0 {
+		return smux.WithKeepAlive(t, opts.KeepAliveInterval, opts.KeepAliveFailures), nil
+	}
+	return t, nil
+}
+
+// NewConn runs the opening handshake over c in the background, so it does
+// not wait for the peer, and returns the muxed connection. Frames are
+// sent once the handshake is done; opening and accepting streams fail if
+// it failed.
+func (t Transport) NewConn(c net.Conn, isServer bool) (smux.Conn, error) {
+	pool := t.BufferPool
+	if pool == nil {
+		pool = smux.DefaultBufferPool
+	}
+	random := t.Rand
+	if random == nil {
+		random = rand.Reader
+	}
+	host := t.Host
+	if host == "" {
+		host = c.RemoteAddr().String()
+	}
+	br := bufio.NewReader(c)
+	conn := newConn(c, br, isServer, pool, random)
+	if t.ReceiveWindow > StreamWindow {
+		conn.window = int(t.ReceiveWindow)
+	}
+	if t.MaxFrameSize != 0 {
+		conn.maxPayload = int(t.MaxFrameSize)
+	}
+	conn.maxStreams = t.MaxStreams
+	if t.streamIDsLeft > 0 {
+		last := maxStreamID - 1 + conn.nextID%2
+		conn.nextID = last - 2*uint64(t.streamIDsLeft-1)
+	}
+	go func() {
+		var err error
+		if isServer {
+			err = serverHandshake(c, br)
+		} else {
+			err = clientHandshake(c, br, host, random)
+		}
+		if err != nil {
+			conn.handshakeErr = err
+			conn.shutdown(err)
+			c.Close()
+			close(conn.ready)
+			return
+		}
+		close(conn.ready)
+		conn.readLoop()
+	}()
+	return conn, nil
+}
+
+// Upgrade accepts the WebSocket upgrade request r received by an
+// http.Handler, and returns the muxed connection over the hijacked
+// connection, as its listening side.
+func Upgrade(w http.ResponseWriter, r *http.Request) (smux.Conn, error) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, smux.ErrNotSupported
+	}
+	c, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	if err := acceptUpgrade(c, r); err != nil {
+		c.Close()
+		return nil, err
+	}
+	conn := newConn(c, brw.Reader, true, smux.DefaultBufferPool, rand.Reader)
+	close(conn.ready)
+	go conn.readLoop()
+	return conn, nil
+}
+
+func newConn(c net.Conn, br *bufio.Reader, isServer bool, pool smux.BufferPool, random io.Reader) *conn {
+	conn := &conn{
+		ws:         &wsConn{c: c, br: br, client: !isServer, rand: random},
+		pool:       pool,
+		window:     StreamWindow,
+		maxPayload: maxPayload,
+		ready:      make(chan struct{}),
+		streams:    make(map[uint32]*stream),
+		nextID:     1,
+		wrote:      make(chan struct{}),
+		accept:     make(chan *stream, acceptBacklog),
+		closed:     make(chan struct{}),
+	}
+	conn.ws.pong = conn.pong
+	if isServer {
+		conn.nextID = 2
+	}
+	return conn
+}
+
+type conn struct {
+	ws           *wsConn
+	ready        chan struct{} // closed once the handshake is done
+	handshakeErr error         // why it failed, set before ready is closed
+	pool         smux.BufferPool
+
+	// window is the receive window of each stream, maxPayload the
+	// largest data payload sent, and maxStreams the streams open at
+	// once, of the Transport, zero being unlimited.
+	window     int
+	maxPayload int
+	maxStreams int
+
+	// openMu orders the open frames of the streams opened concurrently
+	// by ID, as the peer ignores those announced out of order.
+	openMu sync.Mutex
+
+	mu           sync.Mutex
+	streams      map[uint32]*stream
+	nextID       uint64 // past maxStreamID once the IDs are used up
+	lastPeerID   uint32 // of the last stream opened by the peer
+	isClosed     bool
+	closeErr     error // why the connection ended, for Wait
+	eventHandler func(smux.TraceEvent, smux.Stream)
+	pings        map[[8]byte]chan struct{} // closed once answered
+	pingSeq      uint64
+	pending      []*stream     // opened by the peer past the accept backlog
+	pendingRoom  chan struct{} // closed once pending drops below maxPending
+	writing      int           // Writes in progress, which CloseTimeout waits for
+	wrote        chan struct{} // closed and replaced when writing drops to 0
+
+	accept chan *stream
+	closed chan struct{}
+}
+
+// SetEventHandler registers h to be told when the writes of streams stall
+// on their send window, and resume.
+func (c *conn) SetEventHandler(h func(ev smux.TraceEvent, s smux.Stream)) {
+	c.mu.Lock()
+	c.eventHandler = h
+	c.mu.Unlock()
+}
+
+// event reports ev to the handler of SetEventHandler, if any. It must be
+// called without c.mu held.
+func (c *conn) event(ev smux.TraceEvent, s smux.Stream) {
+	c.mu.Lock()
+	h := c.eventHandler
+	c.mu.Unlock()
+	if h != nil {
+		h(ev, s)
+	}
+}
+
+// Close sends a close frame and closes the underlying net.Conn. The writes
+// of all streams fail with smux.ErrConnClosed, and so do reads once the
+// data already received is read.
+func (c *conn) Close() error {
+	return c.close(nil)
+}
+
+// CloseTimeout closes the connection like Close, but first waits up to
+// timeout for the Writes in progress on its streams, which the windows of
+// the peer may hold back, and then for the close frame to be sent.
+func (c *conn) CloseTimeout(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	c.waitWrites(deadline)
+	return c.closeBy(nil, deadline)
+}
+
+// Abort closes the connection and the net.Conn at once, without sending a
+// close frame. The writes of its streams fail with
+// smux.ErrConnClosed, and so do reads once the data already received is
+// read, while the peer sees the net.Conn end rather than the connection
+// close.
+func (c *conn) Abort() error {
+	if !c.shutdown(nil) {
+		return nil
+	}
+	return c.ws.c.Close()
+}
+
+// close closes the connection like Close, for the reason err.
+func (c *conn) close(err error) error {
+	return c.closeBy(err, time.Now().Add(closeTimeout))
+}
+
+// closeBy closes the connection for the reason err, giving up on sending
+// the close frame at deadline.
+func (c *conn) closeBy(err error, deadline time.Time) error {
+	if !c.shutdown(err) {
+		// the read loop may have closed the connection already, when the
+		// peer did.
+		return nil
+	}
+	select {
+	case <-c.ready:
+		c.ws.c.SetWriteDeadline(deadline)
+		// status 1000, normal closure.
+		c.ws.writeFrame(opClose, []byte{0x03, 0xe8})
+	default:
+	}
+	return c.ws.c.Close()
+}
+
+// startWrite and endWrite count the Writes in progress on the streams, which
+// CloseTimeout waits for.
+func (c *conn) startWrite() {
+	c.mu.Lock()
+	c.writing++
+	c.mu.Unlock()
+}
+
+func (c *conn) endWrite() {
+	c.mu.Lock()
+	c.writing--
+	if c.writing == 0 {
+		close(c.wrote)
+		c.wrote = make(chan struct{})
+	}
+	c.mu.Unlock()
+}
+
+// waitWrites waits for the Writes in progress to be done, or for the
+// connection to close or deadline to pass.
+func (c *conn) waitWrites(deadline time.Time) {
+	c.mu.Lock()
+	writing, wrote := c.writing, c.wrote
+	c.mu.Unlock()
+	if writing == 0 {
+		return
+	}
+	t := time.NewTimer(time.Until(deadline))
+	defer t.Stop()
+	select {
+	case <-wrote:
+	case <-c.closed:
+	case <-t.C:
+	}
+}
+
+// shutdown marks the connection closed, for the reason err, and fails its
+// streams. It returns false if the connection was closed already.
+func (c *conn) shutdown(err error) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.isClosed {
+		return false
+	}
+	c.isClosed = true
+	c.closeErr = err
+	close(c.closed)
+	for id, s := range c.streams {
+		s.broadcast()
+		delete(c.streams, id)
+	}
+	return true
+}
+
+// Wait waits for the connection to be closed, and returns why:
+// smux.ErrGoAway if the peer sent a close frame.
+func (c *conn) Wait() error {
+	<-c.closed
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closeErr
+}
+
+func (c *conn) IsClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Ping sends a WebSocket ping, and returns the time it took the peer to
+// answer it.
+func (c *conn) Ping() (time.Duration, error) {
+	c.mu.Lock()
+	if c.isClosed {
+		c.mu.Unlock()
+		return 0, smux.ErrConnClosed
+	}
+	if c.pings == nil {
+		c.pings = make(map[[8]byte]chan struct{})
+	}
+	c.pingSeq++
+	var data [8]byte
+	binary.BigEndian.PutUint64(data[:], c.pingSeq)
+	pong := make(chan struct{})
+	c.pings[data] = pong
+	c.mu.Unlock()
+
+	start := time.Now()
+	err := c.writeMessage(opPing, data[:])
+	if err == nil {
+		select {
+		case <-pong:
+			return time.Since(start), nil
+		case <-c.closed:
+			err = smux.ErrConnClosed
+		}
+	}
+	c.mu.Lock()
+	delete(c.pings, data)
+	c.mu.Unlock()
+	return 0, err
+}
+
+// pong records the answer of the peer to a ping of Ping.
+func (c *conn) pong(payload []byte) {
+	var data [8]byte
+	if len(payload) != len(data) {
+		return
+	}
+	copy(data[:], payload)
+	c.mu.Lock()
+	if pong, ok := c.pings[data]; ok {
+		close(pong)
+		delete(c.pings, data)
+	}
+	c.mu.Unlock()
+}
+
+// NumStreams returns the number of streams neither reset nor both closed
+// and read to EOF.
+func (c *conn) NumStreams() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.streams)
+}
+
+// NetConn returns the net.Conn the connection runs over, or was hijacked
+// by Upgrade.
+func (c *conn) NetConn() net.Conn {
+	return c.ws.c
+}
+
+// Handshake waits for the opening handshake, and returns why it failed.
+func (c *conn) Handshake() error {
+	<-c.ready
+	return c.handshakeErr
+}
+
+func (c *conn) OpenStream() (smux.Stream, error) {
+	c.openMu.Lock()
+	defer c.openMu.Unlock()
+	c.mu.Lock()
+	if c.isClosed {
+		c.mu.Unlock()
+		return nil, smux.ErrConnClosed
+	}
+	if c.maxStreams > 0 && len(c.streams) >= c.maxStreams {
+		c.mu.Unlock()
+		return nil, smux.ErrTooManyStreams
+	}
+	if c.nextID > maxStreamID {
+		c.mu.Unlock()
+		return nil, smux.ErrTooManyStreams
+	}
+	s := c.newStream(uint32(c.nextID))
+	c.nextID += 2
+	c.mu.Unlock()
+
+	if err := c.writeFrame(s.id, typeOpen, nil); err != nil {
+		c.mu.Lock()
+		delete(c.streams, s.id)
+		c.mu.Unlock()
+		return nil, err
+	}
+	c.growWindow(s.id)
+	return s, nil
+}
+
+func (c *conn) AcceptStream() (smux.Stream, error) {
+	select {
+	case s := <-c.accept:
+		return c.accepted(s)
+	case <-c.closed:
+		return nil, smux.ErrConnClosed
+	}
+}
+
+// AcceptStreamContext accepts a stream like AcceptStream, until ctx is
+// done.
+func (c *conn) AcceptStreamContext(ctx context.Context) (smux.Stream, error) {
+	select {
+	case s := <-c.accept:
+		return c.accepted(s)
+	case <-c.closed:
+		return nil, smux.ErrConnClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// accepted returns s, a stream taken from the backlog, unless the
+// connection was closed meanwhile, as select picks either, which already
+// failed s.
+func (c *conn) accepted(s *stream) (smux.Stream, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.isClosed {
+		return nil, smux.ErrConnClosed
+	}
+	return s, nil
+}
+
+// newStream registers a new stream. It must be called with c.mu held.
+func (c *conn) newStream(id uint32) *stream {
+	s := &stream{
+		conn:       c,
+		id:         id,
+		changed:    make(chan struct{}),
+		sendWindow: StreamWindow,
+		recvWindow: c.window,
+		window:     c.window,
+	}
+	c.streams[id] = s
+	return s
+}
+
+// writeFrame sends a frame of the muxer once the handshake is done. A
+// failed write closes the connection and returns smux.ErrConnClosed.
+func (c *conn) writeFrame(id uint32, typ byte, payload []byte) error {
+	msg := c.pool.Get(headerSize + len(payload))
+	defer c.pool.Put(msg)
+	binary.BigEndian.PutUint32(msg, id)
+	msg[4] = typ
+	copy(msg[headerSize:], payload)
+	return c.writeMessage(opBinary, msg)
+}
+
+// writeMessage sends a WebSocket frame of op once the handshake is done,
+// like writeFrame.
+func (c *conn) writeMessage(op byte, payload []byte) error {
+	select {
+	case <-c.ready:
+	case <-c.closed:
+		return smux.ErrConnClosed
+	}
+	if err := c.ws.writeFrame(op, payload); err != nil {
+		c.shutdown(err)
+		c.ws.c.Close()
+		return smux.ErrConnClosed
+	}
+	return nil
+}
+
+// writeWindow gives the peer n more bytes of send window on stream id.
+func (c *conn) writeWindow(id uint32, n int) {
+	var inc [4]byte
+	binary.BigEndian.PutUint32(inc[:], uint32(n))
+	c.writeFrame(id, typeWindow, inc[:])
+}
+
+// growWindow grants the peer the receive window of stream id past the
+// StreamWindow it starts with.
+func (c *conn) growWindow(id uint32) {
+	if c.window > StreamWindow {
+		c.writeWindow(id, c.window-StreamWindow)
+	}
+}
+
+func (c *conn) readLoop() {
+	var err error
+	defer func() { c.close(err) }()
+
+	var msg []byte
+	for {
+		var op byte
+		var m []byte
+		op, m, err = c.ws.readMessage(msg)
+		if err == errCloseFrame {
+			err = smux.ErrGoAway
+		}
+		if err != nil {
+			return
+		}
+		msg = m
+		if op != opBinary || len(m) < headerSize {
+			continue
+		}
+		if !c.handleFrame(binary.BigEndian.Uint32(m), m[4], m[headerSize:]) {
+			return
+		}
+	}
+}
+
+// queueAccept hands s, just opened by the peer, to AcceptStream. Past the
+// backlog, s waits in c.pending, which feedAccept moves to the backlog as
+// streams are accepted, so that a full backlog does not stop the read loop
+// and the streams already open keep flowing. Once c.pending holds
+// maxPending streams, queueAccept waits for room, stopping the read loop
+// until the application accepts.
+func (c *conn) queueAccept(s *stream) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.pending) == 0 {
+		select {
+		case c.accept <- s:
+			return
+		default:
+		}
+	}
+	c.pending = append(c.pending, s)
+	if len(c.pending) == 1 {
+		go c.feedAccept()
+	}
+	if len(c.pending) < maxPending {
+		return
+	}
+	room := make(chan struct{})
+	c.pendingRoom = room
+	c.mu.Unlock()
+	select {
+	case <-room:
+	case <-c.closed:
+	}
+	c.mu.Lock()
+}
+
+// feedAccept moves the streams of c.pending to the backlog, in order, until
+// none is left or the connection closes.
+func (c *conn) feedAccept() {
+	c.mu.Lock()
+	for len(c.pending) > 0 {
+		s := c.pending[0]
+		c.mu.Unlock()
+		select {
+		case c.accept <- s:
+		case <-c.closed:
+			return
+		}
+		c.mu.Lock()
+		c.pending[0] = nil
+		c.pending = c.pending[1:]
+		if c.pendingRoom != nil {
+			close(c.pendingRoom)
+			c.pendingRoom = nil
+		}
+	}
+	c.mu.Unlock()
+}
+
+// handleFrame processes a frame read from the peer, and returns false if
+// the connection must be closed.
+func (c *conn) handleFrame(id uint32, typ byte, payload []byte) bool {
+	c.mu.Lock()
+	s, ok := c.streams[id]
+	switch typ {
+	case typeOpen:
+		// the IDs only ever increase, so that a stream already forgotten
+		// is not opened again.
+		if ok || uint64(id)%2 == c.nextID%2 || id <= c.lastPeerID || c.isClosed {
+			c.mu.Unlock()
+			return true
+		}
+		c.lastPeerID = id
+		if c.maxStreams > 0 && len(c.streams) >= c.maxStreams {
+			c.mu.Unlock()
+			return c.writeFrame(id, typeReset, nil) == nil
+		}
+		s = c.newStream(id)
+		c.mu.Unlock()
+		c.growWindow(id)
+		c.queueAccept(s)
+		return true
+
+	case typeData:
+		switch {
+		case !ok || s.recvEOF:
+		case len(payload) > s.recvWindow:
+			s.reset(smux.ErrReset)
+			c.mu.Unlock()
+			c.writeFrame(id, typeReset, nil)
+			return true
+		default:
+			s.recvWindow -= len(payload)
+			s.queue(payload)
+			s.broadcast()
+		}
+
+	case typeClose:
+		if ok {
+			s.remoteEnd()
+		}
+
+	case typeReset:
+		if ok {
+			var err error = smux.ErrReset
+			if len(payload) == 4 {
+				err = smux.StreamError{Code: binary.BigEndian.Uint32(payload)}
+			}
+			s.reset(err)
+		}
+
+	case typeWindow:
+		if ok && len(payload) == 4 {
+			s.sendWindow += int64(binary.BigEndian.Uint32(payload))
+			s.broadcast()
+		}
+	}
+	c.mu.Unlock()
+	return true
+}
@@ -0,0 +1,12 @@
+package websocket_test
+
+import (
+	"testing"
+
+	sm "github.com/dms3-p2p/go-stream-muxer/test"
+	"github.com/dms3-p2p/go-stream-muxer/websocket"
+)
+
+func TestNodeInterop(t *testing.T) {
+	sm.SubtestNodeInterop(t, websocket.DefaultTransport, websocket.ReferenceScript())
+}
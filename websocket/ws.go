@@ -0,0 +1,264 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// The RFC 6455 framing, of which the muxer uses binary messages, close,
+// ping and pong frames. Messages are not compressed.
+const (
+	opContinuation = 0x0
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+
+	finBit  = 0x80
+	maskBit = 0x80
+
+	// keyGUID is appended to Sec-WebSocket-Key to compute
+	// Sec-WebSocket-Accept.
+	keyGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	// maxMessageSize bounds the size of the messages read, which the
+	// frames of the muxer never come close to.
+	maxMessageSize = 1 << 20
+)
+
+// ErrBadHandshake is returned when the peer's opening handshake is not a
+// WebSocket upgrade for the Subprotocol.
+var ErrBadHandshake = errors.New("websocket: bad handshake")
+
+// errMessageTooLarge is returned when reading a message over
+// maxMessageSize.
+var errMessageTooLarge = errors.New("websocket: message too large")
+
+// errCloseFrame is returned when reading a close frame.
+var errCloseFrame = errors.New("websocket: close frame received")
+
+func acceptKey(key string) string {
+	h := sha1.New()
+	io.WriteString(h, key+keyGUID)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// clientHandshake sends an upgrade request for the Subprotocol over c and
+// reads the response.
+func clientHandshake(c net.Conn, br *bufio.Reader, host string, random io.Reader) error {
+	var nonce [16]byte
+	if _, err := io.ReadFull(random, nonce[:]); err != nil {
+		return err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	req := "GET / HTTP/1.1\r\n" +
+		"Host: " + host + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Protocol: " + Subprotocol + "\r\n\r\n"
+	if _, err := io.WriteString(c, req); err != nil {
+		return err
+	}
+
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		!headerContains(resp.Header, "Upgrade", "websocket") ||
+		resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		return ErrBadHandshake
+	}
+	return nil
+}
+
+// serverHandshake reads an upgrade request from br and accepts it over c.
+func serverHandshake(c net.Conn, br *bufio.Reader) error {
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return err
+	}
+	if req.ProtoMajor != 1 {
+		// not an HTTP/1 client, such as an HTTP/2 one sending its
+		// preface, which would not understand the answer.
+		return ErrBadHandshake
+	}
+	return acceptUpgrade(c, req)
+}
+
+// acceptUpgrade answers req, an upgrade request read from c.
+func acceptUpgrade(c io.Writer, req *http.Request) error {
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if req.Method != "GET" || key == "" ||
+		!headerContains(req.Header, "Upgrade", "websocket") ||
+		!headerContains(req.Header, "Connection", "upgrade") ||
+		!headerContains(req.Header, "Sec-WebSocket-Protocol", Subprotocol) {
+		io.WriteString(c, "HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n")
+		return ErrBadHandshake
+	}
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n" +
+		"Sec-WebSocket-Protocol: " + Subprotocol + "\r\n\r\n"
+	_, err := io.WriteString(c, resp)
+	return err
+}
+
+// wsConn reads and writes WebSocket frames.
+type wsConn struct {
+	c      net.Conn
+	br     *bufio.Reader
+	client bool      // clients mask the frames they send
+	rand   io.Reader // the source of the masking keys
+
+	// pong is called with the payload of the pongs read, if set.
+	pong func(payload []byte)
+
+	wmu  sync.Mutex
+	wbuf []byte
+}
+
+// writeFrame writes payload in a single frame.
+func (w *wsConn) writeFrame(op byte, payload []byte) error {
+	w.wmu.Lock()
+	defer w.wmu.Unlock()
+
+	b := append(w.wbuf[:0], finBit|op)
+	var mask byte
+	if w.client {
+		mask = maskBit
+	}
+	switch n := len(payload); {
+	case n < 126:
+		b = append(b, mask|byte(n))
+	case n <= 0xffff:
+		b = append(b, mask|126, byte(n>>8), byte(n))
+	default:
+		b = append(b, mask|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(b[len(b)-8:], uint64(n))
+	}
+	if w.client {
+		var key [4]byte
+		if _, err := io.ReadFull(w.rand, key[:]); err != nil {
+			return err
+		}
+		b = append(b, key[:]...)
+		start := len(b)
+		b = append(b, payload...)
+		unmask(b[start:], key)
+	} else {
+		b = append(b, payload...)
+	}
+	w.wbuf = b
+	_, err := w.c.Write(b)
+	return err
+}
+
+// readMessage reads the next data message into msg, answering pings on
+// the way, and returns errCloseFrame once the peer sends a close frame. It is not
+// safe for concurrent use.
+func (w *wsConn) readMessage(msg []byte) (byte, []byte, error) {
+	msg = msg[:0]
+	var msgOp byte
+	for {
+		var hdr [2]byte
+		if _, err := io.ReadFull(w.br, hdr[:]); err != nil {
+			return 0, nil, err
+		}
+		fin, op := hdr[0]&finBit != 0, hdr[0]&0x0f
+		size := uint64(hdr[1] &^ maskBit)
+		switch size {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(w.br, ext[:]); err != nil {
+				return 0, nil, err
+			}
+			size = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(w.br, ext[:]); err != nil {
+				return 0, nil, err
+			}
+			size = binary.BigEndian.Uint64(ext[:])
+		}
+		var key [4]byte
+		masked := hdr[1]&maskBit != 0
+		if masked {
+			if _, err := io.ReadFull(w.br, key[:]); err != nil {
+				return 0, nil, err
+			}
+		}
+		if size > uint64(maxMessageSize-len(msg)) {
+			return 0, nil, errMessageTooLarge
+		}
+
+		if op >= opClose {
+			// control frames are never fragmented, and may arrive
+			// between the fragments of a message.
+			payload := make([]byte, size)
+			if _, err := io.ReadFull(w.br, payload); err != nil {
+				return 0, nil, err
+			}
+			if masked {
+				unmask(payload, key)
+			}
+			switch op {
+			case opPing:
+				if err := w.writeFrame(opPong, payload); err != nil {
+					return 0, nil, err
+				}
+			case opPong:
+				if w.pong != nil {
+					w.pong(payload)
+				}
+			case opClose:
+				return 0, nil, errCloseFrame
+			}
+			continue
+		}
+
+		if op != opContinuation {
+			msgOp = op
+		}
+		start := len(msg)
+		msg = append(msg, make([]byte, size)...)
+		if _, err := io.ReadFull(w.br, msg[start:]); err != nil {
+			return 0, nil, err
+		}
+		if masked {
+			unmask(msg[start:], key)
+		}
+		if fin {
+			return msgOp, msg, nil
+		}
+	}
+}
+
+func unmask(b []byte, key [4]byte) {
+	for i := range b {
+		b[i] ^= key[i%4]
+	}
+}